@@ -2,9 +2,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
@@ -19,15 +20,27 @@ import (
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/config"
 	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/throttle"
 	"github.com/asjoyner/shade/fusefs"
-	"github.com/golang/glog"
+	"github.com/asjoyner/shade/logging"
+	"github.com/asjoyner/shade/metrics"
 
 	_ "github.com/asjoyner/shade/drive/amazon"
 	_ "github.com/asjoyner/shade/drive/cache"
+	_ "github.com/asjoyner/shade/drive/compress"
 	_ "github.com/asjoyner/shade/drive/encrypt"
+	_ "github.com/asjoyner/shade/drive/flaky"
 	_ "github.com/asjoyner/shade/drive/google"
+	_ "github.com/asjoyner/shade/drive/listcache"
 	_ "github.com/asjoyner/shade/drive/local"
 	_ "github.com/asjoyner/shade/drive/memory"
+	_ "github.com/asjoyner/shade/drive/namespace"
+	_ "github.com/asjoyner/shade/drive/overlay"
+	_ "github.com/asjoyner/shade/drive/refcount"
+	_ "github.com/asjoyner/shade/drive/split"
+	_ "github.com/asjoyner/shade/drive/stripe"
+	_ "github.com/asjoyner/shade/drive/tar"
+	_ "github.com/asjoyner/shade/drive/writeback"
 )
 
 var (
@@ -38,6 +51,16 @@ var (
 	configFile = flag.String("config", defaultConfig, fmt.Sprintf("The shade config file. Defaults to %q", defaultConfig))
 	treeDebug  = flag.Bool("treeDebug", false, "Print Node tree debugging traces")
 	port       = flag.Int("port", 33247, "HTTP port to listen on (exposes debug and monitoring handlers).")
+
+	// The kernel reads ahead of the application by up to maxReadahead bytes.
+	// Reading past the first tenth of a chunk prefetches the following chunks
+	// (see fusefs), so values much beyond fusefs.DefaultChunkSizeBytes mostly
+	// cost memory.
+	maxReadahead   = flag.Int("maxReadahead", 64*1024*1024, "The maximum number of bytes the kernel may read ahead of the application.")
+	writebackCache = flag.Bool("writebackCache", true, "Allow the kernel to cache writes, and send them to shade in larger requests.")
+
+	downloadBytesPerSec = flag.Int("downloadBytesPerSec", 0, "The maximum number of bytes per second to read from storage (0 is unlimited).")
+	uploadBytesPerSec   = flag.Int("uploadBytesPerSec", 0, "The maximum number of bytes per second to write to storage (0 is unlimited).")
 )
 
 func main() {
@@ -48,34 +71,54 @@ func main() {
 		usage()
 		os.Exit(2)
 	}
+	fuse.Debug = fusefs.DebugFuse
 
 	// initialize the webserver
-	go func() { log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil)) }()
+	http.Handle("/metrics", metrics.Handler())
+	go func() { logging.Exit(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil)) }()
 
 	// read in the config
 	config, err := config.Read(*configFile)
 	if err != nil {
-		log.Fatalf("could not read configuration: %s\n", err)
+		logging.Exitf("could not read configuration: %s", err)
 	}
 
 	// initialize client
 	client, err := drive.NewClient(config)
 	if err != nil {
-		log.Fatalf("could not initialize client: %s\n", err)
+		logging.Exitf("could not initialize client: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	if err := client.Ping(ctx); err != nil {
+		logging.Exitf("could not reach storage backend %q: %s", config.Provider, err)
+	}
+	cancel()
+	client = throttle.Wrap(client, throttle.NewLimiter(*uploadBytesPerSec), throttle.NewLimiter(*downloadBytesPerSec))
+
+	// A view of the past is read only, as files written to it would be newer
+	// than -asOf, and vanish from it.
+	if at, err := fusefs.AsOf(); err != nil {
+		logging.Exit(err)
+	} else if !at.IsZero() {
+		logging.Infof("Presenting the files as of %s, read only", at)
+		*readOnly = true
 	}
 
 	// Setup fuse FS
 	conn, err := mountFuse(flag.Arg(0))
 	if err != nil {
-		log.Fatalf("failed to mount: %s", err)
+		logging.Exitf("failed to mount: %s", err)
 	}
 	fmt.Printf("Mounting Shade FuseFS at %s...\n", flag.Arg(0))
 
-	if err := serviceFuse(conn, client); err != nil {
-		log.Fatalf("failed to service mount: %s", err)
+	if err := serviceFuse(conn, client, flag.Arg(0)); err != nil {
+		logging.Exitf("failed to service mount: %s", err)
+	}
+	if err := drive.Close(client); err != nil {
+		logging.Exitf("failed to flush writes to storage: %s", err)
 	}
 
-	glog.Flush()
+	logging.Flush()
 	return
 }
 
@@ -90,50 +133,78 @@ func mountFuse(mountPoint string) (*fuse.Conn, error) {
 		return nil, fmt.Errorf("sanityCheck failed: %s", err)
 	}
 
+	options, err := mountOptions(mountSettings{
+		maxReadahead:   *maxReadahead,
+		writebackCache: *writebackCache,
+		allowOther:     *allowOther,
+		readOnly:       *readOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c, err := fuse.Mount(mountPoint, options...)
+	if err != nil {
+		fmt.Println("Is the mount point busy?")
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// mountSettings are the tunable options of the fuse mount.
+type mountSettings struct {
+	maxReadahead   int // in bytes
+	writebackCache bool
+	allowOther     bool
+	readOnly       bool
+}
+
+// mountOptions returns the options to pass to fuse.Mount, or an error if the
+// settings are invalid.
+func mountOptions(s mountSettings) ([]fuse.MountOption, error) {
+	if s.maxReadahead < 0 || int64(s.maxReadahead) > math.MaxUint32 {
+		return nil, fmt.Errorf("invalid -maxReadahead: %d", s.maxReadahead)
+	}
 	options := []fuse.MountOption{
 		fuse.FSName("Shade"),
-		fuse.MaxReadahead(64 * 1024 * 1024), // in bytes
+		fuse.MaxReadahead(uint32(s.maxReadahead)),
 		fuse.AsyncRead(),
-		fuse.WritebackCache(),
 	}
-
-	if *allowOther {
+	if s.writebackCache {
+		options = append(options, fuse.WritebackCache())
+	}
+	if s.allowOther {
 		options = append(options, fuse.AllowOther())
 	}
-	if *readOnly {
+	if s.readOnly {
 		options = append(options, fuse.ReadOnly())
 	}
 	options = append(options, fuse.NoAppleDouble())
-	c, err := fuse.Mount(mountPoint, options...)
+	return options, nil
+}
+
+// serviceFuse initializes fusefs, the shade implementation of a fuse file
+// server, and services requests from the fuse kernel filesystem until it is
+// unmounted.
+func serviceFuse(conn *fuse.Conn, client drive.Client, mountPoint string) error {
+	refresh := time.NewTicker(5 * time.Minute)
+	ffs, err := fusefs.New(client, conn, refresh)
 	if err != nil {
-		fmt.Println("Is the mount point busy?")
-		return nil, err
+		return fmt.Errorf("fuse server initialization failed: %s", err)
 	}
 
-	// Trap control-c (sig INT) and unmount
+	// Trap control-c (sig INT), flush files which are still open, and unmount
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
 	go func() {
 		for range sig {
+			ffs.Shutdown()
 			if err := fuse.Unmount(mountPoint); err != nil {
-				log.Printf("fuse.Unmount failed: %v", err)
+				logging.Warningf("fuse.Unmount failed: %v", err)
 			}
 		}
 	}()
 
-	return c, nil
-}
-
-// serviceFuse initializes fusefs, the shade implementation of a fuse file
-// server, and services requests from the fuse kernel filesystem until it is
-// unmounted.
-func serviceFuse(conn *fuse.Conn, client drive.Client) error {
-	refresh := time.NewTicker(5 * time.Minute)
-	ffs, err := fusefs.New(client, conn, refresh)
-	if err != nil {
-		return fmt.Errorf("fuse server initialization failed: %s", err)
-	}
-
 	http.HandleFunc("/refresh", func(w http.ResponseWriter, r *http.Request) {
 		ffs.Refresh()
 		fmt.Fprintf(w, "Ok")
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestMountOptions(t *testing.T) {
+	// FSName, MaxReadahead, AsyncRead and NoAppleDouble are always set.
+	const always = 4
+	testCases := []struct {
+		s       mountSettings
+		want    int
+		wantErr bool
+	}{
+		{s: mountSettings{maxReadahead: 64 * 1024 * 1024}, want: always},
+		{s: mountSettings{maxReadahead: 0, writebackCache: true}, want: always + 1},
+		{s: mountSettings{maxReadahead: 1024, writebackCache: true, allowOther: true, readOnly: true}, want: always + 3},
+		{s: mountSettings{maxReadahead: 1024, readOnly: true}, want: always + 1},
+		{s: mountSettings{maxReadahead: -1}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		options, err := mountOptions(tc.s)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("mountOptions(%+v) succeeded, want error", tc.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("mountOptions(%+v): %s", tc.s, err)
+			continue
+		}
+		if len(options) != tc.want {
+			t.Errorf("mountOptions(%+v): want %d options, got: %d", tc.s, tc.want, len(options))
+		}
+	}
+}
@@ -2,14 +2,18 @@ package cat
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/config"
 	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/fusefs"
 
 	"github.com/google/subcommands"
 )
@@ -19,26 +23,47 @@ func init() {
 }
 
 type catCmd struct {
-	long bool
+	long     bool
+	parallel int
+	sum      string
+	offset   int64
+	length   int64
 }
 
 func (*catCmd) Name() string     { return "cat" }
 func (*catCmd) Synopsis() string { return "List files in the respository." }
 func (*catCmd) Usage() string {
 	return `cat <FILE>:
-  Print the named file to STDOUT.
+  Print the named file to STDOUT.  Each file object in the repository is
+  fetched until one with the name is found.
+
+cat -sum <SUM>:
+  Print the file whose object has the hex encoded SUM, as printed by
+  "ls -l", to STDOUT.  Only that file object is fetched.
+
+With -offset and -length, only that range of bytes of the file is printed,
+and only the chunks which hold it are fetched.  Nothing is printed for an
+offset at or beyond the end of the file.
 `
 }
-func (*catCmd) SetFlags(f *flag.FlagSet) { return }
+func (p *catCmd) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&p.parallel, "parallel", 4, "The number of chunks to fetch concurrently.")
+	f.StringVar(&p.sum, "sum", "", "The hex encoded sum of the file object to print, instead of a name.")
+	f.Int64Var(&p.offset, "offset", 0, "The offset of the first byte of the file to print.")
+	f.Int64Var(&p.length, "length", -1, "The number of bytes of the file to print (-1 prints to the end).")
+}
 
 func (p *catCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
 	// parse the filename
 	configPath := args[0].(*string)
-	if f.NArg() != 1 {
-		fmt.Printf("unexpected number of arguments to cat; want: 1, got: %d\n", f.NArg())
+	want := 1
+	if p.sum != "" {
+		want = 0
+	}
+	if f.NArg() != want {
+		fmt.Printf("unexpected number of arguments to cat; want: %d, got: %d\n", want, f.NArg())
 		return subcommands.ExitFailure
 	}
-	filename := f.Arg(0)
 
 	// read in the config
 	config, err := config.Read(*configPath)
@@ -54,39 +79,197 @@ func (p *catCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}
 		return subcommands.ExitFailure
 	}
 
-	lfm, err := client.ListFiles()
+	var file *shade.File
+	if p.sum != "" {
+		sum, err := hex.DecodeString(p.sum)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid sum %q: %s\n", p.sum, err)
+			return subcommands.ExitFailure
+		}
+		file, err = fileBySum(client, sum)
+	} else {
+		file, err = fileByName(client, f.Arg(0))
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not get files: %v\n", err)
+		fmt.Fprintln(os.Stderr, err)
 		return subcommands.ExitFailure
 	}
+	if p.offset != 0 || p.length != -1 {
+		err = WriteRange(os.Stdout, client, file, p.offset, p.length, p.parallel)
+	} else {
+		err = WriteFileParallel(os.Stdout, client, file, p.parallel)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// fileBySum fetches the file object with the given sum from client.
+func fileBySum(client drive.Client, sha256sum []byte) (*shade.File, error) {
+	fileJSON, err := client.GetFile(sha256sum)
+	if err != nil {
+		return nil, fmt.Errorf("could not get file %x: %v", sha256sum, err)
+	}
 	file := &shade.File{}
+	if err := json.Unmarshal(fileJSON, file); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal: %v", err)
+	}
+	return file, nil
+}
+
+// fileByName fetches file objects from client until it finds one named
+// filename.
+func fileByName(client drive.Client, filename string) (*shade.File, error) {
+	lfm, err := client.ListFiles()
+	if err != nil {
+		return nil, fmt.Errorf("could not get files: %v", err)
+	}
 	for _, sha256sum := range lfm {
-		fileJSON, err := client.GetFile(sha256sum)
+		file, err := fileBySum(client, sha256sum)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "could not get file %q: %v\n", sha256sum, err)
+			fmt.Fprintln(os.Stderr, err)
 			continue
 		}
-		err = json.Unmarshal(fileJSON, file)
-		if err != nil {
-			fmt.Printf("failed to unmarshal: %v\n", err)
-			continue
+		if file.Filename == filename {
+			return file, nil
 		}
-		if file.Filename != filename {
-			continue
+	}
+	return nil, fmt.Errorf("no such file: %v", filename)
+}
+
+// WriteFile writes the contents of file to w, by fetching each of its chunks
+// from client in Index order.
+func WriteFile(w io.Writer, client drive.Client, file *shade.File) error {
+	return WriteFileParallel(w, client, file, 1)
+}
+
+// fetched is the result of fetching a chunk.
+type fetched struct {
+	chunk []byte
+	err   error
+}
+
+// WriteFileParallel is WriteFile, but fetches up to parallel chunks from
+// client concurrently, after passing all of their sums to client.Warm.  The
+// chunks are still written to w in Index order, so at most parallel chunks
+// are held in memory.  It returns at the first error, abandoning the chunks
+// which are still being fetched.
+func WriteFileParallel(w io.Writer, client drive.Client, file *shade.File, parallel int) error {
+	chunks := sortedChunks(file)
+	reads := make([]chunkRead, len(chunks))
+	for i, chunk := range chunks {
+		reads[i] = chunkRead{sum: chunk.Sha256, length: -1}
+	}
+	return writeChunks(w, client, file, reads, parallel)
+}
+
+// WriteRange is WriteFileParallel, but writes only the length bytes of file
+// starting at offset, or fewer if the file ends first.  A length of -1 writes
+// to the end of the file.  Only the chunks which hold the range are fetched,
+// and only the needed part of each if client implements drive.RangeGetter.
+// Nothing is written if offset is at or beyond the end of the file.
+func WriteRange(w io.Writer, client drive.Client, file *shade.File, offset, length int64, parallel int) error {
+	if offset < 0 || length < -1 {
+		return fmt.Errorf("invalid range of %d bytes at offset %d", length, offset)
+	}
+	if offset >= file.Filesize || length == 0 {
+		return nil
+	}
+	if length == -1 || length > file.Filesize-offset {
+		length = file.Filesize - offset
+	}
+	sorted := *file
+	sorted.Chunks = sortedChunks(file)
+	sums, err := fusefs.ChunksForRead(&sorted, offset, length)
+	if err != nil {
+		return err
+	}
+	reads := make([]chunkRead, len(sums))
+	low := offset % int64(file.Chunksize) // the offset within the first chunk
+	for i, sum := range sums {
+		want := int64(file.Chunksize) - low
+		if want > length {
+			want = length
 		}
-		for _, chunk := range file.Chunks {
-			c, err := client.GetChunk(chunk.Sha256, file)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "could not get chunk %x of file: %v\n", chunk.Sha256, err)
-				return subcommands.ExitFailure
-			}
-			if _, err := os.Stdout.Write(c); err != nil {
-				fmt.Fprintf(os.Stderr, "could not write to stdout: %v\n", err)
-				return subcommands.ExitFailure
+		reads[i] = chunkRead{sum: sum, offset: low, length: want}
+		length -= want
+		low = 0
+	}
+	return writeChunks(w, client, file, reads, parallel)
+}
+
+// sortedChunks returns a copy of the Chunks of file, in Index order.
+func sortedChunks(file *shade.File) []shade.Chunk {
+	chunks := make([]shade.Chunk, len(file.Chunks))
+	copy(chunks, file.Chunks)
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Index < chunks[j].Index })
+	return chunks
+}
+
+// chunkRead describes the part of a chunk to write.
+type chunkRead struct {
+	sum    []byte
+	offset int64
+	length int64 // -1 is the whole chunk
+}
+
+// get fetches the part of the chunk described by r from client.
+func (r chunkRead) get(client drive.Client, file *shade.File) ([]byte, error) {
+	if r.length == -1 {
+		return client.GetChunk(r.sum, file)
+	}
+	return drive.GetChunkRange(client, r.sum, file, r.offset, r.length)
+}
+
+// writeChunks writes each of reads to w, in order, fetching up to parallel
+// of them from client concurrently.
+func writeChunks(w io.Writer, client drive.Client, file *shade.File, reads []chunkRead, parallel int) error {
+	if parallel < 1 {
+		return fmt.Errorf("parallel must be at least 1, not %d", parallel)
+	}
+	// Let remote clients look up all of the chunks in a batch, rather than
+	// one at a time as they are fetched.
+	sums := make([][]byte, len(reads))
+	for i, r := range reads {
+		sums[i] = r.sum
+	}
+	client.Warm(sums, file)
+
+	// results reorders the chunks; each is buffered, so fetches never block.
+	results := make([]chan fetched, len(reads))
+	for i := range results {
+		results[i] = make(chan fetched, 1)
+	}
+	// A slot is taken before fetching each chunk, and returned after it is
+	// written.
+	slots := make(chan struct{}, parallel)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i, r := range reads {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
 			}
+			go func(i int, r chunkRead) {
+				c, err := r.get(client, file)
+				results[i] <- fetched{c, err}
+			}(i, r)
+		}
+	}()
+
+	for i, read := range reads {
+		r := <-results[i]
+		if r.err != nil {
+			return drive.NewMissingChunkError(read.sum, file, r.err)
+		}
+		if _, err := w.Write(r.chunk); err != nil {
+			return fmt.Errorf("could not write: %v", err)
 		}
-		return subcommands.ExitSuccess
+		<-slots
 	}
-	fmt.Fprintf(os.Stderr, "no such file: %v\n", filename)
-	return subcommands.ExitFailure
+	return nil
 }
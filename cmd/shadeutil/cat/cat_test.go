@@ -0,0 +1,289 @@
+package cat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+func TestWriteFile(t *testing.T) {
+	client, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := shade.NewFileWithChunksize("partial", 4)
+	for i, c := range []string{"efgh", "abcd"} {
+		if err := client.PutChunk(shade.Sum([]byte(c)), []byte(c), f); err != nil {
+			t.Fatal(err)
+		}
+		f.Chunks = append(f.Chunks, shade.Chunk{Index: 1 - i, Sha256: shade.Sum([]byte(c))})
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteFile(buf, client, f); err != nil {
+		t.Fatalf("WriteFile(): %s", err)
+	}
+	if buf.String() != "abcdefgh" {
+		t.Errorf("want %q, got: %q", "abcdefgh", buf.String())
+	}
+
+	missing := shade.Sum([]byte("ijkl"))
+	f.Chunks = append(f.Chunks, shade.Chunk{Index: 2, Sha256: missing})
+	err = WriteFile(&bytes.Buffer{}, client, f)
+	var mce *drive.MissingChunkError
+	if !errors.As(err, &mce) {
+		t.Fatalf("want a MissingChunkError, got: %v", err)
+	}
+	if !bytes.Equal(mce.Sum, missing) || mce.Filename != "partial" {
+		t.Errorf("want missing chunk %x of partial, got: %x of %s", missing, mce.Sum, mce.Filename)
+	}
+}
+
+// latentClient delays each GetChunk, so that chunks with a higher delay
+// return after those requested later.
+type latentClient struct {
+	drive.Client
+	delay map[string]time.Duration
+
+	mu      sync.Mutex
+	active  int // GetChunk calls in progress
+	maxSeen int // the most GetChunk calls seen in progress at once
+}
+
+func (c *latentClient) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	c.mu.Lock()
+	c.active++
+	if c.active > c.maxSeen {
+		c.maxSeen = c.active
+	}
+	c.mu.Unlock()
+	time.Sleep(c.delay[string(sha256sum)])
+	c.mu.Lock()
+	c.active--
+	c.mu.Unlock()
+	return c.Client.GetChunk(sha256sum, f)
+}
+
+func TestWriteFileParallel(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &latentClient{Client: mc, delay: make(map[string]time.Duration)}
+	f := shade.NewFileWithChunksize("parallel", 3)
+	n := 20
+	for i := 0; i < n; i++ {
+		c := []byte(fmt.Sprintf("%03d", i))
+		sum := shade.Sum(c)
+		if err := mc.PutChunk(sum, c, f); err != nil {
+			t.Fatal(err)
+		}
+		// Earlier chunks are slower, so they complete out of order.
+		client.delay[string(sum)] = time.Duration(n-i) * time.Millisecond
+		f.Chunks = append(f.Chunks, shade.Chunk{Index: i, Sha256: sum})
+	}
+	// Index order, not the order of f.Chunks, determines the output.
+	f.Chunks[0], f.Chunks[n-1] = f.Chunks[n-1], f.Chunks[0]
+
+	sequential := &bytes.Buffer{}
+	if err := WriteFile(sequential, client, f); err != nil {
+		t.Fatalf("WriteFile(): %s", err)
+	}
+	if client.maxSeen != 1 {
+		t.Errorf("WriteFile() fetched %d chunks at once, want 1", client.maxSeen)
+	}
+	parallel := &bytes.Buffer{}
+	client.maxSeen = 0
+	if err := WriteFileParallel(parallel, client, f, 8); err != nil {
+		t.Fatalf("WriteFileParallel(): %s", err)
+	}
+	if client.maxSeen < 2 || client.maxSeen > 8 {
+		t.Errorf("WriteFileParallel(8) fetched %d chunks at once", client.maxSeen)
+	}
+
+	var want bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&want, "%03d", i)
+	}
+	if sequential.String() != want.String() {
+		t.Errorf("sequential output: want %q, got: %q", want.String(), sequential.String())
+	}
+	if parallel.String() != sequential.String() {
+		t.Errorf("parallel output differs from sequential: %q", parallel.String())
+	}
+
+	missing := shade.Sum([]byte("absent"))
+	f.Chunks = append(f.Chunks, shade.Chunk{Index: n, Sha256: missing})
+	var mce *drive.MissingChunkError
+	if err := WriteFileParallel(&bytes.Buffer{}, client, f, 8); !errors.As(err, &mce) || !bytes.Equal(mce.Sum, missing) {
+		t.Errorf("want a MissingChunkError for %x, got: %v", missing, err)
+	}
+	if err := WriteFileParallel(&bytes.Buffer{}, client, f, 0); err == nil {
+		t.Error("WriteFileParallel() accepted a parallelism of 0")
+	}
+}
+
+// warmClient records the sums passed to Warm, and how many chunks had been
+// fetched when it was called.
+type warmClient struct {
+	drive.Client
+
+	mu         sync.Mutex // protects the fields below
+	warmed     [][]byte
+	getsBefore int
+	gets       int
+}
+
+func (c *warmClient) Warm(chunks [][]byte, f *shade.File) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.warmed = chunks
+	c.getsBefore = c.gets
+}
+
+func (c *warmClient) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	c.mu.Lock()
+	c.gets++
+	c.mu.Unlock()
+	return c.Client.GetChunk(sha256sum, f)
+}
+
+// takeGets returns the number of chunks fetched, and resets it to zero.
+func (c *warmClient) takeGets() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	gets := c.gets
+	c.gets = 0
+	return gets
+}
+
+func TestWriteFileWarms(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &warmClient{Client: mc}
+	f := shade.NewFileWithChunksize("warm", 3)
+	for i := 0; i < 10; i++ {
+		c := []byte(fmt.Sprintf("%03d", i))
+		sum := shade.Sum(c)
+		if err := mc.PutChunk(sum, c, f); err != nil {
+			t.Fatal(err)
+		}
+		f.Chunks = append(f.Chunks, shade.Chunk{Index: i, Sha256: sum})
+	}
+	if err := WriteFile(&bytes.Buffer{}, client, f); err != nil {
+		t.Fatalf("WriteFile(): %s", err)
+	}
+	if client.getsBefore != 0 {
+		t.Errorf("Warm was called after %d chunks were fetched", client.getsBefore)
+	}
+	if len(client.warmed) != len(f.Chunks) {
+		t.Fatalf("want %d chunks warmed, got: %d", len(f.Chunks), len(client.warmed))
+	}
+	for i, c := range f.Chunks {
+		if !bytes.Equal(client.warmed[i], c.Sha256) {
+			t.Errorf("chunk %d: warmed %x, want %x", i, client.warmed[i], c.Sha256)
+		}
+	}
+}
+
+func TestWriteRange(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &warmClient{Client: mc}
+	f := shade.NewFileWithChunksize("range", 4)
+	var data []byte
+	// The last chunk is partial.
+	for i, c := range []string{"0000", "0001", "0002", "0003", "04"} {
+		sum := shade.Sum([]byte(c))
+		if err := mc.PutChunk(sum, []byte(c), f); err != nil {
+			t.Fatal(err)
+		}
+		f.Chunks = append(f.Chunks, shade.Chunk{Index: i, Sha256: sum})
+		data = append(data, c...)
+	}
+	f.Filesize = int64(len(data))
+
+	testCases := []struct {
+		offset, length int64
+		want           []byte
+		gets           int
+	}{
+		{0, 1, data[:1], 1},
+		{0, -1, data, 5},
+		{5, 6, data[5:11], 2},
+		{4, 4, data[4:8], 1},
+		{15, 100, data[15:], 2},
+		{17, -1, data[17:], 1},
+		{18, 10, nil, 0},
+		{1000, -1, nil, 0},
+		{3, 0, nil, 0},
+	}
+	for _, tc := range testCases {
+		client.takeGets()
+		buf := &bytes.Buffer{}
+		if err := WriteRange(buf, client, f, tc.offset, tc.length, 2); err != nil {
+			t.Errorf("WriteRange(%d, %d): %s", tc.offset, tc.length, err)
+			continue
+		}
+		if !bytes.Equal(buf.Bytes(), tc.want) {
+			t.Errorf("WriteRange(%d, %d), want: %q, got: %q", tc.offset, tc.length, tc.want, buf.Bytes())
+		}
+		if gets := client.takeGets(); gets != tc.gets {
+			t.Errorf("WriteRange(%d, %d) fetched %d chunks, want %d", tc.offset, tc.length, gets, tc.gets)
+		}
+	}
+	if err := WriteRange(&bytes.Buffer{}, client, f, -1, 1, 2); err == nil {
+		t.Error("WriteRange() accepted a negative offset")
+	}
+}
+
+func TestFileBySumAndName(t *testing.T) {
+	client, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sums [][]byte
+	for _, name := range []string{"a", "b"} {
+		jm, err := shade.NewFile(name).ToJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums = append(sums, shade.Sum(jm))
+		if err := client.PutFile(shade.Sum(jm), jm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, name := range []string{"a", "b"} {
+		f, err := fileBySum(client, sums[i])
+		if err != nil {
+			t.Fatalf("fileBySum(%x): %s", sums[i], err)
+		}
+		if f.Filename != name {
+			t.Errorf("fileBySum(%x): want %q, got %q", sums[i], name, f.Filename)
+		}
+		if f, err = fileByName(client, name); err != nil {
+			t.Fatalf("fileByName(%q): %s", name, err)
+		}
+		if f.Filename != name {
+			t.Errorf("fileByName(%q): got %q", name, f.Filename)
+		}
+	}
+	if _, err := fileBySum(client, shade.Sum([]byte("missing"))); err == nil {
+		t.Error("fileBySum succeeded for a missing sum")
+	}
+	if _, err := fileByName(client, "missing"); err == nil {
+		t.Error("fileByName succeeded for a missing name")
+	}
+}
@@ -0,0 +1,132 @@
+package checkconfig
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/encrypt"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&checkconfigCmd{}, "")
+}
+
+type checkconfigCmd struct {
+	timeout time.Duration
+}
+
+func (*checkconfigCmd) Name() string     { return "checkconfig" }
+func (*checkconfigCmd) Synopsis() string { return "Check that each client in the config works." }
+func (*checkconfigCmd) Usage() string {
+	return `checkconfig [-timeout D]:
+  Initialize and ping each client in the config, and print whether it passed
+  or failed, indented to match the Children of the config.  A client whose
+  children fail is reported as failed, without being initialized.
+`
+}
+
+func (p *checkconfigCmd) SetFlags(f *flag.FlagSet) {
+	f.DurationVar(&p.timeout, "timeout", 30*time.Second, "How long to wait for each client to respond to a ping.")
+}
+
+func (p *checkconfigCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	configPath := args[0].(*string)
+	if f.NArg() != 0 {
+		fmt.Printf("unexpected arguments to checkconfig: %v\n", f.Args())
+		return subcommands.ExitFailure
+	}
+
+	// read in the config
+	config, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Printf("FAIL  %s: %s\n", *configPath, err)
+		return subcommands.ExitFailure
+	}
+
+	r := check(ctx, config, p.timeout)
+	r.print(os.Stdout, 0)
+	if !r.ok() {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// result describes the outcome of checking a node of the config.
+type result struct {
+	provider string
+	err      error
+	children []result
+}
+
+// ok returns true if the node and all of its children passed.
+func (r result) ok() bool {
+	if r.err != nil {
+		return false
+	}
+	for _, c := range r.children {
+		if !c.ok() {
+			return false
+		}
+	}
+	return true
+}
+
+// print writes the result of each node to w, indenting each level of
+// children by two more spaces.
+func (r result) print(w io.Writer, depth int) {
+	indent := strings.Repeat("  ", depth)
+	if r.err != nil {
+		fmt.Fprintf(w, "%sFAIL  %s: %s\n", indent, r.provider, r.err)
+	} else {
+		fmt.Fprintf(w, "%sPASS  %s\n", indent, r.provider)
+	}
+	for _, c := range r.children {
+		c.print(w, depth+1)
+	}
+}
+
+// check validates c and each of its Children, depth first.  Each node which
+// passes has been initialized with drive.NewClient, and answered a Ping
+// within timeout.
+func check(ctx context.Context, c drive.Config, timeout time.Duration) result {
+	r := result{provider: c.Provider}
+	for _, child := range c.Children {
+		r.children = append(r.children, check(ctx, child, timeout))
+	}
+	if !drive.ValidProvider(c.Provider) {
+		r.err = fmt.Errorf("unknown provider: %q", c.Provider)
+		return r
+	}
+	if c.Provider == "encrypt" {
+		if err := encrypt.CheckKeys(c); err != nil {
+			r.err = err
+			return r
+		}
+	}
+	for _, child := range r.children {
+		if !child.ok() {
+			r.err = fmt.Errorf("a child client failed")
+			return r
+		}
+	}
+	client, err := drive.NewClient(c)
+	if err != nil {
+		r.err = fmt.Errorf("initializing client: %s", err)
+		return r
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := client.Ping(ctx); err != nil {
+		r.err = fmt.Errorf("ping: %s", err)
+	}
+	return r
+}
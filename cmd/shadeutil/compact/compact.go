@@ -0,0 +1,63 @@
+package compact
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/umbrella"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&compactCmd{}, "")
+}
+
+type compactCmd struct {
+	keep int
+}
+
+func (*compactCmd) Name() string     { return "compact" }
+func (*compactCmd) Synopsis() string { return "Release all but the newest versions of each file." }
+func (*compactCmd) Usage() string {
+	return `compact [-keep N]:
+  Release all but the newest N versions of each file, and the chunks which
+  are no longer referenced by any remaining version.  At most -maxFilesDelete
+  versions are released per run, oldest first; run it again to continue.
+`
+}
+
+func (p *compactCmd) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&p.keep, "keep", 1, "The number of versions of each file to keep, including the current one.")
+}
+
+func (p *compactCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	configPath := args[0].(*string)
+
+	// read in the config
+	config, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Printf("could not read config: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	// initialize client
+	client, err := drive.NewClient(config)
+	if err != nil {
+		fmt.Printf("could not initialize client: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	if err := umbrella.Compact(client, p.keep); err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	if err := drive.Close(client); err != nil {
+		fmt.Printf("Close: %v\n", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
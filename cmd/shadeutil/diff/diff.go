@@ -0,0 +1,225 @@
+// Package diff provides a subcommand to compare a Shade repository with
+// another, or with a local directory.
+package diff
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/compare"
+	"github.com/asjoyner/shade/umbrella"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&diffCmd{}, "")
+}
+
+type diffCmd struct {
+	dest string
+}
+
+func (*diffCmd) Name() string     { return "diff" }
+func (*diffCmd) Synopsis() string { return "Compare a repository with another, or a directory." }
+func (*diffCmd) Usage() string {
+	return `diff [-dest PATH] <CONFIG> <CONFIG | DIRECTORY>:
+  Given two configs, print the sums of the files and chunks which are in only
+  one of the repositories.  As with sync, the sums are compared verbatim, so
+  the configs should describe the storage beneath any encrypt provider.
+
+  Given a config and a local directory, print whether each file below the
+  directory is new, changed or unchanged, compared with the newest version of
+  the file at the same path below -dest in the repository; ie. what throwing
+  the directory to -dest would store.
+`
+}
+
+func (p *diffCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.dest, "dest", "", "The path in the repository which a local directory is compared with.")
+}
+
+func (p *diffCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 2 {
+		fmt.Printf("unexpected number of arguments to diff; want: 2, got: %d\n", f.NArg())
+		return subcommands.ExitFailure
+	}
+	a, err := newClient(f.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	defer drive.Close(a)
+
+	if fi, err := os.Stat(f.Arg(1)); err == nil && fi.IsDir() {
+		d, err := compareDir(a, f.Arg(1), p.dest)
+		if err != nil {
+			fmt.Println(err)
+			return subcommands.ExitFailure
+		}
+		d.print(os.Stdout)
+		return subcommands.ExitSuccess
+	}
+
+	b, err := newClient(f.Arg(1))
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	defer drive.Close(b)
+	if err := diffRepos(a, b, f.Arg(0), f.Arg(1), os.Stdout); err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// newClient initializes a client from the config at configPath.
+func newClient(configPath string) (drive.Client, error) {
+	config, err := config.Read(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config %s: %v", configPath, err)
+	}
+	client, err := drive.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize client for %s: %s", configPath, err)
+	}
+	return client, nil
+}
+
+// diffRepos prints the sums of the files and chunks known to only one of a
+// and b to out, labelled with aName or bName.  The sums are printed in
+// increasing order as they are found, so the memory used does not grow with
+// the number of chunks; see compare.StreamChunks.
+func diffRepos(a, b drive.Client, aName, bName string, out io.Writer) error {
+	var aFiles, aChunks, bFiles, bChunks int
+	only := func(name, kind string, n *int) func([]byte) error {
+		return func(sum []byte) error {
+			*n++
+			fmt.Fprintf(out, "only in %s: %s %x\n", name, kind, sum)
+			return nil
+		}
+	}
+	err := compare.StreamFiles(a, b, compare.Handler{
+		OnlyA: only(aName, "file", &aFiles),
+		OnlyB: only(bName, "file", &bFiles),
+	})
+	if err != nil {
+		return fmt.Errorf("could not compare repositories: %s", err)
+	}
+	err = compare.StreamChunks(a, b, compare.SortOptions{}, compare.Handler{
+		OnlyA: only(aName, "chunk", &aChunks),
+		OnlyB: only(bName, "chunk", &bChunks),
+	})
+	if err != nil {
+		return fmt.Errorf("could not compare repositories: %s", err)
+	}
+	fmt.Fprintf(out, "%d file(s) and %d chunk(s) only in %s\n", aFiles, aChunks, aName)
+	fmt.Fprintf(out, "%d file(s) and %d chunk(s) only in %s\n", bFiles, bChunks, bName)
+	return nil
+}
+
+// dirDelta describes how the files below a local directory differ from those
+// in a repository.  Each is named by its path in the repository.
+type dirDelta struct {
+	New       []string // not in the repository, or deleted from it
+	Changed   []string // their chunks differ from the newest version's
+	Unchanged []string
+}
+
+// print writes the status of each file, and then a summary, to out.
+func (d dirDelta) print(out io.Writer) {
+	for _, s := range []struct {
+		status string
+		names  []string
+	}{{"new", d.New}, {"changed", d.Changed}, {"unchanged", d.Unchanged}} {
+		for _, name := range s.names {
+			fmt.Fprintf(out, "%s: %s\n", s.status, name)
+		}
+	}
+	fmt.Fprintf(out, "%d new, %d changed, %d unchanged file(s)\n", len(d.New), len(d.Changed), len(d.Unchanged))
+}
+
+// compareDir compares each regular file below the local directory dir with
+// the newest version of the file at the same relative path below dest in the
+// repository.  Files are compared by the sums of their chunks, computed with
+// the Chunksize and SumAlgorithm of the version in the repository, so a file
+// which was stored with other settings is reported as changed only if its
+// content differs.
+func compareDir(client drive.Client, dir, dest string) (dirDelta, error) {
+	inUse, _, err := umbrella.FetchFiles(client)
+	if err != nil {
+		return dirDelta{}, err
+	}
+	files := make(map[string]*shade.File, len(inUse))
+	for _, ff := range inUse {
+		if !ff.File().Deleted {
+			files[ff.File().Filename] = ff.File()
+		}
+	}
+	dest = strings.TrimPrefix(dest, "/")
+
+	var d dirDelta
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(dest, filepath.ToSlash(rel))
+		file, ok := files[name]
+		if !ok {
+			d.New = append(d.New, name)
+			return nil
+		}
+		same, err := sameChunks(p, file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", rel, err)
+		}
+		if same {
+			d.Unchanged = append(d.Unchanged, name)
+		} else {
+			d.Changed = append(d.Changed, name)
+		}
+		return nil
+	})
+	return d, err
+}
+
+// sameChunks reports whether the local file filename has the same chunks as
+// file.
+func sameChunks(filename string, file *shade.File) (bool, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer fh.Close()
+	sums, err := file.ChunkSums(fh, len(file.Chunks)+1)
+	if err != nil {
+		return false, err
+	}
+	if len(sums) != len(file.Chunks) {
+		return false, nil
+	}
+	for _, c := range file.Chunks {
+		if c.Index < 0 || c.Index >= len(sums) || !bytes.Equal(sums[c.Index], c.Sha256) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,117 @@
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+func newMemoryClient(t *testing.T) drive.Client {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	return mc
+}
+
+func TestDiffRepos(t *testing.T) {
+	a := newMemoryClient(t)
+	b := newMemoryClient(t)
+	for _, c := range []drive.Client{a, b} {
+		if err := c.PutFile(shade.Sum([]byte("both")), []byte("both")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.PutFile(shade.Sum([]byte("file a")), []byte("file a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PutChunk(shade.Sum([]byte("chunk b")), []byte("chunk b"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := diffRepos(a, b, "A", "B", out); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"only in A: file " + hexSum("file a"),
+		"only in B: chunk " + hexSum("chunk b"),
+		"1 file(s) and 0 chunk(s) only in A",
+		"0 file(s) and 1 chunk(s) only in B",
+	}
+	if got := strings.Split(strings.TrimSpace(out.String()), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffRepos() printed:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func hexSum(s string) string {
+	return fmt.Sprintf("%x", shade.Sum([]byte(s)))
+}
+
+// putFile stores a shade.File named filename in client, describing content
+// split into 4 byte chunks.
+func putFile(t *testing.T, client drive.Client, filename, content string, deleted bool) {
+	f := shade.NewFileWithChunksize(filename, 4)
+	f.AesKey = nil
+	sums, err := f.ChunkSums(strings.NewReader(content), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, sum := range sums {
+		f.Chunks = append(f.Chunks, shade.Chunk{Index: i, Sha256: sum})
+	}
+	f.Deleted = deleted
+	jm, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PutFile(shade.Sum(jm), jm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompareDir(t *testing.T) {
+	client := newMemoryClient(t)
+	putFile(t, client, "backup/same", "unchanged content", false)
+	putFile(t, client, "backup/sub/edited", "the old content", false)
+	putFile(t, client, "backup/removed", "deleted content", true)
+	putFile(t, client, "elsewhere/new", "not below dest", false)
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"same":       "unchanged content",
+		"sub/edited": "the new content",
+		"removed":    "deleted content",
+		"new":        "not below dest",
+	} {
+		fn := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := compareDir(client, dir, "/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := dirDelta{
+		New:       []string{"backup/new", "backup/removed"},
+		Changed:   []string{"backup/sub/edited"},
+		Unchanged: []string{"backup/same"},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("compareDir(), want: %+v, got: %+v", want, d)
+	}
+}
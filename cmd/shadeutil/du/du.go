@@ -0,0 +1,179 @@
+package du
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/umbrella"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&duCmd{}, "")
+}
+
+type duCmd struct {
+	human bool
+}
+
+func (*duCmd) Name() string     { return "du" }
+func (*duCmd) Synopsis() string { return "Report the size of the repository." }
+func (*duCmd) Usage() string {
+	return `du [-h]:
+  Report the logical size of the files in the repository, the size of the
+  unique chunks they refer to, and the resulting deduplication ratio, in total
+  and for each top level directory.
+`
+}
+
+func (p *duCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&p.human, "h", false, "Print sizes in human readable units")
+}
+
+func (p *duCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	// read in the config
+	configPath := args[0].(*string)
+	config, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Printf("could not read config: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	// initialize client
+	client, err := drive.NewClient(config)
+	if err != nil {
+		fmt.Printf("could not initialize client: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	r, err := diskUsage(client)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	r.print(os.Stdout, p.human)
+	return subcommands.ExitSuccess
+}
+
+// usage describes the size of a set of files.
+type usage struct {
+	files    int
+	logical  int64               // the sum of the Filesize of each file
+	physical int64               // the sum of the size of each unique chunk
+	chunks   map[string]struct{} // the unique chunks seen
+}
+
+// add accounts for a chunk of size bytes with the given sum.
+func (u *usage) add(sum []byte, size int64) {
+	if _, ok := u.chunks[string(sum)]; ok {
+		return
+	}
+	u.chunks[string(sum)] = struct{}{}
+	u.physical += size
+}
+
+// ratio returns the logical size divided by the physical size.
+func (u *usage) ratio() float64 {
+	if u.physical == 0 {
+		return 0
+	}
+	return float64(u.logical) / float64(u.physical)
+}
+
+// report holds the usage of the whole repository, and of each top level
+// directory.
+type report struct {
+	total usage
+	dirs  map[string]*usage
+}
+
+// diskUsage calculates the usage of the files in use in the repository.
+//
+// The physical size is the unencrypted size of the chunks, as described by the
+// shade.File which refers to them.  Encrypted clients store a few more bytes
+// per chunk.
+func diskUsage(client drive.Client) (*report, error) {
+	inUse, _, err := umbrella.FetchFiles(client)
+	if err != nil {
+		return nil, err
+	}
+	r := &report{
+		total: usage{chunks: make(map[string]struct{})},
+		dirs:  make(map[string]*usage),
+	}
+	for _, ff := range inUse {
+		f := ff.File()
+		if f.Deleted {
+			continue
+		}
+		dir := "."
+		if i := strings.Index(strings.TrimPrefix(f.Filename, "/"), "/"); i >= 0 {
+			dir = strings.TrimPrefix(f.Filename, "/")[:i]
+		}
+		du, ok := r.dirs[dir]
+		if !ok {
+			du = &usage{chunks: make(map[string]struct{})}
+			r.dirs[dir] = du
+		}
+		for _, u := range []*usage{&r.total, du} {
+			u.files++
+			u.logical += f.Filesize
+		}
+		for _, c := range f.Chunks {
+			size := int64(f.Chunksize)
+			if c.Index == len(f.Chunks)-1 {
+				size = int64(f.LastChunksize)
+			}
+			r.total.add(c.Sha256, size)
+			du.add(c.Sha256, size)
+		}
+	}
+	return r, nil
+}
+
+// print writes the report to out, in aligned columns.
+func (r *report) print(out io.Writer, human bool) {
+	size := func(b int64) string { return fmt.Sprintf("%d", b) }
+	if human {
+		size = humanBytes
+	}
+	w := &tabwriter.Writer{}
+	w.Init(out, 0, 2, 1, ' ', 0)
+	fmt.Fprint(w, "files\tlogical\tphysical\tchunks\tdedup\tdirectory\n")
+	var dirs []string
+	for dir := range r.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	line := func(u *usage, name string) {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%.2fx\t%s\n", u.files, size(u.logical), size(u.physical), len(u.chunks), u.ratio(), name)
+	}
+	for _, dir := range dirs {
+		line(r.dirs[dir], dir)
+	}
+	line(&r.total, "total")
+	w.Flush()
+}
+
+// humanBytes formats b in the largest binary unit in which it is at least 1.
+func humanBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,91 @@
+package du
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+func TestSharedChunksCountedOnce(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	shared, _ := drive.RandChunk()
+	tailA, _ := drive.RandChunk()
+	tailB, _ := drive.RandChunk()
+	// All the files share their first chunk, docs/c is a copy of photos/b.
+	for _, tf := range []struct {
+		filename string
+		chunks   [][]byte
+	}{
+		{"photos/a", [][]byte{shared, tailA}},
+		{"photos/b", [][]byte{shared, tailB}},
+		{"docs/c", [][]byte{shared, tailB}},
+	} {
+		f := shade.NewFile(tf.filename)
+		f.Chunksize = 100
+		f.LastChunksize = 60
+		for i, sum := range tf.chunks {
+			f.Chunks = append(f.Chunks, shade.Chunk{Index: i, Sha256: sum})
+		}
+		f.UpdateFilesize()
+		jm, err := json.Marshal(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mc.PutFile(shade.Sum(jm), jm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := diskUsage(mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each file is 160 bytes, the unique chunks are shared, tailA and tailB.
+	if r.total.logical != 480 {
+		t.Errorf("total logical size, want: 480, got: %d", r.total.logical)
+	}
+	if len(r.total.chunks) != 3 {
+		t.Errorf("total unique chunks, want: 3, got: %d", len(r.total.chunks))
+	}
+	if r.total.physical != 220 {
+		t.Errorf("total physical size, want: 220, got: %d", r.total.physical)
+	}
+	if got := r.dirs["photos"].physical; got != 220 {
+		t.Errorf("physical size of photos, want: 220, got: %d", got)
+	}
+	if got := r.dirs["photos"].files; got != 2 {
+		t.Errorf("files in photos, want: 2, got: %d", got)
+	}
+	if got := r.dirs["docs"].physical; got != 160 {
+		t.Errorf("physical size of docs, want: 160, got: %d", got)
+	}
+
+	buf := &bytes.Buffer{}
+	r.print(buf, true)
+	if !strings.Contains(buf.String(), "total") {
+		t.Errorf("report is missing the total: %s", buf.String())
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	for b, want := range map[int64]string{
+		0:               "0B",
+		1023:            "1023B",
+		1024:            "1.0KiB",
+		1536:            "1.5KiB",
+		5 * 1024 * 1024: "5.0MiB",
+		3 << 40:         "3.0TiB",
+	} {
+		if got := humanBytes(b); got != want {
+			t.Errorf("humanBytes(%d), want: %s, got: %s", b, want, got)
+		}
+	}
+}
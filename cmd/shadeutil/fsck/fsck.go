@@ -0,0 +1,310 @@
+// Package fsck provides a subcommand to check the integrity of a Shade
+// repository.
+package fsck
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/umbrella"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&fsckCmd{}, "")
+}
+
+type fsckCmd struct {
+	full     bool
+	parallel int
+	progress time.Duration
+}
+
+func (*fsckCmd) Name() string     { return "fsck" }
+func (*fsckCmd) Synopsis() string { return "Check the integrity of the repository." }
+func (*fsckCmd) Usage() string {
+	return `fsck [-full] [-parallel N] [-progress D]:
+  Check that the newest version of each file has chunks numbered 0 to N-1,
+  and that its recorded content digest matches them.
+
+  With -full, also fetch every chunk they reference and check that it matches
+  its sum, -parallel at a time, printing progress to STDERR every -progress.
+  Each missing or corrupt chunk is printed with the files which reference it.
+  The chunks are fetched through the configured client, so in an encrypted
+  repository they are decrypted and compared with their plaintext sums.
+`
+}
+
+func (p *fsckCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&p.full, "full", false, "Fetch and verify the sum of every chunk.")
+	f.IntVar(&p.parallel, "parallel", 8, "The number of chunks to fetch concurrently with -full.")
+	f.DurationVar(&p.progress, "progress", 10*time.Second, "How often to print progress with -full (0 disables it).")
+}
+
+func (p *fsckCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	configPath := args[0].(*string)
+	if f.NArg() != 0 {
+		fmt.Printf("unexpected arguments to fsck: %v\n", f.Args())
+		return subcommands.ExitFailure
+	}
+	if p.parallel < 1 {
+		fmt.Printf("invalid -parallel: %d\n", p.parallel)
+		return subcommands.ExitFailure
+	}
+
+	// read in the config
+	config, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Printf("could not read config: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	// initialize client
+	client, err := drive.NewClient(config)
+	if err != nil {
+		fmt.Printf("could not initialize client: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	inUse, _, err := umbrella.FetchFiles(client)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	r := checkFiles(inUse)
+	if p.full {
+		r.checkChunks(client, inUse, p.parallel, p.progress, os.Stderr)
+	}
+	r.print(os.Stdout)
+	if !r.ok() {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// report describes the problems found in a repository.
+type report struct {
+	Files     int      // the number of files checked
+	Malformed []string // the files whose chunks or digest are inconsistent
+
+	Chunks  int64 // the number of chunks checked with -full
+	Bytes   int64 // their total size
+	Elapsed time.Duration
+	Missing []chunkProblem // chunks which could not be fetched
+	Corrupt []chunkProblem // chunks which do not match their sum
+}
+
+// chunkProblem describes a chunk which failed verification.
+type chunkProblem struct {
+	Sum   []byte
+	Files []string // the files which reference the chunk
+	Err   error
+}
+
+// ok returns true if no problems were found.
+func (r *report) ok() bool {
+	return len(r.Malformed) == 0 && len(r.Missing) == 0 && len(r.Corrupt) == 0
+}
+
+// print writes each problem, and then a summary, to out.
+func (r *report) print(out io.Writer) {
+	for _, m := range r.Malformed {
+		fmt.Fprintf(out, "malformed: %s\n", m)
+	}
+	for _, s := range []struct {
+		status   string
+		problems []chunkProblem
+	}{{"missing", r.Missing}, {"corrupt", r.Corrupt}} {
+		for _, p := range s.problems {
+			fmt.Fprintf(out, "%s chunk %x: %s (referenced by %s)\n", s.status, p.Sum, p.Err, strings.Join(p.Files, ", "))
+		}
+	}
+	fmt.Fprintf(out, "checked %d file(s): %d malformed\n", r.Files, len(r.Malformed))
+	if r.Chunks > 0 {
+		fmt.Fprintf(out, "checked %d chunk(s), %d MB in %s: %d missing, %d corrupt\n", r.Chunks, r.Bytes/1024/1024, r.Elapsed.Round(time.Second), len(r.Missing), len(r.Corrupt))
+	}
+}
+
+// checkFiles checks that the chunks of each file in inUse which was not
+// deleted are numbered from 0, without gaps, and match its recorded digest.
+func checkFiles(inUse []umbrella.FoundFile) *report {
+	r := &report{}
+	for _, ff := range inUse {
+		f := ff.File()
+		if f.Deleted {
+			continue
+		}
+		r.Files++
+		if err := checkIndexes(f); err != nil {
+			r.Malformed = append(r.Malformed, fmt.Sprintf("%s: %s", f.Filename, err))
+			continue
+		}
+		if err := f.VerifyDigest(); err != nil {
+			r.Malformed = append(r.Malformed, fmt.Sprintf("%s: %s", f.Filename, err))
+		}
+	}
+	sort.Strings(r.Malformed)
+	return r
+}
+
+// checkIndexes returns an error unless the Chunks of f are numbered 0 to
+// len(f.Chunks)-1, each exactly once.
+func checkIndexes(f *shade.File) error {
+	seen := make([]bool, len(f.Chunks))
+	for _, c := range f.Chunks {
+		if c.Index < 0 || c.Index >= len(seen) {
+			return fmt.Errorf("chunk index %d out of range for %d chunks", c.Index, len(seen))
+		}
+		if seen[c.Index] {
+			return fmt.Errorf("chunk index %d is repeated", c.Index)
+		}
+		seen[c.Index] = true
+	}
+	return nil
+}
+
+// chunkRef is a chunk to verify, the file to fetch it with, and the names of
+// all the files which reference it.
+type chunkRef struct {
+	sum   []byte
+	file  *shade.File
+	files []string
+}
+
+// chunkRefs returns the unique chunks referenced by the files in inUse which
+// were not deleted.  A chunk is stored separately for each AesKey it is
+// encrypted with, so those are verified separately.
+func chunkRefs(inUse []umbrella.FoundFile) []*chunkRef {
+	byKey := make(map[string]*chunkRef)
+	var refs []*chunkRef
+	for _, ff := range inUse {
+		f := ff.File()
+		if f.Deleted {
+			continue
+		}
+		for _, c := range f.Chunks {
+			key := string(c.Sha256)
+			if f.AesKey != nil {
+				key += string(f.AesKey[:])
+			}
+			ref, ok := byKey[key]
+			if !ok {
+				ref = &chunkRef{sum: c.Sha256, file: f}
+				byKey[key] = ref
+				refs = append(refs, ref)
+			}
+			if n := len(ref.files); n == 0 || ref.files[n-1] != f.Filename {
+				ref.files = append(ref.files, f.Filename)
+			}
+		}
+	}
+	return refs
+}
+
+// checkChunks fetches each chunk referenced by the files in inUse with
+// parallel workers, and records those which are missing or do not match
+// their sum.  Unless interval is 0, progress is written to progress every
+// interval.
+func (r *report) checkChunks(client drive.Client, inUse []umbrella.FoundFile, parallel int, interval time.Duration, progress io.Writer) {
+	refs := chunkRefs(inUse)
+	start := time.Now()
+	var checked, bytes int64
+	done := make(chan struct{})
+	var pw sync.WaitGroup
+	if interval > 0 {
+		pw.Add(1)
+		go func() {
+			defer pw.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					printProgress(progress, atomic.LoadInt64(&checked), len(refs), atomic.LoadInt64(&bytes), time.Since(start))
+				}
+			}
+		}()
+	}
+
+	var mu sync.Mutex // protects r.Missing and r.Corrupt
+	reqs := make(chan *chunkRef)
+	var workers sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for ref := range reqs {
+				missing, corrupt, n := verifyChunk(client, ref)
+				atomic.AddInt64(&bytes, int64(n))
+				atomic.AddInt64(&checked, 1)
+				if missing == nil && corrupt == nil {
+					continue
+				}
+				mu.Lock()
+				if missing != nil {
+					r.Missing = append(r.Missing, *missing)
+				} else {
+					r.Corrupt = append(r.Corrupt, *corrupt)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, ref := range refs {
+		reqs <- ref
+	}
+	close(reqs)
+	workers.Wait()
+	close(done)
+	pw.Wait()
+
+	r.Chunks = checked
+	r.Bytes = bytes
+	r.Elapsed = time.Since(start)
+	sortProblems(r.Missing)
+	sortProblems(r.Corrupt)
+}
+
+// verifyChunk fetches the chunk described by ref, and returns a problem if it
+// is missing or does not match its sum, and otherwise the size of the chunk.
+func verifyChunk(client drive.Client, ref *chunkRef) (missing, corrupt *chunkProblem, size int) {
+	chunk, err := client.GetChunk(ref.sum, ref.file)
+	if err != nil {
+		return &chunkProblem{Sum: ref.sum, Files: ref.files, Err: err}, nil, 0
+	}
+	sum, err := ref.file.Sum(chunk)
+	if err != nil {
+		return nil, &chunkProblem{Sum: ref.sum, Files: ref.files, Err: err}, len(chunk)
+	}
+	if string(sum) != string(ref.sum) {
+		err := fmt.Errorf("content has sum %x", sum)
+		return nil, &chunkProblem{Sum: ref.sum, Files: ref.files, Err: err}, len(chunk)
+	}
+	return nil, nil, len(chunk)
+}
+
+// sortProblems sorts problems by sum, so they are printed in a stable order.
+func sortProblems(problems []chunkProblem) {
+	sort.Slice(problems, func(i, j int) bool { return string(problems[i].Sum) < string(problems[j].Sum) })
+}
+
+// printProgress writes the number of chunks checked of total, and the rate
+// at which they were fetched, to w.
+func printProgress(w io.Writer, checked int64, total int, bytes int64, elapsed time.Duration) {
+	mb := float64(bytes) / 1024 / 1024
+	fmt.Fprintf(w, "checked %d/%d chunks, %0.0f MB at %0.2f MB/s\n", checked, total, mb, mb/elapsed.Seconds())
+}
@@ -0,0 +1,127 @@
+package fsck
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/flaky"
+	"github.com/asjoyner/shade/drive/memory"
+	"github.com/asjoyner/shade/umbrella"
+)
+
+// putFile stores a shade.File with the given name, whose chunks have the
+// given contents, in client.  Chunks listed in skip are not stored.
+func putFile(t *testing.T, client drive.Client, name string, chunks []string, skip ...int) *shade.File {
+	f := shade.NewFileWithChunksize(name, 16)
+	f.AesKey = nil
+	for i, c := range chunks {
+		sum, err := f.Sum([]byte(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Chunks = append(f.Chunks, shade.Chunk{Index: i, Sha256: sum})
+		if len(skip) > 0 && skip[0] == i {
+			continue
+		}
+		if err := client.PutChunk(sum, []byte(c), f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.LastChunksize = len(chunks[len(chunks)-1])
+	f.UpdateFilesize()
+	f.UpdateDigest()
+	jm, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PutFile(shade.Sum(jm), jm); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// fsck checks the files of client and, if chunks is not nil, fetches their
+// chunks from it.
+func fsck(t *testing.T, client, chunks drive.Client) *report {
+	inUse, _, err := umbrella.FetchFiles(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := checkFiles(inUse)
+	if chunks != nil {
+		r.checkChunks(chunks, inUse, 4, 0, nil)
+	}
+	return r
+}
+
+func TestFsck(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		putFile(t, mc, fmt.Sprintf("file%d", i), []string{fmt.Sprintf("chunk %d", i), "shared"})
+	}
+	if r := fsck(t, mc, mc); !r.ok() || r.Files != 10 || r.Chunks != 11 {
+		t.Errorf("fsck of a healthy repository, want 10 files and 11 chunks without problems, got: %+v", r)
+	}
+
+	bad := putFile(t, mc, "bad", []string{"a", "b"})
+	bad.Chunks[1].Index = 0
+	bad.ModifiedTime = bad.ModifiedTime.Add(time.Second)
+	jm, _ := json.Marshal(bad)
+	if err := mc.PutFile(shade.Sum(jm), jm); err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, mc, "incomplete", []string{"c", "d"}, 1)
+	r := fsck(t, mc, mc)
+	if len(r.Malformed) != 1 || !strings.HasPrefix(r.Malformed[0], "bad: ") {
+		t.Errorf("want bad reported as malformed, got: %q", r.Malformed)
+	}
+	if len(r.Missing) != 1 || len(r.Missing[0].Files) != 1 || r.Missing[0].Files[0] != "incomplete" {
+		t.Errorf("want the missing chunk of incomplete reported, got: %+v", r.Missing)
+	}
+	if r := fsck(t, mc, nil); r.Chunks != 0 || len(r.Missing) != 0 {
+		t.Errorf("fsck without -full checked the chunks: %+v", r)
+	}
+}
+
+// TestFsckCorruptChunk confirms a corrupt chunk is reported with each of the
+// files which reference it.
+func TestFsckCorruptChunk(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, mc, "a", []string{"shared"})
+	putFile(t, mc, "b", []string{"shared"})
+	// Only the chunks are fetched from the flaky client, so only they are
+	// corrupted.
+	client := flaky.Wrap(mc, drive.Config{Provider: "flaky", Faults: drive.FaultConfig{CorruptRate: 1}})
+	r := fsck(t, mc, client)
+	if len(r.Corrupt) != 1 || len(r.Missing) != 0 {
+		t.Fatalf("want 1 corrupt chunk, got: %+v", r)
+	}
+	if got := strings.Join(r.Corrupt[0].Files, ","); got != "a,b" && got != "b,a" {
+		t.Errorf("the corrupt chunk is referenced by %q, want a and b", got)
+	}
+	buf := &bytes.Buffer{}
+	r.print(buf)
+	if want := fmt.Sprintf("corrupt chunk %x", shade.Sum([]byte("shared"))); !strings.Contains(buf.String(), want) {
+		t.Errorf("the report does not contain %q:\n%s", want, buf.String())
+	}
+}
+
+func TestProgress(t *testing.T) {
+	buf := &bytes.Buffer{}
+	printProgress(buf, 5, 10, 2*1024*1024, 2e9)
+	if want := "checked 5/10 chunks, 2 MB at 1.00 MB/s\n"; buf.String() != want {
+		t.Errorf("printProgress(), want: %q, got: %q", want, buf.String())
+	}
+}
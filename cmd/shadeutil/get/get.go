@@ -0,0 +1,167 @@
+package get
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/cmd/shadeutil/cat"
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/umbrella"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&getCmd{}, "")
+}
+
+type getCmd struct {
+	workers int
+}
+
+func (*getCmd) Name() string     { return "get" }
+func (*getCmd) Synopsis() string { return "Restore a file or directory to local disk." }
+func (*getCmd) Usage() string {
+	return `get [-workers N] <PATH> <DESTINATION>:
+  Restore the file at PATH in the repository to DESTINATION.  If PATH is a
+  directory, the whole subtree is restored below DESTINATION.
+`
+}
+
+func (p *getCmd) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&p.workers, "workers", 4, "The number of files to restore in parallel.")
+}
+
+func (p *getCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	configPath := args[0].(*string)
+	if f.NArg() != 2 {
+		fmt.Printf("unexpected number of arguments to get; want: 2, got: %d\n", f.NArg())
+		return subcommands.ExitFailure
+	}
+
+	// read in the config
+	config, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Printf("could not read config: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	// initialize client
+	client, err := drive.NewClient(config)
+	if err != nil {
+		fmt.Printf("could not initialize client: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	if err := get(client, f.Arg(0), f.Arg(1), p.workers); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// get restores the file named src to dest.  If src names a directory, each
+// file below it is restored to the same relative path below dest, using the
+// provided number of workers.  If src names both a file and a directory, the
+// file is restored.  Files whose names would place them outside of dest, eg.
+// "photos/../../.bashrc", are skipped.
+func get(client drive.Client, src, dest string, workers int) error {
+	inUse, _, err := umbrella.FetchFiles(client)
+	if err != nil {
+		return err
+	}
+	src = strings.Trim(src, "/")
+	var files []*shade.File
+	for _, ff := range inUse {
+		if f := ff.File(); !f.Deleted {
+			files = append(files, f)
+		}
+	}
+	restore := make(map[string]*shade.File) // destination path to file
+	for _, f := range files {
+		if strings.TrimPrefix(f.Filename, "/") == src {
+			restore[dest] = f
+		}
+	}
+	if len(restore) == 0 {
+		for _, f := range files {
+			fn := strings.TrimPrefix(f.Filename, "/")
+			if src != "" && !strings.HasPrefix(fn, src+"/") {
+				continue
+			}
+			rel := strings.TrimPrefix(strings.TrimPrefix(fn, src), "/")
+			target, ok := below(dest, rel)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "skipping %q: it is not below %s\n", f.Filename, dest)
+				continue
+			}
+			restore[target] = f
+		}
+	}
+	if len(restore) == 0 {
+		return fmt.Errorf("no such file or directory: %s", src)
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	type job struct {
+		dest string
+		file *shade.File
+	}
+	jobs := make(chan job)
+	errs := make(chan error, len(restore))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := writeFile(client, j.file, j.dest); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for d, f := range restore {
+		jobs <- job{d, f}
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+	return <-errs // nil if there were no errors
+}
+
+// writeFile restores file to dest, creating the parent directories as needed.
+func writeFile(client drive.Client, file *shade.File, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	fh, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if err := cat.WriteFile(fh, client, file); err != nil {
+		fh.Close()
+		return fmt.Errorf("%s: %s", file.Filename, err)
+	}
+	return fh.Close()
+}
+
+// below returns the path rel, a slash separated path from the repository,
+// below dir.  It returns false if the cleaned path is not inside dir.
+func below(dir, rel string) (string, bool) {
+	target := filepath.Join(dir, filepath.FromSlash(rel))
+	r, err := filepath.Rel(dir, target)
+	if err != nil || r == "." || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return target, true
+}
@@ -0,0 +1,161 @@
+package get
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+// throw stores data as the named file in client, in chunks of chunkSize
+// bytes, like cmd/throw does.
+func throw(t *testing.T, client drive.Client, filename string, data []byte, chunkSize int) {
+	f := shade.NewFile(filename)
+	f.Chunksize = chunkSize
+	for i := 0; i*chunkSize < len(data); i++ {
+		end := (i + 1) * chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[i*chunkSize : end]
+		sum := shade.Sum(chunk)
+		if err := client.PutChunk(sum, chunk, f); err != nil {
+			t.Fatal(err)
+		}
+		f.Chunks = append(f.Chunks, shade.Chunk{Index: i, Sha256: sum})
+		f.LastChunksize = len(chunk)
+	}
+	f.UpdateFilesize()
+	jm, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PutFile(shade.Sum(jm), jm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func TestGetFile(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	data := randBytes(1000)
+	throw(t, mc, "some/file", data, 64)
+
+	dest := filepath.Join(t.TempDir(), "restored")
+	if err := get(mc, "some/file", dest, 1); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("restored file does not match, want %d bytes, got %d", len(data), len(got))
+	}
+
+	if err := get(mc, "no/such/file", dest, 1); err == nil {
+		t.Errorf("get() of a missing file succeeded")
+	}
+}
+
+func TestGetDirectory(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	files := map[string][]byte{
+		"photos/a.jpg":      randBytes(100),
+		"photos/2023/b.jpg": randBytes(300),
+		"photos/2023/c.jpg": randBytes(0),
+	}
+	for fn, data := range files {
+		throw(t, mc, fn, data, 64)
+	}
+	throw(t, mc, "docs/d.pdf", randBytes(10), 64)
+
+	dest := t.TempDir()
+	if err := get(mc, "/photos/", dest, 2); err != nil {
+		t.Fatal(err)
+	}
+	for fn, data := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(fn[len("photos/"):])))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("restored %s does not match, want %d bytes, got %d", fn, len(data), len(got))
+		}
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dest, "d.pdf")); err == nil {
+		t.Errorf("restored a file outside the requested directory")
+	}
+}
+
+// TestGetSkipsPathsOutsideDest stores files whose names climb out of the
+// requested directory, and expects them not to be written.
+func TestGetSkipsPathsOutsideDest(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	data := randBytes(10)
+	throw(t, mc, "photos/a.jpg", data, 64)
+	throw(t, mc, "photos/../../escaped", randBytes(10), 64)
+	throw(t, mc, "photos/2023/../../../escaped2", randBytes(10), 64)
+
+	root := t.TempDir()
+	dest := filepath.Join(root, "a", "restored")
+	if err := get(mc, "photos", dest, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dest, "a.jpg")); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("photos/a.jpg was not restored: %v", err)
+	}
+	for _, escaped := range []string{"escaped", "escaped2"} {
+		if _, err := os.Stat(filepath.Join(root, escaped)); err == nil {
+			t.Errorf("%s was written, outside of %s", escaped, dest)
+		}
+	}
+}
+
+// TestGetFileAndDirectory stores a file which shares its name with a
+// directory, and expects get to restore only the file, whatever order the
+// files are listed in.
+func TestGetFileAndDirectory(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	data := randBytes(100)
+	throw(t, mc, "src/a", randBytes(10), 64)
+	throw(t, mc, "src", data, 64)
+	throw(t, mc, "src/b", randBytes(10), 64)
+
+	dest := filepath.Join(t.TempDir(), "restored")
+	if err := get(mc, "src", dest, 1); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("restored file does not match, want %d bytes, got %d", len(data), len(got))
+	}
+}
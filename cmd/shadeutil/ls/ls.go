@@ -2,17 +2,23 @@ package ls
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"sort"
+	"strings"
 	"text/tabwriter"
 	"time"
 
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/config"
 	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/fusefs"
 
 	"github.com/google/subcommands"
 )
@@ -25,22 +31,39 @@ var (
 	defaultConfig = path.Join(shade.ConfigDir(), "config.json")
 )
 
+// parallelFetches is the number of file objects fetched at once.
+const parallelFetches = 4
+
 type lsCmd struct {
 	long   bool
+	json   bool
+	tree   bool
 	config string
+	glob   string
+	prefix string
+	limit  int
 }
 
 func (*lsCmd) Name() string     { return "ls" }
 func (*lsCmd) Synopsis() string { return "List files in the respository." }
 func (*lsCmd) Usage() string {
-	return `ls [-l] [-f FILE]:
-  List all the files in the configured shade repositories.
+	return `ls [-l | -json | -tree] [-f FILE] [-path GLOB] [-prefix PREFIX] [-limit N]:
+  List all the files in the configured shade repositories.  If -path or
+  -prefix are specified, only the files which match are listed.  In -path,
+  "**" matches any number of directories.  Files are printed as they are
+  fetched, in no particular order, and -limit stops after N of them.  -tree
+  must fetch every file first, and does not support -limit.
 `
 }
 
 func (p *lsCmd) SetFlags(f *flag.FlagSet) {
 	f.BoolVar(&p.long, "l", false, "Long format listing")
+	f.BoolVar(&p.json, "json", false, "List the files as a JSON array")
+	f.BoolVar(&p.tree, "tree", false, "List the files as an indented directory tree")
 	f.StringVar(&p.config, "f", defaultConfig, "Path to shade config")
+	f.StringVar(&p.glob, "path", "", "Only list filenames which match this shell glob")
+	f.StringVar(&p.prefix, "prefix", "", "Only list filenames which start with this prefix")
+	f.IntVar(&p.limit, "limit", 0, "Stop after listing this many files; zero lists them all")
 }
 
 func (p *lsCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
@@ -59,34 +82,238 @@ func (p *lsCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{})
 		return subcommands.ExitFailure
 	}
 
-	file := &shade.File{}
+	match, err := matcher(p.glob, p.prefix)
+	if err != nil {
+		fmt.Printf("invalid -path %q: %s\n", p.glob, err)
+		return subcommands.ExitFailure
+	}
+	if p.json && p.tree {
+		fmt.Println("specify at most one of -json and -tree")
+		return subcommands.ExitUsageError
+	}
+	if p.tree && p.limit != 0 {
+		fmt.Println("-limit is not supported with -tree")
+		return subcommands.ExitUsageError
+	}
+	lister := func(out io.Writer, client drive.Client, match func(string) bool) error {
+		return list(out, client, p.long, match, p.limit)
+	}
+	if p.json {
+		lister = func(out io.Writer, client drive.Client, match func(string) bool) error {
+			return listJSON(out, client, match, p.limit)
+		}
+	} else if p.tree {
+		lister = listTree
+	}
+	if err := lister(os.Stdout, client, match); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// list prints the files known to client to out, for which match returns true,
+// as each is fetched.  If limit is positive, it stops after limit files.
+func list(out io.Writer, client drive.Client, long bool, match func(string) bool, limit int) error {
 	w := &tabwriter.Writer{}
-	w.Init(os.Stdout, 0, 2, 1, ' ', 0)
-	if p.long {
+	w.Init(out, 0, 2, 1, ' ', 0)
+	if long {
 		fmt.Fprint(w, "\tid\t(sha)\tsize\tchunksize\tchunks\tmtime\tfilename\n")
 	}
+	var lines int
+	err := eachFile(client, match, limit, func(id int, sha256sum []byte, file *shade.File) {
+		if long {
+			fmt.Fprintf(w, "\t%v\t(%x)\t%v\t%v\t%v\t%v\t%v\n", id, sha256sum, file.Filesize, file.Chunksize, file.Chunks, file.ModifiedTime.Format(time.Stamp), file.Filename)
+		} else {
+			fmt.Fprintf(w, "\t%v\n", file.Filename)
+		}
+		// The columns are only aligned within each flushed block, so flush
+		// periodically rather than buffering the whole listing.
+		if lines++; !long || lines%100 == 0 {
+			w.Flush()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// eachFile calls fn for each of the files known to client for which match
+// returns true, as each is fetched.  id is the index of the file in the
+// response to ListFiles.  If limit is positive, it stops after limit files,
+// without fetching the rest.  Files which cannot be retrieved are reported on
+// stderr, and skipped.
+func eachFile(client drive.Client, match func(string) bool, limit int, fn func(id int, sha256sum []byte, file *shade.File)) error {
 	lfm, err := client.ListFiles()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not get files: %v\n", err)
-		return subcommands.ExitFailure
+		return fmt.Errorf("could not get files: %v", err)
 	}
+	ids := make(map[string]int, len(lfm))
 	for id, sha256sum := range lfm {
-		fileJSON, err := client.GetFile(sha256sum)
+		ids[string(sha256sum)] = id
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var found int
+	err = drive.GetFiles(ctx, client, lfm, parallelFetches, func(sha256sum, fileJSON []byte, err error) {
+		if limit > 0 && found >= limit {
+			return
+		}
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "could not get file %q: %v\n", id, err)
-			continue
+			fmt.Fprintf(os.Stderr, "could not get file %x: %v\n", sha256sum, err)
+			return
+		}
+		file := &shade.File{}
+		if err := file.FromJSON(fileJSON); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		if !match(file.Filename) {
+			return
 		}
-		err = json.Unmarshal(fileJSON, file)
+		fn(ids[string(sha256sum)], sha256sum, file)
+		if found++; limit > 0 && found >= limit {
+			cancel()
+		}
+	})
+	if err == context.Canceled {
+		return nil // the limit was reached
+	}
+	return err
+}
+
+// jsonFile is the description of each file printed by listJSON.
+type jsonFile struct {
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Chunksize int       `json:"chunksize"`
+	Chunks    int       `json:"chunks"`
+	Mtime     time.Time `json:"mtime"`
+	Sum       string    `json:"sum"`
+}
+
+// listJSON prints a JSON array describing the files known to client to out,
+// for which match returns true.  If limit is positive, it describes at most
+// limit files.
+func listJSON(out io.Writer, client drive.Client, match func(string) bool, limit int) error {
+	files := []jsonFile{}
+	err := eachFile(client, match, limit, func(_ int, sha256sum []byte, file *shade.File) {
+		files = append(files, jsonFile{
+			Filename:  file.Filename,
+			Size:      file.Filesize,
+			Chunksize: file.Chunksize,
+			Chunks:    len(file.Chunks),
+			Mtime:     file.ModifiedTime,
+			Sum:       hex.EncodeToString(sha256sum),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(files)
+}
+
+// listTree prints the directory hierarchy of the files known to client to
+// out, indenting the contents of each directory below it.  Only files for
+// which match returns true, and the directories which contain them, are
+// printed.
+func listTree(out io.Writer, client drive.Client, match func(string) bool) error {
+	tree, err := fusefs.NewTree(client, nil)
+	if err != nil {
+		return err
+	}
+	root, err := tree.NodeByPath("")
+	if err != nil {
+		return errors.New("no root directory in the tree")
+	}
+	var lines []string
+	printTree(tree, root, 0, match, &lines)
+	for _, line := range lines {
+		fmt.Fprintln(out, line)
+	}
+	return nil
+}
+
+// printTree appends a line for each matching descendant of dir to lines, and
+// returns true if there were any.
+func printTree(tree *fusefs.Tree, dir fusefs.Node, depth int, match func(string) bool, lines *[]string) bool {
+	var children []string
+	for child := range dir.Children {
+		children = append(children, child)
+	}
+	sort.Strings(children)
+	var found bool
+	for _, child := range children {
+		n, err := tree.NodeByPath(path.Join(dir.Filename, child))
 		if err != nil {
-			fmt.Printf("failed to unmarshal: %v\n", err)
-			continue
+			continue // deleted
 		}
-		if p.long {
-			fmt.Fprintf(w, "\t%v\t(%x)\t%v\t%v\t%v\t%v\t%v\n", id, sha256sum, file.Filesize, file.Chunksize, file.Chunks, file.ModifiedTime.Format(time.Stamp), file.Filename)
+		indent := strings.Repeat("  ", depth)
+		if n.IsDir() {
+			// only print the directory if it has matching descendants
+			*lines = append(*lines, indent+child+"/")
+			if !printTree(tree, n, depth+1, match, lines) {
+				*lines = (*lines)[:len(*lines)-1]
+				continue
+			}
+		} else if !match(n.Filename) {
+			continue
 		} else {
-			fmt.Fprintf(w, "\t%v\n", file.Filename)
+			*lines = append(*lines, indent+child)
 		}
+		found = true
 	}
-	w.Flush()
-	return subcommands.ExitSuccess
+	return found
+}
+
+// matcher returns a function which reports whether a filename has prefix,
+// and matches glob with matchGlob, if glob is not empty.  It returns an error
+// if glob is malformed.
+func matcher(glob, prefix string) (func(string) bool, error) {
+	for _, elem := range strings.Split(glob, "/") {
+		if _, err := path.Match(elem, ""); err != nil {
+			return nil, err
+		}
+	}
+	return func(filename string) bool {
+		if !strings.HasPrefix(filename, prefix) {
+			return false
+		}
+		if glob == "" {
+			return true
+		}
+		ok, _ := matchGlob(glob, filename)
+		return ok
+	}, nil
+}
+
+// matchGlob reports whether name matches the shell pattern, as path.Match
+// does, except that a "**" path element matches zero or more path elements.
+func matchGlob(pattern, name string) (bool, error) {
+	return matchElems(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElems(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if ok, err := matchElems(pattern[1:], name[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		ok, err := path.Match(pattern[0], name[0])
+		if !ok || err != nil {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
 }
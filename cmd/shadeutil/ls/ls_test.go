@@ -0,0 +1,288 @@
+package ls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/encrypt"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+var testFilenames = []string{
+	"photos/2022/beach.jpg",
+	"photos/2023/city.jpg",
+	"photos/2023/trip/mountain.jpg",
+	"docs/taxes.pdf",
+}
+
+// newPopulatedClient returns a memory client, with a shade.File for each of
+// testFilenames.
+func newPopulatedClient(t *testing.T) drive.Client {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	populate(t, mc)
+	return mc
+}
+
+// populate puts a shade.File for each of testFilenames into client.
+func populate(t *testing.T, client drive.Client) {
+	for _, fn := range testFilenames {
+		jm, err := json.Marshal(shade.NewFile(fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.PutFile(shade.Sum(jm), jm); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// listed returns the filenames printed by list, in the short format.
+func listed(t *testing.T, client drive.Client, match func(string) bool) map[string]bool {
+	buf := &bytes.Buffer{}
+	if err := list(buf, client, false, match, 0); err != nil {
+		t.Fatal(err)
+	}
+	resp := make(map[string]bool)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if fn := strings.TrimSpace(line); fn != "" {
+			resp[fn] = true
+		}
+	}
+	return resp
+}
+
+func TestListMatching(t *testing.T) {
+	mc := newPopulatedClient(t)
+	testCases := []struct {
+		glob   string
+		prefix string
+		want   []string
+	}{
+		{"", "", testFilenames},
+		{"photos/2023/**", "", []string{"photos/2023/city.jpg", "photos/2023/trip/mountain.jpg"}},
+		{"photos/*/*.jpg", "", []string{"photos/2022/beach.jpg", "photos/2023/city.jpg"}},
+		{"**/*.pdf", "", []string{"docs/taxes.pdf"}},
+		{"", "photos/2022", []string{"photos/2022/beach.jpg"}},
+		{"**/*.jpg", "photos/2023/trip", []string{"photos/2023/trip/mountain.jpg"}},
+	}
+	for _, tc := range testCases {
+		match, err := matcher(tc.glob, tc.prefix)
+		if err != nil {
+			t.Fatalf("matcher(%q, %q): %s", tc.glob, tc.prefix, err)
+		}
+		got := listed(t, mc, match)
+		if len(got) != len(tc.want) {
+			t.Errorf("-path %q -prefix %q: want %d files, got %d: %v", tc.glob, tc.prefix, len(tc.want), len(got), got)
+		}
+		for _, fn := range tc.want {
+			if !got[fn] {
+				t.Errorf("-path %q -prefix %q: missing %s", tc.glob, tc.prefix, fn)
+			}
+		}
+	}
+}
+
+func TestMatcherRejectsMalformedGlob(t *testing.T) {
+	if _, err := matcher("photos/[/*.jpg", ""); err == nil {
+		t.Error("matcher accepted a malformed -path")
+	}
+}
+
+func TestListEncrypted(t *testing.T) {
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derBytes := x509.MarshalPKCS1PrivateKey(privkey)
+	b := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: derBytes}
+	ec, err := encrypt.NewClient(drive.Config{
+		Provider:      "encrypt",
+		RsaPrivateKey: string(pem.EncodeToMemory(b)),
+		Write:         true,
+		Children:      []drive.Config{{Provider: "memory", Write: true}},
+	})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	populate(t, ec)
+
+	got := listed(t, ec, func(string) bool { return true })
+	if len(got) != len(testFilenames) {
+		t.Errorf("want %d files, got %d: %v", len(testFilenames), len(got), got)
+	}
+	for _, fn := range testFilenames {
+		if !got[fn] {
+			t.Errorf("missing %s", fn)
+		}
+	}
+}
+
+func TestListJSON(t *testing.T) {
+	mc := newPopulatedClient(t)
+	buf := &bytes.Buffer{}
+	if err := listJSON(buf, mc, func(string) bool { return true }, 0); err != nil {
+		t.Fatal(err)
+	}
+	var files []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &files); err != nil {
+		t.Fatalf("output is not a JSON array of objects: %s\n%s", err, buf)
+	}
+	if len(files) != len(testFilenames) {
+		t.Fatalf("want %d files, got %d", len(testFilenames), len(files))
+	}
+	want := []string{"chunks", "chunksize", "filename", "mtime", "size", "sum"}
+	seen := make(map[string]bool)
+	for _, f := range files {
+		var keys []string
+		for k := range f {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("want keys %v, got: %v", want, keys)
+		}
+		fn, _ := f["filename"].(string)
+		seen[fn] = true
+		sum, err := hex.DecodeString(f["sum"].(string))
+		if err != nil {
+			t.Errorf("sum of %s is not hex: %s", fn, err)
+			continue
+		}
+		if _, err := mc.GetFile(sum); err != nil {
+			t.Errorf("sum of %s does not identify a file: %s", fn, err)
+		}
+	}
+	for _, fn := range testFilenames {
+		if !seen[fn] {
+			t.Errorf("missing %s", fn)
+		}
+	}
+
+	// An empty listing is still an array.
+	buf.Reset()
+	if err := listJSON(buf, mc, func(string) bool { return false }, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(buf.String()); got != "[]" {
+		t.Errorf("want an empty array, got: %s", got)
+	}
+}
+
+func TestListTree(t *testing.T) {
+	mc := newPopulatedClient(t)
+	testCases := []struct {
+		glob string
+		want string
+	}{
+		{"", `docs/
+  taxes.pdf
+photos/
+  2022/
+    beach.jpg
+  2023/
+    city.jpg
+    trip/
+      mountain.jpg
+`},
+		{"photos/2023/**", `photos/
+  2023/
+    city.jpg
+    trip/
+      mountain.jpg
+`},
+		{"**/*.pdf", `docs/
+  taxes.pdf
+`},
+		{"**/*.png", ""},
+	}
+	for _, tc := range testCases {
+		match := func(filename string) bool {
+			if tc.glob == "" {
+				return true
+			}
+			ok, _ := matchGlob(tc.glob, filename)
+			return ok
+		}
+		buf := &bytes.Buffer{}
+		if err := listTree(buf, mc, match); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("-path %q: want:\n%s\ngot:\n%s", tc.glob, tc.want, got)
+		}
+	}
+}
+
+// countingClient counts the calls to GetFile.
+type countingClient struct {
+	drive.Client
+	mu    sync.Mutex
+	calls int
+}
+
+func (c *countingClient) GetFile(sha256sum []byte) ([]byte, error) {
+	c.mu.Lock()
+	c.calls++
+	c.mu.Unlock()
+	return c.Client.GetFile(sha256sum)
+}
+
+func TestListLimit(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	numFiles := 100
+	for i := 0; i < numFiles; i++ {
+		jm, err := json.Marshal(shade.NewFile(fmt.Sprintf("file%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mc.PutFile(shade.Sum(jm), jm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cc := &countingClient{Client: mc}
+	buf := &bytes.Buffer{}
+	if err := list(buf, cc, false, func(string) bool { return true }, 5); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 5 {
+		t.Errorf("want 5 files listed, got %d:\n%s", lines, buf)
+	}
+	// Fetches in flight or buffered when the limit is reached may complete.
+	cc.mu.Lock()
+	calls := cc.calls
+	cc.mu.Unlock()
+	if calls > 5+2*parallelFetches+1 {
+		t.Errorf("fetched %d of %d files to list 5", calls, numFiles)
+	}
+
+	buf.Reset()
+	if err := listJSON(buf, cc, func(string) bool { return true }, 5); err != nil {
+		t.Fatal(err)
+	}
+	var files []jsonFile
+	if err := json.Unmarshal(buf.Bytes(), &files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 5 {
+		t.Errorf("want 5 files described, got %d", len(files))
+	}
+}
@@ -0,0 +1,186 @@
+// Package orphans provides a subcommand to list, and optionally release, the
+// chunks which are not referenced by any file in use.
+package orphans
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/umbrella"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&orphansCmd{}, "")
+}
+
+type orphansCmd struct {
+	json   bool
+	delete bool
+}
+
+func (*orphansCmd) Name() string     { return "orphans" }
+func (*orphansCmd) Synopsis() string { return "List, and optionally release, unreferenced chunks." }
+func (*orphansCmd) Usage() string {
+	return `orphans [-json] [-delete]:
+  List the chunks which are not referenced by any file in use, or by a pinned
+  version; the chunks cleanup would release.  The size and modification time
+  of each are as reported by the configured client, and the total is printed
+  last.
+
+  With -delete, after listing the chunks, ask for confirmation on standard
+  input, and then release them.  The chunks are found again while the
+  repository is locked, and any which have been referenced since they were
+  listed are kept.  Unlike cleanup, no -maxChunksDelete limit applies.
+`
+}
+
+func (p *orphansCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&p.json, "json", false, "List the chunks as a JSON array")
+	f.BoolVar(&p.delete, "delete", false, "After listing the chunks, ask for confirmation to release them")
+}
+
+func (p *orphansCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	// read in the config
+	configPath := args[0].(*string)
+	config, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Printf("could not read config: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	// initialize client
+	client, err := drive.NewClient(config)
+	if err != nil {
+		fmt.Printf("could not initialize client: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	orphans, err := umbrella.FindOrphans(client)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	if p.json {
+		err = listJSON(os.Stdout, orphans)
+	} else {
+		err = list(os.Stdout, orphans)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	if !p.delete || len(orphans) == 0 {
+		return subcommands.ExitSuccess
+	}
+	// The prompt is written to stderr, so that it does not interrupt -json.
+	if !confirm(os.Stderr, os.Stdin, orphans) {
+		fmt.Fprintln(os.Stderr, "no chunks were released")
+		return subcommands.ExitSuccess
+	}
+	if err := release(os.Stderr, client, orphans); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// total returns the sum of the sizes of orphans.
+func total(orphans []umbrella.Orphan) int64 {
+	var size int64
+	for _, o := range orphans {
+		size += o.Size
+	}
+	return size
+}
+
+// list prints each of orphans, and then their total size, to out.
+func list(out io.Writer, orphans []umbrella.Orphan) error {
+	w := &tabwriter.Writer{}
+	w.Init(out, 0, 2, 1, ' ', 0)
+	fmt.Fprint(w, "size\tmtime\tchunk\n")
+	for _, o := range orphans {
+		mtime := "-"
+		if !o.ModTime.IsZero() {
+			mtime = o.ModTime.Format(time.Stamp)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%x\n", o.Size, mtime, o.Sha256)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "%d unreferenced chunk(s), %d bytes\n", len(orphans), total(orphans))
+	return err
+}
+
+// jsonOrphan is the JSON representation of an umbrella.Orphan.
+type jsonOrphan struct {
+	Sum   string     `json:"sum"`
+	Size  int64      `json:"size"`
+	Mtime *time.Time `json:"mtime,omitempty"`
+}
+
+// listJSON prints orphans to out as a JSON array.  The mtime is omitted if
+// the client does not track it.
+func listJSON(out io.Writer, orphans []umbrella.Orphan) error {
+	chunks := []jsonOrphan{}
+	for _, o := range orphans {
+		jo := jsonOrphan{Sum: hex.EncodeToString(o.Sha256), Size: o.Size}
+		if !o.ModTime.IsZero() {
+			mtime := o.ModTime
+			jo.Mtime = &mtime
+		}
+		chunks = append(chunks, jo)
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(chunks)
+}
+
+// confirm asks on out whether to release orphans, and returns true if the
+// answer read from in is yes.
+func confirm(out io.Writer, in io.Reader, orphans []umbrella.Orphan) bool {
+	fmt.Fprintf(out, "Release %d unreferenced chunk(s), %d bytes? [y/N] ", len(orphans), total(orphans))
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// release releases orphans from client, and reports the outcome to out.
+func release(out io.Writer, client drive.Client, orphans []umbrella.Orphan) error {
+	sums := make([][]byte, 0, len(orphans))
+	for _, o := range orphans {
+		sums = append(sums, o.Sha256)
+	}
+	released, failed, err := umbrella.ReleaseOrphans(client, sums)
+	if err != nil {
+		return err
+	}
+	if err := drive.Flush(client); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "released %d chunk(s)", released)
+	if kept := len(sums) - released - failed; kept > 0 {
+		fmt.Fprintf(out, ", kept %d which are now referenced", kept)
+	}
+	fmt.Fprintln(out)
+	if failed > 0 {
+		return fmt.Errorf("could not release %d chunk(s)", failed)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package orphans
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+	"github.com/asjoyner/shade/umbrella"
+)
+
+func TestListJSON(t *testing.T) {
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	orphans := []umbrella.Orphan{
+		{Sha256: []byte{0xab, 0xcd}, Size: 100, ModTime: mtime},
+		{Sha256: []byte{0x12}, Size: 7},
+	}
+	buf := &bytes.Buffer{}
+	if err := listJSON(buf, orphans); err != nil {
+		t.Fatal(err)
+	}
+	var got []jsonOrphan
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("could not parse %q: %s", buf.String(), err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("listJSON printed %d chunks, want 2", len(got))
+	}
+	if got[0].Sum != "abcd" || got[0].Size != 100 || got[0].Mtime == nil || !got[0].Mtime.Equal(mtime) {
+		t.Errorf("listJSON printed %+v for the first chunk", got[0])
+	}
+	if got[1].Sum != "12" || got[1].Mtime != nil {
+		t.Errorf("listJSON printed %+v for the second chunk, want no mtime", got[1])
+	}
+
+	buf.Reset()
+	if err := listJSON(buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(buf.String()) != "[]" {
+		t.Errorf("listJSON printed %q for no chunks, want []", buf.String())
+	}
+}
+
+func TestConfirmAndRelease(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	sum, data := drive.RandChunk()
+	if err := mc.PutChunk(sum, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	orphans, err := umbrella.FindOrphans(mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := list(buf, orphans); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), hex.EncodeToString(sum)) {
+		t.Errorf("list did not print the orphan %x:\n%s", sum, buf.String())
+	}
+
+	for _, answer := range []string{"", "n\n", "no\n"} {
+		if confirm(&bytes.Buffer{}, strings.NewReader(answer), orphans) {
+			t.Errorf("confirm(%q) returned true", answer)
+		}
+	}
+	if !confirm(&bytes.Buffer{}, strings.NewReader("Y\n"), orphans) {
+		t.Error("confirm(\"Y\") returned false")
+	}
+
+	if err := release(buf, mc, orphans); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mc.GetChunk(sum, nil); err == nil {
+		t.Error("the orphan was not released")
+	}
+}
@@ -0,0 +1,97 @@
+// Package pin provides subcommands to pin versions of files, so that cleanup
+// and compact never release them.
+package pin
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/umbrella"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&pinCmd{}, "")
+	subcommands.Register(&pinCmd{unpin: true}, "")
+}
+
+type pinCmd struct {
+	unpin bool
+}
+
+func (p *pinCmd) Name() string {
+	if p.unpin {
+		return "unpin"
+	}
+	return "pin"
+}
+
+func (p *pinCmd) Synopsis() string {
+	if p.unpin {
+		return "Allow a pinned version of a file to be released."
+	}
+	return "Keep a version of a file forever."
+}
+
+func (p *pinCmd) Usage() string {
+	if p.unpin {
+		return `unpin <sum>:
+  Remove the file object with the given hex encoded sum from the pins, so
+  that cleanup and compact may release it once it is obsolete.
+`
+	}
+	return fmt.Sprintf(`pin <sum>:
+  Add the file object with the given hex encoded sum, as printed by the
+  versions subcommand, to the pins.  Cleanup and compact never release a
+  pinned version, or its chunks.  The pins are stored in the repository as
+  the file %q.
+`, umbrella.PinsFilename)
+}
+
+func (p *pinCmd) SetFlags(f *flag.FlagSet) {}
+
+func (p *pinCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	configPath := args[0].(*string)
+	if f.NArg() != 1 {
+		fmt.Printf("unexpected number of arguments to %s; want: 1, got: %d\n", p.Name(), f.NArg())
+		return subcommands.ExitFailure
+	}
+	sum, err := hex.DecodeString(f.Arg(0))
+	if err != nil {
+		fmt.Printf("invalid sum %q: %s\n", f.Arg(0), err)
+		return subcommands.ExitFailure
+	}
+
+	// read in the config
+	config, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Printf("could not read config: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	// initialize client
+	client, err := drive.NewClient(config)
+	if err != nil {
+		fmt.Printf("could not initialize client: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	update := umbrella.Pin
+	if p.unpin {
+		update = umbrella.Unpin
+	}
+	if err := update(client, sum); err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	if err := drive.Close(client); err != nil {
+		fmt.Printf("Close: %v\n", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
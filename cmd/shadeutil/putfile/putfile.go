@@ -63,5 +63,9 @@ func (p *putfileCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interfa
 		fmt.Fprintf(os.Stderr, "PutChunk: %v\n", err)
 		return subcommands.ExitFailure
 	}
+	if err := drive.Close(client); err != nil {
+		fmt.Fprintf(os.Stderr, "Close: %v\n", err)
+		return subcommands.ExitFailure
+	}
 	return subcommands.ExitSuccess
 }
@@ -0,0 +1,133 @@
+// Package reencrypt provides a subcommand to copy a Shade repository into
+// another, encrypting (or decrypting) it with the keys of the destination.
+package reencrypt
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&reencryptCmd{}, "")
+}
+
+type reencryptCmd struct{}
+
+func (*reencryptCmd) Name() string { return "reencrypt" }
+func (*reencryptCmd) Synopsis() string {
+	return "Copy a repository, encrypting it with the destination's keys."
+}
+func (*reencryptCmd) Usage() string {
+	return `reencrypt <SOURCE CONFIG> <DEST CONFIG>:
+  Copy every file in the source repository, and its chunks, into the
+  destination repository.  Unlike sync, each file is read through the source
+  config, decrypting it if it is encrypted, and written through the
+  destination config, encrypting it if it is encrypted.  Use it to migrate a
+  plaintext repository to an encrypted one, to export an encrypted repository
+  as plaintext, or to rotate keys.
+
+  Each file is given a new AES key and new chunk nonces, so the sums its
+  chunks and file object are stored at differ from the source.
+`
+}
+
+func (p *reencryptCmd) SetFlags(f *flag.FlagSet) {}
+
+func (p *reencryptCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 2 {
+		fmt.Printf("unexpected number of arguments to reencrypt; want: 2, got: %d\n", f.NArg())
+		return subcommands.ExitFailure
+	}
+	var clients []drive.Client
+	for _, configPath := range f.Args() {
+		config, err := config.Read(configPath)
+		if err != nil {
+			fmt.Printf("could not read config %s: %v\n", configPath, err)
+			return subcommands.ExitFailure
+		}
+		client, err := drive.NewClient(config)
+		if err != nil {
+			fmt.Printf("could not initialize client for %s: %s\n", configPath, err)
+			return subcommands.ExitFailure
+		}
+		clients = append(clients, client)
+	}
+
+	err := Reencrypt(clients[0], clients[1], os.Stdout)
+	for _, client := range clients {
+		if cerr := drive.Close(client); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// Reencrypt copies every file known to src, and its chunks, to dst.  Progress
+// is reported to out.
+//
+// Each file is copied with a new AES key and new chunk nonces, as the nonces
+// must not be reused with a different key.  Its chunks are put before the
+// file, so that dst never has a file which refers to a chunk it does not
+// have.
+func Reencrypt(src, dst drive.Client, out io.Writer) error {
+	sums, err := src.ListFiles()
+	if err != nil {
+		return fmt.Errorf("could not list files: %s", err)
+	}
+	for i, sum := range sums {
+		fj, err := src.GetFile(sum)
+		if err != nil {
+			return fmt.Errorf("could not get file %x: %s", sum, err)
+		}
+		f := &shade.File{}
+		if err := f.FromJSON(fj); err != nil {
+			return fmt.Errorf("could not unmarshal file %x: %s", sum, err)
+		}
+		if err := copyFile(src, dst, f); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "copied %d/%d file(s)\n", i+1, len(sums))
+	}
+	return nil
+}
+
+// copyFile copies f and its chunks from src to dst, with a new AES key and
+// chunk nonces.
+func copyFile(src, dst drive.Client, f *shade.File) error {
+	nf := *f
+	nf.AesKey = shade.NewSymmetricKey()
+	nf.Chunks = make([]shade.Chunk, len(f.Chunks))
+	for i, c := range f.Chunks {
+		nf.Chunks[i] = shade.Chunk{Index: c.Index, Sha256: c.Sha256, Nonce: shade.NewNonce()}
+	}
+	for _, c := range f.Chunks {
+		data, err := src.GetChunk(c.Sha256, f)
+		if err != nil {
+			return drive.NewMissingChunkError(c.Sha256, f, err)
+		}
+		if err := dst.PutChunk(c.Sha256, data, &nf); err != nil {
+			return fmt.Errorf("could not put chunk %x of %s: %s", c.Sha256, f.Filename, err)
+		}
+	}
+	fj, err := nf.ToJSON()
+	if err != nil {
+		return err
+	}
+	if err := dst.PutFile(shade.Sum(fj), fj); err != nil {
+		return fmt.Errorf("could not put file %s: %s", f.Filename, err)
+	}
+	return nil
+}
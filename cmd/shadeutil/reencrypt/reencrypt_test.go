@@ -0,0 +1,132 @@
+package reencrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/cmd/shadeutil/cat"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/encrypt"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+// encryptedClient returns an encrypt client, with a new key, wrapping a memory
+// client.
+func encryptedClient(t *testing.T) drive.Client {
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privkey)}
+	client, err := encrypt.NewClient(drive.Config{
+		Provider:      "encrypt",
+		RsaPrivateKey: string(pem.EncodeToMemory(b)),
+		Children:      []drive.Config{{Provider: "memory", Write: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// catFile returns the contents of the only file in client.
+func catFile(t *testing.T, client drive.Client) []byte {
+	sums, err := client.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sums) != 1 {
+		t.Fatalf("want 1 file, got: %d", len(sums))
+	}
+	fj, err := client.GetFile(sums[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &shade.File{}
+	if err := f.FromJSON(fj); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := cat.WriteFile(buf, client, f); err != nil {
+		t.Fatalf("WriteFile(): %s", err)
+	}
+	return buf.Bytes()
+}
+
+// chunkSums returns the sums client stores chunks at.
+func chunkSums(t *testing.T, client drive.Client) map[string]bool {
+	sums := make(map[string]bool)
+	lister := client.NewChunkLister()
+	for lister.Next() {
+		sums[string(lister.Sha256())] = true
+	}
+	if err := lister.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return sums
+}
+
+func TestReencrypt(t *testing.T) {
+	plain, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := shade.NewFileWithChunksize("file", 4)
+	for i, c := range []string{"abcd", "efgh", "ij"} {
+		sum := shade.Sum([]byte(c))
+		f.Chunks = append(f.Chunks, shade.Chunk{Index: i, Sha256: sum})
+		if err := plain.PutChunk(sum, []byte(c), f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.LastChunksize = 2
+	f.UpdateFilesize()
+	fj, err := f.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.PutFile(shade.Sum(fj), fj); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := encryptedClient(t)
+	if err := Reencrypt(plain, encrypted, ioutil.Discard); err != nil {
+		t.Fatalf("Reencrypt(plain, encrypted): %s", err)
+	}
+	want := "abcdefghij"
+	if got := catFile(t, plain); string(got) != want {
+		t.Errorf("plaintext repo: want %q, got: %q", want, got)
+	}
+	if got := catFile(t, encrypted); string(got) != want {
+		t.Errorf("encrypted repo: want %q, got: %q", want, got)
+	}
+	plainSums := chunkSums(t, plain)
+	for sum := range chunkSums(t, encrypted) {
+		if plainSums[sum] {
+			t.Errorf("encrypted repo stores a chunk at its plaintext sum %x", sum)
+		}
+	}
+
+	// And back again, with a new key.
+	decrypted, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Reencrypt(encrypted, decrypted, ioutil.Discard); err != nil {
+		t.Fatalf("Reencrypt(encrypted, decrypted): %s", err)
+	}
+	if got := catFile(t, decrypted); string(got) != want {
+		t.Errorf("decrypted repo: want %q, got: %q", want, got)
+	}
+	// Plaintext chunks are stored at their sums, so they are identical.
+	if got := chunkSums(t, decrypted); !reflect.DeepEqual(got, plainSums) {
+		t.Errorf("want %d chunks at their plaintext sums in the decrypted repo, got: %d", len(plainSums), len(got))
+	}
+}
@@ -0,0 +1,217 @@
+// Package repair provides a subcommand to find file objects which cannot be
+// read, and to re-publish them from a backup or from the sums of their
+// chunks.
+package repair
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/umbrella"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&repairCmd{}, "")
+}
+
+type repairCmd struct {
+	backup   string
+	filename string
+}
+
+func (*repairCmd) Name() string     { return "repair" }
+func (*repairCmd) Synopsis() string { return "Find and re-publish corrupt file objects." }
+func (*repairCmd) Usage() string {
+	return `repair:
+  Fetch every file object, and report the sum of each which cannot be
+  retrieved or unmarshalled.  Such files are missing from the tree.
+
+repair -backup <PATH>:
+  Re-publish the unencrypted file object saved at PATH, after checking that it
+  unmarshals and that each of its chunks can be read.  It is stored at the sum
+  of its contents, so a backup of a corrupt object replaces it.
+
+repair -filename <NAME> <SUM> [<SUM>...]:
+  Publish a new file object named NAME, whose chunks are the hex encoded SUMs,
+  in order, after checking that each can be read.  The AES key of a file
+  cannot be recovered from its chunks, so this only works for chunks which
+  were stored unencrypted.
+`
+}
+
+func (p *repairCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.backup, "backup", "", "The path of a backup of a file object to re-publish.")
+	f.StringVar(&p.filename, "filename", "", "The name of a file to reconstruct from the sums of its chunks.")
+}
+
+func (p *repairCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	configPath := args[0].(*string)
+	if p.backup != "" && p.filename != "" {
+		fmt.Println("-backup and -filename are mutually exclusive")
+		return subcommands.ExitFailure
+	}
+	if p.filename == "" && f.NArg() != 0 {
+		fmt.Printf("unexpected number of arguments to repair; want: 0, got: %d\n", f.NArg())
+		return subcommands.ExitFailure
+	}
+	if p.filename != "" && f.NArg() == 0 {
+		fmt.Println("-filename requires the sums of the file's chunks")
+		return subcommands.ExitFailure
+	}
+
+	// read in the config
+	config, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Printf("could not read config: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	// initialize client
+	client, err := drive.NewClient(config)
+	if err != nil {
+		fmt.Printf("could not initialize client: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	switch {
+	case p.backup != "":
+		fj, err := ioutil.ReadFile(p.backup)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return subcommands.ExitFailure
+		}
+		if err := restoreBackup(client, fj); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return subcommands.ExitFailure
+		}
+	case p.filename != "":
+		var sums [][]byte
+		for _, arg := range f.Args() {
+			sum, err := hex.DecodeString(arg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid sum %q: %s\n", arg, err)
+				return subcommands.ExitFailure
+			}
+			sums = append(sums, sum)
+		}
+		if _, err := umbrella.FetchParams(client); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return subcommands.ExitFailure
+		}
+		if _, err := reconstruct(client, p.filename, sums); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return subcommands.ExitFailure
+		}
+	default:
+		n, err := scan(os.Stdout, client)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return subcommands.ExitFailure
+		}
+		if n > 0 {
+			fmt.Printf("found %d corrupt file object(s)\n", n)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+	if err := drive.Close(client); err != nil {
+		fmt.Fprintf(os.Stderr, "Close: %v\n", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// scan fetches every file object known to client, and prints the sum of each
+// which cannot be retrieved or unmarshalled to w, with the reason.  It returns
+// the number of such file objects.
+func scan(w io.Writer, client drive.Client) (int, error) {
+	sums, err := client.ListFiles()
+	if err != nil {
+		return 0, fmt.Errorf("could not list files: %s", err)
+	}
+	var corrupt int
+	for _, sum := range sums {
+		fj, err := client.GetFile(sum)
+		if err != nil {
+			fmt.Fprintf(w, "%x  could not be retrieved: %s\n", sum, err)
+			corrupt++
+			continue
+		}
+		f := &shade.File{}
+		if err := f.FromJSON(fj); err != nil {
+			fmt.Fprintf(w, "%x  could not be unmarshalled: %s\n", sum, err)
+			corrupt++
+		}
+	}
+	return corrupt, nil
+}
+
+// checkChunks returns an error if any of the chunks of f cannot be read.
+func checkChunks(client drive.Client, f *shade.File) error {
+	for _, c := range f.Chunks {
+		if _, err := client.GetChunk(c.Sha256, f); err != nil {
+			return drive.NewMissingChunkError(c.Sha256, f, err)
+		}
+	}
+	return nil
+}
+
+// restoreBackup publishes the file object fj, if it unmarshals and each of
+// its chunks can be read.
+func restoreBackup(client drive.Client, fj []byte) error {
+	f := &shade.File{}
+	if err := f.FromJSON(fj); err != nil {
+		return fmt.Errorf("backup could not be unmarshalled: %s", err)
+	}
+	if err := checkChunks(client, f); err != nil {
+		return err
+	}
+	if err := client.PutFile(shade.Sum(fj), fj); err != nil {
+		return fmt.Errorf("could not put file %s: %s", f.Filename, err)
+	}
+	return nil
+}
+
+// reconstruct publishes a new file object for filename, whose chunks are
+// sums, in order.  Each chunk is read to find its size.  Every chunk but the
+// last must be the same size, which becomes the Chunksize of the file, and the
+// last may not be larger.
+func reconstruct(client drive.Client, filename string, sums [][]byte) (*shade.File, error) {
+	f := shade.NewFile(filename)
+	for i, sum := range sums {
+		chunk, err := client.GetChunk(sum, f)
+		if err != nil {
+			return nil, drive.NewMissingChunkError(sum, f, err)
+		}
+		switch {
+		case i == 0 && len(sums) > 1:
+			f.Chunksize = len(chunk)
+		case i < len(sums)-1 && len(chunk) != f.Chunksize:
+			return nil, fmt.Errorf("chunk %d (%x) is %d bytes, but chunk 0 is %d bytes", i, sum, len(chunk), f.Chunksize)
+		case i > 0 && len(chunk) > f.Chunksize:
+			return nil, fmt.Errorf("the last chunk (%x) is %d bytes, longer than chunk 0 (%d bytes)", sum, len(chunk), f.Chunksize)
+		}
+		f.Chunks = append(f.Chunks, shade.Chunk{Index: i, Sha256: sum})
+		f.LastChunksize = len(chunk)
+	}
+	f.UpdateFilesize()
+	f.UpdateDigest()
+	fj, err := f.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	if err := client.PutFile(shade.Sum(fj), fj); err != nil {
+		return nil, fmt.Errorf("could not put file %s: %s", filename, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,98 @@
+package repair
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+func TestScan(t *testing.T) {
+	client, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := shade.NewFile("good")
+	fj, err := good.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PutFile(shade.Sum(fj), fj); err != nil {
+		t.Fatal(err)
+	}
+	// a file object truncated in storage
+	corruptSum := shade.Sum([]byte("the original file object"))
+	if err := client.PutFile(corruptSum, fj[:len(fj)/2]); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := scan(buf, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("want 1 corrupt file object, got: %d", n)
+	}
+	if !strings.Contains(buf.String(), fmt.Sprintf("%x", corruptSum)) {
+		t.Errorf("scan did not report %x: %q", corruptSum, buf.String())
+	}
+	if strings.Contains(buf.String(), fmt.Sprintf("%x", shade.Sum(fj))) {
+		t.Errorf("scan reported the good file object: %q", buf.String())
+	}
+}
+
+func TestRepair(t *testing.T) {
+	client, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := [][]byte{[]byte("0123"), []byte("4567"), []byte("89")}
+	var sums [][]byte
+	for _, c := range chunks {
+		sum := shade.Sum(c)
+		if err := client.PutChunk(sum, c, nil); err != nil {
+			t.Fatal(err)
+		}
+		sums = append(sums, sum)
+	}
+
+	f, err := reconstruct(client, "rebuilt", sums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Filesize != 10 || f.Chunksize != 4 || f.LastChunksize != 2 {
+		t.Errorf("want a 10 byte file of 4 byte chunks, got: %s", f)
+	}
+	if n, err := scan(&bytes.Buffer{}, client); err != nil || n != 0 {
+		t.Errorf("scan after reconstruct: %d corrupt, %v", n, err)
+	}
+	if _, err := reconstruct(client, "bad", [][]byte{sums[2], sums[0]}); err == nil {
+		t.Error("reconstructed a file whose first chunk is short")
+	}
+	if _, err := reconstruct(client, "missing", [][]byte{shade.Sum([]byte("missing"))}); err == nil {
+		t.Error("reconstructed a file with a missing chunk")
+	}
+
+	// a backup replaces the corrupt object stored at its sum
+	fj, err := f.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PutFile(shade.Sum(fj), []byte("corrupt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreBackup(client, fj); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := scan(&bytes.Buffer{}, client); err != nil || n != 0 {
+		t.Errorf("scan after restoring the backup: %d corrupt, %v", n, err)
+	}
+	if err := restoreBackup(client, []byte("corrupt")); err == nil {
+		t.Error("restored a corrupt backup")
+	}
+}
@@ -0,0 +1,335 @@
+// Package selftest provides a subcommand to confirm that the configured
+// client can store, retrieve, list and release objects.
+package selftest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/compare"
+	"github.com/asjoyner/shade/drive/encrypt"
+	"github.com/asjoyner/shade/drive/memory"
+	"github.com/asjoyner/shade/repolock"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&selftestCmd{}, "")
+}
+
+type selftestCmd struct {
+	chunks     int
+	chunkBytes int
+}
+
+func (*selftestCmd) Name() string     { return "selftest" }
+func (*selftestCmd) Synopsis() string { return "Round-trip test data through the configured client." }
+func (*selftestCmd) Usage() string {
+	return `selftest [-chunks N] [-chunkBytes N]:
+  Confirm the configured client works end to end.  Random chunks, and a file
+  which refers to them, are written, read back and compared byte for byte,
+  found by listing the client, and then released.  The outcome and duration
+  of each step are printed.
+
+  The test file is stored as deleted, under a random name in the .selftest
+  directory, so it never appears in a mount, and every run uses new objects.
+  They are released even if a step fails.
+`
+}
+
+func (p *selftestCmd) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&p.chunks, "chunks", 4, "The number of random chunks to write")
+	f.IntVar(&p.chunkBytes, "chunkBytes", 64*1024, "The size of each random chunk")
+}
+
+func (p *selftestCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	// read in the config
+	configPath := args[0].(*string)
+	config, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Printf("could not read config: %v", err)
+		return subcommands.ExitFailure
+	}
+	if !config.Write {
+		fmt.Println("selftest requires a config which can Write")
+		return subcommands.ExitFailure
+	}
+
+	// initialize client
+	client, err := drive.NewClient(config)
+	if err != nil {
+		fmt.Printf("could not initialize client: %s\n", err)
+		return subcommands.ExitFailure
+	}
+	defer drive.Close(client)
+
+	if p.chunks < 1 || p.chunkBytes < 1 {
+		fmt.Fprintln(os.Stderr, "-chunks and -chunkBytes must be positive")
+		return subcommands.ExitFailure
+	}
+	if err := selftest(os.Stdout, client, p.chunks, p.chunkBytes); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// testData is the random file and chunks written by a selftest.
+type testData struct {
+	file     *shade.File
+	fileSum  []byte
+	fileJSON []byte
+	chunks   map[string][]byte // chunk bytes, by sum
+	// stored is the sum at which the client lists each chunk, by sum.  It
+	// differs from the sum of the chunk's bytes if the client encrypts them.
+	stored map[string][]byte
+}
+
+// newTestData returns a deleted file of n random chunks of size bytes.
+func newTestData(n, size int) (*testData, error) {
+	name := make([]byte, 8)
+	if _, err := rand.Read(name); err != nil {
+		return nil, err
+	}
+	td := &testData{
+		file:   shade.NewFileWithChunksize(".selftest/"+hex.EncodeToString(name), size),
+		chunks: make(map[string][]byte, n),
+		stored: make(map[string][]byte, n),
+	}
+	td.file.Deleted = true
+	for i := 0; i < n; i++ {
+		c := make([]byte, size)
+		if _, err := rand.Read(c); err != nil {
+			return nil, err
+		}
+		sum, err := td.file.Sum(c)
+		if err != nil {
+			return nil, err
+		}
+		chunk := shade.NewChunk()
+		chunk.Index = i
+		chunk.Sha256 = sum
+		td.file.Chunks = append(td.file.Chunks, chunk)
+		td.chunks[string(sum)] = c
+	}
+	td.file.LastChunksize = size
+	td.file.UpdateFilesize()
+	var err error
+	if td.fileJSON, err = td.file.ToJSON(); err != nil {
+		return nil, err
+	}
+	td.fileSum = shade.Sum(td.fileJSON)
+	return td, nil
+}
+
+// selftest writes a random file of n chunks of size bytes to client, checks
+// that they can be read back and listed, and then releases them.  The outcome
+// of each step is printed to out.  It returns an error if any step failed.
+func selftest(out io.Writer, client drive.Client, n, size int) error {
+	td, err := newTestData(n, size)
+	if err != nil {
+		return fmt.Errorf("could not generate test data: %s", err)
+	}
+	// Hold a shared lock, so a concurrent cleanup does not release the chunks
+	// before the file which refers to them is written.
+	lock, err := repolock.New(client.GetConfig().LockDir).Shared()
+	if err != nil {
+		fmt.Fprintf(out, "testing without the repository lock: %s\n", err)
+	}
+	defer lock.Unlock()
+
+	var failed int
+	step := func(name string, fn func() error) bool {
+		start := time.Now()
+		err := fn()
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL %-12s %8s  %s\n", name, elapsed, err)
+			return false
+		}
+		fmt.Fprintf(out, "PASS %-12s %8s\n", name, elapsed)
+		return true
+	}
+
+	fmt.Fprintf(out, "testing %q with file %x and %d chunk(s) of %d bytes\n", client.GetConfig().Provider, td.fileSum, n, size)
+	_ = step("ping", func() error { return client.Ping(context.Background()) }) &&
+		step("put chunks", func() error { return putChunks(client, td) }) &&
+		step("put file", func() error { return client.PutFile(td.fileSum, td.fileJSON) }) &&
+		step("flush", func() error { return drive.Flush(client) }) &&
+		step("get chunks", func() error { return getChunks(client, td) }) &&
+		step("get file", func() error { return getFile(client, td) }) &&
+		step("list", func() error { return list(client, td) }) &&
+		step("compare", func() error { return delta(client, td) })
+	// The objects are released even if a step failed, in case they were
+	// partially written.
+	step("release", func() error { return release(client, td) })
+
+	if failed > 0 {
+		return fmt.Errorf("%d step(s) failed", failed)
+	}
+	fmt.Fprintln(out, "all steps passed")
+	return nil
+}
+
+// putChunks writes each of the chunks of td to client.
+func putChunks(client drive.Client, td *testData) error {
+	for sum, c := range td.chunks {
+		if err := client.PutChunk([]byte(sum), c, td.file); err != nil {
+			return fmt.Errorf("chunk %x: %s", sum, err)
+		}
+	}
+	return nil
+}
+
+// getChunks fetches each of the chunks of td from client, and compares them
+// to the bytes which were written.
+func getChunks(client drive.Client, td *testData) error {
+	for sum, want := range td.chunks {
+		got, err := client.GetChunk([]byte(sum), td.file)
+		if err != nil {
+			return fmt.Errorf("chunk %x: %s", sum, err)
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("chunk %x: got %d bytes which differ from the %d written", sum, len(got), len(want))
+		}
+	}
+	return nil
+}
+
+// getFile fetches the file of td from client, and compares it to the bytes
+// which were written.
+func getFile(client drive.Client, td *testData) error {
+	got, err := client.GetFile(td.fileSum)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, td.fileJSON) {
+		return fmt.Errorf("got %d bytes which differ from the %d written", len(got), len(td.fileJSON))
+	}
+	return nil
+}
+
+// candidateSums returns the sums at which a client may store each chunk of
+// td, keyed by the sum they are stored at: the sum of its bytes, and its sum
+// as encrypted by the encrypt client, if the file has an AesKey.
+func candidateSums(td *testData) (map[string][]byte, error) {
+	candidates := make(map[string][]byte, 2*len(td.file.Chunks))
+	for _, c := range td.file.Chunks {
+		candidates[string(c.Sha256)] = c.Sha256
+	}
+	if td.file.AesKey == nil {
+		return candidates, nil
+	}
+	esums, err := encrypt.GetAllEncryptedSums(td.file)
+	if err != nil {
+		return nil, err
+	}
+	for i, c := range td.file.Chunks {
+		candidates[string(esums[i])] = c.Sha256
+	}
+	return candidates, nil
+}
+
+// list checks that the client lists the file and each chunk of td, and
+// records the sum at which each chunk is listed in td.stored.
+func list(client drive.Client, td *testData) error {
+	files, err := client.ListFiles()
+	if err != nil {
+		return fmt.Errorf("ListFiles: %s", err)
+	}
+	var found bool
+	for _, sum := range files {
+		if bytes.Equal(sum, td.fileSum) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("ListFiles did not return file %x", td.fileSum)
+	}
+
+	candidates, err := candidateSums(td)
+	if err != nil {
+		return err
+	}
+	lister := client.NewChunkLister()
+	for lister.Next() {
+		listed := lister.Sha256()
+		if sum, ok := candidates[string(listed)]; ok {
+			td.stored[string(sum)] = listed
+		}
+	}
+	if err := lister.Err(); err != nil {
+		return fmt.Errorf("listing chunks: %s", err)
+	}
+	if missing := len(td.chunks) - len(td.stored); missing > 0 {
+		return fmt.Errorf("the chunk lister did not return %d of %d chunk(s)", missing, len(td.chunks))
+	}
+	return nil
+}
+
+// delta compares client to a memory client which holds only the objects of
+// td, at the sums they were listed at, and checks that client holds every
+// one of them.
+func delta(client drive.Client, td *testData) error {
+	want, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		return err
+	}
+	if err := want.PutFile(td.fileSum, td.fileJSON); err != nil {
+		return err
+	}
+	for sum, stored := range td.stored {
+		if err := want.PutChunk(stored, td.chunks[sum], nil); err != nil {
+			return err
+		}
+	}
+	missing, _, err := compare.GetDelta(want, client)
+	if err != nil {
+		return err
+	}
+	if len(missing.Files) > 0 || len(missing.Chunks) > 0 {
+		return fmt.Errorf("the client is missing %d file(s) and %d chunk(s)", len(missing.Files), len(missing.Chunks))
+	}
+	return nil
+}
+
+// release releases the file and chunks of td from client, at each sum they
+// may have been stored at.  It attempts to release every object, and returns
+// the first error encountered.
+func release(client drive.Client, td *testData) error {
+	var firstErr error
+	keep := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := client.ReleaseFile(td.fileSum); err != nil {
+		keep(fmt.Errorf("file %x: %s", td.fileSum, err))
+	}
+	candidates, err := candidateSums(td)
+	if err != nil {
+		keep(err)
+	}
+	for stored := range candidates {
+		if err := client.ReleaseChunk([]byte(stored)); err != nil {
+			keep(fmt.Errorf("chunk %x: %s", stored, err))
+		}
+	}
+	if err := drive.Flush(client); err != nil {
+		keep(err)
+	}
+	return firstErr
+}
@@ -0,0 +1,62 @@
+package selftest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/compare"
+	_ "github.com/asjoyner/shade/drive/encrypt"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+func TestSelftest(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	// selftest must pass, and leave the client as it found it, every time.
+	for i := 0; i < 2; i++ {
+		buf := &bytes.Buffer{}
+		if err := selftest(buf, mc, 3, 1024); err != nil {
+			t.Fatalf("selftest failed: %s\n%s", err, buf.String())
+		}
+		if strings.Contains(buf.String(), "FAIL") || !strings.Contains(buf.String(), "PASS release") {
+			t.Errorf("unexpected selftest output:\n%s", buf.String())
+		}
+		empty, err := memory.NewClient(drive.Config{Provider: "memory"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eq, err := compare.Equal(mc, empty); err != nil || !eq {
+			t.Errorf("selftest did not release its objects (err: %v)", err)
+		}
+	}
+}
+
+func TestSelftestEncrypted(t *testing.T) {
+	// The chunks are listed, and released, at their encrypted sums.
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privkey)}
+	client, err := drive.NewClient(drive.Config{
+		Provider:      "encrypt",
+		RsaPrivateKey: string(pem.EncodeToMemory(b)),
+		Write:         true,
+		Children:      []drive.Config{{Provider: "memory", Write: true}},
+	})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := selftest(buf, client, 3, 1024); err != nil {
+		t.Fatalf("selftest failed: %s\n%s", err, buf.String())
+	}
+}
@@ -8,24 +8,51 @@ import (
 
 	"golang.org/x/net/context"
 
-	"github.com/golang/glog"
 	"github.com/google/subcommands"
 
 	// Subcommand imports
 	"github.com/asjoyner/shade"
 	_ "github.com/asjoyner/shade/cmd/shadeutil/cat"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/checkconfig"
 	_ "github.com/asjoyner/shade/cmd/shadeutil/cleanup"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/compact"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/diff"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/du"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/fsck"
 	_ "github.com/asjoyner/shade/cmd/shadeutil/genkeys"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/get"
 	_ "github.com/asjoyner/shade/cmd/shadeutil/ls"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/orphans"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/pin"
 	_ "github.com/asjoyner/shade/cmd/shadeutil/putfile"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/reencrypt"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/repair"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/selftest"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/sharing"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/snapshot"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/sync"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/trash"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/verify"
+	_ "github.com/asjoyner/shade/cmd/shadeutil/versions"
+	"github.com/asjoyner/shade/logging"
 
 	// Drive client provider imports
 	_ "github.com/asjoyner/shade/drive/amazon"
 	_ "github.com/asjoyner/shade/drive/cache"
+	_ "github.com/asjoyner/shade/drive/compress"
 	_ "github.com/asjoyner/shade/drive/encrypt"
+	_ "github.com/asjoyner/shade/drive/flaky"
 	_ "github.com/asjoyner/shade/drive/google"
+	_ "github.com/asjoyner/shade/drive/listcache"
 	_ "github.com/asjoyner/shade/drive/local"
 	_ "github.com/asjoyner/shade/drive/memory"
+	_ "github.com/asjoyner/shade/drive/namespace"
+	_ "github.com/asjoyner/shade/drive/overlay"
+	_ "github.com/asjoyner/shade/drive/refcount"
+	_ "github.com/asjoyner/shade/drive/split"
+	_ "github.com/asjoyner/shade/drive/stripe"
+	_ "github.com/asjoyner/shade/drive/tar"
+	_ "github.com/asjoyner/shade/drive/writeback"
 )
 
 var (
@@ -42,6 +69,6 @@ func main() {
 
 	ctx := context.Background()
 	exitValue := subcommands.Execute(ctx, configPath)
-	glog.Flush()
+	logging.Flush()
 	os.Exit(int(exitValue))
 }
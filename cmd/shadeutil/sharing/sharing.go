@@ -0,0 +1,268 @@
+// Package sharing provides a subcommand to report which files of a Shade
+// repository share chunks.
+package sharing
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/compare"
+	"github.com/asjoyner/shade/umbrella"
+
+	"github.com/google/subcommands"
+)
+
+// maxNames is the number of the files referencing a chunk which are printed.
+const maxNames = 3
+
+func init() {
+	subcommands.Register(&sharingCmd{}, "")
+}
+
+type sharingCmd struct {
+	top      int
+	maxFiles int
+}
+
+func (*sharingCmd) Name() string     { return "sharing" }
+func (*sharingCmd) Synopsis() string { return "Report the data shared between files." }
+func (*sharingCmd) Usage() string {
+	return `sharing [-top N] [-maxFiles N]:
+  Report the bytes of chunks referenced by the files in the repository, and
+  how many of those bytes are unique.  Then list the -top chunks referenced by
+  the most files, and the -top pairs of files which share the most bytes,
+  noting those with identical content.
+
+  The index of which files reference each chunk is held in memory, which
+  takes roughly 100 bytes per unique chunk, and 8 bytes per reference.  The
+  pairs of files sharing a chunk are not counted for chunks referenced by more
+  than -maxFiles files, eg. a chunk of zeros, as there are too many of them.
+`
+}
+
+func (p *sharingCmd) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&p.top, "top", 10, "The number of chunks and pairs of files to list.")
+	f.IntVar(&p.maxFiles, "maxFiles", 100, "Do not count the pairs of files sharing a chunk referenced by more files than this.")
+}
+
+func (p *sharingCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	// read in the config
+	configPath := args[0].(*string)
+	config, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Printf("could not read config: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	// initialize client
+	client, err := drive.NewClient(config)
+	if err != nil {
+		fmt.Printf("could not initialize client: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	inUse, _, err := umbrella.FetchFiles(client)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	r := buildReport(inUse, p.maxFiles)
+	r.print(os.Stdout, p.top)
+	return subcommands.ExitSuccess
+}
+
+// chunkUse describes the files which reference a chunk.
+type chunkUse struct {
+	size  int64
+	files []int // indexes into report.files, each once, in increasing order
+}
+
+// filePair identifies two files by their indexes into report.files, a < b.
+type filePair struct{ a, b int }
+
+// shared is the data shared by a pair of files.
+type shared struct {
+	bytes  int64
+	chunks int
+}
+
+// report describes the sharing of chunks between the files in use.
+type report struct {
+	files      []*shade.File
+	chunks     map[string]*chunkUse
+	referenced int64 // the bytes of every chunk reference
+	unique     int64 // the bytes of each unique chunk
+	pairs      map[filePair]*shared
+	uncounted  int // chunks whose pairs of files were not counted
+}
+
+// buildReport indexes the chunks referenced by the files in inUse which were
+// not deleted, and counts the data shared by each pair of files.  Pairs are
+// not counted for chunks referenced by more than maxFiles files.
+//
+// Sizes are those of the unencrypted chunks, as described by the shade.File
+// which refers to them.  The files are indexed in order of their names, so
+// that the report does not depend on the order they were fetched in.
+func buildReport(inUse []umbrella.FoundFile, maxFiles int) *report {
+	r := &report{
+		chunks: make(map[string]*chunkUse),
+		pairs:  make(map[filePair]*shared),
+	}
+	for _, ff := range inUse {
+		if f := ff.File(); !f.Deleted {
+			r.files = append(r.files, f)
+		}
+	}
+	sort.SliceStable(r.files, func(i, j int) bool { return r.files[i].Filename < r.files[j].Filename })
+	for i, f := range r.files {
+		for _, c := range f.Chunks {
+			size := int64(f.Chunksize)
+			if c.Index == len(f.Chunks)-1 {
+				size = int64(f.LastChunksize)
+			}
+			r.referenced += size
+			cu, ok := r.chunks[string(c.Sha256)]
+			if !ok {
+				cu = &chunkUse{size: size}
+				r.chunks[string(c.Sha256)] = cu
+				r.unique += size
+			}
+			if n := len(cu.files); n == 0 || cu.files[n-1] != i {
+				cu.files = append(cu.files, i)
+			}
+		}
+	}
+	for _, cu := range r.chunks {
+		if len(cu.files) > maxFiles {
+			r.uncounted++
+			continue
+		}
+		for x, a := range cu.files {
+			for _, b := range cu.files[x+1:] {
+				s, ok := r.pairs[filePair{a, b}]
+				if !ok {
+					s = &shared{}
+					r.pairs[filePair{a, b}] = s
+				}
+				s.bytes += cu.size
+				s.chunks++
+			}
+		}
+	}
+	return r
+}
+
+// sharedChunk is a chunk, and the names of the files which reference it.
+type sharedChunk struct {
+	sum   []byte
+	size  int64
+	files []string
+}
+
+// topChunks returns up to n of the chunks referenced by more than one file,
+// those referenced by the most files first.
+func (r *report) topChunks(n int) []sharedChunk {
+	var top []sharedChunk
+	for sum, cu := range r.chunks {
+		if len(cu.files) < 2 {
+			continue
+		}
+		sc := sharedChunk{sum: []byte(sum), size: cu.size}
+		for _, i := range cu.files {
+			sc.files = append(sc.files, r.files[i].Filename)
+		}
+		top = append(top, sc)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if len(top[i].files) != len(top[j].files) {
+			return len(top[i].files) > len(top[j].files)
+		}
+		return string(top[i].sum) < string(top[j].sum)
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// sharedPair is a pair of files, and the data they share.
+type sharedPair struct {
+	a, b      string
+	bytes     int64
+	chunks    int
+	identical bool // the files have the same content
+}
+
+// topPairs returns up to n of the pairs of files which share the most bytes.
+func (r *report) topPairs(n int) []sharedPair {
+	var top []sharedPair
+	for p, s := range r.pairs {
+		a, b := r.files[p.a], r.files[p.b]
+		top = append(top, sharedPair{
+			a:         a.Filename,
+			b:         b.Filename,
+			bytes:     s.bytes,
+			chunks:    s.chunks,
+			identical: compare.SameContent(a, b),
+		})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].bytes != top[j].bytes {
+			return top[i].bytes > top[j].bytes
+		}
+		if top[i].a != top[j].a {
+			return top[i].a < top[j].a
+		}
+		return top[i].b < top[j].b
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// print writes the totals, and then the top n chunks and pairs of files, to
+// out.
+func (r *report) print(out io.Writer, n int) {
+	fmt.Fprintf(out, "%d file(s) reference %d bytes of chunks, of which %d bytes in %d chunk(s) are unique", len(r.files), r.referenced, r.unique, len(r.chunks))
+	if r.unique > 0 {
+		fmt.Fprintf(out, " (%.2fx dedup)", float64(r.referenced)/float64(r.unique))
+	}
+	fmt.Fprintln(out)
+
+	w := &tabwriter.Writer{}
+	w.Init(out, 0, 2, 1, ' ', 0)
+	if chunks := r.topChunks(n); len(chunks) > 0 {
+		fmt.Fprint(w, "\nfiles\tbytes\tchunk\treferenced by\n")
+		for _, c := range chunks {
+			names := strings.Join(c.files, ", ")
+			if len(c.files) > maxNames {
+				names = fmt.Sprintf("%s and %d more", strings.Join(c.files[:maxNames], ", "), len(c.files)-maxNames)
+			}
+			fmt.Fprintf(w, "%d\t%d\t%x\t%s\n", len(c.files), c.size, c.sum, names)
+		}
+	}
+	if pairs := r.topPairs(n); len(pairs) > 0 {
+		fmt.Fprint(w, "\nshared bytes\tchunks\tfiles\n")
+		for _, p := range pairs {
+			identical := ""
+			if p.identical {
+				identical = " (identical)"
+			}
+			fmt.Fprintf(w, "%d\t%d\t%s and %s%s\n", p.bytes, p.chunks, p.a, p.b, identical)
+		}
+	}
+	w.Flush()
+	if r.uncounted > 0 {
+		fmt.Fprintf(out, "\n%d chunk(s) referenced by too many files were not counted in the shared bytes of pairs\n", r.uncounted)
+	}
+}
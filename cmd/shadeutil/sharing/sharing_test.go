@@ -0,0 +1,117 @@
+package sharing
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+	"github.com/asjoyner/shade/umbrella"
+)
+
+func TestSharing(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	var sums [][]byte
+	for i := 0; i < 6; i++ {
+		sum, _ := drive.RandChunk()
+		sums = append(sums, sum)
+	}
+	// a and b share their first three chunks, c is a copy of a, and d shares
+	// only the first chunk.
+	for _, tf := range []struct {
+		filename string
+		chunks   [][]byte
+	}{
+		{"a", [][]byte{sums[0], sums[1], sums[2], sums[3]}},
+		{"b", [][]byte{sums[0], sums[1], sums[2], sums[4]}},
+		{"c", [][]byte{sums[0], sums[1], sums[2], sums[3]}},
+		{"d", [][]byte{sums[0], sums[5]}},
+	} {
+		f := shade.NewFile(tf.filename)
+		f.Chunksize = 100
+		f.LastChunksize = 60
+		for i, sum := range tf.chunks {
+			f.Chunks = append(f.Chunks, shade.Chunk{Index: i, Sha256: sum})
+		}
+		f.UpdateFilesize()
+		f.UpdateDigest()
+		jm, err := json.Marshal(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mc.PutFile(shade.Sum(jm), jm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inUse, _, err := umbrella.FetchFiles(mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := buildReport(inUse, 100)
+	// 3 files of 360 bytes, and one of 160; the unique chunks are sums[0-2],
+	// of 100 bytes, and the last chunks, sums[3-5], of 60 bytes.
+	if r.referenced != 1240 {
+		t.Errorf("referenced bytes, want: 1240, got: %d", r.referenced)
+	}
+	if r.unique != 480 {
+		t.Errorf("unique bytes, want: 480, got: %d", r.unique)
+	}
+
+	chunks := r.topChunks(2)
+	if len(chunks) != 2 {
+		t.Fatalf("want 2 top chunks, got: %d", len(chunks))
+	}
+	if !bytes.Equal(chunks[0].sum, sums[0]) || strings.Join(chunks[0].files, ",") != "a,b,c,d" {
+		t.Errorf("most shared chunk, want %x in a,b,c,d, got: %x in %s", sums[0], chunks[0].sum, strings.Join(chunks[0].files, ","))
+	}
+	if len(chunks[1].files) != 3 {
+		t.Errorf("second most shared chunk, want 3 files, got: %s", strings.Join(chunks[1].files, ","))
+	}
+
+	for _, want := range []sharedPair{
+		{a: "a", b: "c", bytes: 360, chunks: 4, identical: true},
+		{a: "a", b: "b", bytes: 300, chunks: 3},
+		{a: "b", b: "c", bytes: 300, chunks: 3},
+		{a: "a", b: "d", bytes: 100, chunks: 1},
+	} {
+		var found bool
+		for _, got := range r.topPairs(10) {
+			if got.a == want.a && got.b == want.b {
+				found = true
+				if got != want {
+					t.Errorf("pair %s and %s, want: %+v, got: %+v", want.a, want.b, want, got)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("pair %s and %s was not reported", want.a, want.b)
+		}
+	}
+	if top := r.topPairs(1); len(top) != 1 || top[0].a != "a" || top[0].b != "c" {
+		t.Errorf("want a and c to share the most data, got: %+v", top)
+	}
+
+	// With maxFiles of 3, the chunk shared by all four files is not counted.
+	r = buildReport(inUse, 3)
+	if r.uncounted != 1 {
+		t.Errorf("uncounted chunks, want: 1, got: %d", r.uncounted)
+	}
+	if top := r.topPairs(1); len(top) != 1 || top[0].bytes != 260 {
+		t.Errorf("want a and c to share 260 counted bytes, got: %+v", top)
+	}
+
+	buf := &bytes.Buffer{}
+	r.print(buf, 10)
+	for _, want := range []string{"4 file(s) reference 1240 bytes", "a, b, c and 1 more", "a and c (identical)"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("report is missing %q:\n%s", want, buf.String())
+		}
+	}
+}
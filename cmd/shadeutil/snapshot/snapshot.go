@@ -0,0 +1,111 @@
+// Package snapshot provides subcommands to record the files in use in a
+// snapshot, and to make the files listed by a snapshot visible again.
+package snapshot
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/umbrella"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&snapshotCmd{}, "")
+	subcommands.Register(&snapshotCmd{restore: true}, "")
+}
+
+type snapshotCmd struct {
+	restore bool
+}
+
+func (p *snapshotCmd) Name() string {
+	if p.restore {
+		return "restore-snapshot"
+	}
+	return "snapshot"
+}
+
+func (p *snapshotCmd) Synopsis() string {
+	if p.restore {
+		return "Make the files listed by a snapshot visible again."
+	}
+	return "Record the files in use in a snapshot."
+}
+
+func (p *snapshotCmd) Usage() string {
+	if p.restore {
+		return `restore-snapshot <sum>:
+  Store again the file object with the given hex encoded sum, as printed by
+  the snapshot subcommand, and each file object listed by it, so that they
+  are listed by the configured client.  This repairs a repository whose
+  listing was lost or is unreliable, provided the file objects themselves
+  can still be retrieved.
+`
+	}
+	return fmt.Sprintf(`snapshot:
+  Record the sum and filename of each file in use in a new file under %q,
+  and print the sum of its file object; keep it somewhere safe.  Cleanup
+  and compact never release the versions listed by a snapshot, or their
+  chunks, until the snapshot is deleted.
+`, umbrella.SnapshotDir)
+}
+
+func (p *snapshotCmd) SetFlags(f *flag.FlagSet) {}
+
+func (p *snapshotCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	configPath := args[0].(*string)
+	want := 0
+	if p.restore {
+		want = 1
+	}
+	if f.NArg() != want {
+		fmt.Printf("unexpected number of arguments to %s; want: %d, got: %d\n", p.Name(), want, f.NArg())
+		return subcommands.ExitFailure
+	}
+
+	// read in the config
+	config, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Printf("could not read config: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	// initialize client
+	client, err := drive.NewClient(config)
+	if err != nil {
+		fmt.Printf("could not initialize client: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	if p.restore {
+		sum, err := hex.DecodeString(f.Arg(0))
+		if err != nil {
+			fmt.Printf("invalid sum %q: %s\n", f.Arg(0), err)
+			return subcommands.ExitFailure
+		}
+		n, err := umbrella.RestoreSnapshot(client, sum)
+		if err != nil {
+			fmt.Println(err)
+			return subcommands.ExitFailure
+		}
+		fmt.Printf("Restored %d file(s)\n", n)
+	} else {
+		sum, err := umbrella.TakeSnapshot(client)
+		if err != nil {
+			fmt.Println(err)
+			return subcommands.ExitFailure
+		}
+		fmt.Printf("%x\n", sum)
+	}
+	if err := drive.Close(client); err != nil {
+		fmt.Printf("Close: %v\n", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,209 @@
+// Package sync provides a subcommand to copy the files and chunks of one Shade
+// repository into another.
+package sync
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/compare"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&syncCmd{}, "")
+}
+
+type syncCmd struct {
+	workers int
+	dryRun  bool
+}
+
+func (*syncCmd) Name() string     { return "sync" }
+func (*syncCmd) Synopsis() string { return "Copy a repository from one config to another." }
+func (*syncCmd) Usage() string {
+	return `sync [-workers N] [-dryrun] <SOURCE CONFIG> <DEST CONFIG>:
+  Copy the files and chunks which are missing from the destination repository
+  from the source repository.  Data is copied verbatim, so the configs should
+  describe the storage beneath any encrypt provider.  It is safe to interrupt
+  and run again; only the remaining differences will be copied.
+`
+}
+
+func (p *syncCmd) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&p.workers, "workers", 10, "The number of concurrent copies.")
+	f.BoolVar(&p.dryRun, "dryrun", false, "Print what would be copied, instead of copying it.")
+}
+
+func (p *syncCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 2 {
+		fmt.Printf("unexpected number of arguments to sync; want: 2, got: %d\n", f.NArg())
+		return subcommands.ExitFailure
+	}
+	var clients []drive.Client
+	for _, configPath := range f.Args() {
+		config, err := config.Read(configPath)
+		if err != nil {
+			fmt.Printf("could not read config %s: %v\n", configPath, err)
+			return subcommands.ExitFailure
+		}
+		client, err := drive.NewClient(config)
+		if err != nil {
+			fmt.Printf("could not initialize client for %s: %s\n", configPath, err)
+			return subcommands.ExitFailure
+		}
+		clients = append(clients, client)
+	}
+
+	err := Sync(clients[0], clients[1], p.workers, p.dryRun, os.Stdout)
+	for _, client := range clients {
+		if cerr := drive.Close(client); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// Sync copies the files and chunks which src has and dst does not, using the
+// specified number of concurrent workers.  Progress is reported to out.  If
+// dryRun is true, the sums of the missing files and chunks are printed to out
+// instead.
+//
+// All of the chunks are copied before any of the files, so that dst never has
+// a file which refers to a chunk it does not have.  Because Puts of existing
+// sums are deduplicated, an interrupted Sync is resumed by calling it again.
+// The chunks are compared with compare.StreamChunks, so the memory used does
+// not grow with the size of the repositories.
+func Sync(src, dst drive.Client, workers int, dryRun bool, out io.Writer) error {
+	copyChunk := func(sum []byte) error {
+		data, err := src.GetChunk(sum, nil)
+		if err != nil {
+			return fmt.Errorf("could not get chunk %x: %s", sum, err)
+		}
+		if err := dst.PutChunk(sum, data, nil); err != nil {
+			return fmt.Errorf("could not put chunk %x: %s", sum, err)
+		}
+		return nil
+	}
+	streamChunks := func(h compare.Handler) error {
+		return compare.StreamChunks(src, dst, compare.SortOptions{}, h)
+	}
+	chunks, err := syncSums("chunk", streamChunks, copyChunk, workers, dryRun, out)
+	if err != nil {
+		return err
+	}
+	copyFile := func(sum []byte) error {
+		data, err := src.GetFile(sum)
+		if err != nil {
+			return fmt.Errorf("could not get file %x: %s", sum, err)
+		}
+		if err := dst.PutFile(sum, data); err != nil {
+			return fmt.Errorf("could not put file %x: %s", sum, err)
+		}
+		return nil
+	}
+	streamFiles := func(h compare.Handler) error {
+		return compare.StreamFiles(src, dst, h)
+	}
+	files, err := syncSums("file", streamFiles, copyFile, workers, dryRun, out)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Fprintf(out, "%d chunk(s) and %d file(s) to copy\n", chunks, files)
+	} else {
+		fmt.Fprintf(out, "copied %d chunk(s) and %d file(s)\n", chunks, files)
+	}
+	return nil
+}
+
+// syncSums calls copyFn, from a pool of workers, for each sum which stream
+// reports is known only to the source.  If dryRun is true, the sums are
+// printed to out instead.  It returns the number of sums copied, or which
+// would be, and the first error encountered, if any.
+func syncSums(kind string, stream func(compare.Handler) error, copyFn func([]byte) error, workers int, dryRun bool, out io.Writer) (int, error) {
+	if dryRun {
+		var n int
+		err := stream(compare.Handler{OnlyA: func(sum []byte) error {
+			n++
+			fmt.Fprintf(out, "would copy %s: %x\n", kind, sum)
+			return nil
+		}})
+		if err != nil {
+			return n, fmt.Errorf("could not compare repositories: %s", err)
+		}
+		return n, nil
+	}
+	c := newCopier(kind, copyFn, workers, out)
+	err := stream(compare.Handler{OnlyA: c.add})
+	n, cerr := c.wait()
+	if err != nil {
+		return n, fmt.Errorf("could not compare repositories: %s", err)
+	}
+	return n, cerr
+}
+
+// copier calls copyFn for each sum it is given, from a pool of workers.  It
+// reports progress to out, and records the first error encountered.
+type copier struct {
+	queue chan []byte
+	wg    sync.WaitGroup
+
+	mu       sync.Mutex // guards done and firstErr
+	done     int
+	firstErr error
+}
+
+// newCopier starts workers goroutines to call copyFn.
+func newCopier(kind string, copyFn func([]byte) error, workers int, out io.Writer) *copier {
+	if workers < 1 {
+		workers = 1
+	}
+	c := &copier{queue: make(chan []byte)}
+	for i := 0; i < workers; i++ {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			for sum := range c.queue {
+				err := copyFn(sum)
+				c.mu.Lock()
+				if err != nil {
+					if c.firstErr == nil {
+						c.firstErr = err
+					}
+				} else {
+					c.done++
+					fmt.Fprintf(out, "copied %d %s(s)\n", c.done, kind)
+				}
+				c.mu.Unlock()
+			}
+		}()
+	}
+	return c
+}
+
+// add queues sum to be copied.  It always returns nil, so that it may be a
+// compare.Handler function.
+func (c *copier) add(sum []byte) error {
+	c.queue <- sum
+	return nil
+}
+
+// wait returns the number of sums copied successfully, and the first error
+// encountered, once every sum has been tried.
+func (c *copier) wait() (int, error) {
+	close(c.queue)
+	c.wg.Wait()
+	return c.done, c.firstErr
+}
@@ -0,0 +1,88 @@
+package sync
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/compare"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+func newMemoryClient(t *testing.T) drive.Client {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	return mc
+}
+
+func TestSync(t *testing.T) {
+	src := newMemoryClient(t)
+	dst := newMemoryClient(t)
+	for sum, data := range drive.RandChunks(10) {
+		if err := src.PutFile([]byte(sum), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for sum, data := range drive.RandChunks(20) {
+		if err := src.PutChunk([]byte(sum), data, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A dry run must not copy anything.
+	if err := Sync(src, dst, 4, true, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	files, err := dst.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("dry run copied %d files", len(files))
+	}
+
+	if err := Sync(src, dst, 4, false, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	eq, err := compare.Equal(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !eq {
+		t.Errorf("destination is not Equal() to the source after sync")
+	}
+
+	// Syncing again is a no-op.
+	if err := Sync(src, dst, 4, false, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSyncSumsCountsFailures checks that the sums whose copy fails are not
+// counted as copied.
+func TestSyncSumsCountsFailures(t *testing.T) {
+	stream := func(h compare.Handler) error {
+		for _, sum := range []string{"a", "b", "c", "d"} {
+			if err := h.OnlyA([]byte(sum)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	copyFn := func(sum []byte) error {
+		if string(sum) == "b" || string(sum) == "d" {
+			return errors.New("injected failure")
+		}
+		return nil
+	}
+	n, err := syncSums("chunk", stream, copyFn, 2, false, ioutil.Discard)
+	if err == nil {
+		t.Error("syncSums() did not return the failure")
+	}
+	if n != 2 {
+		t.Errorf("syncSums() counted %d sums copied, want 2", n)
+	}
+}
@@ -0,0 +1,140 @@
+// Package trash provides a subcommand to list, restore and empty the files
+// removed from a mount of the fuse filesystem with -trash.
+package trash
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/umbrella"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&trashCmd{}, "")
+}
+
+type trashCmd struct {
+	restore   string
+	empty     bool
+	retention time.Duration
+}
+
+func (*trashCmd) Name() string     { return "trash" }
+func (*trashCmd) Synopsis() string { return "List, restore, or empty the removed files in the trash." }
+func (*trashCmd) Usage() string {
+	return fmt.Sprintf(`trash [-restore <PATH>] [-empty [-retention <duration>]]:
+  List the files removed from a mount with -trash, which are kept in %q,
+  with the time each was removed.
+
+  With -restore, move the file which was removed from PATH back to it.
+
+  With -empty, list the files removed more than -retention ago, ask for
+  confirmation on standard input, and then delete them.  Their chunks are
+  released by the next cleanup.  With -dryrun, nothing is deleted.
+`, umbrella.TrashDir)
+}
+
+func (p *trashCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.restore, "restore", "", "The path of a removed file to restore.")
+	f.BoolVar(&p.empty, "empty", false, "Delete the files removed more than -retention ago.")
+	f.DurationVar(&p.retention, "retention", 30*24*time.Hour, "How long -empty keeps removed files.")
+}
+
+func (p *trashCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	configPath := args[0].(*string)
+	if f.NArg() != 0 {
+		fmt.Printf("unexpected number of arguments to trash; want: 0, got: %d\n", f.NArg())
+		return subcommands.ExitFailure
+	}
+
+	// read in the config
+	config, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Printf("could not read config: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	// initialize client
+	client, err := drive.NewClient(config)
+	if err != nil {
+		fmt.Printf("could not initialize client: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	switch {
+	case p.restore != "":
+		err = umbrella.RestoreTrash(client, p.restore)
+	case p.empty:
+		err = p.emptyTrash(os.Stdout, os.Stdin, client)
+	default:
+		var inUse []umbrella.FoundFile
+		if inUse, _, err = umbrella.FetchFiles(client); err == nil {
+			err = list(os.Stdout, umbrella.Trash(inUse))
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	if err := drive.Close(client); err != nil {
+		fmt.Fprintf(os.Stderr, "Close: %v\n", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// emptyTrash lists the files in the trash older than p.retention to out, and
+// deletes them if the answer read from in confirms it.
+func (p *trashCmd) emptyTrash(out io.Writer, in io.Reader, client drive.Client) error {
+	inUse, _, err := umbrella.FetchFiles(client)
+	if err != nil {
+		return err
+	}
+	expired := umbrella.ExpiredTrash(inUse, p.retention)
+	if len(expired) == 0 {
+		_, err := fmt.Fprintf(out, "no files were removed more than %s ago\n", p.retention)
+		return err
+	}
+	if err := list(out, expired); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Delete %d file(s) from the trash? [y/N] ", len(expired))
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+	default:
+		_, err := fmt.Fprintln(out, "no files were deleted")
+		return err
+	}
+	deleted, err := umbrella.EmptyTrash(client, p.retention)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "deleted %d file(s)\n", len(deleted))
+	return err
+}
+
+// list prints the original path, size and removal time of each file in
+// trash to out.
+func list(out io.Writer, trash []umbrella.FoundFile) error {
+	w := &tabwriter.Writer{}
+	w.Init(out, 0, 2, 1, ' ', 0)
+	fmt.Fprint(w, "removed\tsize\tpath\t\n")
+	for _, ff := range trash {
+		f := ff.File()
+		path := strings.TrimPrefix(f.Filename, umbrella.TrashDir)
+		fmt.Fprintf(w, "%s\t%d\t%s\t\n", f.ModifiedTime.Format(time.RFC3339), f.Filesize, path)
+	}
+	return w.Flush()
+}
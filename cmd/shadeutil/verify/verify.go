@@ -0,0 +1,102 @@
+package verify
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/compare"
+	"github.com/asjoyner/shade/umbrella"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&verifyCmd{}, "")
+}
+
+type verifyCmd struct{}
+
+func (*verifyCmd) Name() string     { return "verify" }
+func (*verifyCmd) Synopsis() string { return "Check or compare the content digest of files." }
+func (*verifyCmd) Usage() string {
+	return `verify <PATH> [<PATH>]:
+  Print the content digest of the file at PATH, and check it against the
+  digest recorded when the file was written.  If a second PATH is provided,
+  also report whether the two files have identical content.  Metadata, such as
+  the modification time, is not considered.
+`
+}
+
+func (*verifyCmd) SetFlags(f *flag.FlagSet) { return }
+
+func (p *verifyCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	configPath := args[0].(*string)
+	if f.NArg() != 1 && f.NArg() != 2 {
+		fmt.Printf("unexpected number of arguments to verify; want: 1 or 2, got: %d\n", f.NArg())
+		return subcommands.ExitFailure
+	}
+
+	// read in the config
+	config, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Printf("could not read config: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	// initialize client
+	client, err := drive.NewClient(config)
+	if err != nil {
+		fmt.Printf("could not initialize client: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	if err := verify(os.Stdout, client, f.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// verify prints the content digest of each of the named files to w.  It
+// returns an error if any file's recorded digest does not match its chunks,
+// or if two files are named and their content differs.
+func verify(w io.Writer, client drive.Client, paths []string) error {
+	inUse, _, err := umbrella.FetchFiles(client)
+	if err != nil {
+		return err
+	}
+	var files []*shade.File
+	for _, p := range paths {
+		p = strings.Trim(p, "/")
+		var found *shade.File
+		for _, ff := range inUse {
+			f := ff.File()
+			if !f.Deleted && strings.TrimPrefix(f.Filename, "/") == p {
+				found = f
+				break
+			}
+		}
+		if found == nil {
+			return fmt.Errorf("no such file: %s", p)
+		}
+		if err := found.VerifyDigest(); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%x  %s\n", found.ContentDigest(), p)
+		files = append(files, found)
+	}
+	if len(files) == 2 {
+		if !compare.SameContent(files[0], files[1]) {
+			return fmt.Errorf("content differs: %s, %s", paths[0], paths[1])
+		}
+		fmt.Fprintln(w, "content is identical")
+	}
+	return nil
+}
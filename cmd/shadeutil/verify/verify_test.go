@@ -0,0 +1,62 @@
+package verify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+// putFile stores a shade.File with the given name, modification time and
+// chunk sums in client.
+func putFile(t *testing.T, client drive.Client, name string, mtime time.Time, sums ...string) *shade.File {
+	f := shade.NewFile(name)
+	f.ModifiedTime = mtime
+	for i, s := range sums {
+		f.Chunks = append(f.Chunks, shade.Chunk{Index: i, Sha256: shade.Sum([]byte(s))})
+	}
+	f.LastChunksize = 1
+	f.UpdateDigest()
+	jm, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PutFile(shade.Sum(jm), jm); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestVerify(t *testing.T) {
+	client, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	a := putFile(t, client, "a", now, "0", "1")
+	putFile(t, client, "b", now.Add(time.Hour), "0", "1")
+	putFile(t, client, "c", now, "1", "0")
+
+	buf := &bytes.Buffer{}
+	if err := verify(buf, client, []string{"a"}); err != nil {
+		t.Errorf("verify(a): %s", err)
+	}
+	if !strings.Contains(buf.String(), fmt.Sprintf("%x", a.ContentDigest())) {
+		t.Errorf("verify(a) did not print the digest: %q", buf.String())
+	}
+	if err := verify(&bytes.Buffer{}, client, []string{"a", "b"}); err != nil {
+		t.Errorf("files with the same chunks and different mtimes differ: %s", err)
+	}
+	if err := verify(&bytes.Buffer{}, client, []string{"a", "c"}); err == nil {
+		t.Error("files with reordered chunks have identical content")
+	}
+	if err := verify(&bytes.Buffer{}, client, []string{"missing"}); err == nil {
+		t.Error("verify succeeded for a missing file")
+	}
+}
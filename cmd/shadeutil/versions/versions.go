@@ -0,0 +1,160 @@
+package versions
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/config"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/umbrella"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	subcommands.Register(&versionsCmd{}, "")
+}
+
+type versionsCmd struct {
+	restore string
+}
+
+func (*versionsCmd) Name() string     { return "versions" }
+func (*versionsCmd) Synopsis() string { return "List, or restore, the versions of a file." }
+func (*versionsCmd) Usage() string {
+	return `versions [-restore <sum>] <PATH>:
+  List each version of the file at PATH which has not yet been cleaned up,
+  oldest first, with the sum of its file object, its size and its
+  modification time.  The last version listed is the current one.
+
+  If -restore is provided, the version with that sum is stored again, with
+  the current time, so that it becomes the current version.
+`
+}
+
+func (p *versionsCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.restore, "restore", "", "The sum, in hex, of a version to make current.")
+}
+
+func (p *versionsCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	configPath := args[0].(*string)
+	if f.NArg() != 1 {
+		fmt.Printf("unexpected number of arguments to versions; want: 1, got: %d\n", f.NArg())
+		return subcommands.ExitFailure
+	}
+
+	// read in the config
+	config, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Printf("could not read config: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	// initialize client
+	client, err := drive.NewClient(config)
+	if err != nil {
+		fmt.Printf("could not initialize client: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	vs, err := versions(client, f.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	if p.restore == "" {
+		if err := printVersions(os.Stdout, vs); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+
+	sum, err := hex.DecodeString(p.restore)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid sum %q: %s\n", p.restore, err)
+		return subcommands.ExitFailure
+	}
+	if err := restore(client, vs, sum); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	if err := drive.Close(client); err != nil {
+		fmt.Fprintf(os.Stderr, "Close: %v\n", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// versions returns every version of the file at path known to client,
+// including obsolete versions which have not been cleaned up, sorted by
+// ModifiedTime.
+func versions(client drive.Client, path string) ([]umbrella.FoundFile, error) {
+	inUse, obsolete, err := umbrella.FetchFiles(client)
+	if err != nil {
+		return nil, err
+	}
+	path = strings.Trim(path, "/")
+	var vs []umbrella.FoundFile
+	for _, ff := range append(inUse, obsolete...) {
+		if strings.TrimPrefix(ff.File().Filename, "/") == path {
+			vs = append(vs, ff)
+		}
+	}
+	if len(vs) == 0 {
+		return nil, fmt.Errorf("no such file: %s", path)
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		return vs[i].File().ModifiedTime.Before(vs[j].File().ModifiedTime)
+	})
+	return vs, nil
+}
+
+// printVersions prints the sum, size and modification time of each version
+// to out.
+func printVersions(out io.Writer, vs []umbrella.FoundFile) error {
+	w := &tabwriter.Writer{}
+	w.Init(out, 0, 2, 1, ' ', 0)
+	fmt.Fprint(w, "sum\tsize\tmtime\t\n")
+	for _, ff := range vs {
+		f := ff.File()
+		size := fmt.Sprint(f.Filesize)
+		if f.Deleted {
+			size = "deleted"
+		}
+		fmt.Fprintf(w, "%x\t%s\t%s\t\n", ff.Sum(), size, f.ModifiedTime.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// restore stores a copy of the version in vs with the given sum, with the
+// current time as its ModifiedTime, so that it supersedes every other
+// version.
+func restore(client drive.Client, vs []umbrella.FoundFile, sum []byte) error {
+	for _, ff := range vs {
+		if !bytes.Equal(ff.Sum(), sum) {
+			continue
+		}
+		f := *ff.File()
+		f.ModifiedTime = time.Now()
+		fj, err := f.ToJSON()
+		if err != nil {
+			return err
+		}
+		if err := client.PutFile(shade.Sum(fj), fj); err != nil {
+			return fmt.Errorf("PutFile: %s", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("no version of %s with sum %x", vs[0].File().Filename, sum)
+}
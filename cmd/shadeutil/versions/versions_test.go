@@ -0,0 +1,86 @@
+package versions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+	"github.com/asjoyner/shade/umbrella"
+)
+
+// putFile stores a shade.File with the given name, modification time and
+// size in client.
+func putFile(t *testing.T, client drive.Client, name string, mtime time.Time, size int64) {
+	f := shade.NewFile(name)
+	f.ModifiedTime = mtime
+	f.Filesize = size
+	jm, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PutFile(shade.Sum(jm), jm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	client, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Add(-time.Hour)
+	// Push the versions out of order, alongside an unrelated file.
+	putFile(t, client, "dir/a", now.Add(2*time.Minute), 2)
+	putFile(t, client, "dir/a", now, 0)
+	putFile(t, client, "dir/b", now, 10)
+	putFile(t, client, "dir/a", now.Add(time.Minute), 1)
+
+	vs, err := versions(client, "/dir/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 3 {
+		t.Fatalf("want 3 versions, got: %d", len(vs))
+	}
+	for i, ff := range vs {
+		if got := ff.File().Filesize; got != int64(i) {
+			t.Errorf("version %d: want size %d, got: %d", i, i, got)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := printVersions(buf, vs); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], fmt.Sprintf("%x", vs[0].Sum())) {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+	if _, err := versions(client, "missing"); err == nil {
+		t.Error("versions() succeeded for a missing file")
+	}
+
+	if err := restore(client, vs, vs[0].Sum()); err != nil {
+		t.Fatalf("restore(): %s", err)
+	}
+	if err := restore(client, vs, []byte("no such sum")); err == nil {
+		t.Error("restore() succeeded for an unknown sum")
+	}
+	inUse, _, err := umbrella.FetchFiles(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ff := range inUse {
+		if f := ff.File(); f.Filename == "dir/a" && f.Filesize != 0 {
+			t.Errorf("after restore, want the current version to have size 0, got: %d", f.Filesize)
+		}
+	}
+	if vs, err := versions(client, "dir/a"); err != nil || len(vs) != 4 {
+		t.Errorf("after restore, want 4 versions, got: %d (%v)", len(vs), err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// pattern is a single gitignore-style exclusion pattern.
+type pattern struct {
+	negate  bool // the pattern began with "!", and re-includes matches
+	dirOnly bool // the pattern ended with "/", and matches only directories
+	// anchored patterns contain a "/", and match the whole relative path.
+	// Others match the last element of the path, at any depth.
+	anchored bool
+	parts    []string // the pattern, split on "/"
+}
+
+// excluder decides which paths to skip when uploading a directory.  The zero
+// value excludes nothing.
+type excluder struct {
+	patterns []pattern
+}
+
+// readExcludes parses the gitignore-style patterns in filename.
+func readExcludes(filename string) (*excluder, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	e, err := parseExcludes(fh)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return e, nil
+}
+
+// parseExcludes parses one gitignore-style pattern per line of r.  Blank
+// lines and lines beginning with "#" are ignored.  Each pattern is matched
+// with path.Match, and "**" matches any number of directories.
+func parseExcludes(r io.Reader) (*excluder, error) {
+	e := &excluder{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var p pattern
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			p.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		p.parts = strings.Split(line, "/")
+		for _, part := range p.parts {
+			if _, err := path.Match(part, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %s", scanner.Text(), err)
+			}
+		}
+		e.patterns = append(e.patterns, p)
+	}
+	return e, scanner.Err()
+}
+
+// excluded returns whether rel, a slash separated path relative to the root
+// of the upload, should be skipped.  As with gitignore, the last matching
+// pattern wins, so a negated pattern can re-include a path excluded by an
+// earlier one.
+func (e *excluder) excluded(rel string, isDir bool) bool {
+	var excluded bool
+	name := strings.Split(rel, "/")
+	for _, p := range e.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		var ok bool
+		if p.anchored {
+			ok = matchParts(p.parts, name)
+		} else {
+			ok = matchParts(p.parts, name[len(name)-1:])
+		}
+		if ok {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
+
+// matchParts returns whether the elements of a path match those of a pattern.
+func matchParts(pat, name []string) bool {
+	if len(pat) == 0 {
+		return len(name) == 0
+	}
+	if pat[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchParts(pat[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pat[0], name[0]); !ok {
+		return false
+	}
+	return matchParts(pat[1:], name[1:])
+}
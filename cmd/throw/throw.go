@@ -1,15 +1,17 @@
-// throw stores a file in the cloud, encrypted.
+// throw stores a file, or a directory of files, in the cloud, encrypted.
 package main
 
 import (
-	"crypto/sha256"
+	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"sync"
@@ -18,16 +20,30 @@ import (
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/config"
 	"github.com/asjoyner/shade/drive"
-	"github.com/golang/glog"
+	"github.com/asjoyner/shade/drive/throttle"
+	"github.com/asjoyner/shade/logging"
+	"github.com/asjoyner/shade/repolock"
+	"github.com/asjoyner/shade/umbrella"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/jpillora/backoff"
 
 	_ "github.com/asjoyner/shade/drive/amazon"
 	_ "github.com/asjoyner/shade/drive/cache"
+	_ "github.com/asjoyner/shade/drive/compress"
 	_ "github.com/asjoyner/shade/drive/encrypt"
+	_ "github.com/asjoyner/shade/drive/flaky"
 	_ "github.com/asjoyner/shade/drive/google"
+	_ "github.com/asjoyner/shade/drive/listcache"
 	_ "github.com/asjoyner/shade/drive/local"
 	_ "github.com/asjoyner/shade/drive/memory"
+	_ "github.com/asjoyner/shade/drive/namespace"
+	_ "github.com/asjoyner/shade/drive/overlay"
+	_ "github.com/asjoyner/shade/drive/refcount"
+	_ "github.com/asjoyner/shade/drive/split"
+	_ "github.com/asjoyner/shade/drive/stripe"
+	_ "github.com/asjoyner/shade/drive/tar"
 	_ "github.com/asjoyner/shade/drive/win"
+	_ "github.com/asjoyner/shade/drive/writeback"
 )
 
 var (
@@ -42,24 +58,43 @@ var (
 	// ad infinitum, and can be set to a lower value to facilitate testing memory
 	// usage, etc.  You may find testdata/config.win.json helpful for this.
 	maxChunks = flag.Int("maxChunks", 1000000, "The maximum number of chunks to read for a given file.")
+	// uploadBytesPerSec limits the bandwidth used to upload chunks, so that
+	// throw can run without saturating a home uplink.
+	uploadBytesPerSec = flag.Int("uploadBytesPerSec", 0, "The maximum number of bytes per second to upload (0 is unlimited).")
+	// excludeFile is only consulted when uploading a directory.
+	excludeFile = flag.String("exclude", "", "A file of gitignore-style patterns; matching paths are skipped when uploading a directory.")
+	// fileChunkSize allows importing content chunked by another tool, or
+	// re-chunking with a size other than the repository's default.
+	fileChunkSize = flag.Int("fileChunkSize", 0, "The size, in bytes, of the chunks of each uploaded file (0 uses the repository's default).")
+	// warm is most useful when re-uploading files to remote clients, which
+	// check whether each chunk already exists before uploading it.
+	warm = flag.Bool("warm", false, "Read each file twice; first to pass the sums of all its chunks to the client's Warm, so it can look them up in bulk.")
+	// dedupWindow bounds the memory used to skip chunks which repeat within a
+	// file, eg. the zeroed regions of a disk image.
+	dedupWindow = flag.Int("dedupWindow", 65536, "The number of recent chunk sums of each file to remember, so repeated chunks are uploaded once (0 disables this).")
+	// jsonOutput is for scripts which record what was stored, eg. to pin or
+	// verify the file objects later.
+	jsonOutput = flag.Bool("json", false, "Print a JSON object describing each stored file to STDOUT, and the summary to STDERR.")
 )
 
 type chunkToGo struct {
 	chunk      shade.Chunk
 	chunkbytes []byte
 	manifest   *shade.File
+	done       *sync.WaitGroup // marked Done once the chunk is stored
 }
 
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "\nusage: %s [flags] <filename> <destination filename>\n", path.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "       %s [flags] <directory> <destination directory>\n", path.Base(os.Args[0]))
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
 	if flag.NArg() != 2 {
 		flag.Usage()
-		glog.Flush()
+		logging.Flush()
 		os.Exit(2)
 	}
 
@@ -67,7 +102,7 @@ func main() {
 	config, err := config.Read(*configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "could not initialize clients: %s\n", err)
-		glog.Flush()
+		logging.Flush()
 		os.Exit(1)
 	}
 
@@ -76,76 +111,216 @@ func main() {
 	// initialize client
 	client, err := drive.NewClient(config)
 	if err != nil {
-		log.Fatalf("could not initialize client: %s\n", err)
+		logging.Exitf("could not initialize client: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	if err := client.Ping(ctx); err != nil {
+		logging.Exitf("could not reach storage backend %q: %s", config.Provider, err)
+	}
+	cancel()
+	client = throttle.Wrap(client, throttle.NewLimiter(*uploadBytesPerSec), nil)
+
+	filename := flag.Arg(0)
+	fi, err := os.Stat(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		logging.Flush()
+		os.Exit(4)
+	}
+
+	// Hold a shared repository lock until the files are stored, so a
+	// concurrent cleanup does not release the chunks they reference.
+	lock, err := repolock.New(config.LockDir).Shared()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		logging.Flush()
+		os.Exit(5)
+	}
+
+	// Create files with the repository's defaults, rather than the flags, so
+	// they match those created by other tools.
+	if _, err := umbrella.FetchParams(client); err != nil {
+		lock.Unlock()
+		fmt.Fprintf(os.Stderr, "could not read the repository's params: %s\n", err)
+		logging.Flush()
+		os.Exit(5)
+	}
+
+	u := newUploader(client)
+	var uploaded int64
+	if fi.IsDir() {
+		excl := &excluder{}
+		if *excludeFile != "" {
+			if excl, err = readExcludes(*excludeFile); err != nil {
+				lock.Unlock()
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				logging.Flush()
+				os.Exit(3)
+			}
+		}
+		uploaded, err = u.throwDir(filename, flag.Arg(1), excl, os.Stdout)
+	} else {
+		var manifest *shade.File
+		manifest, err = u.throwFile(filename, flag.Arg(1))
+		if manifest != nil {
+			uploaded = manifest.Filesize
+			if *jsonOutput {
+				err = writeJSON(os.Stdout, manifest)
+			}
+		}
+	}
+	u.close()
+	if err != nil {
+		lock.Unlock()
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		logging.Flush()
+		os.Exit(3)
+	}
+	err = drive.Close(client)
+	lock.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "flushing writes to storage failed: %s\n", err)
+		logging.Flush()
+		os.Exit(8)
 	}
 
-	// initialize the goroutines to upload chunks
-	uploadRequests := make(chan chunkToGo)
-	var workers sync.WaitGroup
-	workers.Add(*numUploaders)
+	elapsed := time.Since(start)
+	size := uploaded / 1024 / 1024
+	MBps := float64(size) / (float64(elapsed.Nanoseconds()) / 1000000000)
+	summary := os.Stdout
+	if *jsonOutput {
+		summary = os.Stderr
+	}
+	fmt.Fprintf(summary, "Uploaded %d MB in %s at %0.2f MB/s.\n", size, elapsed, MBps)
+	logging.Flush()
+}
+
+// uploader stores chunks in a drive.Client, using a pool of --numUploaders
+// goroutines which is shared by all of the files being uploaded.
+type uploader struct {
+	client  drive.Client
+	reqs    chan chunkToGo
+	workers sync.WaitGroup
+}
+
+// newUploader starts the goroutines to upload chunks to client.
+func newUploader(client drive.Client) *uploader {
+	u := &uploader{client: client, reqs: make(chan chunkToGo)}
+	u.workers.Add(*numUploaders)
 	for w := 1; w <= *numUploaders; w++ {
-		go func(reqs chan chunkToGo) {
-			for r := range reqs {
-				numRetries := 0
-				b := &backoff.Backoff{Factor: 4}
-				for {
-					numRetries++
-					if err := client.PutChunk(r.chunk.Sha256, r.chunkbytes, r.manifest); err != nil {
-						if numRetries >= *maxRetries {
-							fmt.Fprintf(os.Stderr, "chunk upload failed: %s\n", err)
-							glog.Flush()
-							os.Exit(1)
-						}
-						glog.Errorf("chunk write error, will retry: %s", err)
-						time.Sleep(b.Duration())
-						continue
-					}
-					b.Reset()
-					break
-				}
+		go func() {
+			for r := range u.reqs {
+				u.putChunk(r)
 			}
-			workers.Done()
-			return
-		}(uploadRequests)
+			u.workers.Done()
+		}()
 	}
+	return u
+}
 
-	filename := flag.Arg(0)
+// putChunk stores the chunk described by r, retrying up to maxRetries times.
+func (u *uploader) putChunk(r chunkToGo) {
+	numRetries := 0
+	b := &backoff.Backoff{Factor: 4}
+	for {
+		numRetries++
+		if err := u.client.PutChunk(r.chunk.Sha256, r.chunkbytes, r.manifest); err != nil {
+			if numRetries >= *maxRetries {
+				fmt.Fprintf(os.Stderr, "chunk upload failed: %s\n", err)
+				logging.Flush()
+				os.Exit(1)
+			}
+			logging.Errorf("chunk write error, will retry: %s", err)
+			time.Sleep(b.Duration())
+			continue
+		}
+		break
+	}
+	r.done.Done()
+}
 
-	manifest := shade.NewFile(flag.Arg(1))
+// close stops the upload goroutines, once they are idle.
+func (u *uploader) close() {
+	close(u.reqs)
+	u.workers.Wait()
+}
+
+// throwFile uploads the chunks of the local file filename, and then a
+// shade.File named dest which describes them.  It returns the shade.File.
+func (u *uploader) throwFile(filename, dest string) (*shade.File, error) {
+	manifest := shade.NewFile(dest)
+	if *fileChunkSize > 0 {
+		manifest = shade.NewFileWithChunksize(dest, *fileChunkSize)
+	}
 
 	fh, err := os.Open(filename)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", err)
-		glog.Flush()
-		os.Exit(3)
+		return nil, err
 	}
+	defer fh.Close()
 
-	fi, err := os.Stat(filename)
+	fi, err := fh.Stat()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", err)
-		glog.Flush()
-		os.Exit(4)
+		return nil, err
 	}
 	aproxChunks := fi.Size() / int64(manifest.Chunksize)
+	queued, err := newQueuedSums(*dedupWindow)
+	if err != nil {
+		return nil, err
+	}
+	var planned []shade.Chunk
+	if *warm {
+		if planned, err = u.warmFile(fh, manifest); err != nil {
+			return nil, err
+		}
+	}
+	// A file which fits in one chunk is uploaded by this goroutine, rather
+	// than handed to the workers, as it would be waited for immediately.
+	singleChunk := fi.Mode().IsRegular() && fi.Size() <= int64(manifest.Chunksize)
 
+	var chunks sync.WaitGroup
 	var rt runtime.MemStats
 	for {
 		// Initialize chunk, to ensure each chunk uses a unique nonce
 		chunk := shade.NewChunk()
 		chunk.Index = len(manifest.Chunks)
+		if chunk.Index < len(planned) {
+			// Reuse the nonce the chunk was warmed with.
+			chunk = planned[chunk.Index]
+		}
+		// Size the buffer to the bytes expected to remain, so small files do not
+		// allocate a whole Chunksize.  Once they are read, a one byte probe
+		// checks whether the file has grown, before allocating a whole chunk.
+		bufSize := manifest.Chunksize
+		if remaining := fi.Size() - manifest.Filesize; remaining > 0 && remaining < int64(bufSize) {
+			bufSize = int(remaining)
+		} else if remaining <= 0 && fi.Mode().IsRegular() {
+			more, err := probe(fh)
+			if err != nil {
+				chunks.Wait()
+				return nil, err
+			}
+			if !more {
+				break
+			}
+			if manifest.LastChunksize != 0 {
+				// The last chunk read was short, so no more can follow it.
+				logging.Warningf("%s grew while it was read, uploading its first %d bytes", filename, manifest.Filesize)
+				break
+			}
+		}
 		// Initialize chunkbytes, so it's safe for concurrent access later
-		chunkbytes := make([]byte, manifest.Chunksize)
+		chunkbytes := make([]byte, bufSize)
 
 		// Read a chunk
 		numBytes, err := fh.Read(chunkbytes)
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			fmt.Fprintf(os.Stderr, "%s\n", err)
-			glog.Flush()
-			os.Exit(5)
+			chunks.Wait()
+			return nil, err
 		} else if len(manifest.Chunks) >= *maxChunks {
-			glog.Info("Reached the maximum number of chunks in a single file.")
+			logging.Info("Reached the maximum number of chunks in a single file.")
 			break
 		}
 		manifest.Filesize += int64(numBytes)
@@ -156,49 +331,202 @@ func main() {
 			manifest.LastChunksize = numBytes
 		}
 
-		a := sha256.Sum256(chunkbytes)
-		chunk.Sha256 = a[:]
+		sum, err := manifest.Sum(chunkbytes)
+		if err != nil {
+			chunks.Wait()
+			return nil, err
+		}
+		if chunk.Sha256 != nil && !bytes.Equal(chunk.Sha256, sum) {
+			// The file changed since it was warmed; a nonce must not be reused
+			// for a different sum.
+			chunk.Nonce = shade.NewNonce()
+		}
+		chunk.Sha256 = sum
+		// A chunk repeated within the file is stored once.  It shares the nonce
+		// of the queued copy, so that readers find that copy whichever of the
+		// chunks with the sum they look up.
+		repeated := false
+		if queued != nil {
+			if nonce, ok := queued.Get(string(sum)); ok {
+				chunk.Nonce = nonce.([]byte)
+				repeated = true
+			} else {
+				queued.Add(string(sum), chunk.Nonce)
+			}
+		}
 
 		manifest.Chunks = append(manifest.Chunks, chunk)
 
-		if glog.V(3) {
+		if logging.V(3) {
 			if (len(manifest.Chunks) % 10) == 0 {
 				runtime.ReadMemStats(&rt)
-				glog.Infof("%d/%d chunks: %0.2f MBytes Heap, %0.2f MBytes Sys\n", len(manifest.Chunks), aproxChunks, float64(rt.Alloc)/1024/1024, float64(rt.Sys)/1024/1024)
+				logging.Infof("%d/%d chunks: %0.2f MBytes Heap, %0.2f MBytes Sys\n", len(manifest.Chunks), aproxChunks, float64(rt.Alloc)/1024/1024, float64(rt.Sys)/1024/1024)
 
-				if glog.V(9) {
+				if logging.V(9) {
 					f, err := os.Create("/tmp/throw.mprof")
 					if err != nil {
-						log.Fatal(err)
+						logging.Exit(err)
 					}
 					pprof.WriteHeapProfile(f)
 					f.Close()
 				}
 			}
 		}
+		if repeated {
+			continue
+		}
 		// upload the chunk
-		uploadRequests <- chunkToGo{chunk, chunkbytes, manifest}
+		chunks.Add(1)
+		if singleChunk {
+			u.putChunk(chunkToGo{chunk, chunkbytes, manifest, &chunks})
+			continue
+		}
+		u.reqs <- chunkToGo{chunk, chunkbytes, manifest, &chunks}
 	}
-	close(uploadRequests)
-	workers.Wait()
+	// The manifest is only uploaded once all of its chunks are stored.
+	chunks.Wait()
+	manifest.UpdateDigest()
 
 	jm, err := json.Marshal(manifest)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not marshal file manifest: %s\n", err)
-		glog.Flush()
-		os.Exit(6)
+		return nil, fmt.Errorf("could not marshal file manifest: %s", err)
 	}
 	// upload the manifest
-	a := sha256.Sum256(jm)
-	if err := client.PutFile(a[:], jm); err != nil {
-		fmt.Fprintf(os.Stderr, "manifest upload failed: %s\n", err)
-		glog.Flush()
-		os.Exit(7)
+	if err := u.client.PutFile(shade.Sum(jm), jm); err != nil {
+		return nil, fmt.Errorf("manifest upload failed: %s", err)
 	}
+	return manifest, nil
+}
 
-	elapsed := time.Since(start)
-	size := manifest.Filesize / 1024 / 1024
-	MBps := float64(size) / (float64(elapsed.Nanoseconds()) / 1000000000)
-	fmt.Printf("Uploaded %d MB in %s at %0.2f MB/s.\n", size, elapsed, MBps)
-	glog.Flush()
+// newQueuedSums returns a cache of the nonces of the window chunk sums most
+// recently queued for upload, or nil if window is not positive.
+func newQueuedSums(window int) (*lru.Cache, error) {
+	if window <= 0 {
+		return nil, nil
+	}
+	return lru.New(window)
+}
+
+// warmFile reads fh to find the sum of each of its chunks, and passes them to
+// the client's Warm, before rewinding fh.  It returns the chunks, with the
+// nonces they were warmed with, so that the upload can reuse them.
+func (u *uploader) warmFile(fh *os.File, manifest *shade.File) ([]shade.Chunk, error) {
+	sums, err := manifest.ChunkSums(fh, *maxChunks)
+	if err != nil {
+		return nil, err
+	}
+	planned := make([]shade.Chunk, len(sums))
+	for i, sum := range sums {
+		planned[i] = shade.NewChunk()
+		planned[i].Index = i
+		planned[i].Sha256 = sum
+	}
+	// Clients which encrypt chunks find their nonces in manifest.Chunks.
+	manifest.Chunks = planned
+	u.client.Warm(sums, manifest)
+	manifest.Chunks = nil
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return planned, nil
+}
+
+// probe reports whether fh has more bytes to read, without consuming them.
+func probe(fh *os.File) (bool, error) {
+	var b [1]byte
+	n, err := fh.Read(b[:])
+	if err == io.EOF || n == 0 {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if _, err := fh.Seek(-1, io.SeekCurrent); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// throwDir uploads each regular file below the local directory dir, except
+// those matched by excl, as a shade.File at the same relative path below dest.
+// Progress is reported to w.  It returns the number of bytes uploaded.
+func (u *uploader) throwDir(dir, dest string, excl *excluder, w io.Writer) (int64, error) {
+	var files []string // relative to dir, slash separated
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if excl.excluded(rel, fi.IsDir()) {
+			logging.V(2).Infof("excluding %s", rel)
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			if !fi.IsDir() {
+				logging.Warningf("skipping %s, which is not a regular file", rel)
+			}
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var uploaded int64
+	for i, rel := range files {
+		manifest, err := u.throwFile(filepath.Join(dir, filepath.FromSlash(rel)), path.Join(dest, rel))
+		if err != nil {
+			return uploaded, fmt.Errorf("%s: %s", rel, err)
+		}
+		uploaded += manifest.Filesize
+		if *jsonOutput {
+			if err := writeJSON(w, manifest); err != nil {
+				return uploaded, err
+			}
+			continue
+		}
+		fmt.Fprintf(w, "[%d/%d] %s (%d bytes)\n", i+1, len(files), manifest.Filename, manifest.Filesize)
+	}
+	return uploaded, nil
+}
+
+// thrownFile is the description of each stored file printed by -json.
+type thrownFile struct {
+	Sum      string `json:"sum"` // hex encoded sum of the file object
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Chunks   int    `json:"chunks"`
+	// UniqueChunks is the number of distinct chunks; the rest repeat the
+	// content of another chunk of the file, so were stored only once.
+	UniqueChunks int `json:"uniqueChunks"`
+}
+
+// writeJSON writes a thrownFile describing manifest to w, as a single line.
+func writeJSON(w io.Writer, manifest *shade.File) error {
+	jm, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("could not marshal file manifest: %s", err)
+	}
+	unique := make(map[string]struct{})
+	for _, c := range manifest.Chunks {
+		unique[string(c.Sha256)] = struct{}{}
+	}
+	return json.NewEncoder(w).Encode(thrownFile{
+		Sum:          hex.EncodeToString(shade.Sum(jm)),
+		Filename:     manifest.Filename,
+		Size:         manifest.Filesize,
+		Chunks:       len(manifest.Chunks),
+		UniqueChunks: len(unique),
+	})
 }
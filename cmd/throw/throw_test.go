@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/encrypt"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+func TestExcluded(t *testing.T) {
+	e, err := parseExcludes(strings.NewReader(`
+# dependencies and VCS metadata
+node_modules/
+.git
+*.tmp
+!keep.tmp
+/build
+docs/**/draft.md
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"node_modules", true, true},
+		{"web/node_modules", true, true},
+		{"node_modules", false, false}, // only directories match
+		{".git", true, true},
+		{"sub/.git", true, true},
+		{"a.tmp", false, true},
+		{"sub/b.tmp", false, true},
+		{"keep.tmp", false, false},
+		{"build", true, true},
+		{"sub/build", true, false}, // anchored to the root
+		{"docs/draft.md", false, true},
+		{"docs/2024/jan/draft.md", false, true},
+		{"notes/draft.md", false, false},
+		{"src/main.go", false, false},
+	}
+	for _, tc := range tests {
+		if got := e.excluded(tc.rel, tc.isDir); got != tc.want {
+			t.Errorf("excluded(%q, %v): want %v, got: %v", tc.rel, tc.isDir, tc.want, got)
+		}
+	}
+}
+
+func TestThrowDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throwTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, fn := range []string{
+		"a.txt",
+		"sub/b.txt",
+		"sub/scratch.tmp",
+		"node_modules/dep/index.js",
+		"sub/node_modules/dep/index.js",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(fn))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excl, err := parseExcludes(strings.NewReader("node_modules/\n*.tmp\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newUploader(client)
+	progress := &bytes.Buffer{}
+	uploaded, err := u.throwDir(dir, "backups/dir", excl, progress)
+	u.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len("a.txt") + len("sub/b.txt")); uploaded != want {
+		t.Errorf("want %d bytes uploaded, got: %d", want, uploaded)
+	}
+	if !strings.Contains(progress.String(), "[2/2]") {
+		t.Errorf("unexpected progress output: %q", progress.String())
+	}
+
+	sums, err := client.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, sum := range sums {
+		fj, err := client.GetFile(sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := &shade.File{}
+		if err := f.FromJSON(fj); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, f.Filename)
+		if _, err := client.GetChunk(f.Chunks[0].Sha256, f); err != nil {
+			t.Errorf("chunk of %s was not uploaded: %s", f.Filename, err)
+		}
+	}
+	sort.Strings(got)
+	want := []string{"backups/dir/a.txt", "backups/dir/sub/b.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want files %v, got: %v", want, got)
+	}
+}
+
+func TestThrowFileSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throwTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig int) { *fileChunkSize = orig }(*fileChunkSize)
+	*fileChunkSize = 16
+
+	client, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newUploader(client)
+	defer u.close()
+	for _, size := range []int{0, 1, 15, 16, 17, 32, 100} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		p := filepath.Join(dir, "file")
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := u.throwFile(p, "file")
+		if err != nil {
+			t.Fatalf("throwFile(%d bytes): %s", size, err)
+		}
+		if f.Filesize != int64(size) {
+			t.Errorf("%d bytes: want Filesize %d, got: %d", size, size, f.Filesize)
+		}
+		if want := (size + 15) / 16; len(f.Chunks) != want {
+			t.Errorf("%d bytes: want %d chunks, got: %d", size, want, len(f.Chunks))
+		}
+		var got []byte
+		for _, c := range f.Chunks {
+			b, err := client.GetChunk(c.Sha256, f)
+			if err != nil {
+				t.Fatalf("%d bytes: chunk %d: %s", size, c.Index, err)
+			}
+			got = append(got, b...)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: uploaded content differs", size)
+		}
+	}
+}
+
+// TestThrowSmallFileAllocs confirms that uploading a small file allocates in
+// proportion to its size, rather than its Chunksize.
+func TestThrowSmallFileAllocs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throwTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig int) { *fileChunkSize = orig }(*fileChunkSize)
+	*fileChunkSize = 64 * 1024 * 1024
+
+	p := filepath.Join(dir, "small")
+	if err := ioutil.WriteFile(p, bytes.Repeat([]byte{'x'}, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newUploader(client)
+	defer u.close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 10; i++ {
+		if _, err := u.throwFile(p, "small"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	if perFile := (after.TotalAlloc - before.TotalAlloc) / 10; perFile > 1024*1024 {
+		t.Errorf("uploading a 1KiB file allocated %d bytes", perFile)
+	}
+}
+
+// warmClient records the sums passed to Warm, and the chunks put before it was
+// called.
+type warmClient struct {
+	drive.Client
+	mu         sync.Mutex
+	warmed     [][]byte
+	putsBefore int
+	puts       int
+}
+
+func (c *warmClient) Warm(chunks [][]byte, f *shade.File) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.warmed = chunks
+	c.putsBefore = c.puts
+}
+
+func (c *warmClient) PutChunk(sha256sum, chunk []byte, f *shade.File) error {
+	c.mu.Lock()
+	c.puts++
+	c.mu.Unlock()
+	return c.Client.PutChunk(sha256sum, chunk, f)
+}
+
+func TestThrowFileWarms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throwTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig int) { *fileChunkSize = orig }(*fileChunkSize)
+	*fileChunkSize = 16
+	defer func(orig bool) { *warm = orig }(*warm)
+	*warm = true
+
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	p := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &warmClient{Client: mc}
+	u := newUploader(client)
+	defer u.close()
+	f, err := u.throwFile(p, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.putsBefore != 0 {
+		t.Errorf("Warm was called after %d chunks were put", client.putsBefore)
+	}
+	if len(client.warmed) != len(f.Chunks) {
+		t.Fatalf("want %d chunks warmed, got: %d", len(f.Chunks), len(client.warmed))
+	}
+	for i, c := range f.Chunks {
+		if !bytes.Equal(client.warmed[i], c.Sha256) {
+			t.Errorf("chunk %d: warmed %x, want %x", i, client.warmed[i], c.Sha256)
+		}
+	}
+	var got []byte
+	for _, c := range f.Chunks {
+		b, err := mc.GetChunk(c.Sha256, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("uploaded content differs")
+	}
+}
+
+func TestThrowFileDedups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throwTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig int) { *fileChunkSize = orig }(*fileChunkSize)
+	*fileChunkSize = 16
+
+	// 40 chunks, repeating 3 patterns, and a short last chunk.
+	var data []byte
+	for i := 0; i < 40; i++ {
+		data = append(data, bytes.Repeat([]byte{byte(i % 3)}, 16)...)
+	}
+	data = append(data, 'x')
+	p := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privkey)}
+	ec, err := encrypt.NewClient(drive.Config{
+		Provider:      "encrypt",
+		RsaPrivateKey: string(pem.EncodeToMemory(b)),
+		Children:      []drive.Config{{Provider: "memory", Write: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(orig int) { *dedupWindow = orig }(*dedupWindow)
+	for _, tc := range []struct {
+		window int
+		puts   int
+	}{
+		{window: 65536, puts: 4},
+		{window: 0, puts: 41},
+	} {
+		*dedupWindow = tc.window
+		client := &warmClient{Client: ec}
+		u := newUploader(client)
+		f, err := u.throwFile(p, "file")
+		u.close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.puts != tc.puts {
+			t.Errorf("window %d: want %d chunks put, got: %d", tc.window, tc.puts, client.puts)
+		}
+		if len(f.Chunks) != 41 {
+			t.Fatalf("window %d: want 41 chunks, got: %d", tc.window, len(f.Chunks))
+		}
+		var got []byte
+		for _, c := range f.Chunks {
+			b, err := ec.GetChunk(c.Sha256, f)
+			if err != nil {
+				t.Fatalf("window %d: chunk %d: %s", tc.window, c.Index, err)
+			}
+			got = append(got, b...)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("window %d: uploaded content differs", tc.window)
+		}
+	}
+}
+
+func TestThrowJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throwTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig int) { *fileChunkSize = orig }(*fileChunkSize)
+	*fileChunkSize = 4
+	defer func(orig bool) { *jsonOutput = orig }(*jsonOutput)
+	*jsonOutput = true
+
+	// The first two chunks have the same content.
+	for fn, content := range map[string]string{"a": "abcdabcdefg", "b": "hij"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newUploader(client)
+	out := &bytes.Buffer{}
+	_, err = u.throwDir(dir, "dest", &excluder{}, out)
+	u.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []thrownFile
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		var tf thrownFile
+		if err := dec.Decode(&tf); err != nil {
+			t.Fatalf("could not parse %q: %s", out, err)
+		}
+		got = append(got, tf)
+	}
+	want := []thrownFile{
+		{Filename: "dest/a", Size: 11, Chunks: 3, UniqueChunks: 2},
+		{Filename: "dest/b", Size: 3, Chunks: 1, UniqueChunks: 1},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %d JSON objects, got: %+v", len(want), got)
+	}
+	for i, tf := range got {
+		sum, err := hex.DecodeString(tf.Sum)
+		if err != nil {
+			t.Fatalf("%s: invalid sum: %s", tf.Filename, err)
+		}
+		fj, err := client.GetFile(sum)
+		if err != nil {
+			t.Fatalf("%s: the file object %s was not stored: %s", tf.Filename, tf.Sum, err)
+		}
+		f := &shade.File{}
+		if err := f.FromJSON(fj); err != nil {
+			t.Fatal(err)
+		}
+		if f.Filename != tf.Filename || f.Filesize != tf.Size || len(f.Chunks) != tf.Chunks {
+			t.Errorf("%s describes a different file object: %+v", tf.Sum, f)
+		}
+		tf.Sum = ""
+		if tf != want[i] {
+			t.Errorf("want %+v, got: %+v", want[i], tf)
+		}
+	}
+}
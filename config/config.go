@@ -11,11 +11,23 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"sync"
 
+	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
 )
 
-// Read finds, reads, parses, and returns the config.
+var (
+	selectedMu sync.Mutex // protects selected and selectedBy
+	selected   string     // the SumAlgorithm selected by Read
+	selectedBy string     // the config which selected it, if any has
+)
+
+// Read finds, reads, parses, and returns the config.  It also selects the
+// SumAlgorithm of the config as the one used by shade.Sum.  That algorithm is
+// shared by the whole process, so Read returns an error for a config whose
+// SumAlgorithm differs from that of a config it read before; commands which
+// use two repositories require them to address objects by the same sum.
 func Read(filename string) (drive.Config, error) {
 	contents, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -26,6 +38,19 @@ func Read(filename string) (drive.Config, error) {
 	if err != nil {
 		return drive.Config{}, fmt.Errorf("parsing %q: %s", filename, err)
 	}
+	alg := configs.SumAlgorithm
+	if alg == "" {
+		alg = shade.SHA256
+	}
+	selectedMu.Lock()
+	defer selectedMu.Unlock()
+	if selectedBy != "" && alg != selected {
+		return drive.Config{}, fmt.Errorf("%q uses the sum algorithm %q, but %q uses %q; repositories with different sum algorithms can't be used together", filename, alg, selectedBy, selected)
+	}
+	if err := shade.SetSumAlgorithm(alg); err != nil {
+		return drive.Config{}, fmt.Errorf("parsing %q: %s", filename, err)
+	}
+	selected, selectedBy = alg, filename
 
 	return configs, nil
 }
@@ -40,5 +65,8 @@ func parseConfig(contents []byte) (drive.Config, error) {
 	if !drive.ValidProvider(config.Provider) {
 		return drive.Config{}, fmt.Errorf("unsupported provider in config: %q", config.Provider)
 	}
+	if _, err := shade.SumWith(config.SumAlgorithm, nil); err != nil {
+		return drive.Config{}, err
+	}
 	return config, nil
 }
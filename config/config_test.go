@@ -2,10 +2,12 @@ package config
 
 import (
 	"io/ioutil"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
 
 	// These are imported here to register them as drive client providers, and
@@ -51,6 +53,19 @@ func TestParseConfig(t *testing.T) {
 			config: []byte("{}"),
 			err:    "unsupported provider",
 		},
+		{
+			name:   "alternate sum algorithm",
+			config: []byte(`{"Provider": "memory", "SumAlgorithm": "sha512/256"}`),
+			want: drive.Config{
+				Provider:     "memory",
+				SumAlgorithm: "sha512/256",
+			},
+		},
+		{
+			name:   "unknown sum algorithm",
+			config: []byte(`{"Provider": "memory", "SumAlgorithm": "md5"}`),
+			err:    `unknown sum algorithm "md5"`,
+		},
 		{
 			name:       "bad provider",
 			configPath: "testdata/bad-provider.config.json",
@@ -250,3 +265,35 @@ func TestParseConfig(t *testing.T) {
 		}
 	}
 }
+
+// TestReadRejectsMixedSumAlgorithms checks that Read refuses a config whose
+// SumAlgorithm differs from that of a config read before it.
+func TestReadRejectsMixedSumAlgorithms(t *testing.T) {
+	defer func() {
+		selected, selectedBy = "", ""
+		shade.SetSumAlgorithm(shade.SHA256)
+	}()
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		fn := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fn, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+	dflt := write("default.json", `{"Provider": "memory"}`)
+	sha256 := write("sha256.json", `{"Provider": "memory", "SumAlgorithm": "sha256"}`)
+	sha512 := write("sha512.json", `{"Provider": "memory", "SumAlgorithm": "sha512/256"}`)
+
+	for _, fn := range []string{dflt, sha256} {
+		if _, err := Read(fn); err != nil {
+			t.Errorf("Read(%q): %s", fn, err)
+		}
+	}
+	if _, err := Read(sha512); err == nil {
+		t.Errorf("Read(%q) accepted a second sum algorithm", sha512)
+	}
+	if got := shade.SumAlgorithm(); got != shade.SHA256 {
+		t.Errorf("after the rejected config, shade.Sum uses %q, want %q", got, shade.SHA256)
+	}
+}
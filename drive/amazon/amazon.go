@@ -2,19 +2,23 @@ package amazon
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"expvar"
 	"fmt"
 	"io"
-	"log"
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
 )
 
 var (
@@ -48,7 +52,17 @@ type fileMetadata struct {
 }
 
 // NewClient returns an initialized Drive drive.Client object.
+//
+// Amazon Cloud Drive is not suitable as a bounded cache tier.  Its
+// modifiedDate records when an object was uploaded, not when it was last read,
+// so LRU eviction keyed on it would delete the oldest chunks, which files
+// still reference, from what is usually the authoritative copy of the
+// repository.  Configs which set MaxFiles or MaxChunkBytes are rejected, rather
+// than silently allowed to grow without bound.
 func NewClient(c drive.Config) (drive.Client, error) {
+	if c.MaxFiles > 0 || c.MaxChunkBytes > 0 {
+		return nil, errors.New("the amazon client does not support MaxFiles or MaxChunkBytes")
+	}
 	client, err := getOAuthClient(c)
 	if err != nil {
 		return nil, err
@@ -106,7 +120,7 @@ func (s *Drive) ListFiles() ([][]byte, error) {
 		for _, f := range gfResp.Data {
 			b, err := hex.DecodeString(f.Name)
 			if err != nil {
-				log.Printf("Shade file %q with invalid hex in filename: %s\n", f.Name, err)
+				logging.Warningf("Shade file %q with invalid hex in filename: %s", f.Name, err)
 			}
 			s.files[string(b)] = f.ID
 		}
@@ -129,6 +143,7 @@ func (s *Drive) ListFiles() ([][]byte, error) {
 // GetFile retrieves a file by sha256sum, as returned by ListFiles().
 // f should be marshalled JSON, and may be encrypted.
 func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	defer drive.ObserveLatency("amazon", "GetFile", time.Now())
 	getFileReq.Add(1)
 	return s.GetChunk(sha256sum, nil)
 }
@@ -136,6 +151,7 @@ func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
 // PutFile writes the manifest describing a new file.
 // f should be marshalled JSON, and may be encrypted.
 func (s *Drive) PutFile(sha256sum, contents []byte) error {
+	defer drive.ObserveLatency("amazon", "PutFile", time.Now())
 	putFileReq.Add(1)
 	filename := hex.EncodeToString(sha256sum)
 	metadata := map[string]interface{}{
@@ -166,6 +182,7 @@ func (s *Drive) ReleaseFile(sha256sum []byte) error {
 // The cache is especially helpful for shade.File objects, which are
 // efficiently looked up on each call of ListFiles.
 func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	defer drive.ObserveLatency("amazon", "GetChunk", time.Now())
 	getChunkReq.Add(1)
 	s.fm.RLock()
 	fileID, ok := s.files[string(sha256sum)]
@@ -196,8 +213,34 @@ func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
 	return c, nil
 }
 
+// Stat returns the size and modification time of a file or chunk, from its
+// metadata.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	v := url.Values{}
+	v.Set("filters", fmt.Sprintf("kind:FILE AND name:%x", sha256sum))
+	gfResp, err := s.getMetadata(v)
+	if err != nil {
+		return drive.Info{}, err
+	}
+	if len(gfResp.Data) == 0 {
+		return drive.Info{}, fmt.Errorf("no file with SHA sum: %x", sha256sum)
+	}
+	if len(gfResp.Data) > 1 {
+		return drive.Info{}, fmt.Errorf("More than one file with SHA sum: %x", sha256sum)
+	}
+	md := gfResp.Data[0]
+	info := drive.Info{Size: md.Size}
+	if md.ModifiedDate != "" {
+		if info.ModTime, err = time.Parse(time.RFC3339, md.ModifiedDate); err != nil {
+			return drive.Info{}, fmt.Errorf("parsing ModifiedDate of %x: %s", sha256sum, err)
+		}
+	}
+	return info, nil
+}
+
 // PutChunk writes a chunk and returns its SHA-256 sum
 func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
+	defer drive.ObserveLatency("amazon", "PutChunk", time.Now())
 	putChunkReq.Add(1)
 	s.fm.RLock()
 	_, ok := s.files[string(sha256sum)]
@@ -244,6 +287,32 @@ func (s *Drive) Local() bool { return false }
 // Persistent returns whether the storage is persistent across task restarts.
 func (s *Drive) Persistent() bool { return true }
 
+// Ping requests the metadata of at most one file, to verify Amazon Cloud Drive
+// is reachable and the OAuth token is authorized.
+func (s *Drive) Ping(ctx context.Context) error {
+	v := url.Values{}
+	v.Set("limit", "1")
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/nodes?%s", s.ep.MetadataURL(), v.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("ping failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// Close stops refreshing the endpoint in the background.
+func (s *Drive) Close() error {
+	s.ep.Close()
+	return nil
+}
+
 // NewChunkLister returns an iterator which returns all chunks in Drive.
 func (s *Drive) NewChunkLister() drive.ChunkLister {
 	filters := "kind:FILE AND labels:shadeChunk"
@@ -310,7 +379,7 @@ func (c *ChunkLister) fetchNextChunkSums() error {
 	for _, f := range gfResp.Data {
 		b, err := hex.DecodeString(f.Name)
 		if err != nil {
-			log.Printf("Shade file %q with invalid hex in filename: %s\n", f.Name, err)
+			logging.Warningf("Shade file %q with invalid hex in filename: %s", f.Name, err)
 		}
 		c.sums = append(c.sums, b)
 	}
@@ -342,7 +411,7 @@ func (s *Drive) uploadFile(filename string, chunk []byte, metadata interface{})
 	} else if resp.StatusCode != 201 {
 		buf := new(bytes.Buffer)
 		buf.ReadFrom(resp.Body)
-		return fmt.Errorf("upload failed: %s: %s", resp.Status, buf.String())
+		return statusError(resp, fmt.Errorf("upload failed: %s: %s", resp.Status, buf.String()))
 	}
 	return nil
 }
@@ -400,7 +469,7 @@ func (s *Drive) getMetadata(v url.Values) (getFilesResponse, error) {
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(resp.Body)
 	if resp.StatusCode != 200 {
-		return getFilesResponse{}, fmt.Errorf("%s: %s", resp.Status, buf.String())
+		return getFilesResponse{}, statusError(resp, fmt.Errorf("%s: %s", resp.Status, buf.String()))
 	}
 
 	// Unmarshal the Amazon metadata about our file object
@@ -424,7 +493,19 @@ func (s *Drive) getFileContents(id string) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(resp.Body)
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("%s: %s", resp.Status, buf.String())
+		return nil, statusError(resp, fmt.Errorf("%s: %s", resp.Status, buf.String()))
 	}
 	return buf.Bytes(), nil
 }
+
+// statusError returns ret, the error describing an unsuccessful resp, wrapped
+// in a drive.QuotaError if resp reports that a quota of the account is
+// exceeded: a 429 Too Many Requests, or a 403 Forbidden which names a quota.
+func statusError(resp *http.Response, ret error) error {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode == http.StatusForbidden && strings.Contains(strings.ToLower(ret.Error()), "quota"):
+		return drive.NewQuotaError("amazon", ret)
+	}
+	return ret
+}
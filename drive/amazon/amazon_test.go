@@ -0,0 +1,38 @@
+package amazon
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/asjoyner/shade/drive"
+)
+
+func TestRejectsCacheLimits(t *testing.T) {
+	for _, c := range []drive.Config{
+		{Provider: "amazon", MaxFiles: 10},
+		{Provider: "amazon", MaxChunkBytes: 1024},
+	} {
+		if _, err := NewClient(c); err == nil {
+			t.Errorf("NewClient(%+v) succeeded, want an error", c)
+		}
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	for _, tc := range []struct {
+		code  int
+		body  string
+		quota bool
+	}{
+		{http.StatusTooManyRequests, "Rate exceeded", true},
+		{http.StatusForbidden, "Storage quota exceeded", true},
+		{http.StatusForbidden, "Not authorized", false},
+		{http.StatusInternalServerError, "", false},
+	} {
+		err := statusError(&http.Response{StatusCode: tc.code}, errors.New(tc.body))
+		if got := drive.IsQuotaError(err); got != tc.quota {
+			t.Errorf("statusError(%d, %q): want a QuotaError: %v, got: %v", tc.code, tc.body, tc.quota, err)
+		}
+	}
+}
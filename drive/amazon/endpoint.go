@@ -24,11 +24,14 @@ type Endpoint struct {
 	client      *http.Client
 	contentURL  string
 	metadataURL string
+	stop        chan struct{} // closed by Close
+	closeOnce   sync.Once
 }
 
-// NewEndpoint returns an initialized Endpoint, or an error.
+// NewEndpoint returns an initialized Endpoint, or an error.  It keeps the
+// Endpoint up to date until Close is called.
 func NewEndpoint(c *http.Client) (*Endpoint, error) {
-	ep := &Endpoint{client: c}
+	ep := &Endpoint{client: c, stop: make(chan struct{})}
 	if err := ep.GetEndpoint(); err != nil {
 		return nil, err
 	}
@@ -68,23 +71,33 @@ func (ep *Endpoint) GetEndpoint() error {
 	return nil
 }
 
-// refreshEndpoint periodically calls GetEndpoint
+// refreshEndpoint periodically calls GetEndpoint, until Close is called.
 // This needs to be run every 3-5 days, per:
 // https://developer.amazon.com/public/apis/experience/cloud-drive/content/account
 //
 // TODO(asjoyner): cache this, and save 1 RPC for every invocation of throw
 func (ep *Endpoint) RefreshEndpoint() {
 	for {
+		wait := 72 * time.Hour // Success!  Hibernation time...
 		if err := backoff.Retry(ep.GetEndpoint, backoff.NewExponentialBackOff()); err != nil {
 			// Failed for 15 minutes, lets sleep for a couple hours and try again.
-			time.Sleep(2 * time.Hour)
-		} else {
-			// Success!  Hibernation time...
-			time.Sleep(72 * time.Hour)
+			wait = 2 * time.Hour
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ep.stop:
+			t.Stop()
+			return
+		case <-t.C:
 		}
 	}
 }
 
+// Close stops RefreshEndpoint, once any request in progress completes.
+func (ep *Endpoint) Close() {
+	ep.closeOnce.Do(func() { close(ep.stop) })
+}
+
 func (ep *Endpoint) MetadataURL() string {
 	ep.RLock()
 	defer ep.RUnlock()
@@ -0,0 +1,46 @@
+package amazon
+
+import (
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// endpointTransport answers every request with an endpoint response.
+type endpointTransport struct{}
+
+func (endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := `{"ContentURL": "https://content.example/", "MetadataURL": "https://metadata.example/"}`
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestEndpointClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ep, err := NewEndpoint(&http.Client{Transport: endpointTransport{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ep.MetadataURL(); got != "https://metadata.example/" {
+		t.Errorf("MetadataURL(), want https://metadata.example/, got: %q", got)
+	}
+	d := &Drive{ep: ep}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d.Close() // closing twice is harmless
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines are still running after Close, want %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
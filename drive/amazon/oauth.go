@@ -72,7 +72,9 @@ func getOAuthClient(c drive.Config) (*http.Client, error) {
 		oauthutil.SaveToken(tokenPath, token)
 	}
 
-	return conf.Client(oauth2.NoContext, token), nil
+	client := conf.Client(oauth2.NoContext, token)
+	client.Timeout = c.Timeout()
+	return client, nil
 }
 
 func getFreshToken(conf *oauth2.Config) (*oauth2.Token, error) {
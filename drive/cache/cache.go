@@ -4,23 +4,52 @@
 package cache
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-
-	"github.com/golang/glog"
+	"strings"
+	"sync"
 
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+)
+
+var (
+	listConcurrency    = flag.Int("cacheListConcurrency", 10, "The maximum number of child clients to list files from in parallel.")
+	getConcurrency     = flag.Int("cacheGetConcurrency", 10, "The maximum number of files to fetch from each child client in parallel, in GetFiles.")
+	requireAllReleases = flag.Bool("requireAllReleases", false, "Report a release as failed if any child fails it, not only persistent children.")
+	verifyChunks       = flag.Bool("cacheVerifyChunks", true, "Verify the sum of each unencrypted chunk read from a child, and read it from the next child if it does not match.")
+	refreshConcurrency = flag.Int("cacheRefreshConcurrency", 2, "The number of goroutines which copy the files and chunks read from a child to the Local children in the background (0 copies them before the read returns).")
 )
 
+// refreshQueue is the number of refreshes which may wait for a goroutine.
+// Refreshes requested while it is full are dropped.
+const refreshQueue = 256
+
 func init() {
 	drive.RegisterProvider("cache", NewClient)
 }
 
+// refreshReq describes a file or chunk read from a child, to be copied to the
+// Local children.
 type refreshReq struct {
 	sha256sum []byte
 	content   []byte
 	f         *shade.File
+	chunk     bool         // content is a chunk, rather than a file
+	from      drive.Client // a child which is not refreshed, if not nil
+}
+
+// key identifies the file or chunk described by r.
+func (r refreshReq) key() string {
+	if r.chunk {
+		return "c" + string(r.sha256sum)
+	}
+	return "f" + string(r.sha256sum)
 }
 
 // NewClient returns a Drive client which centralizes reading and writing to
@@ -36,14 +65,15 @@ func NewClient(c drive.Config) (drive.Client, error) {
 			return nil, fmt.Errorf("%s: %s", conf.Provider, err)
 		}
 		if child.GetConfig().Write {
-			glog.V(2).Infof("child %s is writable.", conf.Provider)
+			logging.V(2).Infof("child %s is writable.", conf.Provider)
 			d.config.Write = true
 		} else {
-			glog.V(2).Infof("child %s is NOT writable.", conf.Provider)
+			logging.V(2).Infof("child %s is NOT writable.", conf.Provider)
 		}
 		d.clients = append(d.clients, child)
 	}
-	glog.V(2).Infof("my final write status is: %v", d.config.Write)
+	logging.V(2).Infof("my final write status is: %v", d.config.Write)
+	d.startRefreshes(*refreshConcurrency)
 	return d, nil
 }
 
@@ -55,56 +85,182 @@ func NewClient(c drive.Config) (drive.Client, error) {
 // returning false.  If any of its clients are Persistent(), it requires writes
 // to at least one of those backends to succeed, and reports itself as
 // Persistent().
+//
+// A file or chunk read from a child is copied to the Local children by
+// background goroutines, so that a slow Local child does not delay the read;
+// see refresh.
 type Drive struct {
 	config  drive.Config
 	clients []drive.Client
 	debug   bool
+
+	refreshes  chan refreshReq // nil if refreshes are synchronous
+	refreshMu  sync.Mutex      // protects refreshing and closed
+	refreshing map[string]bool // the keys of the refreshes queued or running
+	refreshed  *sync.Cond      // signalled when refreshing becomes empty
+	closed     bool
+	workers    sync.WaitGroup // the goroutines which refresh
 }
 
 // ListFiles retrieves all of the File objects known to all of the provided
 // clients.  The return is a list of sha256sums of the file object.  The keys
 // may be passed to GetChunk() to retrieve the corresponding shade.File.
+//
+// It is equivalent to ListFilesContext with a background context.
 func (s *Drive) ListFiles() ([][]byte, error) {
-	c := make(chan [][]byte, len(s.clients))
-	for _, client := range s.clients {
-		// TODO: spawn goroutines for this in advance, one per client?
-		// careful to keep it threadsafe
-		go func(client drive.Client) {
-			f, err := client.ListFiles()
-			if err != nil {
-				glog.Warningf("error reading from %q: %s", client.GetConfig().Provider, err)
-			}
-			c <- f
-		}(client)
+	return s.ListFilesContext(context.Background())
+}
+
+// ListFilesContext returns the union of the files known to the child clients
+// which succeed.  At most --cacheListConcurrency children are listed at once.
+// It returns an error if every child fails, rather than an empty list which
+// could mislead eg. cleanup into believing the files have been removed.  If
+// ctx is cancelled before all of the children respond, it returns ctx.Err().
+func (s *Drive) ListFilesContext(ctx context.Context) ([][]byte, error) {
+	type result struct {
+		files [][]byte
+		err   error
 	}
+	// results is buffered so abandoned requests do not leak goroutines
+	results := make(chan result, len(s.clients))
+	go func() {
+		sem := make(chan struct{}, *listConcurrency)
+		for _, client := range s.clients {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(client drive.Client) {
+				defer func() { <-sem }()
+				f, err := client.ListFiles()
+				if err != nil {
+					logging.Warningf("error reading from %q: %s", client.GetConfig().Provider, err)
+					err = fmt.Errorf("%s: %s", client.GetConfig().Provider, err)
+				}
+				results <- result{f, err}
+			}(client)
+		}
+	}()
 
 	var resp [][]byte
-	for i := 0; i < len(s.clients); i++ {
-		resp = append(resp, <-c...)
+	var failed []string
+	for range s.clients {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		select {
+		case r := <-results:
+			if r.err != nil {
+				failed = append(failed, r.err.Error())
+				continue
+			}
+			resp = append(resp, r.files...)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if len(failed) == len(s.clients) {
+		return nil, fmt.Errorf("all clients failed to list files: %s", strings.Join(failed, "; "))
 	}
-
 	return resp, nil
 }
 
+// ListFilesSince returns the files added to the child clients since the call
+// which returned token.  The token records the position of each child, so a
+// child which fails is asked again from the same position by the next call.
+// It returns drive.ErrNoChanges unless every child implements
+// drive.ChangeLister, and an error if every child fails.
+func (s *Drive) ListFilesSince(token string) ([][]byte, string, error) {
+	for _, client := range s.clients {
+		if _, ok := client.(drive.ChangeLister); !ok {
+			return nil, "", drive.ErrNoChanges
+		}
+	}
+	tokens := make([]string, len(s.clients))
+	if token != "" {
+		if err := json.Unmarshal([]byte(token), &tokens); err != nil || len(tokens) != len(s.clients) {
+			return nil, "", fmt.Errorf("invalid token %q", token)
+		}
+	}
+	var resp [][]byte
+	var failed []string
+	for i, client := range s.clients {
+		files, next, err := drive.ListFilesSince(client, tokens[i])
+		if err != nil {
+			logging.Warningf("error listing changes from %q: %s", client.GetConfig().Provider, err)
+			failed = append(failed, fmt.Sprintf("%s: %s", client.GetConfig().Provider, err))
+			continue
+		}
+		resp = append(resp, files...)
+		tokens[i] = next
+	}
+	if len(failed) == len(s.clients) {
+		return nil, "", fmt.Errorf("all clients failed to list changes: %s", strings.Join(failed, "; "))
+	}
+	next, err := json.Marshal(tokens)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp, string(next), nil
+}
+
 // GetFile retrieves a file with a given SHA-256 sum.  It will be returned
 // from the first client in the slice of structs that returns the chunk.
 func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	var quotaErr error
 	for _, client := range s.clients {
 		file, err := client.GetFile(sha256sum)
 		if err != nil {
-			glog.V(2).Infof("File %x not found in %q: %s", sha256sum, client.GetConfig().Provider, err)
-			continue
-		}
-		for _, c := range s.clients {
-			if c.Local() && c != client {
-				c.PutFile(sha256sum, file)
+			if overQuota(client, err) {
+				quotaErr = err
+				continue
 			}
+			logging.V(2).Infof("File %x not found in %q: %s", sha256sum, client.GetConfig().Provider, err)
+			continue
 		}
+		s.refresh(refreshReq{sha256sum: sha256sum, content: file, from: client})
 		return file, nil
 	}
+	if quotaErr != nil {
+		return nil, quotaErr
+	}
 	return nil, errors.New("file not found")
 }
 
+// GetFiles retrieves the files with the given sums, as described by
+// drive.FilesGetter.  Like GetFile, each file is read from the first child
+// which has it, but the whole batch is requested from the first child, up to
+// --cacheGetConcurrency at a time, and only the files it lacks are requested
+// from the next.  Files read from a child are copied to the other Local
+// children.
+func (s *Drive) GetFiles(ctx context.Context, sums [][]byte, fn func(sha256sum, file []byte, err error)) error {
+	remaining := sums
+	for _, client := range s.clients {
+		if len(remaining) == 0 {
+			break
+		}
+		var missing [][]byte
+		err := drive.GetFiles(ctx, client, remaining, *getConcurrency, func(sha256sum, file []byte, err error) {
+			if err != nil {
+				logging.V(2).Infof("File %x not found in %q: %s", sha256sum, client.GetConfig().Provider, err)
+				missing = append(missing, sha256sum)
+				return
+			}
+			s.refresh(refreshReq{sha256sum: sha256sum, content: file, from: client})
+			fn(sha256sum, file, nil)
+		})
+		if err != nil {
+			return err
+		}
+		remaining = missing
+	}
+	for _, sha256sum := range remaining {
+		fn(sha256sum, nil, errors.New("file not found"))
+	}
+	return nil
+}
+
 // PutFile writes the metadata describing a new file.  It will be written to
 // all shade backends configured to Write.  If any backends are Persistent, it
 // returns an error if all Persistent backends fail to write.
@@ -118,9 +274,9 @@ func (s *Drive) PutFile(sha256sum, f []byte) error {
 	done := make(chan struct{}, len(s.clients))
 	for _, client := range s.clients {
 		go func(client drive.Client) {
-			glog.V(3).Infof("client %s putting file %x", client.GetConfig().Provider, sha256sum)
+			logging.V(3).Infof("client %s putting file %x", client.GetConfig().Provider, sha256sum)
 			if err := client.PutFile(sha256sum, f); err != nil {
-				glog.Warningf("%s.PutFile(%x) failed: %s", client.GetConfig().Provider, sha256sum, err)
+				logging.Warningf("%s.PutFile(%x) failed: %s", client.GetConfig().Provider, sha256sum, err)
 				done <- struct{}{}
 				return
 			}
@@ -142,38 +298,148 @@ func (s *Drive) PutFile(sha256sum, f []byte) error {
 }
 
 // ReleaseFile calls ReleaseFile on each of the provided clients in sequence.
-// No errors are returned from child clients.
+// It first waits for a pending refresh of the file, which would restore it.
+// See release for the errors which are returned.
 func (s *Drive) ReleaseFile(sha256sum []byte) error {
+	s.waitRefresh(refreshReq{sha256sum: sha256sum})
+	return s.release("ReleaseFile", sha256sum, func(c drive.Client) error {
+		return c.ReleaseFile(sha256sum)
+	})
+}
+
+// release calls fn on each of the clients, and logs the outcome for each.  It
+// continues past failures, and returns an error describing those from
+// persistent clients, or from any client if --requireAllReleases is set.
+// Failures of other clients only leave stale data in a cache, which will be
+// evicted in time.
+func (s *Drive) release(method string, sha256sum []byte, fn func(drive.Client) error) error {
+	var errs []string
 	for _, client := range s.clients {
-		if err := client.ReleaseFile(sha256sum); err != nil {
-			glog.Infof("could not ReleaseFile in %s: %s", client.GetConfig().Provider, err)
+		provider := client.GetConfig().Provider
+		if err := fn(client); err != nil {
+			if client.Persistent() || *requireAllReleases {
+				logging.Warningf("could not %s %x in %s: %s", method, sha256sum, provider, err)
+				errs = append(errs, fmt.Sprintf("%s: %s", provider, err))
+			} else {
+				logging.Infof("could not %s %x in %s: %s", method, sha256sum, provider, err)
+			}
+			continue
 		}
+		logging.V(3).Infof("%s %x in %s succeeded", method, sha256sum, provider)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s %x failed: %s", method, sha256sum, strings.Join(errs, "; "))
 	}
 	return nil
 }
 
 // GetChunk retrieves a chunk with a given SHA-256 sum.  It will be returned
 // from the first client in the slice of structs that returns the chunk.
+//
+// With --cacheVerifyChunks, a chunk of an unencrypted file whose sum does not
+// match is treated as not found in that client, and the next is tried.  The
+// chunks of encrypted files are stored by an encrypted sum, so they are left
+// to be verified by the encrypt client.
 func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
 	// TODO(asjoyner): consider adding the ability to cancel GetChunk, then
 	// paralellize this with a slight delay between launching each request.
+	var corrupt int
+	var quotaErr error
 	for _, client := range s.clients {
 		chunk, err := client.GetChunk(sha256sum, f)
 		if err != nil {
-			glog.V(2).Infof("Chunk %x not found in %q: %s", sha256sum, client.GetConfig().Provider, err)
+			if overQuota(client, err) {
+				quotaErr = err
+				continue
+			}
+			logging.V(2).Infof("Chunk %x not found in %q: %s", sha256sum, client.GetConfig().Provider, err)
 			continue
 		}
-		for _, c := range s.clients {
-			if c.Local() {
-				glog.V(7).Infof("refreshing chunk %x", sha256sum)
-				c.PutChunk(sha256sum, chunk, f)
+		if err := verifyChunk(sha256sum, chunk, f); err != nil {
+			logging.Warningf("Chunk %x from %q is corrupt, trying the next client: %s", sha256sum, client.GetConfig().Provider, err)
+			corrupt++
+			continue
+		}
+		// The child it was read from is refreshed too, which marks the chunk
+		// as recently used in eg. the local client.
+		s.refresh(refreshReq{sha256sum: sha256sum, content: chunk, f: f, chunk: true})
+		return chunk, nil
+	}
+	if quotaErr != nil {
+		return nil, quotaErr
+	}
+	if corrupt > 0 {
+		return nil, fmt.Errorf("chunk not found, corrupt in %d of %d clients", corrupt, len(s.clients))
+	}
+	return nil, errors.New("chunk not found")
+}
+
+// verifyChunk returns an error if chunk, of the unencrypted file f, does not
+// have the sum sha256sum.  It does nothing without --cacheVerifyChunks, or if
+// f is nil or encrypted.
+func verifyChunk(sha256sum, chunk []byte, f *shade.File) error {
+	if !*verifyChunks || f == nil || f.AesKey != nil {
+		return nil
+	}
+	sum, err := f.Sum(chunk)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, sha256sum) {
+		return fmt.Errorf("content has sum %x", sum)
+	}
+	return nil
+}
+
+// GetChunkRange retrieves part of a chunk from the first client which has it.
+// Unlike GetChunk, the Local clients are not refreshed, as they require the
+// whole chunk.
+func (s *Drive) GetChunkRange(sha256sum []byte, f *shade.File, offset, length int64) ([]byte, error) {
+	var quotaErr error
+	for _, client := range s.clients {
+		chunk, err := drive.GetChunkRange(client, sha256sum, f, offset, length)
+		if err != nil {
+			if overQuota(client, err) {
+				quotaErr = err
+				continue
 			}
+			logging.V(2).Infof("Chunk %x not found in %q: %s", sha256sum, client.GetConfig().Provider, err)
+			continue
 		}
 		return chunk, nil
 	}
+	if quotaErr != nil {
+		return nil, quotaErr
+	}
 	return nil, errors.New("chunk not found")
 }
 
+// overQuota returns true if err, returned by client, reports that a quota of
+// its account is exceeded.  That is logged, as the read is retried from the
+// next client, and if none has the object, err is returned rather than a
+// "not found" error, so the user learns to retry later.
+func overQuota(client drive.Client, err error) bool {
+	if !drive.IsQuotaError(err) {
+		return false
+	}
+	logging.Warningf("%q is over quota, trying the next client: %s", client.GetConfig().Provider, err)
+	return true
+}
+
+// Stat returns the description of the object from the first client which has
+// it.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	for _, client := range s.clients {
+		info, err := client.Stat(sha256sum)
+		if err != nil {
+			logging.V(2).Infof("Stat(%x) failed in %q: %s", sha256sum, client.GetConfig().Provider, err)
+			continue
+		}
+		return info, nil
+	}
+	return drive.Info{}, errors.New("chunk not found")
+}
+
 // PutChunk writes a chunk associated with a SHA-256 sum.  It will attempt to write to
 // all shade backends configured to Write.  If any backends are Persistent, it
 // returns an error if all Persistent backends fail to write.
@@ -186,9 +452,9 @@ func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
 	done := make(chan struct{}, len(s.clients))
 	for _, client := range s.clients {
 		go func(client drive.Client) {
-			glog.V(3).Infof("client %s putting chunk %x", client.GetConfig().Provider, sha256sum)
+			logging.V(3).Infof("client %s putting chunk %x", client.GetConfig().Provider, sha256sum)
 			if err := client.PutChunk(sha256sum, chunk, f); err != nil {
-				glog.Warningf("%s.PutChunk(%x) failed: %s", client.GetConfig().Provider, sha256sum, err)
+				logging.Warningf("%s.PutChunk(%x) failed: %s", client.GetConfig().Provider, sha256sum, err)
 				done <- struct{}{}
 				return
 			}
@@ -209,15 +475,110 @@ func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
 	return fmt.Errorf("persistent storage configured, but all writes failed: %x", sha256sum)
 }
 
-// ReleaseChunk calls ReleaseChunk on each of the provided clients in sequence.
-// No errors are returned from child clients.
-func (s *Drive) ReleaseChunk(sha256sum []byte) error {
-	for _, client := range s.clients {
-		if err := client.ReleaseChunk(sha256sum); err != nil {
-			glog.Infof("could not ReleaseChunk in %s: %s", client.GetConfig().Provider, err)
+// startRefreshes starts n goroutines to refresh the Local children in the
+// background.  If n is not positive, refreshes are synchronous.
+func (s *Drive) startRefreshes(n int) {
+	if n <= 0 {
+		return
+	}
+	s.refreshes = make(chan refreshReq, refreshQueue)
+	s.refreshing = make(map[string]bool)
+	s.refreshed = sync.NewCond(&s.refreshMu)
+	s.workers.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer s.workers.Done()
+			for r := range s.refreshes {
+				s.store(r)
+				s.refreshMu.Lock()
+				delete(s.refreshing, r.key())
+				s.refreshed.Broadcast()
+				s.refreshMu.Unlock()
+			}
+		}()
+	}
+}
+
+// refresh copies the file or chunk described by r to the Local children.
+// With --cacheRefreshConcurrency, it is queued for a background goroutine, so
+// the read which found it returns without waiting.  A refresh of a file or
+// chunk which is already queued or running, or which would exceed the queue,
+// is dropped; a later read will refresh it.
+func (s *Drive) refresh(r refreshReq) {
+	if s.refreshes == nil {
+		s.store(r)
+		return
+	}
+	key := r.key()
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	if s.closed || s.refreshing[key] {
+		return
+	}
+	// The caller may modify the content once the read returns.
+	r.content = append([]byte(nil), r.content...)
+	select {
+	case s.refreshes <- r:
+		s.refreshing[key] = true
+	default:
+		logging.V(2).Infof("refresh queue is full, not refreshing %x", r.sha256sum)
+	}
+}
+
+// waitRefreshes returns once no refreshes are queued or running.
+func (s *Drive) waitRefreshes() {
+	if s.refreshes == nil {
+		return
+	}
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	for len(s.refreshing) > 0 {
+		s.refreshed.Wait()
+	}
+}
+
+// waitRefresh returns once no refresh of the file or chunk described by r is
+// queued or running, so that a release which follows is not undone by it.
+func (s *Drive) waitRefresh(r refreshReq) {
+	if s.refreshes == nil {
+		return
+	}
+	key := r.key()
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	for s.refreshing[key] {
+		s.refreshed.Wait()
+	}
+}
+
+// store writes the file or chunk described by r to each Local child, except
+// r.from.  Failures are logged, as the content remains in another child.
+func (s *Drive) store(r refreshReq) {
+	for _, c := range s.clients {
+		if !c.Local() || c == r.from {
+			continue
+		}
+		var err error
+		if r.chunk {
+			logging.V(7).Infof("refreshing chunk %x", r.sha256sum)
+			err = c.PutChunk(r.sha256sum, r.content, r.f)
+		} else {
+			err = c.PutFile(r.sha256sum, r.content)
+		}
+		if err != nil {
+			logging.Warningf("refreshing %x in %q: %s", r.sha256sum, c.GetConfig().Provider, err)
 		}
 	}
-	return nil
+}
+
+// ReleaseChunk calls ReleaseChunk on each of the provided clients in sequence.
+// It first waits for a pending refresh of the chunk, which would restore it.
+// See release for the errors which are returned.
+func (s *Drive) ReleaseChunk(sha256sum []byte) error {
+	s.waitRefresh(refreshReq{sha256sum: sha256sum, chunk: true})
+	return s.release("ReleaseChunk", sha256sum, func(c drive.Client) error {
+		return c.ReleaseChunk(sha256sum)
+	})
 }
 
 // Warm is passed along to each client that is not Local().
@@ -230,6 +591,19 @@ func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
 	return
 }
 
+// Space returns the space of the persistent client with the least free space,
+// as chunks are written to each of them.  Non-persistent clients evict chunks
+// to make room, so they do not limit the space.
+func (s *Drive) Space() (total, free uint64, err error) {
+	var clients []drive.Client
+	for _, c := range s.clients {
+		if c.Persistent() || !s.Persistent() {
+			clients = append(clients, c)
+		}
+	}
+	return drive.MinSpace(clients)
+}
+
 // GetConfig returns the config used to initialize this client.
 func (s *Drive) GetConfig() drive.Config {
 	return s.config
@@ -257,6 +631,63 @@ func (s *Drive) Persistent() bool {
 	return false
 }
 
+// Flush waits for the background refreshes, then flushes each of the child
+// clients, and returns the first error.
+func (s *Drive) Flush() error {
+	s.waitRefreshes()
+	var firstErr error
+	for _, client := range s.clients {
+		if err := drive.Flush(client); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %s", client.GetConfig().Provider, err)
+		}
+	}
+	return firstErr
+}
+
+// Close waits for the background refreshes, then closes each of the child
+// clients, and returns the first error.
+func (s *Drive) Close() error {
+	s.refreshMu.Lock()
+	if s.refreshes != nil && !s.closed {
+		close(s.refreshes)
+	}
+	s.closed = true
+	s.refreshMu.Unlock()
+	s.workers.Wait()
+	var firstErr error
+	for _, client := range s.clients {
+		if err := drive.Close(client); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %s", client.GetConfig().Provider, err)
+		}
+	}
+	return firstErr
+}
+
+// Ping pings all of the child clients concurrently.  It returns an error
+// describing each child which failed, if any did.
+func (s *Drive) Ping(ctx context.Context) error {
+	errs := make(chan error, len(s.clients))
+	for _, client := range s.clients {
+		go func(client drive.Client) {
+			if err := client.Ping(ctx); err != nil {
+				errs <- fmt.Errorf("%s: %s", client.GetConfig().Provider, err)
+				return
+			}
+			errs <- nil
+		}(client)
+	}
+	var failed []string
+	for range s.clients {
+		if err := <-errs; err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d clients failed ping: %s", len(failed), len(s.clients), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
 // NewChunkLister returns an iterator which will return all of the chunks known
 // to all child clients.
 func (s *Drive) NewChunkLister() drive.ChunkLister {
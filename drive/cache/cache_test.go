@@ -1,12 +1,19 @@
 package cache
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
 
 	_ "github.com/asjoyner/shade/drive/fail"
 	"github.com/asjoyner/shade/drive/memory"
+	_ "github.com/asjoyner/shade/drive/win"
 )
 
 // Test a single pass through to the memory client.
@@ -71,6 +78,8 @@ func TestMemoryAndFailClients(t *testing.T) {
 
 	drive.TestFileRoundTrip(t, cc, 100)
 	drive.TestChunkRoundTrip(t, cc, 100)
+	drive.TestChunkRange(t, cc)
+	drive.TestStat(t, cc)
 }
 
 func TestOnlyPersistentSatisfies(t *testing.T) {
@@ -109,3 +118,406 @@ func TestRelease(t *testing.T) {
 	}
 	drive.TestRelease(t, cc, true)
 }
+
+// TestReleaseErrors ensures release failures are returned from persistent
+// children, and from other children only with --requireAllReleases.
+func TestReleaseErrors(t *testing.T) {
+	persistent, err := NewClient(drive.Config{
+		Children: []drive.Config{
+			{Provider: "memory", Write: true},
+			{
+				Provider: "fail",
+				OAuth:    drive.OAuthConfig{ClientID: "persistent"},
+				Write:    true,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	if err := persistent.ReleaseFile([]byte("b13s")); err == nil {
+		t.Error("failed ReleaseFile in a persistent child was not returned")
+	}
+	if err := persistent.ReleaseChunk([]byte("b13s")); err == nil {
+		t.Error("failed ReleaseChunk in a persistent child was not returned")
+	}
+
+	local, err := NewClient(drive.Config{
+		Children: []drive.Config{
+			{Provider: "memory", Write: true},
+			{Provider: "fail", Write: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	if err := local.ReleaseChunk([]byte("b13s")); err != nil {
+		t.Errorf("failed ReleaseChunk in a non-persistent child was returned: %s", err)
+	}
+	defer func(r bool) { *requireAllReleases = r }(*requireAllReleases)
+	*requireAllReleases = true
+	if err := local.ReleaseChunk([]byte("b13s")); err == nil {
+		t.Error("failed ReleaseChunk was not returned with --requireAllReleases")
+	}
+}
+
+// Test that Ping succeeds only if all the child clients succeed.
+func TestPing(t *testing.T) {
+	cc, err := NewClient(drive.Config{
+		Children: []drive.Config{
+			{Provider: "memory", Write: true},
+			{Provider: "win", Write: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	if err := cc.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() of memory and win clients failed: %s", err)
+	}
+
+	cc, err = NewClient(drive.Config{
+		Children: []drive.Config{
+			{Provider: "memory", Write: true},
+			{Provider: "fail", Write: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	if err := cc.Ping(context.Background()); err == nil {
+		t.Errorf("Ping() of memory and fail clients succeeded")
+	}
+}
+
+// Test that the files of the children which succeed are returned, and that an
+// error is returned only if all of the children fail.
+func TestListFilesErrors(t *testing.T) {
+	cc, err := NewClient(drive.Config{
+		Children: []drive.Config{
+			{Provider: "memory", Write: true},
+			{Provider: "fail", Write: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	files := drive.RandChunks(10)
+	for sum, data := range files {
+		if err := cc.PutFile([]byte(sum), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := cc.ListFiles()
+	if err != nil {
+		t.Fatalf("ListFiles() with one successful child failed: %s", err)
+	}
+	if len(resp) != len(files) {
+		t.Errorf("ListFiles() returned wrong number of files, want: %d, got: %d", len(files), len(resp))
+	}
+
+	cc, err = NewClient(drive.Config{
+		Children: []drive.Config{
+			{Provider: "fail", Write: true},
+			{Provider: "fail", Write: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	if _, err := cc.ListFiles(); err == nil {
+		t.Errorf("ListFiles() with all children failing succeeded")
+	}
+}
+
+func TestListFilesCancelled(t *testing.T) {
+	cc, err := NewClient(drive.Config{
+		Children: []drive.Config{
+			{Provider: "memory", Write: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cc.(*Drive).ListFilesContext(ctx); err != context.Canceled {
+		t.Errorf("ListFilesContext() with a cancelled context, want: %s, got: %v", context.Canceled, err)
+	}
+}
+
+func TestGetFiles(t *testing.T) {
+	cc, err := NewClient(drive.Config{
+		Children: []drive.Config{
+			drive.Config{Provider: "memory", Write: true},
+			drive.Config{Provider: "memory", Write: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	clients := cc.(*Drive).clients
+
+	// a is only in the first child, b only in the second, and c in neither
+	a, b, c := []byte("file a"), []byte("file b"), []byte("file c")
+	if err := clients[0].PutFile(shade.Sum(a), a); err != nil {
+		t.Fatal(err)
+	}
+	if err := clients[1].PutFile(shade.Sum(b), b); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string][]byte)
+	var missing [][]byte
+	sums := [][]byte{shade.Sum(a), shade.Sum(b), shade.Sum(c)}
+	err = drive.GetFiles(context.Background(), cc, sums, 1, func(sum, file []byte, err error) {
+		if err != nil {
+			missing = append(missing, sum)
+			return
+		}
+		got[string(sum)] = file
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range [][]byte{a, b} {
+		if !bytes.Equal(got[string(shade.Sum(f))], f) {
+			t.Errorf("GetFiles(%x): got %q, want %q", shade.Sum(f), got[string(shade.Sum(f))], f)
+		}
+	}
+	if len(missing) != 1 || !bytes.Equal(missing[0], shade.Sum(c)) {
+		t.Errorf("want only %x missing, got: %x", shade.Sum(c), missing)
+	}
+	// Wait for the background refresh.
+	if err := cc.(*Drive).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clients[0].GetFile(shade.Sum(b)); err != nil {
+		t.Errorf("file from the second child was not copied to the first: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cc.(*Drive).GetFiles(ctx, sums, func([]byte, []byte, error) {}); err != context.Canceled {
+		t.Errorf("GetFiles() with a cancelled context, want: %s, got: %v", context.Canceled, err)
+	}
+}
+
+// Test that a chunk whose sum does not match is read from the next child, and
+// that an error is returned if every child's copy is corrupt.
+func TestGetChunkCorrupt(t *testing.T) {
+	cc, err := NewClient(drive.Config{
+		Children: []drive.Config{
+			{Provider: "memory", Write: true},
+			{Provider: "memory", Write: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	clients := cc.(*Drive).clients
+	f := &shade.File{}
+	good := []byte("the chunk as it was stored")
+	sum := shade.Sum(good)
+	if err := clients[0].PutChunk(sum, []byte("bitrot"), f); err != nil {
+		t.Fatal(err)
+	}
+	if err := clients[1].PutChunk(sum, good, f); err != nil {
+		t.Fatal(err)
+	}
+
+	chunk, err := cc.GetChunk(sum, f)
+	if err != nil {
+		t.Fatalf("GetChunk() with a corrupt first child failed: %s", err)
+	}
+	if !bytes.Equal(chunk, good) {
+		t.Errorf("GetChunk() with a corrupt first child, want: %q, got: %q", good, chunk)
+	}
+	// Wait for the background refresh.
+	if err := cc.(*Drive).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if chunk, _ := clients[0].GetChunk(sum, f); !bytes.Equal(chunk, good) {
+		t.Errorf("the corrupt chunk in the first child was not refreshed, got: %q", chunk)
+	}
+
+	for _, c := range clients {
+		if err := c.PutChunk(sum, []byte("bitrot"), f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if chunk, err := cc.GetChunk(sum, f); err == nil {
+		t.Errorf("GetChunk() with only corrupt children succeeded, got: %q", chunk)
+	}
+}
+
+// overQuotaClient is a client whose reads fail with a drive.QuotaError.
+type overQuotaClient struct {
+	drive.Client
+}
+
+func (c *overQuotaClient) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	return nil, drive.NewQuotaError("remote", errors.New("downloadQuotaExceeded"))
+}
+
+func TestGetChunkOverQuota(t *testing.T) {
+	cc, err := NewClient(drive.Config{
+		Children: []drive.Config{
+			{Provider: "memory", Write: true},
+			{Provider: "memory", Write: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	clients := cc.(*Drive).clients
+	clients[0] = &overQuotaClient{clients[0]}
+	f := &shade.File{}
+	chunk := []byte("a chunk")
+	sum := shade.Sum(chunk)
+
+	// The chunk is read from the next child.
+	if err := clients[1].PutChunk(sum, chunk, f); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cc.GetChunk(sum, f); err != nil || !bytes.Equal(got, chunk) {
+		t.Errorf("GetChunk() with the first child over quota = %q, %v", got, err)
+	}
+
+	// Without another copy, the QuotaError is returned.
+	if err := clients[1].ReleaseChunk(sum); err != nil {
+		t.Fatal(err)
+	}
+	_, err = cc.GetChunk(sum, f)
+	var qe *drive.QuotaError
+	if !errors.As(err, &qe) || qe.Provider != "remote" {
+		t.Errorf("GetChunk() from only a child over quota, want a QuotaError, got: %v", err)
+	}
+}
+
+// remoteClient is a memory client which is not Local, so it is not refreshed.
+type remoteClient struct {
+	drive.Client
+}
+
+func (c *remoteClient) Local() bool { return false }
+
+// slowClient is a Local memory client whose PutChunk blocks until release is
+// closed.
+type slowClient struct {
+	drive.Client
+	release chan struct{}
+
+	mu   sync.Mutex
+	puts int
+}
+
+func (c *slowClient) PutChunk(sha256sum, chunk []byte, f *shade.File) error {
+	c.mu.Lock()
+	c.puts++
+	c.mu.Unlock()
+	<-c.release
+	return c.Client.PutChunk(sha256sum, chunk, f)
+}
+
+func TestRefreshInBackground(t *testing.T) {
+	newMemory := func() drive.Client {
+		mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mc
+	}
+	local := &slowClient{Client: newMemory(), release: make(chan struct{})}
+	remote := &remoteClient{newMemory()}
+	d := &Drive{clients: []drive.Client{local, remote}}
+	d.startRefreshes(2)
+	defer d.Close()
+
+	chunk := []byte("a chunk which is only in the remote child")
+	sum := shade.Sum(chunk)
+	if err := remote.PutChunk(sum, chunk, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent reads return without waiting for the local write, and
+	// refresh the chunk only once.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := d.GetChunk(sum, nil)
+			if err != nil || !bytes.Equal(got, chunk) {
+				t.Errorf("GetChunk() want: %q, got: %q (%v)", chunk, got, err)
+			}
+		}()
+	}
+	returned := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(10 * time.Second):
+		t.Fatal("GetChunk() waited for the slow local child")
+	}
+
+	close(local.release)
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := local.GetChunk(sum, nil); err != nil || !bytes.Equal(got, chunk) {
+		t.Errorf("the local child was not refreshed, got: %q (%v)", got, err)
+	}
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	if local.puts != 1 {
+		t.Errorf("want the chunk refreshed once, got: %d", local.puts)
+	}
+}
+
+// TestReleaseWaitsForRefresh ensures that a chunk released while its refresh
+// is pending is not restored to the local child by the refresh.
+func TestReleaseWaitsForRefresh(t *testing.T) {
+	newMemory := func() drive.Client {
+		mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mc
+	}
+	local := &slowClient{Client: newMemory(), release: make(chan struct{})}
+	remote := &remoteClient{newMemory()}
+	d := &Drive{clients: []drive.Client{local, remote}}
+	d.startRefreshes(2)
+	defer d.Close()
+
+	chunk := []byte("a chunk which is released while it is refreshed")
+	sum := shade.Sum(chunk)
+	if err := remote.PutChunk(sum, chunk, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetChunk(sum, nil); err != nil {
+		t.Fatal(err)
+	}
+	released := make(chan error)
+	go func() { released <- d.ReleaseChunk(sum) }()
+	select {
+	case err := <-released:
+		close(local.release)
+		t.Fatalf("ReleaseChunk() returned before the pending refresh: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(local.release)
+	if err := <-released; err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := local.GetChunk(sum, nil); err == nil {
+		t.Error("the released chunk was restored to the local child by its refresh")
+	}
+}
@@ -1,6 +1,13 @@
 package compare
 
-import "github.com/asjoyner/shade/drive"
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+)
 
 // Delta describes the extra file and chunk sums known to one client, which are
 // not known to the other.
@@ -36,73 +43,131 @@ func Equal(a, b drive.Client) (bool, error) {
 //
 // Nb: This is intended only for use on relatively small Shade repositorites,
 // primarily for testing.  Depending on the client, it may consume a lot of ram
-// and take a very long time to run.
+// and take a very long time to run.  StreamFiles and StreamChunks compare
+// larger repositories in bounded memory.
 //
 // Nb: it does not validate the clients contain the same actual bytes, it
-// trusts the sums reported by ListFiles and the ChunkLister interface.
+// trusts the sums reported by ListFiles and the ChunkLister interface.  See
+// GetDeltaVerified.
 func GetDelta(a, b drive.Client) (Delta, Delta, error) {
-	var aDelta, bDelta Delta
-	af, err := a.ListFiles()
+	aDelta, bDelta, _, err := getDelta(a, b)
+	return aDelta, bDelta, err
+}
+
+// GetDeltaVerified is GetDelta, but for the sums known to both clients it
+// also fetches the file or chunk from each, and compares the bytes.  The
+// third return value contains the sums whose bytes differ.
+//
+// sample is the fraction, between 0 and 1, of the common sums to fetch and
+// compare.  A sample of 1 compares every file and chunk, which transfers the
+// whole repository from both clients.  Sums which either client lists, but
+// then fails to return, are reported as an error.
+func GetDeltaVerified(a, b drive.Client, sample float64) (Delta, Delta, Delta, error) {
+	aDelta, bDelta, both, err := getDelta(a, b)
 	if err != nil {
-		return Delta{}, Delta{}, err
+		return Delta{}, Delta{}, Delta{}, err
 	}
-	aFiles := make(map[string]struct{})
-	for _, sum := range af {
-		aFiles[string(sum)] = struct{}{}
-	}
-	bf, err := b.ListFiles()
-	if err != nil {
-		return Delta{}, Delta{}, err
+	var mismatch Delta
+	for _, sum := range both.Files {
+		if rand.Float64() >= sample {
+			continue
+		}
+		same, err := sameBytes(sum, a.GetFile, b.GetFile)
+		if err != nil {
+			return Delta{}, Delta{}, Delta{}, fmt.Errorf("file %x: %s", sum, err)
+		}
+		if !same {
+			mismatch.Files = append(mismatch.Files, sum)
+		}
 	}
-	bFiles := make(map[string]struct{})
-	for _, sum := range bf {
-		bFiles[string(sum)] = struct{}{}
+	getChunk := func(c drive.Client) func([]byte) ([]byte, error) {
+		return func(sum []byte) ([]byte, error) { return c.GetChunk(sum, nil) }
 	}
-	for f := range aFiles {
-		if _, ok := bFiles[f]; !ok {
-			aDelta.Files = append(aDelta.Files, []byte(f))
+	for _, sum := range both.Chunks {
+		if rand.Float64() >= sample {
+			continue
 		}
-	}
-	for f := range bFiles {
-		if _, ok := aFiles[f]; !ok {
-			bDelta.Files = append(bDelta.Files, []byte(f))
+		same, err := sameBytes(sum, getChunk(a), getChunk(b))
+		if err != nil {
+			return Delta{}, Delta{}, Delta{}, fmt.Errorf("chunk %x: %s", sum, err)
+		}
+		if !same {
+			mismatch.Chunks = append(mismatch.Chunks, sum)
 		}
 	}
-	ac, err := AllChunkSums(a.NewChunkLister())
+	return aDelta, bDelta, mismatch, nil
+}
+
+// sameBytes fetches sum with each of the get functions, and reports whether
+// they returned the same bytes.
+func sameBytes(sum []byte, aGet, bGet func([]byte) ([]byte, error)) (bool, error) {
+	aBytes, err := aGet(sum)
 	if err != nil {
-		return Delta{}, Delta{}, err
+		return false, err
 	}
-	aChunks := make(map[string]struct{})
-	for _, sum := range ac {
-		aChunks[string(sum)] = struct{}{}
+	bBytes, err := bGet(sum)
+	if err != nil {
+		return false, err
 	}
+	return bytes.Equal(aBytes, bBytes), nil
+}
 
-	bc, err := AllChunkSums(b.NewChunkLister())
+// getDelta returns the file and chunk sums known only to a, those known only
+// to b, and those known to both.
+func getDelta(a, b drive.Client) (aDelta, bDelta, both Delta, err error) {
+	af, err := a.ListFiles()
 	if err != nil {
-		return Delta{}, Delta{}, err
+		return Delta{}, Delta{}, Delta{}, err
 	}
-	bChunks := make(map[string]struct{})
-	for _, sum := range bc {
-		bChunks[string(sum)] = struct{}{}
+	bf, err := b.ListFiles()
+	if err != nil {
+		return Delta{}, Delta{}, Delta{}, err
 	}
-	for f := range aChunks {
-		if _, ok := bChunks[f]; !ok {
-			aDelta.Chunks = append(aDelta.Chunks, []byte(f))
+	aDelta.Files, bDelta.Files, both.Files = diffSums(af, bf)
+
+	ac, err := AllChunkSums(a.NewChunkLister())
+	if err != nil {
+		return Delta{}, Delta{}, Delta{}, err
+	}
+	bc, err := AllChunkSums(b.NewChunkLister())
+	if err != nil {
+		return Delta{}, Delta{}, Delta{}, err
+	}
+	aDelta.Chunks, bDelta.Chunks, both.Chunks = diffSums(ac, bc)
+	return aDelta, bDelta, both, nil
+}
+
+// diffSums returns the unique sums which are only in a, only in b, and in
+// both.
+func diffSums(a, b [][]byte) (aOnly, bOnly, both [][]byte) {
+	aSums := make(map[string]struct{})
+	for _, sum := range a {
+		aSums[string(sum)] = struct{}{}
+	}
+	bSums := make(map[string]struct{})
+	for _, sum := range b {
+		bSums[string(sum)] = struct{}{}
+	}
+	for s := range aSums {
+		if _, ok := bSums[s]; ok {
+			both = append(both, []byte(s))
+		} else {
+			aOnly = append(aOnly, []byte(s))
 		}
 	}
-	for f := range bChunks {
-		if _, ok := aChunks[f]; !ok {
-			bDelta.Chunks = append(bDelta.Chunks, []byte(f))
+	for s := range bSums {
+		if _, ok := aSums[s]; !ok {
+			bOnly = append(bOnly, []byte(s))
 		}
 	}
-	return aDelta, bDelta, nil
+	return aOnly, bOnly, both
 }
 
 // AllChunkSums iterates lister.  It gathers and returns all of the sums.
 //
 // Nb: It is intended only for use on relatively small Shade repositorites.
 // Depending on the client, it may consume a lot of ram and take a very
-// long time to run.
+// long time to run.  SortSums iterates the sums in bounded memory.
 func AllChunkSums(lister drive.ChunkLister) ([][]byte, error) {
 	var chunkSums [][]byte
 	for lister.Next() {
@@ -113,3 +178,10 @@ func AllChunkSums(lister drive.ChunkLister) ([][]byte, error) {
 	}
 	return chunkSums, nil
 }
+
+// SameContent returns true if the files a and b have identical content, as
+// determined by their ContentDigest.  Metadata such as the Filename and
+// ModifiedTime is not considered, and no chunks are fetched.
+func SameContent(a, b *shade.File) bool {
+	return bytes.Equal(a.ContentDigest(), b.ContentDigest())
+}
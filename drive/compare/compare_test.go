@@ -1,8 +1,11 @@
 package compare
 
 import (
+	"bytes"
 	"testing"
+	"time"
 
+	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
 	_ "github.com/asjoyner/shade/drive/memory"
 )
@@ -89,6 +92,77 @@ func TestEqualAndGetDeltaFindDifferences(t *testing.T) {
 
 // put is a test helper function which populates data into the provided client.
 // If it encounters errors, it calls t.Fatalf()
+func TestSameContent(t *testing.T) {
+	a := shade.NewFile("a")
+	a.Chunks = []shade.Chunk{{Index: 0, Sha256: shade.Sum([]byte("0"))}, {Index: 1, Sha256: shade.Sum([]byte("1"))}}
+	a.LastChunksize = 1
+	b := shade.NewFile("b")
+	b.ModifiedTime = a.ModifiedTime.Add(time.Hour)
+	b.Chunks = []shade.Chunk{a.Chunks[1], a.Chunks[0]}
+	b.LastChunksize = 1
+	if !SameContent(a, b) {
+		t.Error("files with the same chunks do not have the SameContent")
+	}
+	b.Chunks[0].Index, b.Chunks[1].Index = 0, 1
+	if SameContent(a, b) {
+		t.Error("files with reordered chunks have the SameContent")
+	}
+}
+
+// corruptingClient returns a modified copy of one chunk from GetChunk, while
+// still listing it under its original sum.
+type corruptingClient struct {
+	drive.Client
+	corrupt []byte
+}
+
+func (c *corruptingClient) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	chunk, err := c.Client.GetChunk(sha256sum, f)
+	if err != nil || !bytes.Equal(sha256sum, c.corrupt) {
+		return chunk, err
+	}
+	corrupted := append([]byte{}, chunk...)
+	corrupted[0] ^= 0xff
+	return corrupted, nil
+}
+
+func TestGetDeltaVerifiedFindsMismatch(t *testing.T) {
+	testFiles := drive.RandChunks(3)
+	testChunks := drive.RandChunks(5)
+	a := newMemClient(t)
+	put(t, a, testFiles, testChunks)
+	mc := newMemClient(t)
+	put(t, mc, testFiles, testChunks)
+	var corrupt []byte
+	for s := range testChunks {
+		corrupt = []byte(s)
+		break
+	}
+	b := &corruptingClient{Client: mc, corrupt: corrupt}
+
+	if eq, err := Equal(a, b); err != nil || !eq {
+		t.Fatalf("comparing sums: want Equal, got: %v (%v)", eq, err)
+	}
+	aDelta, bDelta, mismatch, err := GetDeltaVerified(a, b, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aDelta.Files != nil || aDelta.Chunks != nil || bDelta.Files != nil || bDelta.Chunks != nil {
+		t.Errorf("unexpected deltas: %+v, %+v", aDelta, bDelta)
+	}
+	if mismatch.Files != nil {
+		t.Errorf("unexpected mismatched files: %x", mismatch.Files)
+	}
+	if len(mismatch.Chunks) != 1 || !bytes.Equal(mismatch.Chunks[0], corrupt) {
+		t.Errorf("want mismatched chunk %x, got: %x", corrupt, mismatch.Chunks)
+	}
+
+	// A sample of 0 fetches nothing, like GetDelta.
+	if _, _, mismatch, err := GetDeltaVerified(a, b, 0); err != nil || mismatch.Chunks != nil {
+		t.Errorf("sample of 0: want no mismatches, got: %x (%v)", mismatch.Chunks, err)
+	}
+}
+
 func put(t *testing.T, c drive.Client, files, chunks map[string][]byte) {
 	// Populate some files into the client
 	for stringSum, file := range files {
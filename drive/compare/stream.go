@@ -0,0 +1,338 @@
+package compare
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/asjoyner/shade/drive"
+)
+
+// DefaultRunSize is the number of sums SortSums holds in memory, unless
+// SortOptions sets RunSize.  A 32 byte sum takes about 60 bytes, so that is
+// about 64MB.
+const DefaultRunSize = 1 << 20
+
+// SortOptions bound the memory used by SortSums and StreamChunks.
+type SortOptions struct {
+	// RunSize is the number of sums to hold in memory.  More sums are sorted
+	// in runs of RunSize, which are written to temporary files and merged.
+	RunSize int
+	// Dir is the directory for the temporary files.  If it is empty, the
+	// default directory for temporary files is used.
+	Dir string
+}
+
+// Handler receives the sums found by StreamFiles and StreamChunks.  Each
+// function may be nil, to ignore those sums.  If a function returns an
+// error, the comparison stops and returns it.
+type Handler struct {
+	OnlyA func(sum []byte) error // sums known only to a
+	OnlyB func(sum []byte) error // sums known only to b
+	Both  func(sum []byte) error // sums known to both
+}
+
+// StreamFiles compares the sums returned by ListFiles of clients a and b,
+// and passes each sum to h, in increasing order.  Unlike GetDelta, it does
+// not build a set of the sums, but the listings are still held in memory.
+func StreamFiles(a, b drive.Client, h Handler) error {
+	af, err := a.ListFiles()
+	if err != nil {
+		return err
+	}
+	bf, err := b.ListFiles()
+	if err != nil {
+		return err
+	}
+	return mergeSums(newSliceLister(af), newSliceLister(bf), h)
+}
+
+// StreamChunks compares the sums returned by the ChunkListers of clients a
+// and b, and passes each sum to h, in increasing order.  The sums of each
+// client are sorted with SortSums, so at most opts.RunSize sums of each are
+// held in memory.
+//
+// This is the variant of GetDelta for repositories with too many chunks to
+// hold in memory.
+func StreamChunks(a, b drive.Client, opts SortOptions, h Handler) error {
+	as, err := SortSums(a.NewChunkLister(), opts)
+	if err != nil {
+		return err
+	}
+	defer as.Close()
+	bs, err := SortSums(b.NewChunkLister(), opts)
+	if err != nil {
+		return err
+	}
+	defer bs.Close()
+	return mergeSums(as, bs, h)
+}
+
+// mergeSums calls h for each sum returned by a or b, which must each return
+// distinct sums in increasing order.
+func mergeSums(a, b drive.ChunkLister, h Handler) error {
+	call := func(f func([]byte) error, sum []byte) error {
+		if f == nil {
+			return nil
+		}
+		return f(sum)
+	}
+	aOK, bOK := a.Next(), b.Next()
+	for aOK || bOK {
+		var c int
+		switch {
+		case !bOK:
+			c = -1
+		case !aOK:
+			c = 1
+		default:
+			c = bytes.Compare(a.Sha256(), b.Sha256())
+		}
+		var err error
+		switch {
+		case c < 0:
+			err = call(h.OnlyA, a.Sha256())
+			aOK = a.Next()
+		case c > 0:
+			err = call(h.OnlyB, b.Sha256())
+			bOK = b.Next()
+		default:
+			err = call(h.Both, a.Sha256())
+			aOK, bOK = a.Next(), b.Next()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := a.Err(); err != nil {
+		return err
+	}
+	return b.Err()
+}
+
+// SortedLister is a drive.ChunkLister which returns each of the sums of
+// another ChunkLister once, in increasing order.  Call Close to remove its
+// temporary files.
+type SortedLister struct {
+	files   []*os.File // the runs spilled to disk
+	runs    runHeap    // the runs with sums remaining
+	sum     []byte
+	started bool
+	err     error
+}
+
+// SortSums reads every sum from lister, and returns a SortedLister of them.
+// Sums are held in memory in runs of opts.RunSize.  Each full run is sorted
+// and written to a temporary file, and the runs are merged as the
+// SortedLister is read.
+func SortSums(lister drive.ChunkLister, opts SortOptions) (*SortedLister, error) {
+	size := opts.RunSize
+	if size <= 0 {
+		size = DefaultRunSize
+	}
+	s := &SortedLister{}
+	var buf [][]byte
+	for lister.Next() {
+		buf = append(buf, lister.Sha256())
+		if len(buf) < size {
+			continue
+		}
+		if err := s.spill(buf, opts.Dir); err != nil {
+			s.Close()
+			return nil, err
+		}
+		buf = buf[:0]
+	}
+	if err := lister.Err(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	sortSums(buf)
+	runs := []*run{{mem: buf}}
+	for _, f := range s.files {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			s.Close()
+			return nil, err
+		}
+		runs = append(runs, &run{r: bufio.NewReader(f)})
+	}
+	for _, r := range runs {
+		ok, err := r.advance()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if ok {
+			heap.Push(&s.runs, r)
+		}
+	}
+	return s, nil
+}
+
+// spill sorts sums, and writes them to a new temporary file in dir.
+func (s *SortedLister) spill(sums [][]byte, dir string) error {
+	sortSums(sums)
+	f, err := ioutil.TempFile(dir, "shade-sums-")
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, f)
+	w := bufio.NewWriter(f)
+	var n [binary.MaxVarintLen64]byte
+	for i, sum := range sums {
+		if i > 0 && bytes.Equal(sum, sums[i-1]) {
+			continue
+		}
+		if _, err := w.Write(n[:binary.PutUvarint(n[:], uint64(len(sum)))]); err != nil {
+			return err
+		}
+		if _, err := w.Write(sum); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// Next advances to the next distinct sum.  It returns false when the sums
+// are exhausted, or an error is encountered.
+func (s *SortedLister) Next() bool {
+	for s.err == nil && len(s.runs) > 0 {
+		r := s.runs[0]
+		sum := r.cur
+		ok, err := r.advance()
+		if err != nil {
+			s.err = err
+			return false
+		}
+		if ok {
+			heap.Fix(&s.runs, 0)
+		} else {
+			heap.Pop(&s.runs)
+		}
+		if s.started && bytes.Equal(sum, s.sum) {
+			continue
+		}
+		s.sum = sum
+		s.started = true
+		return true
+	}
+	return false
+}
+
+// Sha256 returns the current sum.
+func (s *SortedLister) Sha256() []byte {
+	return s.sum
+}
+
+// Err returns the error encountered reading the temporary files, if any.
+func (s *SortedLister) Err() error {
+	return s.err
+}
+
+// Close removes the temporary files.  It returns the first error
+// encountered.
+func (s *SortedLister) Close() error {
+	var firstErr error
+	for _, f := range s.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := os.Remove(f.Name()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.files = nil
+	s.runs = nil
+	return firstErr
+}
+
+// run is a sorted run of sums, either held in memory or read from a
+// temporary file.  cur is the next sum it will return.
+type run struct {
+	r   *bufio.Reader // nil for the run held in memory
+	mem [][]byte
+	cur []byte
+}
+
+// advance reads the next sum of the run into cur.  It returns false at the
+// end of the run.
+func (r *run) advance() (bool, error) {
+	if r.r == nil {
+		if len(r.mem) == 0 {
+			return false, nil
+		}
+		r.cur, r.mem = r.mem[0], r.mem[1:]
+		return true, nil
+	}
+	n, err := binary.ReadUvarint(r.r)
+	if err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	r.cur = make([]byte, n)
+	if _, err := io.ReadFull(r.r, r.cur); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// runHeap is a container/heap of runs, ordered by their current sum.
+type runHeap []*run
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return bytes.Compare(h[i].cur, h[j].cur) < 0 }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*run)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// sortSums sorts sums in place.
+func sortSums(sums [][]byte) {
+	sort.Slice(sums, func(i, j int) bool { return bytes.Compare(sums[i], sums[j]) < 0 })
+}
+
+// sliceLister is a drive.ChunkLister of the distinct sums of a slice, in
+// increasing order.
+type sliceLister struct {
+	sums [][]byte
+	ptr  int
+}
+
+// newSliceLister sorts sums in place, and returns a sliceLister of them.
+func newSliceLister(sums [][]byte) *sliceLister {
+	sortSums(sums)
+	return &sliceLister{sums: sums}
+}
+
+// Next advances to the next distinct sum.
+func (l *sliceLister) Next() bool {
+	for l.ptr++; l.ptr <= len(l.sums); l.ptr++ {
+		if l.ptr == 1 || !bytes.Equal(l.sums[l.ptr-1], l.sums[l.ptr-2]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sha256 returns the current sum.
+func (l *sliceLister) Sha256() []byte {
+	if l.ptr > len(l.sums) {
+		return nil
+	}
+	return l.sums[l.ptr-1]
+}
+
+// Err returns precisely no errors.
+func (l *sliceLister) Err() error {
+	return nil
+}
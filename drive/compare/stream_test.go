@@ -0,0 +1,151 @@
+package compare
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+)
+
+// sumLister is a drive.ChunkLister of a slice of sums, in the given order.
+type sumLister struct {
+	sums [][]byte
+	ptr  int
+}
+
+func (l *sumLister) Next() bool     { l.ptr++; return l.ptr <= len(l.sums) }
+func (l *sumLister) Sha256() []byte { return l.sums[l.ptr-1] }
+func (l *sumLister) Err() error     { return nil }
+
+func TestSortSums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compareTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 5000 sums, listed in no particular order, each of the 2500 distinct
+	// sums twice.
+	var sums [][]byte
+	want := make(map[string]bool)
+	for i := 0; i < 5000; i++ {
+		sum := shade.Sum([]byte(fmt.Sprint(i % 2500)))
+		sums = append(sums, sum)
+		want[string(sum)] = true
+	}
+	s, err := SortSums(&sumLister{sums: sums}, SortOptions{RunSize: 100, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the last, partial, run of sums is held in memory.
+	if len(s.files) != 50 {
+		t.Errorf("want 50 runs spilled to disk, got: %d", len(s.files))
+	}
+	for _, r := range s.runs {
+		if r.r == nil && len(r.mem) >= 100 {
+			t.Errorf("%d sums held in memory, want fewer than 100", len(r.mem))
+		}
+	}
+	var prev []byte
+	var n int
+	for s.Next() {
+		sum := s.Sha256()
+		if prev != nil && bytes.Compare(prev, sum) >= 0 {
+			t.Fatalf("sum %x follows %x", sum, prev)
+		}
+		if !want[string(sum)] {
+			t.Errorf("unexpected sum: %x", sum)
+		}
+		prev = sum
+		n++
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(want) {
+		t.Errorf("want %d sums, got: %d", len(want), n)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if left, err := ioutil.ReadDir(dir); err != nil || len(left) != 0 {
+		t.Errorf("Close left %d temporary files (%v)", len(left), err)
+	}
+}
+
+func TestStreamDelta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compareTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newMemClient(t)
+	b := newMemClient(t)
+	bothChunks := drive.RandChunks(1000)
+	bothFiles := drive.RandChunks(20)
+	put(t, a, bothFiles, bothChunks)
+	put(t, b, bothFiles, bothChunks)
+	aFiles, aChunks := drive.RandChunks(5), drive.RandChunks(300)
+	put(t, a, aFiles, aChunks)
+	bFiles, bChunks := drive.RandChunks(7), drive.RandChunks(200)
+	put(t, b, bFiles, bChunks)
+
+	got := map[string]map[string]bool{}
+	record := func(name string) func([]byte) error {
+		got[name] = map[string]bool{}
+		return func(sum []byte) error {
+			if got[name][string(sum)] {
+				t.Errorf("%s: sum %x reported twice", name, sum)
+			}
+			got[name][string(sum)] = true
+			return nil
+		}
+	}
+	if err := StreamFiles(a, b, Handler{OnlyA: record("aFiles"), OnlyB: record("bFiles"), Both: record("bothFiles")}); err != nil {
+		t.Fatal(err)
+	}
+	opts := SortOptions{RunSize: 64, Dir: dir}
+	if err := StreamChunks(a, b, opts, Handler{OnlyA: record("aChunks"), OnlyB: record("bChunks"), Both: record("bothChunks")}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]map[string][]byte{
+		"aFiles":     aFiles,
+		"bFiles":     bFiles,
+		"bothFiles":  bothFiles,
+		"aChunks":    aChunks,
+		"bChunks":    bChunks,
+		"bothChunks": bothChunks,
+	} {
+		if len(got[name]) != len(want) {
+			t.Errorf("%s: want %d sums, got: %d", name, len(want), len(got[name]))
+		}
+		for sum := range want {
+			if !got[name][sum] {
+				t.Errorf("%s: missing %x", name, sum)
+			}
+		}
+	}
+	if left, err := ioutil.ReadDir(dir); err != nil || len(left) != 0 {
+		t.Errorf("StreamChunks left %d temporary files (%v)", len(left), err)
+	}
+}
+
+func TestStreamChunksStops(t *testing.T) {
+	a := newMemClient(t)
+	b := newMemClient(t)
+	put(t, a, nil, drive.RandChunks(10))
+	stop := fmt.Errorf("stop")
+	var n int
+	err := StreamChunks(a, b, SortOptions{RunSize: 3}, Handler{OnlyA: func([]byte) error {
+		n++
+		return stop
+	}})
+	if err != stop || n != 1 {
+		t.Errorf("want the handler's error after 1 sum, got: %v after %d", err, n)
+	}
+}
@@ -0,0 +1,193 @@
+// Package compress is a storage backend for Shade which gzips the chunks
+// stored in its child client.
+//
+// It wraps a single child client.  PutChunk compresses each chunk before
+// storing it, and GetChunk decompresses each chunk which begins with the gzip
+// magic number, and returns any other chunk as it is stored.  So a repository
+// may mix chunks stored by this client, chunks compressed by an external
+// tool, and chunks stored uncompressed, eg. before this client was
+// configured.  An uncompressed chunk which happens to begin with the gzip
+// magic number would be misread, so only configure this client over chunks
+// written by shade tools or by gzip.  Files are passed to the child as they
+// are.
+//
+// Compression hides the offset of each byte of the plaintext within the
+// stored chunk, so this client does not implement drive.RangeGetter.  A
+// ranged read, such as a read by the fuse filesystem, fetches and
+// decompresses the whole chunk, before slicing the requested bytes from it;
+// see drive.GetChunkRange.  Stat reports the stored, compressed, size.
+//
+// Encrypted content does not compress, so this client must be configured
+// below any "encrypt" client.
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+)
+
+func init() {
+	drive.RegisterProvider("compress", NewClient)
+}
+
+// gzipMagic begins every gzip stream; see RFC 1952.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// NewClient returns a Drive client which compresses the chunks of its only
+// child.
+func NewClient(c drive.Config) (drive.Client, error) {
+	if len(c.Children) != 1 {
+		return nil, errors.New("compress requires exactly one child")
+	}
+	child, err := drive.NewClient(c.Children[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", c.Children[0].Provider, err)
+	}
+	c.Write = child.GetConfig().Write
+	return &Drive{config: c, child: child}, nil
+}
+
+// Drive implements the drive.Client interface by passing each request to its
+// child client, compressing chunks as they are stored and decompressing them
+// as they are retrieved.
+type Drive struct {
+	config drive.Config
+	child  drive.Client
+}
+
+// ListFiles is passed to the child client.
+func (s *Drive) ListFiles() ([][]byte, error) {
+	return s.child.ListFiles()
+}
+
+// ListFilesSince is passed to the child client.
+func (s *Drive) ListFilesSince(token string) ([][]byte, string, error) {
+	return drive.ListFilesSince(s.child, token)
+}
+
+// GetFile is passed to the child client.
+func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	return s.child.GetFile(sha256sum)
+}
+
+// PutFile is passed to the child client.
+func (s *Drive) PutFile(sha256sum, f []byte) error {
+	return s.child.PutFile(sha256sum, f)
+}
+
+// ReleaseFile is passed to the child client.
+func (s *Drive) ReleaseFile(sha256sum []byte) error {
+	return s.child.ReleaseFile(sha256sum)
+}
+
+// GetChunk retrieves the chunk from the child client, and decompresses it if
+// it was stored compressed.
+func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	stored, err := s.child.GetChunk(sha256sum, f)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := Decompress(stored)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing chunk %x: %s", sha256sum, err)
+	}
+	return chunk, nil
+}
+
+// PutChunk compresses the chunk, and writes it to the child client.
+func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
+	stored, err := Compress(chunk)
+	if err != nil {
+		return fmt.Errorf("compressing chunk %x: %s", sha256sum, err)
+	}
+	return s.child.PutChunk(sha256sum, stored, f)
+}
+
+// ReleaseChunk is passed to the child client.
+func (s *Drive) ReleaseChunk(sha256sum []byte) error {
+	return s.child.ReleaseChunk(sha256sum)
+}
+
+// Stat is passed to the child client, so it reports the compressed size.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	return s.child.Stat(sha256sum)
+}
+
+// Warm is passed to the child client.
+func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
+	s.child.Warm(chunks, f)
+}
+
+// Space returns the space of the child client.
+func (s *Drive) Space() (total, free uint64, err error) {
+	return drive.Space(s.child)
+}
+
+// SetProperties sets the properties of an object of the child client.
+func (s *Drive) SetProperties(sha256sum []byte, props map[string]string) error {
+	return drive.SetProperties(s.child, sha256sum, props)
+}
+
+// Properties returns the properties of an object of the child client.
+func (s *Drive) Properties(sha256sum []byte) (map[string]string, error) {
+	return drive.Properties(s.child, sha256sum)
+}
+
+// GetConfig returns the config used to initialize this client.
+func (s *Drive) GetConfig() drive.Config {
+	return s.config
+}
+
+// Local returns whether the child client is local to this machine.
+func (s *Drive) Local() bool { return s.child.Local() }
+
+// Persistent returns whether the child client is persistent.
+func (s *Drive) Persistent() bool { return s.child.Persistent() }
+
+// Flush flushes the child client.
+func (s *Drive) Flush() error { return drive.Flush(s.child) }
+
+// Close closes the child client.
+func (s *Drive) Close() error { return drive.Close(s.child) }
+
+// Ping pings the child client.
+func (s *Drive) Ping(ctx context.Context) error { return s.child.Ping(ctx) }
+
+// NewChunkLister returns the child client's ChunkLister.
+func (s *Drive) NewChunkLister() drive.ChunkLister {
+	return s.child.NewChunkLister()
+}
+
+// Compress returns chunk as a gzip stream.
+func Compress(chunk []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(chunk); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Decompress returns the content of stored, if it is a gzip stream, and
+// otherwise returns stored unchanged.
+func Decompress(stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, gzipMagic) {
+		return stored, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
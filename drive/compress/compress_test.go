@@ -0,0 +1,151 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+func newTestDrive(t *testing.T) (*Drive, drive.Client) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	return &Drive{config: drive.Config{Write: true}, child: mc}, mc
+}
+
+func TestRoundTrip(t *testing.T) {
+	c, err := NewClient(drive.Config{
+		Children: []drive.Config{{Provider: "memory", Write: true}},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	drive.TestFileRoundTrip(t, c, 100)
+	drive.TestChunkRoundTrip(t, c, 100)
+	drive.TestChunkRange(t, c)
+}
+
+func TestStoredCompressed(t *testing.T) {
+	c, mc := newTestDrive(t)
+	chunk := bytes.Repeat([]byte("shade "), 1000)
+	sum := shade.Sum(chunk)
+	if err := c.PutChunk(sum, chunk, nil); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := mc.GetChunk(sum, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) >= len(chunk) {
+		t.Errorf("want the chunk stored in fewer than %d bytes, got: %d", len(chunk), len(stored))
+	}
+	if !bytes.HasPrefix(stored, gzipMagic) {
+		t.Errorf("stored chunk is not a gzip stream: %x", stored[:2])
+	}
+}
+
+// TestExternalChunks reads chunks written to the child directly, either
+// compressed by gzip or not at all.
+func TestExternalChunks(t *testing.T) {
+	c, mc := newTestDrive(t)
+	plain := []byte("stored before compression was configured")
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("compressed by an external tool"))
+	w.Close()
+	for _, tc := range []struct {
+		stored, want []byte
+	}{
+		{plain, plain},
+		{gz.Bytes(), []byte("compressed by an external tool")},
+	} {
+		sum := shade.Sum(tc.want)
+		if err := mc.PutChunk(sum, tc.stored, nil); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.GetChunk(sum, nil)
+		if err != nil {
+			t.Errorf("GetChunk(%q): %s", tc.want, err)
+			continue
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("GetChunk: want %q, got: %q", tc.want, got)
+		}
+	}
+}
+
+// TestChunkRange ensures a ranged read returns the requested bytes of the
+// plaintext, not of the compressed chunk.
+func TestChunkRange(t *testing.T) {
+	c, _ := newTestDrive(t)
+	var chunk []byte
+	for i := 0; i < 4096; i++ {
+		chunk = append(chunk, byte(i%7), byte(i%251))
+	}
+	sum := shade.Sum(chunk)
+	if err := c.PutChunk(sum, chunk, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := drive.Client(c).(drive.RangeGetter); ok {
+		t.Fatal("compress must not implement drive.RangeGetter")
+	}
+	size := int64(len(chunk))
+	for _, r := range []struct{ offset, length int64 }{
+		{0, 1},
+		{10, 100},
+		{size / 2, 1000},
+		{size - 10, 100}, // extends past the end
+		{size, 10},       // entirely past the end
+	} {
+		got, err := drive.GetChunkRange(c, sum, nil, r.offset, r.length)
+		if err != nil {
+			t.Errorf("GetChunkRange(%d, %d): %s", r.offset, r.length, err)
+			continue
+		}
+		if want := drive.SliceRange(chunk, r.offset, r.length); !bytes.Equal(got, want) {
+			t.Errorf("GetChunkRange(%d, %d) returned %d bytes which differ from the plaintext (%d bytes)", r.offset, r.length, len(got), len(want))
+		}
+	}
+}
+
+// propertyClient is a memory client which stores properties.
+type propertyClient struct {
+	drive.Client
+	props map[string]map[string]string
+}
+
+func (c *propertyClient) SetProperties(sha256sum []byte, props map[string]string) error {
+	c.props[string(sha256sum)] = props
+	return nil
+}
+
+func (c *propertyClient) Properties(sha256sum []byte) (map[string]string, error) {
+	return c.props[string(sha256sum)], nil
+}
+
+func TestPropertiesPassedToChild(t *testing.T) {
+	d, mc := newTestDrive(t)
+	pc := &propertyClient{Client: mc, props: make(map[string]map[string]string)}
+	d.child = pc
+	sum := []byte("an object")
+	want := map[string]string{"tool": "shade"}
+	if err := drive.SetProperties(d, sum, want); err != nil {
+		t.Fatal(err)
+	}
+	if got := pc.props[string(sum)]; !reflect.DeepEqual(got, want) {
+		t.Errorf("the child stored properties: %v, want: %v", got, want)
+	}
+	got, err := drive.Properties(d, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Properties() = %v, want: %v", got, want)
+	}
+}
@@ -1,8 +1,12 @@
 package drive
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/asjoyner/shade"
 )
@@ -53,6 +57,11 @@ type Client interface {
 	// The chunk is not required to be deleted by the client.
 	ReleaseChunk(sha256 []byte) error
 
+	// Stat describes the file or chunk with the given SHA-256 sum, without
+	// retrieving its contents.  The sum is the one the object is stored at,
+	// as returned by ListFiles or a ChunkLister.
+	Stat(sha256 []byte) (Info, error)
+
 	// Warm is an optional hint to clients that the supplied chunks might be
 	// fetched soon.  This helps batch up metadata queries for remote clients, to
 	// reduce their latency impact.  Most local clients can return nil.
@@ -74,6 +83,378 @@ type Client interface {
 	// persist after the death of the binary, but perhaps not the machine on
 	// which it is running
 	Persistent() bool
+
+	// Ping performs a cheap check that the storage backend is reachable and
+	// authorized, and returns an error describing the problem if it is not.
+	// Binaries should call it at startup, to fail fast on misconfiguration.
+	Ping(ctx context.Context) error
+}
+
+// Info describes an object stored by a Client.
+type Info struct {
+	Size    int64     // in bytes, as stored by the client
+	ModTime time.Time // the zero value, if the client does not track it
+}
+
+// Flusher is an optional interface implemented by clients which complete
+// some writes in the background.
+type Flusher interface {
+	// Flush blocks until all pending writes have completed, and returns an
+	// error if any of them failed.
+	Flush() error
+}
+
+// Flush calls Flush on c, if it implements Flusher.  Binaries should call it
+// before exiting, to avoid losing writes.
+func Flush(c Client) error {
+	if f, ok := c.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Closer is an optional interface implemented by clients which hold
+// resources, such as background goroutines, open files or child clients,
+// which should be released when the client is discarded.
+type Closer interface {
+	// Close completes any pending writes, as Flush does, and releases the
+	// resources of the client.  The client must not be used afterwards.
+	Close() error
+}
+
+// Close calls Close on c, if it implements Closer, and otherwise Flush.
+// Binaries should call it once they are done with a client, rather than
+// Flush, and so should tests which discard a client.
+func Close(c Client) error {
+	if cl, ok := c.(Closer); ok {
+		return cl.Close()
+	}
+	return Flush(c)
+}
+
+// PermanentError wraps an error which retrying will not resolve, such as an
+// authorization failure.  Clients return it so that callers which retry
+// transient errors can give up immediately.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the underlying error.
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// IsPermanent returns whether err is, or wraps, a PermanentError.  Other
+// errors are assumed to be transient.
+func IsPermanent(err error) bool {
+	var pe *PermanentError
+	return errors.As(err, &pe)
+}
+
+var missingChunks = expvar.NewInt("missingChunks")
+
+// MissingChunkError reports that a chunk of a file could not be retrieved from
+// the client, or from any of its children.  It names the chunk and the file,
+// so the user can find which provider should have held it.
+type MissingChunkError struct {
+	Sum      []byte
+	Filename string
+	Err      error
+}
+
+func (e *MissingChunkError) Error() string {
+	return fmt.Sprintf("chunk %x of %q could not be read from any provider (is a provider which holds it missing from the config?): %s", e.Sum, e.Filename, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *MissingChunkError) Unwrap() error { return e.Err }
+
+// NewMissingChunkError returns a MissingChunkError for the chunk of f with the
+// given sum, which failed to be retrieved with err.  It also counts the event
+// in the missingChunks expvar.
+func NewMissingChunkError(sha256sum []byte, f *shade.File, err error) error {
+	missingChunks.Add(1)
+	var filename string
+	if f != nil {
+		filename = f.Filename
+	}
+	return &MissingChunkError{Sum: sha256sum, Filename: filename, Err: err}
+}
+
+var quotaExceeded = expvar.NewInt("quotaExceeded")
+
+// QuotaError reports that a provider refused a request because a quota of the
+// account was exceeded, eg. the daily download quota of Google Drive.  Such
+// quotas usually reset after a delay, so unlike other errors the request may
+// succeed if it is retried later.
+type QuotaError struct {
+	Provider string
+	Err      error
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s quota exceeded, retry later: %s", e.Provider, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *QuotaError) Unwrap() error { return e.Err }
+
+// NewQuotaError returns a QuotaError for a request to provider which failed
+// with err.  It also counts the event in the quotaExceeded expvar.
+func NewQuotaError(provider string, err error) error {
+	quotaExceeded.Add(1)
+	return &QuotaError{Provider: provider, Err: err}
+}
+
+// IsQuotaError returns true if err is, or wraps, a QuotaError.
+func IsQuotaError(err error) bool {
+	var qe *QuotaError
+	return errors.As(err, &qe)
+}
+
+// FilesGetter is an optional interface implemented by clients which can
+// retrieve many files more quickly than by calling GetFile for each.
+type FilesGetter interface {
+	// GetFiles retrieves the files with the given sums, calling fn with each
+	// file, or the error retrieving it, as it arrives.  The files arrive in no
+	// particular order, but fn is never called concurrently.  If ctx is
+	// cancelled, GetFiles returns ctx.Err() without waiting for the rest.
+	GetFiles(ctx context.Context, sums [][]byte, fn func(sha256, file []byte, err error)) error
+}
+
+// GetFiles retrieves the files with the given sums from c, calling fn with
+// each as described by FilesGetter.  If c implements FilesGetter, it is
+// used.  Otherwise, GetFile is called by up to concurrency goroutines at once;
+// if ctx is cancelled, GetFiles returns once the calls in progress do.
+func GetFiles(ctx context.Context, c Client, sums [][]byte, concurrency int, fn func(sha256, file []byte, err error)) error {
+	if fg, ok := c.(FilesGetter); ok {
+		return fg.GetFiles(ctx, sums, fn)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	type result struct {
+		sum, file []byte
+		err       error
+	}
+	// work is buffered so abandoned workers do not leak goroutines, and
+	// results holds at most one fetch per worker so they stay just ahead of fn
+	work := make(chan []byte, len(sums))
+	for _, sum := range sums {
+		work <- sum
+	}
+	close(work)
+	results := make(chan result, concurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for i := 0; i < concurrency && i < len(sums); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sum := range work {
+				if ctx.Err() != nil {
+					return
+				}
+				file, err := c.GetFile(sum)
+				select {
+				case results <- result{sum, file, err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	for range sums {
+		select {
+		case r := <-results:
+			fn(r.sum, r.file, r.err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// RangeGetter is an optional interface implemented by clients which can
+// retrieve part of a chunk more cheaply than the whole chunk.
+type RangeGetter interface {
+	// GetChunkRange retrieves up to length bytes of the chunk with the given
+	// SHA-256 sum, starting at offset.  Fewer bytes are returned if the chunk
+	// ends first.
+	GetChunkRange(sha256 []byte, f *shade.File, offset, length int64) ([]byte, error)
+}
+
+// GetChunkRange retrieves up to length bytes of a chunk, starting at offset.
+// If c implements RangeGetter, only the requested bytes are fetched.
+// Otherwise, the whole chunk is fetched with GetChunk and trimmed.
+func GetChunkRange(c Client, sha256 []byte, f *shade.File, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("negative offset and length are unsupported")
+	}
+	if rg, ok := c.(RangeGetter); ok {
+		return rg.GetChunkRange(sha256, f, offset, length)
+	}
+	chunk, err := c.GetChunk(sha256, f)
+	if err != nil {
+		return nil, err
+	}
+	return SliceRange(chunk, offset, length), nil
+}
+
+// SliceRange returns up to length bytes of chunk, starting at offset.  It is
+// a helper for implementations of RangeGetter which hold the whole chunk.
+func SliceRange(chunk []byte, offset, length int64) []byte {
+	if offset >= int64(len(chunk)) {
+		return []byte{}
+	}
+	end := offset + length
+	if end > int64(len(chunk)) {
+		end = int64(len(chunk))
+	}
+	return chunk[offset:end]
+}
+
+// GetChunkRanges retrieves a chunk of size bytes as parts concurrent
+// GetChunkRange requests of nearly equal length, and reassembles them.  If c
+// does not implement RangeGetter, or parts is less than two, the chunk is
+// retrieved by a single GetChunk.
+func GetChunkRanges(c Client, sha256 []byte, f *shade.File, size int64, parts int) ([]byte, error) {
+	rg, ok := c.(RangeGetter)
+	if !ok || parts < 2 {
+		return c.GetChunk(sha256, f)
+	}
+	if int64(parts) > size {
+		parts = int(size)
+	}
+	if parts < 1 {
+		parts = 1
+	}
+	ranges := make([][]byte, parts)
+	errs := make([]error, parts)
+	var wg sync.WaitGroup
+	for i := 0; i < parts; i++ {
+		offset := size * int64(i) / int64(parts)
+		length := size*int64(i+1)/int64(parts) - offset
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ranges[i], errs[i] = rg.GetChunkRange(sha256, f, offset, length)
+			if errs[i] == nil && int64(len(ranges[i])) != length {
+				errs[i] = fmt.Errorf("range %d of %x has %d bytes, want: %d", i, sha256, len(ranges[i]), length)
+			}
+		}(i)
+	}
+	wg.Wait()
+	chunk := make([]byte, 0, size)
+	for i, r := range ranges {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		chunk = append(chunk, r...)
+	}
+	return chunk, nil
+}
+
+// SpaceReporter is an optional interface implemented by clients which know
+// how much they can store, such as those backed by a local filesystem or
+// with a storage quota.
+type SpaceReporter interface {
+	// Space returns the number of bytes the client can store in total, and
+	// the number it has available.
+	Space() (total, free uint64, err error)
+}
+
+// ErrUnknownSpace is returned by Space for a client which does not know how
+// much it can store.
+var ErrUnknownSpace = errors.New("the available space is unknown")
+
+// Space returns the total and free bytes of c, if it implements
+// SpaceReporter.  Otherwise, it returns ErrUnknownSpace.
+func Space(c Client) (total, free uint64, err error) {
+	if sr, ok := c.(SpaceReporter); ok {
+		return sr.Space()
+	}
+	return 0, 0, ErrUnknownSpace
+}
+
+// MinSpace returns the space of the client with the least free space among
+// clients, for a client which writes to all of them.  Clients whose space is
+// unknown are skipped; if all of them are, it returns ErrUnknownSpace.
+func MinSpace(clients []Client) (total, free uint64, err error) {
+	known := false
+	for _, c := range clients {
+		t, f, err := Space(c)
+		if err == ErrUnknownSpace {
+			continue
+		} else if err != nil {
+			return 0, 0, err
+		}
+		if !known || f < free {
+			total, free = t, f
+		}
+		known = true
+	}
+	if !known {
+		return 0, 0, ErrUnknownSpace
+	}
+	return total, free, nil
+}
+
+// Propertier is an optional interface implemented by clients which can store
+// small key-value properties alongside their files and chunks, eg. to tag a
+// snapshot, or record the version of the tool which wrote it.  Properties are
+// stored as they are given, unencrypted, so the "encrypt" client does not
+// pass them to its children.
+type Propertier interface {
+	// SetProperties sets the given properties of the file or chunk with the
+	// given sum, replacing the values of any it already has.  Its other
+	// properties are unchanged.
+	SetProperties(sha256sum []byte, props map[string]string) error
+	// Properties returns the properties which were set on the file or chunk
+	// with the given sum.
+	Properties(sha256sum []byte) (map[string]string, error)
+}
+
+// SetProperties sets the given properties of an object, if c implements
+// Propertier.  Otherwise, it does nothing, and returns nil.
+func SetProperties(c Client, sha256sum []byte, props map[string]string) error {
+	if p, ok := c.(Propertier); ok {
+		return p.SetProperties(sha256sum, props)
+	}
+	return nil
+}
+
+// Properties returns the properties of an object, if c implements
+// Propertier.  Otherwise, it returns no properties, and no error.
+func Properties(c Client, sha256sum []byte) (map[string]string, error) {
+	if p, ok := c.(Propertier); ok {
+		return p.Properties(sha256sum)
+	}
+	return nil, nil
+}
+
+// ChangeLister is an optional interface implemented by clients which can list
+// the files added since an earlier listing more cheaply than listing them all,
+// such as from a change feed.
+type ChangeLister interface {
+	// ListFilesSince returns the sums of the files added since the call which
+	// returned token, and the token to pass to the next call.  An empty token
+	// returns every file, like ListFiles.  Files may be returned more than
+	// once.  Released files are not reported.
+	ListFilesSince(token string) (files [][]byte, next string, err error)
+}
+
+// ErrNoChanges is returned by ListFilesSince for a client which can't list
+// the files added since an earlier listing.
+var ErrNoChanges = errors.New("listing changes is not supported")
+
+// ListFilesSince calls ListFilesSince on c, if it implements ChangeLister.
+// Otherwise, it returns ErrNoChanges.
+func ListFilesSince(c Client, token string) (files [][]byte, next string, err error) {
+	if cl, ok := c.(ChangeLister); ok {
+		return cl.ListFilesSince(token)
+	}
+	return nil, "", ErrNoChanges
 }
 
 // ChunkLister provides a mechanism to iterate the Sha256 sums of all the
@@ -97,20 +478,97 @@ type Config struct {
 	OAuth         OAuthConfig
 	FileParentID  string
 	ChunkParentID string
+	// SharedDriveID restricts the "google" client to the shared drive with
+	// this id: only its objects are listed, and new objects are created in
+	// it, in its root unless FileParentID or ChunkParentID are set.
+	SharedDriveID string
 	Write         bool
 	MaxFiles      uint64
 	MaxChunkBytes uint64
+	// BloomFilterBytes is the size of the in-memory Bloom filter the "local"
+	// client uses to skip checking the disk for chunks it does not have.  Zero
+	// disables the filter.
+	BloomFilterBytes uint64
+	// MinFreeBytes is the space, in bytes, the "local" client keeps free on
+	// the filesystems holding its directories.  A write which would leave
+	// less fails with local.ErrInsufficientSpace, after the least recently
+	// used chunks are removed, if MaxChunkBytes is set.  Zero disables the
+	// check.
+	MinFreeBytes uint64
+	// TimeoutSeconds bounds each request the "google" and "amazon" clients
+	// make, including transferring its body, so that a stalled connection
+	// returns an error rather than hanging the caller.  Zero is no timeout.
+	TimeoutSeconds float64
+	// RefcountIndex is the path of the file in which the "refcount" client
+	// persists the files which reference each chunk.
+	RefcountIndex string
+	// ParallelRanges is the number of concurrent Range requests the "google"
+	// client splits the download of each large chunk into, to improve
+	// throughput on links with a high bandwidth-delay product.  Zero or one
+	// downloads each chunk with a single request.
+	ParallelRanges int
+	// ResumableUploadBytes is the size, in bytes, of the smallest object the
+	// "google" client uploads with the resumable upload protocol, in pieces of
+	// at most 8MiB, so that a failed piece is retried without sending the rest
+	// again.  Smaller objects are uploaded with a single request.  Zero
+	// uploads every object with a single request.
+	ResumableUploadBytes int
+	// NoZerobyte disables the "google" client's zerobyte optimization: the
+	// first byte of each object is no longer recorded in its properties, nor
+	// used to shorten the download of the rest.  Objects stored either way
+	// remain readable.
+	NoZerobyte bool
+	// ListCacheSeconds is how long the "listcache" client reuses the list of
+	// files or chunks of its child.  Zero does not reuse them.
+	ListCacheSeconds float64
+	// SplitSize is the largest object, in bytes, the "split" client passes to
+	// its child whole.  Larger files and chunks are stored as several parts.
+	SplitSize int64
+	// Namespace names the namespace the "namespace" client stores the
+	// objects of its child in, isolating them from the objects of other
+	// repositories which share the child.
+	Namespace string
+	// Replicas is the number of distinct children the "stripe" client writes
+	// each chunk to.  Zero or one stores each chunk in a single child.
+	Replicas int
 
 	// See the godoc for the "encrypt" package for more details.
 	// Tip: `shadeutil genkeys -t N` will generate RSA keys and print them as
 	// properly formatted JSON strings, to make it easier to format a Config for
-	// the "encrypt" client.
+	// the "encrypt" client.  If both keys are set, the public key must match
+	// the private key.
 	RsaPublicKey  string
 	RsaPrivateKey string
+	// ConvergentKey is a hex encoded 256-bit master key.  If it is set, the
+	// "encrypt" client derives each chunk's key from it and the chunk's
+	// contents, so identical chunks deduplicate.  Read the godoc for the
+	// "encrypt" package before enabling this.
+	ConvergentKey string
+	// PadFiles makes the "encrypt" client pad each file object to a power of
+	// two bytes, so its stored size does not reveal how many chunks it has.
+	PadFiles bool
+
+	// SumAlgorithm names the hash used to address new files and chunks in
+	// the repository (see shade.SumWith).  It is only read from the top level
+	// config; empty selects the default, "sha256".
+	SumAlgorithm string
+	// LockDir is a directory in which the processes sharing this config hold
+	// advisory locks, so that cleaning up the repository does not release the
+	// chunks of files being written; see the "repolock" package.  It is only
+	// read from the top level config; empty disables locking.
+	LockDir string
+	// Faults configures the errors, latency and corruption injected by the
+	// "flaky" test client.
+	Faults FaultConfig
 
 	Children []Config
 }
 
+// Timeout returns TimeoutSeconds as a time.Duration.
+func (c Config) Timeout() time.Duration {
+	return time.Duration(c.TimeoutSeconds * float64(time.Second))
+}
+
 // OAuthConfig contains the OAuth configuration information.
 type OAuthConfig struct {
 	ClientID     string
@@ -119,6 +577,23 @@ type OAuthConfig struct {
 	TokenPath    string
 }
 
+// FaultConfig describes the faults the "flaky" test client injects into the
+// calls it passes to its child.
+type FaultConfig struct {
+	// Seed seeds the random choice of faults, so a test which makes the same
+	// calls sees the same faults.
+	Seed int64
+	// FailureRates maps the name of a Client method (eg. "GetChunk") to the
+	// probability, from 0 to 1, that a call to it fails.  The rate named "*"
+	// applies to the methods which are not named.
+	FailureRates map[string]float64
+	// LatencySeconds delays each call.
+	LatencySeconds float64
+	// CorruptRate is the probability, from 0 to 1, that each chunk or file
+	// returned has one of its bytes altered.
+	CorruptRate float64
+}
+
 type clientCreator func(c Config) (Client, error)
 
 var (
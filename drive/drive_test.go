@@ -1,8 +1,18 @@
 package drive
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"expvar"
+	"fmt"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/asjoyner/shade"
 )
 
 func TestProviderRegistration(t *testing.T) {
@@ -32,3 +42,179 @@ func TestProviderRegistration(t *testing.T) {
 		t.Errorf(`expected NewClient("bardrive") to fail with error %q, but got: %q`, wantErr, err)
 	}
 }
+
+func TestIsPermanent(t *testing.T) {
+	if IsPermanent(errors.New("transient")) {
+		t.Error("an ordinary error is permanent")
+	}
+	pe := &PermanentError{Err: errors.New("unauthorized")}
+	if !IsPermanent(pe) {
+		t.Error("a PermanentError is not permanent")
+	}
+	if !IsPermanent(fmt.Errorf("listing: %w", pe)) {
+		t.Error("a wrapped PermanentError is not permanent")
+	}
+}
+
+// rangeClient serves a single chunk, counting the GetChunkRange calls.
+type rangeClient struct {
+	Client
+	chunk []byte
+
+	mu     sync.Mutex
+	ranges int
+}
+
+func (c *rangeClient) GetChunk(sha256 []byte, f *shade.File) ([]byte, error) {
+	return c.chunk, nil
+}
+
+func (c *rangeClient) GetChunkRange(sha256 []byte, f *shade.File, offset, length int64) ([]byte, error) {
+	c.mu.Lock()
+	c.ranges++
+	c.mu.Unlock()
+	return SliceRange(c.chunk, offset, length), nil
+}
+
+// wholeClient serves a single chunk, without support for ranges.
+type wholeClient struct {
+	Client
+	chunk []byte
+}
+
+func (c *wholeClient) GetChunk(sha256 []byte, f *shade.File) ([]byte, error) {
+	return c.chunk, nil
+}
+
+func TestGetChunkRanges(t *testing.T) {
+	chunk := make([]byte, 1001)
+	if _, err := rand.Read(chunk); err != nil {
+		t.Fatal(err)
+	}
+	for _, parts := range []int{0, 1, 2, 3, 7, 1001, 5000} {
+		rc := &rangeClient{chunk: chunk}
+		got, err := GetChunkRanges(rc, nil, nil, int64(len(chunk)), parts)
+		if err != nil {
+			t.Fatalf("GetChunkRanges(%d parts): %s", parts, err)
+		}
+		if !bytes.Equal(got, chunk) {
+			t.Errorf("GetChunkRanges(%d parts) returned %d bytes which differ from GetChunk", parts, len(got))
+		}
+		want := parts
+		if parts < 2 {
+			want = 0
+		} else if parts > len(chunk) {
+			want = len(chunk)
+		}
+		if rc.ranges != want {
+			t.Errorf("GetChunkRanges(%d parts) made %d range requests, want: %d", parts, rc.ranges, want)
+		}
+	}
+
+	got, err := GetChunkRanges(&wholeClient{chunk: chunk}, nil, nil, int64(len(chunk)), 4)
+	if err != nil {
+		t.Fatalf("GetChunkRanges without range support: %s", err)
+	}
+	if !bytes.Equal(got, chunk) {
+		t.Errorf("GetChunkRanges without range support returned %d bytes which differ from GetChunk", len(got))
+	}
+
+	// A short range must not be reassembled silently.
+	rc := &rangeClient{chunk: chunk[:900]}
+	if _, err := GetChunkRanges(rc, nil, nil, int64(len(chunk)), 4); err == nil {
+		t.Error("GetChunkRanges succeeded despite a short range")
+	}
+}
+
+func TestObserveLatency(t *testing.T) {
+	ObserveLatency("test", "GetChunk", time.Now())
+	ObserveLatency("test", "GetChunk", time.Now().Add(-300*time.Millisecond))
+	ObserveLatency("test", "GetChunk", time.Now().Add(-2*time.Minute))
+
+	h, ok := expvar.Get("driveLatency").(*expvar.Map).Get("test.GetChunk").(*Histogram)
+	if !ok {
+		t.Fatal("driveLatency does not contain test.GetChunk")
+	}
+	buckets, count, sum := h.Snapshot()
+	if count != 3 {
+		t.Errorf("count: got %d, want 3", count)
+	}
+	if sum < 2*time.Minute+300*time.Millisecond {
+		t.Errorf("sum: got %s, want at least 2m0.3s", sum)
+	}
+	for i, b := range LatencyBuckets {
+		var want uint64
+		switch {
+		case b >= 500*time.Millisecond:
+			want = 2
+		case b >= time.Millisecond:
+			want = 1
+		}
+		if buckets[i] != want {
+			t.Errorf("bucket %s: got %d, want %d", b, buckets[i], want)
+		}
+	}
+	for _, want := range []string{`"count":3`, `"250ms":1`, `"500ms":2`, `"+Inf":3`} {
+		if !strings.Contains(h.String(), want) {
+			t.Errorf("%s does not contain %s", h, want)
+		}
+	}
+}
+
+// blockingClient counts the calls to GetFile in progress, each of which
+// blocks until unblock is closed.
+type blockingClient struct {
+	Client
+	unblock chan struct{}
+
+	mu     sync.Mutex
+	active int
+}
+
+func (c *blockingClient) GetFile(sha256 []byte) ([]byte, error) {
+	c.mu.Lock()
+	c.active++
+	c.mu.Unlock()
+	<-c.unblock
+	c.mu.Lock()
+	c.active--
+	c.mu.Unlock()
+	return sha256, nil
+}
+
+// TestGetFilesCancelled checks that GetFiles returns ctx.Err() once ctx is
+// cancelled, but not while a call to GetFile is still in progress.
+func TestGetFilesCancelled(t *testing.T) {
+	c := &blockingClient{unblock: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	sums := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+	done := make(chan error, 1)
+	go func() {
+		done <- GetFiles(ctx, c, sums, 2, func(sha256, file []byte, err error) {})
+	}()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		active := c.active
+		c.mu.Unlock()
+		if active == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			close(c.unblock)
+			t.Fatalf("%d calls to GetFile started, want 2", active)
+		}
+	}
+	cancel()
+	var err error
+	select {
+	case err = <-done:
+		t.Error("GetFiles returned while calls to GetFile were in progress")
+		close(c.unblock)
+	case <-time.After(50 * time.Millisecond):
+		close(c.unblock)
+		err = <-done
+	}
+	if err != nil && err != context.Canceled {
+		t.Errorf("GetFiles after cancel: want %v, got: %v", context.Canceled, err)
+	}
+}
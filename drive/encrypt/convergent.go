@@ -0,0 +1,82 @@
+package encrypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+)
+
+const (
+	convergentKeyInfo = "shade convergent chunk key"
+	convergentSumInfo = "shade convergent chunk sum"
+)
+
+// convergentNonce is used for every chunk encrypted in convergent mode.  This
+// is safe only because each derived key encrypts a single plaintext.
+var convergentNonce = make([]byte, 12)
+
+// deriveKey implements HKDF-SHA256 (RFC 5869), with an empty salt, to derive
+// 32 bytes from the master key, for a given purpose and chunk sha256sum.
+func deriveKey(master []byte, info string, sha256sum []byte) *[32]byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(master)
+	prk := extract.Sum(nil)
+
+	// A single round of expansion yields the 32 bytes required.
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte(info))
+	expand.Write(sha256sum)
+	expand.Write([]byte{1})
+	key := &[32]byte{}
+	copy(key[:], expand.Sum(nil))
+	return key
+}
+
+// convergentSum returns the sum a chunk is stored at in convergent mode.  It
+// is derived from the master key, so the stored sums do not reveal the
+// plaintext sums of the chunks.
+func (s *Drive) convergentSum(sha256sum []byte) []byte {
+	sum := deriveKey(s.convergentKey, convergentSumInfo, sha256sum)
+	return sum[:]
+}
+
+// ChunkSum returns the sum that the chunk with the given plaintext sha256sum
+// is stored at in the child client, in either encryption mode.
+func (s *Drive) ChunkSum(sha256sum []byte, f *shade.File) ([]byte, error) {
+	if s.convergentKey != nil {
+		return s.convergentSum(sha256sum), nil
+	}
+	return GetEncryptedSum(sha256sum, f)
+}
+
+// StoredChunkSums returns the sums that the chunks of f are stored at, as
+// computed by ChunkSum, by each "encrypt" client in the config c and its
+// children, in the mode that client is configured in.  Unlike
+// GetAllEncryptedSums, it covers convergent mode, so it must be used to
+// compute the chunks a file keeps in use in a repository read through c.
+func StoredChunkSums(c drive.Config, f *shade.File) ([][]byte, error) {
+	var sums [][]byte
+	if c.Provider == "encrypt" {
+		d := &Drive{config: c}
+		if err := d.parseKeys(); err != nil {
+			return nil, err
+		}
+		for _, chunk := range f.Chunks {
+			sum, err := d.ChunkSum(chunk.Sha256, f)
+			if err != nil {
+				return nil, err
+			}
+			sums = append(sums, sum)
+		}
+	}
+	for _, child := range c.Children {
+		childSums, err := StoredChunkSums(child, f)
+		if err != nil {
+			return nil, err
+		}
+		sums = append(sums, childSums...)
+	}
+	return sums, nil
+}
@@ -5,7 +5,9 @@
 //
 // File objects are encrypted with an RSA public key provided in the config.
 // If an RSA private key is provided, GetFile and ListFiles will perform the
-// reverse operation.
+// reverse operation, and the public key is derived from it.  A public key may
+// be provided as well, but NewClient returns an error unless it matches the
+// private key, as files encrypted with it could not be decrypted.
 //
 // Chunk objects are encrypted with 256-bit AES-GCM using an AES key stored in
 // the shade.File struct and a random 96-bit nonce stored with each shade.Chunk
@@ -21,24 +23,55 @@
 // The sha256sum of File objects are not encrypted.  The struct contains
 // sufficient internal randomness (Nonces of shade.Chunk objects, mtime, etc)
 // that the sum does not leak information about the contents of the file.
+//
+// Convergent encryption
+//
+// If ConvergentKey is set in the config, chunks are instead encrypted with a
+// key derived (via HKDF-SHA256) from that master key and the sha256sum of the
+// chunk's plaintext, and stored at a sum derived the same way.  Identical
+// chunks then encrypt identically, even in different files, so they are stored
+// only once.  The AesKey of the shade.File and the Nonce of each shade.Chunk
+// are not used for chunks in this mode; File objects are encrypted as usual.
+//
+// This has a privacy cost: anyone who holds the master key and can see the
+// stored chunks can confirm whether you have stored a chunk with contents they
+// can guess (a "confirmation attack"), and can learn when two of your files
+// share content.  Only enable it if the storage savings are worth that.
+// Chunks written in one mode cannot be read in the other, and
+// GetEncryptedSum and GetAllEncryptedSums only describe the default mode; use
+// ChunkSum, or StoredChunkSums, to find chunks in either mode.
+//
+// Padding
+//
+// The size of an encrypted File object reveals roughly how many chunks it
+// has, and thus the approximate size of the file.  If PadFiles is set in the
+// config, the compressed File object is padded to the next power of two bytes
+// (at least minPaddedSize) before it is encrypted, so that the stored size
+// only reveals which bucket it falls in.  Padded and unpadded objects can be
+// read regardless of the setting.
 package encrypt
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
 
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
-	"github.com/golang/glog"
+	"github.com/asjoyner/shade/logging"
 )
 
 func init() {
@@ -48,53 +81,83 @@ func init() {
 // NewClient performs sanity checking and returns a Drive client.
 func NewClient(c drive.Config) (drive.Client, error) {
 	d := &Drive{config: c}
-	var err error
+	if err := d.parseKeys(); err != nil {
+		return nil, err
+	}
+
+	// Initialize the child client
+	if len(c.Children) == 0 {
+		return nil, errors.New("no clients provided")
+	}
+	if len(c.Children) > 1 {
+		return nil, errors.New("only one encrypted child is supported, you probably want a drive/cache in your config")
+	}
+	child, err := drive.NewClient(c.Children[0])
+	if err != nil {
+		return nil, fmt.Errorf("initing encrypted client %q: %s", c.Provider, err)
+	}
+	d.client = child
+	if child.GetConfig().Write {
+		d.config.Write = true
+	}
+	return d, nil
+}
+
+// CheckKeys returns an error if the keys in the encrypt config c can not be
+// parsed.  Unlike NewClient, it does not initialize the child client.
+func CheckKeys(c drive.Config) error {
+	d := &Drive{config: c}
+	return d.parseKeys()
+}
+
+// parseKeys decodes and verifies the keys in the config.  If both RSA keys
+// are supplied, the public key must be the public part of the private key.
+func (d *Drive) parseKeys() error {
+	c := d.config
+	if len(c.RsaPrivateKey) == 0 && len(c.RsaPublicKey) == 0 {
+		return fmt.Errorf("encrypt requires that you specify either a public or private key")
+	}
 	// Decode and verify RSA pub/priv keys
 	if len(c.RsaPrivateKey) > 0 {
 		b, _ := pem.Decode([]byte(c.RsaPrivateKey))
 		if b == nil {
-			return nil, fmt.Errorf("parsing PEM encoded private key from config: %s", c.RsaPrivateKey)
+			return fmt.Errorf("parsing PEM encoded private key from config: %s", c.RsaPrivateKey)
 		}
 		key, err := x509.ParsePKCS1PrivateKey(b.Bytes)
 		if err != nil {
-			return nil, fmt.Errorf("parsing PKCS1 private key from config: %s", err)
+			return fmt.Errorf("parsing PKCS1 private key from config: %s", err)
 		}
 		d.privkey = key
 		d.pubkey = &key.PublicKey
-	} else if len(c.RsaPublicKey) > 0 {
+	}
+	if len(c.RsaPublicKey) > 0 {
 		b, _ := pem.Decode([]byte(c.RsaPublicKey))
 		if b == nil {
-			return nil, fmt.Errorf("parsing PEM encoded public key from config: %s", c.RsaPublicKey)
+			return fmt.Errorf("parsing PEM encoded public key from config: %s", c.RsaPublicKey)
 		}
 		pubkey, err := x509.ParsePKIXPublicKey(b.Bytes)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse DER encoded public key from config: %s", err)
+			return fmt.Errorf("failed to parse DER encoded public key from config: %s", err)
 		}
 		rsapubkey, ok := pubkey.(*rsa.PublicKey)
 		if !ok {
-			return nil, fmt.Errorf("DER encoded public key in config must be an RSA key: %s", err)
+			return fmt.Errorf("DER encoded public key in config must be an RSA key, not %T", pubkey)
+		}
+		// Files encrypted with a public key which does not match the private
+		// key could never be decrypted.
+		if d.privkey != nil && (rsapubkey.N.Cmp(d.privkey.N) != 0 || rsapubkey.E != d.privkey.E) {
+			return errors.New("RsaPublicKey does not match RsaPrivateKey; files encrypted with it could not be decrypted, so supply only the private key, or the matching public key")
 		}
 		d.pubkey = rsapubkey
-	} else {
-		return nil, fmt.Errorf("encrypt requires that you specify either a public or private key")
-	}
-
-	// Initialize the child client
-	if len(c.Children) == 0 {
-		return nil, errors.New("no clients provided")
-	}
-	if len(c.Children) > 1 {
-		return nil, errors.New("only one encrypted child is supported, you probably want a drive/cache in your config")
-	}
-	child, err := drive.NewClient(c.Children[0])
-	if err != nil {
-		return nil, fmt.Errorf("initing encrypted client %q: %s", c.Provider, err)
 	}
-	d.client = child
-	if child.GetConfig().Write {
-		d.config.Write = true
+	if len(c.ConvergentKey) > 0 {
+		key, err := hex.DecodeString(c.ConvergentKey)
+		if err != nil || len(key) != 32 {
+			return errors.New("ConvergentKey must be a hex encoded 256-bit key")
+		}
+		d.convergentKey = key
 	}
-	return d, nil
+	return nil
 }
 
 // Drive protects the contents of a single child drive.Client.  It can return a
@@ -109,6 +172,9 @@ type Drive struct {
 	client  drive.Client
 	pubkey  *rsa.PublicKey
 	privkey *rsa.PrivateKey
+	// convergentKey is the master key for convergent encryption of chunks, or
+	// nil to encrypt them with the AesKey of their File.
+	convergentKey []byte
 }
 
 // encryptedObj is used to store shade.File objects in the child client.
@@ -117,6 +183,78 @@ type encryptedObj struct {
 	Bytes []byte // the provided shdae.File object
 }
 
+// fileFormatGzip is the version byte which prefixes the plaintext of file
+// objects that were gzip compressed before encryption.  Objects written before
+// compression was introduced are JSON, so begin with '{' instead, and are
+// returned as is.
+const fileFormatGzip byte = 1
+
+// fileFormatPaddedGzip is the version byte which prefixes the plaintext of
+// file objects that were gzip compressed and then padded.  It is followed by
+// the length of the compressed bytes, as a big endian uint32, then the
+// compressed bytes, then zeros.
+const fileFormatPaddedGzip byte = 2
+
+// minPaddedSize is the smallest size a padded file object is padded to, so
+// that small files are indistinguishable from one another.
+const minPaddedSize = 1024
+
+// compressFile returns f, gzip compressed and prefixed with fileFormatGzip.
+// If pad is true, it is instead prefixed with fileFormatPaddedGzip, and
+// padded to the next power of two bytes.
+func compressFile(f []byte, pad bool) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(f); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if !pad {
+		return append([]byte{fileFormatGzip}, buf.Bytes()...), nil
+	}
+	compressed := buf.Bytes()
+	size := minPaddedSize
+	for size < len(compressed)+5 {
+		size *= 2
+	}
+	padded := make([]byte, size)
+	padded[0] = fileFormatPaddedGzip
+	binary.BigEndian.PutUint32(padded[1:5], uint32(len(compressed)))
+	copy(padded[5:], compressed)
+	return padded, nil
+}
+
+// decompressFile reverses compressFile.  Plaintext without the fileFormatGzip
+// or fileFormatPaddedGzip prefix is returned unmodified.
+func decompressFile(plaintext []byte) ([]byte, error) {
+	if len(plaintext) == 0 {
+		return plaintext, nil
+	}
+	switch plaintext[0] {
+	case fileFormatGzip:
+		plaintext = plaintext[1:]
+	case fileFormatPaddedGzip:
+		if len(plaintext) < 5 {
+			return nil, errors.New("truncated padded file object")
+		}
+		n := binary.BigEndian.Uint32(plaintext[1:5])
+		if uint64(n) > uint64(len(plaintext)-5) {
+			return nil, fmt.Errorf("padded file object claims %d bytes, has %d", n, len(plaintext)-5)
+		}
+		plaintext = plaintext[5 : 5+n]
+	default:
+		return plaintext, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(plaintext))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
 // ListFiles retrieves all of the File objects known to the child
 // client.  The return is a list of sha256sums of the file object.  The keys
 // may be passed to GetFile() to retrieve the corresponding shade.File.
@@ -124,10 +262,18 @@ func (s *Drive) ListFiles() ([][]byte, error) {
 	return s.client.ListFiles()
 }
 
+// ListFilesSince returns the files added to the child client since the call
+// which returned token.  As with ListFiles, the sums are not encrypted.
+func (s *Drive) ListFilesSince(token string) ([][]byte, string, error) {
+	return drive.ListFilesSince(s.client, token)
+}
+
 // PutFile encrypts and writes the metadata describing a new file.
 // It uses the following process:
 //  - generates a new 256-bit AES encryption key
-//  - uses the new key to Encrypt() the provided File's bytes
+//  - gzip compresses the provided File's bytes, behind a version byte, and
+//    pads them if PadFiles is set
+//  - uses the new key to Encrypt() the compressed bytes
 //  - RSA encrypts the AES key (but not the sha256sum of the File's bytes)
 //  - bundles the encrypted key and encrypted bytes as an encryptedObj
 //  - marshals the encryptedObj as JSON and store it in the child client, at
@@ -136,14 +282,18 @@ func (s *Drive) PutFile(sha256sum, f []byte) error {
 	if s.config.Write == false {
 		return errors.New("no clients configured to write")
 	}
-	glog.V(3).Infof("Putting file %x", sha256sum)
+	logging.V(3).Infof("Putting file %x", sha256sum)
 	key := shade.NewSymmetricKey()
 	rng := rand.Reader
 	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rng, s.pubkey, key[:], nil)
 	if err != nil {
 		return fmt.Errorf("could not encrypt key: %s", err)
 	}
-	encryptedBytes, err := Encrypt(f, key)
+	compressed, err := compressFile(f, s.config.PadFiles)
+	if err != nil {
+		return fmt.Errorf("compressing file %x: %s", sha256sum, err)
+	}
+	encryptedBytes, err := Encrypt(compressed, key)
 	if err != nil {
 		return fmt.Errorf("encrypting file %x: %s", sha256sum, err)
 	}
@@ -153,7 +303,7 @@ func (s *Drive) PutFile(sha256sum, f []byte) error {
 	if err != nil {
 		return fmt.Errorf("could not marshal json: %s", err)
 	}
-	glog.V(3).Infof("Putting file %x to child client", sha256sum)
+	logging.V(3).Infof("Putting file %x to child client", sha256sum)
 	if err := s.client.PutFile(sha256sum, jm); err != nil {
 		return fmt.Errorf("writing encrypted file: %x", sha256sum)
 	}
@@ -189,7 +339,11 @@ func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("decrypting encrypted file %x: %s", sha256sum, err)
 	}
-	return plaintext, nil
+	f, err := decompressFile(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing file %x: %s", sha256sum, err)
+	}
+	return f, nil
 }
 
 // ReleaseFile calls ReleaseFile on the provided child client.
@@ -207,6 +361,9 @@ func (s *Drive) ReleaseFile(sha256sum []byte) error {
 //  - encrypt the sha256sum with the provided Key and Nonce
 //  - encrypt the bytes with the provided Key and a unique Nonce
 //  - store the encrypted bytes at the encrypted sum in the child client
+//
+// In convergent mode, the key, nonce and sum are derived as described in the
+// package documentation instead.
 func (s *Drive) PutChunk(sha256sum []byte, chunkBytes []byte, f *shade.File) error {
 	if f == nil {
 		return errors.New("provide a file pointer to Put an encrypted chunk")
@@ -214,6 +371,17 @@ func (s *Drive) PutChunk(sha256sum []byte, chunkBytes []byte, f *shade.File) err
 	if s.config.Write == false {
 		return errors.New("no clients configured to write")
 	}
+	if s.convergentKey != nil {
+		key := deriveKey(s.convergentKey, convergentKeyInfo, sha256sum)
+		encBytes, err := encryptUnsafe(chunkBytes, key, convergentNonce)
+		if err != nil {
+			return fmt.Errorf("encrypting file: %x", sha256sum)
+		}
+		if err := s.client.PutChunk(s.convergentSum(sha256sum), encBytes, f); err != nil {
+			return fmt.Errorf("writing encrypted file %x: %s", sha256sum, err)
+		}
+		return nil
+	}
 	if f.AesKey == nil {
 		return errors.New("no AES encryption key for file")
 	}
@@ -221,7 +389,7 @@ func (s *Drive) PutChunk(sha256sum []byte, chunkBytes []byte, f *shade.File) err
 	if err != nil {
 		return fmt.Errorf("encrypting file: %x", sha256sum)
 	}
-	encryptedSum, err := GetEncryptedSum(sha256sum, f)
+	encryptedSum, err := encryptSum(sha256sum, f, lastChunkWithSum(f, sha256sum))
 	if err != nil {
 		return fmt.Errorf("encrypting sha256sum %x: %s", sha256sum, err)
 	}
@@ -239,7 +407,7 @@ func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
 	if f == nil {
 		return nil, errors.New("provide a file pointer to Get an encrypted chunk")
 	}
-	encryptedSum, err := GetEncryptedSum(sha256sum, f)
+	encryptedSum, err := s.ChunkSum(sha256sum, f)
 	if err != nil {
 		return nil, fmt.Errorf("encrypting sha256sum %x: %s", sha256sum, err)
 	}
@@ -248,7 +416,11 @@ func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	chunkBytes, err := Decrypt(encBytes, f.AesKey)
+	key := f.AesKey
+	if s.convergentKey != nil {
+		key = deriveKey(s.convergentKey, convergentKeyInfo, sha256sum)
+	}
+	chunkBytes, err := Decrypt(encBytes, key)
 	if err != nil {
 		return nil, fmt.Errorf("decrypting file %x: %s", sha256sum, err)
 	}
@@ -264,6 +436,15 @@ func (s *Drive) ReleaseChunk(sha256sum []byte) error {
 	return s.client.ReleaseChunk(sha256sum)
 }
 
+// Stat calls Stat on the provided child client.
+//
+// Nb: As with ReleaseChunk, the sha256sum is passed unmodified to the client,
+// so chunks must be identified by their encrypted sum.  The returned Size is
+// that of the encrypted object.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	return s.client.Stat(sha256sum)
+}
+
 // NewChunkLister allows listing all the chunks in the encrypted client.
 //
 // Nb: The returned chunk *sums* are encrypted.  They cannot be decrypted
@@ -279,32 +460,43 @@ func (s *Drive) NewChunkLister() drive.ChunkLister {
 
 // GetEncryptedSum calculates the encrypted sha256sum that a chunk will be
 // stored at, for a given chunk in a given file.  It is used both by PutChunk
-// to store the chunk, and later by GetChunk to find it again.
+// to store the chunk, and later by GetChunk to find it again.  If several
+// chunks of f have the sum, the nonce of the last is used.
 func GetEncryptedSum(sha256sum []byte, f *shade.File) (encryptedSum []byte, err error) {
 	if f == nil {
 		return nil, errors.New("provide a file pointer to Get an encrypted chunk")
 	}
-	var nonce []byte
-	// Find the chunk's Nonce
-	for _, chunk := range f.Chunks {
-		if bytes.Equal(chunk.Sha256, sha256sum) {
-			if chunk.Nonce == nil {
-				return nil, fmt.Errorf("no Nonce in Chunk: %x", sha256sum)
-			}
-			nonce = chunk.Nonce
-		}
-	}
-	if nonce == nil {
+	return encryptSum(sha256sum, f, chunkWithSum(f, sha256sum))
+}
+
+// encryptSum encrypts sha256sum with the AesKey of f and the Nonce of chunk,
+// which is the chunk of f with that sum, or nil if there is none.
+func encryptSum(sha256sum []byte, f *shade.File, chunk *shade.Chunk) ([]byte, error) {
+	if chunk == nil {
 		return nil, fmt.Errorf("no corresponding Chunk in File: %x", sha256sum)
 	}
-	return encryptUnsafe(sha256sum, f.AesKey, nonce)
+	if chunk.Nonce == nil {
+		return nil, fmt.Errorf("no Nonce in Chunk: %x", sha256sum)
+	}
+	return encryptUnsafe(sha256sum, f.AesKey, chunk.Nonce)
 }
 
-// GetAllEncryptedSums returns the encrypted sums for each chunk in f.
+// GetAllEncryptedSums returns the encrypted sums for each chunk in f, in the
+// order of f.Chunks: the i'th sum is that of f.Chunks[i], encrypted with the
+// AesKey of f and the Nonce of that chunk.  Every chunk of f stored by PutChunk
+// is stored at one of them, so they identify the chunks a file keeps in use.
+// A chunk which repeats the content of a later chunk is stored at the sum of
+// the later one, so its own sum may not name a stored chunk.
+//
+// It returns an error if f has no AesKey, or any of its chunks has no Nonce,
+// rather than omit sums; garbage collection would release those chunks.
 func GetAllEncryptedSums(f *shade.File) (encryptedSums [][]byte, err error) {
 	if f == nil {
 		return nil, errors.New("provide a file pointer to Get an encrypted chunk")
 	}
+	if f.AesKey == nil && len(f.Chunks) > 0 {
+		return nil, fmt.Errorf("no AES encryption key for file %s", f.Filename)
+	}
 	encryptedSums = make([][]byte, len(f.Chunks))
 	for i, chunk := range f.Chunks {
 		if chunk.Nonce == nil {
@@ -378,14 +570,14 @@ func Decrypt(ciphertext []byte, key *[32]byte) (plaintext []byte, err error) {
 // passes them along the child client.
 func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
 	if f == nil {
-		glog.Errorf("provide a file pointer to Warm encrypted chunks")
+		logging.Errorf("provide a file pointer to Warm encrypted chunks")
 	}
 
 	var encryptedSums [][]byte
 	for _, sum := range chunks {
-		es, err := GetEncryptedSum(sum, f)
+		es, err := s.ChunkSum(sum, f)
 		if err != nil {
-			glog.Errorf("encrypting sum %x: %s", sum, err)
+			logging.Errorf("encrypting sum %x: %s", sum, err)
 		}
 		encryptedSums = append(encryptedSums, es)
 	}
@@ -393,6 +585,12 @@ func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
 	return
 }
 
+// Space returns the space of the child client.  Encryption adds a few bytes
+// to each chunk, which is not accounted for.
+func (s *Drive) Space() (total, free uint64, err error) {
+	return drive.Space(s.client)
+}
+
 // GetConfig returns the config used to initialize this client.
 func (s *Drive) GetConfig() drive.Config {
 	return s.config
@@ -407,3 +605,18 @@ func (s *Drive) Local() bool {
 func (s *Drive) Persistent() bool {
 	return s.client.Persistent()
 }
+
+// Flush flushes the child client.
+func (s *Drive) Flush() error {
+	return drive.Flush(s.client)
+}
+
+// Close closes the child client.
+func (s *Drive) Close() error {
+	return drive.Close(s.client)
+}
+
+// Ping pings the child client.
+func (s *Drive) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx)
+}
@@ -0,0 +1,100 @@
+package encrypt
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/asjoyner/shade"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// nonceIndexes holds a chunkIndex for each of the files most recently passed
+// to GetEncryptedSum, so that finding the nonce of each chunk of a file does
+// not scan its Chunks, which is quadratic over the whole file.  It is keyed
+// by the AesKey of the file, which each file has its own of, so a File
+// decoded again shares the index of its earlier copies, and the cache does
+// not keep Files alive.
+var nonceIndexes = mustNewLRU(256)
+
+func mustNewLRU(size int) *lru.Cache {
+	c, err := lru.New(size)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// chunkIndex maps the sums of the Chunks of a File to the index of the last
+// chunk with each sum, in the first n Chunks.  Chunks appended since are
+// indexed when they are next looked up.  Every hit is checked against the
+// File, and the index is rebuilt from it if the chunk no longer has the sum,
+// so it may be shared by copies of a File, and by its later versions.
+//
+// A chunk changed in place is only detected when the index no longer leads
+// to a chunk with the sum looked up, so a hit may name an earlier chunk than
+// the last with the sum.  Both hold the same content, so that is harmless
+// when reading, but PutChunk must use the nonce of the last chunk, which is
+// the one readers of the stored File will look for; see lastChunkWithSum.
+type chunkIndex struct {
+	mu  sync.Mutex
+	n   int
+	idx map[string]int
+}
+
+// chunkWithSum returns a chunk of f with the given sum, normally the last, or
+// nil if there is none.
+func chunkWithSum(f *shade.File, sha256sum []byte) *shade.Chunk {
+	if len(f.Chunks) == 0 {
+		return nil
+	}
+	if f.AesKey == nil {
+		return lastChunkWithSum(f, sha256sum)
+	}
+	key := string(f.AesKey[:])
+	var ci *chunkIndex
+	if v, ok := nonceIndexes.Get(key); ok {
+		ci = v.(*chunkIndex)
+	} else {
+		ci = &chunkIndex{}
+		nonceIndexes.Add(key, ci)
+	}
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if ci.idx == nil || ci.n > len(f.Chunks) {
+		ci.rebuild(f)
+	}
+	for ; ci.n < len(f.Chunks); ci.n++ {
+		ci.idx[string(f.Chunks[ci.n].Sha256)] = ci.n
+	}
+	i, ok := ci.idx[string(sha256sum)]
+	if ok && bytes.Equal(f.Chunks[i].Sha256, sha256sum) {
+		return &f.Chunks[i]
+	}
+	// The chunk may have been changed in place, or f may be another copy.
+	ci.rebuild(f)
+	if i, ok := ci.idx[string(sha256sum)]; ok {
+		return &f.Chunks[i]
+	}
+	return nil
+}
+
+// rebuild indexes all of the Chunks of f.
+func (ci *chunkIndex) rebuild(f *shade.File) {
+	ci.idx = make(map[string]int, len(f.Chunks))
+	for i, c := range f.Chunks {
+		ci.idx[string(c.Sha256)] = i
+	}
+	ci.n = len(f.Chunks)
+}
+
+// lastChunkWithSum returns the last chunk of f with the given sum, or nil if
+// there is none.  It searches from the end, as writers store each chunk soon
+// after appending it to the File.
+func lastChunkWithSum(f *shade.File, sha256sum []byte) *shade.Chunk {
+	for i := len(f.Chunks) - 1; i >= 0; i-- {
+		if bytes.Equal(f.Chunks[i].Sha256, sha256sum) {
+			return &f.Chunks[i]
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@
 package fail
 
 import (
+	"context"
 	"errors"
 
 	"github.com/asjoyner/shade"
@@ -60,6 +61,11 @@ func (s *Drive) ReleaseChunk(sha256sum []byte) error {
 	return errors.New("fail.Drive does what it says on the tin")
 }
 
+// Stat returns an error, every time.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	return drive.Info{}, errors.New("fail.Drive does what it says on the tin")
+}
+
 // Warm is unnecessary for this client.
 func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
 	return
@@ -76,6 +82,11 @@ func (s *Drive) Local() bool { return s.config.OAuth.ClientID == "" }
 // Persistent returns whether the storage is persistent across task restarts.
 func (s *Drive) Persistent() bool { return s.config.OAuth.ClientID != "" }
 
+// Ping returns an error, every time.
+func (s *Drive) Ping(ctx context.Context) error {
+	return errors.New("fail.Drive does what it says on the tin")
+}
+
 // NewChunkLister returns an iterator which returns an error for every request.
 func (s *Drive) NewChunkLister() drive.ChunkLister {
 	return &ChunkLister{}
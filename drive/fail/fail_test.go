@@ -1,6 +1,7 @@
 package fail
 
 import (
+	"context"
 	"testing"
 
 	"github.com/asjoyner/shade/drive"
@@ -28,3 +29,13 @@ func TestRemoteFail(t *testing.T) {
 		t.Errorf("Fail client with no OAuth config identifies as remote")
 	}
 }
+
+func TestPingFails(t *testing.T) {
+	client, err := NewClient(drive.Config{Provider: "fail"})
+	if err != nil {
+		t.Fatalf("failed to setup fail client... : %s", err)
+	}
+	if err := client.Ping(context.Background()); err == nil {
+		t.Errorf("Fail client Ping() succeeded")
+	}
+}
@@ -0,0 +1,269 @@
+// Package flaky is a test client.  It wraps a single child client, and passes
+// each call through to it, except that calls may fail, be delayed, or return
+// corrupted data, as described by the Faults in its config.
+//
+// The faults are chosen by a random number generator seeded from the config,
+// so a test which makes the same sequence of calls sees the same faults.
+// Unlike "fail", which fails every call, it exercises the code which retries
+// or falls back to another client.
+package flaky
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+)
+
+func init() {
+	drive.RegisterProvider("flaky", NewClient)
+}
+
+// ErrInjected is returned, wrapped with the name of the method, by each call
+// which was chosen to fail.
+var ErrInjected = errors.New("injected failure")
+
+// NewClient returns a Drive client which injects faults into the calls to its
+// only child.
+func NewClient(c drive.Config) (drive.Client, error) {
+	if len(c.Children) != 1 {
+		return nil, errors.New("flaky requires exactly one child")
+	}
+	child, err := drive.NewClient(c.Children[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", c.Children[0].Provider, err)
+	}
+	return Wrap(child, c), nil
+}
+
+// Wrap returns a Drive which injects the faults described by c.Faults into
+// the calls to child.  The rest of c is returned by GetConfig, except that
+// Write is inherited from child.
+func Wrap(child drive.Client, c drive.Config) *Drive {
+	c.Write = child.GetConfig().Write
+	return &Drive{
+		config: c,
+		child:  child,
+		rand:   rand.New(rand.NewSource(c.Faults.Seed)),
+	}
+}
+
+// Drive implements the drive.Client interface by passing each request to its
+// child client, unless a fault is injected.
+type Drive struct {
+	config drive.Config
+	child  drive.Client
+
+	mu   sync.Mutex // protects rand
+	rand *rand.Rand
+}
+
+// fault delays the call to method by the configured latency, and returns an
+// error if the call was chosen to fail.
+func (s *Drive) fault(method string) error {
+	if l := s.config.Faults.LatencySeconds; l > 0 {
+		time.Sleep(time.Duration(l * float64(time.Second)))
+	}
+	rate, ok := s.config.Faults.FailureRates[method]
+	if !ok {
+		rate = s.config.Faults.FailureRates["*"]
+	}
+	if s.chance(rate) {
+		return fmt.Errorf("%s: %w", method, ErrInjected)
+	}
+	return nil
+}
+
+// chance returns true with probability p.
+func (s *Drive) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Float64() < p
+}
+
+// corrupt returns data, or with probability CorruptRate a copy of data with
+// one byte altered.
+func (s *Drive) corrupt(data []byte) []byte {
+	if len(data) == 0 || !s.chance(s.config.Faults.CorruptRate) {
+		return data
+	}
+	s.mu.Lock()
+	i := s.rand.Intn(len(data))
+	s.mu.Unlock()
+	c := make([]byte, len(data))
+	copy(c, data)
+	c[i] ^= 0xff
+	return c
+}
+
+// ListFiles is passed to the child client, unless it fails.
+func (s *Drive) ListFiles() ([][]byte, error) {
+	if err := s.fault("ListFiles"); err != nil {
+		return nil, err
+	}
+	return s.child.ListFiles()
+}
+
+// ListFilesSince is passed to the child client, unless it fails.
+func (s *Drive) ListFilesSince(token string) ([][]byte, string, error) {
+	if err := s.fault("ListFilesSince"); err != nil {
+		return nil, "", err
+	}
+	return drive.ListFilesSince(s.child, token)
+}
+
+// GetFile retrieves the file from the child client, unless it fails, and may
+// corrupt it.
+func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	if err := s.fault("GetFile"); err != nil {
+		return nil, err
+	}
+	f, err := s.child.GetFile(sha256sum)
+	if err != nil {
+		return nil, err
+	}
+	return s.corrupt(f), nil
+}
+
+// PutFile is passed to the child client, unless it fails.
+func (s *Drive) PutFile(sha256sum, f []byte) error {
+	if err := s.fault("PutFile"); err != nil {
+		return err
+	}
+	return s.child.PutFile(sha256sum, f)
+}
+
+// ReleaseFile is passed to the child client, unless it fails.
+func (s *Drive) ReleaseFile(sha256sum []byte) error {
+	if err := s.fault("ReleaseFile"); err != nil {
+		return err
+	}
+	return s.child.ReleaseFile(sha256sum)
+}
+
+// GetChunk retrieves the chunk from the child client, unless it fails, and
+// may corrupt it.
+func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	if err := s.fault("GetChunk"); err != nil {
+		return nil, err
+	}
+	c, err := s.child.GetChunk(sha256sum, f)
+	if err != nil {
+		return nil, err
+	}
+	return s.corrupt(c), nil
+}
+
+// GetChunkRange retrieves part of the chunk from the child client, unless it
+// fails, and may corrupt it.
+func (s *Drive) GetChunkRange(sha256sum []byte, f *shade.File, offset, length int64) ([]byte, error) {
+	if err := s.fault("GetChunkRange"); err != nil {
+		return nil, err
+	}
+	c, err := drive.GetChunkRange(s.child, sha256sum, f, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return s.corrupt(c), nil
+}
+
+// PutChunk is passed to the child client, unless it fails.
+func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
+	if err := s.fault("PutChunk"); err != nil {
+		return err
+	}
+	return s.child.PutChunk(sha256sum, chunk, f)
+}
+
+// ReleaseChunk is passed to the child client, unless it fails.
+func (s *Drive) ReleaseChunk(sha256sum []byte) error {
+	if err := s.fault("ReleaseChunk"); err != nil {
+		return err
+	}
+	return s.child.ReleaseChunk(sha256sum)
+}
+
+// Stat is passed to the child client, unless it fails.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	if err := s.fault("Stat"); err != nil {
+		return drive.Info{}, err
+	}
+	return s.child.Stat(sha256sum)
+}
+
+// Warm is passed to the child client.  It can't fail.
+func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
+	s.child.Warm(chunks, f)
+}
+
+// Space returns the space of the child client, unless it fails.
+func (s *Drive) Space() (total, free uint64, err error) {
+	if err := s.fault("Space"); err != nil {
+		return 0, 0, err
+	}
+	return drive.Space(s.child)
+}
+
+// GetConfig returns the config used to initialize this client.
+func (s *Drive) GetConfig() drive.Config {
+	return s.config
+}
+
+// Local returns whether the child client is local to this machine.
+func (s *Drive) Local() bool { return s.child.Local() }
+
+// Persistent returns whether the child client is persistent.
+func (s *Drive) Persistent() bool { return s.child.Persistent() }
+
+// Flush flushes the child client, unless it fails.
+func (s *Drive) Flush() error {
+	if err := s.fault("Flush"); err != nil {
+		return err
+	}
+	return drive.Flush(s.child)
+}
+
+// Close closes the child client.  It can't fail, so that the child's
+// resources are always released.
+func (s *Drive) Close() error {
+	return drive.Close(s.child)
+}
+
+// Ping pings the child client, unless it fails.
+func (s *Drive) Ping(ctx context.Context) error {
+	if err := s.fault("Ping"); err != nil {
+		return err
+	}
+	return s.child.Ping(ctx)
+}
+
+// NewChunkLister returns the child client's ChunkLister, or if the listing
+// fails, one which returns the error.
+func (s *Drive) NewChunkLister() drive.ChunkLister {
+	if err := s.fault("NewChunkLister"); err != nil {
+		return &ChunkLister{err: err}
+	}
+	return s.child.NewChunkLister()
+}
+
+// ChunkLister returns no chunks, and an error.
+type ChunkLister struct {
+	err error
+}
+
+// Next always returns false, to indicate an error.
+func (c *ChunkLister) Next() bool { return false }
+
+// Sha256 returns nil, because there are no chunks.
+func (c *ChunkLister) Sha256() []byte { return nil }
+
+// Err returns the injected error.
+func (c *ChunkLister) Err() error { return c.err }
@@ -0,0 +1,116 @@
+package flaky
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+func newFlaky(t *testing.T, faults drive.FaultConfig) *Drive {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	return Wrap(mc, drive.Config{Provider: "flaky", Faults: faults})
+}
+
+func TestRoundTrip(t *testing.T) {
+	fc, err := NewClient(drive.Config{
+		Provider: "flaky",
+		Children: []drive.Config{{Provider: "memory", Write: true}},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	drive.TestFileRoundTrip(t, fc, 100)
+	drive.TestChunkRoundTrip(t, fc, 100)
+}
+
+// failures returns which of n calls to GetChunk failed.
+func failures(t *testing.T, d *Drive, n int) []bool {
+	chunk := []byte("a chunk")
+	if err := d.child.PutChunk(shade.Sum(chunk), chunk, nil); err != nil {
+		t.Fatal(err)
+	}
+	var failed []bool
+	for i := 0; i < n; i++ {
+		_, err := d.GetChunk(shade.Sum(chunk), nil)
+		if err != nil && !errors.Is(err, ErrInjected) {
+			t.Fatalf("GetChunk() returned an error which was not injected: %s", err)
+		}
+		failed = append(failed, err != nil)
+	}
+	return failed
+}
+
+// Test that the same seed injects the same failures, and that a different
+// seed does not.
+func TestFailuresAreDeterministic(t *testing.T) {
+	faults := drive.FaultConfig{Seed: 1, FailureRates: map[string]float64{"GetChunk": 0.5}}
+	a := failures(t, newFlaky(t, faults), 100)
+	b := failures(t, newFlaky(t, faults), 100)
+	faults.Seed = 2
+	c := failures(t, newFlaky(t, faults), 100)
+
+	var numFailed int
+	for i := range a {
+		if a[i] {
+			numFailed++
+		}
+		if a[i] != b[i] {
+			t.Fatalf("call %d failed in one client but not the other with the same seed", i)
+		}
+	}
+	if numFailed < 25 || numFailed > 75 {
+		t.Errorf("%d of 100 calls failed, with a failure rate of 0.5", numFailed)
+	}
+	var differ bool
+	for i := range a {
+		differ = differ || a[i] != c[i]
+	}
+	if !differ {
+		t.Error("a different seed injected the same failures")
+	}
+}
+
+func TestFailureRates(t *testing.T) {
+	d := newFlaky(t, drive.FaultConfig{FailureRates: map[string]float64{"*": 1, "Ping": 0}})
+	if err := d.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() with a failure rate of 0 failed: %s", err)
+	}
+	if _, err := d.ListFiles(); !errors.Is(err, ErrInjected) {
+		t.Errorf("ListFiles() with the default failure rate of 1, want ErrInjected, got: %v", err)
+	}
+	l := d.NewChunkLister()
+	if l.Next() || !errors.Is(l.Err(), ErrInjected) {
+		t.Errorf("the ChunkLister with the default failure rate of 1, want ErrInjected, got: %v", l.Err())
+	}
+}
+
+func TestCorruptAndLatency(t *testing.T) {
+	d := newFlaky(t, drive.FaultConfig{CorruptRate: 1, LatencySeconds: 0.01})
+	chunk := []byte("a chunk")
+	if err := d.PutChunk(shade.Sum(chunk), chunk, nil); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	got, err := d.GetChunk(shade.Sum(chunk), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("GetChunk() took %s, want at least 10ms", elapsed)
+	}
+	if len(got) != len(chunk) || bytes.Equal(got, chunk) {
+		t.Errorf("GetChunk() with a corrupt rate of 1, got: %q, want %q with a byte altered", got, chunk)
+	}
+	if stored, _ := d.child.GetChunk(shade.Sum(chunk), nil); !bytes.Equal(stored, chunk) {
+		t.Errorf("the chunk stored in the child was altered: %q", stored)
+	}
+}
@@ -6,6 +6,12 @@ identifiers for directories.  You can find the ID for a directory in the URL
 when viewing the file in the Google Drive web UI.  These can be set to the same
 value, and AppProperties will be used to disambiguate files from chunks
 
+To store Files and Chunks in a shared drive, set SharedDriveID to its id, which
+is also in the URL of the drive in the Google Drive web UI.  Every list is then
+restricted to that drive, rather than including the user's own files and those
+of every shared drive they can access, and new objects are created in its root,
+or in FileParentID and ChunkParentID, which must be folders within it.
+
 To store Files and Chunks as AppData storage, so that they are not visible in
 the Google Drive web UI, set FileParentID and ChunkParentID to 'appDataFolder'.
 You can optionally reduce the scope to only
@@ -32,23 +38,26 @@ import (
 	"expvar"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"strings"
 	"time"
 
-	"github.com/golang/glog"
 	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/oauth2"
 
 	gdrive "google.golang.org/api/drive/v3"
 	"google.golang.org/api/googleapi"
 
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
 
 	"golang.org/x/net/context"
 )
 
 var (
 	listFileReq           = expvar.NewInt("googleListFilesReq")
+	listChangesReq        = expvar.NewInt("googleListChangesReq")
 	getFileReq            = expvar.NewInt("googleGetFileReq")
 	putFileReq            = expvar.NewInt("googlePutFileReq")
 	getChunkReq           = expvar.NewInt("googleGetChunkReq")
@@ -57,6 +66,14 @@ var (
 	duplicateFileError    = expvar.NewInt("googleDuplicateFileError")
 	listError             = expvar.NewInt("googleListError")
 	getChunkDownloadError = expvar.NewInt("googleGetChunkDownloadError")
+	getChunkMismatch      = expvar.NewInt("googleGetChunkMismatch")
+	resumableUploads      = expvar.NewInt("googleResumableUploads")
+
+	// The storage quota, as of the last call to Quota.
+	quotaLimit             = expvar.NewInt("googleQuotaLimit")
+	quotaUsage             = expvar.NewInt("googleQuotaUsage")
+	quotaUsageInDrive      = expvar.NewInt("googleQuotaUsageInDrive")
+	quotaUsageInDriveTrash = expvar.NewInt("googleQuotaUsageInDriveTrash")
 )
 
 func init() {
@@ -84,12 +101,22 @@ type Drive struct {
 	files   *lru.Cache
 }
 
+// requestContext returns the context for a single request to Google Drive,
+// which expires after timeout, unless it is zero.
+func requestContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
 // ListFiles retrieves all of the File objects known to the client, and returns
 // the corresponding sha256sum of the file object.  Those may be passed to
 // GetChunk() to retrieve the corresponding shade.File.
 func (s *Drive) ListFiles() ([][]byte, error) {
 	listFileReq.Add(1)
-	ctx := context.TODO() // TODO(cfunkhouser): Get a meaningful context here.
+	ctx, cancel := requestContext(s.config.Timeout())
+	defer cancel()
 	resp := make([][]byte, 0)
 	// this query is a Google Drive API query string which will return all
 	// shade metadata files, optionally restricted to a FileParentID
@@ -99,12 +126,10 @@ func (s *Drive) ListFiles() ([][]byte, error) {
 	}
 	req := s.service.Files.List()
 	req = req.Context(ctx).Q(q).Fields("files(id, name)")
-	req = req.IncludeTeamDriveItems(true).SupportsTeamDrives(true)
-	req = req.Corpora("user,allTeamDrives")
-	r, err := req.Do()
+	r, err := s.scope(req).Do()
 	if err != nil {
-		glog.Errorf("List(): %v", err)
-		return nil, fmt.Errorf("couldn't retrieve files: %v", err)
+		logging.Errorf("List(): %v", err)
+		return nil, classify(err, fmt.Errorf("couldn't retrieve files: %v", err))
 	}
 	for _, f := range r.Files {
 		// If decoding the name fails, skip the file.
@@ -115,43 +140,119 @@ func (s *Drive) ListFiles() ([][]byte, error) {
 	return resp, nil
 }
 
+// ListFilesSince returns the shade metadata files added since the call which
+// returned token, using the Drive changes feed, and the page token to resume
+// the feed from.  An empty token lists every file, after recording the start
+// of the feed, so that no file is missed between the two.
+func (s *Drive) ListFilesSince(token string) ([][]byte, string, error) {
+	if token == "" {
+		ctx, cancel := requestContext(s.config.Timeout())
+		defer cancel()
+		startReq := s.service.Changes.GetStartPageToken().SupportsTeamDrives(true)
+		if s.config.SharedDriveID != "" {
+			startReq = startReq.DriveId(s.config.SharedDriveID).SupportsAllDrives(true)
+		}
+		start, err := startReq.Context(ctx).Do()
+		if err != nil {
+			return nil, "", classify(err, fmt.Errorf("couldn't retrieve the start of the changes: %v", err))
+		}
+		files, err := s.ListFiles()
+		return files, start.StartPageToken, err
+	}
+	var resp [][]byte
+	for {
+		listChangesReq.Add(1)
+		ctx, cancel := requestContext(s.config.Timeout())
+		req := s.service.Changes.List(token).Context(ctx)
+		req = req.Fields("nextPageToken, newStartPageToken, changes(removed, file(name, parents, appProperties))")
+		req = req.IncludeTeamDriveItems(true).SupportsTeamDrives(true)
+		if s.config.SharedDriveID != "" {
+			req = req.DriveId(s.config.SharedDriveID).IncludeItemsFromAllDrives(true).SupportsAllDrives(true)
+		}
+		r, err := req.Do()
+		cancel()
+		if err != nil {
+			logging.Errorf("Changes.List(): %v", err)
+			return nil, "", classify(err, fmt.Errorf("couldn't retrieve changes: %v", err))
+		}
+		for _, c := range r.Changes {
+			if c.Removed || c.File == nil || c.File.AppProperties["shadeType"] != "file" {
+				continue
+			}
+			if s.config.FileParentID != "" && !hasParent(c.File, s.config.FileParentID) {
+				continue
+			}
+			// If decoding the name fails, skip the file.
+			if b, err := hex.DecodeString(c.File.Name); err == nil {
+				resp = append(resp, b)
+			}
+		}
+		if r.NextPageToken == "" {
+			return resp, r.NewStartPageToken, nil
+		}
+		token = r.NextPageToken
+	}
+}
+
+// hasParent returns whether parent is one of the parents of f.
+func hasParent(f *gdrive.File, parent string) bool {
+	for _, p := range f.Parents {
+		if p == parent {
+			return true
+		}
+	}
+	return false
+}
+
+// scope restricts req to the configured SharedDriveID.  Without one, it
+// includes the user's own files, and those of every shared drive they can
+// access.
+func (s *Drive) scope(req *gdrive.FilesListCall) *gdrive.FilesListCall {
+	req = req.IncludeTeamDriveItems(true).SupportsTeamDrives(true)
+	if s.config.SharedDriveID != "" {
+		return req.Corpora("drive").DriveId(s.config.SharedDriveID).IncludeItemsFromAllDrives(true).SupportsAllDrives(true)
+	}
+	return req.Corpora("user,allTeamDrives")
+}
+
+// parent returns the directory in which to create new objects, given the
+// configured id of one.  If id is empty, new objects are created in the root
+// of the SharedDriveID, if it is configured, and otherwise the root of the
+// user's drive.
+func (s *Drive) parent(id string) string {
+	if id == "" {
+		return s.config.SharedDriveID
+	}
+	return id
+}
+
 // GetFile retrieves a chunk with a given SHA-256 sum.
 func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	defer drive.ObserveLatency("google", "GetFile", time.Now())
 	getFileReq.Add(1)
-	return s.retrieve(sha256sum)
+	return s.retrieve(sha256sum, nil)
 }
 
 // PutFile writes the metadata describing a new file.
 // content should be marshalled JSON, and may be encrypted.
 func (s *Drive) PutFile(sha256sum, content []byte) error {
+	defer drive.ObserveLatency("google", "PutFile", time.Now())
 	putFileReq.Add(1)
-	glog.V(3).Infof("putting file %x", sha256sum)
+	logging.V(3).Infof("putting file %x", sha256sum)
 	if _, err := s.fileBySum(sha256sum); err == nil {
 		return nil
 	}
 	f := &gdrive.File{
 		Name:          hex.EncodeToString(sha256sum),
 		AppProperties: map[string]string{"shadeType": "file"},
-		Properties:    map[string]string{"zb": hex.EncodeToString(content[0:1])},
+		Properties:    s.properties(content),
 	}
-	if s.config.FileParentID != "" {
-		f.Parents = []string{s.config.FileParentID}
+	if parent := s.parent(s.config.FileParentID); parent != "" {
+		f.Parents = []string{parent}
 	}
 
-	// Avoid the Google Drive API dividing the upload into smaller chunks, and
-	// having to detect the content type.
-	opts := []googleapi.MediaOption{
-		googleapi.ChunkSize(0),
-		googleapi.ContentType("application/javascript"),
-	}
-
-	ctx := context.TODO() // TODO(cfunkhouser): Get a meaningful context here.
-	br := bytes.NewReader(content)
-	if _, err := s.service.Files.Create(f).SupportsTeamDrives(true).Context(ctx).Media(br, opts...).Do(); err != nil {
-		glog.Warningf("couldn't create file: %v", err)
-		return fmt.Errorf("couldn't create file: %v", err)
-	}
-	return nil
+	// Avoid the Google Drive API having to detect the content type.
+	return s.create(f, content, googleapi.ContentType("application/javascript"))
 }
 
 // ReleaseFile removes a file from Google Drive.
@@ -159,24 +260,140 @@ func (s *Drive) ReleaseFile(sha256sum []byte) error {
 	if len(sha256sum) == 0 {
 		return nil
 	}
-	glog.V(3).Infof("releasing file %x", sha256sum)
+	logging.V(3).Infof("releasing file %x", sha256sum)
 	f, err := s.fileBySum(sha256sum)
 	if err != nil {
 		return nil // file not found: our work here is done.
 	}
 
-	ctx := context.Background()
+	ctx, cancel := requestContext(s.config.Timeout())
+	defer cancel()
 	if err := s.service.Files.Delete(f.Id).SupportsTeamDrives(true).Context(ctx).Do(); err != nil {
-		glog.Warningf("couldn't delete file: %v", err)
+		logging.Warningf("couldn't delete file: %v", err)
 		return fmt.Errorf("couldn't delete file: %v", err)
 	}
 	return nil
 }
 
-// GetChunk retrieves a chunk with a given SHA-256 sum.
-func (s *Drive) GetChunk(sha256sum []byte, file *shade.File) ([]byte, error) {
+// minRangeBytes is the smallest range a chunk is split into when
+// ParallelRanges is configured, so small chunks are fetched in one request.
+const minRangeBytes = 1 << 20
+
+// GetChunk retrieves a chunk with a given SHA-256 sum.  If ParallelRanges is
+// configured, a large chunk is downloaded as that many concurrent ranges.
+func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	defer drive.ObserveLatency("google", "GetChunk", time.Now())
+	if s.config.ParallelRanges > 1 {
+		file, err := s.fileBySum(sha256sum)
+		if err != nil {
+			return nil, err
+		}
+		parts := s.config.ParallelRanges
+		if max := int(file.Size / minRangeBytes); parts > max {
+			parts = max
+		}
+		if parts > 1 {
+			chunk, err := drive.GetChunkRanges(s, sha256sum, f, file.Size, parts)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkChunk(sha256sum, chunk, file, f); err != nil {
+				logging.Warning(err)
+				return nil, err
+			}
+			return chunk, nil
+		}
+	}
+	getChunkReq.Add(1)
+	return s.retrieve(sha256sum, f)
+}
+
+// GetChunkRange retrieves part of a chunk with a given SHA-256 sum, using an
+// HTTP Range request to download only the requested bytes.
+func (s *Drive) GetChunkRange(sha256sum []byte, f *shade.File, offset, length int64) ([]byte, error) {
 	getChunkReq.Add(1)
-	return s.retrieve(sha256sum)
+	logging.V(3).Infof("Fetching %d bytes at %d of %x", length, offset, sha256sum)
+	file, err := s.fileBySum(sha256sum)
+	if err != nil {
+		return nil, err
+	}
+	if offset >= file.Size || length == 0 {
+		return []byte{}, nil
+	}
+	end := offset + length - 1
+	if end >= file.Size {
+		end = file.Size - 1
+	}
+
+	ctx, cancel := requestContext(s.config.Timeout())
+	defer cancel()
+	// As in retrieve, avoid downloading the first byte if it was recorded as
+	// a property of the file.
+	var zb []byte
+	if offset == 0 {
+		zb = s.zerobyte(file)
+	}
+	chunk, err := readRange(file, offset, end, zb, s.downloader(ctx, file, sha256sum))
+	if err != nil {
+		return nil, err
+	}
+	getChunkSuccess.Add(1)
+	return chunk, nil
+}
+
+// Space returns the storage quota of the account, and the bytes of it which
+// are unused.  Accounts without a quota return drive.ErrUnknownSpace.
+func (s *Drive) Space() (total, free uint64, err error) {
+	q, err := s.Quota()
+	if err != nil {
+		return 0, 0, err
+	}
+	if q.Limit <= 0 {
+		return 0, 0, drive.ErrUnknownSpace
+	}
+	total = uint64(q.Limit)
+	if q.Usage < q.Limit {
+		free = uint64(q.Limit - q.Usage)
+	}
+	return total, free, nil
+}
+
+// Quota returns the storage quota of the user's account, from the Drive about
+// endpoint, and records it in the googleQuota expvars.  A Limit of zero is
+// unlimited.  Drive does not report a quota for each shared drive, so with a
+// SharedDriveID it is still the quota of the account.
+func (s *Drive) Quota() (*gdrive.AboutStorageQuota, error) {
+	ctx, cancel := requestContext(s.config.Timeout())
+	defer cancel()
+	about, err := s.service.About.Get().Fields("storageQuota").Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("could not get storage quota: %v", err)
+	}
+	q := about.StorageQuota
+	if q == nil {
+		q = &gdrive.AboutStorageQuota{}
+	}
+	quotaLimit.Set(q.Limit)
+	quotaUsage.Set(q.Usage)
+	quotaUsageInDrive.Set(q.UsageInDrive)
+	quotaUsageInDriveTrash.Set(q.UsageInDriveTrash)
+	return q, nil
+}
+
+// Stat returns the size and modification time of a file or chunk, from the
+// metadata used to look up its file ID.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	f, err := s.fileBySum(sha256sum)
+	if err != nil {
+		return drive.Info{}, err
+	}
+	info := drive.Info{Size: f.Size}
+	if f.ModifiedTime != "" {
+		if info.ModTime, err = time.Parse(time.RFC3339, f.ModifiedTime); err != nil {
+			return drive.Info{}, fmt.Errorf("parsing modifiedTime of %x: %s", sha256sum, err)
+		}
+	}
+	return info, nil
 }
 
 // ReleaseChunk removes a chunk file from Google Drive.
@@ -184,63 +401,119 @@ func (s *Drive) ReleaseChunk(sha256sum []byte) error {
 	if len(sha256sum) == 0 {
 		return nil
 	}
-	glog.V(3).Infof("releasing chunk %x", sha256sum)
+	logging.V(3).Infof("releasing chunk %x", sha256sum)
 	f, err := s.fileBySum(sha256sum)
 	if err != nil {
 		return nil // file not found: our work here is done.
 	}
 
-	ctx := context.Background()
+	ctx, cancel := requestContext(s.config.Timeout())
+	defer cancel()
 	if err := s.service.Files.Delete(f.Id).SupportsTeamDrives(true).Context(ctx).Do(); err != nil {
-		glog.Warningf("couldn't delete chunk: %v", err)
+		logging.Warningf("couldn't delete chunk: %v", err)
 		return fmt.Errorf("couldn't delete chunk: %v", err)
 	}
 	return nil
 }
 
-// retrieve is the internal implementation that fetches bytes by sha256sum.  It
-// is called by both GetFile and GetChunk.
-func (s *Drive) retrieve(sha256sum []byte) ([]byte, error) {
-	glog.V(3).Infof("Fetching %x", sha256sum)
-	start := time.Now()
-
-	file, err := s.fileBySum(sha256sum)
+// propertyPrefix is prepended to the keys of the properties set by
+// SetProperties, to keep them apart from those used by this client, such as
+// "zb".
+const propertyPrefix = "prop-"
+
+// maxPropertyBytes is the limit Google Drive imposes on the sum of the
+// lengths of the key and value of each property.
+const maxPropertyBytes = 124
+
+// SetProperties sets the given properties of the object, as Drive properties
+// which are visible to other applications.
+func (s *Drive) SetProperties(sha256sum []byte, props map[string]string) error {
+	update := &gdrive.File{Properties: make(map[string]string)}
+	for k, v := range props {
+		if n := len(propertyPrefix) + len(k) + len(v); n > maxPropertyBytes {
+			return fmt.Errorf("property %q is %d bytes long, the limit is %d", k, n-len(propertyPrefix), maxPropertyBytes-len(propertyPrefix))
+		}
+		update.Properties[propertyPrefix+k] = v
+	}
+	f, err := s.fileBySum(sha256sum)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	glog.V(5).Infof("Fetched %x file ID in %v", sha256sum, time.Since(start))
-
-	dlReq := s.service.Files.Get(file.Id).SupportsTeamDrives(true)
+	ctx, cancel := requestContext(s.config.Timeout())
+	defer cancel()
+	if _, err := s.service.Files.Update(f.Id, update).SupportsTeamDrives(true).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("couldn't set the properties of %x: %v", sha256sum, err)
+	}
+	// The cached object no longer has the current properties.
+	s.files.Remove(string(sha256sum))
+	return nil
+}
 
-	zb, err := getZerobyte(file)
+// Properties returns the properties set on the object by SetProperties.
+func (s *Drive) Properties(sha256sum []byte) (map[string]string, error) {
+	f, err := s.fileBySum(sha256sum)
 	if err != nil {
-		glog.Warningf("getZerobyte(%s): %s", file.Name, err)
-	} else {
-		dlReq.Header().Add("Range", fmt.Sprintf("bytes=1-%d", file.Size))
+		return nil, err
+	}
+	props := make(map[string]string)
+	for k, v := range f.Properties {
+		if strings.HasPrefix(k, propertyPrefix) {
+			props[strings.TrimPrefix(k, propertyPrefix)] = v
+		}
 	}
+	return props, nil
+}
 
-	dlResp, err := dlReq.Download()
+// retrieve is the internal implementation that fetches bytes by sha256sum.  It
+// is called by both GetFile and GetChunk.  f is the File a chunk belongs to,
+// or nil; see checkChunk.
+func (s *Drive) retrieve(sha256sum []byte, f *shade.File) ([]byte, error) {
+	logging.V(3).Infof("Fetching %x", sha256sum)
+	start := time.Now()
+
+	file, err := s.fileBySum(sha256sum)
 	if err != nil {
-		getChunkDownloadError.Add(1)
-		glog.Warningf("couldn't download chunk %x: %v", sha256sum, err)
-		return nil, fmt.Errorf("couldn't download chunk %x: %v", sha256sum, err)
+		return nil, err
 	}
-	defer dlResp.Body.Close()
+	logging.V(5).Infof("Fetched %x file ID in %v", sha256sum, time.Since(start))
 
-	chunk, err := ioutil.ReadAll(dlResp.Body)
+	ctx, cancel := requestContext(s.config.Timeout())
+	defer cancel()
+	chunk, err := readRange(file, 0, file.Size-1, s.zerobyte(file), s.downloader(ctx, file, sha256sum))
 	if err != nil {
-		glog.Warningf("couldn't read chunk %x: %v", sha256sum, err)
-		return nil, fmt.Errorf("couldn't read chunk %x: %v", sha256sum, err)
+		return nil, err
 	}
 	getChunkSuccess.Add(1)
-	glog.V(3).Infof("Fetched %x in %v", sha256sum, time.Since(start))
-	if zb != nil {
-		glog.V(5).Infof("Used the zbyte! (%x + %x size: %d of %d)", zb, chunk[0:7], len(chunk), file.Size)
-		chunk = append(zb, chunk...)
+	logging.V(3).Infof("Fetched %x in %v", sha256sum, time.Since(start))
+	if err := checkChunk(sha256sum, chunk, file, f); err != nil {
+		logging.Warning(err)
+		return nil, err
 	}
 	return chunk, nil
 }
 
+// checkChunk ensures a reassembled chunk has the size recorded in its
+// metadata, to detect a stale zerobyte property or size.  If f is provided
+// and has no AesKey, the chunk is unencrypted, so its sha256sum is also
+// verified.  Mismatches are counted by the googleGetChunkMismatch expvar.
+func checkChunk(sha256sum, chunk []byte, file *gdrive.File, f *shade.File) error {
+	if int64(len(chunk)) != file.Size {
+		getChunkMismatch.Add(1)
+		return fmt.Errorf("chunk %x has %d bytes, want: %d", sha256sum, len(chunk), file.Size)
+	}
+	if f != nil && f.AesKey == nil {
+		sum, err := f.Sum(chunk)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(sum, sha256sum) {
+			getChunkMismatch.Add(1)
+			return fmt.Errorf("chunk %x has sha256sum %x", sha256sum, sum)
+		}
+	}
+	return nil
+}
+
 // fileBySum looks up the file object for a given file name (identified by its
 // sha256sum).  The file.Id is a necessary precondition for several API calls,
 // such as Get and Delete.
@@ -248,19 +521,18 @@ func (s *Drive) fileBySum(sha256sum []byte) (*gdrive.File, error) {
 	if f, ok := s.files.Get(string(sha256sum)); ok {
 		return f.(*gdrive.File), nil
 	}
-	ctx := context.TODO() // TODO(cfunkhouser): Get a meaningful context here.
+	ctx, cancel := requestContext(s.config.Timeout())
+	defer cancel()
 	q := fmt.Sprintf("name = '%x'", sha256sum)
 	if s.config.FileParentID != "" {
 		q = fmt.Sprintf("%s and ('%s' in parents OR '%s' in parents)", q, s.config.FileParentID, s.config.ChunkParentID)
 	}
 	req := s.service.Files.List()
-	req = req.Context(ctx).Q(q).Fields("files(id, name, properties, size)")
-	req = req.SupportsTeamDrives(true).IncludeTeamDriveItems(true)
-	req = req.Corpora("user,allTeamDrives")
-	resp, err := req.Do()
+	req = req.Context(ctx).Q(q).Fields("files(id, name, properties, size, modifiedTime)")
+	resp, err := s.scope(req).Do()
 	if err != nil {
 		listError.Add(1)
-		glog.Warningf("metadata request for file %x failed: %v", sha256sum, err)
+		logging.Warningf("metadata request for file %x failed: %v", sha256sum, err)
 		return nil, fmt.Errorf("metadata request for file %x failed: %v", sha256sum, err)
 	}
 	if len(resp.Files) == 0 {
@@ -268,12 +540,37 @@ func (s *Drive) fileBySum(sha256sum []byte) (*gdrive.File, error) {
 	}
 	if len(resp.Files) > 1 {
 		duplicateFileError.Add(1)
-		glog.Warningf("got non-unique chunk result for file %x: %#v", sha256sum, resp.Files)
+		logging.Warningf("got non-unique chunk result for file %x: %#v", sha256sum, resp.Files)
 		return nil, fmt.Errorf("got non-unique chunk result for file %x: %#v", sha256sum, resp.Files)
 	}
 	return resp.Files[0], nil
 }
 
+// properties returns the Properties to store with an object holding
+// content.  Unless NoZerobyte is configured, the first byte of content is
+// recorded as the "zb" property, so that it need not be downloaded.
+func (s *Drive) properties(content []byte) map[string]string {
+	if s.config.NoZerobyte || len(content) == 0 {
+		return nil
+	}
+	return map[string]string{"zb": hex.EncodeToString(content[0:1])}
+}
+
+// zerobyte returns the first byte of file, as recorded in its Properties, or
+// nil if the whole object should be downloaded; because NoZerobyte is
+// configured, or the object was stored without the property.
+func (s *Drive) zerobyte(file *gdrive.File) []byte {
+	if s.config.NoZerobyte {
+		return nil
+	}
+	zb, err := getZerobyte(file)
+	if err != nil {
+		logging.Warningf("getZerobyte(%s): %s", file.Name, err)
+		return nil
+	}
+	return zb
+}
+
 func getZerobyte(file *gdrive.File) ([]byte, error) {
 	if file.Properties == nil {
 		return nil, errors.New("no Properties, so no zerobyte")
@@ -289,40 +586,136 @@ func getZerobyte(file *gdrive.File) ([]byte, error) {
 	return zb, nil
 }
 
+// readRange returns bytes offset to end, inclusive, of file.  They are
+// fetched by download, which is passed an HTTP Range header, or "" to fetch
+// the whole object.  If zb is the first byte of file, it is not downloaded.
+func readRange(file *gdrive.File, offset, end int64, zb []byte, download func(rng string) ([]byte, error)) ([]byte, error) {
+	if offset != 0 || end < 0 || len(zb) != 1 {
+		zb = nil
+	} else {
+		if end == 0 {
+			return zb, nil
+		}
+		offset = 1
+	}
+	var rng string
+	if offset > 0 || end < file.Size-1 {
+		rng = fmt.Sprintf("bytes=%d-%d", offset, end)
+	}
+	chunk, err := download(rng)
+	if err != nil {
+		return nil, err
+	}
+	if zb != nil {
+		logging.V(5).Infof("Used the zbyte! (%x + %d bytes of %d)", zb, len(chunk), file.Size)
+		chunk = append(zb, chunk...)
+	}
+	return chunk, nil
+}
+
+// downloader returns a function to download the bytes of file named by an
+// HTTP Range header, or the whole object if it is "", for readRange.
+func (s *Drive) downloader(ctx context.Context, file *gdrive.File, sha256sum []byte) func(string) ([]byte, error) {
+	return func(rng string) ([]byte, error) {
+		dlReq := s.service.Files.Get(file.Id).SupportsTeamDrives(true).Context(ctx)
+		if rng != "" {
+			dlReq.Header().Add("Range", rng)
+		}
+		dlResp, err := dlReq.Download()
+		if err != nil {
+			getChunkDownloadError.Add(1)
+			logging.Warningf("couldn't download chunk %x: %v", sha256sum, err)
+			ret := fmt.Errorf("couldn't download chunk %x: %v", sha256sum, err)
+			if qe := quotaError(err, ret); qe != nil {
+				return nil, qe
+			}
+			return nil, ret
+		}
+		defer dlResp.Body.Close()
+
+		chunk, err := ioutil.ReadAll(dlResp.Body)
+		if err != nil {
+			logging.Warningf("couldn't read chunk %x: %v", sha256sum, err)
+			return nil, fmt.Errorf("couldn't read chunk %x: %v", sha256sum, err)
+		}
+		return chunk, nil
+	}
+}
+
 // PutChunk writes a chunk and returns its SHA-256 sum
 func (s *Drive) PutChunk(sha256sum, content []byte, f *shade.File) error {
+	defer drive.ObserveLatency("google", "PutChunk", time.Now())
 	if f == nil {
 		return errors.New("google.PutChunk requires an associated File{} object")
 	}
 	putChunkReq.Add(1)
-	glog.V(3).Infof("putting chunk %x", sha256sum)
+	logging.V(3).Infof("putting chunk %x", sha256sum)
 	if _, err := s.fileBySum(sha256sum); err == nil {
 		return nil
 	}
 	df := &gdrive.File{
 		Name:          hex.EncodeToString(sha256sum),
 		AppProperties: map[string]string{"shadeType": "chunk"},
-		Properties:    map[string]string{"zb": hex.EncodeToString(content[0:1])},
+		Properties:    s.properties(content),
 	}
-	if s.config.ChunkParentID != "" {
-		df.Parents = []string{s.config.ChunkParentID}
+	if parent := s.parent(s.config.ChunkParentID); parent != "" {
+		df.Parents = []string{parent}
 	}
 
-	// Avoid the Google Drive API dividing the upload into smaller chunks.
-	opts := []googleapi.MediaOption{googleapi.ChunkSize(0)}
 	// If there is more than one chunk set the content-type explicitly for the
 	// upload.  Even if it is unencrypted and happens to look like a valid
 	// mime-type, it is not a complete file.  It would be preferrable
 	// for Google not try to display it to the user in the web UI.
+	var opts []googleapi.MediaOption
 	if len(f.Chunks) > 1 {
 		opts = append(opts, googleapi.ContentType("application/octet-stream"))
 	}
+	return s.create(df, content, opts...)
+}
+
+// uploadPieceBytes is the largest piece of a resumable upload.  A piece which
+// fails is sent again in full, so smaller pieces waste less of a flaky link,
+// at the cost of a request for each.
+const uploadPieceBytes = 8 << 20
+
+// create uploads content as the new object f.  Objects smaller than
+// ResumableUploadBytes, or all of them if it is zero, are uploaded with a
+// single request, bounded by the configured timeout.  Larger objects are
+// uploaded with the resumable upload protocol, in pieces of at most
+// uploadPieceBytes.  The Google Drive API retries a piece which fails, without
+// sending the earlier pieces again, and the timeout bounds the transfer of
+// each piece rather than the whole upload.
+func (s *Drive) create(f *gdrive.File, content []byte, opts ...googleapi.MediaOption) error {
+	timeout := s.config.Timeout()
+	threshold := s.config.ResumableUploadBytes
+	if threshold > 0 && len(content) >= threshold {
+		piece := threshold
+		if piece > uploadPieceBytes {
+			piece = uploadPieceBytes
+		}
+		resumableUploads.Add(1)
+		opts = append(opts, googleapi.ChunkSize(piece))
+		if timeout > 0 {
+			// Allow each piece a few attempts; the default deadline to retry
+			// a piece, 32 seconds, may be shorter than a single attempt.
+			opts = append(opts, googleapi.ChunkTransferTimeout(timeout), googleapi.ChunkRetryDeadline(3*timeout))
+			timeout = 0
+		}
+	} else {
+		// Avoid the Google Drive API dividing the upload into smaller chunks.
+		opts = append(opts, googleapi.ChunkSize(0))
+	}
 
-	ctx := context.TODO() // TODO(cfunkhouser): Get a meaningful context here.
+	ctx, cancel := requestContext(timeout)
+	defer cancel()
 	br := bytes.NewReader(content)
-	if _, err := s.service.Files.Create(df).SupportsTeamDrives(true).Context(ctx).Media(br, opts...).Do(); err != nil {
-		glog.Warningf("couldn't create file: %v", err)
-		return fmt.Errorf("couldn't create file: %v", err)
+	if _, err := s.service.Files.Create(f).SupportsTeamDrives(true).Context(ctx).Media(br, opts...).Do(); err != nil {
+		logging.Warningf("couldn't create file: %v", err)
+		ret := fmt.Errorf("couldn't create file: %v", err)
+		if qe := quotaError(err, ret); qe != nil {
+			return qe
+		}
+		return ret
 	}
 	return nil
 }
@@ -331,7 +724,7 @@ func (s *Drive) PutChunk(sha256sum, content []byte, f *shade.File) error {
 // latency by batching the request, and avoiding the need to fetch them
 // sequentially while streaming.
 func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
-	glog.V(6).Infof("Warm request for %d chunks of %s", len(chunks), f.Filename)
+	logging.V(6).Infof("Warm request for %d chunks of %s", len(chunks), f.Filename)
 	var files []string
 	for i, c := range chunks {
 		if _, ok := s.files.Get(string(c)); ok {
@@ -346,32 +739,31 @@ func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
 		return // wait until we can batch at least 20 chunk file requests
 	}
 
-	glog.V(6).Infof("Preloading %d chunk files.", len(files))
+	logging.V(6).Infof("Preloading %d chunk files.", len(files))
 	q := strings.Join(files, " or ")
 
 	if s.config.ChunkParentID != "" {
 		q = fmt.Sprintf("%s and ('%s' in parents )", q, s.config.ChunkParentID)
 	}
-	glog.V(6).Info("Query: ", q)
-	ctx := context.Background()
+	logging.V(6).Info("Query: ", q)
+	ctx, cancel := requestContext(s.config.Timeout())
+	defer cancel()
 	req := s.service.Files.List()
 	req = req.Context(ctx).Q(q).Fields("files(id, name, properties, size)")
-	req = req.SupportsTeamDrives(true).IncludeTeamDriveItems(true)
-	req = req.Corpora("user,allTeamDrives")
-	resp, err := req.Do()
+	resp, err := s.scope(req).Do()
 	if err != nil {
 		listError.Add(1)
-		glog.Warningf("Warm failed: %v", err)
+		logging.Warningf("Warm failed: %v", err)
 		return
 	}
-	glog.V(6).Infof("chunks matched: %d", len(resp.Files))
+	logging.V(6).Infof("chunks matched: %d", len(resp.Files))
 	for _, f := range resp.Files {
 		b, err := hex.DecodeString(f.Name)
 		if err != nil {
-			glog.V(6).Infof("Could not decode filename: %s", err)
+			logging.V(6).Infof("Could not decode filename: %s", err)
 			continue
 		}
-		glog.V(6).Infof("Adding %x to the file cache", b)
+		logging.V(6).Infof("Adding %x to the file cache", b)
 		s.files.Add(string(b), f)
 	}
 	return
@@ -388,6 +780,70 @@ func (s *Drive) Local() bool { return false }
 // Persistent returns whether the storage is persistent across task restarts.
 func (s *Drive) Persistent() bool { return true }
 
+// Ping lists at most one file, to verify Drive is reachable and the OAuth
+// token is authorized.
+func (s *Drive) Ping(ctx context.Context) error {
+	req := s.service.Files.List().Context(ctx).PageSize(1).Fields("files(id)")
+	if _, err := req.Do(); err != nil {
+		return classify(err, fmt.Errorf("couldn't list files: %v", err))
+	}
+	return nil
+}
+
+// quotaReasons are the reasons Google Drive gives for refusing a request
+// because a quota of the account is exceeded.  They reset after a delay.
+var quotaReasons = map[string]bool{
+	"dailyLimitExceeded":    true,
+	"downloadQuotaExceeded": true,
+	"quotaExceeded":         true,
+	"storageQuotaExceeded":  true,
+}
+
+// quotaError returns ret wrapped in a drive.QuotaError if err reports that a
+// quota of the account is exceeded, and otherwise nil.
+func quotaError(err, ret error) error {
+	var ge *googleapi.Error
+	if !errors.As(err, &ge) {
+		return nil
+	}
+	for _, e := range ge.Errors {
+		if quotaReasons[e.Reason] {
+			return drive.NewQuotaError("google", ret)
+		}
+	}
+	return nil
+}
+
+// classify returns ret, wrapped in a drive.PermanentError if err indicates
+// an authorization failure which retrying will not resolve.  Rate limiting is
+// also reported with a 403, but is transient.  An exceeded quota is wrapped
+// in a drive.QuotaError instead.
+func classify(err, ret error) error {
+	if qe := quotaError(err, ret); qe != nil {
+		return qe
+	}
+	var re *oauth2.RetrieveError
+	if errors.As(err, &re) {
+		return &drive.PermanentError{Err: ret}
+	}
+	var ge *googleapi.Error
+	if !errors.As(err, &ge) {
+		return ret
+	}
+	switch ge.Code {
+	case http.StatusUnauthorized:
+		return &drive.PermanentError{Err: ret}
+	case http.StatusForbidden:
+		for _, e := range ge.Errors {
+			if strings.HasSuffix(e.Reason, "RateLimitExceeded") {
+				return ret
+			}
+		}
+		return &drive.PermanentError{Err: ret}
+	}
+	return ret
+}
+
 // NewChunkLister returns an iterator which returns all chunks in Google Drive.
 func (s *Drive) NewChunkLister() drive.ChunkLister {
 	q := "appProperties has { key='shadeType' and value='chunk' }"
@@ -395,13 +851,10 @@ func (s *Drive) NewChunkLister() drive.ChunkLister {
 		q = fmt.Sprintf("%s and '%s' in parents", q, s.config.ChunkParentID)
 	}
 
-	ctx := context.Background()
 	req := s.service.Files.List()
-	req = req.Context(ctx).Q(q).Fields("files(id, name), nextPageToken")
-	req = req.IncludeTeamDriveItems(true).SupportsTeamDrives(true)
-	req = req.PageSize(1000).Corpora("user,allTeamDrives")
+	req = s.scope(req.Q(q).Fields("files(id, name), nextPageToken").PageSize(1000))
 
-	c := &ChunkLister{req: req, sums: make([][]byte, 0)}
+	c := &ChunkLister{req: req, sums: make([][]byte, 0), timeout: s.config.Timeout()}
 	c.err = c.fetchNextChunkSums()
 	return c
 }
@@ -413,6 +866,7 @@ type ChunkLister struct {
 	ptr           int
 	nextPageToken string
 	err           error
+	timeout       time.Duration // bounds the request for each page
 }
 
 // Next increments the pointer
@@ -445,10 +899,12 @@ func (c *ChunkLister) Err() error {
 }
 
 func (c *ChunkLister) fetchNextChunkSums() error {
+	ctx, cancel := requestContext(c.timeout)
+	defer cancel()
 	c.req = c.req.PageToken(c.nextPageToken)
-	r, err := c.req.Do()
+	r, err := c.req.Context(ctx).Do()
 	if err != nil {
-		glog.Errorf("List(): %v", err)
+		logging.Errorf("List(): %v", err)
 		return fmt.Errorf("couldn't retrieve files: %v", err)
 	}
 	for _, f := range r.Files {
@@ -0,0 +1,498 @@
+package google
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/oauth2"
+	gdrive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+)
+
+func TestCheckChunk(t *testing.T) {
+	chunk := []byte("Hope is not a strategy.")
+	sum := shade.Sum(chunk)
+	plain := &shade.File{}
+	encrypted := &shade.File{AesKey: shade.NewSymmetricKey()}
+
+	tests := []struct {
+		desc    string
+		chunk   []byte
+		size    int64
+		f       *shade.File
+		wantErr bool
+	}{
+		{"intact chunk", chunk, int64(len(chunk)), plain, false},
+		{"intact file object", chunk, int64(len(chunk)), nil, false},
+		{"stale size", chunk, int64(len(chunk)) + 1, plain, true},
+		// A stale zerobyte property, prepended to the rest of the chunk.
+		{"stale zerobyte", append([]byte("X"), chunk[1:]...), int64(len(chunk)), plain, true},
+		// The sum of an encrypted chunk can not be verified.
+		{"encrypted chunk", append([]byte("X"), chunk[1:]...), int64(len(chunk)), encrypted, false},
+	}
+	for _, tc := range tests {
+		before := getChunkMismatch.Value()
+		err := checkChunk(sum, tc.chunk, &gdrive.File{Size: tc.size}, tc.f)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: want error: %v, got: %v", tc.desc, tc.wantErr, err)
+		}
+		var want int64
+		if tc.wantErr {
+			want = 1
+		}
+		if got := getChunkMismatch.Value() - before; got != want {
+			t.Errorf("%s: googleGetChunkMismatch increased by %d, want: %d", tc.desc, got, want)
+		}
+	}
+}
+
+// fakeObject stores content as the google client would, and returns a
+// download function for readRange which serves it, and counts the bytes
+// downloaded.
+func fakeObject(t *testing.T, s *Drive, content []byte, downloaded *int) (*gdrive.File, func(string) ([]byte, error)) {
+	file := &gdrive.File{Name: "object", Size: int64(len(content)), Properties: s.properties(content)}
+	return file, func(rng string) ([]byte, error) {
+		b := content
+		if rng != "" {
+			var start, end int
+			if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil {
+				t.Fatalf("invalid Range %q: %s", rng, err)
+			}
+			b = content[start : end+1]
+		}
+		*downloaded += len(b)
+		return b, nil
+	}
+}
+
+func TestZerobyte(t *testing.T) {
+	content := []byte("Hope is not a strategy.")
+	size := int64(len(content))
+	for _, noZerobyte := range []bool{false, true} {
+		s := &Drive{config: drive.Config{Provider: "google", NoZerobyte: noZerobyte}}
+		var downloaded int
+		file, download := fakeObject(t, s, content, &downloaded)
+		if got := file.Properties["zb"] != ""; got == noZerobyte {
+			t.Errorf("NoZerobyte %v: recorded a zerobyte: %v", noZerobyte, got)
+		}
+		chunk, err := readRange(file, 0, size-1, s.zerobyte(file), download)
+		if err != nil || !bytes.Equal(chunk, content) {
+			t.Errorf("NoZerobyte %v: want %q, got: %q (%v)", noZerobyte, content, chunk, err)
+		}
+		want := len(content)
+		if !noZerobyte {
+			want--
+		}
+		if downloaded != want {
+			t.Errorf("NoZerobyte %v: downloaded %d bytes, want: %d", noZerobyte, downloaded, want)
+		}
+		for _, r := range [][2]int64{{0, 0}, {0, 4}, {5, 9}, {0, size - 1}} {
+			chunk, err := readRange(file, r[0], r[1], s.zerobyte(file), download)
+			if want := content[r[0] : r[1]+1]; err != nil || !bytes.Equal(chunk, want) {
+				t.Errorf("NoZerobyte %v: bytes %d-%d, want %q, got: %q (%v)", noZerobyte, r[0], r[1], want, chunk, err)
+			}
+		}
+
+		// Objects stored with the other setting remain readable.
+		other := &Drive{config: drive.Config{Provider: "google", NoZerobyte: !noZerobyte}}
+		file, download = fakeObject(t, other, content, &downloaded)
+		chunk, err = readRange(file, 0, size-1, s.zerobyte(file), download)
+		if err != nil || !bytes.Equal(chunk, content) {
+			t.Errorf("NoZerobyte %v: reading an object stored with NoZerobyte %v, want %q, got: %q (%v)", noZerobyte, !noZerobyte, content, chunk, err)
+		}
+	}
+
+	// An empty object has no zerobyte.
+	s := &Drive{config: drive.Config{Provider: "google"}}
+	var downloaded int
+	file, download := fakeObject(t, s, nil, &downloaded)
+	if chunk, err := readRange(file, 0, -1, s.zerobyte(file), download); err != nil || len(chunk) != 0 {
+		t.Errorf("reading an empty object, got: %q (%v)", chunk, err)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err       error
+		permanent bool
+	}{
+		{errors.New("connection reset by peer"), false},
+		{&googleapi.Error{Code: http.StatusInternalServerError}, false},
+		{&googleapi.Error{Code: http.StatusUnauthorized}, true},
+		{&googleapi.Error{Code: http.StatusForbidden}, true},
+		{&googleapi.Error{
+			Code:   http.StatusForbidden,
+			Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}},
+		}, false},
+		{fmt.Errorf("token: %w", &oauth2.RetrieveError{}), true},
+	}
+	for _, tc := range tests {
+		err := classify(tc.err, fmt.Errorf("couldn't list files: %v", tc.err))
+		if got := drive.IsPermanent(err); got != tc.permanent {
+			t.Errorf("classify(%v): want permanent: %v, got: %v", tc.err, tc.permanent, got)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // never respond, until the test is over
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	service, err := gdrive.New(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.BasePath = srv.URL + "/"
+	s := &Drive{service: service, config: drive.Config{Provider: "google", TimeoutSeconds: 0.1}}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.ListFiles()
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("ListFiles() succeeded against a server which never responds")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("ListFiles() did not time out")
+	}
+}
+
+// fakeUploads is a minimal Google Drive server, which accepts uploads of new
+// objects.  The second piece of each resumable upload fails once.
+type fakeUploads struct {
+	mu          sync.Mutex
+	uploadTypes []string // the uploadType of each upload
+	received    []byte   // the content of the last upload
+	sent        int      // the bytes sent in pieces of resumable uploads
+	pieces      int      // the pieces of the current resumable upload
+	failures    int      // the pieces which failed
+}
+
+func (fu *fakeUploads) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fu.mu.Lock()
+	defer fu.mu.Unlock()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/files":
+		fmt.Fprint(w, `{"files": []}`)
+	case r.Method == "POST" && r.URL.Path == "/upload/drive/v3/files":
+		uploadType := r.URL.Query().Get("uploadType")
+		fu.uploadTypes = append(fu.uploadTypes, uploadType)
+		if uploadType == "resumable" {
+			fu.received = nil
+			fu.pieces = 0
+			w.Header().Set("Location", "http://"+r.Host+"/session")
+			return
+		}
+		fu.received = body
+		fmt.Fprint(w, `{"id": "1"}`)
+	case r.Method == "POST" && r.URL.Path == "/session":
+		fu.sent += len(body)
+		if fu.pieces++; fu.pieces == 2 {
+			fu.failures++
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		var first, last int
+		var total string
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%s", &first, &last, &total); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if first != len(fu.received) {
+			http.Error(w, fmt.Sprintf("piece at %d, want %d", first, len(fu.received)), http.StatusBadRequest)
+			return
+		}
+		fu.received = append(fu.received, body...)
+		if total == "*" {
+			w.Header().Set("X-Http-Status-Code-Override", "308")
+			return
+		}
+		fmt.Fprint(w, `{"id": "1"}`)
+	default:
+		http.Error(w, "unexpected request", http.StatusNotFound)
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	const piece = 256 * 1024
+	testCases := []struct {
+		threshold  int
+		size       int
+		uploadType string
+	}{
+		{0, 4*piece + 100, "multipart"},
+		{piece, piece - 1, "multipart"},
+		{piece, 4*piece + 100, "resumable"},
+	}
+	for _, tc := range testCases {
+		fu := &fakeUploads{}
+		srv := httptest.NewServer(fu)
+		service, err := gdrive.New(http.DefaultClient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		service.BasePath = srv.URL + "/"
+		l, err := lru.New(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Drive{service: service, files: l, config: drive.Config{Provider: "google", ResumableUploadBytes: tc.threshold, TimeoutSeconds: 10}}
+
+		content := make([]byte, tc.size)
+		rand.Read(content)
+		if err := s.PutChunk(shade.Sum(content), content, shade.NewFile("big")); err != nil {
+			t.Errorf("PutChunk of %d bytes, with a threshold of %d: %s", tc.size, tc.threshold, err)
+			srv.Close()
+			continue
+		}
+		srv.Close()
+		if len(fu.uploadTypes) != 1 || fu.uploadTypes[0] != tc.uploadType {
+			t.Errorf("%d bytes, with a threshold of %d, got uploads: %v, want one %s upload", tc.size, tc.threshold, fu.uploadTypes, tc.uploadType)
+		}
+		if tc.uploadType != "resumable" {
+			continue
+		}
+		if !bytes.Equal(fu.received, content) {
+			t.Errorf("resumable upload received %d bytes, want the %d bytes uploaded", len(fu.received), len(content))
+		}
+		// Only the piece which failed was sent again.
+		if fu.failures != 1 || fu.sent != len(content)+piece {
+			t.Errorf("resumable upload sent %d bytes after %d failure(s), want %d bytes after 1", fu.sent, fu.failures, len(content)+piece)
+		}
+	}
+}
+
+// TestSharedDrive confirms that each list is restricted to the SharedDriveID,
+// and that new objects are created in it.
+func TestSharedDrive(t *testing.T) {
+	var mu sync.Mutex
+	var lists []url.Values
+	var parents [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/files":
+			lists = append(lists, r.URL.Query())
+			fmt.Fprint(w, `{"files": []}`)
+		case r.Method == "POST" && r.URL.Path == "/upload/drive/v3/files":
+			// The metadata is the first part of the multipart body.
+			_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			part, err := multipart.NewReader(r.Body, params["boundary"]).NextPart()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var f gdrive.File
+			if err := json.NewDecoder(part).Decode(&f); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			parents = append(parents, f.Parents)
+			fmt.Fprint(w, `{"id": "1"}`)
+		case r.Method == "GET" && r.URL.Path == "/about":
+			fmt.Fprint(w, `{"storageQuota": {"limit": "1000", "usage": "400", "usageInDrive": "300", "usageInDriveTrash": "50"}}`)
+		default:
+			http.Error(w, "unexpected request", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	service, err := gdrive.New(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.BasePath = srv.URL + "/"
+	l, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Drive{service: service, files: l, config: drive.Config{Provider: "google", SharedDriveID: "team", ChunkParentID: "chunks"}}
+
+	if _, err := s.ListFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetFile([]byte("file")); err == nil {
+		t.Error("GetFile succeeded for a file which is not in the shared drive")
+	}
+	lister := s.NewChunkLister()
+	for lister.Next() {
+	}
+	if err := lister.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutFile([]byte("file"), []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutChunk([]byte("chunk"), []byte("content"), shade.NewFile("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	// ListFiles, GetFile, NewChunkLister, and the checks for existing objects
+	// by PutFile and PutChunk.
+	if len(lists) != 5 {
+		t.Errorf("want 5 list requests, got: %d", len(lists))
+	}
+	for i, q := range lists {
+		if q.Get("corpora") != "drive" || q.Get("driveId") != "team" || q.Get("includeItemsFromAllDrives") != "true" {
+			t.Errorf("list request %d is not restricted to the shared drive: %v", i, q)
+		}
+	}
+	want := [][]string{{"team"}, {"chunks"}}
+	if !reflect.DeepEqual(parents, want) {
+		t.Errorf("new objects were created in: %v, want: %v", parents, want)
+	}
+	mu.Unlock()
+
+	q, err := s.Quota()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Limit != 1000 || q.Usage != 400 {
+		t.Errorf("Quota() returned %+v, want a limit of 1000 and usage of 400", q)
+	}
+	if quotaUsageInDriveTrash.Value() != 50 {
+		t.Errorf("googleQuotaUsageInDriveTrash, want: 50, got: %d", quotaUsageInDriveTrash.Value())
+	}
+	total, free, err := s.Space()
+	if err != nil || total != 1000 || free != 600 {
+		t.Errorf("Space() = %d, %d, %v, want 1000, 600, nil", total, free, err)
+	}
+}
+
+// TestProperties sets and reads back properties against a fake Drive server
+// which stores the properties of a single object.
+func TestProperties(t *testing.T) {
+	var mu sync.Mutex
+	stored := map[string]string{"zb": "00"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/files":
+			json.NewEncoder(w).Encode(gdrive.FileList{Files: []*gdrive.File{{Id: "1", Name: "abcd", Properties: stored}}})
+		case r.Method == "PATCH" && r.URL.Path == "/files/1":
+			var f gdrive.File
+			if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for k, v := range f.Properties {
+				stored[k] = v
+			}
+			fmt.Fprint(w, `{"id": "1"}`)
+		default:
+			http.Error(w, "unexpected request", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	service, err := gdrive.New(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.BasePath = srv.URL + "/"
+	l, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Drive{service: service, files: l, config: drive.Config{Provider: "google"}}
+	sum := []byte{0xab, 0xcd}
+
+	if err := drive.SetProperties(s, sum, map[string]string{"tag": "weekly", "zb": "ff"}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if stored["zb"] != "00" || stored["prop-zb"] != "ff" {
+		t.Errorf("the properties set clobbered those of the client: %v", stored)
+	}
+	mu.Unlock()
+	got, err := drive.Properties(s, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"tag": "weekly", "zb": "ff"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Properties() = %v, want: %v", got, want)
+	}
+
+	if err := s.SetProperties(sum, map[string]string{"long": strings.Repeat("x", 200)}); err == nil {
+		t.Error("SetProperties accepted a property longer than Drive allows")
+	}
+}
+
+func TestQuotaError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/files":
+			json.NewEncoder(w).Encode(gdrive.FileList{Files: []*gdrive.File{{Id: "1", Name: "abcd", Size: 4}}})
+		case r.Method == "GET" && r.URL.Path == "/files/1":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error": {"code": 403, "message": "The download quota for this file has been exceeded.", "errors": [{"domain": "usageLimits", "reason": "downloadQuotaExceeded"}]}}`)
+		default:
+			http.Error(w, "unexpected request", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	service, err := gdrive.New(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.BasePath = srv.URL + "/"
+	l, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Drive{service: service, files: l, config: drive.Config{Provider: "google"}}
+
+	_, err = s.GetChunk([]byte{0xab, 0xcd}, nil)
+	var qe *drive.QuotaError
+	if !errors.As(err, &qe) || qe.Provider != "google" {
+		t.Fatalf("GetChunk() over quota, want a QuotaError, got: %v", err)
+	}
+
+	quota := &googleapi.Error{
+		Code:   http.StatusForbidden,
+		Errors: []googleapi.ErrorItem{{Reason: "storageQuotaExceeded"}},
+	}
+	err = classify(quota, fmt.Errorf("couldn't list files: %v", quota))
+	if !drive.IsQuotaError(err) || drive.IsPermanent(err) {
+		t.Errorf("classify(%v) = %v, want a QuotaError which is not permanent", quota, err)
+	}
+}
@@ -3,13 +3,13 @@ package google
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
 
 	gdrive "google.golang.org/api/drive/v3"
 
@@ -56,7 +56,9 @@ func GetOAuthClient(c drive.Config) *http.Client {
 	if c.OAuth.TokenPath != "" {
 		tokenPath = c.OAuth.TokenPath
 	}
-	return getClient(context.TODO(), conf)
+	client := getClient(context.TODO(), conf)
+	client.Timeout = c.Timeout()
+	return client
 }
 
 func getClient(ctx context.Context, config *oauth2.Config) *http.Client {
@@ -76,14 +78,14 @@ func fetchToken(config *oauth2.Config) *oauth2.Token {
 	var code string
 	fmt.Print("Enter your authorization code: ")
 	if _, err := fmt.Scan(&code); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)
+		logging.Exitf("Unable to read authorization code %v", err)
 	}
-	log.Printf("\nRead code: %q\n", code)
+	logging.Infof("Read code: %q", code)
 
 	// TODO(cfunkhouser): Get a meaningful context here.
 	tok, err := config.Exchange(context.TODO(), code)
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
+		logging.Exitf("Unable to retrieve token from web %v", err)
 	}
 	return tok
 }
@@ -103,7 +105,7 @@ func saveToken(file string, token *oauth2.Token) {
 	fmt.Printf("Saving credential file to: %s\n", file)
 	f, err := os.Create(file)
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		logging.Exitf("Unable to cache oauth token: %v", err)
 	}
 	defer f.Close()
 	json.NewEncoder(f).Encode(token)
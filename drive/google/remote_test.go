@@ -50,3 +50,13 @@ func TestRelease(t *testing.T) {
 	client := newTestClient(t)
 	drive.TestRelease(t, client, true)
 }
+
+func TestChunkRange(t *testing.T) {
+	client := newTestClient(t)
+	drive.TestChunkRange(t, client)
+}
+
+func TestStat(t *testing.T) {
+	client := newTestClient(t)
+	drive.TestStat(t, client)
+}
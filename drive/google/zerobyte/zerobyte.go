@@ -1,5 +1,6 @@
 // zerobyte iterates all the shade files, reads their first byte, and adds it
-// as a Property of the file.
+// as a Property of the file.  It is optional; objects without the property are
+// downloaded whole, and are always when the config sets NoZerobyte.
 package main
 
 import (
@@ -9,7 +10,6 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"path"
 	"strings"
 	"sync"
@@ -19,7 +19,7 @@ import (
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/config"
 	"github.com/asjoyner/shade/drive/google"
-	"github.com/golang/glog"
+	"github.com/asjoyner/shade/logging"
 )
 
 var (
@@ -39,15 +39,13 @@ func main() {
 	// read in the config
 	cfg, err := config.Read(*configPath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not initialize clients: %s\n", err)
-		os.Exit(1)
+		logging.Exitf("could not initialize clients: %s", err)
 	}
 
 	client := google.GetOAuthClient(cfg)
 	service, err := gdrive.New(client)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "unable to retrieve Google Drive Client: %s\n", err)
-		os.Exit(2)
+		logging.Exitf("unable to retrieve Google Drive Client: %s", err)
 	}
 
 	ctx := context.Background()
@@ -60,7 +58,7 @@ func main() {
 		go func() {
 			for f := range found {
 				if err := fixZeroByte(ctx, service, f); err != nil {
-					glog.Info(err)
+					logging.Info(err)
 				}
 			}
 			wg.Done()
@@ -70,7 +68,7 @@ func main() {
 	// lookup files and pass to goroutines
 	findFiles(ctx, service, found)
 	wg.Wait()
-	glog.Info("Done!")
+	logging.Info("Done!")
 }
 
 // findFiles iteratively downlaods the list of File objects from Google Drive
@@ -90,14 +88,13 @@ func findFiles(ctx context.Context, service *gdrive.Service, found chan *gdrive.
 			q = fmt.Sprintf("%s and not properties has { key='zb' }", q)
 		}
 	*/
-	glog.V(2).Infof("files.list query: %s", q)
+	logging.V(2).Infof("files.list query: %s", q)
 	req := service.Files.List().IncludeTeamDriveItems(true).SupportsTeamDrives(true)
 	req = req.Context(ctx).Q(q).Fields("files(id, name, properties, mimeType), nextPageToken")
 	req = req.PageSize(1000) //.Corpora("user,allTeamDrives")
 	err := req.Pages(ctx, p.handlePage)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "couldn't retrieve file list: %s\n", err)
-		os.Exit(3)
+		logging.Exitf("couldn't retrieve file list: %s", err)
 	}
 	close(found)
 }
@@ -121,16 +118,16 @@ func (p *pages) handlePage(r *gdrive.FileList) error {
 		if f.Properties != nil {
 			if zb, ok := f.Properties["zb"]; ok {
 				if !*refresh {
-					glog.V(2).Infof("Skipping file %s (%s) with zb: %s", f.Name, f.Id, zb)
+					logging.V(2).Infof("Skipping file %s (%s) with zb: %s", f.Name, f.Id, zb)
 					p.skippedFiles++
 					continue
 				}
 			}
 		}
-		glog.V(3).Infof("requesting processing of file: %s (%s)", f.Name, f.Id)
+		logging.V(3).Infof("requesting processing of file: %s (%s)", f.Name, f.Id)
 		p.found <- f
 	}
-	glog.Infof("Processed %d files (%d completed).", p.numFiles, p.skippedFiles)
+	logging.Infof("Processed %d files (%d completed).", p.numFiles, p.skippedFiles)
 	return nil
 }
 
@@ -151,7 +148,7 @@ func fixZeroByte(ctx context.Context, service *gdrive.Service, f *gdrive.File) e
 	if err != nil {
 		return fmt.Errorf("couldn't read file %s (%s): %v", f.Name, f.Id, err)
 	}
-	glog.V(4).Infof("The first byte is: %x\n", halfMagic)
+	logging.V(4).Infof("The first byte is: %x\n", halfMagic)
 
 	// Update file with zb Property
 	u := &gdrive.File{
@@ -162,6 +159,6 @@ func fixZeroByte(ctx context.Context, service *gdrive.Service, f *gdrive.File) e
 		return fmt.Errorf("couldn't update %s (%s): %s", uf.Name, uf.Id, err)
 	}
 
-	glog.Infof("Added zb=%q to %s", uf.Properties["zb"], uf.Name)
+	logging.Infof("Added zb=%q to %s", uf.Properties["zb"], uf.Name)
 	return nil
 }
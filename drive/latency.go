@@ -0,0 +1,113 @@
+package drive
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of each Histogram.
+// Durations longer than the last fall in an unbounded bucket.
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+var (
+	// latency maps "provider.Method" to the *Histogram of the duration of
+	// the calls to that method of that provider.  It is published as the
+	// driveLatency expvar.
+	latency   = expvar.NewMap("driveLatency")
+	latencyMu sync.Mutex // serializes the creation of histograms
+)
+
+// Histogram counts durations in the buckets of LatencyBuckets.  It is an
+// expvar.Var, so it may be published in an expvar.Map.
+type Histogram struct {
+	mu     sync.Mutex
+	counts []uint64 // the count in each bucket, and the unbounded bucket
+	sum    time.Duration
+}
+
+// NewHistogram returns an empty Histogram.
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make([]uint64, len(LatencyBuckets)+1)}
+}
+
+// Observe counts d in its bucket.
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += d
+}
+
+// Snapshot returns the cumulative count of the durations no longer than
+// each of LatencyBuckets, in the same order, the count of all of them, and
+// their sum.
+func (h *Histogram) Snapshot() (buckets []uint64, count uint64, sum time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets = make([]uint64, len(LatencyBuckets))
+	for i := range LatencyBuckets {
+		count += h.counts[i]
+		buckets[i] = count
+	}
+	count += h.counts[len(LatencyBuckets)]
+	return buckets, count, h.sum
+}
+
+// String returns the histogram as JSON, with the cumulative count of each
+// bucket keyed by its upper bound, eg. "250ms".
+func (h *Histogram) String() string {
+	buckets, count, sum := h.Snapshot()
+	v := struct {
+		Count   uint64            `json:"count"`
+		Sum     float64           `json:"sumSeconds"`
+		Buckets map[string]uint64 `json:"buckets"`
+	}{Count: count, Sum: sum.Seconds(), Buckets: make(map[string]uint64)}
+	for i, b := range LatencyBuckets {
+		v.Buckets[b.String()] = buckets[i]
+	}
+	v.Buckets["+Inf"] = count
+	j, _ := json.Marshal(v)
+	return string(j)
+}
+
+// ObserveLatency records the time since start as the duration of a call to
+// method of provider, in the driveLatency expvar.  It is meant to be
+// deferred at the beginning of the method:
+//
+//	defer drive.ObserveLatency("local", "GetChunk", time.Now())
+func ObserveLatency(provider, method string, start time.Time) {
+	d := time.Since(start)
+	key := provider + "." + method
+	h, ok := latency.Get(key).(*Histogram)
+	if !ok {
+		latencyMu.Lock()
+		if h, ok = latency.Get(key).(*Histogram); !ok {
+			h = NewHistogram()
+			latency.Set(key, h)
+		}
+		latencyMu.Unlock()
+	}
+	h.Observe(d)
+}
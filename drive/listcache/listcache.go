@@ -0,0 +1,285 @@
+// Package listcache is a storage backend for Shade which remembers the
+// listings of its child, so that listing a remote client repeatedly is cheap.
+//
+// It wraps a single child client.  The result of ListFiles, and the sums
+// returned by a ChunkLister which was read to the end without error, are
+// reused for ListCacheSeconds from the config.  A PutFile or ReleaseFile
+// through this client discards the cached list of files, and a PutChunk or
+// ReleaseChunk discards the cached list of chunks, so its own writes are
+// always listed.
+//
+// Writes by other clients of the same repository are not listed until the
+// cached list expires.  The cache is kept in memory, so it only helps a
+// process which lists more than once, like shade refreshing its tree.  Do not
+// configure it for the client a cleanup runs against while other processes
+// write, as a stale list of files could lead it to release their chunks.
+package listcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+)
+
+func init() {
+	drive.RegisterProvider("listcache", NewClient)
+}
+
+// NewClient returns a Drive client which caches the listings of its only
+// child.
+func NewClient(c drive.Config) (drive.Client, error) {
+	if len(c.Children) != 1 {
+		return nil, errors.New("listcache requires exactly one child")
+	}
+	child, err := drive.NewClient(c.Children[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", c.Children[0].Provider, err)
+	}
+	c.Write = child.GetConfig().Write
+	return &Drive{config: c, child: child}, nil
+}
+
+// Drive implements the drive.Client interface by passing each request to its
+// child client, and caching the results of ListFiles and NewChunkLister.
+type Drive struct {
+	config drive.Config
+	child  drive.Client
+	files  list
+	chunks list
+}
+
+// list is a cached listing.  gen is incremented each time it is invalidated,
+// so that a listing which began before a write is not cached after it.
+type list struct {
+	mu      sync.Mutex
+	gen     uint64
+	sums    [][]byte
+	fetched time.Time
+	valid   bool
+}
+
+// get returns the cached sums if they are valid and younger than ttl, and
+// otherwise the generation a new listing should be stored with.
+func (l *list) get(ttl time.Duration) ([][]byte, uint64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.valid && time.Since(l.fetched) < ttl {
+		return l.sums, l.gen, true
+	}
+	return nil, l.gen, false
+}
+
+// set caches sums, unless the list was invalidated since gen was returned by
+// get.
+func (l *list) set(gen uint64, sums [][]byte, fetched time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if gen != l.gen {
+		return
+	}
+	l.sums = sums
+	l.fetched = fetched
+	l.valid = true
+}
+
+// invalidate discards the cached sums.
+func (l *list) invalidate() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gen++
+	l.sums = nil
+	l.valid = false
+}
+
+// ttl returns ListCacheSeconds as a time.Duration.
+func (s *Drive) ttl() time.Duration {
+	return time.Duration(s.config.ListCacheSeconds * float64(time.Second))
+}
+
+// ListFiles returns the files of the child client, from the cache if it was
+// listed within the TTL.
+func (s *Drive) ListFiles() ([][]byte, error) {
+	sums, gen, ok := s.files.get(s.ttl())
+	if ok {
+		logging.V(3).Infof("using %d cached file sums", len(sums))
+		return copySums(sums), nil
+	}
+	start := time.Now()
+	sums, err := s.child.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	s.files.set(gen, copySums(sums), start)
+	return sums, nil
+}
+
+// ListFilesSince is passed to the child client, as listing only the changes
+// is already cheap.
+func (s *Drive) ListFilesSince(token string) ([][]byte, string, error) {
+	return drive.ListFilesSince(s.child, token)
+}
+
+// copySums returns a copy of the slice sums, so the caller may modify it
+// without modifying the cache.  The sums themselves are not copied.
+func copySums(sums [][]byte) [][]byte {
+	return append([][]byte(nil), sums...)
+}
+
+// GetFile is passed to the child client.
+func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	return s.child.GetFile(sha256sum)
+}
+
+// PutFile writes the file to the child client, and discards the cached list
+// of files.
+func (s *Drive) PutFile(sha256sum, f []byte) error {
+	defer s.files.invalidate()
+	return s.child.PutFile(sha256sum, f)
+}
+
+// ReleaseFile releases the file from the child client, and discards the
+// cached list of files.
+func (s *Drive) ReleaseFile(sha256sum []byte) error {
+	defer s.files.invalidate()
+	return s.child.ReleaseFile(sha256sum)
+}
+
+// GetChunk is passed to the child client.
+func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	return s.child.GetChunk(sha256sum, f)
+}
+
+// GetChunkRange is passed to the child client.
+func (s *Drive) GetChunkRange(sha256sum []byte, f *shade.File, offset, length int64) ([]byte, error) {
+	return drive.GetChunkRange(s.child, sha256sum, f, offset, length)
+}
+
+// PutChunk writes the chunk to the child client, and discards the cached
+// list of chunks.
+func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
+	defer s.chunks.invalidate()
+	return s.child.PutChunk(sha256sum, chunk, f)
+}
+
+// ReleaseChunk releases the chunk from the child client, and discards the
+// cached list of chunks.
+func (s *Drive) ReleaseChunk(sha256sum []byte) error {
+	defer s.chunks.invalidate()
+	return s.child.ReleaseChunk(sha256sum)
+}
+
+// Stat is passed to the child client.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	return s.child.Stat(sha256sum)
+}
+
+// Warm is passed to the child client.
+func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
+	s.child.Warm(chunks, f)
+}
+
+// Space returns the space of the child client.
+func (s *Drive) Space() (total, free uint64, err error) {
+	return drive.Space(s.child)
+}
+
+// SetProperties sets the properties of an object of the child client.
+func (s *Drive) SetProperties(sha256sum []byte, props map[string]string) error {
+	return drive.SetProperties(s.child, sha256sum, props)
+}
+
+// Properties returns the properties of an object of the child client.
+func (s *Drive) Properties(sha256sum []byte) (map[string]string, error) {
+	return drive.Properties(s.child, sha256sum)
+}
+
+// GetConfig returns the config used to initialize this client.
+func (s *Drive) GetConfig() drive.Config {
+	return s.config
+}
+
+// Local returns whether the child client is local to this machine.
+func (s *Drive) Local() bool { return s.child.Local() }
+
+// Persistent returns whether the child client is persistent.
+func (s *Drive) Persistent() bool { return s.child.Persistent() }
+
+// Flush flushes the child client.
+func (s *Drive) Flush() error { return drive.Flush(s.child) }
+
+// Close closes the child client.
+func (s *Drive) Close() error { return drive.Close(s.child) }
+
+// Ping pings the child client.
+func (s *Drive) Ping(ctx context.Context) error { return s.child.Ping(ctx) }
+
+// NewChunkLister returns a ChunkLister over the cached chunk sums, if the
+// chunks were listed within the TTL.  Otherwise, it returns the child
+// client's ChunkLister, and caches its sums if it is read to the end without
+// error.
+func (s *Drive) NewChunkLister() drive.ChunkLister {
+	sums, gen, ok := s.chunks.get(s.ttl())
+	if ok {
+		logging.V(3).Infof("using %d cached chunk sums", len(sums))
+		return &ChunkLister{sums: sums}
+	}
+	return &recordingLister{
+		ChunkLister: s.child.NewChunkLister(),
+		list:        &s.chunks,
+		gen:         gen,
+		start:       time.Now(),
+	}
+}
+
+// ChunkLister allows iterating the cached chunk sums.
+type ChunkLister struct {
+	sums [][]byte
+	ptr  int
+}
+
+// Next increments the pointer.
+func (c *ChunkLister) Next() bool {
+	c.ptr++
+	return c.ptr <= len(c.sums)
+}
+
+// Sha256 returns the chunk pointed to by the pointer.
+func (c *ChunkLister) Sha256() []byte {
+	if c.ptr > len(c.sums) {
+		return nil
+	}
+	return c.sums[c.ptr-1]
+}
+
+// Err returns precisely no errors.
+func (c *ChunkLister) Err() error {
+	return nil
+}
+
+// recordingLister records the sums returned by the child's ChunkLister, and
+// caches them once it is exhausted.
+type recordingLister struct {
+	drive.ChunkLister
+	list  *list
+	gen   uint64
+	start time.Time
+	sums  [][]byte
+}
+
+// Next advances the child's ChunkLister, and records the sum it returns.
+func (r *recordingLister) Next() bool {
+	if !r.ChunkLister.Next() {
+		if r.ChunkLister.Err() == nil {
+			r.list.set(r.gen, r.sums, r.start)
+		}
+		return false
+	}
+	r.sums = append(r.sums, r.ChunkLister.Sha256())
+	return true
+}
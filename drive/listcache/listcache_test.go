@@ -0,0 +1,141 @@
+package listcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+// countingClient counts the listings requested of a memory client.
+type countingClient struct {
+	drive.Client
+	fileLists  int
+	chunkLists int
+}
+
+func (c *countingClient) ListFiles() ([][]byte, error) {
+	c.fileLists++
+	return c.Client.ListFiles()
+}
+
+func (c *countingClient) NewChunkLister() drive.ChunkLister {
+	c.chunkLists++
+	return c.Client.NewChunkLister()
+}
+
+func newTestDrive(t *testing.T, ttl time.Duration) (*Drive, *countingClient) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	cc := &countingClient{Client: mc}
+	return &Drive{config: drive.Config{ListCacheSeconds: ttl.Seconds()}, child: cc}, cc
+}
+
+func countChunks(t *testing.T, c drive.Client) int {
+	var n int
+	l := c.NewChunkLister()
+	for l.Next() {
+		n++
+	}
+	if err := l.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestRoundTrip(t *testing.T) {
+	lc, err := NewClient(drive.Config{
+		ListCacheSeconds: 60,
+		Children:         []drive.Config{{Provider: "memory", Write: true}},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	drive.TestFileRoundTrip(t, lc, 100)
+	drive.TestChunkRoundTrip(t, lc, 100)
+}
+
+// Test that the child is listed once within the TTL, and again after a write
+// or once the TTL has passed.
+func TestListFilesIsCached(t *testing.T) {
+	d, cc := newTestDrive(t, time.Minute)
+	a := []byte("file a")
+	if err := d.PutFile(shade.Sum(a), a); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		files, err := d.ListFiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Errorf("ListFiles() returned %d files, want 1", len(files))
+		}
+	}
+	if cc.fileLists != 1 {
+		t.Errorf("the child was listed %d times within the TTL, want 1", cc.fileLists)
+	}
+
+	b := []byte("file b")
+	if err := d.PutFile(shade.Sum(b), b); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := d.ListFiles(); len(files) != 2 {
+		t.Errorf("ListFiles() after PutFile returned %d files, want 2", len(files))
+	}
+	if err := d.ReleaseFile(shade.Sum(a)); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := d.ListFiles(); len(files) != 1 {
+		t.Errorf("ListFiles() after ReleaseFile returned %d files, want 1", len(files))
+	}
+	if cc.fileLists != 3 {
+		t.Errorf("the child was listed %d times, want 3", cc.fileLists)
+	}
+
+	d, cc = newTestDrive(t, 0)
+	d.ListFiles()
+	d.ListFiles()
+	if cc.fileLists != 2 {
+		t.Errorf("the child was listed %d times with no TTL, want 2", cc.fileLists)
+	}
+}
+
+func TestChunkListIsCached(t *testing.T) {
+	d, cc := newTestDrive(t, time.Minute)
+	a := []byte("chunk a")
+	if err := d.PutChunk(shade.Sum(a), a, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if n := countChunks(t, d); n != 1 {
+			t.Errorf("the ChunkLister returned %d chunks, want 1", n)
+		}
+	}
+	if cc.chunkLists != 1 {
+		t.Errorf("the child's chunks were listed %d times within the TTL, want 1", cc.chunkLists)
+	}
+
+	// A listing which is not read to the end is not cached.
+	b := []byte("chunk b")
+	if err := d.PutChunk(shade.Sum(b), b, nil); err != nil {
+		t.Fatal(err)
+	}
+	d.NewChunkLister().Next()
+	if n := countChunks(t, d); n != 2 {
+		t.Errorf("the ChunkLister after PutChunk returned %d chunks, want 2", n)
+	}
+	if err := d.ReleaseChunk(shade.Sum(a)); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, d); n != 1 {
+		t.Errorf("the ChunkLister after ReleaseChunk returned %d chunks, want 1", n)
+	}
+	if cc.chunkLists != 4 {
+		t.Errorf("the child's chunks were listed %d times, want 4", cc.chunkLists)
+	}
+}
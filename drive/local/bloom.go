@@ -0,0 +1,53 @@
+package local
+
+import "encoding/binary"
+
+// bloomHashes is the number of bits set in the filter for each sum.
+const bloomHashes = 4
+
+// bloomFilter is a Bloom filter of the sums of the chunks on disk.  It may
+// report that a sum is present when it is not, but never the reverse, so it
+// can answer most "is this chunk new?" questions without a syscall.  It does
+// not support removal; released chunks remain as false positives until the
+// filter is rebuilt at startup.
+type bloomFilter struct {
+	bits []byte
+}
+
+// newBloomFilter returns an empty bloomFilter which uses size bytes of
+// memory.
+func newBloomFilter(size uint64) *bloomFilter {
+	return &bloomFilter{bits: make([]byte, size)}
+}
+
+// positions returns the bit positions for sha256sum.  The sum is already a
+// uniformly distributed hash, so it is used directly, via double hashing.
+func (b *bloomFilter) positions(sha256sum []byte) [bloomHashes]uint64 {
+	var buf [16]byte
+	copy(buf[:], sha256sum)
+	h1 := binary.BigEndian.Uint64(buf[:8])
+	h2 := binary.BigEndian.Uint64(buf[8:]) | 1
+	nbits := uint64(len(b.bits)) * 8
+	var pos [bloomHashes]uint64
+	for i := range pos {
+		pos[i] = (h1 + uint64(i)*h2) % nbits
+	}
+	return pos
+}
+
+// add records that sha256sum is present.
+func (b *bloomFilter) add(sha256sum []byte) {
+	for _, p := range b.positions(sha256sum) {
+		b.bits[p/8] |= 1 << (p % 8)
+	}
+}
+
+// mayContain returns false if sha256sum was never added.
+func (b *bloomFilter) mayContain(sha256sum []byte) bool {
+	for _, p := range b.positions(sha256sum) {
+		if b.bits[p/8]&(1<<(p%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
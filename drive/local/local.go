@@ -6,12 +6,13 @@
 package local
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"sync"
@@ -19,16 +20,25 @@ import (
 
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
-	"github.com/golang/glog"
+	"github.com/asjoyner/shade/logging"
 	"github.com/google/btree"
 )
 
 var (
+	// stat is replaced in tests, to count the calls.
+	stat = os.Stat
+	// freeSpace is replaced in tests, to simulate a full disk.
+	freeSpace = statfs
+
 	localFiles      = expvar.NewInt("localFiles")
 	localChunks     = expvar.NewInt("localChunks")
 	localChunkBytes = expvar.NewInt("localChunkBytes")
 )
 
+// ErrInsufficientSpace is returned by PutFile and PutChunk if the write would
+// leave less than MinFreeBytes free on the filesystem.
+var ErrInsufficientSpace = errors.New("insufficient disk space")
+
 func init() {
 	drive.RegisterProvider("local", NewClient)
 }
@@ -62,51 +72,65 @@ func NewClient(c drive.Config) (drive.Client, error) {
 		chunks: btree.New(2),
 	}
 
-	// Make note of all the filenames in FileParentID
-	files, err := ioutil.ReadDir(c.FileParentID)
+	// Make note of all the filenames in FileParentID.  After this, ListFiles is
+	// answered from s.files, rather than by reading the directory again.
+	files, _, err := scanDir(c.FileParentID)
 	if err != nil {
 		return nil, err
 	}
-	for _, fi := range files {
-		if !fi.IsDir() {
-			sha256sum, err := hex.DecodeString(fi.Name())
-			if err != nil {
-				log.Printf("file with non-hex string value name: %s", fi.Name())
-				continue
-			}
-			s.files.ReplaceOrInsert(Chunk{
-				sum:   sha256sum,
-				mtime: fi.ModTime().Unix(),
-			})
-		}
+	for _, f := range files {
+		s.files.ReplaceOrInsert(f)
 	}
 	localFiles.Set(int64(s.files.Len()))
 
 	// Count the bytes in the local storage
-	chunks, err := ioutil.ReadDir(c.ChunkParentID)
+	chunks, chunkBytes, err := scanDir(c.ChunkParentID)
 	if err != nil {
 		return nil, err
 	}
-	for _, fi := range chunks {
-		if !fi.IsDir() {
-			sha256sum, err := hex.DecodeString(fi.Name())
-			if err != nil {
-				log.Printf("file with non-hex string value name: %s", fi.Name())
-				continue
-			}
-			s.chunks.ReplaceOrInsert(Chunk{
-				sum:   sha256sum,
-				mtime: fi.ModTime().Unix(),
-			})
-			s.chunkBytes += uint64(fi.Size())
+	if c.BloomFilterBytes > 0 {
+		s.bloom = newBloomFilter(c.BloomFilterBytes)
+	}
+	for _, ch := range chunks {
+		s.chunks.ReplaceOrInsert(ch)
+		if s.bloom != nil {
+			s.bloom.add(ch.sum)
 		}
 	}
+	s.chunkBytes = chunkBytes
 	localChunks.Set(int64(s.chunks.Len()))
 	localChunkBytes.Set(int64(s.chunkBytes))
 
 	return s, nil
 }
 
+// scanDir reads the objects stored in dir, and returns them along with their
+// total size in bytes.
+func scanDir(dir string) ([]Chunk, uint64, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	var objects []Chunk
+	var bytes uint64
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		sha256sum, err := hex.DecodeString(fi.Name())
+		if err != nil {
+			logging.Warningf("file with non-hex string value name: %s", fi.Name())
+			continue
+		}
+		objects = append(objects, Chunk{
+			sum:   sha256sum,
+			mtime: fi.ModTime().Unix(),
+		})
+		bytes += uint64(fi.Size())
+	}
+	return objects, bytes, nil
+}
+
 // Drive implements the drive.Client interface by storing Files and Chunks
 // to the local filesystem.  It treats the ChunkParentID and FileParentID as
 // filepaths to the directory to store data in.
@@ -116,6 +140,7 @@ type Drive struct {
 	files        *btree.BTree // for accounting
 	chunks       *btree.BTree // for accounting
 	chunkBytes   uint64       // for accounting
+	bloom        *bloomFilter // if non-nil, chunks which may be on disk
 }
 
 // Chunk describes an object cached to the filesystem, in a way that the btree
@@ -138,11 +163,15 @@ func (a Chunk) Less(bt btree.Item) bool {
 
 // ListFiles retrieves all of the File objects known to the client.  The return
 // values are the sha256sum of the file object.  The keys may be passed to
-// GetChunk() to retrieve the corresponding shade.File.
+// GetFile() to retrieve the corresponding shade.File.
+//
+// The sums are read from the in-memory index of FileParentID, which is kept
+// up to date as files are put and released, so ListFiles does not touch the
+// disk.
 func (s *Drive) ListFiles() ([][]byte, error) {
 	var resp [][]byte
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 	s.files.Ascend(func(item btree.Item) bool {
 		resp = append(resp, item.(Chunk).sum)
 		return true
@@ -150,9 +179,16 @@ func (s *Drive) ListFiles() ([][]byte, error) {
 	return resp, nil
 }
 
-// GetFile retrieves a chunk with a given SHA-256 sum
+// GetFile retrieves a file object with a given SHA-256 sum
 func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
-	return s.GetChunk(sha256sum, nil)
+	defer drive.ObserveLatency("local", "GetFile", time.Now())
+	s.RLock()
+	defer s.RUnlock()
+	filename := path.Join(s.config.FileParentID, hex.EncodeToString(sha256sum))
+	if f, err := ioutil.ReadFile(filename); err == nil {
+		return f, nil
+	}
+	return nil, errors.New("file not found")
 }
 
 // PutFile writes the metadata describing a new file.
@@ -160,6 +196,7 @@ func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
 //
 // TODO(asjoyner): collapse the logic in PutFile and PutChunk into shared code.
 func (s *Drive) PutFile(sha256sum, data []byte) error {
+	defer drive.ObserveLatency("local", "PutFile", time.Now())
 	s.Lock()
 	defer s.Unlock()
 
@@ -169,7 +206,7 @@ func (s *Drive) PutFile(sha256sum, data []byte) error {
 	if fi, err := os.Stat(filename); err == nil {
 		now := time.Now()
 		if err := os.Chtimes(filename, now, now); err != nil {
-			glog.Warningf("updating file mtime: %s", err)
+			logging.Warningf("updating file mtime: %s", err)
 			return fmt.Errorf("could not update mtime: %s", err)
 		}
 		s.files.Delete(Chunk{sum: sha256sum, mtime: fi.ModTime().Unix()})
@@ -179,7 +216,7 @@ func (s *Drive) PutFile(sha256sum, data []byte) error {
 
 	if s.config.MaxFiles > 0 {
 		if err := s.cleanup(true, 1); err != nil {
-			glog.Warningf("file cleanup(): %s", err)
+			logging.Warningf("file cleanup(): %s", err)
 			return err
 		}
 	}
@@ -188,14 +225,17 @@ func (s *Drive) PutFile(sha256sum, data []byte) error {
 		fh.Close()
 		return nil
 	}
+	if err := s.ensureSpace(s.config.FileParentID, uint64(len(data))); err != nil {
+		return err
+	}
 	if err := ioutil.WriteFile(filename, data, 0400); err != nil {
-		glog.Warningf("writing file to cache: %s", err)
+		logging.Warningf("writing file to cache: %s", err)
 		return err
 	}
 
 	fi, err := os.Stat(filename)
 	if err != nil {
-		glog.Warningf("post-write file stat: %s", err)
+		logging.Warningf("post-write file stat: %s", err)
 		return fmt.Errorf("could not stat file after write: %s", err)
 	}
 	s.files.ReplaceOrInsert(Chunk{
@@ -221,19 +261,31 @@ func (s *Drive) ReleaseFile(sha256sum []byte) error {
 		return nil // no such file: our work here is done
 	}
 	s.files.Delete(Chunk{sum: sha256sum, mtime: fi.ModTime().Unix()})
+	localFiles.Set(int64(s.files.Len()))
 	if err := os.Remove(filename); err != nil {
-		glog.Warningf("removed cache entry but not file: %s", err)
+		logging.Warningf("removed cache entry but not file: %s", err)
 		return err
 	}
 	return nil
 }
 
+// chunkDirs returns the directories which may hold the chunk requested for f.
+// Chunks are only stored in ChunkParentID, but callers which pass a nil
+// shade.File may be asking for a file object by its sum, so FileParentID is
+// also searched for them.
+func (s *Drive) chunkDirs(f *shade.File) []string {
+	if f != nil {
+		return []string{s.config.ChunkParentID}
+	}
+	return []string{s.config.ChunkParentID, s.config.FileParentID}
+}
+
 // GetChunk retrieves a chunk with a given SHA-256 sum
 func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	defer drive.ObserveLatency("local", "GetChunk", time.Now())
 	s.RLock()
 	defer s.RUnlock()
-	paths := []string{s.config.FileParentID, s.config.ChunkParentID}
-	for _, p := range paths {
+	for _, p := range s.chunkDirs(f) {
 		filename := path.Join(p, hex.EncodeToString(sha256sum))
 		if f, err := ioutil.ReadFile(filename); err == nil {
 			return f, nil
@@ -242,56 +294,103 @@ func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
 	return nil, errors.New("chunk not found")
 }
 
+// GetChunkRange reads part of a chunk from local disk.
+func (s *Drive) GetChunkRange(sha256sum []byte, f *shade.File, offset, length int64) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, p := range s.chunkDirs(f) {
+		fh, err := os.Open(path.Join(p, hex.EncodeToString(sha256sum)))
+		if err != nil {
+			continue
+		}
+		defer fh.Close()
+		buf := make([]byte, length)
+		n, err := fh.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	return nil, errors.New("chunk not found")
+}
+
 // PutChunk writes a chunk to local disk
 func (s *Drive) PutChunk(sha256sum []byte, data []byte, f *shade.File) error {
+	defer drive.ObserveLatency("local", "PutChunk", time.Now())
 	s.Lock()
 	defer s.Unlock()
 
 	filename := path.Join(s.config.ChunkParentID, hex.EncodeToString(sha256sum))
+	// The Bloom filter definitively answers that most new chunks are not on
+	// disk, without a syscall.
+	mayExist := s.bloom == nil || s.bloom.mayContain(sha256sum)
 
 	// Optimize duplicate push
-	if fi, err := os.Stat(filename); err == nil {
-		now := time.Now()
-		if err := os.Chtimes(filename, now, now); err != nil {
-			glog.Warningf("updating chunk mtime: %s", err)
-			return fmt.Errorf("could not update mtime: %s", err)
+	if mayExist {
+		if fi, err := stat(filename); err == nil {
+			now := time.Now()
+			if err := os.Chtimes(filename, now, now); err != nil {
+				logging.Warningf("updating chunk mtime: %s", err)
+				return fmt.Errorf("could not update mtime: %s", err)
+			}
+			s.chunks.Delete(Chunk{sum: sha256sum, mtime: fi.ModTime().Unix()})
+			s.chunks.ReplaceOrInsert(Chunk{sum: sha256sum, mtime: now.Unix()})
+			return nil
 		}
-		s.chunks.Delete(Chunk{sum: sha256sum, mtime: fi.ModTime().Unix()})
-		s.chunks.ReplaceOrInsert(Chunk{sum: sha256sum, mtime: now.Unix()})
-		return nil
 	}
 
 	if s.config.MaxChunkBytes > 0 {
 		if err := s.cleanup(false, uint64(len(data))); err != nil {
-			glog.Warningf("chunk cleanup(): %s", err)
+			logging.Warningf("chunk cleanup(): %s", err)
 			return err
 		}
 	}
 
-	if fh, err := os.Open(filename); err == nil {
-		fh.Close()
-		return nil
+	if mayExist {
+		if fh, err := os.Open(filename); err == nil {
+			fh.Close()
+			return nil
+		}
+	}
+	if err := s.ensureSpace(s.config.ChunkParentID, uint64(len(data))); err != nil {
+		return err
 	}
 	if err := ioutil.WriteFile(filename, data, 0400); err != nil {
-		glog.Warningf("writing chunk: %s", err)
+		logging.Warningf("writing chunk: %s", err)
 		return err
 	}
 
-	fi, err := os.Stat(filename)
+	fi, err := stat(filename)
 	if err != nil {
-		glog.Warningf("stating chunk after write: %s", err)
+		logging.Warningf("stating chunk after write: %s", err)
 		return fmt.Errorf("could not stat file after write: %s", err)
 	}
 	s.chunks.ReplaceOrInsert(Chunk{
 		sum:   sha256sum,
 		mtime: fi.ModTime().Unix(),
 	})
+	if s.bloom != nil {
+		s.bloom.add(sha256sum)
+	}
 	s.chunkBytes += uint64(len(data))
 	localChunks.Set(int64(s.chunks.Len()))
 	localChunkBytes.Set(int64(s.chunkBytes))
 	return nil
 }
 
+// Stat returns the size and mtime of a file or chunk on local disk.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, p := range []string{s.config.FileParentID, s.config.ChunkParentID} {
+		fi, err := os.Stat(path.Join(p, hex.EncodeToString(sha256sum)))
+		if err == nil {
+			return drive.Info{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+		}
+	}
+	return drive.Info{}, errors.New("chunk not found")
+}
+
 // ReleaseChunk deletes a chunk with a given SHA-256 sum
 func (s *Drive) ReleaseChunk(sha256sum []byte) error {
 	if len(sha256sum) == 0 {
@@ -308,7 +407,7 @@ func (s *Drive) ReleaseChunk(sha256sum []byte) error {
 	}
 	s.chunks.Delete(Chunk{sum: sha256sum, mtime: fi.ModTime().Unix()})
 	if err := os.Remove(filename); err != nil {
-		glog.Warningf("removed cache entry but not file: %s", err)
+		logging.Warningf("removed cache entry but not file: %s", err)
 		return err
 	}
 	s.chunkBytes -= uint64(fi.Size())
@@ -320,6 +419,31 @@ func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
 	return
 }
 
+// Space returns the size of the filesystem holding ChunkParentID, and the
+// bytes available on it.  If MaxChunkBytes is set, it bounds both.
+func (s *Drive) Space() (total, free uint64, err error) {
+	total, free, err = statfs(s.config.ChunkParentID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if max := s.config.MaxChunkBytes; max > 0 {
+		s.RLock()
+		used := s.chunkBytes
+		s.RUnlock()
+		if total > max {
+			total = max
+		}
+		var room uint64
+		if used < max {
+			room = max - used
+		}
+		if free > room {
+			free = room
+		}
+	}
+	return total, free, nil
+}
+
 // GetConfig returns the config used to initialize this client.
 func (s *Drive) GetConfig() drive.Config {
 	return s.config
@@ -331,6 +455,20 @@ func (s *Drive) Local() bool { return true }
 // Persistent returns whether the storage is persistent across task restarts.
 func (s *Drive) Persistent() bool { return true }
 
+// Ping checks that the configured directories still exist.
+func (s *Drive) Ping(ctx context.Context) error {
+	for _, dir := range []string{s.config.FileParentID, s.config.ChunkParentID} {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	return nil
+}
+
 // NewChunkLister returns an iterator which lists the chunks stored on disk.
 func (s *Drive) NewChunkLister() drive.ChunkLister {
 	var sums [][]byte
@@ -368,6 +506,56 @@ func (c *ChunkLister) Err() error {
 	return nil
 }
 
+// ensureSpace returns ErrInsufficientSpace if writing size bytes to dir would
+// leave less than MinFreeBytes free on its filesystem.  If MaxChunkBytes is
+// set, the least recently used chunks are first removed to make room.  It
+// does nothing if MinFreeBytes is not set, or the free space is unknown on
+// this platform.  The caller must hold the write lock.
+func (s *Drive) ensureSpace(dir string, size uint64) error {
+	min := s.config.MinFreeBytes
+	if min == 0 {
+		return nil
+	}
+	_, free, err := freeSpace(dir)
+	if errors.Is(err, drive.ErrUnknownSpace) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checking the free space in %s: %s", dir, err)
+	}
+	if free >= min+size {
+		return nil
+	}
+	if s.config.MaxChunkBytes > 0 {
+		var removed uint64
+		for free+removed < min+size && s.chunks.Len() > 0 {
+			oldest := s.chunks.Min().(Chunk)
+			filename := path.Join(s.config.ChunkParentID, hex.EncodeToString(oldest.sum))
+			fi, err := os.Stat(filename)
+			if err != nil {
+				return err
+			}
+			if err := os.Remove(filename); err != nil {
+				return err
+			}
+			s.chunks.DeleteMin()
+			s.chunkBytes -= uint64(fi.Size())
+			removed += uint64(fi.Size())
+		}
+		localChunks.Set(int64(s.chunks.Len()))
+		localChunkBytes.Set(int64(s.chunkBytes))
+		logging.V(2).Infof("removed %d bytes of chunks to keep %d bytes free", removed, min)
+		if _, free, err = freeSpace(dir); err != nil {
+			return fmt.Errorf("checking the free space in %s: %s", dir, err)
+		}
+		if free >= min+size {
+			return nil
+		}
+	}
+	logging.Warningf("refusing to write %d bytes to %s, which has %d bytes free of the %d to keep free", size, dir, free, min)
+	return fmt.Errorf("%w: writing %d bytes to %s would leave less than the MinFreeBytes of %d free (%d are free)", ErrInsufficientSpace, size, dir, min, free)
+}
+
 // cleanup iterates the provided BTree and removes the oldest entries from the
 // filesystem, in the provided directory, to bring the length below the
 // provided maximum size.  cleanup is called at insert time, so size is Max-1,
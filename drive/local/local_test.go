@@ -1,12 +1,18 @@
 package local
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"strings"
 	"testing"
 
+	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
 )
 
@@ -66,6 +72,40 @@ func TestParallelRoundTrip(t *testing.T) {
 	drive.TestParallelRoundTrip(t, ld, 100)
 }
 
+func TestChunkRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localdiskTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tearDown(dir)
+	ld, err := NewClient(drive.Config{
+		Provider:      "localdisk",
+		FileParentID:  path.Join(dir, "files"),
+		ChunkParentID: path.Join(dir, "chunks"),
+	})
+	if err != nil {
+		t.Fatalf("initializing client: %s", err)
+	}
+	drive.TestChunkRange(t, ld)
+}
+
+func TestStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localdiskTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tearDown(dir)
+	ld, err := NewClient(drive.Config{
+		Provider:      "localdisk",
+		FileParentID:  path.Join(dir, "files"),
+		ChunkParentID: path.Join(dir, "chunks"),
+	})
+	if err != nil {
+		t.Fatalf("initializing client: %s", err)
+	}
+	drive.TestStat(t, ld)
+}
+
 func TestChunkLister(t *testing.T) {
 	dir, err := ioutil.TempDir("", "localdiskTest")
 	if err != nil {
@@ -113,8 +153,368 @@ func TestRelease(t *testing.T) {
 	drive.TestRelease(t, ld, true)
 }
 
+func TestPing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localdiskTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tearDown(dir)
+	ld, err := NewClient(drive.Config{
+		Provider:      "localdisk",
+		FileParentID:  path.Join(dir, "files"),
+		ChunkParentID: path.Join(dir, "chunks"),
+	})
+	if err != nil {
+		t.Fatalf("initializing client: %s", err)
+	}
+	if err := ld.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() failed: %s", err)
+	}
+	if err := os.Remove(path.Join(dir, "chunks")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ld.Ping(context.Background()); err == nil {
+		t.Errorf("Ping() succeeded with a missing directory")
+	}
+}
+
+func TestFilesAndChunksAreSeparate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localdiskTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tearDown(dir)
+	ld, err := NewClient(drive.Config{
+		Provider:      "localdisk",
+		FileParentID:  path.Join(dir, "files"),
+		ChunkParentID: path.Join(dir, "chunks"),
+	})
+	if err != nil {
+		t.Fatalf("initializing client: %s", err)
+	}
+	fileSum, file := drive.RandChunk()
+	if err := ld.PutFile(fileSum, file); err != nil {
+		t.Fatal(err)
+	}
+	chunkSum, chunk := drive.RandChunk()
+	if err := ld.PutChunk(chunkSum, chunk, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ld.GetFile(chunkSum); err == nil {
+		t.Error("GetFile() returned a chunk")
+	}
+	if _, err := ld.GetChunk(fileSum, shade.NewFile("x")); err == nil {
+		t.Error("GetChunk() returned a file object for a shade.File")
+	}
+	// Callers which do not know which they are asking for still find files.
+	if got, err := ld.GetChunk(fileSum, nil); err != nil || string(got) != string(file) {
+		t.Errorf("GetChunk(fileSum, nil): want the file object, got: %v", err)
+	}
+}
+
+func TestListFilesIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localdiskTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tearDown(dir)
+	config := drive.Config{
+		Provider:      "localdisk",
+		FileParentID:  path.Join(dir, "files"),
+		ChunkParentID: path.Join(dir, "chunks"),
+	}
+	ld, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("initializing client: %s", err)
+	}
+	sum, file := drive.RandChunk()
+	if err := ld.PutFile(sum, file); err != nil {
+		t.Fatal(err)
+	}
+	// A new client builds its index from the directory on disk.
+	ld, err = NewClient(config)
+	if err != nil {
+		t.Fatalf("initializing client: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		s, f := drive.RandChunk()
+		if err := ld.PutFile(s, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ld.ReleaseFile(sum); err != nil {
+		t.Fatal(err)
+	}
+
+	indexed, err := ld.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanned, _, err := scanDir(config.FileParentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexed) != 3 || len(scanned) != 3 {
+		t.Fatalf("want 3 files, got %d from ListFiles and %d from the directory", len(indexed), len(scanned))
+	}
+	want := make(map[string]bool)
+	for _, c := range scanned {
+		want[string(c.sum)] = true
+	}
+	for _, sum := range indexed {
+		if !want[string(sum)] {
+			t.Errorf("ListFiles() returned %x, which is not on disk", sum)
+		}
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	var stats int
+	stat = func(name string) (os.FileInfo, error) {
+		stats++
+		return os.Stat(name)
+	}
+	defer func() { stat = os.Stat }()
+
+	putAll := func(bloomBytes uint64, chunks map[string][]byte) int {
+		dir, err := ioutil.TempDir("", "localdiskTest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tearDown(dir)
+		config := drive.Config{
+			Provider:         "localdisk",
+			FileParentID:     path.Join(dir, "files"),
+			ChunkParentID:    path.Join(dir, "chunks"),
+			BloomFilterBytes: bloomBytes,
+		}
+		ld, err := NewClient(config)
+		if err != nil {
+			t.Fatalf("initializing client: %s", err)
+		}
+		stats = 0
+		for sum, chunk := range chunks {
+			if err := ld.PutChunk([]byte(sum), chunk, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		newChunkStats := stats
+
+		// Dedup must still find every chunk, including after a restart, when
+		// the filter is rebuilt from disk.
+		ld, err = NewClient(config)
+		if err != nil {
+			t.Fatalf("initializing client: %s", err)
+		}
+		for sum, chunk := range chunks {
+			if err := ld.PutChunk([]byte(sum), chunk, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := ld.(*Drive).chunks.Len(); got != len(chunks) {
+			t.Errorf("BloomFilterBytes %d: want %d chunks after pushing duplicates, got: %d", bloomBytes, len(chunks), got)
+		}
+		for sum, chunk := range chunks {
+			got, err := ld.GetChunk([]byte(sum), nil)
+			if err != nil || string(got) != string(chunk) {
+				t.Errorf("BloomFilterBytes %d: chunk %x was not stored: %v", bloomBytes, sum, err)
+			}
+		}
+		return newChunkStats
+	}
+
+	chunks := drive.RandChunks(50)
+	without := putAll(0, chunks)
+	with := putAll(1024, chunks)
+	if with >= without {
+		t.Errorf("want fewer stat calls with a Bloom filter: %d with, %d without", with, without)
+	}
+}
+
+func TestBloomFilterNoFalseNegatives(t *testing.T) {
+	b := newBloomFilter(16) // small, to force false positives
+	added := drive.RandChunks(100)
+	for sum := range added {
+		b.add([]byte(sum))
+	}
+	for sum := range added {
+		if !b.mayContain([]byte(sum)) {
+			t.Errorf("mayContain(%x) is false for an added sum", sum)
+		}
+	}
+	if e := newBloomFilter(16); e.mayContain(shade.Sum([]byte("absent"))) {
+		t.Error("an empty filter may contain a sum")
+	}
+}
+
+// BenchmarkListFiles compares reading the files directory, as was done on
+// each call to ListFiles, with answering from the in-memory index.
+func BenchmarkListFiles(b *testing.B) {
+	dir, err := ioutil.TempDir("", "localdiskTest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tearDown(dir)
+	config := drive.Config{
+		Provider:      "localdisk",
+		FileParentID:  path.Join(dir, "files"),
+		ChunkParentID: path.Join(dir, "chunks"),
+	}
+	ld, err := NewClient(config)
+	if err != nil {
+		b.Fatalf("initializing client: %s", err)
+	}
+	for i := 0; i < 1000; i++ {
+		fj := []byte(fmt.Sprintf(`{"Filename": "file%d"}`, i))
+		if err := ld.PutFile(shade.Sum(fj), fj); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, _, err := scanDir(config.FileParentID); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := ld.ListFiles(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
 func tearDown(dir string) {
 	if err := os.RemoveAll(dir); err != nil {
 		log.Printf("Could not clean up: %s", err)
 	}
 }
+
+func TestSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localdiskTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tearDown(dir)
+	config := drive.Config{
+		Provider:      "localdisk",
+		FileParentID:  path.Join(dir, "files"),
+		ChunkParentID: path.Join(dir, "chunks"),
+		Write:         true,
+	}
+	ld, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("initializing client: %s", err)
+	}
+	total, free, err := drive.Space(ld)
+	if err != nil {
+		t.Fatalf("Space(): %s", err)
+	}
+	if total == 0 || free > total {
+		t.Errorf("Space() of the filesystem: want 0 < free <= total, got free %d of %d", free, total)
+	}
+
+	config.MaxChunkBytes = 1000
+	ld, err = NewClient(config)
+	if err != nil {
+		t.Fatalf("initializing client: %s", err)
+	}
+	data := []byte("four hundred bytes of chunk data, more or less......")
+	for len(data) < 400 {
+		data = append(data, data...)
+	}
+	data = data[:400]
+	if err := ld.PutChunk(shade.Sum(data), data, nil); err != nil {
+		t.Fatal(err)
+	}
+	if total, free, err = drive.Space(ld); err != nil {
+		t.Fatalf("Space(): %s", err)
+	}
+	if total != 1000 || free != 600 {
+		t.Errorf("Space() with MaxChunkBytes: want 600 free of 1000, got %d of %d", free, total)
+	}
+}
+
+func TestMinFreeBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localdiskTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tearDown(dir)
+	// The simulated disk holds 2000 bytes, of which the chunks use some.
+	var ld *Drive
+	freeSpace = func(string) (uint64, uint64, error) {
+		return 2000, 2000 - ld.chunkBytes, nil
+	}
+	defer func() { freeSpace = statfs }()
+	config := drive.Config{
+		Provider:      "localdisk",
+		FileParentID:  path.Join(dir, "files"),
+		ChunkParentID: path.Join(dir, "chunks"),
+		MinFreeBytes:  1000,
+		Write:         true,
+	}
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("initializing client: %s", err)
+	}
+	ld = c.(*Drive)
+	chunk := func(b byte) []byte { return bytes.Repeat([]byte{b}, 400) }
+
+	for _, b := range []byte{'a', 'b'} {
+		if err := ld.PutChunk(shade.Sum(chunk(b)), chunk(b), nil); err != nil {
+			t.Fatalf("PutChunk() with enough space: %s", err)
+		}
+	}
+	err = ld.PutChunk(shade.Sum(chunk('c')), chunk('c'), nil)
+	if !errors.Is(err, ErrInsufficientSpace) || !strings.Contains(err.Error(), "insufficient disk space") {
+		t.Errorf("PutChunk() leaving less than MinFreeBytes, want ErrInsufficientSpace, got: %v", err)
+	}
+	if _, err := ld.GetChunk(shade.Sum(chunk('c')), nil); err == nil {
+		t.Error("the refused chunk was written")
+	}
+	ld.chunkBytes = 1600 // simulate the disk filling up
+	if err := ld.PutFile(shade.Sum([]byte("file")), []byte("file")); !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf("PutFile() leaving less than MinFreeBytes, want ErrInsufficientSpace, got: %v", err)
+	}
+	ld.chunkBytes = 800
+
+	// With MaxChunkBytes, the least recently used chunks are removed to make
+	// room.
+	config.MaxChunkBytes = 1 << 20
+	if c, err = NewClient(config); err != nil {
+		t.Fatalf("initializing client: %s", err)
+	}
+	ld = c.(*Drive)
+	if err := ld.PutChunk(shade.Sum(chunk('c')), chunk('c'), nil); err != nil {
+		t.Fatalf("PutChunk() with MaxChunkBytes: %s", err)
+	}
+	if _, err := ld.GetChunk(shade.Sum(chunk('c')), nil); err != nil {
+		t.Errorf("the new chunk was not written: %s", err)
+	}
+	if n := ld.chunks.Len(); n != 2 {
+		t.Errorf("want 2 chunks after making room, got: %d", n)
+	}
+}
+
+func BenchmarkClient(b *testing.B) {
+	dir, err := ioutil.TempDir("", "localdiskTest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tearDown(dir)
+	ld, err := NewClient(drive.Config{
+		Provider:      "localdisk",
+		FileParentID:  path.Join(dir, "files"),
+		ChunkParentID: path.Join(dir, "chunks"),
+		Write:         true,
+	})
+	if err != nil {
+		b.Fatalf("initializing client: %s", err)
+	}
+	drive.BenchmarkClient(b, ld, []int{4 << 10, 256 << 10, 1 << 20})
+}
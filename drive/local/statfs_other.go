@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package local
+
+import "github.com/asjoyner/shade/drive"
+
+// statfs is not implemented on this platform.
+func statfs(dir string) (total, free uint64, err error) {
+	return 0, 0, drive.ErrUnknownSpace
+}
@@ -1,18 +1,28 @@
 // Package memory is an in memory storage backend for Shade.
 //
-// It stores files and chunks transiently in RAM.
-// It respects MaxFiles and MaxChukBytes as an LRU cache, evicting the
-// least-recently-used file or chunk.  Both Gets and Puts are considered
-// "uses", but GetFiles does not update the LRU state of any data.
+// It stores files and chunks transiently in RAM, in two independent LRU
+// caches, each evicting its least-recently-used entry when full:
+//   - files are limited by count: at most MaxFiles file objects are kept,
+//     regardless of their size.  File objects are small, so this is the
+//     simplest useful bound.
+//   - chunks are limited by size: at most MaxChunkBytes bytes of chunks are
+//     kept, regardless of how many chunks that is.
+//
+// GetFile, PutFile, GetChunk and PutChunk are considered "uses", and mark the
+// entry as most-recently-used.  ListFiles and NewChunkLister do not update the
+// LRU state of any data.
 package memory
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"expvar"
 	"fmt"
 	"math"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
@@ -30,7 +40,8 @@ func init() {
 	drive.RegisterProvider("memory", NewClient)
 }
 
-// NewClient returns a Drive client, based on the provided config.
+// NewClient returns a Drive client, based on the provided config.  If MaxFiles
+// or MaxChunkBytes are not set, they default to 50,000 files and 1GB of chunks.
 func NewClient(c drive.Config) (drive.Client, error) {
 	var err error
 	if c.MaxFiles == 0 {
@@ -62,7 +73,11 @@ type Drive struct {
 	chunks     *lru.Cache
 	chunkBytes uint64
 	wg         sync.WaitGroup // blocks on lru eviction of 'chunks' callback
-	wgl        sync.Mutex     // serializes usage of wg
+	wgl        sync.Mutex     // serializes usage of wg, and protects chunkBytes
+
+	am        sync.Mutex // protects added and addedBase
+	added     [][]byte   // the sums passed to PutFile, in order
+	addedBase int        // the number of sums trimmed from the front of added
 }
 
 // ListFiles retrieves all of the File objects known to the client.  The return
@@ -77,8 +92,10 @@ func (s *Drive) ListFiles() ([][]byte, error) {
 	return resp, nil
 }
 
-// GetFile retrieves a file with a given SHA-256 sum
+// GetFile retrieves a file with a given SHA-256 sum, and marks it as
+// most-recently-used.
 func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	defer drive.ObserveLatency("memory", "GetFile", time.Now())
 	if f, ok := s.files.Get(string(sha256sum)); ok {
 		fb := f.([]byte)
 		// make a copy, to ensure the caller can't modify the underlying array
@@ -89,22 +106,57 @@ func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
 	return nil, errors.New("not in memory client")
 }
 
-// PutFile writes the metadata describing a new file.
+// PutFile writes the metadata describing a new file, evicting the
+// least-recently-used file if there are already MaxFiles files.
 // f should be marshalled JSON, and may be encrypted.
 func (s *Drive) PutFile(sha256sum, f []byte) error {
+	defer drive.ObserveLatency("memory", "PutFile", time.Now())
 	s.files.Add(string(sha256sum), f)
 	memoryFiles.Set(int64(s.files.Len()))
+	s.am.Lock()
+	defer s.am.Unlock()
+	s.added = append(s.added, append([]byte(nil), sha256sum...))
+	// Keep the record of added files from outgrowing the files it describes.
+	if max := 2 * int(s.config.MaxFiles); len(s.added) > max {
+		n := len(s.added) - max/2
+		s.added = append([][]byte(nil), s.added[n:]...)
+		s.addedBase += n
+	}
 	return nil
 }
 
+// ListFilesSince returns the files passed to PutFile since the call which
+// returned token, which is the number of files put before it.  If the record
+// of those files has since been trimmed, every file is returned.
+func (s *Drive) ListFilesSince(token string) ([][]byte, string, error) {
+	s.am.Lock()
+	defer s.am.Unlock()
+	next := strconv.Itoa(s.addedBase + len(s.added))
+	if token == "" {
+		files, err := s.ListFiles()
+		return files, next, err
+	}
+	n, err := strconv.Atoi(token)
+	if err != nil || n > s.addedBase+len(s.added) {
+		return nil, "", fmt.Errorf("invalid token %q", token)
+	}
+	if n < s.addedBase {
+		files, err := s.ListFiles()
+		return files, next, err
+	}
+	return append([][]byte(nil), s.added[n-s.addedBase:]...), next, nil
+}
+
 // ReleaseFile removes a file from the memory client.
 func (s *Drive) ReleaseFile(sha256sum []byte) error {
 	s.files.Remove(string(sha256sum))
 	return nil
 }
 
-// GetChunk retrieves a chunk with a given SHA-256 sum
+// GetChunk retrieves a chunk with a given SHA-256 sum, and marks it as
+// most-recently-used.
 func (s *Drive) GetChunk(sha256sum []byte, _ *shade.File) ([]byte, error) {
+	defer drive.ObserveLatency("memory", "GetChunk", time.Now())
 	if c, ok := s.chunks.Get(string(sha256sum)); ok {
 		cb := c.([]byte)
 		// make a copy, to ensure the caller can't modify the underlying array
@@ -115,8 +167,21 @@ func (s *Drive) GetChunk(sha256sum []byte, _ *shade.File) ([]byte, error) {
 	return nil, errors.New("chunk not in memory client")
 }
 
-// PutChunk writes a chunk and returns its SHA-256 sum
+// GetChunkRange retrieves part of a chunk, copying only the requested bytes.
+func (s *Drive) GetChunkRange(sha256sum []byte, _ *shade.File, offset, length int64) ([]byte, error) {
+	if c, ok := s.chunks.Get(string(sha256sum)); ok {
+		cb := drive.SliceRange(c.([]byte), offset, length)
+		retChunk := make([]byte, len(cb))
+		copy(retChunk, cb)
+		return retChunk, nil
+	}
+	return nil, errors.New("chunk not in memory client")
+}
+
+// PutChunk writes a chunk, evicting the least-recently-used chunks until the
+// total size of the chunks is no more than MaxChunkBytes.
 func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, _ *shade.File) error {
+	defer drive.ObserveLatency("memory", "PutChunk", time.Now())
 	/*
 		fmt.Printf("%d: ", s.chunks.Len())
 		for _, k := range s.chunks.Keys() {
@@ -125,17 +190,17 @@ func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, _ *shade.File) error {
 		fmt.Println()
 		fmt.Printf("adding %x\n", sha256sum)
 	*/
+	s.wgl.Lock()
+	defer s.wgl.Unlock()
 	if !s.chunks.Contains(string(sha256sum)) {
 		s.chunkBytes += uint64(len(chunk))
 	}
-	s.wgl.Lock()
 	for s.chunkBytes > s.config.MaxChunkBytes {
 		//fmt.Printf("%d > %d\n", s.chunkBytes, s.config.MaxChunkBytes)
 		s.wg.Add(1)
 		s.chunks.RemoveOldest()
 		s.wg.Wait()
 	}
-	s.wgl.Unlock()
 	//fmt.Printf("adding %x to LRU...\n", sha256sum)
 	s.chunks.Add(string(sha256sum), chunk)
 	memoryChunks.Set(int64(s.chunks.Len()))
@@ -143,16 +208,27 @@ func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, _ *shade.File) error {
 	return nil
 }
 
+// Stat returns the size of a file or chunk.  The memory client does not track
+// modification times.  It does not change the LRU state of the object.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	for _, c := range []*lru.Cache{s.files, s.chunks} {
+		if b, ok := c.Peek(string(sha256sum)); ok {
+			return drive.Info{Size: int64(len(b.([]byte)))}, nil
+		}
+	}
+	return drive.Info{}, errors.New("not in memory client")
+}
+
 // ReleaseChunk removes a chunk from the memory client.
 func (s *Drive) ReleaseChunk(sha256sum []byte) error {
+	s.wgl.Lock()
+	defer s.wgl.Unlock()
 	if !s.chunks.Contains(string(sha256sum)) {
 		return nil
 	}
-	s.wgl.Lock()
 	s.wg.Add(1)
 	s.chunks.Remove(string(sha256sum))
 	s.wg.Wait()
-	s.wgl.Unlock()
 	memoryChunks.Set(int64(s.chunks.Len()))
 	memoryChunkBytes.Set(int64(s.chunkBytes))
 	return nil
@@ -169,6 +245,18 @@ func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
 	return
 }
 
+// Space returns MaxChunkBytes, and the bytes of chunks which can be stored
+// before the least recently used are evicted.
+func (s *Drive) Space() (total, free uint64, err error) {
+	s.wgl.Lock()
+	defer s.wgl.Unlock()
+	total = s.config.MaxChunkBytes
+	if s.chunkBytes < total {
+		free = total - s.chunkBytes
+	}
+	return total, free, nil
+}
+
 // GetConfig returns the config used to initialize this client.
 func (s *Drive) GetConfig() drive.Config {
 	return s.config
@@ -180,6 +268,9 @@ func (s *Drive) Local() bool { return true }
 // Persistent returns whether the storage is persistent across task restarts.
 func (s *Drive) Persistent() bool { return false }
 
+// Ping always succeeds for this client.
+func (s *Drive) Ping(ctx context.Context) error { return nil }
+
 // NewChunkLister allows listing all the chunks in memory.
 func (s *Drive) NewChunkLister() drive.ChunkLister {
 	keys := s.chunks.Keys()
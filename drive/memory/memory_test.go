@@ -56,6 +56,25 @@ func TestChunkLister(t *testing.T) {
 	drive.TestChunkLister(t, mc, 100)
 }
 
+func TestChunkRange(t *testing.T) {
+	mc, err := NewClient(drive.Config{
+		Provider:      "memory",
+		MaxChunkBytes: 100 * 256 * 50,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	drive.TestChunkRange(t, mc)
+}
+
+func TestStat(t *testing.T) {
+	mc, err := NewClient(drive.Config{Provider: "memory"})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	drive.TestStat(t, mc)
+}
+
 func TestRelease(t *testing.T) {
 	mc, err := NewClient(drive.Config{
 		Provider: "memory",
@@ -188,3 +207,109 @@ func TestReturnsAreCopied(t *testing.T) {
 		t.Fatalf("modyfing chunks returned by the client modifies the cache!")
 	}
 }
+
+// TestFileEvictionOrder ensures MaxFiles limits the number of files, and that
+// GetFile, but not ListFiles, protects a file from eviction.
+func TestFileEvictionOrder(t *testing.T) {
+	mc, err := NewClient(drive.Config{Provider: "memory", MaxFiles: 3})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	sums := [][]byte{[]byte("f1"), []byte("f2"), []byte("f3"), []byte("f4")}
+	// a large file, to demonstrate files are not limited by bytes
+	big := make([]byte, 10*1024*1024)
+	for _, sum := range sums[:3] {
+		if err := mc.PutFile(sum, big); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := mc.GetFile(sums[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mc.ListFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.PutFile(sums[3], big); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false, true, true} {
+		_, err := mc.GetFile(sums[i])
+		if got := err == nil; got != want {
+			t.Errorf("file %s present, want: %v, got: %v", sums[i], want, got)
+		}
+	}
+}
+
+// TestChunkEvictionOrder ensures MaxChunkBytes limits the bytes of chunks, and
+// that GetChunk, but not NewChunkLister, protects a chunk from eviction.
+func TestChunkEvictionOrder(t *testing.T) {
+	mc, err := NewClient(drive.Config{Provider: "memory", MaxChunkBytes: 300})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	sums := [][]byte{[]byte("c1"), []byte("c2"), []byte("c3"), []byte("c4")}
+	for _, sum := range sums[:3] {
+		if err := mc.PutChunk(sum, make([]byte, 100), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := mc.GetChunk(sums[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	lister := mc.NewChunkLister()
+	for lister.Next() {
+	}
+	if err := mc.PutChunk(sums[3], make([]byte, 100), nil); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false, true, true} {
+		_, err := mc.GetChunk(sums[i], nil)
+		if got := err == nil; got != want {
+			t.Errorf("chunk %s present, want: %v, got: %v", sums[i], want, got)
+		}
+	}
+
+	// a chunk twice the size displaces two more chunks
+	if err := mc.PutChunk([]byte("c5"), make([]byte, 200), nil); err != nil {
+		t.Fatal(err)
+	}
+	lister = mc.NewChunkLister()
+	var n int
+	for lister.Next() {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("want 2 chunks after putting a large chunk, got: %d", n)
+	}
+}
+
+// The memory client does not store properties, so they are silently ignored.
+func TestPropertiesIgnored(t *testing.T) {
+	mc, err := NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	sum, chunk := drive.RandChunk()
+	if err := mc.PutChunk(sum, chunk, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := drive.SetProperties(mc, sum, map[string]string{"tag": "weekly"}); err != nil {
+		t.Errorf("SetProperties: %s", err)
+	}
+	props, err := drive.Properties(mc, sum)
+	if err != nil || len(props) != 0 {
+		t.Errorf("Properties, want none, got: %v, %v", props, err)
+	}
+}
+
+func BenchmarkClient(b *testing.B) {
+	mc, err := NewClient(drive.Config{
+		Provider:      "memory",
+		Write:         true,
+		MaxChunkBytes: 256 << 20,
+	})
+	if err != nil {
+		b.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	drive.BenchmarkClient(b, mc, []int{4 << 10, 256 << 10, 1 << 20})
+}
@@ -0,0 +1,239 @@
+// Package namespace is a storage backend for Shade which isolates the objects
+// of one repository from those of others sharing the same child, eg. several
+// users storing their chunks in one bucket, or one ChunkParentID.
+//
+// It wraps a single child client.  Every file and chunk is stored at its sum
+// prefixed by a few bytes derived from the configured Namespace.  ListFiles
+// and NewChunkLister only return the objects with that prefix, with the
+// prefix removed, so the maintenance done by umbrella, such as cleanup, never
+// sees, and never releases, the objects of another namespace.
+//
+// The price of isolation is deduplication: a chunk stored by two namespaces
+// is stored twice, once at the sum prefixed by each.  Repositories which
+// trust each other's cleanup may share a child without this client, and
+// store each chunk once.  Objects stored before this client was configured
+// are not in any namespace, so they are no longer visible through it.
+//
+// The prefix is derived from the name of the namespace, not a secret, so
+// namespaces isolate repositories from each other's mistakes, not from each
+// other's users.
+package namespace
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+)
+
+func init() {
+	drive.RegisterProvider("namespace", NewClient)
+}
+
+// prefixLen is the number of bytes prefixed to each sum.  It is long enough
+// that a sum stored outside the namespace is very unlikely to begin with the
+// prefix by chance.
+const prefixLen = 8
+
+// NewClient returns a Drive client which stores the objects of its only
+// child in c.Namespace.
+func NewClient(c drive.Config) (drive.Client, error) {
+	if len(c.Children) != 1 {
+		return nil, errors.New("namespace requires exactly one child")
+	}
+	if c.Namespace == "" {
+		return nil, errors.New("namespace requires a Namespace")
+	}
+	child, err := drive.NewClient(c.Children[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", c.Children[0].Provider, err)
+	}
+	return newDrive(c, child), nil
+}
+
+func newDrive(c drive.Config, child drive.Client) *Drive {
+	c.Write = child.GetConfig().Write
+	return &Drive{config: c, child: child, prefix: Prefix(c.Namespace)}
+}
+
+// Prefix returns the bytes prefixed to the sums of the objects stored in the
+// namespace with the given name.
+func Prefix(namespace string) []byte {
+	sum := sha256.Sum256([]byte("shade namespace\x00" + namespace))
+	return sum[:prefixLen]
+}
+
+// Drive implements the drive.Client interface by storing the objects of its
+// child at prefixed sums.
+type Drive struct {
+	config drive.Config
+	child  drive.Client
+	prefix []byte
+}
+
+// stored returns the sum the object with sha256sum is stored at by the child.
+func (s *Drive) stored(sha256sum []byte) []byte {
+	return append(append(make([]byte, 0, len(s.prefix)+len(sha256sum)), s.prefix...), sha256sum...)
+}
+
+// unprefix returns the sums in stored which are in the namespace, with the
+// prefix removed.
+func (s *Drive) unprefix(stored [][]byte) [][]byte {
+	sums := make([][]byte, 0, len(stored))
+	for _, sum := range stored {
+		if bytes.HasPrefix(sum, s.prefix) {
+			sums = append(sums, sum[len(s.prefix):])
+		}
+	}
+	return sums
+}
+
+// ListFiles returns the files of the child which are in the namespace.
+func (s *Drive) ListFiles() ([][]byte, error) {
+	files, err := s.child.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	return s.unprefix(files), nil
+}
+
+// ListFilesSince returns the files added to the child since token which are
+// in the namespace.
+func (s *Drive) ListFilesSince(token string) ([][]byte, string, error) {
+	files, next, err := drive.ListFilesSince(s.child, token)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.unprefix(files), next, nil
+}
+
+// GetFile retrieves the file from the child.
+func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	return s.child.GetFile(s.stored(sha256sum))
+}
+
+// PutFile writes the file to the child.
+func (s *Drive) PutFile(sha256sum, f []byte) error {
+	return s.child.PutFile(s.stored(sha256sum), f)
+}
+
+// ReleaseFile releases the file from the child.
+func (s *Drive) ReleaseFile(sha256sum []byte) error {
+	return s.child.ReleaseFile(s.stored(sha256sum))
+}
+
+// GetChunk retrieves the chunk from the child.
+func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	return s.child.GetChunk(s.stored(sha256sum), f)
+}
+
+// GetChunkRange retrieves part of the chunk from the child.
+func (s *Drive) GetChunkRange(sha256sum []byte, f *shade.File, offset, length int64) ([]byte, error) {
+	return drive.GetChunkRange(s.child, s.stored(sha256sum), f, offset, length)
+}
+
+// PutChunk writes the chunk to the child.
+func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
+	return s.child.PutChunk(s.stored(sha256sum), chunk, f)
+}
+
+// ReleaseChunk releases the chunk from the child.
+func (s *Drive) ReleaseChunk(sha256sum []byte) error {
+	return s.child.ReleaseChunk(s.stored(sha256sum))
+}
+
+// Stat describes the object from the child.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	return s.child.Stat(s.stored(sha256sum))
+}
+
+// NewChunkLister returns an iterator which returns the chunks of the child
+// which are in the namespace.
+func (s *Drive) NewChunkLister() drive.ChunkLister {
+	return &ChunkLister{lister: s.child.NewChunkLister(), prefix: s.prefix}
+}
+
+// ChunkLister iterates the chunks of the child, skipping those outside the
+// namespace.
+type ChunkLister struct {
+	lister drive.ChunkLister
+	prefix []byte
+}
+
+// Next advances the iterator to the next chunk in the namespace.
+func (c *ChunkLister) Next() bool {
+	for c.lister.Next() {
+		if bytes.HasPrefix(c.lister.Sha256(), c.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sha256 returns the current chunk sum, without the prefix.
+func (c *ChunkLister) Sha256() []byte {
+	return c.lister.Sha256()[len(c.prefix):]
+}
+
+// Err returns the error encountered by the child, if any.
+func (c *ChunkLister) Err() error {
+	return c.lister.Err()
+}
+
+// Warm is passed to the child.
+func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
+	stored := make([][]byte, len(chunks))
+	for i, sum := range chunks {
+		stored[i] = s.stored(sum)
+	}
+	s.child.Warm(stored, f)
+}
+
+// Space returns the space of the child, which is shared by every namespace.
+func (s *Drive) Space() (total, free uint64, err error) {
+	return drive.Space(s.child)
+}
+
+// SetProperties sets the properties of an object of the child.
+func (s *Drive) SetProperties(sha256sum []byte, props map[string]string) error {
+	return drive.SetProperties(s.child, s.stored(sha256sum), props)
+}
+
+// Properties returns the properties of an object of the child.
+func (s *Drive) Properties(sha256sum []byte) (map[string]string, error) {
+	return drive.Properties(s.child, s.stored(sha256sum))
+}
+
+// GetConfig returns the config used to initialize this client.
+func (s *Drive) GetConfig() drive.Config {
+	return s.config
+}
+
+// Local returns whether the child is local.
+func (s *Drive) Local() bool {
+	return s.child.Local()
+}
+
+// Persistent returns whether the child is persistent.
+func (s *Drive) Persistent() bool {
+	return s.child.Persistent()
+}
+
+// Ping pings the child.
+func (s *Drive) Ping(ctx context.Context) error {
+	return s.child.Ping(ctx)
+}
+
+// Flush flushes the child.
+func (s *Drive) Flush() error {
+	return drive.Flush(s.child)
+}
+
+// Close closes the child.
+func (s *Drive) Close() error {
+	return drive.Close(s.child)
+}
@@ -0,0 +1,93 @@
+package namespace
+
+import (
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+	"github.com/asjoyner/shade/umbrella"
+)
+
+func newSharedClient(t *testing.T) drive.Client {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mc
+}
+
+func TestRoundTrip(t *testing.T) {
+	d := newDrive(drive.Config{Provider: "namespace", Namespace: "alice"}, newSharedClient(t))
+	drive.TestFileRoundTrip(t, d, 100)
+	drive.TestChunkRoundTrip(t, d, 100)
+	drive.TestChunkLister(t, d, 100)
+	drive.TestRelease(t, d, true)
+}
+
+// putFile stores a file with a single chunk, with the given content, in c.
+func putFile(t *testing.T, c drive.Client, filename string, content []byte) []byte {
+	f := shade.NewFile(filename)
+	chunk := shade.NewChunk()
+	chunk.Sha256 = shade.Sum(content)
+	f.Chunks = []shade.Chunk{chunk}
+	f.LastChunksize = len(content)
+	f.UpdateFilesize()
+	if err := c.PutChunk(chunk.Sha256, content, f); err != nil {
+		t.Fatal(err)
+	}
+	fj, err := f.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutFile(shade.Sum(fj), fj); err != nil {
+		t.Fatal(err)
+	}
+	return chunk.Sha256
+}
+
+// TestCleanupIsIsolated stores a file in each of two namespaces of one
+// backend, and checks that cleaning up one does not release the chunks of
+// the other, which it can not see.
+func TestCleanupIsIsolated(t *testing.T) {
+	mc := newSharedClient(t)
+	alice := newDrive(drive.Config{Provider: "namespace", Namespace: "alice"}, mc)
+	bob := newDrive(drive.Config{Provider: "namespace", Namespace: "bob"}, mc)
+
+	putFile(t, alice, "a", []byte("alice's file"))
+	bobSum := putFile(t, bob, "b", []byte("bob's file"))
+	sharedSum := putFile(t, bob, "shared", []byte("a file they both have"))
+	putFile(t, alice, "shared", []byte("a file they both have"))
+	// A chunk no file of alice's references, which cleanup should release.
+	orphan := []byte("an orphaned chunk")
+	orphanSum := shade.Sum(orphan)
+	if err := alice.PutChunk(orphanSum, orphan, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := alice.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("alice sees %d files, want 2", len(files))
+	}
+
+	if err := umbrella.Cleanup(alice); err != nil {
+		t.Fatalf("Cleanup(): %s", err)
+	}
+	if _, err := alice.GetChunk(orphanSum, nil); err == nil {
+		t.Error("the orphaned chunk in alice's namespace was not released")
+	}
+	for _, sum := range [][]byte{bobSum, sharedSum} {
+		if _, err := bob.GetChunk(sum, nil); err != nil {
+			t.Errorf("cleanup of alice's namespace released bob's chunk %x: %s", sum, err)
+		}
+	}
+	if _, err := alice.GetChunk(sharedSum, nil); err != nil {
+		t.Errorf("cleanup released alice's copy of a chunk in use: %s", err)
+	}
+	if _, err := mc.GetChunk(bobSum, nil); err == nil {
+		t.Error("bob's chunk is visible outside his namespace")
+	}
+}
@@ -0,0 +1,257 @@
+// Package overlay is a storage backend for Shade which layers a private,
+// writable client over one or more shared, read-only clients, in the style of
+// overlayfs.
+//
+// The first of the configured Children is the upper client.  All writes and
+// releases go only to it.  The other children are the lower clients, which are
+// only ever read from, regardless of their Write setting.  Reads are served by
+// the upper client if it has the object, and otherwise by the first lower
+// client which does.  ListFiles and NewChunkLister return the union of all of
+// the children.
+//
+// Nb: releasing an object which is stored in a lower client does not hide it,
+// as there is no equivalent of an overlayfs whiteout.  To delete a file, write
+// a newer shade.File with Deleted set, as fusefs does.
+package overlay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+)
+
+func init() {
+	drive.RegisterProvider("overlay", NewClient)
+}
+
+// NewClient returns a Drive client which writes to the first of the
+// configured Children, and reads from all of them.
+func NewClient(c drive.Config) (drive.Client, error) {
+	if len(c.Children) < 2 {
+		return nil, errors.New("overlay requires an upper child and at least one lower child")
+	}
+	var clients []drive.Client
+	for _, conf := range c.Children {
+		child, err := drive.NewClient(conf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", conf.Provider, err)
+		}
+		clients = append(clients, child)
+	}
+	return newDrive(c, clients[0], clients[1:]), nil
+}
+
+func newDrive(c drive.Config, upper drive.Client, lower []drive.Client) *Drive {
+	c.Write = upper.GetConfig().Write
+	return &Drive{config: c, upper: upper, lower: lower}
+}
+
+// Drive implements the drive.Client interface by writing to an upper client,
+// and reading from it and the lower clients.
+type Drive struct {
+	config drive.Config
+	upper  drive.Client
+	lower  []drive.Client
+}
+
+// clients returns the upper client, followed by the lower clients.
+func (s *Drive) clients() []drive.Client {
+	return append([]drive.Client{s.upper}, s.lower...)
+}
+
+// ListFiles returns the union of the files known to all the children.  An
+// error is returned if any of them fails, rather than an incomplete list.
+func (s *Drive) ListFiles() ([][]byte, error) {
+	seen := make(map[string]bool)
+	var resp [][]byte
+	for _, client := range s.clients() {
+		files, err := client.ListFiles()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", client.GetConfig().Provider, err)
+		}
+		for _, sum := range files {
+			if !seen[string(sum)] {
+				seen[string(sum)] = true
+				resp = append(resp, sum)
+			}
+		}
+	}
+	return resp, nil
+}
+
+// GetFile retrieves a file from the first child which has it.
+func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	for _, client := range s.clients() {
+		f, err := client.GetFile(sha256sum)
+		if err == nil {
+			return f, nil
+		}
+		logging.V(2).Infof("File %x not found in %q: %s", sha256sum, client.GetConfig().Provider, err)
+	}
+	return nil, errors.New("file not found")
+}
+
+// PutFile writes the file to the upper client only.
+func (s *Drive) PutFile(sha256sum, content []byte) error {
+	if !s.config.Write {
+		return errors.New("the upper client is not configured to write")
+	}
+	return s.upper.PutFile(sha256sum, content)
+}
+
+// ReleaseFile releases the file from the upper client only.
+func (s *Drive) ReleaseFile(sha256sum []byte) error {
+	return s.upper.ReleaseFile(sha256sum)
+}
+
+// GetChunk retrieves a chunk from the first child which has it.
+func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	for _, client := range s.clients() {
+		c, err := client.GetChunk(sha256sum, f)
+		if err == nil {
+			return c, nil
+		}
+		logging.V(2).Infof("Chunk %x not found in %q: %s", sha256sum, client.GetConfig().Provider, err)
+	}
+	return nil, errors.New("chunk not found")
+}
+
+// GetChunkRange retrieves part of a chunk from the first child which has it.
+func (s *Drive) GetChunkRange(sha256sum []byte, f *shade.File, offset, length int64) ([]byte, error) {
+	for _, client := range s.clients() {
+		if c, err := drive.GetChunkRange(client, sha256sum, f, offset, length); err == nil {
+			return c, nil
+		}
+	}
+	return nil, errors.New("chunk not found")
+}
+
+// PutChunk writes the chunk to the upper client only.
+func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
+	if !s.config.Write {
+		return errors.New("the upper client is not configured to write")
+	}
+	return s.upper.PutChunk(sha256sum, chunk, f)
+}
+
+// ReleaseChunk releases the chunk from the upper client only.
+func (s *Drive) ReleaseChunk(sha256sum []byte) error {
+	return s.upper.ReleaseChunk(sha256sum)
+}
+
+// Stat describes the object from the first child which has it.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	for _, client := range s.clients() {
+		if info, err := client.Stat(sha256sum); err == nil {
+			return info, nil
+		}
+	}
+	return drive.Info{}, errors.New("object not found")
+}
+
+// NewChunkLister returns an iterator which returns the chunks of each child
+// in turn.  Chunks stored by more than one child are returned more than once.
+func (s *Drive) NewChunkLister() drive.ChunkLister {
+	c := &ChunkLister{}
+	for _, client := range s.clients() {
+		c.listers = append(c.listers, client.NewChunkLister())
+	}
+	return c
+}
+
+// ChunkLister iterates the chunks of each child in turn.
+type ChunkLister struct {
+	listers []drive.ChunkLister
+	sha256  []byte
+	err     error
+}
+
+// Next advances the iterator returned by Sha256.  If a child returns an error,
+// iteration stops, and Err returns it.
+func (c *ChunkLister) Next() bool {
+	for len(c.listers) > 0 {
+		if c.listers[0].Next() {
+			c.sha256 = c.listers[0].Sha256()
+			return true
+		}
+		if c.err = c.listers[0].Err(); c.err != nil {
+			c.listers = nil
+			return false
+		}
+		c.listers = c.listers[1:]
+	}
+	return false
+}
+
+// Sha256 returns the current chunk sum.
+func (c *ChunkLister) Sha256() []byte {
+	return c.sha256
+}
+
+// Err returns the error encountered, if any.
+func (c *ChunkLister) Err() error {
+	return c.err
+}
+
+// Warm is passed to all the children.
+func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
+	for _, client := range s.clients() {
+		client.Warm(chunks, f)
+	}
+}
+
+// Space returns the space of the upper client, which receives all writes.
+func (s *Drive) Space() (total, free uint64, err error) {
+	return drive.Space(s.upper)
+}
+
+// GetConfig returns the config used to initialize this client.
+func (s *Drive) GetConfig() drive.Config {
+	return s.config
+}
+
+// Local returns true only if all of the children are local.
+func (s *Drive) Local() bool {
+	for _, client := range s.clients() {
+		if !client.Local() {
+			return false
+		}
+	}
+	return true
+}
+
+// Persistent returns whether the upper client is persistent, as it is the
+// only one written to.
+func (s *Drive) Persistent() bool {
+	return s.upper.Persistent()
+}
+
+// Ping pings all of the children.
+func (s *Drive) Ping(ctx context.Context) error {
+	for _, client := range s.clients() {
+		if err := client.Ping(ctx); err != nil {
+			return fmt.Errorf("%s: %s", client.GetConfig().Provider, err)
+		}
+	}
+	return nil
+}
+
+// Flush flushes the upper client.
+func (s *Drive) Flush() error {
+	return drive.Flush(s.upper)
+}
+
+// Close closes each of the child clients, and returns the first error.
+func (s *Drive) Close() error {
+	var firstErr error
+	for _, client := range s.clients() {
+		if err := drive.Close(client); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %s", client.GetConfig().Provider, err)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,142 @@
+package overlay
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+	_ "github.com/asjoyner/shade/drive/win"
+)
+
+func newTestClient(t *testing.T) drive.Client {
+	oc, err := NewClient(drive.Config{
+		Provider: "overlay",
+		Children: []drive.Config{
+			{Provider: "memory", Write: true},
+			{Provider: "win"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	return oc
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	drive.TestFileRoundTrip(t, newTestClient(t), 100)
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	drive.TestChunkRoundTrip(t, newTestClient(t), 100)
+}
+
+func TestRequiresTwoChildren(t *testing.T) {
+	_, err := NewClient(drive.Config{
+		Provider: "overlay",
+		Children: []drive.Config{{Provider: "memory", Write: true}},
+	})
+	if err == nil {
+		t.Error("NewClient succeeded with only one child")
+	}
+}
+
+// readOnlyClient fails the test if any write or release reaches it.
+type readOnlyClient struct {
+	drive.Client
+	t *testing.T
+}
+
+func (c *readOnlyClient) PutFile(sha256sum, content []byte) error {
+	c.t.Errorf("PutFile(%x) reached the lower client", sha256sum)
+	return nil
+}
+
+func (c *readOnlyClient) ReleaseFile(sha256sum []byte) error {
+	c.t.Errorf("ReleaseFile(%x) reached the lower client", sha256sum)
+	return nil
+}
+
+func (c *readOnlyClient) PutChunk(sha256sum, chunk []byte, f *shade.File) error {
+	c.t.Errorf("PutChunk(%x) reached the lower client", sha256sum)
+	return nil
+}
+
+func (c *readOnlyClient) ReleaseChunk(sha256sum []byte) error {
+	c.t.Errorf("ReleaseChunk(%x) reached the lower client", sha256sum)
+	return nil
+}
+
+func newMemoryClient(t *testing.T) drive.Client {
+	c, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestWritesOnlyReachUpper ensures objects in the lower client are readable
+// through the overlay, and that writes and releases only affect the upper.
+func TestWritesOnlyReachUpper(t *testing.T) {
+	upper := newMemoryClient(t)
+	lowerMemory := newMemoryClient(t)
+	lowerFileSum, lowerFile := drive.RandChunk()
+	lowerChunkSum, lowerChunk := drive.RandChunk()
+	if err := lowerMemory.PutFile(lowerFileSum, lowerFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := lowerMemory.PutChunk(lowerChunkSum, lowerChunk, nil); err != nil {
+		t.Fatal(err)
+	}
+	oc := newDrive(drive.Config{Provider: "overlay"}, upper, []drive.Client{&readOnlyClient{lowerMemory, t}})
+
+	got, err := oc.GetFile(lowerFileSum)
+	if err != nil || !bytes.Equal(got, lowerFile) {
+		t.Errorf("could not read a file from the lower client: %s", err)
+	}
+	got, err = oc.GetChunk(lowerChunkSum, nil)
+	if err != nil || !bytes.Equal(got, lowerChunk) {
+		t.Errorf("could not read a chunk from the lower client: %s", err)
+	}
+
+	fileSum, file := drive.RandChunk()
+	chunkSum, chunk := drive.RandChunk()
+	if err := oc.PutFile(fileSum, file); err != nil {
+		t.Fatal(err)
+	}
+	if err := oc.PutChunk(chunkSum, chunk, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upper.GetChunk(chunkSum, nil); err != nil {
+		t.Errorf("upper client does not have the chunk: %s", err)
+	}
+	if _, err := lowerMemory.GetChunk(chunkSum, nil); err == nil {
+		t.Error("lower client has the chunk")
+	}
+
+	files, err := oc.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("ListFiles: want the union of 2 files, got: %d", len(files))
+	}
+	var chunks int
+	for cl := oc.NewChunkLister(); cl.Next(); chunks++ {
+	}
+	if chunks != 2 {
+		t.Errorf("ChunkLister: want the union of 2 chunks, got: %d", chunks)
+	}
+
+	// Releasing the lower objects leaves them in place.
+	if err := oc.ReleaseFile(lowerFileSum); err != nil {
+		t.Error(err)
+	}
+	if err := oc.ReleaseChunk(lowerChunkSum); err != nil {
+		t.Error(err)
+	}
+	if _, err := oc.GetChunk(lowerChunkSum, nil); err != nil {
+		t.Errorf("releasing a lower chunk removed it: %s", err)
+	}
+}
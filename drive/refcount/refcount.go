@@ -0,0 +1,388 @@
+// Package refcount is a storage backend for Shade which counts the files
+// which reference each chunk, so that a chunk is only released once no file
+// references it.
+//
+// It wraps a single child client.  Each shade.File passed to PutFile is
+// unmarshalled, and recorded as a reference to each of its chunks, both by
+// their plaintext sums and by the sums they are stored at by an "encrypt"
+// client.  ReleaseFile removes those references.  ReleaseChunk is passed to
+// the child only if no file references the chunk; otherwise it does nothing,
+// which the drive.Client interface permits.
+//
+// The index of references is kept in memory, and appended to the file named
+// by RefcountIndex in the config as it changes, so it survives restarts.  If
+// that file does not exist, the index is built by reading every file known to
+// the child.
+//
+// Compared to the mark-sweep approach of umbrella.Cleanup, which computes the
+// chunks in use from a scan of every file, this makes releasing a chunk safe
+// even while other files are being written, and without a full scan.  The
+// costs are:
+//   - Each PutFile and ReleaseFile appends to the index, and the index holds
+//     the sum of every referenced chunk in memory.
+//   - The index is only accurate if every write to the repository goes
+//     through a refcount client sharing it.  Files written by other clients
+//     are not counted until the index is rebuilt, by removing the file.
+//   - A chunk is unreferenced between being put and the file which references
+//     it being put, as PutChunk precedes PutFile.  A scan in that window may
+//     still release it.
+//   - File objects must be readable, so refcount must be configured above
+//     any "encrypt" client.  The sums its chunks are stored at are computed
+//     from the config of that client, in the mode it is configured in.
+package refcount
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/encrypt"
+	"github.com/asjoyner/shade/logging"
+)
+
+func init() {
+	drive.RegisterProvider("refcount", NewClient)
+}
+
+// NewClient returns a Drive client which counts the references to the chunks
+// of its only child.
+func NewClient(c drive.Config) (drive.Client, error) {
+	if len(c.Children) != 1 {
+		return nil, errors.New("refcount requires exactly one child")
+	}
+	if c.RefcountIndex == "" {
+		return nil, errors.New("refcount requires a RefcountIndex")
+	}
+	child, err := drive.NewClient(c.Children[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", c.Children[0].Provider, err)
+	}
+	return newDrive(c, child)
+}
+
+func newDrive(c drive.Config, child drive.Client) (*Drive, error) {
+	c.Write = child.GetConfig().Write
+	d := &Drive{
+		config: c,
+		child:  child,
+		files:  make(map[string][]string),
+		refs:   make(map[string]map[string]struct{}),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Drive implements the drive.Client interface by counting the references to
+// the chunks of a child client.
+type Drive struct {
+	config drive.Config
+	child  drive.Client
+
+	mu    sync.Mutex                     // protects the fields below
+	files map[string][]string            // file sum -> the chunk sums it references
+	refs  map[string]map[string]struct{} // chunk sum -> the files which reference it
+	index *os.File                       // records are appended to it
+}
+
+// record is a line of the index.  It records that the file with sum File
+// references Chunks, or no longer references any chunks, if Release is set.
+// Sums are hex encoded.  The first line of the index instead records the
+// indexVersion it was written with.
+type record struct {
+	Version int      `json:",omitempty"`
+	File    string   `json:",omitempty"`
+	Chunks  []string `json:",omitempty"`
+	Release bool     `json:",omitempty"`
+}
+
+// indexVersion is the Version of the index written by this package.  An index
+// with another Version is rebuilt, because its sums may be computed
+// differently.  Version 1 added the sums of chunks stored by convergent
+// "encrypt" clients.
+const indexVersion = 1
+
+// load reads the index, or builds it from the child if it does not exist or
+// has another indexVersion, then compacts it.
+func (s *Drive) load() error {
+	filename := s.config.RefcountIndex
+	fh, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		if err := s.rebuild(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		var version int
+		scanner := bufio.NewScanner(fh)
+		scanner.Buffer(nil, 64*1024*1024)
+		for scanner.Scan() {
+			var r record
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				// Most likely a partial write when the process exited.
+				logging.Warningf("skipping corrupt record in %s: %q", filename, scanner.Text())
+				continue
+			}
+			if r.Version != 0 {
+				version = r.Version
+				continue
+			}
+			s.apply(r)
+		}
+		err := scanner.Err()
+		fh.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %s", filename, err)
+		}
+		if version != indexVersion {
+			logging.Infof("refcount index %s has version %d; rebuilding it", filename, version)
+			s.files = make(map[string][]string)
+			s.refs = make(map[string]map[string]struct{})
+			if err := s.rebuild(); err != nil {
+				return err
+			}
+		}
+	}
+	return s.compact()
+}
+
+// rebuild populates the index from every file known to the child.
+func (s *Drive) rebuild() error {
+	sums, err := s.child.ListFiles()
+	if err != nil {
+		return fmt.Errorf("rebuilding refcount index: %s", err)
+	}
+	logging.Infof("Building refcount index from %d file(s)", len(sums))
+	for _, sum := range sums {
+		fj, err := s.child.GetFile(sum)
+		if err != nil {
+			return fmt.Errorf("rebuilding refcount index: GetFile(%x): %s", sum, err)
+		}
+		s.apply(record{File: hex.EncodeToString(sum), Chunks: s.chunkSums(sum, fj)})
+	}
+	return nil
+}
+
+// apply updates the in memory index with r.
+// Nb: caller is responsible for holding mu, if needed.
+func (s *Drive) apply(r record) {
+	for _, c := range s.files[r.File] {
+		delete(s.refs[c], r.File)
+		if len(s.refs[c]) == 0 {
+			delete(s.refs, c)
+		}
+	}
+	delete(s.files, r.File)
+	if r.Release {
+		return
+	}
+	s.files[r.File] = r.Chunks
+	for _, c := range r.Chunks {
+		if s.refs[c] == nil {
+			s.refs[c] = make(map[string]struct{})
+		}
+		s.refs[c][r.File] = struct{}{}
+	}
+}
+
+// compact replaces the index with the current references, and opens it to
+// append new ones.
+func (s *Drive) compact() error {
+	filename := s.config.RefcountIndex
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(record{Version: indexVersion}); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	for f, chunks := range s.files {
+		if err := enc.Encode(record{File: f, Chunks: chunks}); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	s.index, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// update applies r to the index, and appends it to the index file.
+func (s *Drive) update(r record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apply(r)
+	if err := json.NewEncoder(s.index).Encode(r); err != nil {
+		return fmt.Errorf("updating refcount index: %s", err)
+	}
+	return nil
+}
+
+// chunkSums returns the hex encoded sums of the chunks referenced by the file
+// object fj, both as plaintext and as they are stored by any encrypted client
+// below s.  If fj is not a shade.File, it references no chunks.
+func (s *Drive) chunkSums(sum, fj []byte) []string {
+	f := &shade.File{}
+	if err := f.FromJSON(fj); err != nil {
+		logging.Warningf("refcount: file %x references no chunks: %s", sum, err)
+		return nil
+	}
+	var sums []string
+	for _, chunk := range f.Chunks {
+		sums = append(sums, hex.EncodeToString(chunk.Sha256))
+	}
+	// Files written without encryption have no Nonces, and thus no encrypted
+	// sums.
+	if esums, err := encrypt.GetAllEncryptedSums(f); err == nil {
+		for _, es := range esums {
+			sums = append(sums, hex.EncodeToString(es))
+		}
+	}
+	ssums, err := encrypt.StoredChunkSums(s.child.GetConfig(), f)
+	if err != nil {
+		logging.Warningf("refcount: could not get the stored sums of the chunks of %x: %s", sum, err)
+	}
+	for _, ss := range ssums {
+		sums = append(sums, hex.EncodeToString(ss))
+	}
+	return sums
+}
+
+// Refs returns the number of files which reference the chunk with the given
+// sum.
+func (s *Drive) Refs(sha256sum []byte) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.refs[hex.EncodeToString(sha256sum)])
+}
+
+// Close closes the index file, and then the child.
+func (s *Drive) Close() error {
+	s.mu.Lock()
+	err := s.index.Close()
+	s.mu.Unlock()
+	if cerr := drive.Close(s.child); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ListFiles returns the files known to the child.
+func (s *Drive) ListFiles() ([][]byte, error) {
+	return s.child.ListFiles()
+}
+
+// GetFile retrieves a file from the child.
+func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	return s.child.GetFile(sha256sum)
+}
+
+// PutFile writes the file to the child, and then records its references to
+// its chunks.
+func (s *Drive) PutFile(sha256sum, content []byte) error {
+	if err := s.child.PutFile(sha256sum, content); err != nil {
+		return err
+	}
+	return s.update(record{File: hex.EncodeToString(sha256sum), Chunks: s.chunkSums(sha256sum, content)})
+}
+
+// ReleaseFile removes the references of the file to its chunks, and then
+// releases it from the child.
+func (s *Drive) ReleaseFile(sha256sum []byte) error {
+	if err := s.update(record{File: hex.EncodeToString(sha256sum), Release: true}); err != nil {
+		return err
+	}
+	return s.child.ReleaseFile(sha256sum)
+}
+
+// GetChunk retrieves a chunk from the child.
+func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	return s.child.GetChunk(sha256sum, f)
+}
+
+// PutChunk writes a chunk to the child.
+func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
+	return s.child.PutChunk(sha256sum, chunk, f)
+}
+
+// ReleaseChunk releases the chunk from the child, only if no file references
+// it.
+func (s *Drive) ReleaseChunk(sha256sum []byte) error {
+	if n := s.Refs(sha256sum); n > 0 {
+		logging.V(2).Infof("not releasing chunk %x, referenced by %d file(s)", sha256sum, n)
+		return nil
+	}
+	return s.child.ReleaseChunk(sha256sum)
+}
+
+// Stat describes the object from the child.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	return s.child.Stat(sha256sum)
+}
+
+// NewChunkLister returns the chunk lister of the child.
+func (s *Drive) NewChunkLister() drive.ChunkLister {
+	return s.child.NewChunkLister()
+}
+
+// Warm is passed to the child.
+func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
+	s.child.Warm(chunks, f)
+}
+
+// Space returns the space of the child.
+func (s *Drive) Space() (total, free uint64, err error) {
+	return drive.Space(s.child)
+}
+
+// GetConfig returns the config used to initialize this client.
+func (s *Drive) GetConfig() drive.Config {
+	return s.config
+}
+
+// Local returns whether the child is local.
+func (s *Drive) Local() bool {
+	return s.child.Local()
+}
+
+// Persistent returns whether the child is persistent.
+func (s *Drive) Persistent() bool {
+	return s.child.Persistent()
+}
+
+// Ping pings the child.
+func (s *Drive) Ping(ctx context.Context) error {
+	return s.child.Ping(ctx)
+}
+
+// Flush flushes the child.
+func (s *Drive) Flush() error {
+	return drive.Flush(s.child)
+}
@@ -0,0 +1,188 @@
+package refcount
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/encrypt"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+// newTestClient returns a refcount Drive wrapping child, with its index in
+// dir.
+func newTestClient(t *testing.T, dir string, child drive.Client) *Drive {
+	c := drive.Config{Provider: "refcount", RefcountIndex: filepath.Join(dir, "index")}
+	d, err := newDrive(c, child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refcountTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newTestClient(t, dir, mc)
+	defer d.Close()
+	drive.TestFileRoundTrip(t, d, 100)
+	drive.TestChunkRoundTrip(t, d, 100)
+	drive.TestRelease(t, d, true)
+}
+
+// putFile stores a file named filename, which references chunks, in c.  It
+// returns the sum of the file.
+func putFile(t *testing.T, c drive.Client, filename string, chunks ...[]byte) []byte {
+	f := shade.NewFile(filename)
+	for i, chunk := range chunks {
+		sum := shade.Sum(chunk)
+		if err := c.PutChunk(sum, chunk, f); err != nil {
+			t.Fatal(err)
+		}
+		f.Chunks = append(f.Chunks, shade.Chunk{Index: i, Sha256: sum})
+	}
+	fj, err := f.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := shade.Sum(fj)
+	if err := c.PutFile(sum, fj); err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
+
+func TestSharedChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refcountTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newTestClient(t, dir, mc)
+
+	shared, onlyA := []byte("shared chunk"), []byte("chunk only in a")
+	a := putFile(t, d, "a", shared, onlyA)
+	b := putFile(t, d, "b", shared)
+	if n := d.Refs(shade.Sum(shared)); n != 2 {
+		t.Errorf("want 2 references to the shared chunk, got: %d", n)
+	}
+
+	if err := d.ReleaseFile(a); err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range [][]byte{shared, onlyA} {
+		if err := d.ReleaseChunk(shade.Sum(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := mc.GetChunk(shade.Sum(shared), nil); err != nil {
+		t.Errorf("shared chunk was released while b referenced it: %s", err)
+	}
+	if _, err := mc.GetChunk(shade.Sum(onlyA), nil); err == nil {
+		t.Error("chunk only referenced by a was not released")
+	}
+
+	// The references survive reopening the index.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d = newTestClient(t, dir, mc)
+	if n := d.Refs(shade.Sum(shared)); n != 1 {
+		t.Errorf("after reopening, want 1 reference to the shared chunk, got: %d", n)
+	}
+	if err := d.ReleaseFile(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ReleaseChunk(shade.Sum(shared)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mc.GetChunk(shade.Sum(shared), nil); err == nil {
+		t.Error("shared chunk was not released once unreferenced")
+	}
+	d.Close()
+}
+
+func TestRebuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refcountTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := []byte("shared chunk")
+	putFile(t, mc, "a", shared)
+	putFile(t, mc, "b", shared)
+
+	// Without an index, the references are read from the child.
+	d := newTestClient(t, dir, mc)
+	defer d.Close()
+	if n := d.Refs(shade.Sum(shared)); n != 2 {
+		t.Errorf("want 2 references to the shared chunk, got: %d", n)
+	}
+}
+
+// TestConvergentChild checks that the chunks stored by a convergent encrypt
+// child are referenced at the sums they are stored at.
+func TestConvergentChild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refcountTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privkey)}
+	ec, err := encrypt.NewClient(drive.Config{
+		Provider:      "encrypt",
+		RsaPrivateKey: string(pem.EncodeToMemory(b)),
+		ConvergentKey: hex.EncodeToString(shade.NewSymmetricKey()[:]),
+		Children:      []drive.Config{{Provider: "memory", Write: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newTestClient(t, dir, ec)
+	defer d.Close()
+
+	chunk := []byte("convergent chunk")
+	fsum := putFile(t, d, "a", chunk)
+	fj, err := d.GetFile(fsum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &shade.File{}
+	if err := f.FromJSON(fj); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ec.(*encrypt.Drive).ChunkSum(shade.Sum(chunk), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := d.Refs(stored); n != 1 {
+		t.Errorf("want 1 reference to the stored sum of the chunk, got: %d", n)
+	}
+}
@@ -0,0 +1,354 @@
+// Package split is a storage backend for Shade which splits objects larger
+// than a configured size into several smaller objects, for children which
+// limit the size of the objects they store.
+//
+// It wraps a single child client.  A file or chunk of at most SplitSize bytes
+// is passed to the child unchanged.  A larger one is cut into parts of at most
+// SplitSize bytes, which are stored as chunks of the child at sums derived
+// from the sum of the object, and a small index object, naming the number of
+// parts, is stored in its place.  GetFile and GetChunk recognize the index,
+// and reassemble the parts.  ListFiles and NewChunkLister only return the
+// sums of the objects, never those of their parts.
+//
+// The parts are stored as they are given, so split must be configured below
+// any "encrypt" client, to bound the size of the encrypted objects which
+// reach the child.
+package split
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+)
+
+func init() {
+	drive.RegisterProvider("split", NewClient)
+}
+
+// indexMagic prefixes the index object stored in place of a split object.
+var indexMagic = []byte("shade split index\n")
+
+// partMarker separates the sum of a split object from the number of a part,
+// in the sum the part is stored at.
+var partMarker = []byte("\x00split")
+
+// index describes how a split object is stored.
+type index struct {
+	Parts int   // the number of parts
+	Size  int64 // the size of the object, in bytes
+}
+
+// maxIndexSize is the size of the largest index object, so a larger object
+// is known not to be an index without retrieving it.
+var maxIndexSize = func() int64 {
+	ij, err := json.Marshal(index{Parts: math.MaxUint32, Size: math.MaxInt64})
+	if err != nil {
+		panic(err)
+	}
+	return int64(len(indexMagic) + len(ij))
+}()
+
+// NewClient returns a Drive client which splits objects larger than
+// c.SplitSize before storing them in its only child.
+func NewClient(c drive.Config) (drive.Client, error) {
+	if len(c.Children) != 1 {
+		return nil, errors.New("split requires exactly one child")
+	}
+	if c.SplitSize <= 0 {
+		return nil, errors.New("split requires a positive SplitSize")
+	}
+	child, err := drive.NewClient(c.Children[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", c.Children[0].Provider, err)
+	}
+	return newDrive(c, child), nil
+}
+
+func newDrive(c drive.Config, child drive.Client) *Drive {
+	c.Write = child.GetConfig().Write
+	return &Drive{config: c, child: child}
+}
+
+// Drive implements the drive.Client interface by splitting large objects
+// into parts stored by a child client.
+type Drive struct {
+	config drive.Config
+	child  drive.Client
+}
+
+// partSum returns the sum part n of the object with the given sum is stored
+// at.
+func partSum(sha256sum []byte, n int) []byte {
+	ps := make([]byte, len(sha256sum)+len(partMarker)+4)
+	copy(ps, sha256sum)
+	copy(ps[len(sha256sum):], partMarker)
+	binary.BigEndian.PutUint32(ps[len(ps)-4:], uint32(n))
+	return ps
+}
+
+// isPart returns whether sha256sum is the sum of a part of a split object.
+func isPart(sha256sum []byte) bool {
+	if len(sha256sum) < len(partMarker)+4 {
+		return false
+	}
+	return bytes.Equal(sha256sum[len(sha256sum)-4-len(partMarker):len(sha256sum)-4], partMarker)
+}
+
+// needsSplit returns whether content must be split.  Content which begins
+// with indexMagic is split regardless of its size, so it is never mistaken
+// for an index.
+func (s *Drive) needsSplit(content []byte) bool {
+	return int64(len(content)) > s.config.SplitSize || bytes.HasPrefix(content, indexMagic)
+}
+
+// putParts stores content as parts of the object with sha256sum, and returns
+// its index object.  If a part can't be stored, the parts stored before it
+// are released, as they are not listed and so would never be collected,
+// unless the object was already stored, and they belong to it.
+func (s *Drive) putParts(sha256sum, content []byte, f *shade.File) ([]byte, error) {
+	size := s.config.SplitSize
+	idx := index{Size: int64(len(content))}
+	for off := int64(0); off < int64(len(content)); off += size {
+		end := off + size
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		if err := s.child.PutChunk(partSum(sha256sum, idx.Parts), content[off:end], f); err != nil {
+			if _, serr := s.child.Stat(sha256sum); serr != nil {
+				s.releaseStoredParts(sha256sum, idx.Parts)
+			}
+			return nil, fmt.Errorf("storing part %d of %x: %s", idx.Parts, sha256sum, err)
+		}
+		idx.Parts++
+	}
+	ij, err := json.Marshal(idx)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, indexMagic...), ij...), nil
+}
+
+// releaseStoredParts releases the first n parts of the object with
+// sha256sum, after storing the rest of them failed.  Failures are only
+// logged, as the store has already failed.
+func (s *Drive) releaseStoredParts(sha256sum []byte, n int) {
+	for p := 0; p < n; p++ {
+		if err := s.child.ReleaseChunk(partSum(sha256sum, p)); err != nil {
+			logging.Warningf("could not release part %d of unstored %x: %s", p, sha256sum, err)
+		}
+	}
+}
+
+// parseIndex returns the index in stored, or nil if stored is not an index
+// object.
+func parseIndex(stored []byte) (*index, error) {
+	if !bytes.HasPrefix(stored, indexMagic) {
+		return nil, nil
+	}
+	idx := &index{}
+	if err := json.Unmarshal(stored[len(indexMagic):], idx); err != nil {
+		return nil, fmt.Errorf("corrupt split index: %s", err)
+	}
+	return idx, nil
+}
+
+// join returns the object stored as stored, reassembling its parts if it is
+// an index object.
+func (s *Drive) join(sha256sum, stored []byte, f *shade.File) ([]byte, error) {
+	idx, err := parseIndex(stored)
+	if err != nil || idx == nil {
+		return stored, err
+	}
+	content := make([]byte, 0, idx.Size)
+	for n := 0; n < idx.Parts; n++ {
+		part, err := s.child.GetChunk(partSum(sha256sum, n), f)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving part %d of %x: %s", n, sha256sum, err)
+		}
+		content = append(content, part...)
+	}
+	if int64(len(content)) != idx.Size {
+		return nil, fmt.Errorf("reassembled %x is %d bytes, want %d", sha256sum, len(content), idx.Size)
+	}
+	return content, nil
+}
+
+// releaseParts releases the parts of the object stored as stored, if it is
+// an index object.
+func (s *Drive) releaseParts(sha256sum, stored []byte) error {
+	idx, err := parseIndex(stored)
+	if err != nil || idx == nil {
+		return err
+	}
+	for n := 0; n < idx.Parts; n++ {
+		if err := s.child.ReleaseChunk(partSum(sha256sum, n)); err != nil {
+			return fmt.Errorf("releasing part %d of %x: %s", n, sha256sum, err)
+		}
+	}
+	return nil
+}
+
+// ListFiles returns the files known to the child.  The parts of split files
+// are stored as chunks, so they are not among them.
+func (s *Drive) ListFiles() ([][]byte, error) {
+	return s.child.ListFiles()
+}
+
+// GetFile retrieves a file from the child, reassembling it if it was split.
+func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	stored, err := s.child.GetFile(sha256sum)
+	if err != nil {
+		return nil, err
+	}
+	return s.join(sha256sum, stored, nil)
+}
+
+// PutFile writes the file to the child, splitting it if it is too large.
+func (s *Drive) PutFile(sha256sum, content []byte) error {
+	if s.needsSplit(content) {
+		var err error
+		if content, err = s.putParts(sha256sum, content, nil); err != nil {
+			return err
+		}
+	}
+	return s.child.PutFile(sha256sum, content)
+}
+
+// ReleaseFile releases the file, and its parts if it was split, from the
+// child.
+func (s *Drive) ReleaseFile(sha256sum []byte) error {
+	if s.mayBeIndex(sha256sum) {
+		if stored, err := s.child.GetFile(sha256sum); err == nil {
+			if err := s.releaseParts(sha256sum, stored); err != nil {
+				return err
+			}
+		}
+	}
+	return s.child.ReleaseFile(sha256sum)
+}
+
+// mayBeIndex returns whether the object with sha256sum may be stored as an
+// index object, so it must be retrieved to find its parts.  An object larger
+// than maxIndexSize is not, so it need not be retrieved just to release it.
+func (s *Drive) mayBeIndex(sha256sum []byte) bool {
+	info, err := s.child.Stat(sha256sum)
+	return err != nil || info.Size <= maxIndexSize
+}
+
+// GetChunk retrieves a chunk from the child, reassembling it if it was split.
+func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	stored, err := s.child.GetChunk(sha256sum, f)
+	if err != nil {
+		return nil, err
+	}
+	return s.join(sha256sum, stored, f)
+}
+
+// PutChunk writes the chunk to the child, splitting it if it is too large.
+func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
+	if s.needsSplit(chunk) {
+		var err error
+		if chunk, err = s.putParts(sha256sum, chunk, f); err != nil {
+			return err
+		}
+	}
+	return s.child.PutChunk(sha256sum, chunk, f)
+}
+
+// ReleaseChunk releases the chunk, and its parts if it was split, from the
+// child.
+func (s *Drive) ReleaseChunk(sha256sum []byte) error {
+	if s.mayBeIndex(sha256sum) {
+		if stored, err := s.child.GetChunk(sha256sum, nil); err == nil {
+			if err := s.releaseParts(sha256sum, stored); err != nil {
+				return err
+			}
+		}
+	}
+	return s.child.ReleaseChunk(sha256sum)
+}
+
+// Stat describes the object from the child.  The size of a split object is
+// that of its index object.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	return s.child.Stat(sha256sum)
+}
+
+// NewChunkLister returns an iterator which returns the chunks of the child,
+// except the parts of split objects.
+func (s *Drive) NewChunkLister() drive.ChunkLister {
+	return &ChunkLister{lister: s.child.NewChunkLister()}
+}
+
+// ChunkLister iterates the chunks of the child, skipping parts.
+type ChunkLister struct {
+	lister drive.ChunkLister
+}
+
+// Next advances the iterator to the next chunk which is not a part.
+func (c *ChunkLister) Next() bool {
+	for c.lister.Next() {
+		if !isPart(c.lister.Sha256()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sha256 returns the current chunk sum.
+func (c *ChunkLister) Sha256() []byte {
+	return c.lister.Sha256()
+}
+
+// Err returns the error encountered by the child, if any.
+func (c *ChunkLister) Err() error {
+	return c.lister.Err()
+}
+
+// Warm is passed to the child.
+func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
+	s.child.Warm(chunks, f)
+}
+
+// Space returns the space of the child.
+func (s *Drive) Space() (total, free uint64, err error) {
+	return drive.Space(s.child)
+}
+
+// GetConfig returns the config used to initialize this client.
+func (s *Drive) GetConfig() drive.Config {
+	return s.config
+}
+
+// Local returns whether the child is local.
+func (s *Drive) Local() bool {
+	return s.child.Local()
+}
+
+// Persistent returns whether the child is persistent.
+func (s *Drive) Persistent() bool {
+	return s.child.Persistent()
+}
+
+// Ping pings the child.
+func (s *Drive) Ping(ctx context.Context) error {
+	return s.child.Ping(ctx)
+}
+
+// Flush flushes the child.
+func (s *Drive) Flush() error {
+	return drive.Flush(s.child)
+}
+
+// Close closes the child.
+func (s *Drive) Close() error {
+	return drive.Close(s.child)
+}
@@ -0,0 +1,156 @@
+package split
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+func newTestClient(t *testing.T) (*Drive, drive.Client) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newDrive(drive.Config{Provider: "split", SplitSize: 8}, mc), mc
+}
+
+func TestRoundTrip(t *testing.T) {
+	d, _ := newTestClient(t)
+	drive.TestFileRoundTrip(t, d, 100)
+	drive.TestChunkRoundTrip(t, d, 100)
+	drive.TestRelease(t, d, true)
+}
+
+func TestSplit(t *testing.T) {
+	d, mc := newTestClient(t)
+	content := []byte("twenty-one bytes long")
+	sum := shade.Sum(content)
+	if err := d.PutChunk(sum, content, nil); err != nil {
+		t.Fatal(err)
+	}
+	// stored as an index object and three parts
+	for n := 0; n < 3; n++ {
+		part, err := mc.GetChunk(partSum(sum, n), nil)
+		if err != nil {
+			t.Fatalf("part %d was not stored: %s", n, err)
+		}
+		if len(part) > 8 {
+			t.Errorf("part %d is %d bytes, want at most 8", n, len(part))
+		}
+	}
+	stored, err := mc.GetChunk(sum, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(stored, indexMagic) {
+		t.Errorf("want an index object stored at the sum, got: %q", stored)
+	}
+	got, err := d.GetChunk(sum, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("reassembled chunk: got %q, want %q", got, content)
+	}
+
+	// only the logical sum is listed
+	var listed [][]byte
+	cl := d.NewChunkLister()
+	for cl.Next() {
+		listed = append(listed, cl.Sha256())
+	}
+	if err := cl.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || !bytes.Equal(listed[0], sum) {
+		t.Errorf("want only %x listed, got: %x", sum, listed)
+	}
+
+	// content which looks like an index is still returned verbatim
+	fake := indexMagic[:]
+	fakeSum := shade.Sum(fake)
+	if err := d.PutFile(fakeSum, fake); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.GetFile(fakeSum); err != nil || !bytes.Equal(got, fake) {
+		t.Errorf("GetFile(%x) = %q, %v; want %q", fakeSum, got, err, fake)
+	}
+
+	if err := d.ReleaseChunk(sum); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 3; n++ {
+		if _, err := mc.GetChunk(partSum(sum, n), nil); err == nil {
+			t.Errorf("part %d was not released", n)
+		}
+	}
+}
+
+// getCounter counts the chunks retrieved from a child, and fails the
+// PutChunk calls after the first failAfter, if it is positive.
+type getCounter struct {
+	drive.Client
+	gets      int
+	puts      int
+	failAfter int
+}
+
+func (c *getCounter) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	c.gets++
+	return c.Client.GetChunk(sha256sum, f)
+}
+
+func (c *getCounter) PutChunk(sha256sum, chunk []byte, f *shade.File) error {
+	c.puts++
+	if c.failAfter > 0 && c.puts > c.failAfter {
+		return errors.New("injected failure")
+	}
+	return c.Client.PutChunk(sha256sum, chunk, f)
+}
+
+func TestReleaseUnsplitChunk(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc := &getCounter{Client: mc}
+	d := newDrive(drive.Config{Provider: "split", SplitSize: 4096}, gc)
+	chunk := bytes.Repeat([]byte("x"), 1024)
+	sum := shade.Sum(chunk)
+	if err := d.PutChunk(sum, chunk, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ReleaseChunk(sum); err != nil {
+		t.Fatal(err)
+	}
+	if gc.gets != 0 {
+		t.Errorf("releasing a chunk too large to be an index retrieved %d chunks", gc.gets)
+	}
+	if _, err := mc.GetChunk(sum, nil); err == nil {
+		t.Error("the chunk was not released")
+	}
+}
+
+func TestPutPartsFailure(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDrive(drive.Config{Provider: "split", SplitSize: 8}, &getCounter{Client: mc, failAfter: 2})
+	content := []byte("twenty-one bytes long")
+	sum := shade.Sum(content)
+	if err := d.PutChunk(sum, content, nil); err == nil {
+		t.Fatal("PutChunk() succeeded although a part could not be stored")
+	}
+	cl := mc.NewChunkLister()
+	for cl.Next() {
+		t.Errorf("chunk %x was left in the child by the failed PutChunk", cl.Sha256())
+	}
+	if err := cl.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,392 @@
+// Package stripe is a storage backend for Shade which spreads the chunks of
+// a repository across several children, so that a repository may be larger
+// than any one of them.
+//
+// Each chunk is written to Replicas distinct children, chosen from its sum:
+// the sum is hashed to a first slot, and the chunk is stored in the child in
+// that slot and in those which follow it, wrapping around.  The placement
+// only depends on the sum and the number of children, so reads and releases
+// ask only those children.  Adding or removing a child moves most chunks to
+// other slots, so the children of a stripe must not change once chunks have
+// been written to it.
+//
+// A chunk remains readable while any of its Replicas children has it, so a
+// stripe with Replicas of two survives the loss of any one child.  Files are
+// small, and are required to list the repository, so they are written to
+// every child.
+package stripe
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+)
+
+func init() {
+	drive.RegisterProvider("stripe", NewClient)
+}
+
+// NewClient returns a Drive client which stripes the chunks of its children,
+// writing each to c.Replicas of them.
+func NewClient(c drive.Config) (drive.Client, error) {
+	if len(c.Children) == 0 {
+		return nil, errors.New("stripe requires at least one child")
+	}
+	if c.Replicas > len(c.Children) {
+		return nil, fmt.Errorf("stripe has %d children, fewer than its %d Replicas", len(c.Children), c.Replicas)
+	}
+	var children []drive.Client
+	for _, conf := range c.Children {
+		child, err := drive.NewClient(conf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", conf.Provider, err)
+		}
+		children = append(children, child)
+	}
+	return newDrive(c, children), nil
+}
+
+// newDrive returns a Drive which stripes the chunks of children.  It is
+// writable only if all of the children are, as every child holds some of the
+// chunks.
+func newDrive(c drive.Config, children []drive.Client) *Drive {
+	if c.Replicas < 1 {
+		c.Replicas = 1
+	}
+	c.Write = true
+	for _, child := range children {
+		if !child.GetConfig().Write {
+			logging.V(2).Infof("child %s is NOT writable.", child.GetConfig().Provider)
+			c.Write = false
+		}
+	}
+	return &Drive{config: c, clients: children}
+}
+
+// Drive implements the drive.Client interface by writing each chunk to
+// Replicas of its children, and each file to all of them.
+type Drive struct {
+	config  drive.Config
+	clients []drive.Client
+}
+
+// replicas returns the children which store the chunk with sha256sum, in the
+// order they are read from.
+func (s *Drive) replicas(sha256sum []byte) []drive.Client {
+	h := sha256.Sum256(sha256sum)
+	first := binary.BigEndian.Uint64(h[:8]) % uint64(len(s.clients))
+	clients := make([]drive.Client, s.config.Replicas)
+	for i := range clients {
+		clients[i] = s.clients[(first+uint64(i))%uint64(len(s.clients))]
+	}
+	return clients
+}
+
+// ListFiles returns the union of the files known to the children which
+// succeed.  As each file is written to every child, a child which fails only
+// hides the files which were written to it alone.  It returns an error if
+// every child fails.
+func (s *Drive) ListFiles() ([][]byte, error) {
+	seen := make(map[string]bool)
+	var resp [][]byte
+	var failed []string
+	for _, client := range s.clients {
+		files, err := client.ListFiles()
+		if err != nil {
+			logging.Warningf("error reading from %q: %s", client.GetConfig().Provider, err)
+			failed = append(failed, fmt.Sprintf("%s: %s", client.GetConfig().Provider, err))
+			continue
+		}
+		for _, sum := range files {
+			if !seen[string(sum)] {
+				seen[string(sum)] = true
+				resp = append(resp, sum)
+			}
+		}
+	}
+	if len(failed) == len(s.clients) {
+		return nil, fmt.Errorf("all clients failed to list files: %s", strings.Join(failed, "; "))
+	}
+	return resp, nil
+}
+
+// GetFile retrieves the file from the first child which has it.
+func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	for _, client := range s.clients {
+		file, err := client.GetFile(sha256sum)
+		if err != nil {
+			logging.V(2).Infof("File %x not found in %q: %s", sha256sum, client.GetConfig().Provider, err)
+			continue
+		}
+		return file, nil
+	}
+	return nil, errors.New("file not found")
+}
+
+// PutFile writes the file to every child.  It returns an error unless at
+// least Replicas of them succeed, so the file is as durable as its chunks.
+func (s *Drive) PutFile(sha256sum, f []byte) error {
+	if !s.config.Write {
+		return errors.New("no clients configured to write")
+	}
+	var ok int
+	var failed []string
+	for _, client := range s.clients {
+		if err := client.PutFile(sha256sum, f); err != nil {
+			logging.Warningf("%s.PutFile(%x) failed: %s", client.GetConfig().Provider, sha256sum, err)
+			failed = append(failed, fmt.Sprintf("%s: %s", client.GetConfig().Provider, err))
+			continue
+		}
+		ok++
+	}
+	if ok < s.config.Replicas {
+		return fmt.Errorf("PutFile(%x) succeeded in %d of %d Replicas: %s", sha256sum, ok, s.config.Replicas, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// ReleaseFile releases the file from every child.
+func (s *Drive) ReleaseFile(sha256sum []byte) error {
+	return release("ReleaseFile", sha256sum, s.clients, func(c drive.Client) error {
+		return c.ReleaseFile(sha256sum)
+	})
+}
+
+// release calls fn on each of the clients, and returns an error describing
+// those which fail.  It continues past failures, so a chunk is released from
+// as many of its replicas as possible; one left behind is listed, and
+// released again, by the next cleanup.
+func release(method string, sha256sum []byte, clients []drive.Client, fn func(drive.Client) error) error {
+	var errs []string
+	for _, client := range clients {
+		provider := client.GetConfig().Provider
+		if err := fn(client); err != nil {
+			logging.Warningf("could not %s %x in %s: %s", method, sha256sum, provider, err)
+			errs = append(errs, fmt.Sprintf("%s: %s", provider, err))
+			continue
+		}
+		logging.V(3).Infof("%s %x in %s succeeded", method, sha256sum, provider)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s %x failed: %s", method, sha256sum, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// GetChunk retrieves the chunk from the first of its replicas which has it.
+func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	for _, client := range s.replicas(sha256sum) {
+		chunk, err := client.GetChunk(sha256sum, f)
+		if err != nil {
+			logging.V(2).Infof("Chunk %x not found in %q: %s", sha256sum, client.GetConfig().Provider, err)
+			continue
+		}
+		return chunk, nil
+	}
+	return nil, errors.New("chunk not found")
+}
+
+// GetChunkRange retrieves part of the chunk from the first of its replicas
+// which has it.
+func (s *Drive) GetChunkRange(sha256sum []byte, f *shade.File, offset, length int64) ([]byte, error) {
+	for _, client := range s.replicas(sha256sum) {
+		chunk, err := drive.GetChunkRange(client, sha256sum, f, offset, length)
+		if err != nil {
+			logging.V(2).Infof("Chunk %x not found in %q: %s", sha256sum, client.GetConfig().Provider, err)
+			continue
+		}
+		return chunk, nil
+	}
+	return nil, errors.New("chunk not found")
+}
+
+// PutChunk writes the chunk to each of its replicas.  It returns an error if
+// any of them fails, as the chunk would be less durable than configured.
+func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
+	if !s.config.Write {
+		return errors.New("no clients configured to write")
+	}
+	for _, client := range s.replicas(sha256sum) {
+		logging.V(3).Infof("client %s putting chunk %x", client.GetConfig().Provider, sha256sum)
+		if err := client.PutChunk(sha256sum, chunk, f); err != nil {
+			return fmt.Errorf("%s: %s", client.GetConfig().Provider, err)
+		}
+	}
+	return nil
+}
+
+// ReleaseChunk releases the chunk from each of its replicas.
+func (s *Drive) ReleaseChunk(sha256sum []byte) error {
+	return release("ReleaseChunk", sha256sum, s.replicas(sha256sum), func(c drive.Client) error {
+		return c.ReleaseChunk(sha256sum)
+	})
+}
+
+// Stat describes the object from the first child which has it.  Files are
+// looked for in every child, not only the replicas of a chunk.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	for _, client := range s.clients {
+		info, err := client.Stat(sha256sum)
+		if err != nil {
+			logging.V(2).Infof("Stat(%x) failed in %q: %s", sha256sum, client.GetConfig().Provider, err)
+			continue
+		}
+		return info, nil
+	}
+	return drive.Info{}, errors.New("chunk not found")
+}
+
+// NewChunkLister returns an iterator which returns each of the chunks known
+// to the children once, however many replicas of it there are.
+func (s *Drive) NewChunkLister() drive.ChunkLister {
+	c := &ChunkLister{seen: make(map[string]bool)}
+	for _, client := range s.clients {
+		c.listers = append(c.listers, client.NewChunkLister())
+	}
+	return c
+}
+
+// ChunkLister iterates the chunks of each child in turn, skipping those
+// already returned from another child.
+type ChunkLister struct {
+	listers []drive.ChunkLister
+	seen    map[string]bool
+	sha256  []byte
+	err     error
+}
+
+// Next advances the iterator to the next chunk not yet returned.  If a child
+// returns an error, iteration stops and it is returned by Err.
+func (c *ChunkLister) Next() bool {
+	for len(c.listers) > 0 {
+		l := c.listers[0]
+		for l.Next() {
+			sum := l.Sha256()
+			if c.seen[string(sum)] {
+				continue
+			}
+			c.seen[string(sum)] = true
+			c.sha256 = sum
+			return true
+		}
+		if c.err = l.Err(); c.err != nil {
+			return false
+		}
+		c.listers = c.listers[1:]
+	}
+	return false
+}
+
+// Sha256 returns the current chunk sum.
+func (c *ChunkLister) Sha256() []byte {
+	return c.sha256
+}
+
+// Err returns the error encountered, if any.
+func (c *ChunkLister) Err() error {
+	return c.err
+}
+
+// Warm passes each chunk to the first of its replicas.
+func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
+	byClient := make(map[drive.Client][][]byte)
+	for _, sum := range chunks {
+		client := s.replicas(sum)[0]
+		byClient[client] = append(byClient[client], sum)
+	}
+	for client, sums := range byClient {
+		client.Warm(sums, f)
+	}
+}
+
+// Space returns the sum of the space of the children whose space is known,
+// divided by Replicas, as each chunk is written to that many of them.
+func (s *Drive) Space() (total, free uint64, err error) {
+	known := false
+	for _, c := range s.clients {
+		t, f, err := drive.Space(c)
+		if err == drive.ErrUnknownSpace {
+			continue
+		} else if err != nil {
+			return 0, 0, err
+		}
+		total += t
+		free += f
+		known = true
+	}
+	if !known {
+		return 0, 0, drive.ErrUnknownSpace
+	}
+	r := uint64(s.config.Replicas)
+	return total / r, free / r, nil
+}
+
+// GetConfig returns the config used to initialize this client.
+func (s *Drive) GetConfig() drive.Config {
+	return s.config
+}
+
+// Local returns true only if all of the children are local.
+func (s *Drive) Local() bool {
+	for _, c := range s.clients {
+		if !c.Local() {
+			return false
+		}
+	}
+	return true
+}
+
+// Persistent returns true only if all of the children are persistent, as
+// each chunk is only stored in some of them.
+func (s *Drive) Persistent() bool {
+	for _, c := range s.clients {
+		if !c.Persistent() {
+			return false
+		}
+	}
+	return true
+}
+
+// Ping pings each of the children, and returns an error describing those
+// which failed, as each holds chunks which are not in the others.
+func (s *Drive) Ping(ctx context.Context) error {
+	var failed []string
+	for _, client := range s.clients {
+		if err := client.Ping(ctx); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", client.GetConfig().Provider, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d clients failed ping: %s", len(failed), len(s.clients), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Flush flushes each of the children, and returns the first error.
+func (s *Drive) Flush() error {
+	var firstErr error
+	for _, client := range s.clients {
+		if err := drive.Flush(client); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %s", client.GetConfig().Provider, err)
+		}
+	}
+	return firstErr
+}
+
+// Close closes each of the children, and returns the first error.
+func (s *Drive) Close() error {
+	var firstErr error
+	for _, client := range s.clients {
+		if err := drive.Close(client); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %s", client.GetConfig().Provider, err)
+		}
+	}
+	return firstErr
+}
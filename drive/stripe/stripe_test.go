@@ -0,0 +1,99 @@
+package stripe
+
+import (
+	"testing"
+
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+func newChildren(t *testing.T, n int) []drive.Client {
+	var children []drive.Client
+	for i := 0; i < n; i++ {
+		mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		children = append(children, mc)
+	}
+	return children
+}
+
+func TestRoundTrip(t *testing.T) {
+	d := newDrive(drive.Config{Provider: "stripe", Replicas: 2}, newChildren(t, 4))
+	drive.TestFileRoundTrip(t, d, 100)
+	drive.TestChunkRoundTrip(t, d, 100)
+	drive.TestChunkLister(t, d, 100)
+	drive.TestRelease(t, d, true)
+}
+
+func TestNewClientTooFewChildren(t *testing.T) {
+	c := drive.Config{Provider: "stripe", Replicas: 3, Children: []drive.Config{
+		{Provider: "memory", Write: true},
+		{Provider: "memory", Write: true},
+	}}
+	if _, err := NewClient(c); err == nil {
+		t.Error("NewClient accepted more Replicas than children")
+	}
+}
+
+// TestReplicas checks that each chunk is stored in exactly the two children
+// it is placed in, and remains readable when any one child is cleared.
+func TestReplicas(t *testing.T) {
+	children := newChildren(t, 5)
+	d := newDrive(drive.Config{Provider: "stripe", Replicas: 2}, children)
+	chunks := drive.RandChunks(50)
+	for sum, chunk := range chunks {
+		if err := d.PutChunk([]byte(sum), chunk, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	used := make(map[drive.Client]bool)
+	for sum := range chunks {
+		want := make(map[drive.Client]bool)
+		for _, c := range d.replicas([]byte(sum)) {
+			want[c] = true
+			used[c] = true
+		}
+		if len(want) != 2 {
+			t.Fatalf("chunk %x is placed in %d distinct children, want 2", sum, len(want))
+		}
+		for i, c := range children {
+			_, err := c.GetChunk([]byte(sum), nil)
+			if got := err == nil; got != want[c] {
+				t.Errorf("chunk %x in child %d: %v, want %v", sum, i, got, want[c])
+			}
+		}
+	}
+	if len(used) != len(children) {
+		t.Errorf("chunks were placed in %d of %d children", len(used), len(children))
+	}
+
+	for cleared := range children {
+		// Replace the child with an empty one, as if its storage were lost.
+		d := newDrive(drive.Config{Provider: "stripe", Replicas: 2}, append([]drive.Client(nil), children...))
+		d.clients[cleared] = newChildren(t, 1)[0]
+		for sum, chunk := range chunks {
+			got, err := d.GetChunk([]byte(sum), nil)
+			if err != nil {
+				t.Errorf("with child %d cleared, GetChunk(%x): %s", cleared, sum, err)
+				continue
+			}
+			if string(got) != string(chunk) {
+				t.Errorf("with child %d cleared, GetChunk(%x) returned the wrong content", cleared, sum)
+			}
+		}
+	}
+
+	for sum := range chunks {
+		if err := d.ReleaseChunk([]byte(sum)); err != nil {
+			t.Fatal(err)
+		}
+		for i, c := range children {
+			if _, err := c.GetChunk([]byte(sum), nil); err == nil {
+				t.Errorf("chunk %x remains in child %d after ReleaseChunk", sum, i)
+			}
+		}
+	}
+}
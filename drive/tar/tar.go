@@ -0,0 +1,362 @@
+// Package tar is a storage backend for Shade which keeps an entire repository
+// in a single tar archive, to make it easy to back up or share.
+//
+// The path to the archive is configured as FileParentID.  Each file and chunk
+// is stored as a tar entry named by its hex encoded sha256sum, below "files/"
+// and "chunks/" respectively.  The archive is indexed when the client is
+// initialized; reads then seek directly to the relevant entry.  If Write is
+// set in the config, new files and chunks are appended to the archive,
+// otherwise it is opened read-only.
+package tar
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+)
+
+const (
+	filesDir  = "files/"
+	chunksDir = "chunks/"
+	// blockSize is the size of a tar header, and the unit entries are padded
+	// to.
+	blockSize = 512
+)
+
+func init() {
+	drive.RegisterProvider("tar", NewClient)
+}
+
+// NewClient opens the tar archive at c.FileParentID and returns a client
+// which serves the files and chunks it contains.  If c.Write is set, the
+// archive is created if it does not already exist.
+func NewClient(c drive.Config) (drive.Client, error) {
+	if c.FileParentID == "" {
+		return nil, errors.New("specify the path to the tar archive as FileParentID")
+	}
+	if c.MaxFiles > 0 || c.MaxChunkBytes > 0 {
+		return nil, errors.New("tar archives are append-only; MaxFiles and MaxChunkBytes are not supported")
+	}
+	flags := os.O_RDONLY
+	if c.Write {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+	fh, err := os.OpenFile(c.FileParentID, flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &Drive{
+		config: c,
+		fh:     fh,
+		files:  make(map[string]entry),
+		chunks: make(map[string]entry),
+	}
+	if err := s.index(); err != nil {
+		fh.Close()
+		return nil, fmt.Errorf("indexing %s: %s", c.FileParentID, err)
+	}
+	return s, nil
+}
+
+// Drive implements the drive.Client interface by storing Files and Chunks as
+// entries in a tar archive.
+type Drive struct {
+	sync.RWMutex // protects the fields below, and the offset of fh
+	config       drive.Config
+	fh           *os.File
+	files        map[string]entry // keyed by string(sha256sum)
+	chunks       map[string]entry // keyed by string(sha256sum)
+	fileOrder    [][]byte         // sha256sums, in archive order
+	chunkOrder   [][]byte         // sha256sums, in archive order
+	// end is the offset of the end of the last entry in the archive, where
+	// the next entry will be appended.
+	end int64
+}
+
+// entry describes where the contents of a tar entry lives in the archive.
+type entry struct {
+	offset  int64
+	size    int64
+	modTime time.Time
+}
+
+// countingReader tracks how many bytes have been read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// index reads the headers of every entry in the archive, and notes where the
+// contents of each file and chunk can be found.
+func (s *Drive) index() error {
+	cr := &countingReader{r: s.fh}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// Next has consumed exactly the header blocks of this entry.
+		e := entry{offset: cr.n, size: hdr.Size, modTime: hdr.ModTime}
+		s.end = e.offset + padded(e.size)
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		var dir string
+		switch {
+		case strings.HasPrefix(hdr.Name, filesDir):
+			dir = filesDir
+		case strings.HasPrefix(hdr.Name, chunksDir):
+			dir = chunksDir
+		default:
+			logging.V(2).Infof("skipping unknown tar entry: %s", hdr.Name)
+			continue
+		}
+		sum, err := hex.DecodeString(strings.TrimPrefix(hdr.Name, dir))
+		if err != nil {
+			logging.Warningf("tar entry with non-hex name: %s", hdr.Name)
+			continue
+		}
+		s.add(dir, sum, e)
+	}
+	return nil
+}
+
+// add records the location of a file or chunk.  If sum was already present
+// in the archive, the later copy is used.
+func (s *Drive) add(dir string, sum []byte, e entry) {
+	m, order := s.files, &s.fileOrder
+	if dir == chunksDir {
+		m, order = s.chunks, &s.chunkOrder
+	}
+	if _, ok := m[string(sum)]; !ok {
+		*order = append(*order, sum)
+	}
+	m[string(sum)] = e
+}
+
+// padded returns size rounded up to a multiple of the tar block size.
+func padded(size int64) int64 {
+	return (size + blockSize - 1) / blockSize * blockSize
+}
+
+// ListFiles retrieves all of the File objects in the archive.
+func (s *Drive) ListFiles() ([][]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	resp := make([][]byte, len(s.fileOrder))
+	copy(resp, s.fileOrder)
+	return resp, nil
+}
+
+// GetFile retrieves a file with a given SHA-256 sum.
+func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	e, ok := s.files[string(sha256sum)]
+	if !ok {
+		return nil, errors.New("file not found")
+	}
+	return s.read(e)
+}
+
+// PutFile appends a file to the archive.
+func (s *Drive) PutFile(sha256sum, data []byte) error {
+	return s.put(filesDir, sha256sum, data)
+}
+
+// ReleaseFile is a no-op; entries are never removed from the archive.
+func (s *Drive) ReleaseFile(sha256sum []byte) error {
+	return nil
+}
+
+// GetChunk retrieves a chunk with a given SHA-256 sum.
+func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	e, ok := s.chunks[string(sha256sum)]
+	if !ok {
+		return nil, errors.New("chunk not found")
+	}
+	return s.read(e)
+}
+
+// GetChunkRange reads part of a chunk from the archive.
+func (s *Drive) GetChunkRange(sha256sum []byte, f *shade.File, offset, length int64) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	e, ok := s.chunks[string(sha256sum)]
+	if !ok {
+		return nil, errors.New("chunk not found")
+	}
+	if offset >= e.size {
+		return []byte{}, nil
+	}
+	if offset+length > e.size {
+		length = e.size - offset
+	}
+	return s.read(entry{offset: e.offset + offset, size: length})
+}
+
+// PutChunk appends a chunk to the archive.
+func (s *Drive) PutChunk(sha256sum []byte, data []byte, f *shade.File) error {
+	return s.put(chunksDir, sha256sum, data)
+}
+
+// ReleaseChunk is a no-op; entries are never removed from the archive.
+func (s *Drive) ReleaseChunk(sha256sum []byte) error {
+	return nil
+}
+
+// Stat returns the size and mtime of a file or chunk in the archive.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, m := range []map[string]entry{s.files, s.chunks} {
+		if e, ok := m[string(sha256sum)]; ok {
+			return drive.Info{Size: e.size, ModTime: e.modTime}, nil
+		}
+	}
+	return drive.Info{}, errors.New("not found in tar archive")
+}
+
+// read returns the contents of the entry.  The caller must hold at least a
+// read lock.
+func (s *Drive) read(e entry) ([]byte, error) {
+	data := make([]byte, e.size)
+	if _, err := s.fh.ReadAt(data, e.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// put appends an entry to the end of the archive, overwriting the previous
+// end-of-archive marker, and then writes a new marker after it.
+func (s *Drive) put(dir string, sha256sum, data []byte) error {
+	if !s.config.Write {
+		return errors.New("tar archive is not configured for writing")
+	}
+	s.Lock()
+	defer s.Unlock()
+	m := s.files
+	if dir == chunksDir {
+		m = s.chunks
+	}
+	if _, ok := m[string(sha256sum)]; ok {
+		return nil
+	}
+
+	if _, err := s.fh.Seek(s.end, io.SeekStart); err != nil {
+		return err
+	}
+	tw := tar.NewWriter(s.fh)
+	hdr := &tar.Header{
+		Name:     dir + hex.EncodeToString(sha256sum),
+		Mode:     0400,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("writing tar header: %s", err)
+	}
+	offset, err := s.fh.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("writing tar entry: %s", err)
+	}
+	// Close pads the entry and writes the end-of-archive marker, which the
+	// next put will overwrite.
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("finishing tar entry: %s", err)
+	}
+	e := entry{offset: offset, size: int64(len(data)), modTime: hdr.ModTime}
+	s.end = offset + padded(e.size)
+	s.add(dir, sha256sum, e)
+	return nil
+}
+
+// Warm is unnecessary for this client.
+func (s *Drive) Warm(chunks [][]byte, f *shade.File) {}
+
+// GetConfig returns the config used to initialize this client.
+func (s *Drive) GetConfig() drive.Config {
+	return s.config
+}
+
+// Local returns whether the storage is local to this machine.
+func (s *Drive) Local() bool { return true }
+
+// Persistent returns whether the storage is persistent across task restarts.
+func (s *Drive) Persistent() bool { return true }
+
+// Ping checks that the archive is still readable.
+func (s *Drive) Ping(ctx context.Context) error {
+	s.RLock()
+	defer s.RUnlock()
+	_, err := s.fh.Stat()
+	return err
+}
+
+// NewChunkLister returns an iterator which lists the chunks in the archive.
+func (s *Drive) NewChunkLister() drive.ChunkLister {
+	s.RLock()
+	defer s.RUnlock()
+	sums := make([][]byte, len(s.chunkOrder))
+	copy(sums, s.chunkOrder)
+	return &ChunkLister{sums: sums}
+}
+
+// ChunkLister allows iterating the chunks in the archive.
+type ChunkLister struct {
+	sums [][]byte
+	ptr  int
+}
+
+// Next increments the pointer.
+func (c *ChunkLister) Next() bool {
+	c.ptr++
+	return c.ptr <= len(c.sums)
+}
+
+// Sha256 returns the chunk pointed to by the pointer.
+func (c *ChunkLister) Sha256() []byte {
+	if c.ptr > len(c.sums) {
+		return nil
+	}
+	return c.sums[c.ptr-1]
+}
+
+// Err returns precisely no errors.
+func (c *ChunkLister) Err() error {
+	return nil
+}
+
+// Close closes the underlying archive.
+func (s *Drive) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.fh.Close()
+}
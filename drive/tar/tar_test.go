@@ -0,0 +1,177 @@
+package tar
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+)
+
+func newTestClient(t *testing.T) (drive.Client, func()) {
+	dir, err := ioutil.TempDir("", "tarTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(drive.Config{
+		Provider:     "tar",
+		FileParentID: path.Join(dir, "shade.tar"),
+		Write:        true,
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("initializing client: %s", err)
+	}
+	return c, func() {
+		c.(*Drive).Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+	drive.TestFileRoundTrip(t, c, 100)
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+	drive.TestChunkRoundTrip(t, c, 100)
+}
+
+func TestParallelRoundTrip(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+	drive.TestParallelRoundTrip(t, c, 10)
+}
+
+func TestChunkLister(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+	drive.TestChunkLister(t, c, 100)
+}
+
+func TestChunkRange(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+	drive.TestChunkRange(t, c)
+}
+
+func TestStat(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+	drive.TestStat(t, c)
+}
+
+func TestRelease(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+	drive.TestRelease(t, c, false)
+}
+
+// TestReopen ensures files and chunks written to an archive can be read back
+// after it is reopened, both for reading and for further appends.
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tarTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := drive.Config{
+		Provider:     "tar",
+		FileParentID: path.Join(dir, "shade.tar"),
+		Write:        true,
+	}
+
+	files := drive.RandChunks(5)
+	chunks := drive.RandChunks(20)
+	put := func(c drive.Client, files, chunks map[string][]byte) {
+		for sum, data := range files {
+			if err := c.PutFile([]byte(sum), data); err != nil {
+				t.Fatalf("PutFile(%x): %s", sum, err)
+			}
+		}
+		for sum, data := range chunks {
+			if err := c.PutChunk([]byte(sum), data, nil); err != nil {
+				t.Fatalf("PutChunk(%x): %s", sum, err)
+			}
+		}
+	}
+	check := func(c drive.Client, files, chunks map[string][]byte) {
+		listed, err := c.ListFiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listed) != len(files) {
+			t.Errorf("want %d files, got: %d", len(files), len(listed))
+		}
+		for sum, want := range files {
+			got, err := c.GetFile([]byte(sum))
+			if err != nil {
+				t.Errorf("GetFile(%x): %s", sum, err)
+				continue
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("GetFile(%x) returned the wrong contents", sum)
+			}
+		}
+		var n int
+		for cl := c.NewChunkLister(); cl.Next(); n++ {
+		}
+		if n != len(chunks) {
+			t.Errorf("want %d chunks, got: %d", len(chunks), n)
+		}
+		for sum, want := range chunks {
+			got, err := c.GetChunk([]byte(sum), nil)
+			if err != nil {
+				t.Errorf("GetChunk(%x): %s", sum, err)
+				continue
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("GetChunk(%x) returned the wrong contents", sum)
+			}
+		}
+	}
+
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(c, files, chunks)
+	// Putting duplicates does not add more entries.
+	put(c, files, chunks)
+	c.(*Drive).Close()
+
+	// Reopen the archive and append more.
+	c, err = NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c, files, chunks)
+	moreFiles := drive.RandChunks(3)
+	moreChunks := drive.RandChunks(7)
+	put(c, moreFiles, moreChunks)
+	c.(*Drive).Close()
+	for sum, data := range moreFiles {
+		files[sum] = data
+	}
+	for sum, data := range moreChunks {
+		chunks[sum] = data
+	}
+
+	// Reopen it read-only, and ensure everything is still present.
+	config.Write = false
+	c, err = NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.(*Drive).Close()
+	check(c, files, chunks)
+	if err := c.PutChunk(shade.Sum([]byte("x")), []byte("x"), nil); err == nil {
+		t.Error("PutChunk succeeded on a read-only archive")
+	}
+}
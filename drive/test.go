@@ -8,6 +8,8 @@ package drive
 import (
 	"bytes"
 	"crypto/rand"
+	"fmt"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -186,6 +188,85 @@ func TestChunkRoundTrip(t *testing.T, c Client, numChunks uint64) {
 	}
 }
 
+// TestStat stores a file and a chunk of different sizes in the client, and
+// ensures Stat reports the size of each.  Stat of an unknown sum must fail.
+func TestStat(t *testing.T, c Client) {
+	fileBytes := []byte("a small file object")
+	fileSum := shade.Sum(fileBytes)
+	if err := c.PutFile(fileSum, fileBytes); err != nil {
+		t.Fatalf("Failed to put file %x: %s", fileSum, err)
+	}
+	defer c.ReleaseFile(fileSum)
+
+	chunkSum, chunkBytes := RandChunk()
+	file := shade.NewFile("testfile")
+	chunk := shade.NewChunk()
+	chunk.Sha256 = chunkSum
+	file.Chunks = append(file.Chunks, chunk)
+	if err := c.PutChunk(chunkSum, chunkBytes, file); err != nil {
+		t.Fatalf("Failed to put chunk %x: %s", chunkSum, err)
+	}
+	defer c.ReleaseChunk(chunkSum)
+
+	for sum, want := range map[string]int{
+		string(fileSum):  len(fileBytes),
+		string(chunkSum): len(chunkBytes),
+	} {
+		info, err := c.Stat([]byte(sum))
+		if err != nil {
+			t.Errorf("Stat(%x): %s", sum, err)
+			continue
+		}
+		if info.Size != int64(want) {
+			t.Errorf("Stat(%x).Size: want %d, got: %d", sum, want, info.Size)
+		}
+	}
+	if _, err := c.Stat(shade.Sum([]byte("not stored"))); err == nil {
+		t.Errorf("Stat of an unknown sum succeeded")
+	}
+}
+
+// TestChunkRange stores a random chunk in the client, then ensures
+// GetChunkRange returns the same bytes as slicing the result of GetChunk, for
+// ranges at the start, middle and end of the chunk, and past its end.
+func TestChunkRange(t *testing.T, c Client) {
+	sum, data := RandChunk()
+	file := shade.NewFile("testfile")
+	chunk := shade.NewChunk()
+	chunk.Sha256 = sum
+	file.Chunks = append(file.Chunks, chunk)
+	file.LastChunksize = int(chunkSize)
+	if err := c.PutChunk(sum, data, file); err != nil {
+		t.Fatalf("Failed to put chunk %x: %s", sum, err)
+	}
+	defer c.ReleaseChunk(sum)
+
+	full, err := c.GetChunk(sum, file)
+	if err != nil {
+		t.Fatalf("Failed to fetch chunk %x: %s", sum, err)
+	}
+	size := int64(len(full))
+	for _, r := range []struct{ offset, length int64 }{
+		{0, 1},
+		{0, 4096},
+		{1, 4096},
+		{size / 2, 100},
+		{size - 10, 10},
+		{size - 10, 100}, // extends past the end
+		{0, size},
+		{size, 10}, // entirely past the end
+	} {
+		got, err := GetChunkRange(c, sum, file, r.offset, r.length)
+		if err != nil {
+			t.Errorf("GetChunkRange(%d, %d): %s", r.offset, r.length, err)
+			continue
+		}
+		if want := SliceRange(full, r.offset, r.length); !bytes.Equal(got, want) {
+			t.Errorf("GetChunkRange(%d, %d) returned %d bytes which differ from GetChunk (%d bytes)", r.offset, r.length, len(got), len(want))
+		}
+	}
+}
+
 // TestParallelRoundTrip calls 4 copies of both test functions in parallel, to
 // try to tickle race conditions in the implementation.
 func TestParallelRoundTrip(t *testing.T, c Client, n uint64) {
@@ -385,3 +466,170 @@ func RandChunk() ([]byte, []byte) {
 	rand.Read(c)
 	return shade.Sum(c), c
 }
+
+// benchConcurrency are the numbers of concurrent callers BenchmarkClient
+// measures each operation with.
+var benchConcurrency = []int{1, 8}
+
+// benchRound is the number of chunks BenchmarkClient generates while its timer
+// is stopped, and releases afterwards, so the chunks stored by a long
+// benchmark do not accumulate in the client.
+const benchRound = 64
+
+// BenchmarkClient measures the throughput and latency of PutChunk and
+// GetChunk of c, with chunks of each of the given sizes, in bytes, and with
+// each of 1 and 8 concurrent callers.  Each is run as a sub-benchmark named
+// eg. "PutChunk/size=65536/concurrency=8", which reports its throughput in
+// MB/s, and the 50th, 90th and 99th percentile latency of a single call as
+// p50-ns, p90-ns and p99-ns.  The output of `go test -bench` is in the
+// standard benchmark format, which may be compared with eg. benchstat.
+//
+// The chunks are generated and released while the timer is stopped.
+func BenchmarkClient(b *testing.B, c Client, sizes []int) {
+	for _, size := range sizes {
+		for _, n := range benchConcurrency {
+			size, n := size, n
+			b.Run(fmt.Sprintf("PutChunk/size=%d/concurrency=%d", size, n), func(b *testing.B) {
+				benchPutChunk(b, c, size, n)
+			})
+			b.Run(fmt.Sprintf("GetChunk/size=%d/concurrency=%d", size, n), func(b *testing.B) {
+				benchGetChunk(b, c, size, n)
+			})
+		}
+	}
+}
+
+// benchPutChunk stores b.N new chunks of size bytes in c, in rounds of
+// benchRound, with n concurrent callers.
+func benchPutChunk(b *testing.B, c Client, size, n int) {
+	b.SetBytes(int64(size))
+	f := shade.NewFile("benchmark")
+	lat := &latencies{}
+	b.ResetTimer()
+	for done := 0; done < b.N; {
+		b.StopTimer()
+		round := b.N - done
+		if round > benchRound {
+			round = benchRound
+		}
+		sums, chunks := benchChunks(round, size)
+		b.StartTimer()
+		err := runConcurrently(round, n, lat, func(i int) error {
+			return c.PutChunk(sums[i], chunks[i], f)
+		})
+		b.StopTimer()
+		if err != nil {
+			b.Fatalf("PutChunk: %s", err)
+		}
+		releaseChunks(c, sums)
+		done += round
+		b.StartTimer()
+	}
+	b.StopTimer()
+	lat.report(b)
+}
+
+// benchGetChunk stores benchRound chunks of size bytes in c, then retrieves
+// them b.N times in turn, with n concurrent callers.
+func benchGetChunk(b *testing.B, c Client, size, n int) {
+	b.SetBytes(int64(size))
+	f := shade.NewFile("benchmark")
+	sums, chunks := benchChunks(benchRound, size)
+	for i := range sums {
+		if err := c.PutChunk(sums[i], chunks[i], f); err != nil {
+			b.Fatalf("PutChunk: %s", err)
+		}
+	}
+	defer releaseChunks(c, sums)
+	lat := &latencies{}
+	b.ResetTimer()
+	err := runConcurrently(b.N, n, lat, func(i int) error {
+		_, err := c.GetChunk(sums[i%len(sums)], f)
+		return err
+	})
+	b.StopTimer()
+	if err != nil {
+		b.Fatalf("GetChunk: %s", err)
+	}
+	lat.report(b)
+}
+
+// benchChunks returns n random chunks of size bytes, and their sums.
+func benchChunks(n, size int) (sums, chunks [][]byte) {
+	for i := 0; i < n; i++ {
+		c := make([]byte, size)
+		rand.Read(c)
+		sums = append(sums, shade.Sum(c))
+		chunks = append(chunks, c)
+	}
+	return sums, chunks
+}
+
+// releaseChunks releases each of sums from c, ignoring errors, as a client
+// which does not release chunks may still be benchmarked.
+func releaseChunks(c Client, sums [][]byte) {
+	for _, sum := range sums {
+		c.ReleaseChunk(sum)
+	}
+}
+
+// runConcurrently calls fn with each of 0 through calls-1, from n goroutines,
+// and records the latency of each call in lat.  It returns the first error.
+func runConcurrently(calls, n int, lat *latencies, fn func(i int) error) error {
+	next := make(chan int)
+	go func() {
+		for i := 0; i < calls; i++ {
+			next <- i
+		}
+		close(next)
+	}()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				start := time.Now()
+				err := fn(i)
+				lat.add(time.Since(start))
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// latencies collects the duration of each call made by a benchmark.
+type latencies struct {
+	mu sync.Mutex
+	d  []time.Duration
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.d = append(l.d, d)
+}
+
+// report reports the 50th, 90th and 99th percentile latencies to b.
+func (l *latencies) report(b *testing.B) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.d) == 0 {
+		return
+	}
+	sort.Slice(l.d, func(i, j int) bool { return l.d[i] < l.d[j] })
+	for _, p := range []int{50, 90, 99} {
+		d := l.d[(len(l.d)-1)*p/100]
+		b.ReportMetric(float64(d.Nanoseconds()), fmt.Sprintf("p%d-ns", p))
+	}
+}
@@ -0,0 +1,213 @@
+// Package throttle limits the bandwidth used to transfer files and chunks.
+//
+// It provides a token bucket Limiter, io.Reader and io.Writer wrappers which
+// apply a Limiter, and a drive.Client wrapper which applies Limiters to the
+// bytes passed to PutFile and PutChunk, and returned from GetFile and
+// GetChunk.
+package throttle
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+)
+
+// Limiter is a token bucket which refills at a fixed number of bytes per
+// second, up to one second's worth of bytes.  A nil *Limiter does not limit.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64 // may go negative, for transfers larger than the bucket
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter which allows bytesPerSec bytes per second.  If
+// bytesPerSec is not positive, it returns nil, which does not limit.
+func NewLimiter(bytesPerSec int) *Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until n bytes may be transferred.
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// NewReader returns an io.Reader which reads from r no faster than l allows.
+func NewReader(r io.Reader, l *Limiter) io.Reader {
+	return &reader{r, l}
+}
+
+type reader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.l.Wait(n)
+	return n, err
+}
+
+// NewWriter returns an io.Writer which writes to w no faster than l allows.
+func NewWriter(w io.Writer, l *Limiter) io.Writer {
+	return &writer{w, l}
+}
+
+type writer struct {
+	w io.Writer
+	l *Limiter
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.l.Wait(len(p))
+	return w.w.Write(p)
+}
+
+// Wrap returns a drive.Client which limits the bytes written to client by
+// upload, and the bytes read from client by download.  Either Limiter may be
+// nil.  If both are nil, client is returned unchanged.
+func Wrap(client drive.Client, upload, download *Limiter) drive.Client {
+	if upload == nil && download == nil {
+		return client
+	}
+	return &Drive{client: client, upload: upload, download: download}
+}
+
+// Drive implements the drive.Client interface by passing each request to its
+// child client, after waiting on the appropriate Limiter.
+type Drive struct {
+	client   drive.Client
+	upload   *Limiter
+	download *Limiter
+}
+
+// ListFiles is passed to the child client, without limit.
+func (s *Drive) ListFiles() ([][]byte, error) {
+	return s.client.ListFiles()
+}
+
+// ListFilesSince is passed to the child client, without limit.
+func (s *Drive) ListFilesSince(token string) ([][]byte, string, error) {
+	return drive.ListFilesSince(s.client, token)
+}
+
+// GetFile retrieves the file from the child client, limited by download.
+func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	f, err := s.client.GetFile(sha256sum)
+	s.download.Wait(len(f))
+	return f, err
+}
+
+// PutFile writes the file to the child client, limited by upload.
+func (s *Drive) PutFile(sha256sum, f []byte) error {
+	s.upload.Wait(len(f))
+	return s.client.PutFile(sha256sum, f)
+}
+
+// ReleaseFile is passed to the child client.
+func (s *Drive) ReleaseFile(sha256sum []byte) error {
+	return s.client.ReleaseFile(sha256sum)
+}
+
+// GetChunk retrieves the chunk from the child client, limited by download.
+func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	c, err := s.client.GetChunk(sha256sum, f)
+	s.download.Wait(len(c))
+	return c, err
+}
+
+// GetChunkRange reads part of a chunk from the child client, limited by
+// download.
+func (s *Drive) GetChunkRange(sha256sum []byte, f *shade.File, offset, length int64) ([]byte, error) {
+	c, err := drive.GetChunkRange(s.client, sha256sum, f, offset, length)
+	s.download.Wait(len(c))
+	return c, err
+}
+
+// PutChunk writes the chunk to the child client, limited by upload.
+func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
+	s.upload.Wait(len(chunk))
+	return s.client.PutChunk(sha256sum, chunk, f)
+}
+
+// Stat is passed to the child client.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	return s.client.Stat(sha256sum)
+}
+
+// ReleaseChunk is passed to the child client.
+func (s *Drive) ReleaseChunk(sha256sum []byte) error {
+	return s.client.ReleaseChunk(sha256sum)
+}
+
+// Warm is passed to the child client.
+func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
+	s.client.Warm(chunks, f)
+}
+
+// Space returns the space of the child client.
+func (s *Drive) Space() (total, free uint64, err error) {
+	return drive.Space(s.client)
+}
+
+// SetProperties sets the properties of an object of the child client.
+func (s *Drive) SetProperties(sha256sum []byte, props map[string]string) error {
+	return drive.SetProperties(s.client, sha256sum, props)
+}
+
+// Properties returns the properties of an object of the child client.
+func (s *Drive) Properties(sha256sum []byte) (map[string]string, error) {
+	return drive.Properties(s.client, sha256sum)
+}
+
+// GetConfig returns the config of the child client.
+func (s *Drive) GetConfig() drive.Config {
+	return s.client.GetConfig()
+}
+
+// Local returns whether the child client is local to this machine.
+func (s *Drive) Local() bool { return s.client.Local() }
+
+// Persistent returns whether the child client is persistent.
+func (s *Drive) Persistent() bool { return s.client.Persistent() }
+
+// Flush flushes the child client.
+func (s *Drive) Flush() error { return drive.Flush(s.client) }
+
+// Close closes the child client.
+func (s *Drive) Close() error { return drive.Close(s.client) }
+
+// Ping pings the child client.
+func (s *Drive) Ping(ctx context.Context) error { return s.client.Ping(ctx) }
+
+// NewChunkLister returns the child client's ChunkLister.
+func (s *Drive) NewChunkLister() drive.ChunkLister {
+	return s.client.NewChunkLister()
+}
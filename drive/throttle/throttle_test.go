@@ -0,0 +1,69 @@
+package throttle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+const rate = 1000 * 1000 // bytes per second
+
+func TestRoundTrip(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	tc := Wrap(mc, NewLimiter(100*rate), NewLimiter(100*rate))
+	drive.TestFileRoundTrip(t, tc, 100)
+	drive.TestChunkRoundTrip(t, tc, 100)
+}
+
+func TestPutChunkIsLimited(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	tc := Wrap(mc, NewLimiter(rate), nil)
+	start := time.Now()
+	// One second worth of bytes are allowed immediately, the next half second
+	// worth must wait.
+	for i := 0; i < 15; i++ {
+		chunk := make([]byte, rate/10)
+		rand.Read(chunk)
+		if err := tc.PutChunk(shade.Sum(chunk), chunk, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("1.5MB at 1MB/s took %s, want at least 500ms", elapsed)
+	}
+}
+
+func TestReaderIsLimited(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), rate*3/2)
+	start := time.Now()
+	r := NewReader(bytes.NewReader(data), NewLimiter(rate))
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("1.5MB at 1MB/s took %s, want at least 500ms", elapsed)
+	}
+}
+
+func TestNilLimiterIsUnlimited(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	if Wrap(mc, NewLimiter(0), nil) != mc {
+		t.Errorf("Wrap() without limits did not return the child client")
+	}
+}
@@ -5,6 +5,7 @@
 package win
 
 import (
+	"context"
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
 )
@@ -55,6 +56,11 @@ func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
 	return nil
 }
 
+// Stat returns no data, no error, every time.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	return drive.Info{}, nil
+}
+
 // ReleaseChunk returns success, every time.
 func (s *Drive) ReleaseChunk(sha256sum []byte) error {
 	return nil
@@ -76,6 +82,9 @@ func (s *Drive) Local() bool { return s.config.OAuth.ClientID == "" }
 // Persistent returns whether the storage is persistent across task restarts.
 func (s *Drive) Persistent() bool { return s.config.OAuth.ClientID != "" }
 
+// Ping returns success, every time.
+func (s *Drive) Ping(ctx context.Context) error { return nil }
+
 // NewChunkLister returns an iterator which returns no chunks, no errors.
 func (s *Drive) NewChunkLister() drive.ChunkLister {
 	return &ChunkLister{}
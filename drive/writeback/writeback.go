@@ -0,0 +1,397 @@
+// Package writeback is a storage backend for Shade which acknowledges writes
+// once they reach a fast child client, and copies them to slower children in
+// the background.
+//
+// The first of the configured Children is the fast child.  Writes to it are
+// synchronous, and their errors are returned to the caller.  Writes to each of
+// the other children are queued in memory, and performed in order by a
+// goroutine per child, retrying failures up to --writebackRetries times.
+// Reads are served by the first child which has the object.
+//
+// Durability: a write which has returned has only been stored by the fast
+// child.  If the process exits before the queues drain, or a queued write
+// exhausts its retries, the slow children will never receive that data;
+// nothing is persisted about the queue itself.  Binaries must call Flush (see
+// drive.Flush) before exiting.  `shadeutil sync` can be used to copy anything
+// which was missed from the fast child to a slow one.  For this reason, a
+// writeback client reports itself as Persistent only if the fast child is.
+//
+// The number of queued writes is exported as the writebackQueueDepth expvar.
+package writeback
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+	"github.com/jpillora/backoff"
+)
+
+var (
+	maxRetries = flag.Int("writebackRetries", 10, "The number of times to try each background write to a slow child.")
+
+	queueDepth     = expvar.NewInt("writebackQueueDepth")
+	failedWrites   = expvar.NewInt("writebackFailedWrites")
+	completeWrites = expvar.NewInt("writebackCompleteWrites")
+)
+
+func init() {
+	drive.RegisterProvider("writeback", NewClient)
+}
+
+// NewClient returns a Drive client which writes synchronously to the first of
+// the configured Children, and asynchronously to the rest.
+func NewClient(c drive.Config) (drive.Client, error) {
+	if len(c.Children) < 2 {
+		return nil, errors.New("writeback requires a fast child and at least one slow child")
+	}
+	var clients []drive.Client
+	for _, conf := range c.Children {
+		child, err := drive.NewClient(conf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", conf.Provider, err)
+		}
+		clients = append(clients, child)
+	}
+	return newDrive(c, clients[0], clients[1:]), nil
+}
+
+func newDrive(c drive.Config, fast drive.Client, slow []drive.Client) *Drive {
+	c.Write = fast.GetConfig().Write
+	d := &Drive{config: c, fast: fast}
+	for _, client := range slow {
+		q := newQueue(client)
+		go q.run()
+		d.queues = append(d.queues, q)
+	}
+	return d
+}
+
+// Drive implements the drive.Client interface by writing to a fast child,
+// and queueing writes to slow children.
+type Drive struct {
+	config drive.Config
+	fast   drive.Client
+	queues []*queue
+}
+
+// clients returns the fast child, followed by the slow children.
+func (s *Drive) clients() []drive.Client {
+	clients := []drive.Client{s.fast}
+	for _, q := range s.queues {
+		clients = append(clients, q.client)
+	}
+	return clients
+}
+
+// enqueue adds o to the queue of each slow child.
+func (s *Drive) enqueue(o op) {
+	for _, q := range s.queues {
+		q.push(o)
+	}
+}
+
+// ListFiles returns the union of the files known to all the children.
+func (s *Drive) ListFiles() ([][]byte, error) {
+	seen := make(map[string]bool)
+	var resp [][]byte
+	var errs int
+	for _, client := range s.clients() {
+		files, err := client.ListFiles()
+		if err != nil {
+			logging.Warningf("%s.ListFiles(): %s", client.GetConfig().Provider, err)
+			errs++
+			continue
+		}
+		for _, sum := range files {
+			if !seen[string(sum)] {
+				seen[string(sum)] = true
+				resp = append(resp, sum)
+			}
+		}
+	}
+	if errs == len(s.queues)+1 {
+		return nil, errors.New("ListFiles failed for every child")
+	}
+	return resp, nil
+}
+
+// GetFile retrieves a file from the first child which has it.
+func (s *Drive) GetFile(sha256sum []byte) ([]byte, error) {
+	for _, client := range s.clients() {
+		if f, err := client.GetFile(sha256sum); err == nil {
+			return f, nil
+		}
+	}
+	return nil, errors.New("file not found")
+}
+
+// PutFile writes the file to the fast child, and queues it for the others.
+func (s *Drive) PutFile(sha256sum, content []byte) error {
+	if err := s.fast.PutFile(sha256sum, content); err != nil {
+		return err
+	}
+	s.enqueue(op{kind: putFile, sum: sha256sum, data: content})
+	return nil
+}
+
+// ReleaseFile releases the file from the fast child, and queues the release
+// for the others, after any queued write of the same file.
+func (s *Drive) ReleaseFile(sha256sum []byte) error {
+	if err := s.fast.ReleaseFile(sha256sum); err != nil {
+		return err
+	}
+	s.enqueue(op{kind: releaseFile, sum: sha256sum})
+	return nil
+}
+
+// GetChunk retrieves a chunk from the first child which has it.
+func (s *Drive) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	for _, client := range s.clients() {
+		if c, err := client.GetChunk(sha256sum, f); err == nil {
+			return c, nil
+		}
+	}
+	return nil, errors.New("chunk not found")
+}
+
+// PutChunk writes the chunk to the fast child, and queues it for the others.
+func (s *Drive) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
+	if err := s.fast.PutChunk(sha256sum, chunk, f); err != nil {
+		return err
+	}
+	s.enqueue(op{kind: putChunk, sum: sha256sum, data: chunk, file: f})
+	return nil
+}
+
+// ReleaseChunk releases the chunk from the fast child, and queues the release
+// for the others, after any queued write of the same chunk.
+func (s *Drive) ReleaseChunk(sha256sum []byte) error {
+	if err := s.fast.ReleaseChunk(sha256sum); err != nil {
+		return err
+	}
+	s.enqueue(op{kind: releaseChunk, sum: sha256sum})
+	return nil
+}
+
+// Stat describes the object from the first child which has it.
+func (s *Drive) Stat(sha256sum []byte) (drive.Info, error) {
+	for _, client := range s.clients() {
+		if info, err := client.Stat(sha256sum); err == nil {
+			return info, nil
+		}
+	}
+	return drive.Info{}, errors.New("chunk not found")
+}
+
+// NewChunkLister lists the chunks of the fast child.
+func (s *Drive) NewChunkLister() drive.ChunkLister {
+	return s.fast.NewChunkLister()
+}
+
+// Warm is passed to all the children.
+func (s *Drive) Warm(chunks [][]byte, f *shade.File) {
+	for _, client := range s.clients() {
+		client.Warm(chunks, f)
+	}
+}
+
+// Space returns the space of the child with the least free space, as every
+// chunk is eventually written to all of them.
+func (s *Drive) Space() (total, free uint64, err error) {
+	return drive.MinSpace(s.clients())
+}
+
+// GetConfig returns the config used to initialize this client.
+func (s *Drive) GetConfig() drive.Config {
+	return s.config
+}
+
+// Local returns true only if all of the children are local.
+func (s *Drive) Local() bool {
+	for _, client := range s.clients() {
+		if !client.Local() {
+			return false
+		}
+	}
+	return true
+}
+
+// Persistent returns whether the fast child is persistent.  The slow children
+// are not consulted, as writes to them may be lost.
+func (s *Drive) Persistent() bool {
+	return s.fast.Persistent()
+}
+
+// Ping pings all of the children.
+func (s *Drive) Ping(ctx context.Context) error {
+	for _, client := range s.clients() {
+		if err := client.Ping(ctx); err != nil {
+			return fmt.Errorf("%s: %s", client.GetConfig().Provider, err)
+		}
+	}
+	return nil
+}
+
+// Flush blocks until every queued write has completed, or failed, and then
+// flushes the children.  It returns an error if any writes were abandoned
+// since the last call to Flush.
+func (s *Drive) Flush() error {
+	var failed int
+	for _, q := range s.queues {
+		failed += q.flush()
+	}
+	for _, client := range s.clients() {
+		if err := drive.Flush(client); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d background writes failed", failed)
+	}
+	return nil
+}
+
+// Close flushes the queued writes, stops the goroutines which perform them,
+// and closes the children.  It returns the first error.
+func (s *Drive) Close() error {
+	err := s.Flush()
+	for _, q := range s.queues {
+		q.close()
+	}
+	for _, client := range s.clients() {
+		if cerr := drive.Close(client); cerr != nil && err == nil {
+			err = fmt.Errorf("%s: %s", client.GetConfig().Provider, cerr)
+		}
+	}
+	return err
+}
+
+type opKind int
+
+const (
+	putFile opKind = iota
+	releaseFile
+	putChunk
+	releaseChunk
+)
+
+// op is a write queued for a slow child.
+type op struct {
+	kind opKind
+	sum  []byte
+	data []byte
+	file *shade.File
+}
+
+// queue holds the writes waiting to be performed on a slow child.
+type queue struct {
+	client drive.Client
+	mu     sync.Mutex
+	cond   *sync.Cond // signalled when ops are added or completed
+	ops    []op
+	busy   bool // an op has been removed from ops, and is being performed
+	failed int  // the number of ops abandoned since the last flush
+	closed bool // run returns once ops is empty
+}
+
+func newQueue(client drive.Client) *queue {
+	q := &queue{client: client}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *queue) push(o op) {
+	q.mu.Lock()
+	q.ops = append(q.ops, o)
+	q.mu.Unlock()
+	queueDepth.Add(1)
+	q.cond.Broadcast()
+}
+
+// run performs the queued ops in order, until the queue is closed.
+func (q *queue) run() {
+	for {
+		q.mu.Lock()
+		for len(q.ops) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.ops) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		o := q.ops[0]
+		q.ops = q.ops[1:]
+		q.busy = true
+		q.mu.Unlock()
+
+		err := q.do(o)
+
+		q.mu.Lock()
+		q.busy = false
+		if err != nil {
+			q.failed++
+		}
+		q.mu.Unlock()
+		queueDepth.Add(-1)
+		q.cond.Broadcast()
+	}
+}
+
+// do performs o, retrying failures up to --writebackRetries times.
+func (q *queue) do(o op) error {
+	name := q.client.GetConfig().Provider
+	b := &backoff.Backoff{Factor: 4, Max: time.Minute}
+	for numRetries := 1; ; numRetries++ {
+		var err error
+		switch o.kind {
+		case putFile:
+			err = q.client.PutFile(o.sum, o.data)
+		case releaseFile:
+			err = q.client.ReleaseFile(o.sum)
+		case putChunk:
+			err = q.client.PutChunk(o.sum, o.data, o.file)
+		case releaseChunk:
+			err = q.client.ReleaseChunk(o.sum)
+		}
+		if err == nil {
+			completeWrites.Add(1)
+			return nil
+		}
+		logging.Warningf("background write of %x to %s failed (retry %d): %s", o.sum, name, numRetries, err)
+		if numRetries >= *maxRetries {
+			failedWrites.Add(1)
+			logging.Errorf("abandoning background write of %x to %s: %s", o.sum, name, err)
+			return err
+		}
+		time.Sleep(b.Duration())
+	}
+}
+
+// close stops run, once it has performed the queued ops.
+func (q *queue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// flush blocks until the queue is empty, and returns the number of ops which
+// failed since the last flush.
+func (q *queue) flush() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.ops) > 0 || q.busy {
+		q.cond.Wait()
+	}
+	failed := q.failed
+	q.failed = 0
+	return failed
+}
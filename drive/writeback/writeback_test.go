@@ -0,0 +1,218 @@
+package writeback
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/fail"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+func newMemoryClient(t *testing.T) drive.Client {
+	c, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	wc, err := NewClient(drive.Config{
+		Provider: "writeback",
+		Children: []drive.Config{
+			{Provider: "memory", Write: true},
+			{Provider: "memory", Write: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	drive.TestFileRoundTrip(t, wc, 100)
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	wc, err := NewClient(drive.Config{
+		Provider: "writeback",
+		Children: []drive.Config{
+			{Provider: "memory", Write: true},
+			{Provider: "memory", Write: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	drive.TestChunkRoundTrip(t, wc, 100)
+}
+
+func TestRequiresTwoChildren(t *testing.T) {
+	_, err := NewClient(drive.Config{
+		Provider: "writeback",
+		Children: []drive.Config{{Provider: "memory", Write: true}},
+	})
+	if err == nil {
+		t.Error("NewClient succeeded with only one child")
+	}
+}
+
+// blockingClient blocks all writes until release is closed.
+type blockingClient struct {
+	drive.Client
+	release chan struct{}
+}
+
+func (c *blockingClient) PutFile(sha256sum, content []byte) error {
+	<-c.release
+	return c.Client.PutFile(sha256sum, content)
+}
+
+func (c *blockingClient) PutChunk(sha256sum, chunk []byte, f *shade.File) error {
+	<-c.release
+	return c.Client.PutChunk(sha256sum, chunk, f)
+}
+
+// TestWritesReturnBeforeSlowChild ensures writes return once the fast child
+// has them, and that the slow child eventually receives them.
+func TestWritesReturnBeforeSlowChild(t *testing.T) {
+	fast := newMemoryClient(t)
+	slowMemory := newMemoryClient(t)
+	slow := &blockingClient{Client: slowMemory, release: make(chan struct{})}
+	wc := newDrive(drive.Config{Provider: "writeback"}, fast, []drive.Client{slow})
+
+	chunkSum, chunk := drive.RandChunk()
+	fileSum, file := drive.RandChunk()
+	done := make(chan struct{})
+	go func() {
+		if err := wc.PutChunk(chunkSum, chunk, nil); err != nil {
+			t.Error(err)
+		}
+		if err := wc.PutFile(fileSum, file); err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked on the slow child")
+	}
+	if _, err := fast.GetChunk(chunkSum, nil); err != nil {
+		t.Errorf("fast child does not have the chunk: %s", err)
+	}
+	if _, err := slowMemory.GetChunk(chunkSum, nil); err == nil {
+		t.Errorf("slow child has the chunk before it was released")
+	}
+	if got := queueDepth.Value(); got < 1 {
+		t.Errorf("writebackQueueDepth: want at least 1, got: %d", got)
+	}
+
+	close(slow.release)
+	if err := wc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := slowMemory.GetChunk(chunkSum, nil)
+	if err != nil || !bytes.Equal(got, chunk) {
+		t.Errorf("slow child did not receive the chunk: %s", err)
+	}
+	got, err = slowMemory.GetFile(fileSum)
+	if err != nil || !bytes.Equal(got, file) {
+		t.Errorf("slow child did not receive the file: %s", err)
+	}
+}
+
+// flakyClient fails the first failures writes.
+type flakyClient struct {
+	drive.Client
+	mu       sync.Mutex
+	failures int
+}
+
+func (c *flakyClient) PutChunk(sha256sum, chunk []byte, f *shade.File) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		return errors.New("flaky write")
+	}
+	return c.Client.PutChunk(sha256sum, chunk, f)
+}
+
+func TestSlowWritesAreRetried(t *testing.T) {
+	slow := &flakyClient{Client: newMemoryClient(t), failures: 2}
+	wc := newDrive(drive.Config{Provider: "writeback"}, newMemoryClient(t), []drive.Client{slow})
+	sum, chunk := drive.RandChunk()
+	if err := wc.PutChunk(sum, chunk, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := slow.GetChunk(sum, nil); err != nil {
+		t.Errorf("slow child did not receive the chunk after retries: %s", err)
+	}
+}
+
+func TestFlushReportsAbandonedWrites(t *testing.T) {
+	defer func(r int) { *maxRetries = r }(*maxRetries)
+	*maxRetries = 1
+	slow, err := fail.NewClient(drive.Config{Provider: "fail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc := newDrive(drive.Config{Provider: "writeback"}, newMemoryClient(t), []drive.Client{slow})
+	sum, chunk := drive.RandChunk()
+	if err := wc.PutChunk(sum, chunk, nil); err != nil {
+		t.Fatalf("write failed despite succeeding on the fast child: %s", err)
+	}
+	if err := wc.Flush(); err == nil {
+		t.Error("Flush did not report the failed background write")
+	}
+	if err := wc.Flush(); err != nil {
+		t.Errorf("a second Flush reported an already reported failure: %s", err)
+	}
+}
+
+// closingClient records whether it was closed.
+type closingClient struct {
+	drive.Client
+	closed bool
+}
+
+func (c *closingClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+// Test that Close completes the queued writes, stops the goroutines which
+// perform them, and closes the children.
+func TestClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	fast := &closingClient{Client: newMemoryClient(t)}
+	slow := &closingClient{Client: newMemoryClient(t)}
+	wc := newDrive(drive.Config{Provider: "writeback"}, fast, []drive.Client{slow, newMemoryClient(t)})
+	sum, chunk := drive.RandChunk()
+	if err := wc.PutChunk(sum, chunk, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := drive.Close(wc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := slow.GetChunk(sum, nil); err != nil {
+		t.Errorf("the queued write was not completed by Close: %s", err)
+	}
+	if !fast.closed || !slow.closed {
+		t.Errorf("the children were not closed, fast: %v, slow: %v", fast.closed, slow.closed)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines are still running after Close, want %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,11 +1,15 @@
 package shade
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"sort"
 	"time"
 )
 
@@ -43,19 +47,51 @@ type File struct {
 	// recover the Nonce when decrypting.  Nb: This increases the encrypted
 	// Chunk's size by gcm.NonceSize(), currently 12 bytes.
 	AesKey *[32]byte
+
+	// Digest optionally records the ContentDigest of the File when it was
+	// written.  It may be compared with the ContentDigest computed from the
+	// Chunks to detect tampering with their order.
+	Digest []byte `json:",omitempty"`
+
+	// SumAlgorithm names the hash used to compute the sums of the Chunks (see
+	// SumWith).  Files which predate it are empty, meaning SHA256, so
+	// repositories with Files of mixed algorithms remain readable.
+	SumAlgorithm string `json:",omitempty"`
+
+	// Xattrs holds the extended attributes of the file, keyed by name.  It is
+	// usually empty, and then omitted, so Files without them are unchanged.
+	Xattrs map[string][]byte `json:",omitempty"`
 }
 
 // NewFile returns a new File object for the given filename.
 //
-// It initializes an AesKey, sets the ModifiedTime to time.Now(), and sets the
-// default Chunksize based on --chunksize.
+// It initializes an AesKey (unless the default cipher is NoCipher), sets the
+// ModifiedTime to time.Now(), and sets the default Chunksize and
+// SumAlgorithm, as returned by DefaultParams.
 func NewFile(filename string) *File {
-	return &File{
+	return NewFileWithChunksize(filename, DefaultParams().Chunksize)
+}
+
+// NewFileWithChunksize returns a new File object for the given filename, like
+// NewFile, but with an explicit Chunksize.  This is useful when importing
+// content which was already chunked by another tool.
+func NewFileWithChunksize(filename string, chunksize int) *File {
+	p := DefaultParams()
+	f := &File{
 		Filename:     filename,
 		ModifiedTime: time.Now(),
-		Chunksize:    *chunksize,
-		AesKey:       NewSymmetricKey(),
+		Chunksize:    chunksize,
+		SumAlgorithm: SumAlgorithm(),
 	}
+	if p.Cipher != NoCipher {
+		f.AesKey = NewSymmetricKey()
+	}
+	return f
+}
+
+// Sum returns the sum of a chunk of f, computed with f's SumAlgorithm.
+func (f *File) Sum(chunk []byte) ([]byte, error) {
+	return SumWith(f.SumAlgorithm, chunk)
 }
 
 // Chunk represents a portion of the content of the File being stored.
@@ -66,7 +102,11 @@ type Chunk struct {
 }
 
 func (f *File) String() string {
-	out := fmt.Sprintf("{Filename: %q, Filesize: %d, Chunksize: %d, AesKey: %v, Chunks:", f.Filename, f.Filesize, f.Chunksize, *f.AesKey)
+	var key interface{} = "none"
+	if f.AesKey != nil {
+		key = *f.AesKey
+	}
+	out := fmt.Sprintf("{Filename: %q, Filesize: %d, Chunksize: %d, AesKey: %v, Chunks:", f.Filename, f.Filesize, f.Chunksize, key)
 	sep := ", "
 	if len(f.Chunks) < 2 {
 		out += " "
@@ -103,12 +143,108 @@ func (f *File) FromJSON(fj []byte) error {
 }
 
 // UpdateFilesize calculates the size of the assocaited Chunks and sets the
-// Filesize member of the struct.
+// Filesize member of the struct.  A File with no Chunks is empty.
 func (f *File) UpdateFilesize() {
+	if len(f.Chunks) == 0 {
+		f.Filesize = 0
+		return
+	}
 	f.Filesize = int64((len(f.Chunks) - 1) * f.Chunksize)
 	f.Filesize += int64(f.LastChunksize)
 }
 
+// ChunkSums reads r to its end, and returns the sum of each Chunksize bytes,
+// as they would be recorded in the Chunks of f.  If max is positive, at most
+// max chunks are read.  f is not modified.
+func (f *File) ChunkSums(r io.Reader, max int) ([][]byte, error) {
+	if f.Chunksize <= 0 {
+		return nil, fmt.Errorf("invalid chunksize: %d", f.Chunksize)
+	}
+	var sums [][]byte
+	for max <= 0 || len(sums) < max {
+		// Reading each chunk into a buffer of its own size avoids allocating a
+		// whole Chunksize for small files.
+		chunk, err := io.ReadAll(io.LimitReader(r, int64(f.Chunksize)))
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		sum, err := f.Sum(chunk)
+		if err != nil {
+			return nil, err
+		}
+		sums = append(sums, sum)
+		if len(chunk) < f.Chunksize {
+			break
+		}
+	}
+	return sums, nil
+}
+
+// ContentDigest returns the root of a Merkle tree whose leaves are the
+// sha256sum and size of each Chunk, in Index order.  It does not cover
+// metadata such as the Filename or ModifiedTime, so Files with identical
+// content share a ContentDigest, regardless of their JSON sum.
+func (f *File) ContentDigest() []byte {
+	chunks := make([]Chunk, len(f.Chunks))
+	copy(chunks, f.Chunks)
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Index < chunks[j].Index })
+
+	// Leaves and interior nodes are prefixed with distinct bytes, so a leaf
+	// can not be mistaken for a node.
+	level := make([][]byte, 0, len(chunks))
+	for i, c := range chunks {
+		size := f.Chunksize
+		if i == len(chunks)-1 {
+			size = f.LastChunksize
+		}
+		leaf := sha256.New()
+		leaf.Write([]byte{0})
+		leaf.Write(c.Sha256)
+		binary.Write(leaf, binary.BigEndian, uint64(size))
+		level = append(level, leaf.Sum(nil))
+	}
+	if len(level) == 0 {
+		return Sum(nil)
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				// An odd node is promoted to the next level unchanged.
+				next = append(next, level[i])
+				continue
+			}
+			node := sha256.New()
+			node.Write([]byte{1})
+			node.Write(level[i])
+			node.Write(level[i+1])
+			next = append(next, node.Sum(nil))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// UpdateDigest sets the Digest member of the struct to the ContentDigest.
+func (f *File) UpdateDigest() {
+	f.Digest = f.ContentDigest()
+}
+
+// VerifyDigest returns an error if the File records a Digest which does not
+// match its ContentDigest.  Files without a Digest are not checked.
+func (f *File) VerifyDigest() error {
+	if f.Digest == nil {
+		return nil
+	}
+	if d := f.ContentDigest(); !bytes.Equal(d, f.Digest) {
+		return fmt.Errorf("%s: content digest %x does not match recorded digest %x", f.Filename, d, f.Digest)
+	}
+	return nil
+}
+
 // NewChunk returns a new Chunk object.
 //
 // It ensures that each new chunk has a unique cryptographically secure Nonce.
@@ -1,6 +1,10 @@
 package shade
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+	"time"
+)
 
 func TestUpdateFilesize(t *testing.T) {
 	f := File{
@@ -13,4 +17,115 @@ func TestUpdateFilesize(t *testing.T) {
 	if f.Filesize != expected {
 		t.Errorf("UpdateFilesize unexpected, want: %d, got: %d", f.Filesize, expected)
 	}
+
+	empty := File{Chunksize: 16 * 1024 * 1024}
+	empty.UpdateFilesize()
+	if empty.Filesize != 0 {
+		t.Errorf("UpdateFilesize of a File with no Chunks, want: 0, got: %d", empty.Filesize)
+	}
+}
+
+func TestNewFileWithChunksize(t *testing.T) {
+	f := NewFileWithChunksize("imported", 3001)
+	if f.Chunksize != 3001 {
+		t.Errorf("want Chunksize 3001, got: %d", f.Chunksize)
+	}
+	if f.AesKey == nil {
+		t.Error("NewFileWithChunksize() did not initialize an AesKey")
+	}
+	if d := NewFile("default"); d.Chunksize != *chunksize {
+		t.Errorf("NewFile(): want the --chunksize default %d, got: %d", *chunksize, d.Chunksize)
+	}
+}
+
+func TestChunkSums(t *testing.T) {
+	f := NewFileWithChunksize("chunked", 4)
+	for _, tc := range []struct {
+		content string
+		max     int
+		want    []string
+	}{
+		{"", 0, nil},
+		{"abc", 0, []string{"abc"}},
+		{"abcdefgh", 0, []string{"abcd", "efgh"}},
+		{"abcdefghi", 0, []string{"abcd", "efgh", "i"}},
+		{"abcdefghi", 2, []string{"abcd", "efgh"}},
+	} {
+		sums, err := f.ChunkSums(bytes.NewReader([]byte(tc.content)), tc.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sums) != len(tc.want) {
+			t.Errorf("ChunkSums(%q, %d) returned %d sums, want %d", tc.content, tc.max, len(sums), len(tc.want))
+			continue
+		}
+		for i, w := range tc.want {
+			if !bytes.Equal(sums[i], Sum([]byte(w))) {
+				t.Errorf("ChunkSums(%q, %d)[%d] is not the sum of %q", tc.content, tc.max, i, w)
+			}
+		}
+	}
+	if _, err := (&File{}).ChunkSums(bytes.NewReader(nil), 0); err == nil {
+		t.Error("ChunkSums() with no Chunksize succeeded")
+	}
+}
+
+func TestContentDigest(t *testing.T) {
+	chunks := []Chunk{
+		{Index: 0, Sha256: Sum([]byte("zero"))},
+		{Index: 1, Sha256: Sum([]byte("one"))},
+		{Index: 2, Sha256: Sum([]byte("two"))},
+	}
+	a := File{
+		Filename:      "a",
+		ModifiedTime:  time.Unix(1, 0),
+		Chunks:        chunks,
+		Chunksize:     16,
+		LastChunksize: 3,
+		AesKey:        NewSymmetricKey(),
+	}
+	// Identical chunks, listed in a different order, with different metadata.
+	b := File{
+		Filename:      "b",
+		ModifiedTime:  time.Unix(2, 0),
+		Chunks:        []Chunk{chunks[2], chunks[0], chunks[1]},
+		Chunksize:     16,
+		LastChunksize: 3,
+		AesKey:        NewSymmetricKey(),
+	}
+	if !bytes.Equal(a.ContentDigest(), b.ContentDigest()) {
+		t.Errorf("files with identical chunks have different digests: %x, %x", a.ContentDigest(), b.ContentDigest())
+	}
+
+	b.LastChunksize = 4
+	if bytes.Equal(a.ContentDigest(), b.ContentDigest()) {
+		t.Error("files with different sizes share a digest")
+	}
+	b.LastChunksize = 3
+	b.Chunks = []Chunk{chunks[0], chunks[1]}
+	if bytes.Equal(a.ContentDigest(), b.ContentDigest()) {
+		t.Error("files with different chunks share a digest")
+	}
+	if (&File{}).ContentDigest() == nil {
+		t.Error("an empty file has no digest")
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	f := File{
+		Chunks:        []Chunk{{Index: 0, Sha256: Sum([]byte("zero"))}, {Index: 1, Sha256: Sum([]byte("one"))}},
+		Chunksize:     16,
+		LastChunksize: 3,
+	}
+	if err := f.VerifyDigest(); err != nil {
+		t.Errorf("file without a digest failed verification: %s", err)
+	}
+	f.UpdateDigest()
+	if err := f.VerifyDigest(); err != nil {
+		t.Errorf("file with a correct digest failed verification: %s", err)
+	}
+	f.Chunks[0].Index, f.Chunks[1].Index = 1, 0
+	if err := f.VerifyDigest(); err == nil {
+		t.Error("file with reordered chunks passed verification")
+	}
 }
@@ -0,0 +1,106 @@
+package fusefs
+
+import (
+	"expvar"
+	"flag"
+	"math"
+	"sync"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+var (
+	chunkCacheBytes = flag.Int64("chunkCacheBytes", 64*1024*1024, "The size, in bytes, of the cache of recently read chunks shared by all open files (0 disables).")
+
+	chunkCacheHits   = expvar.NewInt("chunkCacheHits")
+	chunkCacheMisses = expvar.NewInt("chunkCacheMisses")
+)
+
+// cachingClient keeps the most recently read chunks of the drive.Client it
+// wraps in memory, up to a total size in bytes.  Unlike the LRU of each
+// handle, it is shared by all of the open files, so handles reading the same
+// chunk fetch it from the backend only once.
+//
+// The cached chunks are returned to callers without being copied, so they
+// must not be modified.
+type cachingClient struct {
+	drive.Client
+	maxBytes int64
+	mu       sync.Mutex // protects lru and bytes
+	lru      *simplelru.LRU
+	bytes    int64
+}
+
+// cacheChunks wraps client in a cachingClient which holds up to maxBytes of
+// chunks.  If maxBytes is not positive, client is returned unchanged.
+func cacheChunks(client drive.Client, maxBytes int64) drive.Client {
+	if maxBytes <= 0 {
+		return client
+	}
+	c := &cachingClient{Client: client, maxBytes: maxBytes}
+	// The LRU is bounded by c.maxBytes, rather than its number of entries.
+	c.lru, _ = simplelru.NewLRU(math.MaxInt32, func(_, v interface{}) {
+		c.bytes -= int64(len(v.([]byte)))
+	})
+	return c
+}
+
+// get returns the cached chunk, if present.
+func (c *cachingClient) get(sha256sum []byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.lru.Get(string(sha256sum)); ok {
+		chunkCacheHits.Add(1)
+		return v.([]byte), true
+	}
+	chunkCacheMisses.Add(1)
+	return nil, false
+}
+
+// add caches chunk, evicting the least recently used chunks to make room.
+// Chunks larger than the whole cache are not cached.
+func (c *cachingClient) add(sha256sum, chunk []byte) {
+	if int64(len(chunk)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru.Contains(string(sha256sum)) {
+		return
+	}
+	c.lru.Add(string(sha256sum), chunk)
+	c.bytes += int64(len(chunk))
+	for c.bytes > c.maxBytes {
+		c.lru.RemoveOldest()
+	}
+}
+
+// GetChunk returns the chunk from the cache, or fetches and caches it.
+func (c *cachingClient) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	if cb, ok := c.get(sha256sum); ok {
+		return cb, nil
+	}
+	cb, err := c.Client.GetChunk(sha256sum, f)
+	if err != nil {
+		return nil, err
+	}
+	c.add(sha256sum, cb)
+	return cb, nil
+}
+
+// GetChunkRange answers from the cache if the whole chunk is present.
+// Otherwise it reads only the requested range from the wrapped client, which
+// is not cached.
+func (c *cachingClient) GetChunkRange(sha256sum []byte, f *shade.File, offset, length int64) ([]byte, error) {
+	if cb, ok := c.get(sha256sum); ok {
+		return drive.SliceRange(cb, offset, length), nil
+	}
+	return drive.GetChunkRange(c.Client, sha256sum, f, offset, length)
+}
+
+// Space returns the space of the wrapped client.
+func (c *cachingClient) Space() (total, free uint64, err error) {
+	return drive.Space(c.Client)
+}
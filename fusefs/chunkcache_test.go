@@ -0,0 +1,109 @@
+package fusefs
+
+import (
+	"sync"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+// getCountingClient counts the calls to GetChunk.
+type getCountingClient struct {
+	drive.Client
+	mu   sync.Mutex
+	gets int
+}
+
+func (c *getCountingClient) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	c.mu.Lock()
+	c.gets++
+	c.mu.Unlock()
+	return c.Client.GetChunk(sha256sum, f)
+}
+
+// TestChunkCacheSharedByHandles ensures two handles reading the same chunk
+// fetch it from the backend only once.
+func TestChunkCacheSharedByHandles(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	cc := &getCountingClient{Client: mc}
+	sc, err := New(cc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	f := shade.NewFile("hot")
+	sum, chunk := drive.RandChunk()
+	if err := mc.PutChunk(sum, chunk, f); err != nil {
+		t.Fatal(err)
+	}
+
+	hits := chunkCacheHits.Value()
+	for i := 0; i < 2; i++ {
+		hID, err := sc.allocHandle(fuse.NodeID(sc.inode.FromPath(f.Filename)), f)
+		if err != nil {
+			t.Fatalf("allocHandle() failed: %s", err)
+		}
+		h, err := sc.handleByID(fuse.HandleID(hID))
+		if err != nil {
+			t.Fatalf("handleByID() failed: %s", err)
+		}
+		if _, err := h.getChunk(sc.client, sum); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cc.gets != 1 {
+		t.Errorf("want 1 GetChunk from the backend, got: %d", cc.gets)
+	}
+	if got := chunkCacheHits.Value() - hits; got != 1 {
+		t.Errorf("want 1 chunkCacheHits, got: %d", got)
+	}
+}
+
+func TestChunkCacheEviction(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	cc := &getCountingClient{Client: mc}
+	a, b, large := []byte("aaaa"), []byte("bbbb"), []byte("too large to cache")
+	for _, chunk := range [][]byte{a, b, large} {
+		if err := mc.PutChunk(shade.Sum(chunk), chunk, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := cacheChunks(cc, 6)
+	read := func(chunk []byte) {
+		if _, err := c.GetChunk(shade.Sum(chunk), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read(a)
+	read(a)
+	if cc.gets != 1 {
+		t.Errorf("repeated read: want 1 GetChunk, got: %d", cc.gets)
+	}
+	read(b) // evicts a, as both do not fit in 6 bytes
+	read(a)
+	if cc.gets != 3 {
+		t.Errorf("read after eviction: want 3 GetChunk, got: %d", cc.gets)
+	}
+	read(large)
+	read(large)
+	if cc.gets != 5 {
+		t.Errorf("uncacheable chunk: want 5 GetChunk, got: %d", cc.gets)
+	}
+
+	got, err := drive.GetChunkRange(c, shade.Sum(a), nil, 1, 2)
+	if err != nil || string(got) != "aa" {
+		t.Errorf("GetChunkRange of a cached chunk: want %q, got: %q (%v)", "aa", got, err)
+	}
+	if cc.gets != 5 {
+		t.Errorf("GetChunkRange of a cached chunk reached the backend")
+	}
+}
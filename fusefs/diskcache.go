@@ -0,0 +1,103 @@
+package fusefs
+
+import (
+	"expvar"
+	"flag"
+	"os"
+	"path/filepath"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/local"
+	"github.com/asjoyner/shade/logging"
+)
+
+var (
+	chunkDiskCache      = flag.String("chunkDiskCache", "", "A directory in which to cache the chunks read, after decryption, so later reads of them skip both the backend and decryption (empty disables).  Nb: the cached chunks are stored unencrypted.")
+	chunkDiskCacheBytes = flag.Uint64("chunkDiskCacheBytes", 1<<30, "The size, in bytes, of the -chunkDiskCache; the least recently used chunks are evicted to stay below it.")
+
+	chunkDiskCacheHits   = expvar.NewInt("chunkDiskCacheHits")
+	chunkDiskCacheMisses = expvar.NewInt("chunkDiskCacheMisses")
+)
+
+// diskCachingClient keeps the chunks read from the drive.Client it wraps on
+// local disk, keyed by their plaintext sum.  If the wrapped client decrypts
+// the chunks, eg. an "encrypt" client over a "cache" client with a local
+// child, that local child holds them encrypted, and each read decrypts them
+// again.  The chunks in a diskCachingClient were already decrypted.
+//
+// The chunks are stored by a "local" client, whose MaxChunkBytes evicts the
+// least recently used chunks.  Each hit refreshes the chunk's position.
+type diskCachingClient struct {
+	drive.Client
+	disk drive.Client
+}
+
+// cacheChunksOnDisk wraps client in a diskCachingClient which holds up to
+// maxBytes of chunks in dir, which is created if necessary.  If dir is empty,
+// client is returned unchanged.
+func cacheChunksOnDisk(client drive.Client, dir string, maxBytes uint64) (drive.Client, error) {
+	if dir == "" {
+		return client, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	disk, err := local.NewClient(drive.Config{
+		Provider:      "local",
+		ChunkParentID: filepath.Join(dir, "chunks"),
+		FileParentID:  filepath.Join(dir, "files"),
+		MaxChunkBytes: maxBytes,
+		Write:         true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &diskCachingClient{Client: client, disk: disk}, nil
+}
+
+// get returns the chunk from the disk cache, if present.
+func (c *diskCachingClient) get(sha256sum []byte, f *shade.File) ([]byte, bool) {
+	cb, err := c.disk.GetChunk(sha256sum, f)
+	if err != nil {
+		chunkDiskCacheMisses.Add(1)
+		return nil, false
+	}
+	chunkDiskCacheHits.Add(1)
+	// Storing the chunk again only updates its mtime, which marks it as
+	// recently used.
+	if err := c.disk.PutChunk(sha256sum, cb, f); err != nil {
+		logging.Warningf("refreshing chunk %x in the disk cache: %s", sha256sum, err)
+	}
+	return cb, true
+}
+
+// GetChunk returns the chunk from the disk cache, or fetches and caches it.
+func (c *diskCachingClient) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	if cb, ok := c.get(sha256sum, f); ok {
+		return cb, nil
+	}
+	cb, err := c.Client.GetChunk(sha256sum, f)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.disk.PutChunk(sha256sum, cb, f); err != nil {
+		logging.Warningf("adding chunk %x to the disk cache: %s", sha256sum, err)
+	}
+	return cb, nil
+}
+
+// GetChunkRange answers from the disk cache if the chunk is present.
+// Otherwise it reads only the requested range from the wrapped client, which
+// is not cached.
+func (c *diskCachingClient) GetChunkRange(sha256sum []byte, f *shade.File, offset, length int64) ([]byte, error) {
+	if cb, ok := c.get(sha256sum, f); ok {
+		return drive.SliceRange(cb, offset, length), nil
+	}
+	return drive.GetChunkRange(c.Client, sha256sum, f, offset, length)
+}
+
+// Space returns the space of the wrapped client.
+func (c *diskCachingClient) Space() (total, free uint64, err error) {
+	return drive.Space(c.Client)
+}
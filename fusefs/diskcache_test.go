@@ -0,0 +1,92 @@
+package fusefs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	_ "github.com/asjoyner/shade/drive/encrypt"
+	_ "github.com/asjoyner/shade/drive/memory"
+)
+
+// TestChunkDiskCache ensures repeated reads of a file, even after a remount,
+// fetch and decrypt each chunk from the encrypt client only once.
+func TestChunkDiskCache(t *testing.T) {
+	defer func(dir string, cacheBytes int64) {
+		*chunkDiskCache, *chunkCacheBytes = dir, cacheBytes
+	}(*chunkDiskCache, *chunkCacheBytes)
+	// Disable the in-memory cache, so that every read reaches the disk cache.
+	*chunkDiskCache, *chunkCacheBytes = t.TempDir(), 0
+
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privkey)}
+	ec, err := drive.NewClient(drive.Config{
+		Provider:      "encrypt",
+		RsaPrivateKey: string(pem.EncodeToMemory(b)),
+		Write:         true,
+		Children:      []drive.Config{{Provider: "memory", Write: true}},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	// Each GetChunk of the encrypt client decrypts the chunk.
+	cc := &getCountingClient{Client: ec}
+
+	f := shade.NewFileWithChunksize("hot", 1024)
+	var want []byte
+	for i := 0; i < 3; i++ {
+		chunk := make([]byte, f.Chunksize)
+		rand.Read(chunk)
+		sum := shade.Sum(chunk)
+		f.Chunks = append(f.Chunks, shade.Chunk{Index: i, Sha256: sum, Nonce: shade.NewNonce()})
+		if err := ec.PutChunk(sum, chunk, f); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, chunk...)
+	}
+	f.Filesize = int64(len(want))
+
+	var gets int
+	hits, misses := chunkDiskCacheHits.Value(), chunkDiskCacheMisses.Value()
+	for mount := 0; mount < 2; mount++ {
+		sc, err := New(cc, nil, nil)
+		if err != nil {
+			t.Fatalf("New() failed: %s", err)
+		}
+		// New may read the repository's params.
+		before := cc.gets
+		for read := 0; read < 2; read++ {
+			// The chunks are read from sc.client, rather than a handle, which
+			// would prefetch the next chunk concurrently.
+			var got []byte
+			for _, c := range f.Chunks {
+				cb, err := sc.client.GetChunk(c.Sha256, f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, cb...)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("mount %d, read %d returned the wrong bytes", mount, read)
+			}
+		}
+		gets += cc.gets - before
+	}
+	if gets != len(f.Chunks) {
+		t.Errorf("want %d GetChunk calls to the encrypt client, got: %d", len(f.Chunks), gets)
+	}
+	if got := chunkDiskCacheMisses.Value() - misses; got != 3 {
+		t.Errorf("want 3 chunkDiskCacheMisses, got: %d", got)
+	}
+	if got := chunkDiskCacheHits.Value() - hits; got != 9 {
+		t.Errorf("want 9 chunkDiskCacheHits, got: %d", got)
+	}
+}
@@ -3,7 +3,7 @@ package fusefs
 // This is a thin layer of glue between the bazil.org/fuse kernel interface
 // and the Shade Drive API.
 //
-// This module uses glog for variable output.  The vmodule levels above 6 get
+// This module logs with the logging package.  The verbose levels above 6 get
 // very chatty. Roughly, they contain:
 //  3. writes of file objects to Fuse
 //  4. Drive client reads, refresh timing information
@@ -12,6 +12,9 @@ package fusefs
 //  7. one log line for every operation handled by the fuse API
 //  8. raw data as returned by some interesting operations (readdir)
 //  9. debugging parameters of tricky internal calculations (offsets, etc)
+//
+// The messages bazil.org/fuse logs about each request and response are
+// logged at level 7 once DebugFuse is installed as fuse.Debug.
 
 import (
 	"bytes"
@@ -35,23 +38,37 @@ import (
 
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
-	"github.com/golang/glog"
+	"github.com/asjoyner/shade/logging"
+	"github.com/asjoyner/shade/repolock"
+	"github.com/asjoyner/shade/umbrella"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/jpillora/backoff"
 )
 
 var (
-	kernelRefresh = flag.Duration("kernel-refresh", time.Minute, "How long the kernel should cache metadata entries.")
-	numWorkers    = flag.Int("numFuseWorkers", 20, "The number of goroutines to service fuse requests.")
-	maxRetries    = flag.Int("maxRetries", 10, "The number of times to try to write a chunk to persistent storage.")
-
-	// DefaultChunkSizeBytes defines the default for newly created shade.File(s)
+	kernelRefresh     = flag.Duration("kernel-refresh", time.Minute, "How long the kernel should cache metadata entries.")
+	numWorkers        = flag.Int("numFuseWorkers", 20, "The number of goroutines to service fuse requests.")
+	maxRetries        = flag.Int("maxRetries", 10, "The number of times to try to write a chunk to persistent storage.")
+	flushConcurrency  = flag.Int("flushConcurrency", 4, "The number of dirty chunks of a file to write to storage in parallel when it is flushed.")
+	autoFlushInterval = flag.Duration("autoFlushInterval", 0, "How often to flush completed chunks of files open for writing (0 disables).")
+	// The dirty data of files open for writing is held in RAM until the file
+	// is flushed.  These bound it, so a writer which outpaces the drive.Client
+	// waits for its data to be stored; see limitDirty.
+	maxDirtyBytes       = flag.Int64("maxDirtyBytes", 1<<30, "The most bytes written to all open files to hold in RAM before storing them (0 is unlimited).")
+	maxHandleDirtyBytes = flag.Int64("maxHandleDirtyBytes", 256<<20, "The most bytes written to each open file to hold in RAM before storing them (0 is unlimited).  Set it to several times the chunksize.")
+	trash               = flag.Bool("trash", false, "Move removed files to the "+umbrella.TrashDir+" directory, from which shadeutil trash can restore them, rather than deleting them.")
+	rangedReads         = flag.Bool("rangedReads", false, "Fetch only the bytes of each chunk needed to answer a read, rather than the whole chunk.  This bypasses the per-handle chunk cache and prefetching.")
+	// Each write request is copied into the dirty copy of a chunk, so a
+	// chunk of DefaultChunkSizeBytes is assembled from many writes of
+	// maxWrite bytes.  Larger writes mean fewer requests, and fewer copies.
+	maxWrite = flag.Int("maxWrite", maxMaxWrite, "The largest write, in bytes, the kernel may send in a single request (4KiB to 128KiB).")
+
+	// DefaultChunkSizeBytes defines the default for newly created
+	// shade.File(s), if the repository does not record its own Chunksize in
+	// its params.  Existing files are read and written using the Chunksize
+	// they were stored with.
 	DefaultChunkSizeBytes = 16 * 1024 * 1024
 
-	// prefetchByte is the byte that, if it is read, we assume the next chunk will
-	// also be read, and go ahead and fetch the next chunk to warm the cache.
-	prefetchByte = int64(DefaultChunkSizeBytes / 10)
-
 	// chunksPerHandle defines how many chunks to keep in the LRU of an open filehandle.
 	// This avoids calling Drive.GetChunk() on every 4k read, because it makes a copy.
 	// To keep sequential reads from consuming a lot of CPU doing memory copies,
@@ -60,6 +77,19 @@ var (
 	chunksPerHandle = 6
 
 	blockSize uint32 = 4096
+	// unknownSpace is reported as both the size and the free space of the
+	// filesystem when the backend does not know how much it can store, so
+	// applications which check for free space before writing do not refuse.
+	unknownSpace uint64 = 1 << 50 // 1PiB
+	// spaceRefresh is how long the space reported by the backend is cached,
+	// as finding it may require a request to a remote service.
+	spaceRefresh = time.Minute
+
+	// minMaxWrite and maxMaxWrite bound -maxWrite.  The kernel requires room
+	// for at least one page, and bazil.org/fuse sizes its request buffers for
+	// writes of at most 128KiB.
+	minMaxWrite = 4096
+	maxMaxWrite = 128 * 1024
 )
 
 // Server holds the state about the fuse connection
@@ -73,6 +103,27 @@ type Server struct {
 	handles []*handle             // index is the handleid, inode=0 if free
 	hm      sync.Mutex            // protects access to handles
 	writers map[int]io.PipeWriter // index matches fh
+	lock    *repolock.Dir         // serializes writes with cleanup, if set
+	// shared is the shared repository lock taken by lockWrites, and
+	// sharedTaken whether lockWrites was called; both are protected by hm.
+	shared      *repolock.Lock
+	sharedTaken bool
+
+	stop     chan struct{} // closed by Shutdown, to stop periodicFlush
+	stopOnce sync.Once
+
+	spaceMu    sync.Mutex // protects the fields below
+	spaceAt    time.Time  // when the space was last retrieved
+	spaceTotal uint64     // bytes the backend can store
+	spaceFree  uint64     // bytes the backend has available
+}
+
+// DebugFuse logs a message from bazil.org/fuse, which describes a request
+// from the kernel or the response to it, at level 7.  A program which serves
+// a mount installs it as fuse.Debug, so that the messages are logged rather
+// than discarded.
+func DebugFuse(msg interface{}) {
+	logging.V(7).Info(msg)
 }
 
 // New returns a Server which will service fuse requests arriving on conn,
@@ -80,23 +131,82 @@ type Server struct {
 // when Server.conn.Ready is closed.  The cached view of files is updated every
 // refresh.
 func New(client drive.Client, conn *fuse.Conn, refresh *time.Ticker) (*Server, error) {
+	if _, err := initResponse(*maxWrite); err != nil {
+		return nil, err
+	}
+	if err := validNamePolicy(*filenames); err != nil {
+		return nil, err
+	}
+	if err := validWarmPath(*warmPath); err != nil {
+		return nil, err
+	}
 	tree, err := NewTree(client, refresh)
 	if err != nil {
 		return nil, err
 	}
+	if err := useParams(client, tree); err != nil {
+		return nil, err
+	}
 	uid, gid, err := uidAndGid()
 	if err != nil {
 		return nil, err
 	}
-	return &Server{
-		client:  client,
+	inodes := NewInodeMap()
+	if *inodeMapPath != "" {
+		if inodes, err = LoadInodeMap(*inodeMapPath); err != nil {
+			return nil, fmt.Errorf("loading the inode map: %s", err)
+		}
+	}
+	inflight := limitInflight(client, *maxInflight)
+	onDisk, err := cacheChunksOnDisk(inflight, *chunkDiskCache, *chunkDiskCacheBytes)
+	if err != nil {
+		return nil, fmt.Errorf("initializing the -chunkDiskCache: %s", err)
+	}
+	sc := &Server{
+		client:  cacheChunks(onDisk, *chunkCacheBytes),
 		tree:    tree,
-		inode:   NewInodeMap(),
+		inode:   inodes,
 		writers: make(map[int]io.PipeWriter),
 		conn:    conn,
 		uid:     uid,
 		gid:     gid,
-	}, nil
+		lock:    repolock.New(client.GetConfig().LockDir),
+		stop:    make(chan struct{}),
+	}
+	if *autoFlushInterval > 0 {
+		go sc.periodicFlush(time.NewTicker(*autoFlushInterval))
+	}
+	if *warmOnMount {
+		// Warmed chunks bypass the shared chunk cache, so they do not evict
+		// the chunks of the files being read, but are added to the
+		// -chunkDiskCache, if there is one.
+		wf := warmFilter{glob: *warmPath, maxBytes: *warmMaxFileBytes}
+		if *warmModifiedWithin > 0 {
+			wf.since = time.Now().Add(-*warmModifiedWithin)
+		}
+		go warmFiles(onDisk, tree, wf, *warmFetch, *warmConcurrency)
+	}
+	return sc, nil
+}
+
+// useParams makes the repository's params, as found in tree, the defaults of
+// new files.  A repository without params records them, with a Chunksize of
+// DefaultChunkSizeBytes.
+func useParams(client drive.Client, tree *Tree) error {
+	var sum []byte
+	if n, err := tree.NodeByPath(umbrella.ParamsFilename); err == nil && !n.Synthetic() {
+		sum = n.Sha256sum
+	} else {
+		p := shade.DefaultParams()
+		p.Chunksize = DefaultChunkSizeBytes
+		if err := shade.SetParams(p); err != nil {
+			return err
+		}
+	}
+	if _, err := umbrella.UseParams(client, sum); err != nil {
+		return fmt.Errorf("could not use the repository's params: %s", err)
+	}
+	return nil
 }
 
 type handle struct {
@@ -106,6 +216,16 @@ type handle struct {
 	cache *lru.Cache                 // a cache of clean chunks
 	queue map[string]*sync.WaitGroup // outstanding requests to fill cache
 	ql    sync.Mutex                 // guards access to queue
+	// dirents is the listing of a directory when it was opened, so that a
+	// readdir spanning several requests sees the same entries at the same
+	// offsets, even if the tree is refreshed in between.
+	dirents []byte
+	// append is set if the file was opened with O_APPEND, so that every
+	// write goes to the end of the file, regardless of its offset.
+	append bool
+	// released is set if the kernel released the handle before its dirty
+	// chunks could be stored.  The handle is kept until they are.
+	released bool
 }
 
 // getChunk returns a shasum, using and updating the cache of chunks associated
@@ -131,7 +251,7 @@ func (h *handle) getChunkImpl(client drive.Client, sha256sum []byte, block bool)
 	if ok {
 		h.ql.Unlock()
 		if !block {
-			glog.V(4).Infof("This is already in flight: %x", sha256sum)
+			logging.V(4).Infof("This is already in flight: %x", sha256sum)
 			return nil, nil
 		}
 		wg.Wait()
@@ -145,17 +265,45 @@ func (h *handle) getChunkImpl(client drive.Client, sha256sum []byte, block bool)
 	nwg.Add(1) // initialized as nil above if !ok
 	h.queue[string(sha256sum)] = &nwg
 	h.ql.Unlock()
-	glog.V(4).Infof("Fetching reference copy of: %x", sha256sum)
+	logging.V(4).Infof("Fetching reference copy of: %x", sha256sum)
 	cb, err := client.GetChunk(sha256sum, h.file)
 	if err != nil {
-		glog.Warningf("client.GetChunk() err: %s", err)
-		return nil, err
+		// Release any concurrent readers; they will find the cache empty.
+		h.ql.Lock()
+		delete(h.queue, string(sha256sum))
+		h.ql.Unlock()
+		nwg.Done()
+		return nil, drive.NewMissingChunkError(sha256sum, h.file, err)
 	}
 	h.cache.Add(string(sha256sum), cb)
 	nwg.Done()
 	return cb, nil
 }
 
+// dirtyBytes returns the number of bytes in the dirty chunks of h.
+func (h *handle) dirtyBytes() int64 {
+	var n int64
+	for _, cb := range h.dirty {
+		n += int64(len(cb))
+	}
+	return n
+}
+
+// size returns the size of the file open in h, including its dirty chunks.
+func (h *handle) size() int64 {
+	chunkSize := int64(h.file.Chunksize)
+	var size int64
+	if n := int64(len(h.file.Chunks)); n > 0 {
+		size = (n-1)*chunkSize + int64(h.file.LastChunksize)
+	}
+	for cn, cb := range h.dirty {
+		if end := cn*chunkSize + int64(len(cb)); end > size {
+			size = end
+		}
+	}
+	return size
+}
+
 // return the current bytes of a chunk
 // TODO: write a test for this
 // Nb: chunkNum starts at zero
@@ -172,7 +320,7 @@ func (h *handle) chunkBytesForWrite(chunkNum int64, client drive.Client) ([]byte
 	}
 	chunkCopy := make([]byte, len(origChunk))
 	copy(chunkCopy, origChunk)
-	//glog.V(9).Infof("returning copied chunk: %s", chunkCopy)
+	//logging.V(9).Infof("returning copied chunk: %s", chunkCopy)
 	return chunkCopy, nil
 }
 
@@ -191,7 +339,7 @@ func (h *handle) applyWrite(data []byte, offset int64, client drive.Client) erro
 
 	var dataPtr int64 // tracks bytes read from data into chunks
 	for cn := firstChunk; cn <= lastChunk; cn++ {
-		//glog.V(9).Infof("working chunk %d\n", cn)
+		//logging.V(9).Infof("working chunk %d\n", cn)
 		chunkStart := cn * chunkSize // the position of the chunk in the file
 		var chunkOffset int64        // the start of the write inside this chunk
 		if offset > chunkStart {
@@ -202,15 +350,15 @@ func (h *handle) applyWrite(data []byte, offset int64, client drive.Client) erro
 			return err
 		}
 
-		//glog.V(9).Infof("before copy: %q\n", cb)
+		//logging.V(9).Infof("before copy: %q\n", cb)
 		n := copy(cb[chunkOffset:], data[dataPtr:])
-		//glog.V(9).Infof("post copy: %q\n", cb)
+		//logging.V(9).Infof("post copy: %q\n", cb)
 		dataPtr += int64(n)
 		// determine if we read all of the data, or filled the chunk
 		chunkRemainder := chunkSize - int64(len(cb))
 		dataRemainder := writeSize - dataPtr
 		var appendSize int64
-		//glog.V(9).Infof("dataremaidner: %d chunkRemainder: %d\n", dataRemainder, chunkRemainder)
+		//logging.V(9).Infof("dataremaidner: %d chunkRemainder: %d\n", dataRemainder, chunkRemainder)
 		if dataRemainder > 0 && dataRemainder <= chunkRemainder {
 			appendSize = dataRemainder
 		} else if dataRemainder > 0 && dataRemainder > chunkRemainder {
@@ -219,11 +367,11 @@ func (h *handle) applyWrite(data []byte, offset int64, client drive.Client) erro
 
 		// extend cb if necessary
 		if appendSize > 0 {
-			//glog.V(9).Infof("append[%d:%d] (%q)\n", dataPtr, appendSize, data)
+			//logging.V(9).Infof("append[%d:%d] (%q)\n", dataPtr, appendSize, data)
 			cb = append(cb, data[dataPtr:dataPtr+appendSize]...)
 			dataPtr += appendSize
 		}
-		//glog.V(9).Infof("post extend: %q\n", cb)
+		//logging.V(9).Infof("post extend: %q\n", cb)
 
 		h.dirty[cn] = cb
 	}
@@ -237,8 +385,8 @@ func (sc *Server) Serve() error {
 	for w := 1; w <= *numWorkers; w++ {
 		go func(reqs chan fuse.Request) {
 			for req := range reqs {
-				if glog.V(7) {
-					glog.Infof("%+v", req)
+				if logging.V(7) {
+					logging.Infof("%+v", req)
 				}
 				sc.serve(req)
 			}
@@ -259,6 +407,29 @@ func (sc *Server) Serve() error {
 	return nil
 }
 
+// Shutdown flushes the dirty chunks of every open handle to the drive.Client,
+// and publishes their files, as if each had been released.  It should be
+// called before unmounting, so that writes to files which are still open are
+// not lost.  It holds sc.hm, so it is safe to call while requests are being
+// served; writes which arrive afterwards are flushed when their handle is
+// released, as usual.  It also stops the periodic flush of --autoFlushInterval.
+func (sc *Server) Shutdown() {
+	sc.stopOnce.Do(func() { close(sc.stop) })
+	sc.lockWrites()
+	defer sc.unlockWrites()
+	for i, h := range sc.handles {
+		if h.inode == 0 || h.file == nil || len(h.dirty) == 0 {
+			continue
+		}
+		logging.Infof("flushing %s before shutdown", h.file.Filename)
+		if h.released {
+			sc.releaseHandle(fuse.HandleID(i))
+		} else {
+			sc.flush(fuse.HandleID(i))
+		}
+	}
+}
+
 // Refresh updates the view of the underlying drive.Client.
 func (sc *Server) Refresh() error {
 	return sc.tree.Refresh()
@@ -269,21 +440,20 @@ func (sc *Server) serve(req fuse.Request) {
 	switch req := req.(type) {
 	default:
 		// ENOSYS means "this server never implements this request."
-		glog.Warningf("ENOSYS: %+v", req)
+		logging.Warningf("ENOSYS: %+v", req)
 		req.RespondError(fuse.ENOSYS)
 
 	case *fuse.InitRequest:
-		resp := fuse.InitResponse{MaxWrite: 128 * 1024,
-			Flags: fuse.InitBigWrites & fuse.InitAsyncRead,
+		resp, err := initResponse(*maxWrite)
+		if err != nil {
+			logging.Errorf("initResponse: %s", err)
+			req.RespondError(fuse.EIO)
+			return
 		}
-		req.Respond(&resp)
+		req.Respond(resp)
 
 	case *fuse.StatfsRequest:
-		resp := &fuse.StatfsResponse{
-			Files: uint64(sc.tree.NumNodes()),
-			Bsize: blockSize,
-		}
-		req.Respond(resp)
+		req.Respond(sc.statfs())
 
 	case *fuse.GetattrRequest:
 		sc.getattr(req)
@@ -293,6 +463,7 @@ func (sc *Server) serve(req fuse.Request) {
 
 	// Ack that the kernel has forgotten the metadata about an inode
 	case *fuse.ForgetRequest:
+		sc.inode.Forget(uint64(req.Header.Node), req.N)
 		req.Respond()
 
 	// Allocate a kernel file handle, return it
@@ -304,21 +475,34 @@ func (sc *Server) serve(req fuse.Request) {
 		inode := uint64(req.Header.Node)
 		p, err := sc.inode.ToPath(uint64(inode))
 		if err != nil {
-			glog.Warningf("SetattrRequest for inode %d: %s", inode, err)
+			logging.Warningf("SetattrRequest for inode %d: %s", inode, err)
 		}
 		n, err := sc.tree.NodeByPath(p)
 		if err != nil {
-			glog.Warningf("FileByInode(%v): %v", inode, err)
+			logging.Warningf("FileByInode(%v): %v", inode, err)
 			req.RespondError(fuse.EIO)
 			return
 		}
-		glog.Info("Ignoring Setattr for ", p)
+		logging.Info("Ignoring Setattr for ", p)
 		req.Respond(&fuse.SetattrResponse{Attr: sc.attrFromNode(n, inode)})
 
 	case *fuse.CreateRequest:
 		// TODO: if allow_other, require uid == invoking uid to allow writes
 		sc.create(req)
 
+	// Extended attributes are stored in the shade.File
+	case *fuse.GetxattrRequest:
+		sc.getxattr(req)
+
+	case *fuse.ListxattrRequest:
+		sc.listxattr(req)
+
+	case *fuse.SetxattrRequest:
+		sc.setxattr(req)
+
+	case *fuse.RemovexattrRequest:
+		sc.removexattr(req)
+
 	// Return Dirents for directories, or requested portion of file
 	case *fuse.ReadRequest:
 		if req.Dir {
@@ -348,9 +532,12 @@ func (sc *Server) serve(req fuse.Request) {
 
 	// Flush writes to the underlying storage layers
 	case *fuse.FlushRequest:
-		sc.hm.Lock()
-		defer sc.hm.Unlock()
-		sc.flush(req.Handle)
+		sc.lockWrites()
+		defer sc.unlockWrites()
+		if err := sc.flush(req.Handle); err != nil {
+			req.RespondError(fuse.EIO)
+			return
+		}
 		req.Respond()
 
 	// Ack release of the kernel's mapping an inode->fileId
@@ -379,7 +566,7 @@ func (sc *Server) nodeByID(inode fuse.NodeID) (Node, error) {
 func (sc *Server) getattr(req *fuse.GetattrRequest) {
 	n, err := sc.nodeByID(req.Header.Node)
 	if err != nil {
-		glog.Warningf("getattr: sc.nodeById(%d): %s", req.Header.Node, err)
+		logging.Warningf("getattr: sc.nodeById(%d): %s", req.Header.Node, err)
 		req.RespondError(fuse.EIO)
 		return
 	}
@@ -398,23 +585,24 @@ func (sc *Server) lookup(req *fuse.LookupRequest) {
 	// This request is by inode.  Lookup what filename was assigned to that inode.
 	parentDir, err := sc.inode.ToPath(inode)
 	if err != nil {
-		glog.Warningf("lookup of unassigned inode %d: %s", inode, err)
+		logging.Warningf("lookup of unassigned inode %d: %s", inode, err)
 		req.RespondError(fuse.ENOENT)
 		return
 	}
 	// Get the Node for the child of that inode, if it exists
-	filename := strings.TrimPrefix(path.Join(parentDir, req.Name), "/")
+	name := sc.lookupName(strings.TrimPrefix(parentDir, "/"), req.Name)
+	filename := strings.TrimPrefix(path.Join(parentDir, name), "/")
 	node, err := sc.tree.NodeByPath(filename)
 	if err != nil {
-		glog.Warningf("Lookup(%v in %v): ENOENT", filename, inode)
+		logging.Warningf("Lookup(%v in %v): ENOENT", filename, inode)
 		req.RespondError(fuse.ENOENT)
 		return
 	}
-	resp.Node = fuse.NodeID(sc.inode.FromPath(filename))
+	resp.Node = fuse.NodeID(sc.inode.Lookup(filename))
 	resp.EntryValid = *kernelRefresh
 	resp.Attr = sc.attrFromNode(node, inode)
-	if glog.V(5) {
-		glog.Infof("Lookup(%v in %v): %+v", req.Name, inode, resp.Node)
+	if logging.V(5) {
+		logging.Infof("Lookup(%v in %v): %+v", req.Name, inode, resp.Node)
 	}
 	req.Respond(resp)
 }
@@ -423,58 +611,107 @@ func (sc *Server) readDir(req *fuse.ReadRequest) {
 	resp := &fuse.ReadResponse{Data: make([]byte, 0, req.Size)}
 	n, err := sc.nodeByID(req.Header.Node)
 	if err != nil {
-		glog.Warningf("nodeByID(%d): %v", req.Header.Node, err)
+		logging.Warningf("nodeByID(%d): %v", req.Header.Node, err)
+		req.RespondError(fuse.EIO)
+		return
+	}
+
+	data, err := sc.direntsForRead(req.Handle, n.Filename)
+	if err != nil {
+		logging.Warningf("direntsForRead(%v): %v", n.Filename, err)
 		req.RespondError(fuse.EIO)
 		return
 	}
+	if logging.V(8) {
+		logging.Info("ReadDir Response: ", string(data))
+	}
+
+	fuseutil.HandleRead(req, resp, data)
+	req.Respond(resp)
+}
+
+// direntType returns the type of n, as reported in a directory listing.  It
+// must agree with the mode reported by attrFromNode.
+func direntType(n Node) fuse.DirentType {
+	if n.IsDir() {
+		return fuse.DT_Dir
+	}
+	return fuse.DT_File
+}
 
+// direntsForRead returns the listing of dir snapshotted when handle hID was
+// opened, or the current listing if the handle has none.
+func (sc *Server) direntsForRead(hID fuse.HandleID, dir string) ([]byte, error) {
+	sc.hm.Lock()
+	var data []byte
+	if int(hID) < len(sc.handles) && sc.handles[hID].inode != 0 {
+		data = sc.handles[hID].dirents
+	}
+	sc.hm.Unlock()
+	if data != nil {
+		return data, nil
+	}
+	return sc.dirents(dir)
+}
+
+// dirents returns the fuse encoded listing of the children of dir.
+func (sc *Server) dirents(dir string) ([]byte, error) {
 	// HandleRead requires the data section to be sorted the same way each time,
 	// but they are stored in a map.  So read them out and sort them first.
-	var children []string
-	for name := range n.Children {
-		children = append(children, name)
-	}
+	children := sc.tree.Children(dir)
 	sort.Strings(children)
 
-	var data []byte
+	// A non-nil empty listing distinguishes an empty directory from a handle
+	// without a listing.
+	data := []byte{}
 	for _, name := range children {
-		childPath := strings.TrimPrefix(path.Join(n.Filename, name), "/")
+		childPath := strings.TrimPrefix(path.Join(dir, name), "/")
 		c, err := sc.tree.NodeByPath(childPath)
 		if err != nil {
-			glog.Warningf("child: NodeByPath(%v): %v", childPath, err)
-			req.RespondError(fuse.EIO)
-			return
-		}
-		childType := fuse.DT_File
-		if c.Synthetic() {
-			childType = fuse.DT_Dir
+			return nil, fmt.Errorf("child: NodeByPath(%v): %v", childPath, err)
 		}
 		ci := sc.inode.FromPath(childPath)
-		data = fuse.AppendDirent(data, fuse.Dirent{Inode: ci, Name: name, Type: childType})
-	}
-	if glog.V(8) {
-		glog.Info("ReadDir Response: ", string(data))
+		data = fuse.AppendDirent(data, fuse.Dirent{Inode: ci, Name: name, Type: direntType(c)})
 	}
+	return data, nil
+}
 
-	fuseutil.HandleRead(req, resp, data)
-	req.Respond(resp)
+// readErrno returns the error to report to the kernel for a read which failed
+// with err.  A backend which is over quota is reported as EDQUOT, rather than
+// EIO, as the read may succeed once the quota resets.
+func readErrno(err error) fuse.Errno {
+	if drive.IsQuotaError(err) {
+		logging.Errorf("the storage backend is over quota; reads will fail until it resets: %s", err)
+		return fuse.Errno(syscall.EDQUOT)
+	}
+	return fuse.EIO
 }
 
 func (sc *Server) read(req *fuse.ReadRequest) {
 	h, err := sc.handleByID(req.Handle)
 	if err != nil || h.file == nil {
-		glog.Warningf("handleByID(%v): %v", req.Handle, err)
+		logging.Warningf("handleByID(%v): %v", req.Handle, err)
 		req.RespondError(fuse.ESTALE)
 		return
 	}
 	f := h.file
-	if glog.V(6) {
-		glog.Infof("Read(name: %s, offset: %d, size: %d)", f.Filename, req.Offset, req.Size)
+	if logging.V(6) {
+		logging.Infof("Read(name: %s, offset: %d, size: %d)", f.Filename, req.Offset, req.Size)
+	}
+	if *rangedReads {
+		d, err := readRange(sc.client, f, req.Offset, int64(req.Size))
+		if err != nil {
+			logging.Errorf("reading %s at %d: %s", f.Filename, req.Offset, err)
+			req.RespondError(readErrno(err))
+			return
+		}
+		req.Respond(&fuse.ReadResponse{Data: d})
+		return
 	}
 	chunkSize := int64(f.Chunksize)
-	chunkSums, err := chunksForRead(f, req.Offset, int64(req.Size))
+	chunkSums, err := ChunksForRead(f, req.Offset, int64(req.Size))
 	if err != nil {
-		glog.Warningf("chunksForRead(): %s", err)
+		logging.Warningf("ChunksForRead(): %s", err)
 		req.RespondError(fuse.EIO)
 		return
 	}
@@ -483,8 +720,8 @@ func (sc *Server) read(req *fuse.ReadRequest) {
 	for _, cs := range chunkSums {
 		cb, err := h.getChunk(sc.client, cs)
 		if err != nil {
-			glog.Errorf("reading chunk %x: %s", cs, err)
-			req.RespondError(fuse.EIO)
+			logging.Errorf("reading %s: %s", f.Filename, err)
+			req.RespondError(readErrno(err))
 			return
 		}
 		allTheBytes = append(allTheBytes, cb...)
@@ -497,7 +734,7 @@ func (sc *Server) read(req *fuse.ReadRequest) {
 		low = 0
 	}
 	if low > dsize {
-		glog.Errorf("too-low chunk calculation error (low:%d, dsize:%d): filename: %s, offset:%d, size:%d, filesize:%d", low, dsize, f.Filename, req.Offset, req.Size, f.Filesize)
+		logging.Errorf("too-low chunk calculation error (low:%d, dsize:%d): filename: %s, offset:%d, size:%d, filesize:%d", low, dsize, f.Filename, req.Offset, req.Size, f.Filesize)
 		req.RespondError(fuse.EIO)
 		return
 	}
@@ -507,8 +744,8 @@ func (sc *Server) read(req *fuse.ReadRequest) {
 	}
 	d := allTheBytes[low:high]
 	resp := &fuse.ReadResponse{Data: d}
-	if glog.V(8) {
-		glog.Infof("Read resp: %+v %d bytes", resp, len(d))
+	if logging.V(8) {
+		logging.Infof("Read resp: %+v %d bytes", resp, len(d))
 	}
 	req.Respond(resp)
 
@@ -520,6 +757,7 @@ func (sc *Server) read(req *fuse.ReadRequest) {
 	// prefetching.  To satisfy, we prefetch whenever the byte which is 10% of
 	// the chunksize is read.
 	lastChunkJustRead := chunkSums[len(chunkSums)-1]
+	prefetchByte := chunkSize / 10
 	if low < prefetchByte && high > prefetchByte {
 		var prefetchChunk int
 		for i, c := range f.Chunks {
@@ -528,14 +766,14 @@ func (sc *Server) read(req *fuse.ReadRequest) {
 			}
 		}
 		if prefetchChunk >= len(f.Chunks) {
-			glog.V(3).Info("There is no next chunk to prefetch.")
+			logging.V(3).Info("There is no next chunk to prefetch.")
 			return
 		}
 		maxPrefetch := (chunksPerHandle * 3 / 4) - 1
 		for x := prefetchChunk; x < prefetchChunk+maxPrefetch && x < len(f.Chunks); x++ {
-			glog.V(4).Infof("Discovery prefetch chunk %d", x)
+			logging.V(4).Infof("Discovery prefetch chunk %d", x)
 			cs := f.Chunks[x].Sha256
-			glog.V(4).Infof("Prefetching chunk %d: %x", x, cs)
+			logging.V(4).Infof("Prefetching chunk %d: %x", x, cs)
 			// TODO: make this a pool of workers, maybe per-handle?
 			go func() { h.prefetchChunk(sc.client, cs) }()
 		}
@@ -571,7 +809,7 @@ func (sc *Server) attrFromNode(node Node, i uint64) fuse.Attr {
 		Nlink: 1,
 	}
 
-	if node.Synthetic() { // it's a synthetic directory
+	if node.IsDir() { // a synthetic directory, or a file with children
 		attr.Mode = os.ModeDir | 0755
 		attr.Nlink = uint32(len(node.Children) + 2)
 		return attr
@@ -604,19 +842,25 @@ func (sc *Server) open(req *fuse.OpenRequest) {
 	// get the shade.File for the node, stuff it in the Handle
 	f, err := sc.tree.FileByNode(n)
 	if err != nil && !req.Dir {
-		glog.Warningf("FileByNode(%v): %s", n, err)
+		logging.Warningf("FileByNode(%v): %s", n, err)
 		req.RespondError(fuse.ENOENT)
 		return
 	}
-	hID, err := sc.allocHandle(req.Header.Node, f)
+	var hID uint64
+	if req.Dir {
+		hID, err = sc.allocDirHandle(req.Header.Node, n.Filename)
+	} else {
+		hID, err = sc.allocHandle(req.Header.Node, f)
+	}
 	if err != nil {
-		glog.Errorf("allocating handle for %s: %s", n.Filename, err)
+		logging.Errorf("allocating handle for %s: %s", n.Filename, err)
 		req.RespondError(fuse.EIO)
 		return
 	}
+	sc.setAppend(hID, req.Flags)
 
 	resp := fuse.OpenResponse{Handle: fuse.HandleID(hID)}
-	glog.V(5).Infof("Open Response: %+v", resp)
+	logging.V(5).Infof("Open Response: %+v", resp)
 	req.Respond(&resp)
 }
 
@@ -651,6 +895,30 @@ func (sc *Server) allocHandle(inode fuse.NodeID, f *shade.File) (uint64, error)
 	return hID, nil
 }
 
+// allocate a kernel directory handle for the requested inode, holding a
+// snapshot of the listing of dir until it is released
+func (sc *Server) allocDirHandle(inode fuse.NodeID, dir string) (uint64, error) {
+	data, err := sc.dirents(dir)
+	if err != nil {
+		return 0, err
+	}
+	hID, err := sc.allocHandle(inode, nil)
+	if err != nil {
+		return 0, err
+	}
+	sc.hm.Lock()
+	sc.handles[hID].dirents = data
+	sc.hm.Unlock()
+	return hID, nil
+}
+
+// setAppend records on handle hID whether it was opened with O_APPEND.
+func (sc *Server) setAppend(hID uint64, flags fuse.OpenFlags) {
+	sc.hm.Lock()
+	sc.handles[hID].append = flags&fuse.OpenAppend != 0
+	sc.hm.Unlock()
+}
+
 // Lookup a handleID by its NodeID
 func (sc *Server) handleByID(id fuse.HandleID) (*handle, error) {
 	sc.hm.Lock()
@@ -663,15 +931,46 @@ func (sc *Server) handleByID(id fuse.HandleID) (*handle, error) {
 
 // Acknowledge release (eg. close) of file handle by the kernel
 func (sc *Server) release(req *fuse.ReleaseRequest) {
-	sc.hm.Lock()
-	defer sc.hm.Unlock()
-	h := sc.handles[req.Handle]
-	sc.flush(req.Handle)
-	h.inode = 0
-	glog.V(5).Infof("release on req.Handle: %+v", req.Handle)
+	sc.lockWrites()
+	defer sc.unlockWrites()
+	if err := sc.releaseHandle(req.Handle); err != nil {
+		logging.Errorf("keeping the dirty chunks of released handle %v, to retry storing them: %s", req.Handle, err)
+	}
+	sc.flushReleased()
+	logging.V(5).Infof("release on req.Handle: %+v", req.Handle)
 	req.Respond()
 }
 
+// releaseHandle flushes the handle hID, and frees it for reuse.  If the
+// flush fails, the handle is marked released instead, and keeps its dirty
+// chunks, to be retried by flushReleased.
+// Nb: caller is responsible for holding sc.hm
+func (sc *Server) releaseHandle(hID fuse.HandleID) error {
+	h := sc.handles[hID]
+	if err := sc.flush(hID); err != nil {
+		h.released = true
+		return err
+	}
+	h.inode = 0
+	h.dirents = nil
+	h.released = false
+	return nil
+}
+
+// flushReleased retries the flush of every handle which was released with
+// dirty chunks that could not be stored.
+// Nb: caller is responsible for holding sc.hm
+func (sc *Server) flushReleased() {
+	for i, h := range sc.handles {
+		if h.inode == 0 || !h.released {
+			continue
+		}
+		if err := sc.releaseHandle(fuse.HandleID(i)); err != nil {
+			logging.Warningf("retrying the flush of released %s: %s", h.file.Filename, err)
+		}
+	}
+}
+
 // Allocate handle, corresponding to kernel filehandle, for writes
 func (sc *Server) create(req *fuse.CreateRequest) {
 	pn, err := sc.nodeByID(req.Header.Node)
@@ -679,19 +978,26 @@ func (sc *Server) create(req *fuse.CreateRequest) {
 		req.RespondError(fuse.ENOENT)
 		return
 	}
+	name, err := sc.newName(pn.Filename, req.Name)
+	if err != nil {
+		logging.Warningf("Create(%v in %v): %s", req.Name, pn.Filename, err)
+		req.RespondError(err.(*nameError).errno)
+		return
+	}
 	// create child node
-	fn := path.Join(pn.Filename, req.Name)
+	fn := path.Join(pn.Filename, name)
 	n := sc.tree.Create(fn)
-	inode := sc.inode.FromPath(fn)
+	inode := sc.inode.Lookup(fn)
 	// create file object
 	file := shade.NewFile(fn)
 	// create handle
 	hID, err := sc.allocHandle(fuse.NodeID(inode), file)
 	if err != nil {
-		glog.Errorf("allocating handle for %s: %s", fn, err)
+		logging.Errorf("allocating handle for %s: %s", fn, err)
 		req.RespondError(fuse.EIO)
 		return
 	}
+	sc.setAppend(hID, req.Flags)
 
 	// Respond to tell the fuse kernel module about the file
 	resp := fuse.CreateResponse{
@@ -706,7 +1012,7 @@ func (sc *Server) create(req *fuse.CreateRequest) {
 			Attr:       sc.attrFromNode(n, inode),
 		},
 	}
-	glog.V(5).Infof("Create(%v in %v): %+v", req.Name, pn.Filename, resp)
+	logging.V(5).Infof("Create(%v in %v): %+v", req.Name, pn.Filename, resp)
 
 	req.Respond(&resp)
 }
@@ -721,26 +1027,32 @@ func (sc *Server) mkdir(req *fuse.MkdirRequest) {
 		return
 	}
 
-	if !p.Synthetic() {
+	if !p.IsDir() {
 		// TODO: is this right?  we want to return "Not a directory"
 		req.RespondError(fuse.EEXIST)
 		return
 	}
-	if p.Children[req.Name] {
+	name, err := sc.newName(p.Filename, req.Name)
+	if err != nil {
+		logging.Warningf("Mkdir(%v in %v): %s", req.Name, p.Filename, err)
+		req.RespondError(err.(*nameError).errno)
+		return
+	}
+	if p.Children[name] {
 		req.RespondError(fuse.EEXIST)
 	}
 
-	dir := path.Join(p.Filename, req.Name)
+	dir := path.Join(p.Filename, name)
 	n := sc.tree.Mkdir(dir)
 
-	inode := sc.inode.FromPath(dir)
+	inode := sc.inode.Lookup(dir)
 
 	resp := fuse.LookupResponse{
 		Node:       fuse.NodeID(inode),
 		EntryValid: *kernelRefresh,
 		Attr:       sc.attrFromNode(n, inode),
 	}
-	glog.V(5).Infof("Mkdir(%v): %+v", req.Name, resp)
+	logging.V(5).Infof("Mkdir(%v): %+v", req.Name, resp)
 	req.Respond(&fuse.MkdirResponse{LookupResponse: resp})
 }
 
@@ -751,56 +1063,230 @@ func (sc *Server) remove(req *fuse.RemoveRequest) {
 	// TODO: if allow_other, require uid == invoking uid to allow writes
 	parentdir, err := sc.inode.ToPath(uint64(req.Header.Node))
 	if err != nil {
-		glog.Warningf("sc.NodeById(%d): %s", req.Header.Node, err)
+		logging.Warningf("sc.NodeById(%d): %s", req.Header.Node, err)
 		req.RespondError(fuse.ENOENT)
 		return
 	}
 	filename := strings.TrimPrefix(path.Join(parentdir, req.Name), "/")
-	// create Deleted File
+	if err := sc.removePath(filename, req.Dir); err != nil {
+		req.RespondError(err)
+		return
+	}
+	req.Respond()
+}
+
+// removePath removes the file, or if dir is true the empty directory, at
+// filename from the tree.  Removing a file publishes a Deleted shade.File,
+// after moving it to the trash if --trash is set.  Directories are synthetic,
+// so they are only removed from the tree.  The error returned is suitable to
+// respond to the kernel with.
+func (sc *Server) removePath(filename string, dir bool) error {
+	if dir {
+		if err := sc.tree.Rmdir(filename); err == errNotEmpty {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		} else if err != nil {
+			logging.Warningf("Rmdir(%q): %s", filename, err)
+			return fuse.ENOENT
+		}
+		return nil
+	}
+	n, err := sc.tree.NodeByPath(filename)
+	if err != nil {
+		logging.Warningf("NodeByPath(%q): %s", filename, err)
+		return fuse.ENOENT
+	} else if n.IsDir() {
+		return fuse.Errno(syscall.EISDIR)
+	}
+	if *trash && !umbrella.InTrash(filename) {
+		if err := sc.moveToTrash(n); err != nil {
+			logging.Warningf("could not move %q to the trash: %s", filename, err)
+			return fuse.EIO
+		}
+	}
+
+	// publish Deleted File
 	f := shade.NewFile(filename)
 	f.Deleted = true
-	node := Node{
+	jm, err := json.Marshal(f)
+	if err != nil {
+		logging.Exitf("could not marshal shade.File: %s", err)
+	}
+	sum := shade.Sum(jm)
+	for {
+		err := sc.client.PutFile(sum, jm)
+		if err != nil {
+			logging.Errorf("error storing deleted file %s with sum: %x: %s", filename, sum, err)
+			continue
+		}
+		logging.V(5).Infof("stored file %s with sum: %x", filename, sum)
+		break
+	}
+	// remove Node, and its entry in the parent's Children
+	logging.V(5).Infof("sc.tree.Update(..%s..)", f.Filename)
+	sc.tree.Update(Node{
 		Filename:     f.Filename,
 		ModifiedTime: f.ModifiedTime,
 		Deleted:      true,
-		Sha256sum:    []byte("deleted"),
+		Sha256sum:    sum,
+	})
+	return nil
+}
+
+// moveToTrash publishes a copy of the file of n at its path in the trash, so
+// that it can be restored after n is removed.
+func (sc *Server) moveToTrash(n Node) error {
+	f, err := sc.tree.FileByNode(n)
+	if err != nil {
+		return err
 	}
-	if req.Dir {
-		// ensure the are no children of this node
-		node, err := sc.tree.NodeByPath(filename)
-		if err != nil {
-			glog.Warningf("sc.NodeById(%d): %s", req.Header.Node, err)
-			req.RespondError(fuse.ENOENT)
-		}
-		if len(node.Children) == 0 {
-			glog.Warningf("sc.NodeById(%d): %s", req.Header.Node, err)
-			req.RespondError(syscall.ENOTEMPTY)
+	f.Filename = umbrella.TrashPath(n.Filename)
+	sc.tree.Create(f.Filename)
+	sc.storeFile(&handle{file: f})
+	return nil
+}
+
+// Flags of a SetxattrRequest, as defined by setxattr(2).
+const (
+	xattrCreate  = 0x1 // fail if the attribute already exists
+	xattrReplace = 0x2 // fail if the attribute does not exist
+)
+
+// getxattr responds with the value of an extended attribute
+func (sc *Server) getxattr(req *fuse.GetxattrRequest) {
+	xattrs, err := sc.xattrs(req.Header.Node)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+	value, ok := xattrs[req.Name]
+	if !ok {
+		req.RespondError(fuse.ErrNoXattr)
+		return
+	}
+	if req.Size != 0 && len(value) > int(req.Size) {
+		req.RespondError(fuse.ERANGE)
+		return
+	}
+	req.Respond(&fuse.GetxattrResponse{Xattr: value})
+}
+
+// listxattr responds with the names of the extended attributes
+func (sc *Server) listxattr(req *fuse.ListxattrRequest) {
+	xattrs, err := sc.xattrs(req.Header.Node)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+	var names []string
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	resp := &fuse.ListxattrResponse{}
+	resp.Append(names...)
+	if req.Size != 0 && len(resp.Xattr) > int(req.Size) {
+		req.RespondError(fuse.ERANGE)
+		return
+	}
+	req.Respond(resp)
+}
+
+// setxattr sets the value of an extended attribute, and publishes the file
+func (sc *Server) setxattr(req *fuse.SetxattrRequest) {
+	// req.Xattr is only valid until Respond, so it is copied
+	value := append([]byte{}, req.Xattr...)
+	err := sc.updateXattrs(req.Header.Node, func(xattrs map[string][]byte) error {
+		_, exists := xattrs[req.Name]
+		if exists && req.Flags&xattrCreate != 0 {
+			return fuse.EEXIST
 		}
-		node.Sha256sum = nil
-	} else {
-		// publish Deleted File
-		jm, err := json.Marshal(f)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "could not marshal shade.File: %s\n", err)
-			os.Exit(1)
+		if !exists && req.Flags&xattrReplace != 0 {
+			return fuse.ErrNoXattr
 		}
-		sum := shade.Sum(jm)
-		for {
-			err := sc.client.PutFile(sum, jm)
-			if err != nil {
-				glog.Errorf("error storing deleted file %s with sum: %x: %s", filename, sum, err)
-				continue
-			}
-			glog.V(5).Infof("stored file %s with sum: %x", filename, sum)
-			break
+		xattrs[req.Name] = value
+		return nil
+	})
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+	req.Respond()
+}
+
+// removexattr removes an extended attribute, and publishes the file
+func (sc *Server) removexattr(req *fuse.RemovexattrRequest) {
+	err := sc.updateXattrs(req.Header.Node, func(xattrs map[string][]byte) error {
+		if _, ok := xattrs[req.Name]; !ok {
+			return fuse.ErrNoXattr
 		}
+		delete(xattrs, req.Name)
+		return nil
+	})
+	if err != nil {
+		req.RespondError(err)
+		return
 	}
-	// remove Node
-	glog.V(5).Infof("sc.tree.Update(..%s..)", f.Filename)
-	sc.tree.Update(node)
 	req.Respond()
 }
 
+// xattrs returns the extended attributes of the file at inode.  Synthetic
+// directories have no shade.File, and so have none.
+func (sc *Server) xattrs(inode fuse.NodeID) (map[string][]byte, error) {
+	n, err := sc.nodeByID(inode)
+	if err != nil {
+		logging.Warningf("nodeByID(%d): %v", inode, err)
+		return nil, fuse.ENOENT
+	}
+	if n.Synthetic() {
+		return nil, nil
+	}
+	f, err := sc.tree.FileByNode(n)
+	if err != nil {
+		logging.Warningf("FileByNode(%v): %s", n, err)
+		return nil, fuse.EIO
+	}
+	return f.Xattrs, nil
+}
+
+// updateXattrs applies update to the extended attributes of the file at
+// inode, and publishes the result as a new version of the file.  Open handles
+// on the file are updated too, so a later flush does not revert the change.
+func (sc *Server) updateXattrs(inode fuse.NodeID, update func(map[string][]byte) error) error {
+	n, err := sc.nodeByID(inode)
+	if err != nil {
+		logging.Warningf("nodeByID(%d): %v", inode, err)
+		return fuse.ENOENT
+	}
+	if n.Synthetic() {
+		return fuse.ENOTSUP
+	}
+	sc.hm.Lock()
+	defer sc.hm.Unlock()
+	f, err := sc.tree.FileByNode(n)
+	if err != nil {
+		logging.Warningf("FileByNode(%v): %s", n, err)
+		return fuse.EIO
+	}
+	xattrs := make(map[string][]byte, len(f.Xattrs)+1)
+	for name, value := range f.Xattrs {
+		xattrs[name] = value
+	}
+	if err := update(xattrs); err != nil {
+		return err
+	}
+	if len(xattrs) == 0 {
+		xattrs = nil
+	}
+	f.Xattrs = xattrs
+	sc.storeFile(&handle{file: f})
+	for _, h := range sc.handles {
+		if h.inode == inode && h.file != nil {
+			h.file.Xattrs = xattrs
+		}
+	}
+	return nil
+}
+
 // rename renames a file or directory, optionally reparenting it
 func (sc *Server) rename(req *fuse.RenameRequest) {
 	// TODO(asjoyner): shadeify
@@ -890,109 +1376,528 @@ func (sc *Server) write(req *fuse.WriteRequest) {
 	// TODO: if allow_other, require uid == invoking uid to allow writes
 	h, err := sc.handleByID(req.Handle)
 	if err != nil {
-		glog.Warningf("handleByID(%v): %v", req.Handle, err)
+		logging.Warningf("handleByID(%v): %v", req.Handle, err)
 		req.RespondError(fuse.ESTALE)
 		return
 	}
 
-	// update chunks in handle
-	sc.hm.Lock()
-	defer sc.hm.Unlock()
-	if h.applyWrite(req.Data, req.Offset, sc.client); err != nil {
+	if err := sc.writeHandle(req.Handle, h, req.Data, req.Offset); err != nil {
 		req.RespondError(fuse.EIO)
 		return
 	}
-	sc.handles[req.Handle] = h
 	req.Respond(&fuse.WriteResponse{Size: len(req.Data)})
 }
 
-// Write out the dirty chunks to the shade drive.Client
+// writeHandle applies data to the dirty chunks of h, the handle hID, at
+// offset.  If h was opened with O_APPEND, offset is ignored, and data is
+// written at the end of the file, as it is when the write is applied.
+func (sc *Server) writeHandle(hID fuse.HandleID, h *handle, data []byte, offset int64) error {
+	sc.hm.Lock()
+	defer sc.hm.Unlock()
+	if h.append {
+		offset = h.size()
+	}
+	if err := h.applyWrite(data, offset, sc.client); err != nil {
+		return err
+	}
+	sc.handles[hID] = h
+	sc.limitDirty(hID)
+	return nil
+}
+
+// Write out the dirty chunks to the shade drive.Client.  It returns an error
+// if any of them could not be stored.
 // Nb: caller is responsible for holding sc.hm
-func (sc *Server) flush(hID fuse.HandleID) {
+func (sc *Server) flush(hID fuse.HandleID) error {
 	h := sc.handles[hID]
 	if h.file == nil || len(h.dirty) == 0 {
-		return
+		return nil
+	}
+	l, err := sc.writeLock()
+	if err != nil {
+		logging.V(2).Infof("deferring the flush of %s: %s", h.file.Filename, err)
+		return err
+	}
+	defer l.Unlock()
+	if err := sc.storeChunks(h); err != nil {
+		// The chunks which failed remain dirty, to be retried by the next
+		// flush, and the file is not published until they are stored.
+		logging.Errorf("not storing %s: %s", h.file.Filename, err)
+		sc.handles[hID] = h
+		return err
+	}
+	sc.storeFile(h)
+
+	// Update the handle
+	sc.handles[hID] = h
+	return nil
+}
+
+// storeChunks records the sums of the dirty chunks of h in h.file.Chunks, and
+// writes up to --flushConcurrency of them to the drive.Client at once.  The
+// chunks which are stored are removed from h.dirty.  It returns an error if
+// any of them still fails after maxRetries attempts; h.file.Chunks then
+// describes only chunks which have been stored, so it may still be published
+// by flushCompleted.
+func (sc *Server) storeChunks(h *handle) error {
+	type put struct {
+		cn  int64
+		sum []byte
 	}
 	// ensure h.file.Chunks is large enough
+	origChunks := append([]shade.Chunk(nil), h.file.Chunks...)
+	origLast := h.file.LastChunksize
 	var lastDirtyChunk int64 = -1
 	for cn := range h.dirty {
 		if cn > lastDirtyChunk {
 			lastDirtyChunk = cn
 		}
 	}
-	glog.V(8).Infof("Chunks length before: %+v", len(h.file.Chunks))
+	logging.V(8).Infof("Chunks length before: %+v", len(h.file.Chunks))
 	if int64(len(h.file.Chunks)) <= lastDirtyChunk {
 		nc := make([]shade.Chunk, lastDirtyChunk+1, lastDirtyChunk+1)
 		copy(nc, h.file.Chunks)
 		h.file.Chunks = nc
 	}
-	glog.V(8).Infof("Chunks length: %+v", len(h.file.Chunks))
-	glog.V(8).Infof("lastDirtyChunk: %+v", lastDirtyChunk)
+	logging.V(8).Infof("Chunks length: %+v", len(h.file.Chunks))
+	logging.V(8).Infof("lastDirtyChunk: %+v", lastDirtyChunk)
+
+	// The sums are recorded first, so h.file is not modified while the
+	// client reads it.
+	var puts []put
 	for cn, dirtyChunk := range h.dirty {
-		sum := shade.Sum(dirtyChunk)
-		h.file.Chunks[cn].Sha256 = sum
-		h.file.Chunks[cn].Nonce = shade.NewNonce()
-		if cn+1 == int64(len(h.file.Chunks)) {
-			h.file.LastChunksize = len(dirtyChunk)
-		}
-		numRetries := 0
-		b := &backoff.Backoff{Factor: 4}
-		for {
-			numRetries++
-			err := sc.client.PutChunk(sum, dirtyChunk, h.file)
-			if err != nil {
-				glog.Errorf("error storing chunk with sum (retry %d): %x: %s", numRetries, sum, err)
-				if numRetries >= *maxRetries {
-					glog.Errorf("aborting write, maximum retries exceeded.")
-					break
+		sum, err := recordChunk(h, cn, dirtyChunk)
+		if err != nil {
+			return err
+		}
+		puts = append(puts, put{cn, sum})
+	}
+	sort.Slice(puts, func(i, j int) bool { return puts[i].cn < puts[j].cn })
+
+	workers := *flushConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(puts) {
+		workers = len(puts)
+	}
+	reqs := make(chan put)
+	var wg sync.WaitGroup
+	var mu sync.Mutex // protects failed and errs
+	failed := make(map[int64]bool)
+	var errs []string
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for p := range reqs {
+				err := sc.putChunk(p.sum, h.dirty[p.cn], h.file)
+				if err != nil {
+					mu.Lock()
+					failed[p.cn] = true
+					errs = append(errs, err.Error())
+					mu.Unlock()
 				}
-				time.Sleep(b.Duration())
-				continue
 			}
-			if glog.V(6) {
-				glog.Infof("stored chunk with sum: %x", sum)
+		}()
+	}
+	for _, p := range puts {
+		reqs <- p
+	}
+	close(reqs)
+	wg.Wait()
+
+	if len(errs) == 0 {
+		for _, p := range puts {
+			delete(h.dirty, p.cn)
+		}
+		return nil
+	}
+
+	// Restore the chunks which failed to what they were before, and drop
+	// the new chunks from the first which failed, so that h.file.Chunks
+	// has no holes.  The chunks dropped remain dirty, even if they were
+	// stored, to be recorded again by the next flush.
+	for cn := range failed {
+		if cn < int64(len(origChunks)) {
+			h.file.Chunks[cn] = origChunks[cn]
+		} else {
+			h.file.Chunks[cn] = shade.Chunk{}
+		}
+	}
+	kept := len(origChunks)
+	for kept < len(h.file.Chunks) && h.file.Chunks[kept].Sha256 != nil {
+		kept++
+	}
+	h.file.Chunks = h.file.Chunks[:kept]
+	h.file.LastChunksize = origLast
+	if last := int64(kept - 1); last >= 0 && h.dirty[last] != nil && !failed[last] {
+		h.file.LastChunksize = len(h.dirty[last])
+	}
+	for _, p := range puts {
+		if p.cn < int64(kept) && !failed[p.cn] {
+			delete(h.dirty, p.cn)
+		}
+	}
+	return fmt.Errorf("%d of %d chunks could not be stored: %s", len(errs), len(puts), strings.Join(errs, "; "))
+}
+
+// flushCompleted writes out the dirty chunks which are unlikely to change
+// again, and publishes a shade.File describing them.  This bounds the amount
+// of dirty data held in RAM, and lost if the machine crashes, while a file is
+// held open for writing.  A chunk is considered completed if it is full sized
+// and is not the final chunk of the file.  Only chunks which are contiguous
+// with those already in h.file.Chunks are flushed, so the published File never
+// has holes in it.
+// Nb: caller is responsible for holding sc.hm
+func (sc *Server) flushCompleted(hID fuse.HandleID) {
+	h := sc.handles[hID]
+	if h.file == nil || len(h.dirty) == 0 {
+		return
+	}
+	finalChunk := int64(len(h.file.Chunks) - 1)
+	var completed []int64
+	for cn := range h.dirty {
+		if cn > finalChunk {
+			finalChunk = cn
+		}
+	}
+	for cn, dirtyChunk := range h.dirty {
+		if cn < finalChunk && len(dirtyChunk) == h.file.Chunksize {
+			completed = append(completed, cn)
+		}
+	}
+	if len(completed) == 0 {
+		return
+	}
+	sort.Slice(completed, func(i, j int) bool { return completed[i] < completed[j] })
+	l, err := sc.writeLock()
+	if err != nil {
+		logging.V(2).Infof("deferring the auto flush of %s: %s", h.file.Filename, err)
+		return
+	}
+	defer l.Unlock()
+
+	var flushed int
+	for _, cn := range completed {
+		if cn > int64(len(h.file.Chunks)) {
+			break // the published File can't skip over unwritten chunks
+		}
+		var orig shade.Chunk
+		origLast := h.file.LastChunksize
+		if cn == int64(len(h.file.Chunks)) {
+			h.file.Chunks = append(h.file.Chunks, shade.Chunk{Index: int(cn)})
+		} else {
+			orig = h.file.Chunks[cn]
+		}
+		if err := sc.storeChunk(h, cn, h.dirty[cn]); err != nil {
+			logging.Warningf("auto flush of %s aborted: %s", h.file.Filename, err)
+			if orig.Sha256 == nil {
+				h.file.Chunks = h.file.Chunks[:cn]
+			} else {
+				h.file.Chunks[cn] = orig
 			}
-			b.Reset()
+			h.file.LastChunksize = origLast
 			break
 		}
+		delete(h.dirty, cn)
+		flushed++
+	}
+	if flushed == 0 {
+		return
+	}
+	logging.V(5).Infof("auto flushed %d chunk(s) of %s", flushed, h.file.Filename)
+	sc.storeFile(h)
+	sc.handles[hID] = h
+}
+
+// limitDirty bounds the dirty data held in RAM, after a write to handle hID.
+// If the handle holds more than --maxHandleDirtyBytes, its completed chunks
+// are flushed, and then the whole file if that is not enough.  If the open
+// files together hold more than --maxDirtyBytes, the completed chunks of
+// each are flushed, and then whole files, largest first, until they do not.
+// It is called before the write is acknowledged, so a writer which outpaces
+// the drive.Client waits for its data to be stored.
+// Nb: caller is responsible for holding sc.hm
+func (sc *Server) limitDirty(hID fuse.HandleID) {
+	if limit := *maxHandleDirtyBytes; limit > 0 && sc.handles[hID].dirtyBytes() > limit {
+		sc.flushCompleted(hID)
+		if sc.handles[hID].dirtyBytes() > limit {
+			logging.V(3).Infof("flushing %s, which has more than %d dirty bytes", sc.handles[hID].file.Filename, limit)
+			sc.flush(hID)
+		}
+	}
+	limit := *maxDirtyBytes
+	if limit <= 0 || sc.dirtyBytes() <= limit {
+		return
+	}
+	for i, h := range sc.handles {
+		if h.inode != 0 {
+			sc.flushCompleted(fuse.HandleID(i))
+		}
+	}
+	for total := sc.dirtyBytes(); total > limit; {
+		largest, size := -1, int64(0)
+		for i, h := range sc.handles {
+			if b := h.dirtyBytes(); h.inode != 0 && h.file != nil && b > size {
+				largest, size = i, b
+			}
+		}
+		if largest < 0 {
+			return
+		}
+		logging.V(3).Infof("flushing %s, as open files have more than %d dirty bytes", sc.handles[largest].file.Filename, limit)
+		sc.flush(fuse.HandleID(largest))
+		total -= size
+	}
+}
+
+// dirtyBytes returns the number of bytes in the dirty chunks of every open
+// handle.
+// Nb: caller is responsible for holding sc.hm
+func (sc *Server) dirtyBytes() int64 {
+	var total int64
+	for _, h := range sc.handles {
+		if h.inode != 0 {
+			total += h.dirtyBytes()
+		}
+	}
+	return total
+}
+
+// periodicFlush calls flushCompleted on every open handle each time refresh
+// ticks, and retries the flush of released handles, until Shutdown is called.
+func (sc *Server) periodicFlush(refresh *time.Ticker) {
+	defer refresh.Stop()
+	for {
+		select {
+		case <-refresh.C:
+		case <-sc.stop:
+			return
+		}
+		sc.lockWrites()
+		for i, h := range sc.handles {
+			if h.inode == 0 {
+				continue
+			}
+			sc.flushCompleted(fuse.HandleID(i))
+		}
+		sc.flushReleased()
+		sc.unlockWrites()
+	}
+}
+
+// statfs describes the capacity of the backend, as reported by drive.Space, in
+// blocks of blockSize bytes.
+func (sc *Server) statfs() *fuse.StatfsResponse {
+	sc.spaceMu.Lock()
+	if time.Since(sc.spaceAt) > spaceRefresh {
+		total, free, err := drive.Space(sc.client)
+		if err != nil {
+			if err != drive.ErrUnknownSpace {
+				logging.Warningf("could not get the space of the backend: %s", err)
+			}
+			total, free = unknownSpace, unknownSpace
+		}
+		sc.spaceTotal, sc.spaceFree, sc.spaceAt = total, free, time.Now()
+	}
+	total, free := sc.spaceTotal, sc.spaceFree
+	sc.spaceMu.Unlock()
+	return &fuse.StatfsResponse{
+		Blocks: total / uint64(blockSize),
+		Bfree:  free / uint64(blockSize),
+		Bavail: free / uint64(blockSize),
+		Files:  uint64(sc.tree.NumNodes()),
+		Bsize:  blockSize,
+		Frsize: blockSize,
+	}
+}
+
+// writeLock acquires a shared repository lock, which is held while the
+// chunks of a file and then the file itself are stored, so that a concurrent
+// umbrella.Cleanup does not release the chunks in between.  It is called
+// with sc.hm held, so it never waits for Cleanup: if lockWrites already took
+// the lock, it returns nil, and otherwise it returns ErrLocked while Cleanup
+// holds the repository, and the caller leaves the chunks dirty, to be
+// flushed later.  The lock is advisory; if it can't be acquired for any other
+// reason, the write proceeds without it rather than losing the dirty data.
+// Nb: caller is responsible for holding sc.hm
+func (sc *Server) writeLock() (*repolock.Lock, error) {
+	if sc.lock == nil || sc.sharedTaken {
+		return nil, nil
+	}
+	l, err := sc.lock.TryShared()
+	if errors.Is(err, repolock.ErrLocked) {
+		return nil, err
+	}
+	if err != nil {
+		logging.Warningf("writing without the repository lock: %s", err)
+	}
+	return l, nil
+}
+
+// lockWrites acquires a shared repository lock, waiting for a running
+// umbrella.Cleanup to finish, and then sc.hm, so that the flushes made until
+// unlockWrites is called do not have to wait with sc.hm held.  It is used
+// where a flush must not be deferred, as when a file is flushed or closed.
+func (sc *Server) lockWrites() {
+	var l *repolock.Lock
+	if sc.lock != nil {
+		var err error
+		if l, err = sc.lock.Shared(); err != nil {
+			logging.Warningf("writing without the repository lock: %s", err)
+		}
+	}
+	sc.hm.Lock()
+	sc.shared, sc.sharedTaken = l, true
+}
+
+// unlockWrites releases sc.hm, and then the lock taken by lockWrites.
+func (sc *Server) unlockWrites() {
+	l := sc.shared
+	sc.shared, sc.sharedTaken = nil, false
+	sc.hm.Unlock()
+	l.Unlock()
+}
+
+// storeChunk records the sum of dirtyChunk as chunk cn of the handle's File,
+// and writes it to the drive.Client.  It returns an error if the write still
+// fails after maxRetries attempts.
+// Nb: h.file.Chunks must already be large enough to hold chunk cn.
+func (sc *Server) storeChunk(h *handle, cn int64, dirtyChunk []byte) error {
+	sum, err := recordChunk(h, cn, dirtyChunk)
+	if err != nil {
+		return err
 	}
-	h.dirty = nil
+	return sc.putChunk(sum, dirtyChunk, h.file)
+}
+
+// recordChunk records the sum of dirtyChunk as chunk cn of the handle's File,
+// and returns the sum.
+// Nb: h.file.Chunks must already be large enough to hold chunk cn.
+func recordChunk(h *handle, cn int64, dirtyChunk []byte) ([]byte, error) {
+	sum, err := h.file.Sum(dirtyChunk)
+	if err != nil {
+		return nil, err
+	}
+	h.file.Chunks[cn].Index = int(cn)
+	h.file.Chunks[cn].Sha256 = sum
+	h.file.Chunks[cn].Nonce = shade.NewNonce()
+	if cn+1 == int64(len(h.file.Chunks)) {
+		h.file.LastChunksize = len(dirtyChunk)
+	}
+	return sum, nil
+}
+
+// putChunk writes the chunk with sum, of the File f, to the drive.Client,
+// retrying with backoff.  It returns an error if the write still fails after
+// maxRetries attempts.
+func (sc *Server) putChunk(sum, dirtyChunk []byte, f *shade.File) error {
+	numRetries := 0
+	b := &backoff.Backoff{Factor: 4}
+	for {
+		numRetries++
+		err := sc.client.PutChunk(sum, dirtyChunk, f)
+		if err != nil {
+			logging.Errorf("error storing chunk with sum (retry %d): %x: %s", numRetries, sum, err)
+			if numRetries >= *maxRetries {
+				return fmt.Errorf("storing chunk %x: %s", sum, err)
+			}
+			time.Sleep(b.Duration())
+			continue
+		}
+		if logging.V(6) {
+			logging.Infof("stored chunk with sum: %x", sum)
+		}
+		return nil
+	}
+}
+
+// storeFile publishes the handle's File to the drive.Client, and updates the
+// Tree's understanding of the Node to match.  The published File describes
+// only the chunks which have been stored, but the Node has the size of the
+// handle, including its dirty chunks, so a partly flushed file does not
+// appear to shrink while it is open.
+func (sc *Server) storeFile(h *handle) {
 	h.file.ModifiedTime = time.Now()
 	h.file.UpdateFilesize()
+	h.file.UpdateDigest()
 	jm, err := json.Marshal(h.file)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not marshal shade.File: %s\n", err)
-		os.Exit(1)
+		logging.Exitf("could not marshal shade.File: %s", err)
 	}
 	sum := shade.Sum(jm)
 	for {
 		err := sc.client.PutFile(sum, jm)
 		if err != nil {
-			glog.Errorf("error storing file %s with sum: %x: %s", h.file.Filename, sum, err)
+			logging.Errorf("error storing file %s with sum: %x: %s", h.file.Filename, sum, err)
 			continue
 		}
-		glog.V(3).Infof("stored file %s with sum: %x", h.file.Filename, sum)
+		logging.V(3).Infof("stored file %s with sum: %x", h.file.Filename, sum)
 		break
 	}
 
 	// Update sc.tree's understanding of the Node
 	n, err := sc.tree.NodeByPath(h.file.Filename)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not find existing file being flushed: %s\n", err)
+		logging.Errorf("could not find existing file being flushed: %s", err)
 	}
-	n.Filesize = h.file.Filesize
+	n.Filesize = h.size()
 	n.ModifiedTime = h.file.ModifiedTime
 	n.Sha256sum = sum
 	sc.tree.Update(n)
+}
 
-	// Update the handle
-	sc.handles[hID] = h
+// initResponse returns the response to the kernel's InitRequest, allowing
+// writes of up to maxWrite bytes.  It returns an error if maxWrite is outside
+// the limits supported by the fuse protocol.
+func initResponse(maxWrite int) (*fuse.InitResponse, error) {
+	if maxWrite < minMaxWrite || maxWrite > maxMaxWrite {
+		return nil, fmt.Errorf("maxWrite must be between %d and %d bytes, not %d", minMaxWrite, maxMaxWrite, maxWrite)
+	}
+	return &fuse.InitResponse{
+		MaxWrite: uint32(maxWrite),
+		Flags:    fuse.InitBigWrites | fuse.InitAsyncRead,
+	}, nil
 }
 
-func chunksForRead(f *shade.File, offset, size int64) ([][]byte, error) {
+// readRange returns size bytes of f starting at offset, or fewer if the file
+// ends first.  Only the needed part of each chunk is fetched from a client
+// which implements drive.RangeGetter.  Other clients, such as "compress",
+// whose stored chunks can not be addressed by plaintext offset, fetch each
+// whole chunk, and drive.GetChunkRange slices it.
+func readRange(client drive.Client, f *shade.File, offset, size int64) ([]byte, error) {
+	chunkSums, err := ChunksForRead(f, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	var d []byte
+	low := offset % int64(f.Chunksize) // the offset within the first chunk
+	for _, cs := range chunkSums {
+		want := size - int64(len(d))
+		if want <= 0 {
+			break
+		}
+		cb, err := drive.GetChunkRange(client, cs, f, low, want)
+		if err != nil {
+			return nil, drive.NewMissingChunkError(cs, f, err)
+		}
+		d = append(d, cb...)
+		low = 0
+	}
+	return d, nil
+}
+
+// ChunksForRead returns the sums of the chunks of f which hold the size bytes
+// starting at offset.  The Chunks of f must be in Index order.  It returns an
+// error if offset is beyond the last chunk.
+func ChunksForRead(f *shade.File, offset, size int64) ([][]byte, error) {
 	if offset < 0 || size < 0 {
 		return nil, fmt.Errorf("negative offset and size are unsupported")
 	}
+	if f.Chunksize <= 0 {
+		return nil, fmt.Errorf("invalid chunksize %d in %s", f.Chunksize, f.Filename)
+	}
 	chunkSize := int64(f.Chunksize)
 	firstChunk := offset / chunkSize
 	lastChunk := ((offset + size - 1) / chunkSize) + 1
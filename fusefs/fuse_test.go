@@ -5,24 +5,35 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"math/big"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/compress"
+	"github.com/asjoyner/shade/drive/flaky"
+	"github.com/asjoyner/shade/drive/local"
 	"github.com/asjoyner/shade/drive/memory"
-	"github.com/golang/glog"
+	"github.com/asjoyner/shade/logging"
+	"github.com/asjoyner/shade/repolock"
+	"github.com/asjoyner/shade/umbrella"
 	lru "github.com/hashicorp/golang-lru"
 
 	"bazil.org/fuse"
+	"bazil.org/fuse/fuseutil"
 )
 
 func init() {
@@ -44,7 +55,7 @@ func TestFuseRead(t *testing.T) {
 	}
 	defer tearDownDir(mountPoint)
 
-	glog.Infof("Mounting fuse filesystem at: %s", mountPoint)
+	logging.Infof("Mounting fuse filesystem at: %s", mountPoint)
 	client, ffs, err := setupFuse(t, mountPoint)
 	if err != nil {
 		t.Fatalf("could not mount fuse: %s", err)
@@ -98,7 +109,7 @@ func TestFuseRead(t *testing.T) {
 			t.Errorf("failed to PutFile \"%x\": %s", fileSum[:], err)
 		}
 		i++
-		glog.Infof("Added to drive.Client %d: %s\n", i, filename)
+		logging.Infof("Added to drive.Client %d: %s\n", i, filename)
 	}
 
 	// double check that the client is sane
@@ -109,12 +120,12 @@ func TestFuseRead(t *testing.T) {
 	if nf := len(files); nf != nc {
 		t.Fatalf("incomplete file set in client, want: %d, got: %d", nc, nf)
 	}
-	glog.Infof("There are %d files known to the drive.Client.", nc)
+	logging.Infof("There are %d files known to the drive.Client.", nc)
 
 	if err := ffs.Refresh(); err != nil {
 		t.Fatalf("failed to refresh fuse fileserver: %s", err)
 	}
-	glog.Infof("Drive client refreshed successfully.")
+	logging.Infof("Drive client refreshed successfully.")
 
 	seen := make(map[string]bool)
 	visit := func(path string, f os.FileInfo, err error) error {
@@ -124,7 +135,7 @@ func TestFuseRead(t *testing.T) {
 		return nil
 	}
 
-	glog.Infof("Attempting to walk the filesystem.")
+	logging.Infof("Attempting to walk the filesystem.")
 	if err := filepath.Walk(mountPoint, visit); err != nil {
 		t.Fatalf("filepath.Walk() returned %v", err)
 	}
@@ -157,11 +168,11 @@ func TestFuseRoundtrip(t *testing.T) {
 
 	maxFileSizeBytes := int64(DefaultChunkSizeBytes * 3)
 	nf := 20 // number of files
-	glog.Infof("DefaultChunkSizeBytes: %d\n", DefaultChunkSizeBytes)
-	glog.Infof("maxFileSizeBytes: %d\n", maxFileSizeBytes)
+	logging.Infof("DefaultChunkSizeBytes: %d\n", DefaultChunkSizeBytes)
+	logging.Infof("maxFileSizeBytes: %d\n", maxFileSizeBytes)
 
 	// Generate some random file contents
-	glog.Infof("Generating Random test data...\n")
+	logging.Infof("Generating Random test data...\n")
 	testFiles := make(map[string][]byte, nf)
 	for i := 0; i < nf; i++ {
 		fileSize, err := rand.Int(rand.Reader, big.NewInt(maxFileSizeBytes))
@@ -179,15 +190,15 @@ func TestFuseRoundtrip(t *testing.T) {
 	for stringSum, chunk := range testFiles {
 		filename := path.Join(mountPoint, pathFromStringSum(stringSum))
 		if err := os.MkdirAll(path.Dir(filename), 0700); err != nil {
-			t.Fatalf(err.Error())
+			t.Fatal(err)
 		}
-		glog.Infof("Writing %d bytes to %s\n", len(chunk), filename)
+		logging.Infof("Writing %d bytes to %s\n", len(chunk), filename)
 		start := time.Now()
 		if err := ioutil.WriteFile(filename, chunk, 0400); err != nil {
-			t.Fatalf(err.Error())
+			t.Fatal(err)
 		}
 		elapsed := time.Since(start)
-		glog.Infof("Took %s at %0.2fMB/s.\n", elapsed, float64(len(chunk))/1e6/elapsed.Seconds())
+		logging.Infof("Took %s at %0.2fMB/s.\n", elapsed, float64(len(chunk))/1e6/elapsed.Seconds())
 	}
 
 	// Validate all the files have the right contents
@@ -199,7 +210,7 @@ func TestFuseRoundtrip(t *testing.T) {
 		return nil
 	}
 
-	glog.Infof("Attempting to walk the filesystem.\n")
+	logging.Infof("Attempting to walk the filesystem.\n")
 	if err := filepath.Walk(mountPoint, visit); err != nil {
 		t.Fatalf("filepath.Walk() returned %v", err)
 	}
@@ -216,9 +227,9 @@ func TestFuseRoundtrip(t *testing.T) {
 	// Delete all the test files, ensure they disappear.
 	for stringSum := range testFiles {
 		filename := path.Join(mountPoint, pathFromStringSum(stringSum))
-		glog.Infof("Removing %s\n", filename)
+		logging.Infof("Removing %s\n", filename)
 		if err := os.Remove(filename); err != nil {
-			t.Errorf(err.Error())
+			t.Error(err)
 		}
 		if _, err := ioutil.ReadFile(filename); err == nil {
 			t.Errorf("File still existed after delete: %s", filename)
@@ -245,6 +256,9 @@ func TestFuseDirs(t *testing.T) {
 		t.Fatalf("could not create test directory: %s", err)
 	}
 
+	if err := os.Remove(testDir); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("removing a non-empty directory: want ENOTEMPTY, got: %v", err)
+	}
 	if err := os.RemoveAll(testDir); err != nil {
 		t.Fatalf("could not remove test directory: %s", err)
 	}
@@ -268,6 +282,79 @@ func TestFuseDirs(t *testing.T) {
 // memory-backed drive.Client which it is following.  The FS is configured not
 // to refresh the drive.Client, you must call Refresh() if you update the
 // client outside fuse.
+// TestFuseUnusualChunksize puts a file with a chunksize other than
+// DefaultChunkSizeBytes, as an import from another tool would, and reads it
+// back through the fuse mount.
+func TestFuseUnusualChunksize(t *testing.T) {
+	mountPoint, err := ioutil.TempDir("", "fusefsTest")
+	if err != nil {
+		t.Fatalf("could not acquire TempDir: %s", err)
+	}
+	defer tearDownDir(mountPoint)
+
+	client, ffs, err := setupFuse(t, mountPoint)
+	if err != nil {
+		t.Fatalf("could not mount fuse: %s", err)
+	}
+	defer tearDownFuse(t, mountPoint)
+
+	chunksize := 3001 // not a multiple of the page size, or of maxWrite
+	contents := make([]byte, 5*chunksize+17)
+	rand.Read(contents)
+	f := shade.NewFileWithChunksize("unusual", chunksize)
+	for i := 0; i*chunksize < len(contents); i++ {
+		end := (i + 1) * chunksize
+		if end > len(contents) {
+			end = len(contents)
+		}
+		chunk := shade.NewChunk()
+		chunk.Index = i
+		chunk.Sha256 = shade.Sum(contents[i*chunksize : end])
+		if err := client.PutChunk(chunk.Sha256, contents[i*chunksize:end], f); err != nil {
+			t.Fatal(err)
+		}
+		f.Chunks = append(f.Chunks, chunk)
+		f.LastChunksize = end - i*chunksize
+	}
+	f.UpdateFilesize()
+	fj, err := f.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PutFile(shade.Sum(fj), fj); err != nil {
+		t.Fatal(err)
+	}
+	if err := ffs.Refresh(); err != nil {
+		t.Fatalf("failed to refresh fuse fileserver: %s", err)
+	}
+
+	filename := path.Join(mountPoint, "unusual")
+	got, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Errorf("read %d bytes which differ from the %d bytes stored", len(got), len(contents))
+	}
+
+	fh, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	for _, offset := range []int64{1, int64(chunksize) - 1, int64(3 * chunksize), int64(len(contents) - 20)} {
+		buf := make([]byte, 40)
+		n, err := fh.ReadAt(buf, offset)
+		if err != nil && n == 0 {
+			t.Errorf("ReadAt(%d): %s", offset, err)
+			continue
+		}
+		if want := drive.SliceRange(contents, offset, 40); !bytes.Equal(buf[:n], want) {
+			t.Errorf("ReadAt(%d) returned %d bytes which differ from the file", offset, n)
+		}
+	}
+}
+
 func setupFuse(t *testing.T, mountPoint string) (drive.Client, *Server, error) {
 	options := []fuse.MountOption{
 		fuse.FSName("Shade"),
@@ -334,7 +421,7 @@ func checkPath(t *testing.T, testChunks map[string][]byte, seen map[string]bool,
 		return err
 	}
 	if !f.IsDir() {
-		glog.Infof("Seen in FS %d: %s\n", len(seen)+1, path)
+		logging.Infof("Seen in FS %d: %s\n", len(seen)+1, path)
 		contents, err := ioutil.ReadFile(path)
 		if err != nil {
 			t.Error(err)
@@ -356,13 +443,13 @@ func checkPath(t *testing.T, testChunks map[string][]byte, seen map[string]bool,
 		}
 		seen[string(chs)] = true
 	}
-	glog.Infof("File is as expected: %s", path)
+	logging.Infof("File is as expected: %s", path)
 	return nil
 }
 
 // TestChunksForRead tests the function which calculates which chunks are
 // necessary to service a fuse read request.  It initializes a set of chunks,
-// then calls chunksForRead to ensure the correct series of chunks are returned
+// then calls ChunksForRead to ensure the correct series of chunks are returned
 // for each offset.
 func TestChunksForRead(t *testing.T) {
 	f := &shade.File{
@@ -412,36 +499,246 @@ func TestChunksForRead(t *testing.T) {
 		},
 	}
 	for _, ts := range testSet {
-		cs, err := chunksForRead(f, ts.offset, ts.size)
+		cs, err := ChunksForRead(f, ts.offset, ts.size)
 		if err != nil {
-			t.Errorf("unexpected error: chunksForRead(%+v, %d, %d): %s", f, ts.offset, ts.size, err)
+			t.Errorf("unexpected error: ChunksForRead(%+v, %d, %d): %s", f, ts.offset, ts.size, err)
 			continue
 		}
 		if len(cs) != len(ts.want) {
-			t.Errorf("chunksForRead(%+v, %d, %d), want: %s, got: %s", f, ts.offset, ts.size, ts.want, cs)
+			t.Errorf("ChunksForRead(%+v, %d, %d), want: %s, got: %s", f, ts.offset, ts.size, ts.want, cs)
 			continue
 		}
 		for i := 0; i < len(cs); i++ {
 			if !bytes.Equal(cs[i], ts.want[i]) {
-				t.Errorf("chunksForRead(%+v, %d, %d), want: %s, got: %s", f, ts.offset, ts.size, ts.want, cs)
+				t.Errorf("ChunksForRead(%+v, %d, %d), want: %s, got: %s", f, ts.offset, ts.size, ts.want, cs)
 			}
 		}
 	}
-	_, err := chunksForRead(f, 33, 1)
+	_, err := ChunksForRead(f, 33, 1)
 	if err == nil {
-		t.Errorf("expected error from chunksForRead(%+v, %d, %d), got nil", f, 33, 1)
+		t.Errorf("expected error from ChunksForRead(%+v, %d, %d), got nil", f, 33, 1)
 	}
-	_, err = chunksForRead(f, -1024, 1)
+	_, err = ChunksForRead(f, -1024, 1)
 	if err == nil {
-		t.Errorf("expected error from chunksForRead(%+v, %d, %d), got nil", f, -1024, 1)
+		t.Errorf("expected error from ChunksForRead(%+v, %d, %d), got nil", f, -1024, 1)
 	}
-	_, err = chunksForRead(f, 0, -1)
+	_, err = ChunksForRead(f, 0, -1)
 	if err == nil {
-		t.Errorf("expected error from chunksForRead(%+v, %d, %d), got nil", f, -1024, 1)
+		t.Errorf("expected error from ChunksForRead(%+v, %d, %d), got nil", f, -1024, 1)
 	}
 }
 
 // Test the method which updates a handle with new data during a write
+// TestReadRange ensures that reading with ranged chunk fetches returns the same
+// bytes as fetching whole chunks.
+func TestReadRange(t *testing.T) {
+	client, err := memory.NewClient(drive.Config{Provider: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a file of three full chunks, and a partial chunk
+	chunksize := 1024
+	contents := make([]byte, 3*chunksize+100)
+	rand.Read(contents)
+	f := shade.NewFile("test")
+	f.Chunksize = chunksize
+	f.Filesize = int64(len(contents))
+	for i := 0; i*chunksize < len(contents); i++ {
+		end := (i + 1) * chunksize
+		if end > len(contents) {
+			end = len(contents)
+		}
+		chunk := shade.NewChunk()
+		chunk.Index = i
+		chunk.Sha256 = shade.Sum(contents[i*chunksize : end])
+		if err := client.PutChunk(chunk.Sha256, contents[i*chunksize:end], f); err != nil {
+			t.Fatal(err)
+		}
+		f.Chunks = append(f.Chunks, chunk)
+	}
+
+	size := int64(len(contents))
+	for _, r := range []struct{ offset, size int64 }{
+		{0, 1},
+		{0, 4096},
+		{1, 10},
+		{1000, 48},   // spans the first two chunks
+		{1023, 2050}, // spans all four chunks
+		{2048, 1024}, // exactly one chunk
+		{size - 1, 1},
+		{size - 10, 4096}, // extends past the end of the file
+	} {
+		got, err := readRange(client, f, r.offset, r.size)
+		if err != nil {
+			t.Errorf("readRange(%d, %d): %s", r.offset, r.size, err)
+			continue
+		}
+		want := drive.SliceRange(contents, r.offset, r.size)
+		if !bytes.Equal(got, want) {
+			t.Errorf("readRange(%d, %d) returned %d bytes which differ from the full read (%d bytes)", r.offset, r.size, len(got), len(want))
+		}
+	}
+}
+
+// TestReadRangeCompressed reads parts of a file whose chunks are compressed,
+// so can not be fetched by range, and expects the bytes of the plaintext.
+func TestReadRangeCompressed(t *testing.T) {
+	client, err := compress.NewClient(drive.Config{
+		Provider: "compress",
+		Children: []drive.Config{{Provider: "memory", Write: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunksize := 1024
+	contents := []byte(strings.Repeat("compressible ", 3*chunksize/13+10))
+	f := shade.NewFile("test")
+	f.Chunksize = chunksize
+	f.Filesize = int64(len(contents))
+	for i := 0; i*chunksize < len(contents); i++ {
+		end := (i + 1) * chunksize
+		if end > len(contents) {
+			end = len(contents)
+		}
+		chunk := shade.NewChunk()
+		chunk.Index = i
+		chunk.Sha256 = shade.Sum(contents[i*chunksize : end])
+		if err := client.PutChunk(chunk.Sha256, contents[i*chunksize:end], f); err != nil {
+			t.Fatal(err)
+		}
+		f.Chunks = append(f.Chunks, chunk)
+	}
+	for _, r := range []struct{ offset, size int64 }{
+		{1, 10},
+		{1000, 48},  // spans the first two chunks
+		{2048, 100}, // within the third chunk
+		{int64(len(contents)) - 10, 4096},
+	} {
+		got, err := readRange(client, f, r.offset, r.size)
+		if err != nil {
+			t.Errorf("readRange(%d, %d): %s", r.offset, r.size, err)
+			continue
+		}
+		if want := drive.SliceRange(contents, r.offset, r.size); !bytes.Equal(got, want) {
+			t.Errorf("readRange(%d, %d): want %q, got: %q", r.offset, r.size, want, got)
+		}
+	}
+}
+
+// TestMissingChunk reads a file whose second chunk is absent from the client,
+// and expects an error naming the chunk and the file.
+func TestMissingChunk(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory"})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	f := shade.NewFileWithChunksize("partial", 4)
+	present := []byte("abcd")
+	missing := shade.Sum([]byte("efgh"))
+	if err := mc.PutChunk(shade.Sum(present), present, f); err != nil {
+		t.Fatal(err)
+	}
+	f.Chunks = []shade.Chunk{
+		{Index: 0, Sha256: shade.Sum(present)},
+		{Index: 1, Sha256: missing},
+	}
+	f.LastChunksize = 4
+	f.UpdateFilesize()
+
+	hID, err := sc.allocHandle(fuse.NodeID(sc.inode.FromPath(f.Filename)), f)
+	if err != nil {
+		t.Fatalf("allocHandle() failed: %s", err)
+	}
+	h, err := sc.handleByID(fuse.HandleID(hID))
+	if err != nil {
+		t.Fatalf("handleByID() failed: %s", err)
+	}
+	if _, err := h.getChunk(sc.client, shade.Sum(present)); err != nil {
+		t.Errorf("reading the present chunk: %s", err)
+	}
+	before := expvar.Get("missingChunks").(*expvar.Int).Value()
+	for i := 0; i < 2; i++ { // a failed fetch must not block the next one
+		_, err := h.getChunk(sc.client, missing)
+		checkMissingChunk(t, err, missing, f.Filename)
+	}
+	_, err = readRange(sc.client, f, 2, 4)
+	checkMissingChunk(t, err, missing, f.Filename)
+	if got := expvar.Get("missingChunks").(*expvar.Int).Value() - before; got != 3 {
+		t.Errorf("want 3 missingChunks, got: %d", got)
+	}
+}
+
+func checkMissingChunk(t *testing.T, err error, sum []byte, filename string) {
+	t.Helper()
+	var mce *drive.MissingChunkError
+	if !errors.As(err, &mce) {
+		t.Fatalf("want a MissingChunkError, got: %v", err)
+	}
+	if !bytes.Equal(mce.Sum, sum) || mce.Filename != filename {
+		t.Errorf("want missing chunk %x of %s, got: %x of %s", sum, filename, mce.Sum, mce.Filename)
+	}
+	if msg := err.Error(); !strings.Contains(msg, hex.EncodeToString(sum)) || !strings.Contains(msg, filename) {
+		t.Errorf("error does not name the chunk and file: %s", msg)
+	}
+}
+
+func TestReadErrno(t *testing.T) {
+	quota := drive.NewMissingChunkError([]byte{1}, nil, drive.NewQuotaError("google", errors.New("downloadQuotaExceeded")))
+	if got := readErrno(quota); got != fuse.Errno(syscall.EDQUOT) {
+		t.Errorf("readErrno(%v) = %v, want EDQUOT", quota, got)
+	}
+	missing := drive.NewMissingChunkError([]byte{1}, nil, errors.New("chunk not found"))
+	if got := readErrno(missing); got != fuse.EIO {
+		t.Errorf("readErrno(%v) = %v, want EIO", missing, got)
+	}
+}
+
+func TestChunksForReadInvalidChunksize(t *testing.T) {
+	f := shade.NewFileWithChunksize("broken", 0)
+	f.Chunks = []shade.Chunk{shade.NewChunk()}
+	if _, err := ChunksForRead(f, 0, 10); err == nil {
+		t.Error("ChunksForRead() succeeded for a file with no chunksize")
+	}
+}
+
+func TestInitResponse(t *testing.T) {
+	testCases := []struct {
+		maxWrite int
+		wantErr  bool
+	}{
+		{maxWrite: 4096},
+		{maxWrite: 64 * 1024},
+		{maxWrite: 128 * 1024},
+		{maxWrite: 0, wantErr: true},
+		{maxWrite: 4095, wantErr: true},
+		{maxWrite: 128*1024 + 1, wantErr: true},
+		{maxWrite: 1024 * 1024, wantErr: true},
+	}
+	for _, tc := range testCases {
+		resp, err := initResponse(tc.maxWrite)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("initResponse(%d) succeeded, want error", tc.maxWrite)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("initResponse(%d): %s", tc.maxWrite, err)
+			continue
+		}
+		if resp.MaxWrite != uint32(tc.maxWrite) {
+			t.Errorf("initResponse(%d).MaxWrite = %d", tc.maxWrite, resp.MaxWrite)
+		}
+		if want := fuse.InitBigWrites | fuse.InitAsyncRead; resp.Flags&want != want {
+			t.Errorf("initResponse(%d).Flags = %v, want %v set", tc.maxWrite, resp.Flags, want)
+		}
+	}
+}
+
 func TestApplyWrite(t *testing.T) {
 	// setup some initial data for the test
 	mc, err := memory.NewClient(drive.Config{Provider: "memory"})
@@ -512,7 +809,7 @@ func TestApplyWrite(t *testing.T) {
 		},
 	}
 	for i, ts := range testSet {
-		glog.Infof("test %d", i)
+		logging.Infof("test %d", i)
 		h := handle{
 			file: &shade.File{
 				Chunks:    ts.before,
@@ -537,3 +834,1096 @@ func TestApplyWrite(t *testing.T) {
 		}
 	}
 }
+
+// TestAutoFlush writes several chunks worth of data to an open handle, and
+// ensures the periodic background flush stores the completed chunks before the
+// handle is released.
+func TestShutdown(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory"})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	filename := "unclosed"
+	sc.tree.Create(filename)
+	f := shade.NewFile(filename)
+	f.Chunksize = 8
+	hID, err := sc.allocHandle(fuse.NodeID(sc.inode.FromPath(filename)), f)
+	if err != nil {
+		t.Fatalf("allocHandle() failed: %s", err)
+	}
+	h, err := sc.handleByID(fuse.HandleID(hID))
+	if err != nil {
+		t.Fatalf("handleByID() failed: %s", err)
+	}
+	contents := []byte("01234567abc")
+	sc.hm.Lock()
+	if err := h.applyWrite(contents, 0, mc); err != nil {
+		t.Fatalf("applyWrite() failed: %s", err)
+	}
+	sc.hm.Unlock()
+
+	// The handle is never released.
+	sc.Shutdown()
+
+	files, err := mc.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("want 1 file stored by Shutdown(), got: %d", len(files))
+	}
+	fj, err := mc.GetFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := &shade.File{}
+	if err := stored.FromJSON(fj); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readRange(mc, stored, 0, int64(len(contents)))
+	if err != nil {
+		t.Fatalf("reading the stored file: %s", err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Errorf("want %q stored, got: %q", contents, got)
+	}
+	if len(h.dirty) != 0 {
+		t.Errorf("want no dirty chunks after Shutdown(), got: %d", len(h.dirty))
+	}
+}
+
+// TestSumAlgorithmRoundTrip writes a file with an alternate sum algorithm, to
+// a client which already holds a file written with the default, and reads both
+// back.
+func TestSumAlgorithmRoundTrip(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory"})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	write := func(filename string, contents []byte) *shade.File {
+		sc.tree.Create(filename)
+		f := shade.NewFileWithChunksize(filename, 8)
+		hID, err := sc.allocHandle(fuse.NodeID(sc.inode.FromPath(filename)), f)
+		if err != nil {
+			t.Fatalf("allocHandle() failed: %s", err)
+		}
+		h, err := sc.handleByID(fuse.HandleID(hID))
+		if err != nil {
+			t.Fatalf("handleByID() failed: %s", err)
+		}
+		sc.hm.Lock()
+		defer sc.hm.Unlock()
+		if err := h.applyWrite(contents, 0, mc); err != nil {
+			t.Fatalf("applyWrite() failed: %s", err)
+		}
+		sc.flush(fuse.HandleID(hID))
+		return h.file
+	}
+
+	oldContents := []byte("written with sha256")
+	oldFile := write("old", oldContents)
+	if err := shade.SetSumAlgorithm(shade.SHA512_256); err != nil {
+		t.Fatal(err)
+	}
+	defer shade.SetSumAlgorithm(shade.SHA256)
+	newContents := []byte("written with sha512/256")
+	newFile := write("new", newContents)
+
+	if newFile.SumAlgorithm != shade.SHA512_256 {
+		t.Errorf("want SumAlgorithm %q, got: %q", shade.SHA512_256, newFile.SumAlgorithm)
+	}
+	want, err := shade.SumWith(shade.SHA512_256, newContents[:8])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newFile.Chunks[0].Sha256, want) {
+		t.Errorf("chunk 0 has sum %x, want the sha512/256 sum %x", newFile.Chunks[0].Sha256, want)
+	}
+	for _, tc := range []struct {
+		f    *shade.File
+		want []byte
+	}{{oldFile, oldContents}, {newFile, newContents}} {
+		got, err := readRange(mc, tc.f, 0, tc.f.Filesize)
+		if err != nil {
+			t.Errorf("reading %s: %s", tc.f.Filename, err)
+			continue
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("reading %s: want %q, got: %q", tc.f.Filename, tc.want, got)
+		}
+		if err := tc.f.VerifyDigest(); err != nil {
+			t.Errorf("verifying %s: %s", tc.f.Filename, err)
+		}
+	}
+}
+
+func TestAutoFlush(t *testing.T) {
+	*autoFlushInterval = 10 * time.Millisecond
+	defer func() { *autoFlushInterval = 0 }()
+	mc, err := memory.NewClient(drive.Config{Provider: "memory"})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	filename := "autoflush"
+	sc.tree.Create(filename)
+	f := shade.NewFile(filename)
+	f.Chunksize = 8
+	hID, err := sc.allocHandle(fuse.NodeID(sc.inode.FromPath(filename)), f)
+	if err != nil {
+		t.Fatalf("allocHandle() failed: %s", err)
+	}
+	h, err := sc.handleByID(fuse.HandleID(hID))
+	if err != nil {
+		t.Fatalf("handleByID() failed: %s", err)
+	}
+	sc.hm.Lock()
+	if err := h.applyWrite([]byte("01234567abcdefghxyz"), 0, mc); err != nil {
+		t.Fatalf("applyWrite() failed: %s", err)
+	}
+	sc.hm.Unlock()
+
+	want := [][]byte{[]byte("01234567"), []byte("abcdefgh")}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sc.hm.Lock()
+		flushed := len(h.file.Chunks)
+		sc.hm.Unlock()
+		if flushed == len(want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("completed chunks were not flushed, want: %d, got: %d", len(want), flushed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sc.hm.Lock()
+	if len(h.dirty) != 1 || !bytes.Equal(h.dirty[2], []byte("xyz")) {
+		t.Errorf("want only the final chunk dirty, got: %d dirty chunks", len(h.dirty))
+	}
+	for i, c := range h.file.Chunks {
+		cb, err := mc.GetChunk(c.Sha256, h.file)
+		if err != nil {
+			t.Errorf("chunk %d was not stored: %s", i, err)
+			continue
+		}
+		if !bytes.Equal(cb, want[i]) {
+			t.Errorf("chunk %d, want: %q, got: %q", i, want[i], cb)
+		}
+	}
+	sc.hm.Unlock()
+	// The Node keeps the size of the open file, including the dirty chunk,
+	// while the stored File describes only the stored chunks.
+	n, err := sc.tree.NodeByPath(filename)
+	if err != nil {
+		t.Fatalf("NodeByPath(%q) failed: %s", filename, err)
+	}
+	if n.Filesize != 19 {
+		t.Errorf("tree node has wrong size, want: 19, got: %d", n.Filesize)
+	}
+	if got := storedSizes(t, mc); len(got) != 1 || got[0] != 16 {
+		t.Errorf("want 1 file of 16 bytes stored by the auto flush, got sizes: %v", got)
+	}
+
+	// Shutdown stores the final chunk, and stops the periodic flush.
+	sc.Shutdown()
+	if n, err = sc.tree.NodeByPath(filename); err != nil {
+		t.Fatalf("NodeByPath(%q) failed: %s", filename, err)
+	}
+	if n.Filesize != 19 {
+		t.Errorf("tree node has wrong size after Shutdown, want: 19, got: %d", n.Filesize)
+	}
+	got := storedSizes(t, mc)
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if len(got) != 2 || got[1] != 19 {
+		t.Errorf("want a file of 19 bytes stored by Shutdown, got sizes: %v", got)
+	}
+	sc.hm.Lock()
+	if err := h.applyWrite([]byte("34567"), 19, mc); err != nil {
+		t.Fatalf("applyWrite() failed: %s", err)
+	}
+	sc.hm.Unlock()
+	time.Sleep(10 * *autoFlushInterval)
+	sc.hm.Lock()
+	defer sc.hm.Unlock()
+	if len(h.dirty) == 0 {
+		t.Errorf("a completed chunk was flushed after Shutdown")
+	}
+}
+
+// storedSizes returns the Filesize of each File stored in client.
+func storedSizes(t *testing.T, client drive.Client) []int64 {
+	files, err := client.ListFiles()
+	if err != nil {
+		t.Fatalf("ListFiles() failed: %s", err)
+	}
+	var sizes []int64
+	for _, sum := range files {
+		fj, err := client.GetFile(sum)
+		if err != nil {
+			t.Fatalf("GetFile(%x) failed: %s", sum, err)
+		}
+		f := &shade.File{}
+		if err := f.FromJSON(fj); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, f.Filesize)
+	}
+	return sizes
+}
+
+// TestDirtyBytesAreBounded writes two files, a few bytes at a time, and
+// checks that the dirty data held for each, and in total, stays within the
+// bounds, and that both files are stored correctly.
+func TestDirtyBytesAreBounded(t *testing.T) {
+	defer func(h, d int64) { *maxHandleDirtyBytes, *maxDirtyBytes = h, d }(*maxHandleDirtyBytes, *maxDirtyBytes)
+	*maxHandleDirtyBytes, *maxDirtyBytes = 40, 64
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	var handles []*handle
+	var hIDs []fuse.HandleID
+	contents := make(map[string][]byte)
+	for _, filename := range []string{"stream-a", "stream-b"} {
+		sc.tree.Create(filename)
+		f := shade.NewFile(filename)
+		f.Chunksize = 8
+		hID, err := sc.allocHandle(fuse.NodeID(sc.inode.FromPath(filename)), f)
+		if err != nil {
+			t.Fatalf("allocHandle() failed: %s", err)
+		}
+		h, err := sc.handleByID(fuse.HandleID(hID))
+		if err != nil {
+			t.Fatalf("handleByID() failed: %s", err)
+		}
+		handles = append(handles, h)
+		hIDs = append(hIDs, fuse.HandleID(hID))
+		contents[filename] = bytes.Repeat([]byte(filename+":0123456789\n"), 50)
+	}
+
+	const writeSize = 5
+	sc.hm.Lock()
+	for offset := 0; offset < len(contents["stream-a"]); offset += writeSize {
+		for i, h := range handles {
+			data := contents[h.file.Filename][offset:]
+			if len(data) > writeSize {
+				data = data[:writeSize]
+			}
+			if err := h.applyWrite(data, int64(offset), mc); err != nil {
+				t.Fatalf("applyWrite() failed: %s", err)
+			}
+			sc.limitDirty(hIDs[i])
+			if b := h.dirtyBytes(); b > *maxHandleDirtyBytes {
+				t.Fatalf("%s has %d dirty bytes, want at most %d", h.file.Filename, b, *maxHandleDirtyBytes)
+			}
+			if b := sc.dirtyBytes(); b > *maxDirtyBytes {
+				t.Fatalf("open files have %d dirty bytes, want at most %d", b, *maxDirtyBytes)
+			}
+		}
+	}
+	for _, hID := range hIDs {
+		sc.flush(hID)
+	}
+	sc.hm.Unlock()
+
+	for _, h := range handles {
+		got, err := readRange(mc, h.file, 0, h.file.Filesize)
+		if err != nil {
+			t.Fatalf("reading %s: %s", h.file.Filename, err)
+		}
+		if want := contents[h.file.Filename]; !bytes.Equal(got, want) {
+			t.Errorf("%s, want: %q, got: %q", h.file.Filename, want, got)
+		}
+	}
+}
+
+// TestAppend writes to a handle opened with O_APPEND from several goroutines
+// at once, always at offset zero, and checks that each write is appended to
+// the existing content of the file, and none is overwritten.
+func TestAppend(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	filename := "log"
+	sc.tree.Create(filename)
+	f := shade.NewFile(filename)
+	f.Chunksize = 8
+	hID, err := sc.allocHandle(fuse.NodeID(sc.inode.FromPath(filename)), f)
+	if err != nil {
+		t.Fatalf("allocHandle() failed: %s", err)
+	}
+	h, err := sc.handleByID(fuse.HandleID(hID))
+	if err != nil {
+		t.Fatalf("handleByID() failed: %s", err)
+	}
+	// Some existing content, partly flushed.
+	if err := sc.writeHandle(fuse.HandleID(hID), h, []byte("header:0123"), 0); err != nil {
+		t.Fatalf("writeHandle() failed: %s", err)
+	}
+	sc.hm.Lock()
+	sc.flush(fuse.HandleID(hID))
+	sc.hm.Unlock()
+
+	sc.setAppend(hID, fuse.OpenWriteOnly|fuse.OpenAppend)
+	const writers, records = 4, 10
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < records; r++ {
+				record := []byte(fmt.Sprintf("%d:%d\n", w, r))
+				if err := sc.writeHandle(fuse.HandleID(hID), h, record, 0); err != nil {
+					t.Errorf("writeHandle() failed: %s", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	sc.hm.Lock()
+	sc.flush(fuse.HandleID(hID))
+	sc.hm.Unlock()
+
+	got, err := readRange(mc, h.file, 0, h.file.Filesize)
+	if err != nil {
+		t.Fatalf("reading %s: %s", filename, err)
+	}
+	if !bytes.HasPrefix(got, []byte("header:0123")) {
+		t.Fatalf("the existing content was overwritten, got: %q", got)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(got[len("header:0123"):]), "\n"), "\n")
+	if len(lines) != writers*records {
+		t.Fatalf("want %d records appended, got %d: %q", writers*records, len(lines), got)
+	}
+	next := make(map[string]int)
+	for _, l := range lines {
+		parts := strings.Split(l, ":")
+		if len(parts) != 2 || parts[1] != fmt.Sprint(next[parts[0]]) {
+			t.Fatalf("record %q out of order, or corrupted, in: %q", l, got)
+		}
+		next[parts[0]]++
+	}
+}
+
+// writeFile writes contents to a new file through sc, in chunks of 16 bytes,
+// and returns its handle, without flushing it.
+func writeFile(t *testing.T, sc *Server, filename string, contents []byte) fuse.HandleID {
+	sc.tree.Create(filename)
+	f := shade.NewFile(filename)
+	f.Chunksize = 16
+	hID, err := sc.allocHandle(fuse.NodeID(sc.inode.FromPath(filename)), f)
+	if err != nil {
+		t.Fatalf("allocHandle() failed: %s", err)
+	}
+	h, err := sc.handleByID(fuse.HandleID(hID))
+	if err != nil {
+		t.Fatalf("handleByID() failed: %s", err)
+	}
+	if err := sc.writeHandle(fuse.HandleID(hID), h, contents, 0); err != nil {
+		t.Fatalf("writeHandle() failed: %s", err)
+	}
+	return fuse.HandleID(hID)
+}
+
+// timeFlush flushes the handle hID of sc with the given --flushConcurrency,
+// and returns how long it took.
+func timeFlush(sc *Server, hID fuse.HandleID, concurrency int) time.Duration {
+	defer func(c int) { *flushConcurrency = c }(*flushConcurrency)
+	*flushConcurrency = concurrency
+	sc.hm.Lock()
+	defer sc.hm.Unlock()
+	start := time.Now()
+	sc.flush(hID)
+	return time.Since(start)
+}
+
+// TestParallelFlush flushes a file of many chunks to a slow client, and
+// expects the chunks to be stored in parallel, and the file to be intact.
+func TestParallelFlush(t *testing.T) {
+	contents := make([]byte, 16*16+5) // 16 full chunks, and a partial one
+	rand.Read(contents)
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := flaky.Wrap(mc, drive.Config{Provider: "flaky", Faults: drive.FaultConfig{LatencySeconds: 0.02}})
+	sc, err := New(slow, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+
+	serial := timeFlush(sc, writeFile(t, sc, "serial", contents), 1)
+	hID := writeFile(t, sc, "parallel", contents)
+	parallel := timeFlush(sc, hID, 8)
+	if parallel > serial/2 {
+		t.Errorf("flushing with 8 workers took %s, and with 1 took %s", parallel, serial)
+	}
+	h := sc.handles[hID]
+	if len(h.dirty) != 0 {
+		t.Errorf("%d chunks are still dirty after flush", len(h.dirty))
+	}
+	if len(h.file.Chunks) != 17 || h.file.LastChunksize != 5 {
+		t.Errorf("flushed file has %d chunks, and a last chunk of %d bytes, want 17 and 5", len(h.file.Chunks), h.file.LastChunksize)
+	}
+	for i, c := range h.file.Chunks {
+		if c.Index != i {
+			t.Errorf("chunk %d has Index %d", i, c.Index)
+		}
+	}
+	got, err := readRange(mc, h.file, 0, h.file.Filesize)
+	if err != nil {
+		t.Fatalf("reading the flushed file: %s", err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Errorf("the flushed file differs from what was written")
+	}
+}
+
+// TestFlushFailure ensures that a file is not published until all of its
+// chunks are stored, and that the chunks which fail remain dirty.
+func TestFlushFailure(t *testing.T) {
+	defer func(r int) { *maxRetries = r }(*maxRetries)
+	*maxRetries = 1
+	contents := make([]byte, 16*4)
+	rand.Read(contents)
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	sc.client = flaky.Wrap(mc, drive.Config{Provider: "flaky", Faults: drive.FaultConfig{
+		FailureRates: map[string]float64{"PutChunk": 1},
+	}})
+	before, err := mc.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hID := writeFile(t, sc, "unlucky", contents)
+	timeFlush(sc, hID, 4)
+	if n := len(sc.handles[hID].dirty); n != 4 {
+		t.Errorf("%d chunks are dirty after a failed flush, want 4", n)
+	}
+	if n := len(sc.handles[hID].file.Chunks); n != 0 {
+		t.Errorf("%d chunks are recorded in the File after a failed flush, want 0", n)
+	}
+	if files, err := mc.ListFiles(); err != nil || len(files) != len(before) {
+		t.Errorf("ListFiles() after a failed flush: %d files, %v; want %d", len(files), err, len(before))
+	}
+
+	// The failed chunks are not recorded in the File, so an auto flush
+	// once the client recovers publishes only chunks which were stored.
+	sc.client = mc
+	sc.hm.Lock()
+	sc.flushCompleted(hID)
+	sc.hm.Unlock()
+	files, err := mc.ListFiles()
+	if err != nil || len(files) != len(before)+1 {
+		t.Fatalf("ListFiles() after an auto flush: %d files, %v; want %d", len(files), err, len(before)+1)
+	}
+	for _, sum := range files {
+		fj, err := mc.GetFile(sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := &shade.File{}
+		if err := f.FromJSON(fj); err != nil {
+			t.Fatal(err)
+		}
+		if f.Filename != "unlucky" {
+			continue
+		}
+		got, err := readRange(mc, f, 0, f.Filesize)
+		if err != nil {
+			t.Fatalf("reading the auto flushed file: %s", err)
+		}
+		if !bytes.Equal(got, contents[:16*3]) {
+			t.Errorf("the auto flushed file has %d bytes, want the first 3 chunks", len(got))
+		}
+	}
+
+	// The next flush stores the rest of the file.
+	timeFlush(sc, hID, 4)
+	h := sc.handles[hID]
+	got, err := readRange(mc, h.file, 0, h.file.Filesize)
+	if err != nil {
+		t.Fatalf("reading the flushed file: %s", err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Errorf("the flushed file differs from what was written")
+	}
+	if files, err := mc.ListFiles(); err != nil || len(files) != len(before)+2 {
+		t.Errorf("ListFiles() after a successful flush: %d files, %v; want %d", len(files), err, len(before)+2)
+	}
+}
+
+// TestFlushDuringCleanup ensures that a flush made with sc.hm held does not
+// wait for the exclusive lock of a running Cleanup, but is deferred, and that
+// lockWrites waits for the lock before taking sc.hm.
+func TestFlushDuringCleanup(t *testing.T) {
+	contents := make([]byte, 16*2)
+	rand.Read(contents)
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	sc.lock = &repolock.Dir{Path: t.TempDir(), TTL: time.Minute, Wait: time.Minute}
+	cleanup, err := sc.lock.Exclusive()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hID := writeFile(t, sc, "during-cleanup", contents)
+	start := time.Now()
+	sc.hm.Lock()
+	err = sc.flush(hID)
+	sc.hm.Unlock()
+	if !errors.Is(err, repolock.ErrLocked) {
+		t.Errorf("flush while Cleanup holds the repository: want ErrLocked, got: %v", err)
+	}
+	if waited := time.Since(start); waited > 10*time.Second {
+		t.Errorf("flush waited %s for Cleanup with sc.hm held", waited)
+	}
+	if n := len(sc.handles[hID].dirty); n != 2 {
+		t.Errorf("%d chunks are dirty after a deferred flush, want 2", n)
+	}
+
+	flushed := make(chan error)
+	go func() {
+		sc.lockWrites()
+		defer sc.unlockWrites()
+		flushed <- sc.flush(hID)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// sc.hm is not held while lockWrites waits.
+	sc.hm.Lock()
+	sc.hm.Unlock()
+	cleanup.Unlock()
+	if err := <-flushed; err != nil {
+		t.Fatalf("flush after Cleanup finished: %s", err)
+	}
+	h := sc.handles[hID]
+	got, err := readRange(mc, h.file, 0, h.file.Filesize)
+	if err != nil {
+		t.Fatalf("reading the flushed file: %s", err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Errorf("the flushed file differs from what was written")
+	}
+}
+
+// TestReleaseFailure ensures that a handle released with chunks which could
+// not be stored keeps them, and frees the handle once a retry stores them.
+func TestReleaseFailure(t *testing.T) {
+	defer func(r int) { *maxRetries = r }(*maxRetries)
+	*maxRetries = 1
+	contents := make([]byte, 16*2)
+	rand.Read(contents)
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	sc.client = flaky.Wrap(mc, drive.Config{Provider: "flaky", Faults: drive.FaultConfig{
+		FailureRates: map[string]float64{"PutChunk": 1},
+	}})
+
+	hID := writeFile(t, sc, "unlucky", contents)
+	sc.hm.Lock()
+	defer sc.hm.Unlock()
+	if err := sc.releaseHandle(hID); err == nil {
+		t.Fatal("releaseHandle() succeeded with a failing client")
+	}
+	h := sc.handles[hID]
+	if h.inode == 0 || !h.released {
+		t.Errorf("a handle whose flush failed was freed on release")
+	}
+	if n := len(h.dirty); n != 2 {
+		t.Errorf("%d chunks are dirty after a failed release, want 2", n)
+	}
+
+	sc.client = mc
+	sc.flushReleased()
+	if h.inode != 0 || h.released {
+		t.Errorf("a released handle was not freed once its flush succeeded")
+	}
+	got, err := readRange(mc, h.file, 0, h.file.Filesize)
+	if err != nil {
+		t.Fatalf("reading the flushed file: %s", err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Errorf("the flushed file differs from what was written")
+	}
+}
+
+func TestRemovePath(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory"})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	sc.tree.Mkdir("dir")
+	sc.tree.Create("dir/file")
+
+	if err := sc.removePath("dir", true); err != fuse.Errno(syscall.ENOTEMPTY) {
+		t.Errorf("removing a non-empty directory: want ENOTEMPTY, got: %v", err)
+	}
+	if err := sc.removePath("dir", false); err != fuse.Errno(syscall.EISDIR) {
+		t.Errorf("removing a directory as a file: want EISDIR, got: %v", err)
+	}
+	if err := sc.removePath("missing", false); err != fuse.ENOENT {
+		t.Errorf("removing a missing file: want ENOENT, got: %v", err)
+	}
+
+	if err := sc.removePath("dir/file", false); err != nil {
+		t.Fatalf("removing a file: %s", err)
+	}
+	if sc.tree.HasChild("dir", "file") {
+		t.Error("removed file is still listed in its directory")
+	}
+	if _, err := sc.tree.NodeByPath("dir/file"); err == nil {
+		t.Error("removed file is still in the tree")
+	}
+	files, err := mc.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("want 1 Deleted file published, got: %d", len(files))
+	}
+	fj, err := mc.GetFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &shade.File{}
+	if err := f.FromJSON(fj); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Deleted || f.Filename != "dir/file" {
+		t.Errorf("want a Deleted file named dir/file, got: %s", f)
+	}
+
+	if err := sc.removePath("dir", true); err != nil {
+		t.Fatalf("removing an empty directory: %s", err)
+	}
+	if sc.tree.HasChild("", "dir") {
+		t.Error("removed directory is still listed in the root")
+	}
+}
+
+// TestRemovePathTrash removes a file with --trash, and checks that it is
+// gone from its path, but can be restored from the trash.
+func TestRemovePathTrash(t *testing.T) {
+	*trash = true
+	defer func() { *trash = false }()
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	filename := "dir/file"
+	sc.tree.Create(filename)
+	hID, err := sc.allocHandle(fuse.NodeID(sc.inode.FromPath(filename)), shade.NewFile(filename))
+	if err != nil {
+		t.Fatalf("allocHandle() failed: %s", err)
+	}
+	h, err := sc.handleByID(fuse.HandleID(hID))
+	if err != nil {
+		t.Fatalf("handleByID() failed: %s", err)
+	}
+	content := []byte("precious data")
+	if err := sc.writeHandle(fuse.HandleID(hID), h, content, 0); err != nil {
+		t.Fatalf("writeHandle() failed: %s", err)
+	}
+	sc.hm.Lock()
+	sc.flush(fuse.HandleID(hID))
+	sc.hm.Unlock()
+
+	if err := sc.removePath(filename, false); err != nil {
+		t.Fatalf("removing a file: %s", err)
+	}
+	if _, err := sc.tree.NodeByPath(filename); err == nil {
+		t.Error("removed file is still in the tree")
+	}
+	if _, err := sc.tree.NodeByPath(umbrella.TrashPath(filename)); err != nil {
+		t.Errorf("removed file is not in the trash: %s", err)
+	}
+	// Removing a file in the trash deletes it for good.
+	sc.tree.Create(umbrella.TrashDir + "other")
+	if err := sc.removePath(umbrella.TrashDir+"other", false); err != nil {
+		t.Fatalf("removing a file in the trash: %s", err)
+	}
+	if _, err := sc.tree.NodeByPath(umbrella.TrashPath(umbrella.TrashDir + "other")); err == nil {
+		t.Error("a file removed from the trash was moved to the trash again")
+	}
+
+	if err := umbrella.RestoreTrash(mc, filename); err != nil {
+		t.Fatalf("RestoreTrash() failed: %s", err)
+	}
+	if err := sc.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := sc.tree.NodeByPath(filename)
+	if err != nil {
+		t.Fatalf("restored file is not in the tree: %s", err)
+	}
+	f, err := sc.tree.FileByNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readRange(mc, f, 0, f.Filesize)
+	if err != nil {
+		t.Fatalf("reading the restored file: %s", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("restored file, want: %q, got: %q", content, got)
+	}
+	if _, err := sc.tree.NodeByPath(umbrella.TrashPath(filename)); err == nil {
+		t.Error("restored file is still in the trash")
+	}
+}
+
+// TestDebugFuse checks that DebugFuse logs the messages of bazil.org/fuse
+// only at level 7 and above.
+func TestDebugFuse(t *testing.T) {
+	capture := func(level int) string {
+		var buf bytes.Buffer
+		defer logging.SetLogger(logging.SetLogger(logging.NewWriterLogger(&buf, level)))
+		DebugFuse("fuse debug message")
+		return buf.String()
+	}
+	if out := capture(7); !strings.Contains(out, "fuse debug message") {
+		t.Errorf("at level 7, want the message logged, got: %q", out)
+	}
+	if out := capture(6); out != "" {
+		t.Errorf("at level 6, want nothing logged, got: %q", out)
+	}
+}
+
+func TestReadDirSnapshot(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory"})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	sc.tree.Mkdir("big")
+	for i := 0; i < 1000; i++ {
+		sc.tree.Create(fmt.Sprintf("big/file%04d", i))
+	}
+	want, err := sc.dirents("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode := fuse.NodeID(sc.inode.FromPath("big"))
+	hID, err := sc.allocDirHandle(inode, "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read the listing a small chunk at a time, adding entries as a refresh
+	// would between each request
+	var got []byte
+	size := 512
+	for i := 0; ; i++ {
+		req := &fuse.ReadRequest{Handle: fuse.HandleID(hID), Offset: int64(len(got)), Size: size}
+		resp := &fuse.ReadResponse{Data: make([]byte, 0, size)}
+		data, err := sc.direntsForRead(req.Handle, "big")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fuseutil.HandleRead(req, resp, data)
+		if len(resp.Data) == 0 {
+			break
+		}
+		got = append(got, resp.Data...)
+		sc.tree.Create(fmt.Sprintf("big/a%04d", i))
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("listing changed while it was read: got %d bytes, want %d", len(got), len(want))
+	}
+
+	// once released, the handle no longer serves the snapshot
+	sc.hm.Lock()
+	sc.handles[hID].inode = 0
+	sc.handles[hID].dirents = nil
+	sc.hm.Unlock()
+	data, err := sc.direntsForRead(fuse.HandleID(hID), "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(data, want) {
+		t.Error("released handle still serves the snapshotted listing")
+	}
+}
+
+func TestFuseXattrs(t *testing.T) {
+	mountPoint, err := ioutil.TempDir("", "fusefsTest")
+	if err != nil {
+		t.Fatalf("could not acquire TempDir: %s", err)
+	}
+	defer tearDownDir(mountPoint)
+
+	_, ffs, err := setupFuse(t, mountPoint)
+	if err != nil {
+		t.Fatalf("could not mount fuse: %s", err)
+	}
+	defer tearDownFuse(t, mountPoint)
+
+	filename := path.Join(mountPoint, "tagged")
+	if err := ioutil.WriteFile(filename, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(filename, "user.color", []byte("red"), 0); err != nil {
+		t.Fatalf("Setxattr: %s", err)
+	}
+	if err := ffs.tree.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(filename, "user.color", buf)
+	if err != nil {
+		t.Fatalf("Getxattr: %s", err)
+	}
+	if got := string(buf[:n]); got != "red" {
+		t.Errorf("Getxattr: want %q, got %q", "red", got)
+	}
+	n, err = syscall.Listxattr(filename, buf)
+	if err != nil {
+		t.Fatalf("Listxattr: %s", err)
+	}
+	if got := string(buf[:n]); got != "user.color\x00" {
+		t.Errorf("Listxattr: want %q, got %q", "user.color\x00", got)
+	}
+	if err := syscall.Removexattr(filename, "user.color"); err != nil {
+		t.Fatalf("Removexattr: %s", err)
+	}
+	if _, err := syscall.Getxattr(filename, "user.color", buf); err == nil {
+		t.Error("Getxattr succeeded after Removexattr")
+	}
+}
+
+func TestUpdateXattrs(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory"})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	f := shade.NewFile("tagged")
+	jm, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.PutFile(shade.Sum(jm), jm); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	inode := fuse.NodeID(sc.inode.FromPath("tagged"))
+
+	set := func(xattrs map[string][]byte) error {
+		xattrs["user.color"] = []byte("red")
+		return nil
+	}
+	if err := sc.updateXattrs(inode, set); err != nil {
+		t.Fatal(err)
+	}
+	// the new version of the file is found by a refresh
+	if err := sc.tree.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	xattrs, err := sc.xattrs(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(xattrs["user.color"]); got != "red" {
+		t.Errorf("want user.color=red, got: %q", got)
+	}
+	n, err := sc.tree.NodeByPath("tagged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Filesize != f.Filesize {
+		t.Errorf("setting an xattr changed the size to %d, want %d", n.Filesize, f.Filesize)
+	}
+
+	if err := sc.updateXattrs(fuse.NodeID(sc.inode.FromPath("")), set); err != fuse.ENOTSUP {
+		t.Errorf("setting an xattr on a directory: want ENOTSUP, got: %v", err)
+	}
+	remove := func(xattrs map[string][]byte) error {
+		delete(xattrs, "user.color")
+		return nil
+	}
+	if err := sc.updateXattrs(inode, remove); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = sc.tree.NodeByPath("tagged"); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = sc.tree.FileByNode(n); err != nil {
+		t.Fatal(err)
+	}
+	if f.Xattrs != nil {
+		t.Errorf("removing the last xattr left: %v", f.Xattrs)
+	}
+}
+
+// TestDirentTypes ensures directory listings and attributes agree on the type
+// of each node, including paths which are both a file and a directory.
+func TestDirentTypes(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory"})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	now := time.Now()
+	for _, f := range []struct {
+		name    string
+		mtime   time.Time
+		deleted bool
+	}{
+		{"file", now, false},
+		{"dir/child", now, false},
+		// both a file, and the parent directory of another
+		{"collision", now, false},
+		{"collision/child", now, false},
+		// a file which was deleted, then recreated as a directory
+		{"recreated", now.Add(-time.Minute), false},
+		{"recreated", now, true},
+		{"recreated/child", now.Add(time.Minute), false},
+	} {
+		file := shade.NewFile(f.name)
+		file.ModifiedTime = f.mtime
+		file.Deleted = f.deleted
+		jm, err := json.Marshal(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mc.PutFile(shade.Sum(jm), jm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	sc.tree.Mkdir("empty")
+
+	for p, want := range map[string]fuse.DirentType{
+		"file":            fuse.DT_File,
+		"dir":             fuse.DT_Dir,
+		"dir/child":       fuse.DT_File,
+		"empty":           fuse.DT_Dir,
+		"collision":       fuse.DT_Dir,
+		"collision/child": fuse.DT_File,
+		"recreated":       fuse.DT_Dir,
+		"recreated/child": fuse.DT_File,
+	} {
+		n, err := sc.tree.NodeByPath(p)
+		if err != nil {
+			t.Errorf("NodeByPath(%q): %s", p, err)
+			continue
+		}
+		if got := direntType(n); got != want {
+			t.Errorf("direntType(%q): want %v, got %v", p, want, got)
+		}
+		attr := sc.attrFromNode(n, sc.inode.FromPath(p))
+		if isDir := attr.Mode&os.ModeDir != 0; isDir != (want == fuse.DT_Dir) {
+			t.Errorf("attrFromNode(%q) reports directory: %v, but dirent type is %v", p, isDir, want)
+		}
+	}
+	for _, child := range []string{"file", "dir", "empty", "collision", "recreated"} {
+		if !sc.tree.HasChild("", child) {
+			t.Errorf("%q is not listed in the root", child)
+		}
+	}
+	if err := sc.removePath("collision", false); err != fuse.Errno(syscall.EISDIR) {
+		t.Errorf("removing a file which is also a directory: want EISDIR, got: %v", err)
+	}
+}
+
+// unsizedClient hides the space of the client it wraps.
+type unsizedClient struct {
+	drive.Client
+}
+
+func TestStatfs(t *testing.T) {
+	dir := t.TempDir()
+	lc, err := local.NewClient(drive.Config{
+		Provider:      "local",
+		FileParentID:  filepath.Join(dir, "files"),
+		ChunkParentID: filepath.Join(dir, "chunks"),
+		Write:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := New(lc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	resp := sc.statfs()
+	if resp.Bsize != blockSize || resp.Frsize != blockSize {
+		t.Errorf("want a block size of %d, got Bsize %d and Frsize %d", blockSize, resp.Bsize, resp.Frsize)
+	}
+	if resp.Blocks == 0 || resp.Bfree == 0 || resp.Bavail > resp.Bfree || resp.Bfree > resp.Blocks {
+		t.Errorf("want 0 < Bavail <= Bfree <= Blocks, got: %+v", resp)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(filepath.Join(dir, "chunks"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(st.Blocks) * uint64(st.Bsize) / uint64(blockSize); resp.Blocks != want {
+		t.Errorf("want the %d blocks of the local filesystem, got: %d", want, resp.Blocks)
+	}
+
+	sc, err = New(&unsizedClient{lc}, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	resp = sc.statfs()
+	if want := unknownSpace / uint64(blockSize); resp.Blocks != want || resp.Bavail != want {
+		t.Errorf("want %d blocks free of %d for a backend of unknown size, got: %+v", want, want, resp)
+	}
+}
@@ -0,0 +1,54 @@
+package fusefs
+
+import (
+	"flag"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+)
+
+var maxInflight = flag.Int("max-inflight", 0, "The maximum number of concurrent chunk reads and writes to the drive.Client (0 is unlimited).")
+
+// inflightClient bounds the number of concurrent GetChunk and PutChunk calls
+// to the drive.Client it wraps.  This decouples the number of fuse workers,
+// and the prefetches they start, from the concurrency seen by the backend.
+type inflightClient struct {
+	drive.Client
+	sem chan struct{}
+}
+
+// limitInflight wraps client in an inflightClient which allows n concurrent
+// chunk operations.  If n is not positive, client is returned unchanged.
+func limitInflight(client drive.Client, n int) drive.Client {
+	if n <= 0 {
+		return client
+	}
+	return &inflightClient{Client: client, sem: make(chan struct{}, n)}
+}
+
+// GetChunk waits for a free slot, then calls GetChunk on the wrapped client.
+func (c *inflightClient) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	c.sem <- struct{}{}
+	defer func() { <-c.sem }()
+	return c.Client.GetChunk(sha256sum, f)
+}
+
+// GetChunkRange waits for a free slot, then reads part of a chunk from the
+// wrapped client.
+func (c *inflightClient) GetChunkRange(sha256sum []byte, f *shade.File, offset, length int64) ([]byte, error) {
+	c.sem <- struct{}{}
+	defer func() { <-c.sem }()
+	return drive.GetChunkRange(c.Client, sha256sum, f, offset, length)
+}
+
+// PutChunk waits for a free slot, then calls PutChunk on the wrapped client.
+func (c *inflightClient) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
+	c.sem <- struct{}{}
+	defer func() { <-c.sem }()
+	return c.Client.PutChunk(sha256sum, chunk, f)
+}
+
+// Space returns the space of the wrapped client.
+func (c *inflightClient) Space() (total, free uint64, err error) {
+	return drive.Space(c.Client)
+}
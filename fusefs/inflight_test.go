@@ -0,0 +1,106 @@
+package fusefs
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+// concurrencyClient records the maximum number of concurrent GetChunk and
+// PutChunk calls.
+type concurrencyClient struct {
+	drive.Client
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (c *concurrencyClient) track() func() {
+	c.mu.Lock()
+	c.current++
+	if c.current > c.max {
+		c.max = c.current
+	}
+	c.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	return func() {
+		c.mu.Lock()
+		c.current--
+		c.mu.Unlock()
+	}
+}
+
+func (c *concurrencyClient) GetChunk(sha256sum []byte, f *shade.File) ([]byte, error) {
+	defer c.track()()
+	return c.Client.GetChunk(sha256sum, f)
+}
+
+func (c *concurrencyClient) PutChunk(sha256sum []byte, chunk []byte, f *shade.File) error {
+	defer c.track()()
+	return c.Client.PutChunk(sha256sum, chunk, f)
+}
+
+func TestMaxInflight(t *testing.T) {
+	*maxInflight = 3
+	defer func() { *maxInflight = 0 }()
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	cc := &concurrencyClient{Client: mc}
+	sc, err := New(cc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	f := shade.NewFile("inflight")
+	var sums [][]byte
+	for i := 0; i < 20; i++ {
+		sum, chunk := drive.RandChunk()
+		if err := sc.client.PutChunk(sum, chunk, f); err != nil {
+			t.Fatal(err)
+		}
+		sums = append(sums, sum)
+	}
+	hID, err := sc.allocHandle(fuse.NodeID(sc.inode.FromPath(f.Filename)), f)
+	if err != nil {
+		t.Fatalf("allocHandle() failed: %s", err)
+	}
+	h, err := sc.handleByID(fuse.HandleID(hID))
+	if err != nil {
+		t.Fatalf("handleByID() failed: %s", err)
+	}
+
+	// Mix direct reads, prefetches and writes.
+	var wg sync.WaitGroup
+	for i, sum := range sums {
+		wg.Add(1)
+		go func(i int, sum []byte) {
+			defer wg.Done()
+			switch i % 3 {
+			case 0:
+				if _, err := h.getChunk(sc.client, sum); err != nil {
+					t.Error(err)
+				}
+			case 1:
+				h.prefetchChunk(sc.client, sum)
+			case 2:
+				s, chunk := drive.RandChunk()
+				if err := sc.client.PutChunk(s, chunk, f); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i, sum)
+	}
+	wg.Wait()
+	if cc.max > *maxInflight {
+		t.Errorf("concurrent chunk operations exceeded the limit, want <= %d, got: %d", *maxInflight, cc.max)
+	}
+	if cc.max < 2 {
+		t.Errorf("chunk operations were not concurrent, max: %d", cc.max)
+	}
+}
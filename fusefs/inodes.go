@@ -1,12 +1,23 @@
 package fusefs
 
 import (
+	"bufio"
+	"encoding/json"
 	"errors"
 	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
+
+	"github.com/asjoyner/shade/logging"
 )
 
 var (
+	inodeMapPath = flag.String("inodeMap", "", "A file in which to persist the inode of each path, so inodes are stable across remounts (empty disables).")
+
 	numOpenInodes = expvar.NewInt("numOpenInodes")
 	lastInode     = expvar.NewInt("lastInode")
 )
@@ -16,7 +27,10 @@ var (
 type InodeMap struct {
 	sync.RWMutex // protects acess to all fields of the struct
 	inodes       map[uint64]string
+	paths        map[string]uint64 // the inode assigned to each path
+	lookups      map[uint64]uint64 // the kernel's lookup count of each inode
 	lastInode    uint64
+	log          *os.File // if non-nil, each assignment is appended to it
 }
 
 // NewInodeMap returns an initialized InodeMap. Initially, it knows of only the
@@ -28,30 +42,168 @@ func NewInodeMap() *InodeMap {
 		inodes: map[uint64]string{
 			1: "/",
 		},
+		paths:     map[string]uint64{"/": 1},
+		lookups:   make(map[uint64]uint64),
 		lastInode: 1,
 	}
 }
 
+// inodeRecord is a line of the file backing a persistent InodeMap.  It either
+// assigns an Inode to a Path, or records the LastInode allocated.
+type inodeRecord struct {
+	Inode     uint64 `json:",omitempty"`
+	Path      string `json:",omitempty"`
+	LastInode uint64 `json:",omitempty"`
+}
+
+// LoadInodeMap returns an InodeMap which persists the inode assigned to each
+// path in filename, so that a path keeps its inode across remounts.  The
+// assignments already in filename are loaded, and the file is compacted.
+//
+// Assignments are never forgotten, even when their path is removed, so that
+// the path has the same inode if it reappears, and inode numbers are never
+// reused for a different path.
+func LoadInodeMap(filename string) (*InodeMap, error) {
+	im := NewInodeMap()
+	fh, err := os.Open(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(fh)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			var r inodeRecord
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				// Most likely a partial write when the process exited.
+				logging.Warningf("skipping corrupt inode record in %s: %q", filename, scanner.Text())
+				continue
+			}
+			im.load(r)
+		}
+		err := scanner.Err()
+		fh.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %s", filename, err)
+		}
+	}
+	if err := im.compact(filename); err != nil {
+		return nil, err
+	}
+	numOpenInodes.Set(int64(len(im.inodes)))
+	lastInode.Set(int64(im.lastInode))
+	return im, nil
+}
+
+// load applies a record read from the file backing the InodeMap.  Later
+// records for a path replace earlier ones.
+func (im *InodeMap) load(r inodeRecord) {
+	if r.LastInode > im.lastInode {
+		im.lastInode = r.LastInode
+	}
+	if r.Inode <= 1 || r.Path == "" {
+		return
+	}
+	if old, ok := im.paths[r.Path]; ok {
+		delete(im.inodes, old)
+	}
+	im.paths[r.Path] = r.Inode
+	im.inodes[r.Inode] = r.Path
+	if r.Inode > im.lastInode {
+		im.lastInode = r.Inode
+	}
+}
+
+// compact replaces filename with the current assignments, and opens it to
+// append new ones.
+func (im *InodeMap) compact(filename string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(tmp)
+	records := []inodeRecord{{LastInode: im.lastInode}}
+	for p, inode := range im.paths {
+		if inode != 1 {
+			records = append(records, inodeRecord{Inode: inode, Path: p})
+		}
+	}
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	im.log, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// Close closes the file backing the InodeMap, if any.
+func (im *InodeMap) Close() error {
+	im.Lock()
+	defer im.Unlock()
+	if im.log == nil {
+		return nil
+	}
+	err := im.log.Close()
+	im.log = nil
+	return err
+}
+
 // FromPath returns the inode allocated for a given path.  If no inode has been
 // allocated for that path yet, it allocates a new one and returns it.
 func (im *InodeMap) FromPath(p string) uint64 {
 	im.RLock()
-	for inode, path := range im.inodes {
-		if p == path {
+	if inode, ok := im.paths[p]; ok {
+		if _, open := im.inodes[inode]; open {
 			im.RUnlock()
 			return inode
 		}
 	}
 	im.RUnlock()
 
-	// allocate the inode
 	im.Lock()
 	defer im.Unlock()
-	im.lastInode++
-	im.inodes[im.lastInode] = p
+	return im.assign(p)
+}
+
+// Lookup returns the inode allocated for a given path, as FromPath does, and
+// counts a lookup of it by the kernel, to be matched by a call to Forget.
+func (im *InodeMap) Lookup(p string) uint64 {
+	im.Lock()
+	defer im.Unlock()
+	inode := im.assign(p)
+	im.lookups[inode]++
+	return inode
+}
+
+// assign returns the inode allocated for p, allocating it if necessary.
+// Nb: caller is responsible for holding im.Lock
+func (im *InodeMap) assign(p string) uint64 {
+	inode, ok := im.paths[p]
+	if !ok {
+		// allocate the inode
+		im.lastInode++
+		inode = im.lastInode
+		im.paths[p] = inode
+		if im.log != nil {
+			if err := json.NewEncoder(im.log).Encode(inodeRecord{Inode: inode, Path: p}); err != nil {
+				logging.Warningf("persisting inode %d for %s: %s", inode, p, err)
+			}
+		}
+	}
+	im.inodes[inode] = p
 	numOpenInodes.Set(int64(len(im.inodes)))
 	lastInode.Set(int64(im.lastInode))
-	return im.lastInode
+	return inode
 }
 
 // ToPath returns the path which was allocated to inode.  If inode has not yet
@@ -65,10 +217,37 @@ func (im *InodeMap) ToPath(inode uint64) (string, error) {
 	return "", errors.New("inode not allocated")
 }
 
-// Release deletes the mapping from an inode to a given path.
+// Forget subtracts n from the count of the kernel's lookups of inode, and
+// releases it once the kernel has forgotten every lookup.  The root inode is
+// never released.
+func (im *InodeMap) Forget(inode, n uint64) {
+	im.Lock()
+	defer im.Unlock()
+	if inode == 1 {
+		return
+	}
+	if n < im.lookups[inode] {
+		im.lookups[inode] -= n
+		return
+	}
+	im.release(inode)
+}
+
+// Release deletes the mapping from an inode to a given path.  If the InodeMap
+// is persistent, the path keeps its inode if it is allocated again; otherwise
+// the path is forgotten, and is allocated a new inode.
 func (im *InodeMap) Release(inode uint64) {
 	im.Lock()
 	defer im.Unlock()
+	im.release(inode)
+}
+
+// Nb: caller is responsible for holding im.Lock
+func (im *InodeMap) release(inode uint64) {
+	delete(im.lookups, inode)
+	if p, ok := im.inodes[inode]; ok && im.log == nil && im.paths[p] == inode {
+		delete(im.paths, p)
+	}
 	delete(im.inodes, inode)
 	numOpenInodes.Set(int64(len(im.inodes)))
 	lastInode.Set(int64(im.lastInode))
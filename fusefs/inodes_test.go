@@ -0,0 +1,133 @@
+package fusefs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+func TestInodeMap(t *testing.T) {
+	im := NewInodeMap()
+	if p, err := im.ToPath(1); err != nil || p != "/" {
+		t.Errorf("ToPath(1): want /, got: %q (%v)", p, err)
+	}
+	a := im.FromPath("a")
+	if got := im.FromPath("a"); got != a {
+		t.Errorf("FromPath(a) changed from %d to %d", a, got)
+	}
+	if p, err := im.ToPath(a); err != nil || p != "a" {
+		t.Errorf("ToPath(%d): want a, got: %q (%v)", a, p, err)
+	}
+	im.Release(a)
+	if _, err := im.ToPath(a); err == nil {
+		t.Errorf("ToPath(%d) succeeded after Release", a)
+	}
+	if got := im.FromPath("a"); got == a {
+		t.Errorf("FromPath(a) reused released inode %d", a)
+	}
+}
+
+// TestInodeMapForget checks that an inode is released once the kernel has
+// forgotten each lookup of it, and that its path is forgotten too, unless the
+// InodeMap is persistent.
+func TestInodeMapForget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inodeMapTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	persistent, err := LoadInodeMap(path.Join(dir, "inodes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer persistent.Close()
+
+	for _, tc := range []struct {
+		im        *InodeMap
+		wantPaths int
+	}{
+		{NewInodeMap(), 1},
+		{persistent, 2},
+	} {
+		im := tc.im
+		a := im.Lookup("a")
+		if got := im.Lookup("a"); got != a {
+			t.Errorf("Lookup(a) changed from %d to %d", a, got)
+		}
+		im.Forget(a, 1)
+		if p, err := im.ToPath(a); err != nil || p != "a" {
+			t.Errorf("after forgetting 1 of 2 lookups, ToPath(%d): want a, got: %q (%v)", a, p, err)
+		}
+		im.Forget(a, 1)
+		if _, err := im.ToPath(a); err == nil {
+			t.Errorf("ToPath(%d) succeeded after every lookup was forgotten", a)
+		}
+		if got := len(im.paths); got != tc.wantPaths {
+			t.Errorf("persistent: %v, want %d paths, got: %d", im.log != nil, tc.wantPaths, got)
+		}
+		im.Forget(1, 1)
+		if p, err := im.ToPath(1); err != nil || p != "/" {
+			t.Errorf("the root inode was released: %q (%v)", p, err)
+		}
+	}
+}
+
+// TestPersistentInodeMap mounts a Server with -inodeMap, records the inode of
+// a path, and "remounts" from the same file.
+func TestPersistentInodeMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inodeMapTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*inodeMapPath = path.Join(dir, "inodes.json")
+	defer func() { *inodeMapPath = "" }()
+
+	mount := func() *Server {
+		mc, err := memory.NewClient(drive.Config{Provider: "memory"})
+		if err != nil {
+			t.Fatalf("NewClient() for test config failed: %s", err)
+		}
+		sc, err := New(mc, nil, nil)
+		if err != nil {
+			t.Fatalf("New() failed: %s", err)
+		}
+		return sc
+	}
+
+	sc := mount()
+	sc.inode.FromPath("first")
+	want := sc.inode.FromPath("dir/file")
+	gone := sc.inode.FromPath("removed")
+	sc.inode.Release(gone)
+	if err := sc.inode.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a partial write when the process exited.
+	fh, err := os.OpenFile(*inodeMapPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.WriteString(`{"Inode": 99, "Pa`)
+	fh.Close()
+
+	sc = mount()
+	defer sc.inode.Close()
+	if p, err := sc.inode.ToPath(want); err != nil || p != "dir/file" {
+		t.Errorf("after remount, ToPath(%d): want dir/file, got: %q (%v)", want, p, err)
+	}
+	// Access in a different order must not change the inode.
+	if got := sc.inode.FromPath("dir/file"); got != want {
+		t.Errorf("after remount, want inode %d for dir/file, got: %d", want, got)
+	}
+	if got := sc.inode.FromPath("removed"); got != gone {
+		t.Errorf("after remount, want inode %d for removed, got: %d", gone, got)
+	}
+	if got := sc.inode.FromPath("new"); got <= gone {
+		t.Errorf("a new path was allocated inode %d, which may have been used before", got)
+	}
+}
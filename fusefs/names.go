@@ -0,0 +1,129 @@
+package fusefs
+
+// The names of new files and directories are checked, and may be rewritten,
+// according to -filenames, so that a repository can be restored on other
+// operating systems.  By default, names are stored in Unicode Normalization
+// Form C (NFC), and a lookup of a name which is not found is retried in NFC,
+// so the composed and decomposed spellings of a name resolve to the same
+// node.  Names which already exist in the tree, eg. because they were stored
+// by throw or under another policy, are used as they are.
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"syscall"
+	"unicode"
+
+	"bazil.org/fuse"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The policies -filenames may select for the names of new files and
+// directories.
+const (
+	// anyNames stores names exactly as they are given.
+	anyNames = "any"
+	// nfcNames stores names in Unicode Normalization Form C, so that a name
+	// typed on a system which composes accents and one which decomposes them
+	// (eg. macOS) refer to the same file.
+	nfcNames = "nfc"
+	// portableNames stores names in NFC, and rejects names containing
+	// characters which are invalid in a filename on common operating systems.
+	portableNames = "portable"
+	// escapeNames stores names in NFC, and replaces the characters rejected by
+	// portableNames with a %XX escape of each of their bytes.
+	escapeNames = "escape"
+)
+
+var (
+	filenames    = flag.String("filenames", nfcNames, fmt.Sprintf("The policy for the names of new files and directories: %q, %q, %q or %q.", anyNames, nfcNames, portableNames, escapeNames))
+	maxNameBytes = flag.Int("maxNameBytes", 255, "The longest name, in bytes, of a new file or directory (0 is unlimited).")
+)
+
+// validNamePolicy returns an error unless policy is a known -filenames policy.
+func validNamePolicy(policy string) error {
+	switch policy {
+	case anyNames, nfcNames, portableNames, escapeNames:
+		return nil
+	}
+	return fmt.Errorf("unknown -filenames policy %q, want one of: %q, %q, %q, %q", policy, anyNames, nfcNames, portableNames, escapeNames)
+}
+
+// nameError describes why a name may not be created, and the errno to
+// report to the kernel.
+type nameError struct {
+	name   string
+	reason string
+	errno  fuse.Errno
+}
+
+func (e *nameError) Error() string {
+	return fmt.Sprintf("invalid name %q: %s", e.name, e.reason)
+}
+
+// storedName returns the name that a new file or directory named name is
+// stored with, according to policy and limited to maxBytes bytes.  It
+// returns a *nameError if name may not be created.  A name containing NUL is
+// always rejected.
+func storedName(name, policy string, maxBytes int) (string, error) {
+	if strings.IndexByte(name, 0) >= 0 {
+		return "", &nameError{name, "contains NUL", fuse.Errno(syscall.EINVAL)}
+	}
+	stored := name
+	if policy != anyNames {
+		stored = norm.NFC.String(name)
+	}
+	if policy == portableNames || policy == escapeNames {
+		var b strings.Builder
+		for _, r := range stored {
+			if portable(r) {
+				b.WriteRune(r)
+				continue
+			}
+			if policy == portableNames {
+				return "", &nameError{name, fmt.Sprintf("contains %q, which is not portable", r), fuse.Errno(syscall.EINVAL)}
+			}
+			for _, c := range []byte(string(r)) {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		stored = b.String()
+	}
+	if maxBytes > 0 && len(stored) > maxBytes {
+		return "", &nameError{name, fmt.Sprintf("is %d bytes long, the limit is %d", len(stored), maxBytes), fuse.Errno(syscall.ENAMETOOLONG)}
+	}
+	return stored, nil
+}
+
+// portable returns false for control characters, and for the characters
+// which Windows does not permit in a filename.
+func portable(r rune) bool {
+	return !unicode.IsControl(r) && !strings.ContainsRune(`\<>:"|?*`, r)
+}
+
+// newName returns the name with which to create the child name of the
+// directory dir.  If dir already has a child of that name, it is returned
+// unchanged, so existing files stored under other policies may still be
+// written.  Otherwise, it returns the name according to -filenames, or a
+// *nameError if it may not be created.
+func (sc *Server) newName(dir, name string) (string, error) {
+	if sc.tree.HasChild(dir, name) {
+		return name, nil
+	}
+	return storedName(name, *filenames, *maxNameBytes)
+}
+
+// lookupName returns the name of the child of dir which name refers to.  It
+// is name itself if dir has such a child, and otherwise the name that a new
+// file named name would be stored with, so that equivalent names resolve to
+// the same node.
+func (sc *Server) lookupName(dir, name string) string {
+	if sc.tree.HasChild(dir, name) {
+		return name
+	}
+	if stored, err := storedName(name, *filenames, 0); err == nil {
+		return stored
+	}
+	return name
+}
@@ -0,0 +1,112 @@
+package fusefs
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+)
+
+func TestStoredName(t *testing.T) {
+	composed := "caf\u00e9"
+	decomposed := "cafe\u0301"
+	for _, tc := range []struct {
+		name, policy string
+		want         string
+		errno        fuse.Errno // if non-zero, the name is rejected
+	}{
+		{name: "file", policy: nfcNames, want: "file"},
+		{name: decomposed, policy: anyNames, want: decomposed},
+		{name: decomposed, policy: nfcNames, want: composed},
+		{name: composed, policy: nfcNames, want: composed},
+		{name: `a\b`, policy: nfcNames, want: `a\b`},
+		{name: `a\b`, policy: portableNames, errno: fuse.Errno(syscall.EINVAL)},
+		{name: "a\tb", policy: portableNames, errno: fuse.Errno(syscall.EINVAL)},
+		{name: decomposed, policy: portableNames, want: composed},
+		{name: `a\b?`, policy: escapeNames, want: "a%5Cb%3F"},
+		{name: "a\u0085b", policy: escapeNames, want: "a%C2%85b"},
+		{name: "a\x00b", policy: anyNames, errno: fuse.Errno(syscall.EINVAL)},
+		{name: "a\x00b", policy: escapeNames, errno: fuse.Errno(syscall.EINVAL)},
+		{name: strings.Repeat("x", 255), policy: nfcNames, want: strings.Repeat("x", 255)},
+		{name: strings.Repeat("x", 256), policy: anyNames, errno: fuse.Errno(syscall.ENAMETOOLONG)},
+		// 86 escapes of 3 bytes each exceed the limit, though the name does not.
+		{name: strings.Repeat("?", 86), policy: escapeNames, errno: fuse.Errno(syscall.ENAMETOOLONG)},
+	} {
+		got, err := storedName(tc.name, tc.policy, 255)
+		if tc.errno != 0 {
+			ne, ok := err.(*nameError)
+			if !ok || ne.errno != tc.errno {
+				t.Errorf("storedName(%q, %q): want errno %v, got: %v", tc.name, tc.policy, tc.errno, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("storedName(%q, %q): %s", tc.name, tc.policy, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("storedName(%q, %q): want %q, got: %q", tc.name, tc.policy, tc.want, got)
+		}
+	}
+}
+
+func TestValidNamePolicy(t *testing.T) {
+	for _, p := range []string{anyNames, nfcNames, portableNames, escapeNames} {
+		if err := validNamePolicy(p); err != nil {
+			t.Errorf("validNamePolicy(%q): %s", p, err)
+		}
+	}
+	if err := validNamePolicy("ascii"); err == nil {
+		t.Error("validNamePolicy accepted an unknown policy")
+	}
+}
+
+// TestEquivalentNames ensures that names which differ only in their Unicode
+// normalization resolve to the same node, and that an existing file whose
+// name is not normalized is still found by its own name.
+func TestEquivalentNames(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory"})
+	if err != nil {
+		t.Fatalf("NewClient() for test config failed: %s", err)
+	}
+	sc, err := New(mc, nil, nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	composed := "caf\u00e9"
+	decomposed := "cafe\u0301"
+
+	sc.tree.Mkdir("dir")
+	name, err := sc.newName("dir", decomposed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != composed {
+		t.Fatalf("newName(%q): want %q, got: %q", decomposed, composed, name)
+	}
+	sc.tree.Create("dir/" + name)
+	for _, n := range []string{composed, decomposed} {
+		if got := sc.lookupName("dir", n); got != composed {
+			t.Errorf("lookupName(%q): want %q, got: %q", n, composed, got)
+		}
+		if got, err := sc.newName("dir", n); err != nil || got != composed {
+			t.Errorf("newName(%q) of an existing file: want %q, got: %q (%v)", n, composed, got, err)
+		}
+	}
+
+	// A file stored with a decomposed name, eg. by throw, keeps it.
+	sc.tree.Create(decomposed)
+	if got := sc.lookupName("", decomposed); got != decomposed {
+		t.Errorf("lookupName(%q) of an existing file: want it unchanged, got: %q", decomposed, got)
+	}
+	if got, err := sc.newName("", decomposed); err != nil || got != decomposed {
+		t.Errorf("newName(%q) of an existing file: want it unchanged, got: %q (%v)", decomposed, got, err)
+	}
+
+	if _, err := sc.newName("dir", "a\x00b"); err == nil {
+		t.Error("newName accepted a name containing NUL")
+	}
+}
@@ -1,9 +1,11 @@
 package fusefs
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"expvar"
+	"flag"
 	"fmt"
 	"path"
 	"strings"
@@ -12,10 +14,22 @@ import (
 
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
-	"github.com/golang/glog"
+	"github.com/asjoyner/shade/logging"
+	"github.com/jpillora/backoff"
 )
 
 var (
+	refreshRetries        = flag.Int("refreshRetries", 3, "The number of times to retry a transient ListFiles failure during each refresh of the tree.")
+	initialRefreshRetries = flag.Int("initialRefreshRetries", 10, "The number of times to retry a transient ListFiles failure while building the initial tree.")
+	refreshConcurrency    = flag.Int("refreshConcurrency", 10, "The maximum number of file objects to fetch in parallel during each refresh of the tree.")
+	// incrementalRefresh can be much shorter than the full refresh, as only
+	// the files added since the last refresh are listed and fetched.
+	incrementalRefresh = flag.Duration("incrementalRefresh", 0, "How often to add the files added since the last refresh to the tree, for clients which can list their changes (0 disables).")
+	asOf               = flag.String("asOf", "", "Present each file as it was at this time, in RFC 3339 format (eg. 2006-01-02T15:04:05Z), or a duration ago (eg. 72h), rather than its latest version.  The filesystem is mounted read only.")
+
+	// refreshBackoff is the delay between retries of ListFiles.
+	refreshBackoff = backoff.Backoff{Min: time.Second, Max: time.Minute, Factor: 2}
+
 	treeNodesExpvar       = expvar.NewInt("treeNodes")
 	knownNodesExpvar      = expvar.NewInt("knownNodes")
 	lastRefreshDurationMs = expvar.NewInt("lastRefreshDurationMs")
@@ -44,6 +58,15 @@ type Node struct {
 	// LastSeen time.Time
 }
 
+// IsDir returns true if the node should be presented as a directory.  This is
+// the case for synthetic directories, and also for a file which shares its
+// path with the parent directory of other files, so that they remain
+// reachable.  Use it, rather than Synthetic, wherever the type of a node is
+// reported, so that it is reported consistently.
+func (n *Node) IsDir() bool {
+	return n.Synthetic() || len(n.Children) > 0
+}
+
 // Synthetic returns true for synthetically created directories.
 func (n *Node) Synthetic() bool {
 	if n.Sha256sum == nil {
@@ -62,13 +85,48 @@ type Tree struct {
 	nodes  map[string]Node // full path to node
 	nm     sync.RWMutex    // protects nodes
 	debug  bool
+
+	// changes is the token from which to list the files added to the client,
+	// or empty if it can't list its changes; see RefreshChanges.
+	changes string
+	cm      sync.Mutex // protects changes
+
+	// asOf excludes the file objects modified after it, if it is not zero.
+	asOf time.Time
+}
+
+// AsOf returns the time parsed from --asOf, or the zero time if it is not set.
+// A duration is subtracted from the current time.
+func AsOf() (time.Time, error) {
+	if *asOf == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, *asOf); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(*asOf)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -asOf %q: not an RFC 3339 time or a duration", *asOf)
+	}
+	return time.Now().Add(-d), nil
 }
 
 // NewTree queries client to discover all the shade.File(s).  It returns a Tree
 // object which is ready to answer questions about the nodes in the file tree.
-// If the initial query fails, an error is returned instead.
+// Transient failures of the initial query are retried up to
+// --initialRefreshRetries times; if it still fails, or fails permanently, an
+// error is returned instead.
+//
+// With --asOf, the Tree presents the newest version of each file modified at
+// or before that time, if it was not deleted, as long as the client still
+// stores that version; see the README.
 func NewTree(client drive.Client, refresh *time.Ticker) (*Tree, error) {
+	at, err := AsOf()
+	if err != nil {
+		return nil, err
+	}
 	t := &Tree{
+		asOf:   at,
 		client: client,
 		nodes: map[string]Node{
 			"": {
@@ -76,12 +134,15 @@ func NewTree(client drive.Client, refresh *time.Ticker) (*Tree, error) {
 				Children: make(map[string]bool),
 			}},
 	}
-	if err := t.Refresh(); err != nil {
+	if err := t.refresh(*initialRefreshRetries); err != nil {
 		return nil, fmt.Errorf("initializing Tree: %s", err)
 	}
 	if refresh != nil {
 		go t.periodicRefresh(refresh)
 	}
+	if *incrementalRefresh > 0 {
+		go t.periodicChanges(time.NewTicker(*incrementalRefresh))
+	}
 	return t, nil
 }
 
@@ -92,10 +153,10 @@ func (t *Tree) NodeByPath(p string) (Node, error) {
 	defer t.nm.RUnlock()
 	n, ok := t.nodes[p]
 	if !ok || n.Deleted {
-		if glog.V(5) {
-			glog.Info("known nodes:")
+		if logging.V(5) {
+			logging.Info("known nodes:")
 			for _, n := range t.nodes {
-				glog.Infof("%+v", n)
+				logging.Infof("%+v", n)
 			}
 		}
 		return Node{}, fmt.Errorf("no such node: %q", p)
@@ -118,7 +179,7 @@ func (t *Tree) FileByNode(n Node) (*shade.File, error) {
 	}
 	fj, err := t.client.GetFile(n.Sha256sum)
 	if err != nil {
-		return nil, fmt.Errorf("GetChunk(%x): %s", n.Sha256sum, err)
+		return nil, fmt.Errorf("GetFile(%x): %s", n.Sha256sum, err)
 	}
 	if fj == nil || len(fj) == 0 {
 		return nil, fmt.Errorf("Could not find JSON for node: %q", n.Filename)
@@ -139,6 +200,18 @@ func (t *Tree) HasChild(parent, child string) bool {
 	return t.nodes[parent].Children[child]
 }
 
+// Children returns the names of the children immediately below dir in the
+// file tree, in no particular order.
+func (t *Tree) Children(dir string) []string {
+	t.nm.RLock()
+	defer t.nm.RUnlock()
+	var children []string
+	for name := range t.nodes[dir].Children {
+		children = append(children, name)
+	}
+	return children
+}
+
 // NumNodes returns the number of nodes (files + synthetic directories) in the
 // system.
 func (t *Tree) NumNodes() int {
@@ -160,6 +233,31 @@ func (t *Tree) Mkdir(dir string) Node {
 	return t.nodes[dir]
 }
 
+// errNotEmpty is returned by Rmdir for a directory which has children.
+var errNotEmpty = errors.New("directory not empty")
+
+// Rmdir removes the synthetic directory dir from the tree, and from the
+// Children of its parent.  It returns errNotEmpty if dir has children.
+func (t *Tree) Rmdir(dir string) error {
+	dir = strings.TrimPrefix(dir, "/")
+	t.nm.Lock()
+	defer t.nm.Unlock()
+	n, ok := t.nodes[dir]
+	if !ok || n.Deleted || dir == "" {
+		return fmt.Errorf("no such directory: %q", dir)
+	}
+	if !n.IsDir() {
+		return fmt.Errorf("not a directory: %q", dir)
+	}
+	if len(n.Children) != 0 {
+		return errNotEmpty
+	}
+	delete(t.nodes, dir)
+	parent, f := path.Split(dir)
+	delete(t.nodes[strings.TrimSuffix(parent, "/")].Children, f)
+	return nil
+}
+
 // Create adds a new shade.File node to the tree
 func (t *Tree) Create(filename string) Node {
 	t.nm.Lock()
@@ -179,11 +277,11 @@ func (t *Tree) Update(n Node) {
 	defer t.nm.Unlock()
 	on, ok := t.nodes[n.Filename]
 	if !ok {
-		glog.Warningf("Attempt to update a non-existent node: %+v", n)
+		logging.Warningf("Attempt to update a non-existent node: %+v", n)
 		return
 	}
 	if on.ModifiedTime.After(n.ModifiedTime) {
-		glog.V(5).Infof("Update mtime (%s) older than current Node (%s)", n.ModifiedTime, on.ModifiedTime)
+		logging.V(5).Infof("Update mtime (%s) older than current Node (%s)", n.ModifiedTime, on.ModifiedTime)
 		return
 	}
 	t.nodes[n.Filename] = n
@@ -192,7 +290,7 @@ func (t *Tree) Update(n Node) {
 		dir = strings.TrimSuffix(dir, "/")
 		parent, ok := t.nodes[dir]
 		if !ok {
-			glog.Warningf("Updated node without a parent: %+v", n)
+			logging.Warningf("Updated node without a parent: %+v", n)
 			return
 		}
 		delete(parent.Children, f)
@@ -201,35 +299,109 @@ func (t *Tree) Update(n Node) {
 
 // Refresh updates the cached view of the Tree by calling ListFiles and
 // processing the result.
+//
+// The new set of nodes is built without holding t.nm, so lookups continue to
+// be answered from the existing nodes while the (potentially slow) fetches
+// happen.  The existing nodes are then merged in, and the result is swapped
+// in, under a brief lock.  Because the existing nodes include any changes made
+// locally before or during the refresh, those are not lost by the swap.
+//
+// File objects are fetched up to --refreshConcurrency at a time, or in a
+// batch if the client implements drive.FilesGetter.
+//
+// Transient failures of ListFiles are retried up to --refreshRetries times.
 func (t *Tree) Refresh() error {
-	glog.Info("Begining cache refresh cycle.")
+	return t.refresh(*refreshRetries)
+}
+
+func (t *Tree) refresh(retries int) error {
+	logging.Info("Begining cache refresh cycle.")
 	start := time.Now()
-	// key is a string([]byte) representation of the file's SHA2
-	knownNodes := make(map[string]bool)
-	newFiles, err := t.client.ListFiles()
+	newFiles, err := t.listFiles(retries)
+	if err != nil {
+		return err
+	}
+	logging.Infof("Found %d file(s) via %s", len(newFiles), t.client.GetConfig().Provider)
+	nodes, known, err := t.fetchNodes(newFiles)
+	if err != nil {
+		return err
+	}
+	t.nm.Lock()
+	t.nodes = mergeNodes(nodes, t.nodes)
+	numNodes := len(t.nodes)
+	t.nm.Unlock()
+	logging.Infof("Refresh complete with %d file(s) in %v.", known, time.Since(start))
+	lastRefreshDurationMs.Set(int64(time.Since(start).Nanoseconds() / 1000))
+	knownNodesExpvar.Set(int64(known))
+	treeNodesExpvar.Set(int64(numNodes))
+	return nil
+}
+
+// RefreshChanges adds the files added to the client since the last refresh
+// to the Tree, without listing or fetching the rest.  It returns
+// drive.ErrNoChanges if the client can't list its changes, in which case
+// only Refresh finds new files.
+func (t *Tree) RefreshChanges() error {
+	t.cm.Lock()
+	token := t.changes
+	t.cm.Unlock()
+	if token == "" {
+		return drive.ErrNoChanges
+	}
+	files, next, err := drive.ListFilesSince(t.client, token)
 	if err != nil {
-		return fmt.Errorf("%q ListFiles(): %s", t.client.GetConfig().Provider, err)
-	}
-	glog.Infof("Found %d file(s) via %s", len(newFiles), t.client.GetConfig().Provider)
-	// fetch all those files into the local disk cache
-	for _, sha256sum := range newFiles {
-		// check if we have already processed this Node
-		if knownNodes[string(sha256sum)] {
-			continue // we've already processed this file
+		return fmt.Errorf("%q ListFilesSince(): %s", t.client.GetConfig().Provider, err)
+	}
+	if len(files) > 0 {
+		nodes, _, err := t.fetchNodes(files)
+		if err != nil {
+			return err
 		}
+		t.nm.Lock()
+		t.applyNodes(nodes)
+		treeNodesExpvar.Set(int64(len(t.nodes)))
+		t.nm.Unlock()
+		logging.V(2).Infof("Added %d changed file(s) to the tree", len(nodes))
+	}
+	t.cm.Lock()
+	t.changes = next
+	t.cm.Unlock()
+	return nil
+}
 
-		// fetch the file Chunk
-		f, err := t.client.GetFile(sha256sum)
+// fetchNodes fetches the file objects with the given sums, and returns a
+// Node for the newest version of each Filename among them, and the number of
+// file objects which were fetched.  Files which can't be fetched are skipped.
+//
+// File objects are fetched up to --refreshConcurrency at a time, or in a
+// batch if the client implements drive.FilesGetter.
+func (t *Tree) fetchNodes(sums [][]byte) (map[string]Node, int, error) {
+	// key is a string([]byte) representation of the file's SHA2
+	knownNodes := make(map[string]bool)
+	// skip the files listed by more than one child
+	var unique [][]byte
+	listed := make(map[string]bool, len(sums))
+	for _, sha256sum := range sums {
+		if listed[string(sha256sum)] {
+			continue
+		}
+		listed[string(sha256sum)] = true
+		unique = append(unique, sha256sum)
+	}
+	nodes := make(map[string]Node, len(unique))
+	// fetch up to --refreshConcurrency files at once, and populate nodes as
+	// they arrive
+	err := drive.GetFiles(context.Background(), t.client, unique, *refreshConcurrency, func(sha256sum, f []byte, err error) {
 		if err != nil {
 			// TODO(asjoyner): if !client.Local()... retry?
-			glog.Infof("Failed to fetch file %x: %s  (skipping)", sha256sum, err)
-			continue
+			logging.Infof("Failed to fetch file %x: %s  (skipping)", sha256sum, err)
+			return
 		}
-		// unmarshal and populate t.nodes as the shade.files go by
+		// unmarshal and populate nodes as the shade.files go by
 		file := &shade.File{}
 		if err := file.FromJSON(f); err != nil {
-			glog.Warningf("Could not unmarshal file %x: %v", sha256sum, err)
-			continue
+			logging.Warningf("Could not unmarshal file %x: %v", sha256sum, err)
+			return
 		}
 		node := Node{
 			Filename:     path.Clean(file.Filename),
@@ -239,60 +411,163 @@ func (t *Tree) Refresh() error {
 			Sha256sum:    sha256sum,
 			Children:     nil,
 		}
-		if glog.V(5) {
-			glog.Infof("processing node: %+v", node)
+		if logging.V(5) {
+			logging.Infof("processing node: %+v", node)
+		}
+		knownNodes[string(sha256sum)] = true
+		if !t.asOf.IsZero() && node.ModifiedTime.After(t.asOf) {
+			return
 		}
-		t.nm.Lock()
 		// TODO(asjoyner): handle file + directory collisions
-		if existing, ok := t.nodes[node.Filename]; ok && existing.ModifiedTime.After(node.ModifiedTime) {
-			t.nm.Unlock()
+		if existing, ok := nodes[node.Filename]; ok && existing.ModifiedTime.After(node.ModifiedTime) {
+			return
+		}
+		nodes[node.Filename] = node
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return nodes, len(knownNodes), nil
+}
+
+// applyNodes adds nodes to the Tree, except where it already has a newer
+// version of the same path.
+// Nb: caller is responsible for holding t.nm
+func (t *Tree) applyNodes(nodes map[string]Node) {
+	for name, n := range nodes {
+		if existing, ok := t.nodes[name]; ok {
+			if existing.ModifiedTime.After(n.ModifiedTime) {
+				continue
+			}
+			// A directory keeps its children, even if it is also a file.
+			n.Children = existing.Children
+		}
+		t.nodes[name] = n
+		if !n.Deleted {
+			addParents(t.nodes, name)
 			continue
 		}
-		t.nodes[node.Filename] = node
-		if node.Deleted { // ensure the parent is updated
-			dir, f := path.Split(node.Filename)
-			dir = strings.TrimSuffix(dir, "/")
-			parent, _ := t.nodes[dir]
-			delete(parent.Children, f) // harmless if parent doesn't exist
-		} else {
-			t.addParents(node.Filename)
+		dir, f := path.Split(name)
+		if parent, ok := t.nodes[strings.TrimSuffix(dir, "/")]; ok {
+			delete(parent.Children, f)
 		}
-		t.nm.Unlock()
-		knownNodes[string(sha256sum)] = true
 	}
-	glog.Infof("Refresh complete with %d file(s) in %v.", len(knownNodes), time.Since(start))
-	lastRefreshDurationMs.Set(int64(time.Since(start).Nanoseconds() / 1000))
-	knownNodesExpvar.Set(int64(len(knownNodes)))
-	treeNodesExpvar.Set(int64(len(t.nodes)))
-	return nil
+}
+
+// listFiles calls ListFiles, retrying transient failures up to retries times
+// with backoff.  Permanent failures, such as authorization errors, are
+// returned immediately.  If the client can list its changes, the files are
+// listed with ListFilesSince instead, and the token it returns is recorded
+// for RefreshChanges.
+func (t *Tree) listFiles(retries int) ([][]byte, error) {
+	provider := t.client.GetConfig().Provider
+	b := refreshBackoff
+	for attempt := 0; ; attempt++ {
+		files, next, err := drive.ListFilesSince(t.client, "")
+		if err == drive.ErrNoChanges {
+			files, err = t.client.ListFiles()
+		}
+		if err == nil {
+			t.cm.Lock()
+			t.changes = next
+			t.cm.Unlock()
+			return files, nil
+		}
+		if drive.IsPermanent(err) || attempt >= retries {
+			return nil, fmt.Errorf("%q ListFiles(): %s", provider, err)
+		}
+		d := b.Duration()
+		logging.Warningf("%q ListFiles() failed (retry %d of %d in %v): %s", provider, attempt+1, retries, d, err)
+		time.Sleep(d)
+	}
+}
+
+// mergeNodes adds the current nodes to the fresh nodes, and returns the
+// result.  Where both describe the same path, the newer ModifiedTime wins, as
+// it would have if fresh had been applied to current one at a time.  The
+// Children of each directory are then recalculated from scratch.
+func mergeNodes(fresh, current map[string]Node) map[string]Node {
+	for name, n := range current {
+		if f, ok := fresh[name]; ok && !n.ModifiedTime.After(f.ModifiedTime) {
+			continue
+		}
+		fresh[name] = n
+	}
+	if _, ok := fresh[""]; !ok {
+		fresh[""] = Node{Filename: ""}
+	}
+	for name, n := range fresh {
+		if n.Children != nil || n.Synthetic() {
+			n.Children = make(map[string]bool)
+			fresh[name] = n
+		}
+	}
+	for name, n := range fresh {
+		if name == "" || n.Deleted {
+			continue
+		}
+		addParents(fresh, name)
+	}
+	return fresh
 }
 
 // recursive function to update parent dirs
 func (t *Tree) addParents(filepath string) {
+	addParents(t.nodes, filepath)
+}
+
+// addParents ensures each of the parent directories of filepath exist in
+// nodes, and lists their child.
+func addParents(nodes map[string]Node, filepath string) {
 	dir, f := path.Split(filepath)
 	dir = strings.TrimSuffix(dir, "/")
-	if glog.V(5) {
-		glog.Infof("adding %q as a child of %q", f, dir)
+	if logging.V(5) {
+		logging.Infof("adding %q as a child of %q", f, dir)
 	}
-	// TODO(asjoyner): handle file + directory collisions
-	if parent, ok := t.nodes[dir]; !ok {
-		// if the parent node doesn't yet exist, initialize it
-		t.nodes[dir] = Node{
+	if parent, ok := nodes[dir]; !ok || parent.Deleted {
+		// if the parent node doesn't yet exist, or is a deleted file which has
+		// since been recreated as a directory, initialize it
+		nodes[dir] = Node{
 			Filename: dir,
 			Children: map[string]bool{f: true},
 		}
 	} else {
+		if !parent.Synthetic() {
+			logging.V(2).Infof("%q is both a file and a directory; presenting it as a directory", dir)
+		}
+		if parent.Children == nil {
+			parent.Children = make(map[string]bool)
+			nodes[dir] = parent
+		}
 		parent.Children[f] = true
 		return
 	}
 	if dir != "" {
-		t.addParents(dir)
+		addParents(nodes, dir)
+	}
+}
+
+// periodicChanges calls RefreshChanges each time refresh ticks, until it
+// finds the client can't list its changes.
+func (t *Tree) periodicChanges(refresh *time.Ticker) {
+	defer refresh.Stop()
+	for {
+		<-refresh.C
+		err := t.RefreshChanges()
+		if err == drive.ErrNoChanges {
+			logging.Infof("%q can't list its changes, so only full refreshes will find new files", t.client.GetConfig().Provider)
+			return
+		} else if err != nil {
+			logging.Warningf("refreshing the changes to the Tree: %s", err)
+		}
 	}
 }
 
 func (t *Tree) periodicRefresh(refresh *time.Ticker) {
 	for {
 		<-refresh.C
-		t.Refresh()
+		if err := t.Refresh(); err != nil {
+			logging.Warningf("refreshing Tree: %s", err)
+		}
 	}
 }
@@ -1,10 +1,23 @@
 package fusefs
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/encrypt"
+	"github.com/asjoyner/shade/drive/memory"
 	_ "github.com/asjoyner/shade/drive/win"
+	"github.com/jpillora/backoff"
 )
 
 func TestSynthetic(t *testing.T) {
@@ -100,3 +113,450 @@ func TestAddParent(t *testing.T) {
 		}
 	}
 }
+
+// slowClient delays each call to GetFile, to simulate a slow refresh.
+type slowClient struct {
+	drive.Client
+	delay time.Duration
+}
+
+func (c *slowClient) GetFile(sha256sum []byte) ([]byte, error) {
+	time.Sleep(c.delay)
+	return c.Client.GetFile(sha256sum)
+}
+
+func TestRefreshDoesNotBlockReads(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("failed to initialize test client: %s", err)
+	}
+	numFiles := 10
+	for i := 0; i < numFiles; i++ {
+		jm, err := json.Marshal(shade.NewFile(fmt.Sprintf("dir/file%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mc.PutFile(shade.Sum(jm), jm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// fetch serially, so the refresh is still in flight while reading
+	defer func(c int) { *refreshConcurrency = c }(*refreshConcurrency)
+	*refreshConcurrency = 1
+	sc := &slowClient{Client: mc}
+	tree, err := NewTree(sc, nil)
+	if err != nil {
+		t.Fatalf("failed to initialize Tree: %s", err)
+	}
+
+	sc.delay = 20 * time.Millisecond
+	done := make(chan error)
+	go func() { done <- tree.Refresh() }()
+	time.Sleep(10 * time.Millisecond) // let the refresh begin
+
+	// make local changes while the refresh is in flight
+	tree.Create("dir/local")
+	tree.Mkdir("newdir")
+	for i := 0; i < numFiles; i++ {
+		start := time.Now()
+		if _, err := tree.NodeByPath(fmt.Sprintf("dir/file%d", i)); err != nil {
+			t.Error(err)
+		}
+		if d := time.Since(start); d > sc.delay {
+			t.Errorf("NodeByPath() stalled for %s during Refresh()", d)
+		}
+	}
+	select {
+	case <-done:
+		t.Fatalf("Refresh() completed too quickly to test concurrent reads")
+	default:
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"dir/local", "newdir", "dir/file9"} {
+		if _, err := tree.NodeByPath(p); err != nil {
+			t.Errorf("node lost by Refresh(): %s", err)
+		}
+	}
+	if !tree.HasChild("dir", "local") {
+		t.Errorf("locally created file is not a child of its directory")
+	}
+	if !tree.HasChild("", "newdir") {
+		t.Errorf("locally created directory is not a child of the root")
+	}
+}
+
+// TestConcurrentRefresh ensures fetching file objects concurrently is faster
+// than fetching them serially, and builds the same tree.
+func TestConcurrentRefresh(t *testing.T) {
+	defer func(c int) { *refreshConcurrency = c }(*refreshConcurrency)
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatalf("failed to initialize test client: %s", err)
+	}
+	numFiles := 50
+	for i := 0; i < numFiles; i++ {
+		jm, err := json.Marshal(shade.NewFile(fmt.Sprintf("dir%d/file%d", i%5, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mc.PutFile(shade.Sum(jm), jm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sc := &slowClient{Client: mc, delay: 10 * time.Millisecond}
+
+	var trees []*Tree
+	var durations []time.Duration
+	for _, c := range []int{1, 10} {
+		*refreshConcurrency = c
+		start := time.Now()
+		tree, err := NewTree(sc, nil)
+		if err != nil {
+			t.Fatalf("failed to initialize Tree: %s", err)
+		}
+		durations = append(durations, time.Since(start))
+		trees = append(trees, tree)
+	}
+	if durations[1]*2 > durations[0] {
+		t.Errorf("concurrent refresh took %s, serial refresh took %s", durations[1], durations[0])
+	}
+	if !reflect.DeepEqual(trees[0].nodes, trees[1].nodes) {
+		t.Errorf("concurrent refresh built a different tree: %v, want %v", trees[1].nodes, trees[0].nodes)
+	}
+	if n := trees[1].NumNodes(); n != numFiles+6 {
+		t.Errorf("want %d nodes, got: %d", numFiles+6, n)
+	}
+}
+
+// flakyListClient fails the first failures calls to ListFiles with err.
+type flakyListClient struct {
+	drive.Client
+	err      error
+	failures int
+	calls    int
+}
+
+func (c *flakyListClient) ListFiles() ([][]byte, error) {
+	c.calls++
+	if c.calls <= c.failures {
+		return nil, c.err
+	}
+	return c.Client.ListFiles()
+}
+
+// TestRefreshRetries ensures transient ListFiles failures are retried until
+// the tree populates, and permanent ones are not.
+func TestRefreshRetries(t *testing.T) {
+	defer func(b backoff.Backoff) { refreshBackoff = b }(refreshBackoff)
+	refreshBackoff = backoff.Backoff{Min: time.Millisecond, Max: time.Millisecond}
+
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jm, err := json.Marshal(shade.NewFile("flaky"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.PutFile(shade.Sum(jm), jm); err != nil {
+		t.Fatal(err)
+	}
+
+	flaky := &flakyListClient{Client: mc, err: errors.New("transient"), failures: 5}
+	tree, err := NewTree(flaky, nil)
+	if err != nil {
+		t.Fatalf("NewTree failed despite ListFiles eventually succeeding: %s", err)
+	}
+	if _, err := tree.NodeByPath("flaky"); err != nil {
+		t.Errorf("tree did not populate: %s", err)
+	}
+
+	flaky.calls, flaky.failures = 0, *refreshRetries+1
+	if err := tree.Refresh(); err == nil {
+		t.Error("Refresh succeeded despite exhausting its retries")
+	}
+
+	flaky.calls, flaky.failures = 0, 1
+	flaky.err = &drive.PermanentError{Err: errors.New("unauthorized")}
+	if _, err := NewTree(flaky, nil); err == nil {
+		t.Error("NewTree succeeded despite a permanent ListFiles failure")
+	}
+	if flaky.calls != 1 {
+		t.Errorf("a permanent ListFiles failure was retried: %d calls", flaky.calls)
+	}
+}
+
+// changesClient counts the calls to ListFiles and GetFile of a memory client,
+// which can list its changes.
+type changesClient struct {
+	*memory.Drive
+	lists, gets int
+}
+
+func (c *changesClient) ListFiles() ([][]byte, error) {
+	c.lists++
+	return c.Drive.ListFiles()
+}
+
+func (c *changesClient) GetFile(sha256sum []byte) ([]byte, error) {
+	c.gets++
+	return c.Drive.GetFile(sha256sum)
+}
+
+func putTestFile(t *testing.T, c drive.Client, f *shade.File) {
+	jm, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutFile(shade.Sum(jm), jm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRefreshChanges ensures that the files added to a client which can list
+// its changes appear in the tree, without listing or fetching the others.
+func TestRefreshChanges(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := &changesClient{Drive: mc.(*memory.Drive)}
+	for i := 0; i < 10; i++ {
+		putTestFile(t, cc, shade.NewFile(fmt.Sprintf("old/%d", i)))
+	}
+	tree, err := NewTree(cc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.lists, cc.gets = 0, 0
+
+	putTestFile(t, cc, shade.NewFile("new/file"))
+	removed := shade.NewFile("old/3")
+	removed.Deleted = true
+	putTestFile(t, cc, removed)
+	if err := tree.RefreshChanges(); err != nil {
+		t.Fatalf("RefreshChanges() failed: %s", err)
+	}
+	if _, err := tree.NodeByPath("new/file"); err != nil {
+		t.Errorf("the added file is not in the tree: %s", err)
+	}
+	if _, err := tree.NodeByPath("old/3"); err == nil {
+		t.Error("the deleted file is still in the tree")
+	}
+	if tree.HasChild("old", "3") {
+		t.Error("the deleted file is still a child of its directory")
+	}
+	if _, err := tree.NodeByPath("old/4"); err != nil {
+		t.Errorf("an unchanged file is no longer in the tree: %s", err)
+	}
+	if cc.lists != 0 || cc.gets != 2 {
+		t.Errorf("RefreshChanges() listed the files %d times and fetched %d, want 0 and 2", cc.lists, cc.gets)
+	}
+
+	// Without changes, nothing is fetched.
+	if err := tree.RefreshChanges(); err != nil {
+		t.Fatalf("RefreshChanges() failed: %s", err)
+	}
+	if cc.gets != 2 {
+		t.Errorf("RefreshChanges() without changes fetched %d files", cc.gets-2)
+	}
+}
+
+// TestPeriodicChanges ensures files added to the client appear in the tree
+// promptly with --incrementalRefresh, and that a client which can't list its
+// changes still works.
+func TestPeriodicChanges(t *testing.T) {
+	defer func(d time.Duration) { *incrementalRefresh = d }(*incrementalRefresh)
+	*incrementalRefresh = 10 * time.Millisecond
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewTree(mc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestFile(t, mc, shade.NewFile("prompt"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := tree.NodeByPath("prompt"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the added file did not appear in the tree")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tree, err = NewTree(&flakyListClient{Client: mc}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.RefreshChanges(); err != drive.ErrNoChanges {
+		t.Errorf("RefreshChanges() of a client which can't list its changes, want: %s, got: %v", drive.ErrNoChanges, err)
+	}
+}
+
+func TestRmdir(t *testing.T) {
+	tree := Tree{nodes: map[string]Node{"": {Children: make(map[string]bool)}}}
+	tree.Mkdir("a/b")
+	if err := tree.Rmdir("a"); err != errNotEmpty {
+		t.Errorf("Rmdir() of a non-empty directory: want errNotEmpty, got: %v", err)
+	}
+	if err := tree.Rmdir("a/b"); err != nil {
+		t.Errorf("Rmdir() of an empty directory: %s", err)
+	}
+	if _, err := tree.NodeByPath("a/b"); err == nil {
+		t.Error("a/b is still in the tree")
+	}
+	if tree.HasChild("a", "b") {
+		t.Error("a/b is still a child of a")
+	}
+	if err := tree.Rmdir("/a"); err != nil {
+		t.Errorf("Rmdir() of a newly empty directory: %s", err)
+	}
+	if err := tree.Rmdir("a"); err == nil {
+		t.Error("Rmdir() of a missing directory succeeded")
+	}
+	tree.Create("file")
+	if err := tree.Rmdir("file"); err == nil || err == errNotEmpty {
+		t.Errorf("Rmdir() of a file: want an error, got: %v", err)
+	}
+}
+
+// TestFileByNodeEncrypted ensures FileByNode returns the decrypted metadata
+// of a file stored by an "encrypt" client.
+func TestFileByNodeEncrypted(t *testing.T) {
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemPrivKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privkey)})
+	ec, err := encrypt.NewClient(drive.Config{
+		Provider:      "encrypt",
+		RsaPrivateKey: string(pemPrivKey),
+		Children:      []drive.Config{{Provider: "memory", Write: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := shade.NewFile("dir/secret")
+	sum, data := drive.RandChunk()
+	chunk := shade.NewChunk()
+	chunk.Sha256 = sum
+	want.Chunks = []shade.Chunk{chunk}
+	want.LastChunksize = len(data)
+	want.UpdateFilesize()
+	if err := ec.PutChunk(sum, data, want); err != nil {
+		t.Fatal(err)
+	}
+	putTestFile(t, ec, want)
+
+	tree, err := NewTree(ec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := tree.NodeByPath("dir/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := tree.FileByNode(n)
+	if err != nil {
+		t.Fatalf("FileByNode() failed: %s", err)
+	}
+	if got.Filename != want.Filename || got.Filesize != want.Filesize || !reflect.DeepEqual(got.Chunks, want.Chunks) || !reflect.DeepEqual(got.AesKey, want.AesKey) {
+		t.Errorf("FileByNode(), want: %s, got: %s", want, got)
+	}
+	if _, err := tree.FileByNode(Node{Filename: "dir/missing", Sha256sum: []byte("no such file")}); err == nil {
+		t.Error("FileByNode() succeeded for a file which is not stored")
+	}
+}
+
+// TestAsOf changes one file and deletes another, then builds a Tree with
+// --asOf a time before those changes, and expects the old content of each.
+func TestAsOf(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().Add(-time.Hour)
+	versions := []struct {
+		filename string
+		content  string
+		mtime    time.Time
+		deleted  bool
+	}{
+		{"changed", "the old content", before.Add(-time.Minute), false},
+		{"changed", "the new content", before.Add(time.Minute), false},
+		{"removed", "a removed file", before.Add(-time.Minute), false},
+		{"removed", "", before.Add(time.Minute), true},
+		{"dir/added", "an added file", before.Add(time.Minute), false},
+		{"gone", "removed long ago", before.Add(-2 * time.Minute), false},
+		{"gone", "", before.Add(-time.Minute), true},
+	}
+	for _, v := range versions {
+		f := shade.NewFile(v.filename)
+		f.ModifiedTime = v.mtime
+		f.Deleted = v.deleted
+		if !v.deleted {
+			chunk := shade.NewChunk()
+			chunk.Sha256 = shade.Sum([]byte(v.content))
+			if err := mc.PutChunk(chunk.Sha256, []byte(v.content), f); err != nil {
+				t.Fatal(err)
+			}
+			f.Chunks = []shade.Chunk{chunk}
+			f.LastChunksize = len(v.content)
+			f.UpdateFilesize()
+		}
+		putTestFile(t, mc, f)
+	}
+
+	*asOf = before.Format(time.RFC3339)
+	defer func() { *asOf = "" }()
+	tree, err := NewTree(mc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for filename, want := range map[string]string{
+		"changed": "the old content",
+		"removed": "a removed file",
+	} {
+		n, err := tree.NodeByPath(filename)
+		if err != nil {
+			t.Errorf("%s is not in the tree as of %s: %s", filename, *asOf, err)
+			continue
+		}
+		f, err := tree.FileByNode(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readRange(mc, f, 0, f.Filesize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s as of %s: got %q, want %q", filename, *asOf, got, want)
+		}
+	}
+	for _, filename := range []string{"dir/added", "dir", "gone"} {
+		if _, err := tree.NodeByPath(filename); err == nil {
+			t.Errorf("%s is in the tree as of %s", filename, *asOf)
+		}
+	}
+
+	*asOf = "not a time"
+	if _, err := NewTree(mc, nil); err == nil {
+		t.Error("NewTree() accepted an invalid -asOf")
+	}
+	*asOf = "30m"
+	at, err := AsOf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(at); d < 30*time.Minute || d > 31*time.Minute {
+		t.Errorf("-asOf 30m is %s ago, want 30m", d)
+	}
+}
@@ -0,0 +1,122 @@
+package fusefs
+
+// After the initial tree is built, the chunks of a selection of files may be
+// warmed in the background, so that the first reads of them are not slow.
+// Each selected file's chunks are passed to client.Warm, which lets a remote
+// client prepare to serve them, eg. by caching their metadata.  With
+// -warmFetch, each chunk is also fetched, so that a "cache" client stores a
+// copy in its Local children, and the -chunkDiskCache stores a decrypted copy;
+// without either, fetching only costs bandwidth.  The mount is usable while the files are warmed.
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+)
+
+var (
+	warmOnMount        = flag.Bool("warmOnMount", false, "After mounting, warm the chunks of the files selected by -warmPath, -warmMaxFileBytes and -warmModifiedWithin in the background.")
+	warmPath           = flag.String("warmPath", "", "Only warm the files whose path matches this shell glob; '*' does not match '/' (empty matches every file).")
+	warmMaxFileBytes   = flag.Int64("warmMaxFileBytes", 0, "Only warm the files of at most this many bytes (0 is unlimited).")
+	warmModifiedWithin = flag.Duration("warmModifiedWithin", 0, "Only warm the files modified within this long before the mount (0 is unlimited).")
+	warmFetch          = flag.Bool("warmFetch", false, "Also fetch each chunk of the warmed files, so a cache client stores it locally.")
+	warmConcurrency    = flag.Int("warmConcurrency", 4, "The number of chunks of the warmed files to fetch in parallel.")
+
+	warmedFilesExpvar  = expvar.NewInt("warmedFiles")
+	warmedChunksExpvar = expvar.NewInt("warmedChunks")
+)
+
+// warmFilter selects the files to warm.
+type warmFilter struct {
+	glob     string    // empty matches every path
+	maxBytes int64     // zero is unlimited
+	since    time.Time // the zero value selects files of any age
+}
+
+// validWarmPath returns an error if glob is not a valid -warmPath.
+func validWarmPath(glob string) error {
+	if _, err := path.Match(glob, ""); err != nil {
+		return fmt.Errorf("invalid -warmPath %q: %s", glob, err)
+	}
+	return nil
+}
+
+// match returns true if the file described by n should be warmed.
+func (wf warmFilter) match(n Node) bool {
+	if wf.glob != "" {
+		if ok, _ := path.Match(wf.glob, n.Filename); !ok {
+			return false
+		}
+	}
+	if wf.maxBytes > 0 && n.Filesize > wf.maxBytes {
+		return false
+	}
+	return wf.since.IsZero() || !n.ModifiedTime.Before(wf.since)
+}
+
+// files returns the nodes of the files in the tree which wf selects, in no
+// particular order.
+func (wf warmFilter) files(t *Tree) []Node {
+	t.nm.RLock()
+	defer t.nm.RUnlock()
+	var nodes []Node
+	for _, n := range t.nodes {
+		if n.Synthetic() || n.Deleted || !wf.match(n) {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// warmFiles passes the chunks of each file in t which wf selects to
+// client.Warm.  If fetch is set, it also fetches each chunk, with at most
+// concurrency fetches in flight, and discards it.  It returns when every
+// selected file has been warmed.  Failures are logged, and do not stop the
+// remaining files from being warmed.
+func warmFiles(client drive.Client, t *Tree, wf warmFilter, fetch bool, concurrency int) {
+	start := time.Now()
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var warmed int
+	for _, n := range wf.files(t) {
+		f, err := t.FileByNode(n)
+		if err != nil {
+			logging.Warningf("could not warm %q: %s", n.Filename, err)
+			continue
+		}
+		chunks := make([][]byte, 0, len(f.Chunks))
+		for _, c := range f.Chunks {
+			chunks = append(chunks, c.Sha256)
+		}
+		client.Warm(chunks, f)
+		warmed++
+		warmedFilesExpvar.Add(1)
+		if !fetch {
+			continue
+		}
+		for _, sum := range chunks {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(sum []byte) {
+				defer func() { <-sem; wg.Done() }()
+				if _, err := client.GetChunk(sum, f); err != nil {
+					logging.Warningf("could not warm chunk %x of %q: %s", sum, f.Filename, err)
+					return
+				}
+				warmedChunksExpvar.Add(1)
+			}(sum)
+		}
+	}
+	wg.Wait()
+	logging.Infof("Warmed %d file(s) in %s", warmed, time.Since(start))
+}
@@ -0,0 +1,132 @@
+package fusefs
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	_ "github.com/asjoyner/shade/drive/cache"
+	"github.com/asjoyner/shade/drive/local"
+)
+
+func TestWarmFilter(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		wf   warmFilter
+		n    Node
+		want bool
+	}{
+		{warmFilter{}, Node{Filename: "any/file", Filesize: 1 << 40}, true},
+		{warmFilter{glob: "hot/*"}, Node{Filename: "hot/file"}, true},
+		{warmFilter{glob: "hot/*"}, Node{Filename: "hot/dir/file"}, false},
+		{warmFilter{glob: "hot/*"}, Node{Filename: "cold/file"}, false},
+		{warmFilter{maxBytes: 100}, Node{Filename: "small", Filesize: 100}, true},
+		{warmFilter{maxBytes: 100}, Node{Filename: "big", Filesize: 101}, false},
+		{warmFilter{since: now.Add(-time.Hour)}, Node{Filename: "new", ModifiedTime: now}, true},
+		{warmFilter{since: now.Add(-time.Hour)}, Node{Filename: "old", ModifiedTime: now.Add(-2 * time.Hour)}, false},
+	}
+	for _, tc := range testCases {
+		if got := tc.wf.match(tc.n); got != tc.want {
+			t.Errorf("%+v.match(%+v), want: %v, got: %v", tc.wf, tc.n, tc.want, got)
+		}
+	}
+	if err := validWarmPath("["); err == nil {
+		t.Error("validWarmPath accepted a malformed glob")
+	}
+}
+
+// TestWarmOnMount mounts a cache client, whose first child is a local client
+// on disk, and whose second child holds the repository.  The chunks of the
+// selected files should be copied to the first child, and no others.
+func TestWarmOnMount(t *testing.T) {
+	defer func(on, fetch bool, glob string, maxBytes int64) {
+		*warmOnMount, *warmFetch, *warmPath, *warmMaxFileBytes = on, fetch, glob, maxBytes
+	}(*warmOnMount, *warmFetch, *warmPath, *warmMaxFileBytes)
+	*warmOnMount, *warmFetch, *warmPath, *warmMaxFileBytes = true, true, "hot/*", 1000
+
+	dir := t.TempDir()
+	localConfig := func(name string, write bool) drive.Config {
+		return drive.Config{
+			Provider:      "local",
+			FileParentID:  filepath.Join(dir, name+"-files"),
+			ChunkParentID: filepath.Join(dir, name+"-chunks"),
+			Write:         write,
+		}
+	}
+	remote, err := local.NewClient(localConfig("remote", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := make(map[string][][]byte)
+	for _, tf := range []struct {
+		filename string
+		size     int64
+	}{
+		{"hot/a", 500},
+		{"hot/big", 5000},
+		{"cold/b", 500},
+	} {
+		f := shade.NewFile(tf.filename)
+		for i := 0; i < 2; i++ {
+			sum, chunk := drive.RandChunk()
+			if err := remote.PutChunk(sum, chunk, f); err != nil {
+				t.Fatal(err)
+			}
+			f.Chunks = append(f.Chunks, shade.Chunk{Index: i, Sha256: sum})
+			chunks[tf.filename] = append(chunks[tf.filename], sum)
+		}
+		f.Filesize = tf.size
+		jm, err := json.Marshal(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.PutFile(shade.Sum(jm), jm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, err := drive.NewClient(drive.Config{
+		Provider: "cache",
+		Children: []drive.Config{localConfig("cache", true), localConfig("remote", false)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer drive.Close(client)
+	if _, err := New(client, nil, nil); err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+
+	// cached returns the number of chunks of filename in the cache child.
+	cached := func(filename string) int {
+		if err := drive.Flush(client); err != nil {
+			t.Fatal(err)
+		}
+		lc, err := local.NewClient(localConfig("cache", false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for _, sum := range chunks[filename] {
+			if _, err := lc.GetChunk(sum, nil); err == nil {
+				n++
+			}
+		}
+		return n
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for cached("hot/a") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the chunks of hot/a were not cached, %d of 2 are", cached("hot/a"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, filename := range []string{"hot/big", "cold/b"} {
+		if n := cached(filename); n != 0 {
+			t.Errorf("%d chunk(s) of %s were cached, which is not selected", n, filename)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Package logging is the leveled logger used by the shade packages and tools.
+//
+// Messages are logged at a severity, and informational messages may also be
+// verbose, at a level which is logged only if the level chosen by the user is
+// at least as high.  They are recorded by a Logger, which is glog unless
+// SetLogger installs another.  With glog, -v sets the level of the verbose
+// messages logged, and -log_dir, -logtostderr and -alsologtostderr choose
+// where they are written, for every package alike.
+//
+// The functions mirror those of glog, so a call site reads the same:
+//
+//	logging.Warningf("could not refresh %s: %s", name, err)
+//	logging.V(3).Infof("fetched %d files", n)
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Severity is the severity of a logged message.
+type Severity int
+
+// The severities of messages, in increasing order.  A message logged at
+// ExitSeverity is followed by the exit of the program.
+const (
+	InfoSeverity Severity = iota
+	WarningSeverity
+	ErrorSeverity
+	ExitSeverity
+)
+
+// letter returns the single character which identifies s in a log line, as
+// it does in glog's.
+func (s Severity) letter() byte {
+	return "IWEF"[s]
+}
+
+// Logger records the messages logged by the functions of this package.
+type Logger interface {
+	// Log records msg at severity s.  depth is the number of stack frames
+	// between Log and the caller which logged msg, for a Logger which
+	// records the file and line it was logged from.
+	Log(s Severity, depth int, msg string)
+	// V reports whether verbose messages at level are recorded.
+	V(level int) bool
+	// Flush writes any buffered messages.
+	Flush()
+}
+
+var (
+	mu     sync.RWMutex // protects logger
+	logger Logger       = glogLogger{}
+)
+
+// SetLogger replaces the Logger which records messages, and returns the
+// previous one.
+func SetLogger(l Logger) Logger {
+	mu.Lock()
+	defer mu.Unlock()
+	prev := logger
+	logger = l
+	return prev
+}
+
+func current() Logger {
+	mu.RLock()
+	defer mu.RUnlock()
+	return logger
+}
+
+// Info logs its arguments, formatted as by fmt.Sprint, at InfoSeverity.
+func Info(args ...interface{}) {
+	current().Log(InfoSeverity, 1, fmt.Sprint(args...))
+}
+
+// Infof logs its arguments, formatted as by fmt.Sprintf, at InfoSeverity.
+func Infof(format string, args ...interface{}) {
+	current().Log(InfoSeverity, 1, fmt.Sprintf(format, args...))
+}
+
+// Warning logs its arguments, formatted as by fmt.Sprint, at WarningSeverity.
+func Warning(args ...interface{}) {
+	current().Log(WarningSeverity, 1, fmt.Sprint(args...))
+}
+
+// Warningf logs its arguments, formatted as by fmt.Sprintf, at
+// WarningSeverity.
+func Warningf(format string, args ...interface{}) {
+	current().Log(WarningSeverity, 1, fmt.Sprintf(format, args...))
+}
+
+// Error logs its arguments, formatted as by fmt.Sprint, at ErrorSeverity.
+func Error(args ...interface{}) {
+	current().Log(ErrorSeverity, 1, fmt.Sprint(args...))
+}
+
+// Errorf logs its arguments, formatted as by fmt.Sprintf, at ErrorSeverity.
+func Errorf(format string, args ...interface{}) {
+	current().Log(ErrorSeverity, 1, fmt.Sprintf(format, args...))
+}
+
+// Exit logs its arguments, formatted as by fmt.Sprint, at ExitSeverity,
+// flushes the log, and exits with status 1.
+func Exit(args ...interface{}) {
+	l := current()
+	l.Log(ExitSeverity, 1, fmt.Sprint(args...))
+	l.Flush()
+	os.Exit(1)
+}
+
+// Exitf logs its arguments, formatted as by fmt.Sprintf, at ExitSeverity,
+// flushes the log, and exits with status 1.
+func Exitf(format string, args ...interface{}) {
+	l := current()
+	l.Log(ExitSeverity, 1, fmt.Sprintf(format, args...))
+	l.Flush()
+	os.Exit(1)
+}
+
+// Flush writes any buffered messages.  It should be called before the
+// program exits.
+func Flush() {
+	current().Flush()
+}
+
+// Verbose is returned by V.  Its methods log only if it is true.
+type Verbose bool
+
+// V reports whether verbose messages at level are logged.  It may be used as
+// a boolean, to guard expensive logging, or to log:
+//
+//	logging.V(2).Infof("stored chunk %x", sum)
+func V(level int) Verbose {
+	return Verbose(current().V(level))
+}
+
+// Info is equivalent to Info, if v is true.
+func (v Verbose) Info(args ...interface{}) {
+	if v {
+		current().Log(InfoSeverity, 1, fmt.Sprint(args...))
+	}
+}
+
+// Infof is equivalent to Infof, if v is true.
+func (v Verbose) Infof(format string, args ...interface{}) {
+	if v {
+		current().Log(InfoSeverity, 1, fmt.Sprintf(format, args...))
+	}
+}
+
+// glogLogger records messages with glog.
+type glogLogger struct{}
+
+func (glogLogger) Log(s Severity, depth int, msg string) {
+	// glog counts its own caller, this method, as depth 0.
+	depth++
+	switch s {
+	case InfoSeverity:
+		glog.InfoDepth(depth, msg)
+	case WarningSeverity:
+		glog.WarningDepth(depth, msg)
+	case ErrorSeverity:
+		glog.ErrorDepth(depth, msg)
+	default:
+		glog.ExitDepth(depth, msg)
+	}
+}
+
+// V reports whether -v is at least level.  Unlike glog.V, it does not honor
+// -vmodule, which would match the file of this package rather than that of
+// the caller.
+func (glogLogger) V(level int) bool {
+	return bool(glog.V(glog.Level(level)))
+}
+
+func (glogLogger) Flush() {
+	glog.Flush()
+}
+
+// writerLogger records messages as lines written to an io.Writer.
+type writerLogger struct {
+	mu    sync.Mutex // serializes writes to w
+	w     io.Writer
+	level int
+}
+
+// NewWriterLogger returns a Logger which writes each message to w, as a line
+// prefixed by the letter of its severity and the time, and records verbose
+// messages up to level.  It may be used with SetLogger to send the log to a
+// file, or to a syslog.Writer.
+func NewWriterLogger(w io.Writer, level int) Logger {
+	return &writerLogger{w: w, level: level}
+}
+
+func (l *writerLogger) Log(s Severity, depth int, msg string) {
+	line := fmt.Sprintf("%c%s %s", s.letter(), time.Now().Format("0102 15:04:05.000000"), msg)
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, line)
+}
+
+func (l *writerLogger) V(level int) bool {
+	return level <= l.level
+}
+
+func (l *writerLogger) Flush() {
+	if s, ok := l.w.(interface{ Sync() error }); ok {
+		s.Sync()
+	}
+}
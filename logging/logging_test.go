@@ -0,0 +1,50 @@
+package logging
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+// TestCaptureAtLevel installs a Logger at level 2, and checks that exactly
+// the messages at or below that level are captured, with their severity.
+func TestCaptureAtLevel(t *testing.T) {
+	var buf bytes.Buffer
+	defer SetLogger(SetLogger(NewWriterLogger(&buf, 2)))
+
+	Infof("info %d", 0)
+	V(1).Info("verbose 1")
+	V(2).Infof("verbose %d", 2)
+	V(3).Info("verbose 3")
+	if V(3) {
+		t.Error("V(3) is true at level 2")
+	}
+	Warning("warning")
+	Errorf("error\n")
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		// Drop the timestamp between the severity and the message.
+		f := strings.SplitN(line, " ", 3)
+		if len(f) != 3 {
+			t.Fatalf("malformed log line: %q", line)
+		}
+		got = append(got, line[:1]+" "+f[2])
+	}
+	want := []string{"I info 0", "I verbose 1", "I verbose 2", "W warning", "E error"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("captured log:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestGlogLevel checks that the default Logger honors -v.
+func TestGlogLevel(t *testing.T) {
+	defer flag.Set("v", flag.Lookup("v").Value.String())
+	if err := flag.Set("v", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if !V(3) || V(4) {
+		t.Errorf("with -v=3, V(3) = %v and V(4) = %v, want true and false", V(3), V(4))
+	}
+}
@@ -0,0 +1,230 @@
+// Package metrics exports the counters and gauges published via expvar by the
+// drive providers and fusefs as Prometheus metrics.
+//
+// The expvars remain the source of truth, and continue to be served at
+// /debug/vars.  They are read each time the Prometheus handler is scraped, and
+// translated into typed metric families, labeled by provider.  Expvars which
+// are not published, because the package which owns them is not linked into
+// the binary, are omitted.
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/asjoyner/shade/drive"
+)
+
+// family describes a Prometheus metric family, built from one or more
+// expvars.
+type family struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	// vars maps the name of each expvar to the values of the family's labels.
+	vars map[string][]string
+}
+
+var families = []family{
+	{
+		desc: prometheus.NewDesc("shade_drive_requests_total",
+			"Requests made by a drive provider, by method.",
+			[]string{"provider", "method"}, nil),
+		valueType: prometheus.CounterValue,
+		vars: map[string][]string{
+			"googleListFilesReq": {"google", "ListFiles"},
+			"googleGetFileReq":   {"google", "GetFile"},
+			"googlePutFileReq":   {"google", "PutFile"},
+			"googleGetChunkReq":  {"google", "GetChunk"},
+			"googlePutChunkReq":  {"google", "PutChunk"},
+			"amazonListFilesReq": {"amazon", "ListFiles"},
+			"amazonGetFileReq":   {"amazon", "GetFile"},
+			"amazonPutFileReq":   {"amazon", "PutFile"},
+			"amazonGetChunkReq":  {"amazon", "GetChunk"},
+			"amazonPutChunkReq":  {"amazon", "PutChunk"},
+		},
+	},
+	{
+		desc: prometheus.NewDesc("shade_drive_chunk_downloads_total",
+			"Chunks successfully downloaded by a drive provider.",
+			[]string{"provider"}, nil),
+		valueType: prometheus.CounterValue,
+		vars: map[string][]string{
+			"googleGetChunkSuccess": {"google"},
+		},
+	},
+	{
+		desc: prometheus.NewDesc("shade_drive_errors_total",
+			"Errors encountered by a drive provider, by kind.",
+			[]string{"provider", "kind"}, nil),
+		valueType: prometheus.CounterValue,
+		vars: map[string][]string{
+			"googleDuplicateFileError":    {"google", "duplicate_file"},
+			"googleListError":             {"google", "list"},
+			"googleGetChunkDownloadError": {"google", "download"},
+			"googleGetChunkMismatch":      {"google", "chunk_mismatch"},
+		},
+	},
+	{
+		desc: prometheus.NewDesc("shade_drive_files",
+			"File objects stored by a drive provider.",
+			[]string{"provider"}, nil),
+		valueType: prometheus.GaugeValue,
+		vars: map[string][]string{
+			"memoryFiles": {"memory"},
+			"localFiles":  {"local"},
+		},
+	},
+	{
+		desc: prometheus.NewDesc("shade_drive_chunks",
+			"Chunks stored by a drive provider.",
+			[]string{"provider"}, nil),
+		valueType: prometheus.GaugeValue,
+		vars: map[string][]string{
+			"memoryChunks": {"memory"},
+			"localChunks":  {"local"},
+		},
+	},
+	{
+		desc: prometheus.NewDesc("shade_drive_chunk_bytes",
+			"Bytes of chunks stored by a drive provider.",
+			[]string{"provider"}, nil),
+		valueType: prometheus.GaugeValue,
+		vars: map[string][]string{
+			"memoryChunkBytes": {"memory"},
+			"localChunkBytes":  {"local"},
+		},
+	},
+	{
+		desc: prometheus.NewDesc("shade_missing_chunks_total",
+			"Chunks of a file which could not be read from any provider.",
+			nil, nil),
+		valueType: prometheus.CounterValue,
+		vars:      map[string][]string{"missingChunks": nil},
+	},
+	{
+		desc: prometheus.NewDesc("shade_writeback_queue_depth",
+			"Writes queued for the slow children of a writeback client.",
+			nil, nil),
+		valueType: prometheus.GaugeValue,
+		vars:      map[string][]string{"writebackQueueDepth": nil},
+	},
+	{
+		desc: prometheus.NewDesc("shade_writeback_writes_total",
+			"Background writes to the slow children of a writeback client, by result.",
+			[]string{"result"}, nil),
+		valueType: prometheus.CounterValue,
+		vars: map[string][]string{
+			"writebackCompleteWrites": {"complete"},
+			"writebackFailedWrites":   {"failed"},
+		},
+	},
+	{
+		desc: prometheus.NewDesc("shade_tree_nodes",
+			"Nodes in the fusefs tree, including synthetic directories.",
+			nil, nil),
+		valueType: prometheus.GaugeValue,
+		vars:      map[string][]string{"treeNodes": nil},
+	},
+	{
+		desc: prometheus.NewDesc("shade_tree_known_nodes",
+			"File objects found by the last refresh of the fusefs tree.",
+			nil, nil),
+		valueType: prometheus.GaugeValue,
+		vars:      map[string][]string{"knownNodes": nil},
+	},
+	{
+		desc: prometheus.NewDesc("shade_tree_last_refresh_duration",
+			"The duration of the last refresh of the fusefs tree, as reported by the lastRefreshDurationMs expvar.",
+			nil, nil),
+		valueType: prometheus.GaugeValue,
+		vars:      map[string][]string{"lastRefreshDurationMs": nil},
+	},
+	{
+		desc: prometheus.NewDesc("shade_fuse_chunk_cache_requests_total",
+			"Reads of the fusefs cache of recently read chunks, by result.",
+			[]string{"result"}, nil),
+		valueType: prometheus.CounterValue,
+		vars: map[string][]string{
+			"chunkCacheHits":   {"hit"},
+			"chunkCacheMisses": {"miss"},
+		},
+	},
+	{
+		desc: prometheus.NewDesc("shade_fuse_open_inodes",
+			"Inodes currently allocated by fusefs.",
+			nil, nil),
+		valueType: prometheus.GaugeValue,
+		vars:      map[string][]string{"numOpenInodes": nil},
+	},
+}
+
+// latencyDesc describes the histograms of the driveLatency expvar.
+var latencyDesc = prometheus.NewDesc("shade_drive_latency_seconds",
+	"The duration of the calls to a drive provider, by method, as reported by the driveLatency expvar.",
+	[]string{"provider", "method"}, nil)
+
+// collector implements prometheus.Collector by reading expvars.
+type collector struct{}
+
+// Describe sends the descriptors of every family to ch.
+func (collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, f := range families {
+		ch <- f.desc
+	}
+	ch <- latencyDesc
+}
+
+// Collect sends the current value of each published expvar to ch.
+func (collector) Collect(ch chan<- prometheus.Metric) {
+	for _, f := range families {
+		for name, labels := range f.vars {
+			v, ok := expvar.Get(name).(*expvar.Int)
+			if !ok {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(f.desc, f.valueType, float64(v.Value()), labels...)
+		}
+	}
+	collectLatency(ch)
+}
+
+// collectLatency sends each histogram in the driveLatency expvar to ch.
+func collectLatency(ch chan<- prometheus.Metric) {
+	m, ok := expvar.Get("driveLatency").(*expvar.Map)
+	if !ok {
+		return
+	}
+	m.Do(func(kv expvar.KeyValue) {
+		h, ok := kv.Value.(*drive.Histogram)
+		if !ok {
+			return
+		}
+		labels := strings.SplitN(kv.Key, ".", 2)
+		if len(labels) != 2 {
+			return
+		}
+		counts, count, sum := h.Snapshot()
+		buckets := make(map[float64]uint64, len(counts))
+		for i, b := range drive.LatencyBuckets {
+			buckets[b.Seconds()] = counts[i]
+		}
+		ch <- prometheus.MustNewConstHistogram(latencyDesc, count, sum.Seconds(), buckets, labels...)
+	})
+}
+
+// NewRegistry returns a Prometheus registry containing the shade metrics.
+func NewRegistry() *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(collector{})
+	return r
+}
+
+// Handler returns an http.Handler which serves the shade metrics in the
+// Prometheus exposition format.  It is typically registered at /metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(NewRegistry(), promhttp.HandlerOpts{})
+}
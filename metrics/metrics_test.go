@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/drive/memory"
+	"github.com/asjoyner/shade/fusefs"
+)
+
+func TestHandler(t *testing.T) {
+	client, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fj, err := shade.NewFile("metrics").ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PutFile(shade.Sum(fj), fj); err != nil {
+		t.Fatal(err)
+	}
+	sum, chunk := drive.RandChunk()
+	if err := client.PutChunk(sum, chunk, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fusefs.NewTree(client, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(Handler())
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`# TYPE shade_drive_files gauge`,
+		`shade_drive_files{provider="memory"} 1`,
+		`shade_drive_chunks{provider="memory"} 1`,
+		`# TYPE shade_drive_chunk_bytes gauge`,
+		`# TYPE shade_tree_nodes gauge`,
+		`shade_tree_known_nodes 1`,
+		`# TYPE shade_tree_last_refresh_duration gauge`,
+		`# TYPE shade_fuse_open_inodes gauge`,
+		`# TYPE shade_fuse_chunk_cache_requests_total counter`,
+		`# TYPE shade_drive_latency_seconds histogram`,
+		`shade_drive_latency_seconds_count{method="PutChunk",provider="memory"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("scrape does not contain %q", want)
+		}
+	}
+	// The google provider is not linked into this test.
+	if strings.Contains(string(body), `provider="google"`) {
+		t.Error("scrape contains metrics from an unlinked provider")
+	}
+}
@@ -0,0 +1,81 @@
+package shade
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+)
+
+// The names of the ciphers which may protect the Chunks of new Files.
+const (
+	// AESGCM encrypts each Chunk with a new AesKey per File (see File).
+	AESGCM = "aes-256-gcm"
+	// NoCipher stores the Chunks of new Files unencrypted.  The provider may
+	// still encrypt them, as the "encrypt" provider does.
+	NoCipher = "none"
+)
+
+var (
+	cipherName = flag.String("cipher", AESGCM, fmt.Sprintf("The cipher of new files: %q or %q", AESGCM, NoCipher))
+
+	paramsMu  sync.RWMutex // protects params and paramsSet
+	params    Params
+	paramsSet bool
+)
+
+// Params are the defaults of new Files.  A repository records them, so that
+// every tool which writes to it creates Files alike; see umbrella.UseParams.
+type Params struct {
+	Chunksize    int
+	SumAlgorithm string
+	Cipher       string
+}
+
+// Validate returns an error if p names an unknown algorithm or cipher, or has
+// an invalid Chunksize.
+func (p Params) Validate() error {
+	if p.Chunksize <= 0 {
+		return fmt.Errorf("invalid chunksize: %d", p.Chunksize)
+	}
+	if _, err := SumWith(p.SumAlgorithm, nil); err != nil {
+		return err
+	}
+	if p.Cipher != AESGCM && p.Cipher != NoCipher {
+		return fmt.Errorf("unknown cipher %q, want one of: %q, %q", p.Cipher, AESGCM, NoCipher)
+	}
+	return nil
+}
+
+// DefaultParams returns the Params of new Files.  Until SetParams is called,
+// they are chosen by --chunksize and --cipher.  The SumAlgorithm is always the
+// one used by Sum.
+func DefaultParams() Params {
+	paramsMu.RLock()
+	defer paramsMu.RUnlock()
+	if paramsSet {
+		p := params
+		p.SumAlgorithm = SumAlgorithm()
+		return p
+	}
+	return Params{
+		Chunksize:    *chunksize,
+		SumAlgorithm: SumAlgorithm(),
+		Cipher:       *cipherName,
+	}
+}
+
+// SetParams sets the Params of new Files, overriding the flags, and selects
+// p.SumAlgorithm as the one used by Sum.
+func SetParams(p Params) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if err := SetSumAlgorithm(p.SumAlgorithm); err != nil {
+		return err
+	}
+	paramsMu.Lock()
+	defer paramsMu.Unlock()
+	params = p
+	paramsSet = true
+	return nil
+}
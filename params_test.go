@@ -0,0 +1,38 @@
+package shade
+
+import "testing"
+
+func TestSetParams(t *testing.T) {
+	defer func(p Params, set bool) {
+		params, paramsSet = p, set
+		SetSumAlgorithm(SHA256)
+	}(params, paramsSet)
+
+	if p := DefaultParams(); p.Chunksize != *chunksize || p.Cipher != *cipherName || p.SumAlgorithm != SHA256 {
+		t.Errorf("DefaultParams() before SetParams(), want the flag defaults, got: %+v", p)
+	}
+	want := Params{Chunksize: 4096, SumAlgorithm: SHA512_256, Cipher: NoCipher}
+	if err := SetParams(want); err != nil {
+		t.Fatal(err)
+	}
+	if p := DefaultParams(); p != want {
+		t.Errorf("DefaultParams() after SetParams(), want: %+v, got: %+v", want, p)
+	}
+	f := NewFile("new")
+	if f.Chunksize != 4096 || f.SumAlgorithm != SHA512_256 || f.AesKey != nil {
+		t.Errorf("NewFile() did not inherit the params, got: %s", f)
+	}
+
+	for _, p := range []Params{
+		{Chunksize: 0, Cipher: AESGCM},
+		{Chunksize: 1, SumAlgorithm: "md5", Cipher: AESGCM},
+		{Chunksize: 1, Cipher: "rot13"},
+	} {
+		if err := SetParams(p); err == nil {
+			t.Errorf("SetParams(%+v) accepted invalid params", p)
+		}
+	}
+	if p := DefaultParams(); p != want {
+		t.Errorf("a failed SetParams() changed the params to %+v", p)
+	}
+}
@@ -0,0 +1,246 @@
+// Package repolock provides an advisory lock which keeps umbrella.Cleanup from
+// releasing chunks while files which reference them are being written.
+//
+// Cleanup computes the chunks referenced by the files in the repository, and
+// then releases the rest.  A writer which stores (or finds already stored) a
+// chunk after Cleanup computed that set, and then stores a file referencing
+// it, loses the chunk.  To prevent that, Cleanup holds the Exclusive lock while
+// it runs, and each writer holds a Shared lock from before it stores its first
+// chunk until it has stored the file.
+//
+// The lock is a directory of files on local disk, named by the LockDir of the
+// top level config, so it only coordinates the processes on one machine which
+// share a config.  A lock file which has not been refreshed by its holder for
+// --repoLockTTL is stale, and ignored, so a crashed holder cannot block the
+// others for longer than that.  An empty LockDir disables locking.
+package repolock
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/asjoyner/shade/logging"
+)
+
+var (
+	lockTTL  = flag.Duration("repoLockTTL", 10*time.Minute, "How long a repository lock is honored after its holder last refreshed it.")
+	lockWait = flag.Duration("repoLockWait", 5*time.Minute, "How long to wait for a conflicting repository lock to be released.")
+)
+
+// pollInterval is how often a conflicting lock is checked while waiting.
+var pollInterval = 100 * time.Millisecond
+
+const (
+	exclusiveName = "exclusive"
+	sharedPrefix  = "shared-"
+)
+
+// ErrLocked is returned when a conflicting lock was not released in time.
+var ErrLocked = errors.New("the repository is locked")
+
+// Dir is a directory of lock files.
+type Dir struct {
+	Path string
+	// TTL is how long a lock file is honored after it was last refreshed.
+	TTL time.Duration
+	// Wait is how long to wait for a conflicting lock to be released.
+	Wait time.Duration
+}
+
+// New returns the Dir at path, with the TTL and Wait set by flags.
+func New(path string) *Dir {
+	return &Dir{Path: path, TTL: *lockTTL, Wait: *lockWait}
+}
+
+// Lock is a held lock.  The lock file is refreshed until Unlock is called.
+type Lock struct {
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Exclusive acquires the exclusive lock, which is held by Cleanup.  It waits
+// for any other exclusive lock to be released, and then for the holders of
+// shared locks to finish.  It returns ErrLocked if they do not within Wait.
+func (d *Dir) Exclusive() (*Lock, error) {
+	if d.Path == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(d.Path, 0700); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(d.Wait)
+	name := filepath.Join(d.Path, exclusiveName)
+	for {
+		fh, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			l, err := d.hold(fh)
+			if err != nil {
+				return nil, err
+			}
+			// Writers which started before the lock was taken must finish.
+			if err := d.waitFor(sharedPrefix, deadline); err != nil {
+				l.Unlock()
+				return nil, err
+			}
+			return l, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("could not create lock: %s", err)
+		}
+		if d.stale(name) {
+			logging.Warningf("removing stale repository lock %s", name)
+			os.Remove(name)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: %s is held", ErrLocked, name)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Shared acquires a shared lock, which is held by each writer.  Any number of
+// shared locks may be held at once, but not while the exclusive lock is.  It
+// returns ErrLocked if the exclusive lock is not released within Wait.
+func (d *Dir) Shared() (*Lock, error) {
+	return d.shared(time.Now().Add(d.Wait))
+}
+
+// TryShared acquires a shared lock, like Shared, but returns ErrLocked at once
+// rather than waiting if the exclusive lock is held.  It is for callers which
+// must not block, and can retry the write later.
+func (d *Dir) TryShared() (*Lock, error) {
+	return d.shared(time.Now())
+}
+
+// shared acquires a shared lock, or returns ErrLocked if the exclusive lock is
+// still held at the deadline.
+func (d *Dir) shared(deadline time.Time) (*Lock, error) {
+	if d.Path == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(d.Path, 0700); err != nil {
+		return nil, err
+	}
+	for {
+		if err := d.waitFor(exclusiveName, deadline); err != nil {
+			return nil, err
+		}
+		fh, err := os.CreateTemp(d.Path, sharedPrefix+"*")
+		if err != nil {
+			return nil, fmt.Errorf("could not create lock: %s", err)
+		}
+		l, err := d.hold(fh)
+		if err != nil {
+			return nil, err
+		}
+		// Cleanup may have taken the exclusive lock between the check and the
+		// creation of the shared lock; if so, let it go first.
+		if !d.held(exclusiveName) {
+			return l, nil
+		}
+		l.Unlock()
+	}
+}
+
+// hold records the holder in the newly created lock file fh, and starts
+// refreshing it.
+func (d *Dir) hold(fh *os.File) (*Lock, error) {
+	host, _ := os.Hostname()
+	_, err := fmt.Fprintf(fh, "%s %d\n", host, os.Getpid())
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return nil, fmt.Errorf("could not write lock: %s", err)
+	}
+	l := &Lock{path: fh.Name(), stop: make(chan struct{}), done: make(chan struct{})}
+	go l.refresh(d.TTL / 3)
+	return l, nil
+}
+
+// waitFor waits until no lock file whose name begins with prefix is held, or
+// returns ErrLocked if one still is at the deadline.
+func (d *Dir) waitFor(prefix string, deadline time.Time) error {
+	for d.held(prefix) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %s%s is held", ErrLocked, filepath.Join(d.Path, prefix), "*")
+		}
+		time.Sleep(pollInterval)
+	}
+	return nil
+}
+
+// held returns whether a lock file whose name begins with prefix is held.
+// Stale lock files are removed.
+func (d *Dir) held(prefix string) bool {
+	entries, err := os.ReadDir(d.Path)
+	if err != nil {
+		logging.Warningf("could not read repository locks: %s", err)
+		return false
+	}
+	var held bool
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		name := filepath.Join(d.Path, e.Name())
+		if d.stale(name) {
+			logging.Warningf("removing stale repository lock %s", name)
+			os.Remove(name)
+			continue
+		}
+		held = true
+	}
+	return held
+}
+
+// stale returns whether the lock file name was last refreshed more than TTL
+// ago.  A lock file which no longer exists is stale.
+func (d *Dir) stale(name string) bool {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return true
+	}
+	return time.Since(fi.ModTime()) > d.TTL
+}
+
+// refresh updates the modification time of the lock file every interval, so
+// it does not become stale while it is held.
+func (l *Lock) refresh(interval time.Duration) {
+	defer close(l.done)
+	if interval <= 0 {
+		<-l.stop
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-t.C:
+			if err := os.Chtimes(l.path, now, now); err != nil {
+				logging.Warningf("could not refresh repository lock: %s", err)
+			}
+		}
+	}
+}
+
+// Unlock releases the lock.  It is a no-op on a nil Lock, which is returned
+// when locking is disabled.
+func (l *Lock) Unlock() error {
+	if l == nil {
+		return nil
+	}
+	close(l.stop)
+	<-l.done
+	return os.Remove(l.path)
+}
@@ -0,0 +1,156 @@
+package repolock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newDir(t *testing.T) *Dir {
+	pollInterval = time.Millisecond
+	return &Dir{Path: t.TempDir(), TTL: time.Minute, Wait: time.Minute}
+}
+
+func TestExclusiveWaitsForShared(t *testing.T) {
+	d := newDir(t)
+	shared, err := d.Shared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan *Lock)
+	go func() {
+		l, err := d.Exclusive()
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- l
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Exclusive was acquired while a Shared lock was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A writer arriving while Exclusive waits must let it go first.  It
+	// uses its own Dir, as the pending Exclusive is still reading d.Wait.
+	short := &Dir{Path: d.Path, TTL: d.TTL, Wait: 20 * time.Millisecond}
+	if _, err := short.Shared(); !errors.Is(err, ErrLocked) {
+		t.Errorf("Shared while Exclusive is pending: want ErrLocked, got: %v", err)
+	}
+
+	if err := shared.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	exclusive := <-acquired
+	if _, err := short.Shared(); !errors.Is(err, ErrLocked) {
+		t.Errorf("Shared while Exclusive is held: want ErrLocked, got: %v", err)
+	}
+	if _, err := short.Exclusive(); !errors.Is(err, ErrLocked) {
+		t.Errorf("a second Exclusive: want ErrLocked, got: %v", err)
+	}
+	if err := exclusive.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := d.Shared()
+	if err != nil {
+		t.Fatalf("Shared after Exclusive was released: %s", err)
+	}
+	l.Unlock()
+}
+
+func TestSharedLocksDoNotConflict(t *testing.T) {
+	d := newDir(t)
+	d.Wait = 0
+	var locks []*Lock
+	for i := 0; i < 3; i++ {
+		l, err := d.Shared()
+		if err != nil {
+			t.Fatalf("Shared lock %d: %s", i, err)
+		}
+		locks = append(locks, l)
+	}
+	for _, l := range locks {
+		if err := l.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Exclusive(); err != nil {
+		t.Errorf("Exclusive after the Shared locks were released: %s", err)
+	}
+}
+
+func TestStaleLocksAreIgnored(t *testing.T) {
+	d := newDir(t)
+	d.Wait = 0
+	old := time.Now().Add(-2 * d.TTL)
+	for _, name := range []string{exclusiveName, sharedPrefix + "crashed"} {
+		fn := filepath.Join(d.Path, name)
+		if err := os.WriteFile(fn, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := d.Exclusive()
+	if err != nil {
+		t.Fatalf("Exclusive with stale locks: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.Path, sharedPrefix+"crashed")); !os.IsNotExist(err) {
+		t.Errorf("the stale shared lock was not removed: %v", err)
+	}
+	l.Unlock()
+}
+
+func TestLockIsRefreshed(t *testing.T) {
+	d := newDir(t)
+	d.TTL = 100 * time.Millisecond
+	d.Wait = 0
+	l, err := d.Exclusive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Unlock()
+	time.Sleep(3 * d.TTL)
+	if _, err := d.Shared(); !errors.Is(err, ErrLocked) {
+		t.Errorf("Shared while a refreshed Exclusive is held: want ErrLocked, got: %v", err)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	d := &Dir{}
+	l, err := d.Exclusive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Exclusive(); err != nil {
+		t.Errorf("a second Exclusive with locking disabled: %s", err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTrySharedDoesNotWait(t *testing.T) {
+	d := newDir(t)
+	l, err := d.TryShared()
+	if err != nil {
+		t.Fatalf("TryShared with no lock held: %s", err)
+	}
+	l.Unlock()
+
+	exclusive, err := d.Exclusive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := d.TryShared(); !errors.Is(err, ErrLocked) {
+		t.Errorf("TryShared while Exclusive is held: want ErrLocked, got: %v", err)
+	}
+	if waited := time.Since(start); waited > d.Wait/2 {
+		t.Errorf("TryShared waited %s for the Exclusive lock", waited)
+	}
+	exclusive.Unlock()
+}
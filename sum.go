@@ -2,13 +2,100 @@ package shade
 
 import (
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
 )
 
+// The names of the built in sum algorithms.  SHA256 is the default.
+// SHA512_256 is typically faster on 64-bit processors.
+const (
+	SHA256     = "sha256"
+	SHA512_256 = "sha512/256"
+)
+
+var (
+	algMu         sync.RWMutex // protects algorithms and sumAlgorithm
+	sumAlgorithm  = SHA256
+	sumAlgorithms = map[string]func([]byte) []byte{
+		SHA256: func(data []byte) []byte {
+			h := sha256.Sum256(data)
+			return h[:]
+		},
+		SHA512_256: func(data []byte) []byte {
+			h := sha512.Sum512_256(data)
+			return h[:]
+		},
+	}
+)
+
+// RegisterSumAlgorithm makes a hash function available by name, for use with
+// SetSumAlgorithm and SumWith.  It allows hashes which are not in the
+// standard library, such as BLAKE3, to be provided by other packages.
+func RegisterSumAlgorithm(name string, sum func([]byte) []byte) {
+	algMu.Lock()
+	defer algMu.Unlock()
+	sumAlgorithms[name] = sum
+}
+
+// SetSumAlgorithm sets the algorithm used by Sum, and recorded in new Files.
+// An empty name selects the default, SHA256.
+func SetSumAlgorithm(name string) error {
+	if name == "" {
+		name = SHA256
+	}
+	algMu.Lock()
+	defer algMu.Unlock()
+	if _, ok := sumAlgorithms[name]; !ok {
+		return fmt.Errorf("unknown sum algorithm %q, want one of: %v", name, sumAlgorithmNames())
+	}
+	sumAlgorithm = name
+	return nil
+}
+
+// SumAlgorithm returns the name of the algorithm used by Sum.
+func SumAlgorithm() string {
+	algMu.RLock()
+	defer algMu.RUnlock()
+	return sumAlgorithm
+}
+
+// sumAlgorithmNames returns the registered algorithms, sorted.
+// Nb: caller is responsible for holding algMu.
+func sumAlgorithmNames() []string {
+	var names []string
+	for n := range sumAlgorithms {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // Sum is the uniform hash calculation used for all operations on Shade data.
+// It uses the algorithm selected with SetSumAlgorithm, SHA-256 by default.
 func Sum(data []byte) []byte {
-	h := sha256.Sum256(data)
-	return h[:]
+	sum, err := SumWith(SumAlgorithm(), data)
+	if err != nil {
+		panic(err) // SetSumAlgorithm only accepts registered algorithms
+	}
+	return sum
+}
+
+// SumWith returns the sum of data using the named algorithm.  An empty name
+// selects SHA256, for compatibility with Files which predate the choice.
+func SumWith(name string, data []byte) ([]byte, error) {
+	if name == "" {
+		name = SHA256
+	}
+	algMu.RLock()
+	sum, ok := sumAlgorithms[name]
+	algMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sum algorithm %q", name)
+	}
+	return sum(data), nil
 }
 
 // SumString returns a string representation of a Shade Sum.
@@ -0,0 +1,55 @@
+package shade
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"testing"
+)
+
+func TestSumAlgorithms(t *testing.T) {
+	defer SetSumAlgorithm(SHA256)
+	data := []byte("shade")
+	sha256sum := sha256.Sum256(data)
+	sha512_256sum := sha512.Sum512_256(data)
+
+	if got := Sum(data); !bytes.Equal(got, sha256sum[:]) {
+		t.Errorf("default Sum: want SHA-256 %x, got: %x", sha256sum, got)
+	}
+	if err := SetSumAlgorithm(SHA512_256); err != nil {
+		t.Fatal(err)
+	}
+	if got := Sum(data); !bytes.Equal(got, sha512_256sum[:]) {
+		t.Errorf("Sum after SetSumAlgorithm(%s): want %x, got: %x", SHA512_256, sha512_256sum, got)
+	}
+	f := NewFile("new")
+	if f.SumAlgorithm != SHA512_256 {
+		t.Errorf("NewFile() recorded SumAlgorithm %q, want: %q", f.SumAlgorithm, SHA512_256)
+	}
+	// A File from before SumAlgorithm was recorded still uses SHA-256.
+	old := &File{}
+	if got, err := old.Sum(data); err != nil || !bytes.Equal(got, sha256sum[:]) {
+		t.Errorf("Sum of a File with no SumAlgorithm: want %x, got: %x (%v)", sha256sum, got, err)
+	}
+
+	if err := SetSumAlgorithm("md5"); err == nil {
+		t.Error("SetSumAlgorithm() accepted an unknown algorithm")
+	}
+	if SumAlgorithm() != SHA512_256 {
+		t.Errorf("a failed SetSumAlgorithm() changed the algorithm to %q", SumAlgorithm())
+	}
+	if _, err := (&File{SumAlgorithm: "md5"}).Sum(data); err == nil {
+		t.Error("Sum() succeeded for a File with an unknown algorithm")
+	}
+
+	RegisterSumAlgorithm("reverse", func(d []byte) []byte {
+		r := make([]byte, len(d))
+		for i, b := range d {
+			r[len(d)-1-i] = b
+		}
+		return r
+	})
+	if got, err := SumWith("reverse", data); err != nil || string(got) != "edahs" {
+		t.Errorf("SumWith() a registered algorithm: got %q (%v)", got, err)
+	}
+}
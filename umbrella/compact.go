@@ -0,0 +1,102 @@
+package umbrella
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+)
+
+// Compact releases all but the newest keep versions of each file, and then
+// the chunks which none of the remaining versions reference.
+//
+// Unlike Cleanup, which refuses to run if there are more than --maxFilesDelete
+// obsolete files, Compact releases up to --maxFilesDelete of them per run,
+// oldest first, so that running it repeatedly bounds the number of versions
+// kept of frequently edited files.  Unused chunks are released as by Cleanup,
+// subject to --maxChunksDelete.  Pinned versions are kept, and do not count
+// towards keep.  Like Cleanup, it holds the exclusive repository lock.
+func Compact(client drive.Client, keep int) error {
+	if keep < 1 {
+		return fmt.Errorf("must keep at least 1 version of each file, not %d", keep)
+	}
+	lock, err := lockRepository(client)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	inUse, obsolete, err := FetchFiles(client)
+	if err == nil {
+		inUse, obsolete, err = excludePinned(client, inUse, obsolete)
+	}
+	if err != nil {
+		logging.Warning(err)
+		return err
+	}
+	retained, expired := retainVersions(obsolete, keep-1)
+	if len(expired) > *maxFilesDelete {
+		logging.Infof("Releasing %d of %d expired versions; run again to release the rest", *maxFilesDelete, len(expired))
+		// The versions left for the next run still reference their chunks.
+		retained = append(retained, expired[*maxFilesDelete:]...)
+		expired = expired[:*maxFilesDelete]
+	}
+
+	var failed []FoundFile
+	for _, ff := range expired {
+		logging.Infof("Releasing expired version: %s (%s %x)", ff.file.Filename, ff.file.ModifiedTime, ff.sum)
+		if *dryRun {
+			fmt.Printf("Releasing expired version: %s (%s %x)\n", ff.file.Filename, ff.file.ModifiedTime, ff.sum)
+		} else if err := client.ReleaseFile(ff.sum); err != nil {
+			logging.Warningf("could not release expired version %s (%x): %s", ff.file.Filename, ff.sum, err)
+			failed = append(failed, ff)
+		}
+	}
+
+	// Expired versions which were not released still reference their chunks.
+	chunksInUse := make(map[string]struct{})
+	for _, ff := range append(append(inUse, retained...), failed...) {
+		sums, err := chunkSums(client.GetConfig(), ff.file)
+		if err != nil {
+			return err
+		}
+		for _, s := range sums {
+			chunksInUse[string(s)] = struct{}{}
+		}
+	}
+	failedChunks, err := cleanupUnusedFiles(client, chunksInUse)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 || failedChunks > 0 {
+		err := fmt.Errorf("could not release %d expired version(s) and %d unused chunk(s)", len(failed), failedChunks)
+		logging.Warning(err.Error())
+		return err
+	}
+	return nil
+}
+
+// retainVersions sorts the obsolete files into the newest n versions of each
+// Filename, which are retained, and the rest, which are expired.  The expired
+// versions are returned oldest first.
+func retainVersions(obsolete []FoundFile, n int) (retained, expired []FoundFile) {
+	sorted := make([]FoundFile, len(obsolete))
+	copy(sorted, obsolete)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].file.ModifiedTime.After(sorted[j].file.ModifiedTime)
+	})
+	kept := make(map[string]int)
+	for _, ff := range sorted {
+		if kept[ff.file.Filename] < n {
+			kept[ff.file.Filename]++
+			retained = append(retained, ff)
+			continue
+		}
+		expired = append(expired, ff)
+	}
+	// reverse expired, so the oldest versions are released first
+	for i, j := 0, len(expired)-1; i < j; i, j = i+1, j-1 {
+		expired[i], expired[j] = expired[j], expired[i]
+	}
+	return retained, expired
+}
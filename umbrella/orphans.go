@@ -0,0 +1,97 @@
+package umbrella
+
+import (
+	"time"
+
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+)
+
+// Orphan describes a chunk which is not referenced by any file in use, and
+// which Cleanup would release.
+type Orphan struct {
+	Sha256  []byte
+	Size    int64     // in bytes, as stored by the client
+	ModTime time.Time // the zero value, if the client does not track it
+}
+
+// FindOrphans returns the chunks known to client which are not referenced by
+// any file in use, or by a pinned version; the chunks Cleanup would release.
+// The size and modification time of each is reported by client.Stat.  Unlike
+// Cleanup, it does not lock the repository, so a chunk of a file which is
+// being written may be reported.
+func FindOrphans(client drive.Client) ([]Orphan, error) {
+	sums, err := findOrphanSums(client)
+	if err != nil {
+		return nil, err
+	}
+	orphans := make([]Orphan, 0, len(sums))
+	for _, sum := range sums {
+		o := Orphan{Sha256: sum}
+		if info, err := client.Stat(sum); err != nil {
+			logging.Warningf("could not stat unreferenced chunk %x: %s", sum, err)
+		} else {
+			o.Size = info.Size
+			o.ModTime = info.ModTime
+		}
+		orphans = append(orphans, o)
+	}
+	return orphans, nil
+}
+
+// ReleaseOrphans releases those of the chunks identified by sums, eg. by an
+// earlier call to FindOrphans, which are still not referenced by any file in
+// use.  The orphans are found again while the exclusive repository lock is
+// held, so a chunk which was referenced since sums were found is kept.  The
+// -maxChunksDelete safety limit does not apply, as the caller has chosen the
+// chunks to release.
+//
+// It returns the number of chunks released, and the number which could not
+// be.
+func ReleaseOrphans(client drive.Client, sums [][]byte) (released, failed int, err error) {
+	lock, err := lockRepository(client)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer lock.Unlock()
+
+	current, err := findOrphanSums(client)
+	if err != nil {
+		return 0, 0, err
+	}
+	orphaned := make(map[string]bool, len(current))
+	for _, sum := range current {
+		orphaned[string(sum)] = true
+	}
+	for _, sum := range sums {
+		if !orphaned[string(sum)] {
+			logging.Infof("Keeping chunk which is no longer unreferenced: %x", sum)
+			continue
+		}
+		logging.V(2).Infof("Releasing unreferenced chunk: %x", sum)
+		if err := client.ReleaseChunk(sum); err != nil {
+			logging.Warningf("could not release unreferenced chunk %x: %s", sum, err)
+			failed++
+			continue
+		}
+		released++
+	}
+	return released, failed, nil
+}
+
+// findOrphanSums returns the sums of the chunks known to client which are not
+// referenced by any file in use, or by a pinned version.
+func findOrphanSums(client drive.Client) ([][]byte, error) {
+	inUse, obsolete, err := FetchFiles(client)
+	if err != nil {
+		return nil, err
+	}
+	if inUse, _, err = excludePinned(client, inUse, obsolete); err != nil {
+		return nil, err
+	}
+	inUseChunks, err := chunksInUse(client, inUse, nil)
+	if err != nil {
+		return nil, err
+	}
+	return unusedChunks(client, inUseChunks)
+}
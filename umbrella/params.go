@@ -0,0 +1,87 @@
+package umbrella
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+)
+
+// ParamsFilename is the Filename of the shade.File which records the
+// repository's shade.Params, the defaults of new Files.  Its content is the
+// JSON encoded Params.
+//
+// The first tool which writes to a repository without it records its own
+// defaults, as chosen by its flags and config.  Every tool after that uses the
+// recorded defaults instead, so that they agree no matter how they were
+// invoked.
+const ParamsFilename = ".shade/params"
+
+// FindParams returns the sum of the newest version of ParamsFilename in inUse,
+// or nil if the repository has no params.
+func FindParams(inUse []FoundFile) []byte {
+	for _, ff := range inUse {
+		if ff.file.Filename == ParamsFilename && !ff.file.Deleted {
+			return ff.sum
+		}
+	}
+	return nil
+}
+
+// ReadParams returns the Params recorded by the file object with the given
+// sum.
+func ReadParams(client drive.Client, sha256sum []byte) (shade.Params, error) {
+	content, err := fetchContent(client, sha256sum)
+	if err != nil {
+		return shade.Params{}, err
+	}
+	var p shade.Params
+	if err := json.Unmarshal(content, &p); err != nil {
+		return shade.Params{}, fmt.Errorf("could not unmarshal params %x: %s", sha256sum, err)
+	}
+	if err := p.Validate(); err != nil {
+		return shade.Params{}, fmt.Errorf("invalid params %x: %s", sha256sum, err)
+	}
+	return p, nil
+}
+
+// UseParams makes the Params recorded by the file object with the given sum
+// the defaults of new Files, and returns them.  If sha256sum is nil, as
+// returned by FindParams for a repository without params, the current
+// defaults are recorded as the repository's params, if the client is
+// writable, and used from then on.
+func UseParams(client drive.Client, sha256sum []byte) (shade.Params, error) {
+	current := shade.DefaultParams()
+	if sha256sum == nil {
+		if client.GetConfig().Write {
+			content, err := json.Marshal(current)
+			if err != nil {
+				return shade.Params{}, err
+			}
+			if _, err := putContent(client, ParamsFilename, content); err != nil {
+				return shade.Params{}, fmt.Errorf("could not put params: %s", err)
+			}
+			logging.Infof("Recorded the repository's params: %+v", current)
+		}
+		return current, shade.SetParams(current)
+	}
+	p, err := ReadParams(client, sha256sum)
+	if err != nil {
+		return shade.Params{}, err
+	}
+	if p != current {
+		logging.Warningf("Using the repository's params %+v, rather than %+v", p, current)
+	}
+	return p, shade.SetParams(p)
+}
+
+// FetchParams finds the repository's params, and uses them as in UseParams.
+func FetchParams(client drive.Client) (shade.Params, error) {
+	inUse, _, err := FetchFiles(client)
+	if err != nil {
+		return shade.Params{}, err
+	}
+	return UseParams(client, FindParams(inUse))
+}
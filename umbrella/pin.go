@@ -0,0 +1,179 @@
+package umbrella
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+)
+
+// PinsFilename is the Filename of the shade.File which lists the pinned file
+// objects.  Its content is a JSON list of their hex encoded sums.
+//
+// Storing the pins as an ordinary file means they are encrypted and
+// replicated like any other, and that Cleanup keeps the chunks of the newest
+// version and releases the older ones.  Deleting the file unpins everything.
+const PinsFilename = ".shade/pins"
+
+// Pins returns the hex encoded sums of the pinned file objects, as listed by
+// the newest version of PinsFilename in inUse, and by each snapshot in inUse.
+func Pins(client drive.Client, inUse []FoundFile) (map[string]struct{}, error) {
+	pins := make(map[string]struct{})
+	for _, ff := range inUse {
+		if ff.file.Deleted {
+			continue
+		}
+		if isSnapshot(ff.file.Filename) {
+			s, err := ReadSnapshot(client, ff.sum)
+			if err != nil {
+				return nil, err
+			}
+			for _, sf := range s.Files {
+				pins[sf.Sum] = struct{}{}
+			}
+			continue
+		}
+		if ff.file.Filename != PinsFilename {
+			continue
+		}
+		// The file may be a cached entry from a State, without its chunks.
+		content, err := fetchContent(client, ff.sum)
+		if err != nil {
+			return nil, err
+		}
+		var sums []string
+		if err := json.Unmarshal(content, &sums); err != nil {
+			return nil, fmt.Errorf("could not unmarshal pins %x: %s", ff.sum, err)
+		}
+		for _, s := range sums {
+			pins[s] = struct{}{}
+		}
+	}
+	return pins, nil
+}
+
+// excludePinned moves the pinned versions in obsolete to inUse, so that
+// neither they nor their chunks are released.
+func excludePinned(client drive.Client, inUse, obsolete []FoundFile) ([]FoundFile, []FoundFile, error) {
+	pins, err := Pins(client, inUse)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(pins) == 0 {
+		return inUse, obsolete, nil
+	}
+	var unpinned []FoundFile
+	for _, ff := range obsolete {
+		if _, ok := pins[hex.EncodeToString(ff.sum)]; ok {
+			logging.V(2).Infof("Keeping pinned version: %s (%s %x)", ff.file.Filename, ff.file.ModifiedTime, ff.sum)
+			inUse = append(inUse, ff)
+			continue
+		}
+		unpinned = append(unpinned, ff)
+	}
+	return inUse, unpinned, nil
+}
+
+// Pin adds the file object with the given sum to the pins.
+func Pin(client drive.Client, sha256sum []byte) error {
+	if _, err := fetchFile(client, sha256sum); err != nil {
+		return err
+	}
+	return updatePins(client, func(pins map[string]struct{}) {
+		pins[hex.EncodeToString(sha256sum)] = struct{}{}
+	})
+}
+
+// Unpin removes the file object with the given sum from the pins.
+func Unpin(client drive.Client, sha256sum []byte) error {
+	return updatePins(client, func(pins map[string]struct{}) {
+		delete(pins, hex.EncodeToString(sha256sum))
+	})
+}
+
+// updatePins reads the pins, applies update to them, and writes them as a
+// new version of PinsFilename.
+func updatePins(client drive.Client, update func(map[string]struct{})) error {
+	inUse, _, err := FetchFiles(client)
+	if err != nil {
+		return err
+	}
+	// The versions pinned by snapshots are not recorded in PinsFilename, so
+	// that deleting a snapshot releases them.
+	var files []FoundFile
+	for _, ff := range inUse {
+		if !isSnapshot(ff.file.Filename) {
+			files = append(files, ff)
+		}
+	}
+	pins, err := Pins(client, files)
+	if err != nil {
+		return err
+	}
+	if _, err := UseParams(client, FindParams(inUse)); err != nil {
+		return err
+	}
+	update(pins)
+	sums := make([]string, 0, len(pins))
+	for s := range pins {
+		sums = append(sums, s)
+	}
+	sort.Strings(sums)
+	content, err := json.Marshal(sums)
+	if err != nil {
+		return err
+	}
+	if _, err := putContent(client, PinsFilename, content); err != nil {
+		return fmt.Errorf("could not put pins: %s", err)
+	}
+	return nil
+}
+
+// fetchContent retrieves the file object with the given sum, and returns the
+// concatenation of its chunks.
+func fetchContent(client drive.Client, sha256sum []byte) ([]byte, error) {
+	file, err := fetchFile(client, sha256sum)
+	if err != nil {
+		return nil, err
+	}
+	var content []byte
+	for _, c := range file.Chunks {
+		chunk, err := client.GetChunk(c.Sha256, file)
+		if err != nil {
+			return nil, drive.NewMissingChunkError(c.Sha256, file, err)
+		}
+		content = append(content, chunk...)
+	}
+	return content, nil
+}
+
+// putContent stores content as a single chunk, and a new version of filename
+// which describes it.  It returns the sum of the new file object.
+func putContent(client drive.Client, filename string, content []byte) ([]byte, error) {
+	file := shade.NewFile(filename)
+	chunk := shade.NewChunk()
+	var err error
+	if chunk.Sha256, err = file.Sum(content); err != nil {
+		return nil, err
+	}
+	file.Chunks = []shade.Chunk{chunk}
+	file.LastChunksize = len(content)
+	file.UpdateFilesize()
+	file.UpdateDigest()
+	if err := client.PutChunk(chunk.Sha256, content, file); err != nil {
+		return nil, err
+	}
+	fj, err := file.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	sum := shade.Sum(fj)
+	if err := client.PutFile(sum, fj); err != nil {
+		return nil, err
+	}
+	return sum, nil
+}
@@ -0,0 +1,150 @@
+package umbrella
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+)
+
+// State records what previous runs of Cleanup learned about the repository,
+// so that subsequent runs need only fetch the files which are new since then.
+//
+// Nb: Identifying obsolete files and unused chunks requires the full set of
+// files which are in use, so the incremental mode is an optimization layered
+// on top of this cached set, not a replacement for it.  The cache is only
+// correct if it was built against the same repository, and only this cleanup
+// released files from it.  If in doubt, delete the state file; the next run
+// will fetch every file and rebuild it.
+type State struct {
+	// Version is the stateVersion the State was written with.
+	Version int
+	// HighWater is the time of the last successful Cleanup.  Files with an
+	// older ModifiedTime which are not already in Files were uploaded late
+	// (eg. by a client with a skewed clock), and are logged when found.
+	HighWater time.Time
+	// Files is keyed by the hex encoded sum of the file object.
+	Files map[string]CachedFile
+}
+
+// stateVersion is the Version of the State written by this package.  A State
+// with another Version is discarded, and rebuilt, because the sums cached in
+// it may be computed differently.  Version 1 added the sums of chunks stored
+// by convergent "encrypt" clients.
+const stateVersion = 1
+
+// CachedFile is the subset of a shade.File needed by Cleanup.  It omits the
+// AesKey, so the state file does not contain key material.
+type CachedFile struct {
+	Filename     string
+	ModifiedTime time.Time
+	// Deleted records that the file object marks the deletion of Filename,
+	// so a cached deletion is not mistaken for a file with no content.
+	Deleted bool
+	// Chunks holds the plaintext and encrypted sums of the file's chunks.
+	Chunks [][]byte
+}
+
+// ReadState reads the State from the provided filename.  If it does not exist,
+// or was written with another stateVersion, an empty State is returned.
+func ReadState(filename string) (*State, error) {
+	st := &State{Version: stateVersion, Files: make(map[string]CachedFile)}
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read cleanup state: %s", err)
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, fmt.Errorf("could not unmarshal cleanup state %s: %s", filename, err)
+	}
+	if st.Version != stateVersion {
+		logging.Infof("discarding cleanup state %s of version %d; it will be rebuilt", filename, st.Version)
+		return &State{Version: stateVersion, Files: make(map[string]CachedFile)}, nil
+	}
+	if st.Files == nil {
+		st.Files = make(map[string]CachedFile)
+	}
+	return st, nil
+}
+
+// Write stores the State to the provided filename.
+func (st *State) Write(filename string) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("could not marshal cleanup state: %s", err)
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("could not write cleanup state: %s", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("could not write cleanup state: %s", err)
+	}
+	return nil
+}
+
+// FetchFilesSince is like FetchFiles, but only fetches the files which are
+// not already recorded in st.  Those it does fetch are added to st, and files
+// which are no longer listed by the client are removed from it.  Obsolete
+// versions are still correctly identified, because the Filename and
+// ModifiedTime of every cached file is compared against the new files.
+//
+// The inUse and obsolete FoundFiles for cached files carry only the
+// Filename, ModifiedTime and Deleted; their chunk sums are available in st.Files.
+func FetchFilesSince(client drive.Client, st *State) (inUse, obsolete []FoundFile, err error) {
+	files, err := client.ListFiles()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%q ListFiles(): %s", client.GetConfig().Provider, err)
+	}
+	logging.Infof("Found %d file(s) via %s", len(files), client.GetConfig().Provider)
+	listed := make(map[string][]byte, len(files))
+	for _, sha256sum := range files {
+		listed[hex.EncodeToString(sha256sum)] = sha256sum
+	}
+	for hs := range st.Files {
+		if _, ok := listed[hs]; !ok {
+			logging.V(4).Infof("cached file is no longer listed: %s", hs)
+			delete(st.Files, hs)
+		}
+	}
+
+	var fetched int
+	found := make([]FoundFile, 0, len(listed))
+	for hs, sha256sum := range listed {
+		if cf, ok := st.Files[hs]; ok {
+			file := &shade.File{Filename: cf.Filename, ModifiedTime: cf.ModifiedTime, Deleted: cf.Deleted}
+			found = append(found, FoundFile{file, sha256sum})
+			continue
+		}
+		file, err := fetchFile(client, sha256sum)
+		if err != nil {
+			return nil, nil, err
+		}
+		fetched++
+		if file.ModifiedTime.Before(st.HighWater) {
+			logging.Infof("file %s (%x) is older than the last cleanup: %s", file.Filename, sha256sum, file.ModifiedTime)
+		}
+		sums, err := chunkSums(client.GetConfig(), file)
+		if err != nil {
+			return nil, nil, err
+		}
+		st.Files[hs] = CachedFile{
+			Filename:     file.Filename,
+			ModifiedTime: file.ModifiedTime,
+			Deleted:      file.Deleted,
+			Chunks:       sums,
+		}
+		found = append(found, FoundFile{file, sha256sum})
+	}
+	logging.Infof("Fetched %d new file(s) since %s", fetched, st.HighWater)
+	inUse, obsolete = sortFiles(found)
+	return
+}
@@ -0,0 +1,119 @@
+package umbrella
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+)
+
+// SnapshotDir is the directory of the shade.Files which hold snapshots.  Each
+// snapshot is stored as a file of its own, named for the time it was taken,
+// whose content is a JSON encoded Snapshot.
+//
+// The versions listed by a snapshot are pinned for as long as the snapshot
+// exists; see Pins.  Deleting the snapshot releases them.
+const SnapshotDir = ".shade/snapshots/"
+
+// Snapshot lists the file objects which were in use at a point in time.
+type Snapshot struct {
+	Time  time.Time
+	Files []SnapshotFile
+}
+
+// SnapshotFile identifies a file object listed by a Snapshot.
+type SnapshotFile struct {
+	Sum      string // hex encoded
+	Filename string
+}
+
+// TakeSnapshot records the file objects currently in use as a new snapshot,
+// and returns the sum of the file object which holds it.  That sum is all
+// RestoreSnapshot requires, even if ListFiles does not return it.
+func TakeSnapshot(client drive.Client) ([]byte, error) {
+	inUse, _, err := FetchFiles(client)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := UseParams(client, FindParams(inUse)); err != nil {
+		return nil, err
+	}
+	s := Snapshot{Time: time.Now()}
+	for _, ff := range inUse {
+		s.Files = append(s.Files, SnapshotFile{
+			Sum:      hex.EncodeToString(ff.sum),
+			Filename: ff.file.Filename,
+		})
+	}
+	sort.Slice(s.Files, func(i, j int) bool {
+		return s.Files[i].Filename < s.Files[j].Filename
+	})
+	content, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	filename := SnapshotDir + s.Time.UTC().Format("20060102T150405.000000000Z")
+	sum, err := putContent(client, filename, content)
+	if err != nil {
+		return nil, fmt.Errorf("could not put snapshot: %s", err)
+	}
+	logging.Infof("Recorded a snapshot of %d file(s) as %s (%x)", len(s.Files), filename, sum)
+	return sum, nil
+}
+
+// ReadSnapshot retrieves the snapshot held by the file object with the given
+// sum.
+func ReadSnapshot(client drive.Client, sha256sum []byte) (Snapshot, error) {
+	content, err := fetchContent(client, sha256sum)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(content, &s); err != nil {
+		return Snapshot{}, fmt.Errorf("could not unmarshal snapshot %x: %s", sha256sum, err)
+	}
+	return s, nil
+}
+
+// RestoreSnapshot stores again each file object listed by the snapshot held
+// by the file object with the given sum, and that file object itself, so that
+// ListFiles returns them.  It returns the number of file objects stored.
+//
+// The file objects must still be retrievable by their sum; RestoreSnapshot
+// only repairs their visibility, eg. after the listing of a backend was lost.
+func RestoreSnapshot(client drive.Client, sha256sum []byte) (int, error) {
+	s, err := ReadSnapshot(client, sha256sum)
+	if err != nil {
+		return 0, err
+	}
+	sums := [][]byte{sha256sum}
+	for _, sf := range s.Files {
+		sum, err := hex.DecodeString(sf.Sum)
+		if err != nil {
+			return 0, fmt.Errorf("invalid sum %q for %s in snapshot %x: %s", sf.Sum, sf.Filename, sha256sum, err)
+		}
+		sums = append(sums, sum)
+	}
+	var restored int
+	for _, sum := range sums {
+		f, err := client.GetFile(sum)
+		if err != nil {
+			return restored, fmt.Errorf("failed to fetch file %x: %s", sum, err)
+		}
+		if err := client.PutFile(sum, f); err != nil {
+			return restored, fmt.Errorf("could not restore file %x: %s", sum, err)
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// isSnapshot returns whether filename is that of a snapshot.
+func isSnapshot(filename string) bool {
+	return strings.HasPrefix(filename, SnapshotDir)
+}
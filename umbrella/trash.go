@@ -0,0 +1,126 @@
+package umbrella
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/asjoyner/shade"
+	"github.com/asjoyner/shade/drive"
+	"github.com/asjoyner/shade/logging"
+)
+
+// TrashDir is the directory a file removed from a mount of the fuse
+// filesystem with -trash is moved to, at the same path below it.  The
+// ModifiedTime of the file in the trash is the time it was removed.
+//
+// Files in the trash are ordinary files, so cleanup keeps them, and their
+// chunks, until the trash is emptied; see EmptyTrash.
+const TrashDir = ".shade-trash/"
+
+// TrashPath returns the path in the trash of the file at filename.
+func TrashPath(filename string) string {
+	return TrashDir + strings.TrimPrefix(filename, "/")
+}
+
+// InTrash returns whether filename is the path of a file in the trash.
+func InTrash(filename string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(filename, "/"), TrashDir)
+}
+
+// Trash returns the files in inUse which are in the trash, sorted by
+// filename.
+func Trash(inUse []FoundFile) []FoundFile {
+	var trash []FoundFile
+	for _, ff := range inUse {
+		if InTrash(ff.file.Filename) && !ff.file.Deleted {
+			trash = append(trash, ff)
+		}
+	}
+	sort.Slice(trash, func(i, j int) bool {
+		return trash[i].file.Filename < trash[j].file.Filename
+	})
+	return trash
+}
+
+// RestoreTrash moves the file at filename, or at its path in the trash, out
+// of the trash, so that it is at filename again.
+func RestoreTrash(client drive.Client, filename string) error {
+	filename = strings.TrimPrefix(filename, "/")
+	if InTrash(filename) {
+		filename = strings.TrimPrefix(filename, TrashDir)
+	}
+	inUse, _, err := FetchFiles(client)
+	if err != nil {
+		return err
+	}
+	for _, ff := range Trash(inUse) {
+		if ff.file.Filename != TrashPath(filename) {
+			continue
+		}
+		f := *ff.file
+		f.Filename = filename
+		f.ModifiedTime = time.Now()
+		if err := storeFile(client, &f); err != nil {
+			return fmt.Errorf("could not restore %s: %s", filename, err)
+		}
+		if err := storeFile(client, deletedFile(ff.file.Filename)); err != nil {
+			return fmt.Errorf("could not remove %s from the trash: %s", filename, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("no such file in the trash: %s", filename)
+}
+
+// ExpiredTrash returns the files in the trash of inUse which were removed
+// more than retention ago.
+func ExpiredTrash(inUse []FoundFile, retention time.Duration) []FoundFile {
+	var expired []FoundFile
+	cutoff := time.Now().Add(-retention)
+	for _, ff := range Trash(inUse) {
+		if ff.file.ModifiedTime.Before(cutoff) {
+			expired = append(expired, ff)
+		}
+	}
+	return expired
+}
+
+// EmptyTrash deletes the files in the trash which were removed more than
+// retention ago, and returns them.  Their chunks are released by the next
+// cleanup.  If --dryrun is set, the files are printed, rather than deleted.
+func EmptyTrash(client drive.Client, retention time.Duration) ([]FoundFile, error) {
+	inUse, _, err := FetchFiles(client)
+	if err != nil {
+		return nil, err
+	}
+	expired := ExpiredTrash(inUse, retention)
+	for _, ff := range expired {
+		logging.Infof("Deleting from the trash: %s (%s %x)", ff.file.Filename, ff.file.ModifiedTime, ff.sum)
+		if *dryRun {
+			fmt.Printf("Deleting from the trash: %s (%s %x)\n", ff.file.Filename, ff.file.ModifiedTime, ff.sum)
+			continue
+		}
+		if err := storeFile(client, deletedFile(ff.file.Filename)); err != nil {
+			return nil, fmt.Errorf("could not delete %s: %s", ff.file.Filename, err)
+		}
+	}
+	return expired, nil
+}
+
+// deletedFile returns a Deleted shade.File at filename, which supersedes the
+// versions before it.
+func deletedFile(filename string) *shade.File {
+	f := shade.NewFile(filename)
+	f.Deleted = true
+	return f
+}
+
+// storeFile stores the file object describing f.
+func storeFile(client drive.Client, f *shade.File) error {
+	fj, err := f.ToJSON()
+	if err != nil {
+		return err
+	}
+	return client.PutFile(shade.Sum(fj), fj)
+}
@@ -3,6 +3,7 @@
 package umbrella
 
 import (
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"time"
@@ -10,7 +11,8 @@ import (
 	"github.com/asjoyner/shade"
 	"github.com/asjoyner/shade/drive"
 	"github.com/asjoyner/shade/drive/encrypt"
-	"github.com/golang/glog"
+	"github.com/asjoyner/shade/logging"
+	"github.com/asjoyner/shade/repolock"
 )
 
 var (
@@ -18,6 +20,7 @@ var (
 	maxChunksDelete = flag.Int("maxChunksDelete", 100, "A safety limit: the maxmium number of chunks to delete per run.")
 	deleteMostFiles = flag.Bool("deleteMostFiles", false, "A safety limit: more files must remain than are deleted.")
 	dryRun          = flag.Bool("dryrun", false, "Instead of deleting files, print what would have been deleted.")
+	since           = flag.String("since", "", "Path to a state file from previous cleanups; if set, only files not seen by a previous run are fetched.")
 )
 
 // FoundFile groups files with their associated sums
@@ -26,49 +29,75 @@ type FoundFile struct {
 	sum  []byte
 }
 
+// File returns the shade.File which was found.
+func (ff FoundFile) File() *shade.File { return ff.file }
+
+// Sum returns the sha256sum of the file object.
+func (ff FoundFile) Sum() []byte { return ff.sum }
+
 // FetchFiles uses the provided client to fetch all of the known files and
 // sorts them into those which are inUse and those which are obsolete.
 func FetchFiles(client drive.Client) (inUse, obsolete []FoundFile, err error) {
-	filesByPath := make(map[string]FoundFile)
-	obsolete = make([]FoundFile, 0)
 	// ListFiles to retrieve all file objects
 	files, err := client.ListFiles()
 	if err != nil {
 		return nil, nil, fmt.Errorf("%q ListFiles(): %s", client.GetConfig().Provider, err)
 	}
-	glog.Infof("Found %d file(s) via %s", len(files), client.GetConfig().Provider)
+	logging.Infof("Found %d file(s) via %s", len(files), client.GetConfig().Provider)
 	uniqueFiles := make(map[string]struct{}, 0)
 	for _, sha256sum := range files {
 		uniqueFiles[string(sha256sum)] = struct{}{}
 	}
-	glog.Infof("Deduplicated %d file(s) to %d unique files", len(files), len(uniqueFiles))
+	logging.Infof("Deduplicated %d file(s) to %d unique files", len(files), len(uniqueFiles))
 
+	found := make([]FoundFile, 0, len(uniqueFiles))
 	for stringSum := range uniqueFiles {
 		sha256sum := []byte(stringSum)
-		// fetch the file
-		f, err := client.GetFile(sha256sum)
+		file, err := fetchFile(client, sha256sum)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to fetch file %x: %s", sha256sum, err)
-		}
-		file := &shade.File{}
-		if err := file.FromJSON(f); err != nil {
-			return nil, nil, fmt.Errorf("Could not unmarshal file %x: %v", sha256sum, err)
+			return nil, nil, err
 		}
+		found = append(found, FoundFile{file, sha256sum})
+	}
+	inUse, obsolete = sortFiles(found)
+	return
+}
+
+// fetchFile retrieves and unmarshals the file object with the given sum.
+func fetchFile(client drive.Client, sha256sum []byte) (*shade.File, error) {
+	f, err := client.GetFile(sha256sum)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch file %x: %s", sha256sum, err)
+	}
+	file := &shade.File{}
+	if err := file.FromJSON(f); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal file %x: %v", sha256sum, err)
+	}
+	return file, nil
+}
+
+// sortFiles sorts the provided files into the newest version of each
+// Filename, which are inUse, and the older versions, which are obsolete.
+func sortFiles(found []FoundFile) (inUse, obsolete []FoundFile) {
+	filesByPath := make(map[string]FoundFile)
+	obsolete = make([]FoundFile, 0)
+	for _, ff := range found {
+		file, sha256sum := ff.file, ff.sum
 		existing, ok := filesByPath[file.Filename]
 		if !ok {
-			glog.V(4).Infof("found new file for %s at %x", file.Filename, sha256sum)
-			filesByPath[file.Filename] = FoundFile{file, sha256sum}
+			logging.V(4).Infof("found new file for %s at %x", file.Filename, sha256sum)
+			filesByPath[file.Filename] = ff
 			continue
 		}
 
 		if existing.file.ModifiedTime.After(file.ModifiedTime) {
-			glog.V(4).Infof("found obsolete file for %s (%x): %d < %d", file.Filename, sha256sum, existing.file.ModifiedTime.Unix(), file.ModifiedTime.Unix())
-			obsolete = append(obsolete, FoundFile{file, sha256sum})
+			logging.V(4).Infof("found obsolete file for %s (%x): %d < %d", file.Filename, sha256sum, existing.file.ModifiedTime.Unix(), file.ModifiedTime.Unix())
+			obsolete = append(obsolete, ff)
 			continue
 		}
-		filesByPath[file.Filename] = FoundFile{file, sha256sum}
-		glog.V(4).Infof("file obsoleted existing file %s (%x): %d > %d", file.Filename, existing.sum, existing.file.ModifiedTime.Unix(), file.ModifiedTime.Unix())
-		obsolete = append(obsolete, FoundFile{existing.file, existing.sum})
+		filesByPath[file.Filename] = ff
+		logging.V(4).Infof("file obsoleted existing file %s (%x): %d > %d", file.Filename, existing.sum, existing.file.ModifiedTime.Unix(), file.ModifiedTime.Unix())
+		obsolete = append(obsolete, existing)
 	}
 	inUse = make([]FoundFile, 0, len(filesByPath))
 	for _, ff := range filesByPath {
@@ -78,90 +107,197 @@ func FetchFiles(client drive.Client) (inUse, obsolete []FoundFile, err error) {
 }
 
 // Cleanup attempts to remove obsolete files and unused chunks from persistent
-// storage clients.
+// storage clients.  If --since is set, the files are fetched incrementally
+// using the state recorded by previous runs; see FetchFilesSince.  Pinned
+// versions are kept, as if they were in use; see Pin.  The exclusive
+// repository lock is held throughout; see lockRepository.
 func Cleanup(client drive.Client) error {
-	inUse, obsolete, err := FetchFiles(client)
+	lock, err := lockRepository(client)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	var st *State
+	var inUse, obsolete []FoundFile
+	if *since != "" {
+		if st, err = ReadState(*since); err != nil {
+			logging.Warning(err)
+			return err
+		}
+		inUse, obsolete, err = FetchFilesSince(client, st)
+	} else {
+		inUse, obsolete, err = FetchFiles(client)
+	}
+	if err == nil {
+		inUse, obsolete, err = excludePinned(client, inUse, obsolete)
+	}
 	if err != nil {
-		glog.Warning(err)
+		logging.Warning(err)
 		return err
 	}
 	niu := len(inUse)
 	no := len(obsolete)
 	if niu < no && !*deleteMostFiles {
 		err := fmt.Errorf("more files are obsolete (%d) than remain (%d); aborting (bypass with --deleteMostFiles)", no, niu)
-		glog.Warning(err.Error())
+		logging.Warning(err.Error())
 		return err
 	}
 	if no > *maxFilesDelete {
 		err := fmt.Errorf("num obsolete files (%d) over safety threshold (%d)", no, maxFilesDelete)
-		glog.Warning(err.Error())
+		logging.Warning(err.Error())
 		return err
 	}
+	var failedFiles int
+	released := make(map[string]bool)
 	for _, ff := range obsolete {
-		glog.Infof("Releasing obsolete file: %s (%s %x)", ff.file.Filename, ff.file.ModifiedTime, ff.sum)
+		logging.Infof("Releasing obsolete file: %s (%s %x)", ff.file.Filename, ff.file.ModifiedTime, ff.sum)
 		if *dryRun {
 			fmt.Printf("Releasing obsolete file: %s (%s %x)\n", ff.file.Filename, ff.file.ModifiedTime, ff.sum)
+		} else if err := client.ReleaseFile(ff.sum); err != nil {
+			logging.Warningf("could not release obsolete file %s (%x): %s", ff.file.Filename, ff.sum, err)
+			failedFiles++
 		} else {
-			client.ReleaseFile(ff.sum)
+			released[string(ff.sum)] = true
 		}
 	}
 
-	// Build the map of all the chunksInUse
-	chunksInUse := make(map[string]struct{})
-	for _, ff := range inUse {
-		for _, chunk := range ff.file.Chunks {
-			chunksInUse[string(chunk.Sha256)] = struct{}{}
-		}
-		esums, err := encrypt.GetAllEncryptedSums(ff.file)
-		if err != nil {
-			summary := fmt.Sprintf("could not get encrypted sums for %s: %d", ff.file.Filename, len(esums))
-			glog.Warningf("%s: %s", summary, err)
-			return fmt.Errorf("%s: %s", summary, err)
+	inUseChunks, err := chunksInUse(client, inUse, st)
+	if err != nil {
+		return err
+	}
+	failedChunks, err := cleanupUnusedFiles(client, inUseChunks)
+	if err != nil {
+		return err
+	}
+	if st != nil && !*dryRun {
+		// Files which could not be released remain in the state, so they are
+		// identified as obsolete again by the next run.
+		for _, ff := range obsolete {
+			if released[string(ff.sum)] {
+				delete(st.Files, hex.EncodeToString(ff.sum))
+			}
 		}
-		glog.V(4).Infof("encrypted sums for %s: %d", ff.file.Filename, len(esums))
-		for _, s := range esums {
-			glog.V(7).Infof("valid encrypted sum: %x", s)
-			chunksInUse[string(s)] = struct{}{}
+		st.HighWater = time.Now()
+		if err := st.Write(*since); err != nil {
+			logging.Warning(err)
+			return err
 		}
 	}
-
-	if err := cleanupUnusedFiles(client, chunksInUse); err != nil {
+	if failedFiles > 0 || failedChunks > 0 {
+		err := fmt.Errorf("could not release %d obsolete file(s) and %d unused chunk(s)", failedFiles, failedChunks)
+		logging.Warning(err.Error())
 		return err
 	}
 	return nil
 }
 
-func cleanupUnusedFiles(client drive.Client, chunksInUse map[string]struct{}) error {
-	var unusedChunks [][]byte
+// lockRepository acquires the exclusive lock in the LockDir of the client's
+// config, so that no files are written while the chunks in use are computed
+// and the rest are released.
+func lockRepository(client drive.Client) (*repolock.Lock, error) {
+	lock, err := repolock.New(client.GetConfig().LockDir).Exclusive()
+	if err != nil {
+		err = fmt.Errorf("could not lock the repository: %s", err)
+		logging.Warning(err)
+		return nil, err
+	}
+	return lock, nil
+}
+
+// chunkSums returns the sums of all of the chunks referenced by f, both as
+// plaintext and as they would be stored by an encrypted client.  c is the
+// config of the client the repository is read through; the sums of any
+// "encrypt" client in it are computed in the mode it is configured in.
+func chunkSums(c drive.Config, f *shade.File) ([][]byte, error) {
+	var sums [][]byte
+	for _, chunk := range f.Chunks {
+		sums = append(sums, chunk.Sha256)
+	}
+	esums, err := encrypt.GetAllEncryptedSums(f)
+	if err != nil {
+		summary := fmt.Sprintf("could not get encrypted sums for %s: %d", f.Filename, len(esums))
+		logging.Warningf("%s: %s", summary, err)
+		return nil, fmt.Errorf("%s: %s", summary, err)
+	}
+	ssums, err := encrypt.StoredChunkSums(c, f)
+	if err != nil {
+		err = fmt.Errorf("could not get the stored sums of the chunks of %s: %s", f.Filename, err)
+		logging.Warning(err)
+		return nil, err
+	}
+	logging.V(4).Infof("encrypted sums for %s: %d", f.Filename, len(esums)+len(ssums))
+	return append(append(sums, esums...), ssums...), nil
+}
+
+// chunksInUse returns the set of the sums of the chunks referenced by the
+// files in inUse, read through client.  If st is not nil, the sums recorded in
+// it are used, rather than computing the encrypted sums of each file again.
+func chunksInUse(client drive.Client, inUse []FoundFile, st *State) (map[string]struct{}, error) {
+	inUseChunks := make(map[string]struct{})
+	for _, ff := range inUse {
+		var sums [][]byte
+		if st != nil {
+			sums = st.Files[hex.EncodeToString(ff.sum)].Chunks
+		} else {
+			var err error
+			if sums, err = chunkSums(client.GetConfig(), ff.file); err != nil {
+				return nil, err
+			}
+		}
+		for _, s := range sums {
+			logging.V(7).Infof("valid chunk sum: %x", s)
+			inUseChunks[string(s)] = struct{}{}
+		}
+	}
+	return inUseChunks, nil
+}
+
+// unusedChunks returns the sums of the chunks known to client which are not
+// in inUseChunks.
+func unusedChunks(client drive.Client, inUseChunks map[string]struct{}) ([][]byte, error) {
+	var unused [][]byte
 	lister := client.NewChunkLister()
 	for lister.Next() {
 		csum := lister.Sha256()
-		if _, ok := chunksInUse[string(csum)]; !ok {
-			glog.V(3).Infof("chunk is obsolete: %x", csum)
-			unusedChunks = append(unusedChunks, csum)
+		if _, ok := inUseChunks[string(csum)]; !ok {
+			logging.V(3).Infof("chunk is obsolete: %x", csum)
+			unused = append(unused, csum)
 			continue
 		}
-		glog.V(3).Infof("chunk is in use: %x", csum)
+		logging.V(3).Infof("chunk is in use: %x", csum)
 	}
 	if err := lister.Err(); err != nil {
-		return err
+		return nil, err
 	}
-	uc := len(unusedChunks)
-	glog.V(2).Infof("Identified %d unused chunks", uc)
+	return unused, nil
+}
+
+// cleanupUnusedFiles releases the chunks known to client which are not in
+// inUseChunks.  It returns the number of chunks which could not be released.
+func cleanupUnusedFiles(client drive.Client, inUseChunks map[string]struct{}) (int, error) {
+	unused, err := unusedChunks(client, inUseChunks)
+	if err != nil {
+		return 0, err
+	}
+	uc := len(unused)
+	logging.V(2).Infof("Identified %d unused chunks", uc)
 	if uc >= *maxChunksDelete {
 		err := fmt.Errorf("num unused chunks (%d) over safety threshold (%d)", uc, *maxChunksDelete)
-		glog.Warning(err.Error())
-		return err
+		logging.Warning(err.Error())
+		return 0, err
 	}
-	for _, csum := range unusedChunks {
-		glog.V(2).Infof("Releasing unreferenced chunk: %x", csum)
+	var failed int
+	for _, csum := range unused {
+		logging.V(2).Infof("Releasing unreferenced chunk: %x", csum)
 		if *dryRun {
 			fmt.Printf("Releasing unreferenced chunk: %x\n", csum)
-		} else {
-			client.ReleaseChunk(csum)
+		} else if err := client.ReleaseChunk(csum); err != nil {
+			logging.Warningf("could not release unreferenced chunk %x: %s", csum, err)
+			failed++
 		}
 	}
-	return nil
+	return failed, nil
 }
 
 // CleanupLoop calls Cleanup once per hour
@@ -5,9 +5,12 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"path"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -17,6 +20,7 @@ import (
 	"github.com/asjoyner/shade/drive/compare"
 	"github.com/asjoyner/shade/drive/encrypt"
 	"github.com/asjoyner/shade/drive/memory"
+	"github.com/asjoyner/shade/repolock"
 )
 
 const chunkSize uint64 = 100 * 256
@@ -289,6 +293,149 @@ func TestEncryptedClients(t *testing.T) {
 	}
 }
 
+// TestConvergentCleanup checks that Cleanup keeps the chunks of an in-use
+// file stored by a convergent encrypt client, whose stored sums are derived
+// from the ConvergentKey rather than the file.
+func TestConvergentCleanup(t *testing.T) {
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privkey)}
+	client, err := encrypt.NewClient(drive.Config{
+		Provider:      "encrypt",
+		RsaPrivateKey: string(pem.EncodeToMemory(b)),
+		ConvergentKey: hex.EncodeToString(shade.NewSymmetricKey()[:]),
+		Children:      []drive.Config{{Provider: "memory", Write: true}},
+	})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+
+	file := shade.NewFile("testfile")
+	file.LastChunksize = int(chunkSize)
+	contents := make(map[int][]byte)
+	for x := 0; x < 4; x++ {
+		sum, data := drive.RandChunk()
+		chunk := shade.NewChunk()
+		chunk.Index = x
+		chunk.Sha256 = []byte(sum)
+		file.Chunks = append(file.Chunks, chunk)
+		contents[x] = data
+		if err := client.PutChunk(sum, data, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putFile(t, client, *file)
+
+	if err := Cleanup(client); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chunk := range file.Chunks {
+		data, err := client.GetChunk(chunk.Sha256, file)
+		if err != nil {
+			t.Errorf("reading chunk %d after Cleanup: %s", chunk.Index, err)
+			continue
+		}
+		if !bytes.Equal(data, contents[chunk.Index]) {
+			t.Errorf("chunk %d changed after Cleanup", chunk.Index)
+		}
+	}
+}
+
+// unreleasableClient fails every call to ReleaseChunk.
+type unreleasableClient struct {
+	drive.Client
+}
+
+func (c *unreleasableClient) ReleaseChunk(sha256sum []byte) error {
+	return fmt.Errorf("could not release %x", sha256sum)
+}
+
+// TestReleaseFailuresAreReported ensures Cleanup returns an error, after
+// releasing what it can, when a chunk can not be released.
+func TestReleaseFailuresAreReported(t *testing.T) {
+	mc := &unreleasableClient{newMemoryClient(t)}
+	sum, data := drive.RandChunk()
+	if err := mc.PutChunk(sum, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := Cleanup(mc); err == nil {
+		t.Error("Cleanup succeeded despite failing to release a chunk")
+	}
+}
+
+// countingClient counts the calls to GetFile.
+type countingClient struct {
+	drive.Client
+	getFiles int
+}
+
+func (c *countingClient) GetFile(sha256sum []byte) ([]byte, error) {
+	c.getFiles++
+	return c.Client.GetFile(sha256sum)
+}
+
+func TestFetchingFilesSince(t *testing.T) {
+	mc := &countingClient{Client: newMemoryClient(t)}
+	st, err := ReadState(path.Join(t.TempDir(), "doesnotexist"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := shade.NewFile("testfile")
+	putFile(t, mc, *file)
+	other := shade.NewFile("otherfile")
+	putFile(t, mc, *other)
+
+	inUse, obsolete, err := FetchFilesSince(mc, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inUse) != 2 || len(obsolete) != 0 {
+		t.Errorf("first run, want: 2 in use, 0 obsolete, got: %d, %d", len(inUse), len(obsolete))
+	}
+	if mc.getFiles != 2 {
+		t.Errorf("first run, want: 2 fetches, got: %d", mc.getFiles)
+	}
+
+	// Push a version of the file with a newer mtime, the cached version of the
+	// file must now be considered obsolete.
+	stateFile := path.Join(t.TempDir(), "state")
+	if err := st.Write(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if st, err = ReadState(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	jm, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSum := shade.Sum(jm)
+	file.ModifiedTime = file.ModifiedTime.Add(1 * time.Minute)
+	putFile(t, mc, *file)
+
+	mc.getFiles = 0
+	inUse, obsolete, err = FetchFilesSince(mc, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.getFiles != 1 {
+		t.Errorf("second run, want: 1 fetch, got: %d", mc.getFiles)
+	}
+	if len(inUse) != 2 {
+		t.Errorf("second run, in use files unexpected, want: 2, got %d", len(inUse))
+	}
+	if len(obsolete) != 1 {
+		t.Fatalf("second run, obsolete files unexpected, want: 1, got %d", len(obsolete))
+	}
+	if !bytes.Equal(obsolete[0].sum, oldSum) {
+		t.Errorf("wrong file found obsolete, want: %x, got: %x", oldSum, obsolete[0].sum)
+	}
+}
+
 // putFile wraps up the boilerplate to push a snapshot of a file into a given
 // client.  It calls t.Fatalf if it encounters any unexpected errors.
 func putFile(t *testing.T, client drive.Client, file shade.File) {
@@ -317,3 +464,489 @@ func deltaErrors(t *testing.T, expectedExtras, testClientExtras compare.Delta) {
 		t.Errorf("in-use chunk was deleted: %x", sum)
 	}
 }
+
+func TestCompact(t *testing.T) {
+	mc := newMemoryClient(t)
+
+	// Each version of the file has a chunk of its own, and one they share.
+	shared, sharedData := drive.RandChunk()
+	var versions []shade.File
+	var own [][]byte
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		file := shade.NewFile("hot")
+		file.ModifiedTime = now.Add(time.Duration(i-10) * time.Minute)
+		sum, data := drive.RandChunk()
+		for j, s := range [][]byte{shared, sum} {
+			chunk := shade.NewChunk()
+			chunk.Index = j
+			chunk.Sha256 = s
+			file.Chunks = append(file.Chunks, chunk)
+		}
+		for s, d := range map[string][]byte{string(shared): sharedData, string(sum): data} {
+			if err := mc.PutChunk([]byte(s), d, file); err != nil {
+				t.Fatal(err)
+			}
+		}
+		putFile(t, mc, *file)
+		versions = append(versions, *file)
+		own = append(own, sum)
+	}
+	// An unrelated file with a single version is untouched.
+	cold := shade.NewFile("cold")
+	putFile(t, mc, *cold)
+
+	if err := Compact(mc, 0); err == nil {
+		t.Error("Compact(0) succeeded, want an error")
+	}
+	if err := Compact(mc, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	inUse, obsolete, err := FetchFiles(mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inUse) != 2 || len(obsolete) != 2 {
+		t.Errorf("want 2 files in use and 2 obsolete, got: %d and %d", len(inUse), len(obsolete))
+	}
+	for _, ff := range obsolete {
+		if ff.File().Filename != "hot" || ff.File().ModifiedTime.Before(versions[7].ModifiedTime) {
+			t.Errorf("unexpected version retained: %s at %s", ff.File().Filename, ff.File().ModifiedTime)
+		}
+	}
+	if _, err := mc.GetChunk(shared, nil); err != nil {
+		t.Errorf("the shared chunk was released: %s", err)
+	}
+	for i, sum := range own {
+		_, err := mc.GetChunk(sum, nil)
+		if i < 7 && err == nil {
+			t.Errorf("the chunk of expired version %d was not released", i)
+		}
+		if i >= 7 && err != nil {
+			t.Errorf("the chunk of retained version %d was released: %s", i, err)
+		}
+	}
+}
+
+func TestPinnedVersionsSurviveCleanup(t *testing.T) {
+	mc := newMemoryClient(t)
+
+	// Two versions of a file, each with a chunk of its own.
+	var sums [][]byte
+	var fileSums [][]byte
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		file := shade.NewFile("snapshot")
+		file.ModifiedTime = now.Add(time.Duration(i-2) * time.Minute)
+		sum, data := drive.RandChunk()
+		chunk := shade.NewChunk()
+		chunk.Sha256 = sum
+		file.Chunks = append(file.Chunks, chunk)
+		if err := mc.PutChunk(sum, data, file); err != nil {
+			t.Fatal(err)
+		}
+		putFile(t, mc, *file)
+		fj, err := file.ToJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums = append(sums, sum)
+		fileSums = append(fileSums, shade.Sum(fj))
+	}
+	// Enough other files to satisfy the safety threshold.
+	for i := 0; i < 3; i++ {
+		putFile(t, mc, *shade.NewFile(fmt.Sprintf("other%d", i)))
+	}
+
+	if err := Pin(mc, fileSums[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := Cleanup(mc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mc.GetFile(fileSums[0]); err != nil {
+		t.Errorf("the pinned version was released: %s", err)
+	}
+	if _, err := mc.GetChunk(sums[0], nil); err != nil {
+		t.Errorf("the chunk of the pinned version was released: %s", err)
+	}
+
+	// Once unpinned, the next cleanup releases them.
+	if err := Unpin(mc, fileSums[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := Cleanup(mc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mc.GetFile(fileSums[0]); err == nil {
+		t.Error("the unpinned version was not released")
+	}
+	if _, err := mc.GetChunk(sums[0], nil); err == nil {
+		t.Error("the chunk of the unpinned version was not released")
+	}
+	if _, err := mc.GetChunk(sums[1], nil); err != nil {
+		t.Errorf("the chunk of the current version was released: %s", err)
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	mc := newMemoryClient(t)
+
+	// An old version of a file, whose chunk is orphaned by the current version,
+	// and a few chunks no file references.
+	var inUse, orphaned [][]byte
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		file := shade.NewFile("versioned")
+		file.ModifiedTime = now.Add(time.Duration(i-2) * time.Minute)
+		sum, data := drive.RandChunk()
+		chunk := shade.NewChunk()
+		chunk.Sha256 = sum
+		file.Chunks = append(file.Chunks, chunk)
+		if err := mc.PutChunk(sum, data, file); err != nil {
+			t.Fatal(err)
+		}
+		putFile(t, mc, *file)
+		if i == 0 {
+			orphaned = append(orphaned, sum)
+		} else {
+			inUse = append(inUse, sum)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		sum, data := drive.RandChunk()
+		if err := mc.PutChunk(sum, data, nil); err != nil {
+			t.Fatal(err)
+		}
+		orphaned = append(orphaned, sum)
+	}
+
+	orphans, err := FindOrphans(mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, o := range orphans {
+		got[string(o.Sha256)] = true
+		if o.Size <= 0 {
+			t.Errorf("orphan %x has size %d", o.Sha256, o.Size)
+		}
+	}
+	want := make(map[string]bool)
+	for _, sum := range orphaned {
+		want[string(sum)] = true
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindOrphans returned %d chunks, want the %d unreferenced chunks", len(got), len(want))
+	}
+
+	// Once the orphans are released, only the chunk in use remains.
+	var sums [][]byte
+	for _, o := range orphans {
+		sums = append(sums, o.Sha256)
+	}
+	released, failed, err := ReleaseOrphans(mc, sums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released != len(orphaned) || failed != 0 {
+		t.Errorf("ReleaseOrphans released %d and failed %d, want %d and 0", released, failed, len(orphaned))
+	}
+	for _, sum := range orphaned {
+		if _, err := mc.GetChunk(sum, nil); err == nil {
+			t.Errorf("orphan %x was not released", sum)
+		}
+	}
+	if _, err := mc.GetChunk(inUse[0], nil); err != nil {
+		t.Errorf("the chunk in use was released: %s", err)
+	}
+}
+
+// An orphan which is referenced before ReleaseOrphans is called is kept.
+func TestReleaseOrphansKeepsReferenced(t *testing.T) {
+	mc := newMemoryClient(t)
+	sum, data := drive.RandChunk()
+	if err := mc.PutChunk(sum, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	orphans, err := FindOrphans(mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 {
+		t.Fatalf("FindOrphans returned %d chunks, want 1", len(orphans))
+	}
+
+	file := shade.NewFile("late")
+	chunk := shade.NewChunk()
+	chunk.Sha256 = sum
+	file.Chunks = append(file.Chunks, chunk)
+	putFile(t, mc, *file)
+
+	released, failed, err := ReleaseOrphans(mc, [][]byte{orphans[0].Sha256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released != 0 || failed != 0 {
+		t.Errorf("ReleaseOrphans released %d and failed %d, want 0 and 0", released, failed)
+	}
+	if _, err := mc.GetChunk(sum, nil); err != nil {
+		t.Errorf("the newly referenced chunk was released: %s", err)
+	}
+}
+
+// racingClient starts write when Cleanup begins listing chunks, after it has
+// computed the chunks in use, and gives it a moment to store its chunk.
+type racingClient struct {
+	drive.Client
+	write func()
+}
+
+func (c *racingClient) NewChunkLister() drive.ChunkLister {
+	stored := make(chan struct{})
+	go func() {
+		c.write()
+		close(stored)
+	}()
+	select {
+	case <-stored:
+	case <-time.After(500 * time.Millisecond):
+	}
+	return c.Client.NewChunkLister()
+}
+
+// TestLockSerializesWritesWithCleanup ensures a file written while Cleanup
+// runs keeps its chunk, because the writer waits for the repository lock.
+func TestLockSerializesWritesWithCleanup(t *testing.T) {
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", LockDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("could not initilize test client: %s", err)
+	}
+	// Enough files to satisfy the safety threshold.
+	for i := 0; i < 3; i++ {
+		putFile(t, mc, *shade.NewFile(fmt.Sprintf("other%d", i)))
+	}
+
+	sum, data := drive.RandChunk()
+	file := shade.NewFile("new")
+	chunk := shade.NewChunk()
+	chunk.Sha256 = sum
+	file.Chunks = append(file.Chunks, chunk)
+	written := make(chan error, 1)
+	rc := &racingClient{Client: mc, write: func() {
+		lock, err := repolock.New(mc.GetConfig().LockDir).Shared()
+		if err != nil {
+			written <- err
+			return
+		}
+		defer lock.Unlock()
+		if err := mc.PutChunk(sum, data, file); err != nil {
+			written <- err
+			return
+		}
+		fj, err := file.ToJSON()
+		if err != nil {
+			written <- err
+			return
+		}
+		written <- mc.PutFile(shade.Sum(fj), fj)
+	}}
+
+	if err := Cleanup(rc); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mc.GetChunk(sum, nil); err != nil {
+		t.Errorf("the chunk of the file written during Cleanup was released: %s", err)
+	}
+}
+
+// TestParams confirms that the first tool to write to a repository records
+// its defaults, and that a second tool uses them rather than its own.
+func TestParams(t *testing.T) {
+	defer shade.SetParams(shade.DefaultParams())
+	mc, err := memory.NewClient(drive.Config{Provider: "memory", Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := shade.Params{Chunksize: 1000, SumAlgorithm: shade.SHA512_256, Cipher: shade.NoCipher}
+	if err := shade.SetParams(first); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := FetchParams(mc); err != nil || p != first {
+		t.Fatalf("FetchParams() of a repository without params, want: %+v, got: %+v (%v)", first, p, err)
+	}
+
+	// The second tool was invoked with other defaults.
+	if err := shade.SetParams(shade.Params{Chunksize: 2000, SumAlgorithm: shade.SHA256, Cipher: shade.AESGCM}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := FetchParams(mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != first {
+		t.Errorf("FetchParams(), want the repository's params %+v, got: %+v", first, p)
+	}
+	f := shade.NewFile("new")
+	if f.Chunksize != 1000 || f.SumAlgorithm != shade.SHA512_256 || f.AesKey != nil {
+		t.Errorf("NewFile() did not inherit the repository's params, got: %s", f)
+	}
+	files, err := mc.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("the params were recorded in %d files, want 1", len(files))
+	}
+
+	// A client which can't write uses its own defaults, without recording them.
+	ro := newMemoryClient(t)
+	if _, err := FetchParams(ro); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ro.ListFiles(); len(files) != 0 {
+		t.Errorf("the params were recorded by a client which can't write")
+	}
+}
+
+// unlistedClient only lists the files which were put through it, as if the
+// listing of the underlying client had been lost.
+type unlistedClient struct {
+	drive.Client
+	listed map[string]bool
+}
+
+func (c *unlistedClient) ListFiles() ([][]byte, error) {
+	files, err := c.Client.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	var listed [][]byte
+	for _, sum := range files {
+		if c.listed[string(sum)] {
+			listed = append(listed, sum)
+		}
+	}
+	return listed, nil
+}
+
+func (c *unlistedClient) PutFile(sha256sum, f []byte) error {
+	c.listed[string(sha256sum)] = true
+	return c.Client.PutFile(sha256sum, f)
+}
+
+func TestSnapshot(t *testing.T) {
+	mc := newMemoryClient(t)
+	now := time.Now().Add(-time.Hour)
+	for i := 0; i < 4; i++ {
+		file := shade.NewFile(fmt.Sprintf("file%d", i))
+		file.ModifiedTime = now
+		putFile(t, mc, *file)
+	}
+	before, _, err := FetchFiles(mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := TakeSnapshot(mc)
+	if err != nil {
+		t.Fatalf("TakeSnapshot(): %s", err)
+	}
+	s, err := ReadSnapshot(mc, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Files) != len(before) {
+		t.Errorf("snapshot lists %d files, want: %d", len(s.Files), len(before))
+	}
+
+	// A newer version of a file does not release the one in the snapshot.
+	file := shade.NewFile("file0")
+	putFile(t, mc, *file)
+	if err := Cleanup(mc); err != nil {
+		t.Fatal(err)
+	}
+	for _, ff := range before {
+		if _, err := mc.GetFile(ff.sum); err != nil {
+			t.Errorf("the version of %s in the snapshot was released: %s", ff.file.Filename, err)
+		}
+	}
+
+	// Reconstruct the files from the snapshot alone.
+	uc := &unlistedClient{Client: mc, listed: make(map[string]bool)}
+	n, err := RestoreSnapshot(uc, sum)
+	if err != nil {
+		t.Fatalf("RestoreSnapshot(): %s", err)
+	}
+	if n != len(before)+1 {
+		t.Errorf("RestoreSnapshot() restored %d files, want: %d", n, len(before)+1)
+	}
+	after, _, err := FetchFiles(uc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	for _, ff := range before {
+		want[ff.file.Filename] = string(ff.sum)
+	}
+	var snapshots int
+	for _, ff := range after {
+		if isSnapshot(ff.file.Filename) {
+			snapshots++
+			continue
+		}
+		if want[ff.file.Filename] != string(ff.sum) {
+			t.Errorf("restored %s (%x) which is not in the snapshot", ff.file.Filename, ff.sum)
+		}
+		delete(want, ff.file.Filename)
+	}
+	if len(want) != 0 || snapshots != 1 {
+		t.Errorf("files missing after restore: %v, snapshots: %d", want, snapshots)
+	}
+}
+
+// TestCleanupSinceAfterUnpinningAll deletes the pins file, then runs Cleanup
+// with --since twice, so the second run finds the deletion in the state
+// rather than fetching it.
+func TestCleanupSinceAfterUnpinningAll(t *testing.T) {
+	defer func(s string) { *since = s }(*since)
+	*since = path.Join(t.TempDir(), "state")
+	mc := newMemoryClient(t)
+
+	pinned := shade.NewFile("pinned")
+	pinned.ModifiedTime = time.Now().Add(-2 * time.Minute)
+	putFile(t, mc, *pinned)
+	fj, err := pinned.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinnedSum := shade.Sum(fj)
+	newer := shade.NewFile("pinned")
+	newer.ModifiedTime = time.Now().Add(-time.Minute)
+	putFile(t, mc, *newer)
+	for i := 0; i < 3; i++ {
+		putFile(t, mc, *shade.NewFile(fmt.Sprintf("other%d", i)))
+	}
+	if err := Pin(mc, pinnedSum); err != nil {
+		t.Fatal(err)
+	}
+	if err := Cleanup(mc); err != nil {
+		t.Fatal(err)
+	}
+
+	unpinned := shade.NewFile(PinsFilename)
+	unpinned.Deleted = true
+	putFile(t, mc, *unpinned)
+	for i := 0; i < 2; i++ {
+		if err := Cleanup(mc); err != nil {
+			t.Fatalf("Cleanup %d after deleting the pins: %s", i+1, err)
+		}
+	}
+	if _, err := mc.GetFile(pinnedSum); err == nil {
+		t.Error("the version which is no longer pinned was not released")
+	}
+}
@@ -1,10 +1,11 @@
 package shade
 
 import (
-	"log"
 	"os"
 	"path"
 	"runtime"
+
+	"github.com/asjoyner/shade/logging"
 )
 
 var (
@@ -23,7 +24,7 @@ func ConfigDir() string {
 	case "linux", "freebsd":
 		dir = path.Join(envFunc("HOME"), ".shade")
 	default:
-		log.Printf("TODO: ConfigDir on GOOS %q", goos)
+		logging.Warningf("TODO: ConfigDir on GOOS %q", goos)
 	}
 	return dir
 }